@@ -0,0 +1,623 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Corporate accounts are organizations repaired for under a contract. A
+// ticket belongs to one when account_id is given at intake; warranty and
+// split tickets keep their original's account. Before a renewal the owner
+// reviews each account's health score at /api/v1/accounts/health: a 0-100
+// blend of the ticket volume trend against the previous period of the same
+// length, SLA compliance, how promptly invoices were paid within the
+// account's payment terms, and the satisfaction ratings staff recorded when
+// the account's devices were collected. A part with no data in the period is
+// left out of the blend rather than counted as zero.
+
+const corporateAccountsTable = `
+	CREATE TABLE IF NOT EXISTS corporate_accounts (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		contact_name VARCHAR(255) NULL,
+		contact_email VARCHAR(255) NULL,
+		contract_reference VARCHAR(100) NULL,
+		contract_start DATE NULL,
+		contract_end DATE NULL,
+		payment_terms_days INT NOT NULL DEFAULT 30,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uniq_corporate_accounts_name (name)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const ticketRatingsTable = `
+	CREATE TABLE IF NOT EXISTS ticket_ratings (
+		order_id VARCHAR(50) PRIMARY KEY,
+		score TINYINT NOT NULL,
+		comment VARCHAR(1000) NULL,
+		recorded_by VARCHAR(50) NULL,
+		recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ticket_ratings_recorded (recorded_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Weights of the parts of an account's health score
+const (
+	healthWeightVolume       = 20
+	healthWeightSLA          = 30
+	healthWeightPayments     = 25
+	healthWeightSatisfaction = 25
+)
+
+// Health bands by score
+const (
+	HealthHealthy = "healthy" // 75 and over
+	HealthWatch   = "watch"   // 50 to 74
+	HealthAtRisk  = "at_risk"
+	HealthNoData  = "no_data"
+)
+
+var errAccountExists = errors.New("an account with this name already exists")
+
+// CorporateAccount is an organization on a contract.
+type CorporateAccount struct {
+	ID                int64      `json:"id"`
+	Name              string     `json:"name"`
+	ContactName       string     `json:"contact_name,omitempty"`
+	ContactEmail      string     `json:"contact_email,omitempty"`
+	ContractReference string     `json:"contract_reference,omitempty"`
+	ContractStart     *time.Time `json:"contract_start,omitempty"`
+	ContractEnd       *time.Time `json:"contract_end,omitempty"` // Renewal date
+	PaymentTermsDays  int        `json:"payment_terms_days"`     // Days after Ready for Delivery an invoice is due
+	ResponseHours     *int       `json:"response_hours"`         // Committed time to start work (contractsla.go)
+	ResolutionHours   *int       `json:"resolution_hours"`       // Committed time to Ready for Delivery
+	CreatedBy         string     `json:"created_by,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// AccountHealth is an account's health score over a period with the figures
+// behind each part of it. Scores are nil where there was nothing to measure.
+type AccountHealth struct {
+	AccountID    int64               `json:"account_id"`
+	Name         string              `json:"name"`
+	ContractEnd  *time.Time          `json:"contract_end,omitempty"`
+	Period       ReportRange         `json:"period"`
+	Score        *int                `json:"score"`
+	Band         string              `json:"band"`
+	Volume       AccountVolume       `json:"volume"`
+	SLA          AccountSLA          `json:"sla"`
+	Payments     AccountPayments     `json:"payments"`
+	Satisfaction AccountSatisfaction `json:"satisfaction"`
+}
+
+// AccountVolume compares the tickets booked in the period with the period
+// before it. A falling volume lowers the score: the account is using the
+// contract less.
+type AccountVolume struct {
+	Tickets         int      `json:"tickets"`
+	PreviousTickets int      `json:"previous_tickets"`
+	TrendPercent    *float64 `json:"trend_percent"`
+	Score           *int     `json:"score"`
+}
+
+// AccountSLA counts the period's tickets whose SLA has been decided: met by
+// reaching Ready for Delivery in time, or breached.
+type AccountSLA struct {
+	Tickets           int      `json:"tickets"`
+	Breached          int      `json:"breached"`
+	CompliancePercent *float64 `json:"compliance_percent"`
+	Score             *int     `json:"score"`
+}
+
+// AccountPayments measures invoices from Ready for Delivery to the last
+// payment. Invoices not yet due are left out until paid.
+type AccountPayments struct {
+	Invoices         int      `json:"invoices"`
+	PaidOnTime       int      `json:"paid_on_time"`
+	PaidLate         int      `json:"paid_late"`
+	Overdue          int      `json:"overdue"` // Unpaid past the payment terms
+	AverageDaysToPay *float64 `json:"average_days_to_pay"`
+	Score            *int     `json:"score"`
+}
+
+// AccountSatisfaction averages the 1-5 ratings recorded in the period.
+type AccountSatisfaction struct {
+	Ratings int      `json:"ratings"`
+	Average *float64 `json:"average"`
+	Score   *int     `json:"score"`
+}
+
+// AccountService handles corporate accounts and ticket ratings
+type AccountService struct {
+	db *sql.DB
+}
+
+func NewAccountService(database *sql.DB) *AccountService {
+	return &AccountService{db: database}
+}
+
+var accountService *AccountService
+
+const accountColumns = `id, name, contact_name, contact_email, contract_reference, contract_start, contract_end,
+	payment_terms_days, response_hours, resolution_hours, created_by, created_at`
+
+func scanAccount(row rowScanner) (*CorporateAccount, error) {
+	account := &CorporateAccount{}
+	var contactName, contactEmail, reference, createdBy sql.NullString
+	var start, end sql.NullTime
+	var responseHours, resolutionHours sql.NullInt64
+	err := row.Scan(&account.ID, &account.Name, &contactName, &contactEmail, &reference, &start, &end,
+		&account.PaymentTermsDays, &responseHours, &resolutionHours, &createdBy, &account.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	account.ContactName, account.ContactEmail = contactName.String, contactEmail.String
+	account.ContractReference, account.CreatedBy = reference.String, createdBy.String
+	account.ContractStart, account.ContractEnd = timePtr(start), timePtr(end)
+	account.ResponseHours, account.ResolutionHours = intPtr(responseHours), intPtr(resolutionHours)
+	return account, nil
+}
+
+func (as *AccountService) GetAccount(id int64) (*CorporateAccount, error) {
+	return scanAccount(as.db.QueryRow(`SELECT `+accountColumns+` FROM corporate_accounts WHERE id = ?`, id))
+}
+
+// List returns every account by name.
+func (as *AccountService) List() ([]CorporateAccount, error) {
+	rows, err := as.db.Query(`SELECT ` + accountColumns + ` FROM corporate_accounts ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []CorporateAccount{}
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, *account)
+	}
+	return accounts, rows.Err()
+}
+
+// Create stores a new account.
+func (as *AccountService) Create(account *CorporateAccount) error {
+	result, err := as.db.Exec(`
+		INSERT INTO corporate_accounts (name, contact_name, contact_email, contract_reference, contract_start,
+		                                contract_end, payment_terms_days, response_hours, resolution_hours, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, account.Name, nullString(account.ContactName), nullString(account.ContactEmail),
+		nullString(account.ContractReference), account.ContractStart, account.ContractEnd,
+		account.PaymentTermsDays, account.ResponseHours, account.ResolutionHours, nullString(account.CreatedBy))
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return errAccountExists
+	}
+	if err != nil {
+		return err
+	}
+	account.ID, err = result.LastInsertId()
+	return err
+}
+
+// checkIntakeAccount validates the account a new ticket is booked under.
+func (as *AccountService) checkIntakeAccount(order *Order, fieldErrors *ValidationErrors) error {
+	if order.AccountID == 0 {
+		return nil
+	}
+	_, err := as.GetAccount(order.AccountID)
+	if err == sql.ErrNoRows {
+		fieldErrors.Add("account_id", "must be an existing account")
+		return nil
+	}
+	return err
+}
+
+// Rate records the customer's 1-5 rating of a collected ticket, replacing
+// any earlier one.
+func (as *AccountService) Rate(orderID string, score int, comment, actorID string) error {
+	var status string
+	var deletedAt sql.NullTime
+	err := as.db.QueryRow(`SELECT status, deleted_at FROM orders WHERE id = ?`, orderID).Scan(&status, &deletedAt)
+	if err != nil {
+		return err
+	}
+	if status != closedStatus || deletedAt.Valid {
+		return &StatusGuardError{Reason: "only a collected ticket can be rated"}
+	}
+	_, err = as.db.Exec(`
+		INSERT INTO ticket_ratings (order_id, score, comment, recorded_by) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE score = VALUES(score), comment = VALUES(comment),
+			recorded_by = VALUES(recorded_by), recorded_at = CURRENT_TIMESTAMP
+	`, orderID, score, nullString(comment), nullString(actorID))
+	return err
+}
+
+// Health scores one account over period.
+func (as *AccountService) Health(account *CorporateAccount, period ReportRange) (*AccountHealth, error) {
+	health := &AccountHealth{AccountID: account.ID, Name: account.Name, ContractEnd: account.ContractEnd, Period: period}
+	previous := ReportRange{From: period.From.Add(-period.To.Sub(period.From)), To: period.From}
+	now := time.Now()
+
+	// Volume
+	for _, count := range []struct {
+		period ReportRange
+		into   *int
+	}{{period, &health.Volume.Tickets}, {previous, &health.Volume.PreviousTickets}} {
+		err := as.db.QueryRow(`
+			SELECT COUNT(*) FROM orders
+			WHERE account_id = ? AND deleted_at IS NULL AND created_at >= ? AND created_at < ?
+		`, account.ID, count.period.From, count.period.To).Scan(count.into)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case health.Volume.PreviousTickets > 0:
+		trend := roundTenth(100 * float64(health.Volume.Tickets-health.Volume.PreviousTickets) / float64(health.Volume.PreviousTickets))
+		health.Volume.TrendPercent = &trend
+		health.Volume.Score = healthScore(100 + trend)
+	case health.Volume.Tickets > 0:
+		health.Volume.Score = healthScore(100)
+	}
+
+	// SLA: a ticket's SLA is decided once it is flagged breached (sla.go)
+	// or reaches Ready for Delivery unflagged
+	var breached sql.NullInt64
+	err := as.db.QueryRow(`
+		SELECT COUNT(*), SUM(sla_breached_at IS NOT NULL) FROM orders
+		WHERE account_id = ? AND deleted_at IS NULL AND sla_due_at IS NOT NULL
+		  AND created_at >= ? AND created_at < ?
+		  AND (sla_breached_at IS NOT NULL OR status IN ('Ready for Delivery', ?))
+	`, account.ID, period.From, period.To, closedStatus).Scan(&health.SLA.Tickets, &breached)
+	if err != nil {
+		return nil, err
+	}
+	health.SLA.Breached = int(breached.Int64)
+	if health.SLA.Tickets > 0 {
+		compliance := roundTenth(100 * float64(health.SLA.Tickets-health.SLA.Breached) / float64(health.SLA.Tickets))
+		health.SLA.CompliancePercent = &compliance
+		health.SLA.Score = healthScore(compliance)
+	}
+
+	// Payments
+	rows, err := as.db.Query(`
+		SELECT o.total_cost, o.amount_paid,
+		       (SELECT MIN(h.changed_at) FROM ticket_status_history h
+		        WHERE h.order_id = o.id AND h.to_status = 'Ready for Delivery'),
+		       (SELECT MAX(e.occurred_at) FROM ticket_events e
+		        WHERE e.ticket_id = o.id AND e.event_type = ?)
+		FROM orders o
+		WHERE o.account_id = ? AND o.deleted_at IS NULL AND o.total_cost > 0
+		  AND o.created_at >= ? AND o.created_at < ?
+	`, EventPaymentRecorded, account.ID, period.From, period.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	terms := time.Duration(account.PaymentTermsDays) * 24 * time.Hour
+	var paidDays float64
+	var paid int
+	for rows.Next() {
+		var total, amountPaid Money
+		var readyAt, paidAt sql.NullTime
+		if err := rows.Scan(&total, &amountPaid, &readyAt, &paidAt); err != nil {
+			return nil, err
+		}
+		if !readyAt.Valid {
+			continue
+		}
+		switch {
+		case amountPaid >= total && paidAt.Valid:
+			took := max(paidAt.Time.Sub(readyAt.Time), 0)
+			paidDays += took.Hours() / 24
+			paid++
+			if took <= terms {
+				health.Payments.PaidOnTime++
+			} else {
+				health.Payments.PaidLate++
+			}
+		case now.Sub(readyAt.Time) > terms:
+			health.Payments.Overdue++
+		default:
+			continue
+		}
+		health.Payments.Invoices++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if paid > 0 {
+		average := roundTenth(paidDays / float64(paid))
+		health.Payments.AverageDaysToPay = &average
+	}
+	if health.Payments.Invoices > 0 {
+		health.Payments.Score = healthScore(100 * float64(health.Payments.PaidOnTime) / float64(health.Payments.Invoices))
+	}
+
+	// Satisfaction
+	var average sql.NullFloat64
+	err = as.db.QueryRow(`
+		SELECT COUNT(*), AVG(r.score) FROM ticket_ratings r JOIN orders o ON o.id = r.order_id
+		WHERE o.account_id = ? AND r.recorded_at >= ? AND r.recorded_at < ?
+	`, account.ID, period.From, period.To).Scan(&health.Satisfaction.Ratings, &average)
+	if err != nil {
+		return nil, err
+	}
+	if average.Valid {
+		rounded := roundTenth(average.Float64)
+		health.Satisfaction.Average = &rounded
+		health.Satisfaction.Score = healthScore(100 * (average.Float64 - 1) / 4)
+	}
+
+	var weighted, weights int
+	for _, part := range []struct {
+		score  *int
+		weight int
+	}{
+		{health.Volume.Score, healthWeightVolume},
+		{health.SLA.Score, healthWeightSLA},
+		{health.Payments.Score, healthWeightPayments},
+		{health.Satisfaction.Score, healthWeightSatisfaction},
+	} {
+		if part.score != nil {
+			weighted += *part.score * part.weight
+			weights += part.weight
+		}
+	}
+	health.Band = HealthNoData
+	if weights > 0 {
+		health.Score = healthScore(float64(weighted) / float64(weights))
+		switch {
+		case *health.Score >= 75:
+			health.Band = HealthHealthy
+		case *health.Score >= 50:
+			health.Band = HealthWatch
+		default:
+			health.Band = HealthAtRisk
+		}
+	}
+	return health, nil
+}
+
+// healthScore rounds a percentage into a 0-100 score.
+func healthScore(percent float64) *int {
+	score := int(math.Round(min(max(percent, 0), 100)))
+	return &score
+}
+
+func roundTenth(f float64) float64 {
+	return math.Round(f*10) / 10
+}
+
+// AccountsHandler lists corporate accounts (GET) or adds one (POST).
+func AccountsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		accounts, err := accountService.List()
+		if err != nil {
+			log.Printf("Error listing accounts: %v", err)
+			http.Error(w, "Failed to retrieve accounts", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(accounts)
+
+	case "POST":
+		if !hasPermission(r, PermAccountsManage) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			CorporateAccount
+			ContractStart    string `json:"contract_start"`
+			ContractEnd      string `json:"contract_end"`
+			PaymentTermsDays *int   `json:"payment_terms_days"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		account := request.CorporateAccount
+
+		var fieldErrors ValidationErrors
+		account.Name = strings.TrimSpace(account.Name)
+		if account.Name == "" || len(account.Name) > 255 {
+			fieldErrors.Add("name", "is required and must be at most 255 characters")
+		}
+		if len(account.ContactName) > 255 {
+			fieldErrors.Add("contact_name", "must be at most 255 characters")
+		}
+		if account.ContactEmail != "" && !strings.Contains(account.ContactEmail, "@") {
+			fieldErrors.Add("contact_email", "must be an email address")
+		}
+		if len(account.ContractReference) > 100 {
+			fieldErrors.Add("contract_reference", "must be at most 100 characters")
+		}
+		account.ContractStart = parseDateField("contract_start", request.ContractStart, &fieldErrors)
+		account.ContractEnd = parseDateField("contract_end", request.ContractEnd, &fieldErrors)
+		if account.ContractStart != nil && account.ContractEnd != nil && !account.ContractEnd.After(*account.ContractStart) {
+			fieldErrors.Add("contract_end", "must be after contract_start")
+		}
+		account.PaymentTermsDays = 30
+		if request.PaymentTermsDays != nil {
+			account.PaymentTermsDays = *request.PaymentTermsDays
+		}
+		if account.PaymentTermsDays < 0 || account.PaymentTermsDays > 365 {
+			fieldErrors.Add("payment_terms_days", "must be between 0 and 365")
+		}
+		for _, commitment := range []struct {
+			field string
+			hours *int
+		}{{"response_hours", account.ResponseHours}, {"resolution_hours", account.ResolutionHours}} {
+			if commitment.hours != nil && (*commitment.hours < 1 || *commitment.hours > 8760) {
+				fieldErrors.Add(commitment.field, "must be between 1 and 8760")
+			}
+		}
+		if account.ResponseHours != nil && account.ResolutionHours != nil && *account.ResolutionHours < *account.ResponseHours {
+			fieldErrors.Add("resolution_hours", "must not be less than response_hours")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		account.CreatedBy = actorID(r)
+		err := accountService.Create(&account)
+		if err == errAccountExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating account %s: %v", account.Name, err)
+			http.Error(w, "Failed to create account", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Account %d (%s) created by %s", account.ID, account.Name, actorID(r))
+		auditService.Record(r, AuditAccountCreated, "account", strconv.FormatInt(account.ID, 10), nil, account)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(account)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// AccountHealthHandler scores one account (?account_id=) or every account,
+// weakest first, over ?from=&to= (default the last 30 days).
+func AccountHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	var accountID int64
+	if value := r.URL.Query().Get("account_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id <= 0 {
+			fieldErrors.Add("account_id", "must be a positive integer")
+		}
+		accountID = id
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	var accounts []CorporateAccount
+	if accountID != 0 {
+		account, err := accountService.GetAccount(accountID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrieving account %d: %v", accountID, err)
+			http.Error(w, "Failed to build account health", http.StatusInternalServerError)
+			return
+		}
+		accounts = []CorporateAccount{*account}
+	} else {
+		var err error
+		if accounts, err = accountService.List(); err != nil {
+			log.Printf("Error listing accounts: %v", err)
+			http.Error(w, "Failed to build account health", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	report := []AccountHealth{}
+	for i := range accounts {
+		health, err := accountService.Health(&accounts[i], period)
+		if err != nil {
+			log.Printf("Error scoring account %d: %v", accounts[i].ID, err)
+			http.Error(w, "Failed to build account health", http.StatusInternalServerError)
+			return
+		}
+		report = append(report, *health)
+	}
+	// Weakest first; accounts without data last
+	sort.SliceStable(report, func(i, j int) bool {
+		if report[i].Score == nil || report[j].Score == nil {
+			return report[j].Score == nil && report[i].Score != nil
+		}
+		return *report[i].Score < *report[j].Score
+	})
+
+	if accountID != 0 {
+		json.NewEncoder(w).Encode(report[0])
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// rateOrder serves POST /api/v1/orders/{id}/rating
+// ({"score": 4, "comment": "..."}), the customer's rating given at
+// collection.
+func rateOrder(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsEdit) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Score   int    `json:"score"`
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	request.Comment = strings.TrimSpace(request.Comment)
+	if request.Score < 1 || request.Score > 5 {
+		fieldErrors.Add("score", "must be between 1 and 5")
+	}
+	if len(request.Comment) > 1000 {
+		fieldErrors.Add("comment", "must be at most 1000 characters")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := accountService.Rate(orderID, request.Score, request.Comment, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error rating order %s: %v", orderID, err)
+		http.Error(w, "Failed to record rating", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Order %s rated %d by %s", orderID, request.Score, actorID(r))
+	auditService.Record(r, AuditTicketRated, "order", orderID, nil, request)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Rating recorded successfully",
+	})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const apiKeysTable = `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id VARCHAR(50) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		key_prefix VARCHAR(16) NOT NULL,
+		key_hash CHAR(64) NOT NULL UNIQUE,
+		scopes JSON NOT NULL,
+		created_by VARCHAR(50),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP NULL,
+		revoked_at TIMESTAMP NULL,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// apiKeyScopes maps each scope a key can be granted to the endpoints it opens.
+var apiKeyScopes = map[string][]string{
+	"orders:create": {"/api/v1/orders/create"},
+	"orders:read":   {"/api/v1/orders", "/api/v1/orders/events"},
+	"orders:status": {"/api/v1/orders/status"},
+	"print:agent":   {"/api/v1/print-jobs", "/api/v1/print-jobs/status"},
+	"lobby:kiosk":   {"/api/v1/lobby/tokens"},
+}
+
+// apiKeyScopeRoles is the role a key acts as in the role and permission
+// checks of the endpoints each scope opens. Keys hold no role anywhere
+// else, so an Admin-only check never passes for one.
+var apiKeyScopeRoles = map[string]string{
+	"orders:create": RoleFrontDesk,
+	"orders:read":   RoleFrontDesk,
+	"orders:status": RoleFrontDesk,
+	"print:agent":   RoleFrontDesk,
+	"lobby:kiosk":   RoleFrontDesk,
+}
+
+// apiKeyRole returns the role a key with scopes acts as on path, or "" when
+// none of its scopes opens path.
+func apiKeyRole(scopes []string, path string) string {
+	for _, scope := range scopes {
+		if slices.Contains(apiKeyScopes[scope], path) {
+			return apiKeyScopeRoles[scope]
+		}
+	}
+	return ""
+}
+
+// ErrAPIKeyInvalid is returned for unknown, revoked or expired keys.
+var ErrAPIKeyInvalid = errors.New("api key is invalid, revoked or expired")
+
+// APIKey is a credential for machine clients such as the website intake form.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+
+	// Set for tokens issued to a service account
+	ServiceAccountID string     `json:"service_account_id,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+}
+
+// APIKeyService handles API key database operations
+type APIKeyService struct {
+	db *sql.DB
+}
+
+func NewAPIKeyService(database *sql.DB) *APIKeyService {
+	return &APIKeyService{db: database}
+}
+
+// CreateKey stores a new key and returns it with the plaintext secret, which
+// is shown to the caller exactly once. Service account tokens pass their
+// account and expiry; standalone keys pass "" and nil.
+func (aks *APIKeyService) CreateKey(name string, scopes []string, createdBy, serviceAccountID string, expiresAt *time.Time) (*APIKey, string, error) {
+	prefix, err := randomToken(6)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomToken(24)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Keep the prefix free of the separator so keys split unambiguously
+	prefix = strings.NewReplacer("_", "x", "-", "y").Replace(prefix)
+	plaintext := fmt.Sprintf("pch_%s_%s", prefix, secret)
+
+	key := &APIKey{
+		ID:        fmt.Sprintf("KEY-%d", time.Now().UnixNano()),
+		Name:      name,
+		Prefix:    "pch_" + prefix,
+		Scopes:    scopes,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+
+		ServiceAccountID: serviceAccountID,
+		ExpiresAt:        expiresAt,
+	}
+
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = aks.db.Exec(`
+		INSERT INTO api_keys (id, name, key_prefix, key_hash, scopes, created_by, created_at, service_account_id, expires_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), ?)
+	`, key.ID, key.Name, key.Prefix, hashToken(plaintext), string(scopesJSON), key.CreatedBy, key.CreatedAt,
+		key.ServiceAccountID, key.ExpiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return key, plaintext, nil
+}
+
+// Authenticate resolves a plaintext key to its record.
+func (aks *APIKeyService) Authenticate(plaintext string) (*APIKey, error) {
+	key := &APIKey{}
+	var scopesJSON string
+
+	err := aks.db.QueryRow(`
+		SELECT id, name, key_prefix, scopes, created_at
+		FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+	`, hashToken(plaintext)).Scan(&key.ID, &key.Name, &key.Prefix, &scopesJSON, &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(scopesJSON), &key.Scopes); err != nil {
+		return nil, err
+	}
+
+	aks.db.Exec(`UPDATE api_keys SET last_used_at = NOW() WHERE id = ?`, key.ID)
+	return key, nil
+}
+
+func (aks *APIKeyService) ListKeys() ([]APIKey, error) {
+	rows, err := aks.db.Query(`
+		SELECT id, name, key_prefix, scopes, COALESCE(created_by, ''), created_at, last_used_at, revoked_at,
+			COALESCE(service_account_id, ''), expires_at
+		FROM api_keys ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var scopesJSON string
+		var lastUsedAt, revokedAt, expiresAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &scopesJSON, &key.CreatedBy, &key.CreatedAt,
+			&lastUsedAt, &revokedAt, &key.ServiceAccountID, &expiresAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(scopesJSON), &key.Scopes); err != nil {
+			return nil, err
+		}
+		key.LastUsedAt = timePtr(lastUsedAt)
+		key.RevokedAt = timePtr(revokedAt)
+		key.ExpiresAt = timePtr(expiresAt)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (aks *APIKeyService) RevokeKey(id string) (bool, error) {
+	result, err := aks.db.Exec(`UPDATE api_keys SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// scopesAllowPath reports whether any granted scope opens path.
+func scopesAllowPath(scopes []string, path string) bool {
+	for _, scope := range scopes {
+		for _, allowed := range apiKeyScopes[scope] {
+			if path == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticateAPIKey turns an X-API-Key header into request claims, or
+// writes the error response and returns nil.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string) *Claims {
+	key, err := apiKeyService.Authenticate(plaintext)
+	if err == ErrAPIKeyInvalid {
+		http.Error(w, "Invalid, revoked or expired API key", http.StatusUnauthorized)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error authenticating API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil
+	}
+
+	if !scopesAllowPath(key.Scopes, r.URL.Path) {
+		http.Error(w, "API key is not allowed to call this endpoint", http.StatusForbidden)
+		return nil
+	}
+
+	return &Claims{APIKeyID: key.ID, Scopes: key.Scopes}
+}
+
+var apiKeyService *APIKeyService
+
+// APIKeysHandler lists (GET) or creates (POST) API keys.
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		keys, err := apiKeyService.ListKeys()
+		if err != nil {
+			log.Printf("Error listing API keys: %v", err)
+			http.Error(w, "Failed to retrieve API keys", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(keys)
+
+	case "POST":
+		var request struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if request.Name == "" || len(request.Scopes) == 0 {
+			http.Error(w, "Name and at least one scope are required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range request.Scopes {
+			if _, ok := apiKeyScopes[scope]; !ok {
+				http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+				return
+			}
+		}
+
+		key, plaintext, err := apiKeyService.CreateKey(request.Name, request.Scopes, actorID(r), "", nil)
+		if err != nil {
+			log.Printf("Error creating API key: %v", err)
+			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("API key %s (%s) created by %s with scopes %v", key.ID, key.Name, actorID(r), key.Scopes)
+		auditService.Record(r, AuditAPIKeyCreated, "api_key", key.ID, nil, key)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "API key created. Store the key now; it cannot be shown again.",
+			"api_key": key,
+			"key":     plaintext,
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RevokeAPIKeyHandler revokes an API key.
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ID == "" {
+		http.Error(w, "API key ID is required", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := apiKeyService.RevokeKey(request.ID)
+	if err != nil {
+		log.Printf("Error revoking API key %s: %v", request.ID, err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API key not found or already revoked", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("API key %s revoked by %s", request.ID, actorID(r))
+	auditService.Record(r, AuditAPIKeyRevoked, "api_key", request.ID, nil, nil)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "API key revoked successfully",
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Managers balance work between engineers: PUT /api/v1/orders/{id}/assign
+// moves a ticket to another engineer, recorded as a TicketEdited event of
+// assigned_engineer_id like any other edit, and GET
+// /api/v1/engineers/workload counts each engineer's open tickets. Open means
+// not collected and not cancelled.
+
+// EngineerWorkload is the open work assigned to one engineer.
+type EngineerWorkload struct {
+	EngineerID  string         `json:"engineer_id"`
+	Name        string         `json:"name"`
+	Email       string         `json:"email"`
+	OpenTickets int            `json:"open_tickets"`
+	Overdue     int            `json:"overdue"` // Open tickets past their expected delivery date
+	ByStatus    map[string]int `json:"by_status"`
+	Presence    string         `json:"presence"` // active, idle, away or offline
+	AwayNote    string         `json:"away_note,omitempty"`
+}
+
+// Workload returns every engineer's open ticket counts, busiest first, and
+// the number of open tickets nobody is assigned to.
+func (os *OrderService) Workload() ([]EngineerWorkload, int, error) {
+	rows, err := os.db.Query(`
+		SELECT u.id, u.full_name, u.email, o.status,
+		       COUNT(o.id),
+		       COALESCE(SUM(o.expected_delivery_date < CURDATE()), 0)
+		FROM users u
+		LEFT JOIN orders o ON o.assigned_engineer_id = u.id
+		     AND o.status NOT IN (?, ?) AND o.deleted_at IS NULL
+		WHERE u.role = ? AND u.approved = TRUE
+		GROUP BY u.id, u.full_name, u.email, o.status
+		ORDER BY u.full_name, u.id
+	`, closedStatus, StatusCancelled, RoleEngineer)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var workloads []EngineerWorkload
+	index := map[string]int{}
+	for rows.Next() {
+		var id, name, email string
+		var status sql.NullString
+		var count, overdue int
+		if err := rows.Scan(&id, &name, &email, &status, &count, &overdue); err != nil {
+			return nil, 0, err
+		}
+		i, seen := index[id]
+		if !seen {
+			i = len(workloads)
+			index[id] = i
+			workloads = append(workloads, EngineerWorkload{EngineerID: id, Name: name, Email: email, ByStatus: map[string]int{}})
+		}
+		if status.Valid {
+			workloads[i].ByStatus[status.String] = count
+			workloads[i].OpenTickets += count
+			workloads[i].Overdue += overdue
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Busiest first; the SQL order keeps ties alphabetical
+	sort.SliceStable(workloads, func(i, j int) bool {
+		return workloads[i].OpenTickets > workloads[j].OpenTickets
+	})
+
+	var unassigned int
+	err = os.db.QueryRow(`
+		SELECT COUNT(*) FROM orders
+		WHERE (assigned_engineer_id IS NULL OR assigned_engineer_id = '') AND status NOT IN (?, ?) AND deleted_at IS NULL
+	`, closedStatus, StatusCancelled).Scan(&unassigned)
+	return workloads, unassigned, err
+}
+
+// assignOrder serves PUT /api/v1/orders/{id}/assign ({"engineer_id": "..."}).
+func assignOrder(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsAssign) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		EngineerID string `json:"engineer_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	request.EngineerID = strings.TrimSpace(request.EngineerID)
+	if request.EngineerID == "" {
+		fieldErrors.Add("engineer_id", "is required")
+	}
+	edits := map[string]*string{assignedEngineerField: &request.EngineerID}
+	if request.EngineerID != "" {
+		var referenceErrors ValidationErrors
+		if err := validateTicketReferences(orderID, edits, &referenceErrors); err != nil {
+			log.Printf("Error validating assignment of order %s: %v", orderID, err)
+			http.Error(w, "Failed to assign order", http.StatusInternalServerError)
+			return
+		}
+		for _, fieldError := range referenceErrors {
+			fieldErrors.Add("engineer_id", fieldError.Message)
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	order, err := orderService.GetOrder(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving order %s: %v", orderID, err)
+		http.Error(w, "Failed to assign order", http.StatusInternalServerError)
+		return
+	}
+	if order.Status == closedStatus || order.Status == StatusCancelled {
+		http.Error(w, "Only open tickets can be reassigned", http.StatusConflict)
+		return
+	}
+
+	payload, err := orderService.EditOrder(orderID, edits, actorID(r))
+	if err == errNoTicketChanges {
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "The ticket is already assigned to this engineer",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error assigning order %s: %v", orderID, err)
+		http.Error(w, "Failed to assign order", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Order %s assigned to %s", orderID, request.EngineerID)
+	auditService.Record(r, AuditTicketEdited, "order", orderID, nil, payload)
+	response := map[string]interface{}{
+		"message": "Order assigned successfully",
+		"changes": payload.Changes,
+	}
+	// Tell the dispatcher when the engineer isn't around to pick it up
+	if presence, err := presenceService.Get(request.EngineerID); err != nil {
+		log.Printf("Error retrieving presence of %s: %v", request.EngineerID, err)
+	} else if presence != nil {
+		response["engineer_presence"] = presence
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// EngineerWorkloadHandler lists open ticket counts per engineer, busiest
+// first, with whether each is around and the number of unassigned open
+// tickets.
+func EngineerWorkloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	engineers, unassigned, err := orderService.Workload()
+	if err != nil {
+		log.Printf("Error building engineer workload: %v", err)
+		http.Error(w, "Failed to retrieve workload", http.StatusInternalServerError)
+		return
+	}
+	if engineers == nil {
+		engineers = []EngineerWorkload{}
+	}
+	if err := addWorkloadPresence(engineers); err != nil {
+		log.Printf("Error retrieving engineer presence: %v", err)
+		http.Error(w, "Failed to retrieve workload", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"engineers":  engineers,
+		"unassigned": unassigned,
+	})
+}
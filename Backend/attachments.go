@@ -0,0 +1,742 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attachments (device intake photos, diagnostic screenshots, signed forms)
+// are kept in a blob store (see blobstore.go) with their metadata in the
+// database. Uploads are checked against an allow-list of content types,
+// sniffed from the file itself rather than trusted from the client, and
+// storage is metered per ticket and per shop location against configurable
+// quotas: uploads past the warning threshold succeed with a warning, and
+// uploads that would exceed a quota are refused. Downloads can be handed out
+// as signed, expiring URLs that need no login.
+
+const attachmentsTable = `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id VARCHAR(50) PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		location VARCHAR(50) NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		content_type VARCHAR(100) NOT NULL,
+		size_bytes BIGINT NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		storage_path VARCHAR(500) NOT NULL,
+		uploaded_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_attachments_order (order_id),
+		INDEX idx_attachments_location (location),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// StorageConfig holds the attachment store location, limits and quotas.
+type StorageConfig struct {
+	Dir                string
+	Location           string
+	MaxFileBytes       int64
+	TicketQuotaBytes   int64
+	LocationQuotaBytes int64
+	WarnPercent        int64
+	AllowedTypes       []string
+	URLTTL             time.Duration // Lifetime of signed download URLs
+}
+
+func getStorageConfig() StorageConfig {
+	return StorageConfig{
+		Dir:                getEnv("ATTACHMENTS_DIR", "./data/attachments"),
+		Location:           getEnv("SHOP_LOCATION", "main"),
+		MaxFileBytes:       int64(getEnvInt("ATTACHMENT_MAX_FILE_MB", 10)) << 20,
+		TicketQuotaBytes:   int64(getEnvInt("ATTACHMENT_TICKET_QUOTA_MB", 100)) << 20,
+		LocationQuotaBytes: int64(getEnvInt("ATTACHMENT_LOCATION_QUOTA_MB", 20480)) << 20,
+		WarnPercent:        int64(getEnvInt("ATTACHMENT_QUOTA_WARN_PERCENT", 80)),
+		AllowedTypes: splitList(getEnv("ATTACHMENT_ALLOWED_TYPES",
+			"image/jpeg,image/png,image/gif,image/webp,image/heic,application/pdf,text/plain,video/mp4")),
+		URLTTL: getEnvDuration("ATTACHMENT_URL_TTL", 15*time.Minute),
+	}
+}
+
+// QuotaError is returned when an upload would exceed a storage quota.
+type QuotaError struct {
+	Scope string
+	Used  int64
+	Limit int64
+	Size  int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s storage quota exceeded: %s used of %s, this file needs %s more",
+		e.Scope, formatBytes(e.Used), formatBytes(e.Limit), formatBytes(e.Size))
+}
+
+var errAttachmentTooLarge = errors.New("file is larger than the per-file upload limit")
+
+// AttachmentTypeError is returned when an upload's content type is not
+// allowed.
+type AttachmentTypeError struct {
+	ContentType string
+}
+
+func (e *AttachmentTypeError) Error() string {
+	return fmt.Sprintf("files of type %s cannot be attached", e.ContentType)
+}
+
+// detectContentType decides an upload's type from its first bytes, falling
+// back to the declared type for formats that cannot be sniffed (such as
+// HEIC photos).
+func detectContentType(declared string, head []byte) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if sniffed != "" && sniffed != "application/octet-stream" {
+		return sniffed
+	}
+	if declared, _, err := mime.ParseMediaType(declared); err == nil {
+		return declared
+	}
+	return "application/octet-stream"
+}
+
+// Attachment is a file stored against a ticket.
+type Attachment struct {
+	ID          string    `json:"id"`
+	OrderID     string    `json:"order_id"`
+	Location    string    `json:"location"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	SizeBytes   int64     `json:"size_bytes"`
+	SHA256      string    `json:"sha256"`
+	UploadedBy  string    `json:"uploaded_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	storagePath string    // Key in the blob store
+	storage     string    // Blob store the file is in
+}
+
+// StorageUsage is usage against one quota.
+type StorageUsage struct {
+	Scope      string `json:"scope"`
+	Key        string `json:"key"`
+	UsedBytes  int64  `json:"used_bytes"`
+	QuotaBytes int64  `json:"quota_bytes"`
+	Percent    int64  `json:"percent"`
+	Files      int    `json:"files"`
+}
+
+func newStorageUsage(scope, key string, used, quota int64, files int) StorageUsage {
+	usage := StorageUsage{Scope: scope, Key: key, UsedBytes: used, QuotaBytes: quota, Files: files}
+	if quota > 0 {
+		usage.Percent = used * 100 / quota
+	}
+	return usage
+}
+
+// formatBytes renders a byte count for error messages.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// AttachmentService handles attachment storage and metering
+type AttachmentService struct {
+	db      *sql.DB
+	config  StorageConfig
+	stores  map[string]BlobStore
+	backend string // Store new uploads go to
+	urlKey  []byte // Signs download URLs served by this API
+}
+
+func NewAttachmentService(database *sql.DB) (*AttachmentService, error) {
+	config := getStorageConfig()
+	stores, backend, err := newBlobStores(config)
+	if err != nil {
+		return nil, err
+	}
+	service := &AttachmentService{db: database, config: config, stores: stores, backend: backend}
+
+	// URLs signed with a per-process key stop working after a restart
+	if secret := getEnv("ATTACHMENT_URL_SECRET", ""); secret != "" {
+		service.urlKey = []byte(secret)
+	} else {
+		service.urlKey = make([]byte, 32)
+		if _, err := rand.Read(service.urlKey); err != nil {
+			return nil, err
+		}
+	}
+	return service, nil
+}
+
+// store returns the blob store an attachment was written to.
+func (as *AttachmentService) store(attachment *Attachment) (BlobStore, error) {
+	store, ok := as.stores[attachment.storage]
+	if !ok {
+		return nil, fmt.Errorf("attachment %s is in the %s store, which is not configured", attachment.ID, attachment.storage)
+	}
+	return store, nil
+}
+
+// usage totals the bytes and files stored for a ticket or a location.
+func (as *AttachmentService) usage(q rowQuerier, column, key string) (int64, int, error) {
+	var used int64
+	var files int
+	err := q.QueryRow(`SELECT COALESCE(SUM(size_bytes), 0), COUNT(*) FROM attachments WHERE `+column+` = ?`, key).
+		Scan(&used, &files)
+	return used, files, err
+}
+
+// checkQuotas returns the ticket and location usage with the attachment
+// added, or a QuotaError when it would exceed either quota.
+func (as *AttachmentService) checkQuotas(q rowQuerier, attachment *Attachment) ([]StorageUsage, error) {
+	size := attachment.SizeBytes
+	ticketUsed, ticketFiles, err := as.usage(q, "order_id", attachment.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if ticketUsed+size > as.config.TicketQuotaBytes {
+		return nil, &QuotaError{Scope: "Ticket", Used: ticketUsed, Limit: as.config.TicketQuotaBytes, Size: size}
+	}
+	locationUsed, locationFiles, err := as.usage(q, "location", attachment.Location)
+	if err != nil {
+		return nil, err
+	}
+	if locationUsed+size > as.config.LocationQuotaBytes {
+		return nil, &QuotaError{Scope: "Location", Used: locationUsed, Limit: as.config.LocationQuotaBytes, Size: size}
+	}
+	return []StorageUsage{
+		newStorageUsage("ticket", attachment.OrderID, ticketUsed+size, as.config.TicketQuotaBytes, ticketFiles+1),
+		newStorageUsage("location", attachment.Location, locationUsed+size, as.config.LocationQuotaBytes, locationFiles+1),
+	}, nil
+}
+
+// Store writes an upload to the blob store and records it, refusing it when
+// its type is not allowed or the file or either quota would be exceeded. It
+// returns usage after the upload.
+func (as *AttachmentService) Store(attachment *Attachment, content io.Reader) ([]StorageUsage, error) {
+	return as.StoreAllowing(attachment, content, as.config.AllowedTypes)
+}
+
+// StoreAllowing is Store with its own list of allowed content types, for
+// uploads such as voice notes that the general allow-list does not cover.
+func (as *AttachmentService) StoreAllowing(attachment *Attachment, content io.Reader, allowedTypes []string) ([]StorageUsage, error) {
+	// The order ID becomes a directory name, so it must name a real order
+	// before anything is written
+	var exists int
+	err := as.db.QueryRow(`SELECT COUNT(*) FROM orders WHERE id = ?`, attachment.OrderID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 || filepath.Base(attachment.OrderID) != attachment.OrderID {
+		return nil, sql.ErrNoRows
+	}
+
+	attachment.ID = fmt.Sprintf("ATT-%d", time.Now().UnixNano())
+	attachment.Location = as.config.Location
+	attachment.CreatedAt = time.Now()
+
+	// Spool the upload to measure, hash and sniff it before it reaches the store
+	spool, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// Read one byte past the limit to tell an oversized file from an exact fit
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(spool, hash), io.LimitReader(content, as.config.MaxFileBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if written > as.config.MaxFileBytes {
+		return nil, errAttachmentTooLarge
+	}
+	head := make([]byte, 512)
+	n, err := spool.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	attachment.ContentType = detectContentType(attachment.ContentType, head[:n])
+	if !containsFold(allowedTypes, attachment.ContentType) {
+		return nil, &AttachmentTypeError{ContentType: attachment.ContentType}
+	}
+	attachment.SizeBytes = written
+	attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	// Refuse an upload over quota before it is sent to the store
+	if _, err := as.checkQuotas(as.db, attachment); err != nil {
+		return nil, err
+	}
+
+	// The file is stored before the transaction so no row lock is held over
+	// the network call; if the row is not recorded the file is removed again
+	attachment.storage = as.backend
+	store := as.stores[as.backend]
+	attachment.storagePath = store.Key(attachment.OrderID, attachment.ID)
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := store.Put(attachment.storagePath, spool, written, attachment.ContentType, attachment.SHA256); err != nil {
+		return nil, err
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			store.Delete(attachment.storagePath)
+		}
+	}()
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the ticket serialises uploads to it, and the quotas are
+	// checked again in case another upload landed meanwhile
+	if _, err := orderService.lockOrderStatus(tx, attachment.OrderID); err != nil {
+		return nil, err
+	}
+	usages, err := as.checkQuotas(tx, attachment)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO attachments (id, order_id, location, filename, content_type, size_bytes, sha256, storage_backend, storage_path, uploaded_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, attachment.ID, attachment.OrderID, attachment.Location, attachment.Filename, attachment.ContentType,
+		attachment.SizeBytes, attachment.SHA256, attachment.storage, attachment.storagePath, nullString(attachment.UploadedBy), attachment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	stored = true
+	return usages, nil
+}
+
+// Delete removes an attachment's file and record, unless its ticket is
+// under legal hold.
+func (as *AttachmentService) Delete(attachment *Attachment) error {
+	if err := checkLegalHold(as.db, attachment.OrderID); err != nil {
+		return err
+	}
+	if err := as.deleteFile(attachment); err != nil {
+		return err
+	}
+	_, err := as.db.Exec(`DELETE FROM attachments WHERE id = ?`, attachment.ID)
+	return err
+}
+
+// deleteFile removes an attachment's file from its store.
+func (as *AttachmentService) deleteFile(attachment *Attachment) error {
+	store, err := as.store(attachment)
+	if err != nil {
+		return err
+	}
+	return store.Delete(attachment.storagePath)
+}
+
+// Open returns an attachment's content.
+func (as *AttachmentService) Open(attachment *Attachment) (io.ReadCloser, error) {
+	store, err := as.store(attachment)
+	if err != nil {
+		return nil, err
+	}
+	return store.Open(attachment.storagePath)
+}
+
+// downloadSignature signs an attachment ID and expiry time.
+func (as *AttachmentService) downloadSignature(id string, expires int64) string {
+	return hex.EncodeToString(hmacSHA256(as.urlKey, id+"\n"+strconv.FormatInt(expires, 10)))
+}
+
+// SignedURL returns a download URL for an attachment that works without a
+// login until it expires. Stores that can sign their own URLs hand them out
+// directly; otherwise the URL points at this API's public download route.
+func (as *AttachmentService) SignedURL(attachment *Attachment) (string, time.Time, error) {
+	expiresAt := time.Now().Add(as.config.URLTTL)
+	store, err := as.store(attachment)
+	if err != nil {
+		return "", expiresAt, err
+	}
+	if presigner, ok := store.(blobPresigner); ok {
+		url, err := presigner.PresignGet(attachment.storagePath, attachment.Filename, as.config.URLTTL)
+		return url, expiresAt, err
+	}
+	expires := expiresAt.Unix()
+	return fmt.Sprintf("/api/v1/public/attachments?id=%s&expires=%d&sig=%s",
+		attachment.ID, expires, as.downloadSignature(attachment.ID, expires)), expiresAt, nil
+}
+
+// VerifyDownload checks the signature and expiry of a download URL.
+func (as *AttachmentService) VerifyDownload(id, expires, sig string) bool {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	expected := as.downloadSignature(id, expiresAt)
+	return subtle.ConstantTimeCompare([]byte(sig), []byte(expected)) == 1
+}
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	attachment := &Attachment{}
+	var uploadedBy sql.NullString
+	err := row.Scan(&attachment.ID, &attachment.OrderID, &attachment.Location, &attachment.Filename,
+		&attachment.ContentType, &attachment.SizeBytes, &attachment.SHA256, &attachment.storage,
+		&attachment.storagePath, &uploadedBy, &attachment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	attachment.UploadedBy = uploadedBy.String
+	return attachment, nil
+}
+
+const attachmentColumns = `id, order_id, location, filename, content_type, size_bytes, sha256, storage_backend, storage_path, uploaded_by, created_at`
+
+func (as *AttachmentService) GetAttachment(id string) (*Attachment, error) {
+	return scanAttachment(as.db.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, id))
+}
+
+// ListAttachments returns a ticket's attachments with its storage usage.
+func (as *AttachmentService) ListAttachments(orderID string) ([]Attachment, StorageUsage, error) {
+	rows, err := as.db.Query(`SELECT `+attachmentColumns+` FROM attachments WHERE order_id = ? ORDER BY created_at`, orderID)
+	if err != nil {
+		return nil, StorageUsage{}, err
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	var used int64
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, StorageUsage{}, err
+		}
+		used += attachment.SizeBytes
+		attachments = append(attachments, *attachment)
+	}
+	usage := newStorageUsage("ticket", orderID, used, as.config.TicketQuotaBytes, len(attachments))
+	return attachments, usage, rows.Err()
+}
+
+// UsageReport lists usage for every location and the tickets using the most
+// storage.
+func (as *AttachmentService) UsageReport(topTickets int) (map[string]interface{}, error) {
+	locations := []StorageUsage{}
+	rows, err := as.db.Query(`SELECT location, SUM(size_bytes), COUNT(*) FROM attachments GROUP BY location ORDER BY location`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var location string
+		var used int64
+		var files int
+		if err := rows.Scan(&location, &used, &files); err != nil {
+			return nil, err
+		}
+		locations = append(locations, newStorageUsage("location", location, used, as.config.LocationQuotaBytes, files))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tickets := []StorageUsage{}
+	ticketRows, err := as.db.Query(`
+		SELECT order_id, SUM(size_bytes) AS used, COUNT(*) FROM attachments
+		GROUP BY order_id ORDER BY used DESC LIMIT ?
+	`, topTickets)
+	if err != nil {
+		return nil, err
+	}
+	defer ticketRows.Close()
+	for ticketRows.Next() {
+		var orderID string
+		var used int64
+		var files int
+		if err := ticketRows.Scan(&orderID, &used, &files); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, newStorageUsage("ticket", orderID, used, as.config.TicketQuotaBytes, files))
+	}
+	if err := ticketRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"locations":   locations,
+		"top_tickets": tickets,
+		"limits": map[string]int64{
+			"max_file_bytes":       as.config.MaxFileBytes,
+			"ticket_quota_bytes":   as.config.TicketQuotaBytes,
+			"location_quota_bytes": as.config.LocationQuotaBytes,
+			"warn_percent":         as.config.WarnPercent,
+		},
+	}, nil
+}
+
+// quotaWarnings describes usage past the warning threshold.
+func (as *AttachmentService) quotaWarnings(usages []StorageUsage) []string {
+	var warnings []string
+	for _, usage := range usages {
+		if usage.Percent >= as.config.WarnPercent {
+			warnings = append(warnings, fmt.Sprintf("%s %s is at %d%% of its storage quota (%s of %s)",
+				usage.Scope, usage.Key, usage.Percent, formatBytes(usage.UsedBytes), formatBytes(usage.QuotaBytes)))
+		}
+	}
+	return warnings
+}
+
+var attachmentService *AttachmentService
+
+// AttachmentsHandler lists a ticket's attachments (GET ?order_id=) or
+// uploads one as multipart field "file" (POST ?order_id=).
+func AttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		http.Error(w, "order_id is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		attachments, usage, err := attachmentService.ListAttachments(orderID)
+		if err != nil {
+			log.Printf("Error listing attachments for %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve attachments", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"attachments": attachments,
+			"usage":       usage,
+		})
+
+	case "POST":
+		// Leave headroom for the multipart envelope around the file
+		r.Body = http.MaxBytesReader(w, r.Body, attachmentService.config.MaxFileBytes+1<<20)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, fmt.Sprintf("File exceeds the %s upload limit", formatBytes(attachmentService.config.MaxFileBytes)), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "A multipart file field named \"file\" is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		contentType := header.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachment := &Attachment{
+			OrderID:     orderID,
+			Filename:    truncate(filepath.Base(header.Filename), 255),
+			ContentType: truncate(contentType, 100),
+			UploadedBy:  actorID(r),
+		}
+
+		usages, err := attachmentService.Store(attachment, file)
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			http.Error(w, quotaErr.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var typeErr *AttachmentTypeError
+		if errors.As(err, &typeErr) {
+			http.Error(w, typeErr.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err == errAttachmentTooLarge {
+			http.Error(w, fmt.Sprintf("File exceeds the %s upload limit", formatBytes(attachmentService.config.MaxFileBytes)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error storing attachment for %s: %v", orderID, err)
+			http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+			return
+		}
+
+		warnings := attachmentService.quotaWarnings(usages)
+		for _, warning := range warnings {
+			log.Printf("Storage warning: %s", warning)
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"attachment": attachment,
+			"usage":      usages,
+			"warnings":   warnings,
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// attachmentDisposition is the Content-Disposition that downloads a file
+// under its original name.
+func attachmentDisposition(filename string) string {
+	return fmt.Sprintf("attachment; filename=%q", strings.ReplaceAll(filename, `"`, ""))
+}
+
+// serveAttachment streams an attachment's content.
+func serveAttachment(w http.ResponseWriter, r *http.Request, attachment *Attachment) {
+	content, err := attachmentService.Open(attachment)
+	if err != nil {
+		log.Printf("Error opening attachment %s: %v", attachment.ID, err)
+		http.Error(w, "Attachment file is missing", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", attachmentDisposition(attachment.Filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, attachment.Filename, attachment.CreatedAt, seeker)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.SizeBytes, 10))
+	if _, err := io.Copy(w, content); err != nil {
+		log.Printf("Error streaming attachment %s: %v", attachment.ID, err)
+	}
+}
+
+// DownloadAttachmentHandler streams a stored attachment (GET ?id=).
+func DownloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	attachment, err := attachmentService.GetAttachment(r.URL.Query().Get("id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading attachment: %v", err)
+		http.Error(w, "Failed to retrieve attachment", http.StatusInternalServerError)
+		return
+	}
+	serveAttachment(w, r, attachment)
+}
+
+// AttachmentURLHandler returns a signed download URL for an attachment that
+// works without a login until ATTACHMENT_URL_TTL passes (GET ?id=).
+func AttachmentURLHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	attachment, err := attachmentService.GetAttachment(r.URL.Query().Get("id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading attachment: %v", err)
+		http.Error(w, "Failed to retrieve attachment", http.StatusInternalServerError)
+		return
+	}
+
+	url, expiresAt, err := attachmentService.SignedURL(attachment)
+	if err != nil {
+		log.Printf("Error signing download URL for %s: %v", attachment.ID, err)
+		http.Error(w, "Failed to create download URL", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        url,
+		"expires_at": expiresAt,
+	})
+}
+
+// PublicAttachmentHandler serves a download URL signed by
+// AttachmentURLHandler (GET ?id=&expires=&sig=).
+func PublicAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if !attachmentService.VerifyDownload(query.Get("id"), query.Get("expires"), query.Get("sig")) {
+		http.Error(w, "This download link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	attachment, err := attachmentService.GetAttachment(query.Get("id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading attachment: %v", err)
+		http.Error(w, "Failed to retrieve attachment", http.StatusInternalServerError)
+		return
+	}
+	serveAttachment(w, r, attachment)
+}
+
+// StorageUsageHandler reports attachment storage per location and the
+// heaviest tickets (GET ?top=20). Admin only.
+func StorageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	top := 20
+	if raw := r.URL.Query().Get("top"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "top must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	report, err := attachmentService.UsageReport(top)
+	if err != nil {
+		log.Printf("Error building storage report: %v", err)
+		http.Error(w, "Failed to build storage report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
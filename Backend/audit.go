@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const auditLogTable = `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		actor_id VARCHAR(50) NULL,
+		action VARCHAR(100) NOT NULL,
+		entity_type VARCHAR(50) NOT NULL,
+		entity_id VARCHAR(100) NULL,
+		before_value JSON NULL,
+		after_value JSON NULL,
+		ip_address VARCHAR(45) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_audit_actor (actor_id, created_at),
+		INDEX idx_audit_entity (entity_type, entity_id, created_at),
+		INDEX idx_audit_created (created_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Audited actions
+const (
+	AuditLogin                  = "auth.login"
+	AuditLoginFailed            = "auth.login_failed"
+	AuditRegister               = "auth.register"
+	AuditPasswordReset          = "auth.password_reset"
+	AuditTicketCreated          = "ticket.created"
+	AuditStatusChanged          = "ticket.status_changed"
+	AuditItemAdded              = "ticket.item_added"
+	AuditPayment                = "ticket.payment_recorded"
+	AuditRoleChanged            = "user.role_changed"
+	AuditUserApproval           = "user.approval_changed"
+	AuditSessionsRevoke         = "user.sessions_revoked"
+	AuditAPIKeyCreated          = "api_key.created"
+	AuditAPIKeyRevoked          = "api_key.revoked"
+	AuditTicketTypeSave         = "ticket_type.saved"
+	AuditPartSaved              = "part.saved"
+	AuditBuildInvoiced          = "build.invoiced"
+	AuditBuybackRecorded        = "buyback.recorded"
+	AuditBuybackResold          = "buyback.resold"
+	AuditValuationRuleSaved     = "valuation_rule.saved"
+	AuditEstimatePublished      = "estimate.published"
+	AuditEstimateSelected       = "estimate.selected"
+	AuditEstimateRejected       = "estimate.rejected"
+	AuditPrintRequested         = "print.requested"
+	AuditTokenRevoked           = "user.token_revoked"
+	AuditPermissionChanged      = "role.permission_changed"
+	AuditServiceAccountSaved    = "service_account.created"
+	AuditServiceAccountDisabled = "service_account.disabled"
+	AuditCustomerCreated        = "customer.created"
+	AuditItemsArranged          = "ticket.items_arranged"
+	AuditTicketEdited           = "ticket.edited"
+	AuditTicketCostRecorded     = "ticket.cost_recorded"
+	AuditEmailFlagCleared       = "email.flag_cleared"
+	AuditTicketCancelled        = "ticket.cancelled"
+	AuditIDPolicyUpdated        = "id_policy.updated"
+	AuditIDPhotoUploaded        = "ticket.id_photo_uploaded"
+	AuditTheftCheckBlocked      = "device.theft_check_blocked"
+	AuditTheftCheckOverridden   = "ticket.theft_check_overridden"
+	AuditTicketNoteAdded        = "ticket.note_added"
+	AuditTicketNoteEdited       = "ticket.note_edited"
+	AuditLegalHoldPlaced        = "legal_hold.placed"
+	AuditLegalHoldReleased      = "legal_hold.released"
+	AuditPartScrapped           = "part.scrapped"
+	AuditCoreReceived           = "core.received"
+	AuditCoreResolved           = "core.resolved"
+	AuditPartReceived           = "part.received"
+	AuditSupplierPricesSaved    = "part.supplier_prices_saved"
+	AuditTicketHeld             = "ticket.held"
+	AuditTicketReleased         = "ticket.released"
+	AuditTicketMerged           = "ticket.merged"
+	AuditTicketSplit            = "ticket.split"
+	AuditRecallCreated          = "recall.created"
+	AuditRecallResponse         = "recall.response_recorded"
+	AuditTicketTagged           = "ticket.tagged"
+	AuditTicketUntagged         = "ticket.untagged"
+	AuditCustomFieldSave        = "custom_field.saved"
+	AuditCertificationSaved     = "certification.saved"
+	AuditCertificationDeleted   = "certification.deleted"
+	AuditTicketReopened         = "ticket.reopened"
+	AuditCustomerUpdated        = "customer.updated"
+	AuditCaseFileExported       = "ticket.case_file_exported"
+	AuditAccountCreated         = "account.created"
+	AuditTicketRated            = "ticket.rated"
+	AuditQuoteIssued            = "quote.issued"
+	AuditQuoteConverted         = "quote.converted"
+	AuditSignatureCaptured      = "ticket.signature_captured"
+	AuditChecklistTemplateSave  = "checklist_template.saved"
+	AuditChecklistRecorded      = "ticket.checklist_recorded"
+	AuditDiagnosisSaved         = "ticket.diagnosis_saved"
+	AuditDiagnosisPublished     = "ticket.diagnosis_published"
+	AuditVoiceNoteAdded         = "ticket.voice_note_added"
+	AuditReportSubscribed       = "report_subscription.created"
+	AuditReportUnsubscribed     = "report_subscription.deleted"
+	AuditEscalationRuleSaved    = "escalation_rule.saved"
+	AuditEscalationRuleDeleted  = "escalation_rule.deleted"
+	AuditDeliveryRescheduled    = "ticket.delivery_rescheduled"
+	AuditTicketSnoozed          = "ticket.snoozed"
+	AuditTicketSnoozeDismissed  = "ticket.snooze_dismissed"
+	AuditStocktakeOpened        = "stocktake.opened"
+	AuditStocktakePosted        = "stocktake.posted"
+	AuditStocktakeCancelled     = "stocktake.cancelled"
+	AuditTicketPartAdded        = "ticket.part_added"
+	AuditMaintenanceChanged     = "maintenance.changed"
+)
+
+// AuditEntry is one recorded action with the values it changed.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	ActorID    string          `json:"actor_id,omitempty"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	IPAddress  string          `json:"ip_address,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditFilter narrows an audit log query. Zero values match everything.
+type AuditFilter struct {
+	ActorID    string
+	EntityType string
+	EntityID   string
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+}
+
+// AuditService records who did what across the system
+type AuditService struct {
+	db *sql.DB
+}
+
+func NewAuditService(database *sql.DB) *AuditService {
+	return &AuditService{db: database}
+}
+
+// Record logs an action by the authenticated caller of r.
+func (as *AuditService) Record(r *http.Request, action, entityType, entityID string, before, after interface{}) {
+	as.RecordAs(r, actorID(r), action, entityType, entityID, before, after)
+}
+
+// RecordAs logs an action for an explicit actor, for routes such as login
+// that run before the caller is authenticated. Failures are logged rather
+// than failing the request that has already succeeded.
+func (as *AuditService) RecordAs(r *http.Request, actor, action, entityType, entityID string, before, after interface{}) {
+	beforeJSON, err := auditJSON(before)
+	if err == nil {
+		var afterJSON sql.NullString
+		afterJSON, err = auditJSON(after)
+		if err == nil {
+			_, err = as.db.Exec(`
+				INSERT INTO audit_log (actor_id, action, entity_type, entity_id, before_value, after_value, ip_address)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, nullString(actor), action, entityType, nullString(entityID), beforeJSON, afterJSON, nullString(clientIP(r)))
+		}
+	}
+	if err != nil {
+		log.Printf("Error writing audit log entry %s %s/%s: %v", action, entityType, entityID, err)
+	}
+}
+
+func auditJSON(value interface{}) (sql.NullString, error) {
+	if value == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// Query returns matching entries, newest first.
+func (as *AuditService) Query(filter AuditFilter) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.ActorID != "" {
+		conditions = append(conditions, "actor_id = ?")
+		args = append(args, filter.ActorID)
+	}
+	if filter.EntityType != "" {
+		conditions = append(conditions, "entity_type = ?")
+		args = append(args, filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		conditions = append(conditions, "entity_id = ?")
+		args = append(args, filter.EntityID)
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, *filter.From)
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, *filter.To)
+	}
+
+	query := `SELECT id, actor_id, action, entity_type, entity_id, before_value, after_value, ip_address, created_at FROM audit_log`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ?`
+	args = append(args, filter.Limit)
+
+	rows, err := as.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var actor, entityID, before, after, ip sql.NullString
+		if err := rows.Scan(&entry.ID, &actor, &entry.Action, &entry.EntityType, &entityID,
+			&before, &after, &ip, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entry.ActorID = actor.String
+		entry.EntityID = entityID.String
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entry.IPAddress = ip.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+var auditService *AuditService
+
+// AuditLogHandler queries the audit log. Filters: user_id, entity_type,
+// entity_id, from and to (YYYY-MM-DD or RFC3339; a bare date for "to" is
+// inclusive) and limit (default 100, max 1000).
+func AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		ActorID:    query.Get("user_id"),
+		EntityType: query.Get("entity_type"),
+		EntityID:   query.Get("entity_id"),
+		Limit:      100,
+	}
+
+	var fieldErrors ValidationErrors
+	filter.From = parseDateField("from", query.Get("from"), &fieldErrors)
+	filter.To = parseDateField("to", query.Get("to"), &fieldErrors)
+	if filter.To != nil && len(query.Get("to")) == len("2006-01-02") {
+		end := filter.To.AddDate(0, 0, 1)
+		filter.To = &end
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 1000 {
+			fieldErrors.Add("limit", "must be between 1 and 1000")
+		} else {
+			filter.Limit = n
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	entries, err := auditService.Query(filter)
+	if err != nil {
+		log.Printf("Error querying audit log: %v", err)
+		http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
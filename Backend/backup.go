@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Data backup consent recorded at intake.
+const (
+	BackupConsentDeclined      = "declined"           // Customer accepts the risk of data loss
+	BackupConsentSelfManaged   = "customer_backed_up" // Customer made their own backup
+	BackupConsentRequestBackup = "request_backup"     // Shop backs the data up before work starts
+)
+
+var backupConsents = []string{BackupConsentDeclined, BackupConsentSelfManaged, BackupConsentRequestBackup}
+
+// backupChecklist is the verification every backup must pass before the
+// device may be wiped or repaired.
+var backupChecklist = []string{
+	"files_copied",
+	"checksums_verified",
+	"customer_folders_confirmed",
+	"test_restore",
+}
+
+const backupJobsTable = `
+	CREATE TABLE IF NOT EXISTS backup_jobs (
+		order_id VARCHAR(50) PRIMARY KEY,
+		size_gb DECIMAL(10,2) NOT NULL,
+		quoted_price DECIMAL(10,2) NOT NULL,
+		storage_target VARCHAR(255) NOT NULL,
+		checklist JSON NULL,
+		proof_url VARCHAR(500) NULL,
+		status ENUM('quoted', 'verified') NOT NULL DEFAULT 'quoted',
+		created_by VARCHAR(50) NULL,
+		verified_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		verified_at TIMESTAMP NULL,
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// BackupJob is the data backup sub-flow of a ticket: sized and quoted at
+// intake, written to a storage target and verified with proof before work.
+type BackupJob struct {
+	OrderID       string          `json:"order_id"`
+	SizeGB        float64         `json:"size_gb"`
+	QuotedPrice   Money           `json:"quoted_price"`
+	StorageTarget string          `json:"storage_target"`
+	Checklist     map[string]bool `json:"checklist,omitempty"`
+	ProofURL      string          `json:"proof_url,omitempty"`
+	Status        string          `json:"status"`
+	CreatedBy     string          `json:"created_by,omitempty"`
+	VerifiedBy    string          `json:"verified_by,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	VerifiedAt    *time.Time      `json:"verified_at,omitempty"`
+}
+
+// BackupService handles backup job database operations
+type BackupService struct {
+	db *sql.DB
+}
+
+func NewBackupService(database *sql.DB) *BackupService {
+	return &BackupService{db: database}
+}
+
+var errBackupNotRequested = fmt.Errorf("customer has not requested a data backup")
+
+var errBackupExists = errors.New("a backup job has already been quoted for this order")
+
+// QuoteBackup opens the backup job for an order and bills the quoted price
+// as a line item on the ticket.
+func (bs *BackupService) QuoteBackup(job *BackupJob, actorID string) error {
+	tx, err := bs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var consent sql.NullString
+	if err := tx.QueryRow(`SELECT data_backup_consent FROM orders WHERE id = ? FOR UPDATE`, job.OrderID).Scan(&consent); err != nil {
+		return err
+	}
+	if consent.String != BackupConsentRequestBackup {
+		return errBackupNotRequested
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO backup_jobs (order_id, size_gb, quoted_price, storage_target, created_by)
+		VALUES (?, ?, ?, ?, ?)
+	`, job.OrderID, job.SizeGB, job.QuotedPrice, job.StorageTarget, nullString(actorID))
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return errBackupExists
+	}
+	if err != nil {
+		return err
+	}
+
+	item := ItemAddedPayload{
+		Description:  fmt.Sprintf("Data backup (%.2f GB)", job.SizeGB),
+		Amount:       job.QuotedPrice,
+		WarrantyDays: noWarranty,
+	}
+	if _, err := orderService.events.Append(tx, job.OrderID, EventItemAdded, actorID, item); err != nil {
+		return err
+	}
+
+	if err := migrationService.DualWrite(tx, "orders", job.OrderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// VerifyBackup records the completed checklist and proof of backup.
+func (bs *BackupService) VerifyBackup(orderID string, checklist map[string]bool, proofURL, actorID string) error {
+	checklistJSON, err := json.Marshal(checklist)
+	if err != nil {
+		return err
+	}
+
+	result, err := bs.db.Exec(`
+		UPDATE backup_jobs
+		SET checklist = ?, proof_url = ?, status = 'verified', verified_by = ?, verified_at = NOW()
+		WHERE order_id = ?
+	`, string(checklistJSON), proofURL, nullString(actorID), orderID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (bs *BackupService) GetBackupJob(orderID string) (*BackupJob, error) {
+	var job BackupJob
+	var checklistJSON, proofURL, createdBy, verifiedBy sql.NullString
+	var verifiedAt sql.NullTime
+
+	err := bs.db.QueryRow(`
+		SELECT order_id, size_gb, quoted_price, storage_target, checklist, proof_url, status,
+		       created_by, verified_by, created_at, verified_at
+		FROM backup_jobs WHERE order_id = ?
+	`, orderID).Scan(&job.OrderID, &job.SizeGB, &job.QuotedPrice, &job.StorageTarget, &checklistJSON,
+		&proofURL, &job.Status, &createdBy, &verifiedBy, &job.CreatedAt, &verifiedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if checklistJSON.Valid {
+		if err := json.Unmarshal([]byte(checklistJSON.String), &job.Checklist); err != nil {
+			return nil, err
+		}
+	}
+	job.ProofURL = proofURL.String
+	job.CreatedBy = createdBy.String
+	job.VerifiedBy = verifiedBy.String
+	job.VerifiedAt = timePtr(verifiedAt)
+	return &job, nil
+}
+
+var backupService *BackupService
+
+// backupStatusGuard keeps a ticket whose customer asked for a backup out of
+// the workshop, and so out of every status past New Order, until that backup
+// has been verified.
+func backupStatusGuard(tx *sql.Tx, orderID, from, to string) error {
+	if !slices.Contains(orderStatuses[1:], to) {
+		return nil
+	}
+
+	var consent, backupStatus sql.NullString
+	err := tx.QueryRow(`
+		SELECT o.data_backup_consent, b.status
+		FROM orders o LEFT JOIN backup_jobs b ON b.order_id = o.id
+		WHERE o.id = ?
+	`, orderID).Scan(&consent, &backupStatus)
+	if err != nil {
+		return err
+	}
+
+	if consent.String == BackupConsentRequestBackup && backupStatus.String != "verified" {
+		return &StatusGuardError{Reason: "the requested data backup must be verified before work begins"}
+	}
+	return nil
+}
+
+// BackupJobHandler returns (GET) or quotes (POST) the backup job of an order.
+func BackupJobHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		orderID := r.URL.Query().Get("order_id")
+		if orderID == "" {
+			http.Error(w, "order_id is required", http.StatusBadRequest)
+			return
+		}
+
+		job, err := backupService.GetBackupJob(orderID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Backup job not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrieving backup job for %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve backup job", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+
+	case "POST":
+		var request struct {
+			OrderID       string  `json:"order_id"`
+			SizeGB        float64 `json:"size_gb"`
+			QuotedPrice   Money   `json:"quoted_price"`
+			StorageTarget string  `json:"storage_target"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if request.SizeGB <= 0 {
+			fieldErrors.Add("size_gb", "must be greater than zero")
+		}
+		if request.QuotedPrice < 0 {
+			fieldErrors.Add("quoted_price", "must not be negative")
+		}
+		if request.StorageTarget == "" {
+			fieldErrors.Add("storage_target", "is required")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		job := &BackupJob{
+			OrderID:       request.OrderID,
+			SizeGB:        request.SizeGB,
+			QuotedPrice:   request.QuotedPrice,
+			StorageTarget: request.StorageTarget,
+		}
+		err := backupService.QuoteBackup(job, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errBackupNotRequested || err == errBackupExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error quoting backup for %s: %v", request.OrderID, err)
+			http.Error(w, "Failed to create backup job", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Backup job quoted successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// VerifyBackupHandler completes the verification checklist with proof of
+// backup, which releases the ticket to the workshop.
+func VerifyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID   string          `json:"order_id"`
+		Checklist map[string]bool `json:"checklist"`
+		ProofURL  string          `json:"proof_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.OrderID == "" {
+		fieldErrors.Add("order_id", "is required")
+	}
+	for _, step := range backupChecklist {
+		if !request.Checklist[step] {
+			fieldErrors.Add("checklist."+step, "must be completed")
+		}
+	}
+	if request.ProofURL == "" {
+		fieldErrors.Add("proof_url", "is required")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := backupService.VerifyBackup(request.OrderID, request.Checklist, request.ProofURL, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Backup job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying backup for %s: %v", request.OrderID, err)
+		http.Error(w, "Failed to verify backup", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Backup verified successfully",
+	})
+}
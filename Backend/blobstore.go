@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attachment files live in a blob store: a directory on local disk, or a
+// bucket on any S3-compatible service (AWS S3, MinIO, Ceph, Backblaze B2)
+// addressed path-style and signed with AWS Signature Version 4. The store an
+// attachment was written to is recorded with it, so switching
+// ATTACHMENT_STORAGE only affects new uploads.
+
+// Blob store backends
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// BlobStore keeps attachment files under a key.
+type BlobStore interface {
+	// Key returns where the file of an attachment is stored.
+	Key(orderID, attachmentID string) string
+	Put(key string, content io.Reader, size int64, contentType, sha256Hex string) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// blobPresigner is a store that can hand out its own time-limited download
+// URLs.
+type blobPresigner interface {
+	PresignGet(key, filename string, ttl time.Duration) (string, error)
+}
+
+// localBlobStore keeps files under a directory; its keys are file paths.
+type localBlobStore struct {
+	dir string
+}
+
+func (ls *localBlobStore) Key(orderID, attachmentID string) string {
+	return filepath.Join(ls.dir, orderID, attachmentID)
+}
+
+func (ls *localBlobStore) Put(key string, content io.Reader, size int64, contentType, sha256Hex string) error {
+	if err := os.MkdirAll(filepath.Dir(key), 0o750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(key, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(key)
+	}
+	return err
+}
+
+// Open returns the *os.File, so downloads can serve ranges.
+func (ls *localBlobStore) Open(key string) (io.ReadCloser, error) {
+	return os.Open(key)
+}
+
+func (ls *localBlobStore) Delete(key string) error {
+	if err := os.Remove(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// s3BlobStore keeps files in a bucket of an S3-compatible service.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3BlobStore reads the S3_* environment variables.
+func newS3BlobStore() (*s3BlobStore, error) {
+	endpoint, err := url.Parse(getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT must be a URL such as https://s3.amazonaws.com")
+	}
+	store := &s3BlobStore{
+		endpoint:  endpoint,
+		bucket:    getEnv("S3_BUCKET", ""),
+		region:    getEnv("S3_REGION", "us-east-1"),
+		accessKey: getEnv("S3_ACCESS_KEY", ""),
+		secretKey: getEnv("S3_SECRET_KEY", ""),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if store.bucket == "" || store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for S3 storage")
+	}
+	return store, nil
+}
+
+func (ss *s3BlobStore) Key(orderID, attachmentID string) string {
+	return orderID + "/" + attachmentID
+}
+
+// objectURL returns the path-style URL of an object.
+func (ss *s3BlobStore) objectURL(key string) *url.URL {
+	u := *ss.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + ss.bucket + "/" + key
+	u.RawPath = ""
+	u.RawQuery = ""
+	return &u
+}
+
+// s3Escape percent-encodes everything but unreserved characters, as
+// Signature Version 4 requires; slashes are kept in paths.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signature computes the Signature Version 4 signature of a canonical
+// request made at now.
+func (ss *s3BlobStore) signature(canonicalRequest string, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + ss.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+ss.secretKey), amzDate[:8])
+	key = hmacSHA256(key, ss.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// do sends a signed request for an object.
+func (ss *s3BlobStore) do(method, key string, body io.Reader, size int64, contentType, payloadHash string) (*http.Response, error) {
+	u := ss.objectURL(key)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3Escape(u.Path, true),
+		"",
+		"host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		ss.accessKey, amzDate[:8], ss.region, signedHeaders, ss.signature(canonicalRequest, now)))
+
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s returned %s: %s", method, key, resp.Status, bytes.TrimSpace(detail))
+	}
+	return resp, nil
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (ss *s3BlobStore) Put(key string, content io.Reader, size int64, contentType, sha256Hex string) error {
+	resp, err := ss.do("PUT", key, content, size, contentType, sha256Hex)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (ss *s3BlobStore) Open(key string) (io.ReadCloser, error) {
+	resp, err := ss.do("GET", key, nil, 0, "", emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (ss *s3BlobStore) Delete(key string) error {
+	resp, err := ss.do("DELETE", key, nil, 0, "", emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// PresignGet returns a query-signed download URL that names the file.
+func (ss *s3BlobStore) PresignGet(key, filename string, ttl time.Duration) (string, error) {
+	u := ss.objectURL(key)
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", fmt.Sprintf("%s/%s/%s/s3/aws4_request", ss.accessKey, amzDate[:8], ss.region))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	query.Set("response-content-disposition", attachmentDisposition(filename))
+	// Encode sorts by key; SigV4 wants %20 rather than + for spaces
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		s3Escape(u.Path, true),
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + ss.signature(canonicalRequest, now)
+	return u.String(), nil
+}
+
+// newBlobStores returns every configured store and the name of the one new
+// uploads go to (ATTACHMENT_STORAGE). The local store is always available,
+// and the S3 store whenever S3_BUCKET is set, so attachments written before
+// a switch stay readable.
+func newBlobStores(config StorageConfig) (map[string]BlobStore, string, error) {
+	stores := map[string]BlobStore{StorageLocal: &localBlobStore{dir: config.Dir}}
+	backend := strings.ToLower(getEnv("ATTACHMENT_STORAGE", StorageLocal))
+	if backend != StorageLocal && backend != StorageS3 {
+		return nil, "", fmt.Errorf("ATTACHMENT_STORAGE must be local or s3")
+	}
+	if backend == StorageS3 || getEnv("S3_BUCKET", "") != "" {
+		store, err := newS3BlobStore()
+		if err != nil {
+			return nil, "", err
+		}
+		stores[StorageS3] = store
+	}
+	return stores, backend, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// The ticket board shows one column per workflow status, each holding its
+// tickets in the order staff arranged them. Columns page independently
+// (GET /api/v1/board?status=In Progress&page=2), and dragging a card is one
+// POST /api/v1/board/move that changes the ticket's status through the usual
+// guards and puts it at its new place in the same transaction, so a refused
+// move leaves the board as it was. Tickets nobody has placed sit below the
+// placed ones, most recently updated first.
+
+// boardStatuses are the board's columns: the workflow statuses, with
+// reopened tickets waiting next to new ones to go through it again. Reopened
+// is shown only; tickets get there through the reopen endpoint.
+var boardStatuses = slices.Insert(slices.Clone(orderStatuses), 1, StatusReopened)
+
+// boardOrder sorts a column's cards.
+const boardOrder = `board_position IS NULL, board_position, updated_at DESC, id`
+
+var errBoardMoveForbidden = errors.New("your role cannot move tickets to this status")
+
+// BoardColumn is one page of a board column.
+type BoardColumn struct {
+	Status      string  `json:"status"`
+	Count       int     `json:"count"` // Tickets in the column on all pages
+	CanMoveHere bool    `json:"can_move_here"`
+	Cards       []Order `json:"cards"`
+	Page        int     `json:"page"`
+	PageSize    int     `json:"page_size"`
+	HasMore     bool    `json:"has_more"`
+}
+
+// BoardService reads and arranges the ticket board
+type BoardService struct {
+	db *sql.DB
+}
+
+func NewBoardService(database *sql.DB) *BoardService {
+	return &BoardService{db: database}
+}
+
+var boardService *BoardService
+
+// Column returns one page of the tickets in status that match filter.
+func (bs *BoardService) Column(status string, filter OrderListFilter, page, pageSize int) (*BoardColumn, error) {
+	where, args := filter.where()
+	where = `status = ? AND deleted_at IS NULL` + where
+	args = append([]interface{}{status}, args...)
+
+	column := &BoardColumn{Status: status, Page: page, PageSize: pageSize}
+	if err := bs.db.QueryRow(`SELECT COUNT(*) FROM orders WHERE `+where, args...).Scan(&column.Count); err != nil {
+		return nil, err
+	}
+	cards, err := orderService.queryOrders(`SELECT `+orderColumns+` FROM orders WHERE `+where+`
+		ORDER BY `+boardOrder+` LIMIT ? OFFSET ?`, append(args, pageSize, (page-1)*pageSize)...)
+	if err != nil {
+		return nil, err
+	}
+	column.Cards = cards
+	column.HasMore = page*pageSize < column.Count
+	return column, nil
+}
+
+// Move puts a ticket at position (0 is the top) in status's column, changing
+// its status first when it is in another column. The status change needs
+// allowed; moves within a column do not. It returns the ticket's previous
+// status.
+func (bs *BoardService) Move(orderID, status string, position int, allowed bool, actorID string) (string, error) {
+	tx, err := bs.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	current, err := orderService.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if current != status {
+		if status == StatusReopened {
+			return "", &StatusGuardError{Reason: "tickets are reopened with POST /api/v1/orders/{id}/reopen"}
+		}
+		if !allowed {
+			return "", errBoardMoveForbidden
+		}
+		if err := orderService.changeStatus(tx, orderID, current, status, actorID); err != nil {
+			return "", err
+		}
+	}
+
+	// Lock the column so concurrent moves into it renumber one at a time
+	rows, err := tx.Query(`SELECT id, board_position FROM orders
+		WHERE status = ? AND deleted_at IS NULL AND id <> ? ORDER BY `+boardOrder+` FOR UPDATE`, status, orderID)
+	if err != nil {
+		return "", err
+	}
+	var cards []string
+	placed := 0
+	for rows.Next() {
+		var id string
+		var boardPosition sql.NullInt64
+		if err := rows.Scan(&id, &boardPosition); err != nil {
+			rows.Close()
+			return "", err
+		}
+		if boardPosition.Valid {
+			placed++
+		}
+		cards = append(cards, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	// Cards above the moved one become placed; unplaced cards below it stay
+	// where the default order puts them
+	position = min(position, len(cards))
+	cards = slices.Insert(cards, position, orderID)
+	for i, id := range cards[:max(placed+1, position+1)] {
+		if _, err := tx.Exec(`UPDATE orders SET board_position = ?, updated_at = updated_at WHERE id = ?`, i+1, id); err != nil {
+			return "", err
+		}
+	}
+
+	return current, tx.Commit()
+}
+
+// parseBoardPage reads ?page= and ?page_size= for a board column.
+func parseBoardPage(r *http.Request, fieldErrors *ValidationErrors) (int, int) {
+	page, pageSize := 1, 25
+	if raw := r.URL.Query().Get("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			fieldErrors.Add("page", "must be a positive number")
+		} else {
+			page = n
+		}
+	}
+	if raw := r.URL.Query().Get("page_size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 100 {
+			fieldErrors.Add("page_size", "must be between 1 and 100")
+		} else {
+			pageSize = n
+		}
+	}
+	return page, pageSize
+}
+
+// BoardHandler returns the first page of every board column, or the
+// requested page of one column with ?status=. Columns take the ticket list
+// filters (?priority=, ?tag=, ?overdue=) and ?page_size=.
+func BoardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	statuses := boardStatuses
+	if status := r.URL.Query().Get("status"); status != "" {
+		if !slices.Contains(boardStatuses, status) {
+			fieldErrors.Add("status", fmt.Sprintf("%q is not a board column", status))
+		}
+		statuses = []string{status}
+	}
+	filter := parseOrderListFilter(r.URL.Query(), "updated", &fieldErrors)
+	filter.SnoozedBy = actorID(r)
+	page, pageSize := parseBoardPage(r, &fieldErrors)
+	if len(statuses) > 1 && page != 1 {
+		fieldErrors.Add("page", "needs a status")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	columns := []BoardColumn{}
+	for _, status := range statuses {
+		column, err := boardService.Column(status, filter, page, pageSize)
+		if err != nil {
+			log.Printf("Error retrieving board column %s: %v", status, err)
+			http.Error(w, "Failed to retrieve board", http.StatusInternalServerError)
+			return
+		}
+		column.CanMoveHere = status != StatusReopened && canSetStatus(r, status)
+		piiPolicyFor(r).shapeOrders(column.Cards)
+		columns = append(columns, *column)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"columns": columns,
+	})
+}
+
+// BoardMoveHandler moves a ticket on the board (POST {"order_id": "...",
+// "status": "In Progress", "position": 0}).
+func BoardMoveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID  string `json:"order_id"`
+		Status   string `json:"status"`
+		Position int    `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.OrderID == "" {
+		fieldErrors.Add("order_id", "is required")
+	}
+	if !slices.Contains(boardStatuses, request.Status) {
+		fieldErrors.Add("status", fmt.Sprintf("%q is not a board column", request.Status))
+	}
+	if request.Position < 0 {
+		fieldErrors.Add("position", "cannot be negative")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	previous, err := boardService.Move(request.OrderID, request.Status, request.Position, canSetStatus(r, request.Status), actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err == errBoardMoveForbidden {
+		http.Error(w, "Your role cannot move tickets to this status", http.StatusForbidden)
+		return
+	}
+	var guardErr *StatusGuardError
+	if errors.As(err, &guardErr) {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error moving order %s on the board: %v", request.OrderID, err)
+		http.Error(w, "Failed to move ticket", http.StatusInternalServerError)
+		return
+	}
+
+	if previous != request.Status {
+		auditService.Record(r, AuditStatusChanged, "order", request.OrderID,
+			map[string]string{"status": previous}, map[string]string{"status": request.Status})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":         "Ticket moved successfully",
+		"previous_status": previous,
+		"status":          request.Status,
+	})
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build orders are custom PCs assembled from inventory. They ride on an
+// order of ticket type build_to_order, so they share the customer record,
+// payments and event stream, but follow their own flow: pick components,
+// assemble against a checklist, pass burn-in, then invoice.
+
+const buildTicketType = "build_to_order"
+
+const buildOrdersTable = `
+	CREATE TABLE IF NOT EXISTS build_orders (
+		order_id VARCHAR(50) PRIMARY KEY,
+		status ENUM('planning', 'assembling', 'burn_in', 'ready', 'invoiced') NOT NULL DEFAULT 'planning',
+		assembly_fee DECIMAL(10,2) NOT NULL DEFAULT 0,
+		checklist JSON NULL,
+		burn_in_passed BOOLEAN NULL,
+		burn_in_results JSON NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		invoiced_at TIMESTAMP NULL,
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const buildComponentsTable = `
+	CREATE TABLE IF NOT EXISTS build_components (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		part_sku VARCHAR(64) NOT NULL,
+		quantity INT NOT NULL,
+		unit_price DECIMAL(10,2) NOT NULL,
+		INDEX idx_build_components_order (order_id),
+		FOREIGN KEY (order_id) REFERENCES build_orders(order_id) ON DELETE CASCADE,
+		FOREIGN KEY (part_sku) REFERENCES parts(sku)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// buildChecklist is the assembly checklist every build must complete.
+var buildChecklist = []string{
+	"components_inspected",
+	"cpu_and_cooler_installed",
+	"memory_installed",
+	"storage_installed",
+	"cable_management",
+	"bios_updated",
+	"os_installed",
+	"drivers_installed",
+}
+
+// requiredBuildCategories must each appear in a complete picklist.
+var requiredBuildCategories = []string{"cpu", "motherboard", "memory", "storage", "psu", "case"}
+
+// psuHeadroomPercent is the margin the PSU must have over the summed draw.
+const psuHeadroomPercent = 20
+
+// BuildComponent is one picked inventory part.
+type BuildComponent struct {
+	PartSKU   string `json:"part_sku"`
+	Name      string `json:"name"`
+	Category  string `json:"category"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice Money  `json:"unit_price"`
+
+	attributes map[string]string
+}
+
+// BurnInResults are the measurements of a burn-in run.
+type BurnInResults struct {
+	DurationMinutes int     `json:"duration_minutes"`
+	MaxCPUTempC     float64 `json:"max_cpu_temp_c"`
+	MaxGPUTempC     float64 `json:"max_gpu_temp_c,omitempty"`
+	Errors          int     `json:"errors"`
+	Notes           string  `json:"notes,omitempty"`
+}
+
+// BuildOrder is the build side of a build_to_order ticket.
+type BuildOrder struct {
+	OrderID       string           `json:"order_id"`
+	Status        string           `json:"status"`
+	AssemblyFee   Money            `json:"assembly_fee"`
+	Components    []BuildComponent `json:"components"`
+	Warnings      []string         `json:"warnings"`
+	Checklist     map[string]bool  `json:"checklist"`
+	BurnInPassed  *bool            `json:"burn_in_passed,omitempty"`
+	BurnInResults *BurnInResults   `json:"burn_in_results,omitempty"`
+	ComponentsSum Money            `json:"components_total"`
+	CreatedBy     string           `json:"created_by,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	InvoicedAt    *time.Time       `json:"invoiced_at,omitempty"`
+}
+
+var (
+	errNotBuildTicket   = errors.New("order is not a build-to-order ticket")
+	errBuildStarted     = errors.New("a build has already been started for this order")
+	errBuildInvoiced    = errors.New("build has already been invoiced")
+	errBuildNotReady    = errors.New("build is not at this stage yet: complete the checklist, pass burn-in, then invoice")
+	errBuildAssembled   = errors.New("components cannot change once assembly is complete; reopen a checklist step first")
+	errInsufficientPart = errors.New("not enough stock for a picked component")
+)
+
+// compatibilityWarnings checks a picklist for missing parts and spec
+// mismatches. Warnings never block the build; staff may know better.
+func compatibilityWarnings(components []BuildComponent) []string {
+	warnings := []string{}
+	byCategory := map[string][]BuildComponent{}
+	for _, c := range components {
+		byCategory[c.Category] = append(byCategory[c.Category], c)
+	}
+
+	for _, category := range requiredBuildCategories {
+		if len(byCategory[category]) == 0 {
+			warnings = append(warnings, "No "+category+" selected")
+		}
+	}
+
+	var board map[string]string
+	if boards := byCategory["motherboard"]; len(boards) > 0 {
+		board = boards[0].attributes
+	}
+	if board != nil {
+		for _, cpu := range byCategory["cpu"] {
+			if socket := cpu.attributes["socket"]; socket != "" && board["socket"] != "" && socket != board["socket"] {
+				warnings = append(warnings, fmt.Sprintf("CPU %s needs socket %s but the motherboard has %s", cpu.Name, socket, board["socket"]))
+			}
+		}
+		for _, memory := range byCategory["memory"] {
+			if kind := memory.attributes["memory_type"]; kind != "" && board["memory_type"] != "" && kind != board["memory_type"] {
+				warnings = append(warnings, fmt.Sprintf("Memory %s is %s but the motherboard takes %s", memory.Name, kind, board["memory_type"]))
+			}
+		}
+		for _, chassis := range byCategory["case"] {
+			supported := chassis.attributes["form_factors"]
+			if supported != "" && board["form_factor"] != "" && !containsFold(strings.Split(supported, ","), board["form_factor"]) {
+				warnings = append(warnings, fmt.Sprintf("Case %s does not fit a %s motherboard", chassis.Name, board["form_factor"]))
+			}
+		}
+	}
+
+	draw := 0
+	for _, c := range components {
+		if watts, err := strconv.Atoi(c.attributes["power_draw_w"]); err == nil {
+			draw += watts * c.Quantity
+		}
+	}
+	for _, psu := range byCategory["psu"] {
+		watts, err := strconv.Atoi(psu.attributes["wattage"])
+		if err == nil && draw > 0 && watts*100 < draw*(100+psuHeadroomPercent) {
+			warnings = append(warnings, fmt.Sprintf("PSU %s (%dW) has less than %d%% headroom over the estimated %dW draw", psu.Name, watts, psuHeadroomPercent, draw))
+		}
+	}
+
+	return warnings
+}
+
+func containsFold(values []string, want string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), want) {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildService handles build order database operations
+type BuildService struct {
+	db *sql.DB
+}
+
+func NewBuildService(database *sql.DB) *BuildService {
+	return &BuildService{db: database}
+}
+
+// StartBuild opens the build record for a build_to_order ticket.
+func (bs *BuildService) StartBuild(orderID string, assemblyFee Money, actorID string) error {
+	var ticketType sql.NullString
+	err := bs.db.QueryRow(`SELECT ticket_type FROM orders WHERE id = ?`, orderID).Scan(&ticketType)
+	if err != nil {
+		return err
+	}
+	if ticketType.String != buildTicketType {
+		return errNotBuildTicket
+	}
+
+	result, err := bs.db.Exec(`INSERT IGNORE INTO build_orders (order_id, assembly_fee, created_by) VALUES (?, ?, ?)`,
+		orderID, assemblyFee, nullString(actorID))
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errBuildStarted
+	}
+	return nil
+}
+
+// lockBuild locks the build row for the rest of tx and returns its status.
+func (bs *BuildService) lockBuild(tx *sql.Tx, orderID string) (string, error) {
+	var status string
+	err := tx.QueryRow(`SELECT status FROM build_orders WHERE order_id = ? FOR UPDATE`, orderID).Scan(&status)
+	if err == nil && status == "invoiced" {
+		return status, errBuildInvoiced
+	}
+	return status, err
+}
+
+// SetComponents replaces the picklist, snapshotting current part prices.
+// Once assembly is complete the parts are the ones burn-in tested and
+// invoicing bills, so they stay fixed until the checklist is reopened.
+func (bs *BuildService) SetComponents(orderID string, picks map[string]int) error {
+	tx, err := bs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, err := bs.lockBuild(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if status != "planning" && status != "assembling" {
+		return errBuildAssembled
+	}
+
+	if _, err := tx.Exec(`DELETE FROM build_components WHERE order_id = ?`, orderID); err != nil {
+		return err
+	}
+	for sku, quantity := range picks {
+		result, err := tx.Exec(`
+			INSERT INTO build_components (order_id, part_sku, quantity, unit_price)
+			SELECT ?, sku, ?, unit_price FROM parts WHERE sku = ?
+		`, orderID, quantity, sku)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return fmt.Errorf("unknown part %s: %w", sku, sql.ErrNoRows)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SaveChecklist records assembly progress; a build with components moves to
+// assembling, and to burn_in once every step is done.
+func (bs *BuildService) SaveChecklist(orderID string, checklist map[string]bool) error {
+	checklistJSON, err := json.Marshal(checklist)
+	if err != nil {
+		return err
+	}
+
+	status := "burn_in"
+	for _, step := range buildChecklist {
+		if !checklist[step] {
+			status = "assembling"
+			break
+		}
+	}
+
+	result, err := bs.db.Exec(`
+		UPDATE build_orders SET checklist = ?, status = ?, burn_in_passed = IF(? = 'burn_in', burn_in_passed, NULL)
+		WHERE order_id = ? AND status <> 'invoiced'
+	`, string(checklistJSON), status, status, orderID)
+	return bs.requireBuildUpdate(result, err, orderID)
+}
+
+// RecordBurnIn stores a burn-in run; a pass makes the build ready to invoice.
+func (bs *BuildService) RecordBurnIn(orderID string, passed bool, results BurnInResults) error {
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	result, err := bs.db.Exec(`
+		UPDATE build_orders SET burn_in_passed = ?, burn_in_results = ?, status = IF(?, 'ready', 'burn_in')
+		WHERE order_id = ? AND status IN ('burn_in', 'ready')
+	`, passed, string(resultsJSON), passed, orderID)
+	return bs.requireBuildUpdate(result, err, orderID)
+}
+
+func (bs *BuildService) requireBuildUpdate(result sql.Result, err error, orderID string) error {
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+	build, err := bs.GetBuild(orderID)
+	if err != nil {
+		return err
+	}
+	if build.Status == "invoiced" {
+		return errBuildInvoiced
+	}
+	return errBuildNotReady
+}
+
+// Invoice converts a ready build into billable items on its ticket and
+// takes the components out of stock.
+func (bs *BuildService) Invoice(orderID, actorID string) error {
+	tx, err := bs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := orderService.lockOrderStatus(tx, orderID); err != nil {
+		return err
+	}
+	status, err := bs.lockBuild(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if status != "ready" {
+		return errBuildNotReady
+	}
+
+	components, err := loadBuildComponents(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range components {
+		result, err := tx.Exec(`UPDATE parts SET quantity_on_hand = quantity_on_hand - ? WHERE sku = ? AND quantity_on_hand >= ?`,
+			c.Quantity, c.PartSKU, c.Quantity)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return fmt.Errorf("%s: %w", c.PartSKU, errInsufficientPart)
+		}
+		_, err = takeFromLots(tx, StockMovement{PartSKU: c.PartSKU, Quantity: -c.Quantity, Reason: MovementBuild,
+			OrderID: orderID, ActorID: actorID}, "")
+		if err != nil {
+			return err
+		}
+
+		item := ItemAddedPayload{
+			Description:  fmt.Sprintf("%s x%d", c.Name, c.Quantity),
+			Amount:       c.UnitPrice * Money(c.Quantity),
+			WarrantyKind: WarrantyParts,
+		}
+		if _, err := orderService.events.Append(tx, orderID, EventItemAdded, actorID, item); err != nil {
+			return err
+		}
+	}
+
+	var assemblyFee Money
+	if err := tx.QueryRow(`SELECT assembly_fee FROM build_orders WHERE order_id = ?`, orderID).Scan(&assemblyFee); err != nil {
+		return err
+	}
+	if assemblyFee > 0 {
+		item := ItemAddedPayload{Description: "PC assembly and burn-in", Amount: assemblyFee, WarrantyKind: WarrantyLabor}
+		if _, err := orderService.events.Append(tx, orderID, EventItemAdded, actorID, item); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE build_orders SET status = 'invoiced', invoiced_at = NOW() WHERE order_id = ?`, orderID); err != nil {
+		return err
+	}
+
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func loadBuildComponents(q queryer, orderID string) ([]BuildComponent, error) {
+	rows, err := q.Query(`
+		SELECT c.part_sku, p.name, p.category, p.attributes, c.quantity, c.unit_price
+		FROM build_components c JOIN parts p ON p.sku = c.part_sku
+		WHERE c.order_id = ? ORDER BY c.id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	components := []BuildComponent{}
+	for rows.Next() {
+		var c BuildComponent
+		var attributes sql.NullString
+		if err := rows.Scan(&c.PartSKU, &c.Name, &c.Category, &attributes, &c.Quantity, &c.UnitPrice); err != nil {
+			return nil, err
+		}
+		c.attributes = map[string]string{}
+		if attributes.Valid {
+			if err := json.Unmarshal([]byte(attributes.String), &c.attributes); err != nil {
+				return nil, err
+			}
+		}
+		components = append(components, c)
+	}
+	return components, rows.Err()
+}
+
+func (bs *BuildService) GetBuild(orderID string) (*BuildOrder, error) {
+	var build BuildOrder
+	var checklist, burnInResults, createdBy sql.NullString
+	var burnInPassed sql.NullBool
+	var invoicedAt sql.NullTime
+
+	err := bs.db.QueryRow(`
+		SELECT order_id, status, assembly_fee, checklist, burn_in_passed, burn_in_results, created_by, created_at, invoiced_at
+		FROM build_orders WHERE order_id = ?
+	`, orderID).Scan(&build.OrderID, &build.Status, &build.AssemblyFee, &checklist, &burnInPassed,
+		&burnInResults, &createdBy, &build.CreatedAt, &invoicedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	build.Checklist = map[string]bool{}
+	if checklist.Valid {
+		if err := json.Unmarshal([]byte(checklist.String), &build.Checklist); err != nil {
+			return nil, err
+		}
+	}
+	if burnInPassed.Valid {
+		build.BurnInPassed = &burnInPassed.Bool
+	}
+	if burnInResults.Valid {
+		build.BurnInResults = &BurnInResults{}
+		if err := json.Unmarshal([]byte(burnInResults.String), build.BurnInResults); err != nil {
+			return nil, err
+		}
+	}
+	build.CreatedBy = createdBy.String
+	build.InvoicedAt = timePtr(invoicedAt)
+
+	build.Components, err = loadBuildComponents(bs.db, orderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range build.Components {
+		build.ComponentsSum += c.UnitPrice * Money(c.Quantity)
+	}
+	build.Warnings = compatibilityWarnings(build.Components)
+	return &build, nil
+}
+
+var buildService *BuildService
+
+// writeBuildError maps build workflow errors to responses.
+func writeBuildError(w http.ResponseWriter, err error, orderID, action string) {
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Build not found", http.StatusNotFound)
+	case err == errNotBuildTicket, err == errBuildStarted, err == errBuildInvoiced, err == errBuildNotReady, err == errBuildAssembled:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInsufficientPart):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		log.Printf("Error trying to %s for build %s: %v", action, orderID, err)
+		http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+	}
+}
+
+// BuildsHandler returns a build with its picklist and compatibility
+// warnings (GET ?order_id=) or opens one for a build_to_order ticket (POST).
+func BuildsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		orderID := r.URL.Query().Get("order_id")
+		if orderID == "" {
+			http.Error(w, "order_id is required", http.StatusBadRequest)
+			return
+		}
+
+		build, err := buildService.GetBuild(orderID)
+		if err != nil {
+			writeBuildError(w, err, orderID, "retrieve build")
+			return
+		}
+		json.NewEncoder(w).Encode(build)
+
+	case "POST":
+		var request struct {
+			OrderID     string `json:"order_id"`
+			AssemblyFee Money  `json:"assembly_fee"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if request.OrderID == "" || request.AssemblyFee < 0 {
+			http.Error(w, "Order ID and a non-negative assembly fee are required", http.StatusBadRequest)
+			return
+		}
+
+		err := buildService.StartBuild(request.OrderID, request.AssemblyFee, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeBuildError(w, err, request.OrderID, "start build")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Build started successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// BuildComponentsHandler replaces a build's picklist and returns the
+// compatibility warnings for it.
+func BuildComponentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "PUT" {
+		http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID    string `json:"order_id"`
+		Components []struct {
+			PartSKU  string `json:"part_sku"`
+			Quantity int    `json:"quantity"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.OrderID == "" {
+		fieldErrors.Add("order_id", "is required")
+	}
+	picks := map[string]int{}
+	for i, c := range request.Components {
+		if c.PartSKU == "" || c.Quantity < 1 {
+			fieldErrors.Add(fmt.Sprintf("components[%d]", i), "needs a part_sku and a positive quantity")
+			continue
+		}
+		picks[c.PartSKU] += c.Quantity
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if err := buildService.SetComponents(request.OrderID, picks); err != nil {
+		writeBuildError(w, err, request.OrderID, "update components")
+		return
+	}
+
+	build, err := buildService.GetBuild(request.OrderID)
+	if err != nil {
+		writeBuildError(w, err, request.OrderID, "retrieve build")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "Components updated successfully",
+		"warnings": build.Warnings,
+	})
+}
+
+// BuildChecklistHandler records assembly checklist progress.
+func BuildChecklistHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID   string          `json:"order_id"`
+		Checklist map[string]bool `json:"checklist"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.OrderID == "" {
+		http.Error(w, "Order ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	for step := range request.Checklist {
+		if !containsFold(buildChecklist, step) {
+			fieldErrors.Add("checklist."+step, "is not a build checklist step")
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if err := buildService.SaveChecklist(request.OrderID, request.Checklist); err != nil {
+		writeBuildError(w, err, request.OrderID, "update checklist")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Checklist updated successfully",
+	})
+}
+
+// BuildBurnInHandler records burn-in test results.
+func BuildBurnInHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID string        `json:"order_id"`
+		Passed  bool          `json:"passed"`
+		Results BurnInResults `json:"results"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.OrderID == "" {
+		fieldErrors.Add("order_id", "is required")
+	}
+	if request.Results.DurationMinutes <= 0 {
+		fieldErrors.Add("results.duration_minutes", "must be greater than zero")
+	}
+	if request.Results.Errors < 0 {
+		fieldErrors.Add("results.errors", "must not be negative")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if err := buildService.RecordBurnIn(request.OrderID, request.Passed, request.Results); err != nil {
+		writeBuildError(w, err, request.OrderID, "record burn-in")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Burn-in results recorded successfully",
+	})
+}
+
+// InvoiceBuildHandler converts a ready build into an invoice on its ticket.
+func InvoiceBuildHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID string `json:"order_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.OrderID == "" {
+		http.Error(w, "Order ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := buildService.Invoice(request.OrderID, actorID(r)); err != nil {
+		writeBuildError(w, err, request.OrderID, "invoice build")
+		return
+	}
+
+	log.Printf("Build %s invoiced by %s", request.OrderID, actorID(r))
+	auditService.Record(r, AuditBuildInvoiced, "order", request.OrderID, nil, nil)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Build invoiced successfully",
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Tickets are never hard-deleted: DELETE /api/v1/orders/{id} records a
+// TicketCancelled event with the reason, which moves the ticket to the
+// Cancelled status and stamps deleted_at. Lists, the dashboard and reports
+// leave out rows with deleted_at set; the ticket itself and its history stay
+// readable by ID. A ticket under legal hold cannot be cancelled.
+
+// StatusCancelled is the status of a cancelled ticket. It is not part of the
+// workflow in orderStatuses and is reached only by cancelling.
+const StatusCancelled = "Cancelled"
+
+// orderStatusEnumStatements extend the orders status ENUM of existing
+// databases with Cancelled and Reopened (reopen.go).
+var orderStatusEnumStatements = []string{
+	`ALTER TABLE orders MODIFY COLUMN status
+		ENUM('New Order', 'In Progress', 'Ready for Delivery', 'Collected', 'Cancelled', 'Reopened') DEFAULT 'New Order'`,
+}
+
+var errTicketAlreadyCancelled = errors.New("the ticket is already cancelled")
+
+// TicketCancelledPayload records why a ticket was cancelled and the status
+// it was in.
+type TicketCancelledPayload struct {
+	From       string `json:"from"`
+	Reason     string `json:"reason"`
+	MergedInto string `json:"merged_into,omitempty"` // Ticket a duplicate was merged into (merge.go)
+}
+
+// CancelOrder cancels a ticket that has not been collected.
+func (os *OrderService) CancelOrder(orderID, reason, actorID string) error {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := os.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if err := checkLegalHold(tx, orderID); err != nil {
+		return err
+	}
+	switch current {
+	case StatusCancelled:
+		return errTicketAlreadyCancelled
+	case closedStatus:
+		return &StatusGuardError{Reason: "a collected ticket cannot be cancelled"}
+	}
+
+	payload := TicketCancelledPayload{From: current, Reason: reason}
+	if _, err := os.events.Append(tx, orderID, EventTicketCancelled, actorID, payload); err != nil {
+		return err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// projectTicketCancelled marks the orders row cancelled and soft-deleted.
+func projectTicketCancelled(tx *sql.Tx, event *TicketEvent) error {
+	var payload TicketCancelledPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE orders
+		SET status = ?, deleted_at = ?, cancel_reason = ?, merged_into = NULLIF(?, ''),
+		    hold_state = NULL, hold_reason = NULL, hold_started_at = NULL, updated_at = ?, last_updated_by = NULLIF(?, '')
+		WHERE id = ?
+	`, StatusCancelled, event.OccurredAt, payload.Reason, payload.MergedInto, event.OccurredAt, event.ActorID, event.TicketID)
+	return err
+}
+
+// cancelledStatusGuard keeps a cancelled ticket out of the workflow.
+func cancelledStatusGuard(tx *sql.Tx, orderID, from, to string) error {
+	if from == StatusCancelled {
+		return &StatusGuardError{Reason: "the ticket is cancelled"}
+	}
+	return nil
+}
+
+// cancelOrder serves DELETE /api/v1/orders/{id} ({"reason": "..."}).
+func cancelOrder(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsCancel) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Reason == "" {
+		fieldErrors.Add("reason", "is required")
+	} else if len(request.Reason) > 500 {
+		fieldErrors.Add("reason", "is too long")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := orderService.CancelOrder(orderID, request.Reason, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err == errTicketAlreadyCancelled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if holdErr, ok := err.(*LegalHoldError); ok {
+		http.Error(w, holdErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling order %s: %v", orderID, err)
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Order %s cancelled: %s", orderID, request.Reason)
+	auditService.Record(r, AuditTicketCancelled, "order", orderID, nil, request)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Order cancelled successfully",
+	})
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GET /api/v1/orders/{id}/case-file bundles everything the shop holds on a
+// ticket into one PDF for insurance claims and legal disputes: the ticket
+// detail, devices and their check-in checklists, status history, every
+// note, the latest diagnosis, the estimate and the customer's decision, the
+// invoice with its payments, photos, the intake and delivery signatures
+// (signatures.go), and the other attachments (signed forms) listed with their
+// SHA-256 so the originals can be matched later. Customer details are masked
+// as on the ticket screen. Case files are exports (exportlog.go): limited to
+// the roles for case_file and recorded in the export log.
+//
+// The PDF is written by hand: Helvetica in WinAnsi encoding, so characters
+// outside Latin-1 print as "?". JPEG photos are embedded as they are, PNG
+// and GIF are re-encoded; other formats are listed by name only.
+
+// A4 page geometry in points.
+const (
+	pdfPageWidth    = 595.0
+	pdfPageHeight   = 842.0
+	pdfMargin       = 40.0
+	pdfBodySize     = 10.0
+	pdfHeadingSize  = 13.0
+	pdfLineSpacing  = 1.35
+	pdfMaxImageSide = 300.0
+)
+
+// caseFileMaxImageBytes caps the size of a photo embedded in a case file.
+const caseFileMaxImageBytes = 20 << 20
+
+type pdfImage struct {
+	width, height int
+	colorSpace    string
+	filter        string
+	data          []byte
+}
+
+// pdfDocument is a minimal PDF writer: text lines that flow down A4 pages
+// and images scaled to fit.
+type pdfDocument struct {
+	pages  []*bytes.Buffer
+	images []pdfImage
+	y      float64
+}
+
+func newPDFDocument() *pdfDocument {
+	doc := &pdfDocument{}
+	doc.newPage()
+	return doc
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// space moves down by height, starting a new page when it does not fit.
+func (d *pdfDocument) space(height float64) {
+	if d.y-height < pdfMargin {
+		d.newPage()
+	}
+	d.y -= height
+}
+
+// Text writes s wrapped to the page width.
+func (d *pdfDocument) Text(s string, size float64, bold bool, indent float64) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	// Helvetica averages about half its size per character
+	width := int((pdfPageWidth - 2*pdfMargin - indent) / (size * 0.5))
+	for _, paragraph := range strings.Split(s, "\n") {
+		for _, line := range wrapText(paragraph, width) {
+			d.space(size * pdfLineSpacing)
+			fmt.Fprintf(d.page(), "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n",
+				font, size, pdfMargin+indent, d.y, pdfEscape(line))
+		}
+	}
+}
+
+// Heading starts a section.
+func (d *pdfDocument) Heading(s string) {
+	d.space(pdfHeadingSize)
+	d.Text(s, pdfHeadingSize, true, 0)
+	d.space(2)
+	fmt.Fprintf(d.page(), "%.1f %.1f m %.1f %.1f l S\n", pdfMargin, d.y, pdfPageWidth-pdfMargin, d.y)
+	d.space(4)
+}
+
+// Field writes one "label: value" line, skipping empty values.
+func (d *pdfDocument) Field(label, value string) {
+	if value == "" {
+		return
+	}
+	d.Text(label+": "+value, pdfBodySize, false, 0)
+}
+
+// Image draws img scaled down to fit pdfMaxImageSide.
+func (d *pdfDocument) Image(img pdfImage) {
+	w, h := float64(img.width), float64(img.height)
+	if scale := pdfMaxImageSide / max(w, h); scale < 1 {
+		w, h = w*scale, h*scale
+	}
+	d.space(h + 4)
+	fmt.Fprintf(d.page(), "q %.1f 0 0 %.1f %.1f %.1f cm /Im%d Do Q\n", w, h, pdfMargin, d.y, len(d.images)+1)
+	d.images = append(d.images, img)
+}
+
+// Bytes assembles the document: catalog, page tree, the two fonts, the
+// images, then each page and its content stream.
+func (d *pdfDocument) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+		out.WriteString("endobj\n")
+	}
+
+	firstImage := 5
+	firstPage := firstImage + len(d.images)
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	xobjects := make([]string, len(d.images))
+	for i := range d.images {
+		xobjects[i] = fmt.Sprintf("/Im%d %d 0 R", i+1, firstImage+i)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)), nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+	for _, img := range d.images {
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s /Length %d >>",
+			img.width, img.height, img.colorSpace, img.filter, len(img.data)), img.data)
+	}
+	resources := fmt.Sprintf("<< /Font << /F1 3 0 R /F2 4 0 R >> /XObject << %s >> >>", strings.Join(xobjects, " "))
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources %s /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, firstPage+2*i+1), nil)
+		object(fmt.Sprintf("<< /Length %d >>", content.Len()), content.Bytes())
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// wrapText breaks s into lines of at most width characters at spaces.
+func wrapText(s string, width int) []string {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return []string{""}
+	}
+	var lines []string
+	line := ""
+	for _, word := range words {
+		for len([]rune(word)) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			runes := []rune(word)
+			lines = append(lines, string(runes[:width]))
+			word = string(runes[width:])
+		}
+		switch {
+		case line == "":
+			line = word
+		case len([]rune(line))+1+len([]rune(word)) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	return append(lines, line)
+}
+
+// pdfWinAnsi maps the characters outside Latin-1 that WinAnsi can show.
+var pdfWinAnsi = map[rune]string{
+	'€': "\x80", '…': "\x85", '‘': "\x91", '’': "\x92", '“': "\x93", '”': "\x94",
+	'•': "\x95", '–': "\x96", '—': "\x97", '„': "\x84", '₹': "Rs.",
+}
+
+// pdfEscape encodes s as a WinAnsi PDF string literal body.
+func pdfEscape(s string) string {
+	var out strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			out.WriteRune(r)
+		case pdfWinAnsi[r] != "":
+			out.WriteString(pdfWinAnsi[r])
+		case r >= 0xa0 && r <= 0xff:
+			out.WriteByte(byte(r))
+		default:
+			out.WriteByte('?')
+		}
+	}
+	return out.String()
+}
+
+// pdfImageFrom prepares an attachment for embedding, or returns false for a
+// format that cannot be.
+func pdfImageFrom(contentType string, data []byte) (pdfImage, bool) {
+	switch contentType {
+	case "image/jpeg":
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return pdfImage{}, false
+		}
+		img := pdfImage{width: config.Width, height: config.Height, filter: "DCTDecode", data: data}
+		switch config.ColorModel {
+		case color.GrayModel:
+			img.colorSpace = "DeviceGray"
+		case color.YCbCrModel:
+			img.colorSpace = "DeviceRGB"
+		default: // CMYK JPEGs need an inverted decode array; list them instead
+			return pdfImage{}, false
+		}
+		return img, true
+	case "image/png", "image/gif":
+		var decoded image.Image
+		var err error
+		if contentType == "image/png" {
+			decoded, err = png.Decode(bytes.NewReader(data))
+		} else {
+			decoded, err = gif.Decode(bytes.NewReader(data))
+		}
+		if err != nil {
+			return pdfImage{}, false
+		}
+		bounds := decoded.Bounds()
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		row := make([]byte, 0, 3*bounds.Dx())
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row = row[:0]
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				// Transparent pixels go on white, as they would on paper
+				r, g, b, a := decoded.At(x, y).RGBA()
+				white := 0xffff - a
+				row = append(row, byte((r+white)>>8), byte((g+white)>>8), byte((b+white)>>8))
+			}
+			writer.Write(row)
+		}
+		writer.Close()
+		return pdfImage{width: bounds.Dx(), height: bounds.Dy(), colorSpace: "DeviceRGB", filter: "FlateDecode", data: compressed.Bytes()}, true
+	}
+	return pdfImage{}, false
+}
+
+// BuildCaseFile renders the case file of a ticket. order must already be
+// shaped for the reader's PII policy.
+func BuildCaseFile(order *Order, exportedBy string) ([]byte, error) {
+	detail, err := orderService.GetTicketDetail(order)
+	if err != nil {
+		return nil, err
+	}
+	locale := shopLocale
+	when := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return locale.FormatDateTime(*t)
+	}
+
+	doc := newPDFDocument()
+	doc.Text("Case file: ticket "+detail.ID, 18, true, 0)
+	doc.Text(fmt.Sprintf("Exported %s by %s", locale.FormatDateTime(time.Now()), exportedBy), pdfBodySize, false, 0)
+
+	doc.Heading("Ticket")
+	doc.Field("Status", detail.Status)
+	doc.Field("Type", detail.TicketType)
+	doc.Field("Booked in", locale.FormatDateTime(detail.CreatedAt))
+	doc.Field("Booked in by", detail.CreatedBy)
+	doc.Field("Last updated", locale.FormatDateTime(detail.UpdatedAt))
+	if detail.AssignedEngineer != nil {
+		doc.Field("Engineer", detail.AssignedEngineer.Name)
+	}
+	doc.Field("Expected delivery", when(detail.ExpectedDeliveryDate))
+	doc.Field("Warranty expires", when(detail.WarrantyExpDate))
+	doc.Field("Warranty claim of", detail.WarrantyClaimOf)
+	doc.Field("Reworks", detail.ParentTicketID)
+	doc.Field("Rework tickets", strings.Join(detail.ReworkTickets, ", "))
+	doc.Field("Merged into", detail.MergedInto)
+	doc.Field("Merged from", strings.Join(detail.MergedFrom, ", "))
+	doc.Field("Split from", detail.SplitFrom)
+	doc.Field("Split into", strings.Join(detail.SplitInto, ", "))
+	doc.Field("Cancelled", when(detail.CancelledAt))
+	doc.Field("Cancellation reason", detail.CancelReason)
+	if detail.Hold != nil {
+		doc.Field("On hold", fmt.Sprintf("%s since %s: %s", detail.Hold.HoldState, locale.FormatDateTime(detail.Hold.StartedAt), detail.Hold.Reason))
+	}
+	if detail.LegalHold != nil {
+		doc.Field("Legal hold", fmt.Sprintf("since %s: %s", locale.FormatDateTime(detail.LegalHold.PlacedAt), detail.LegalHold.Reason))
+		doc.Field("Legal hold reference", detail.LegalHold.Reference)
+	}
+	doc.Field("Services", strings.Join(detail.Services, ", "))
+	doc.Field("Issue", detail.IssueDescription)
+	for _, key := range sortedKeys(detail.CustomFields) {
+		doc.Field(key, detail.CustomFields[key])
+	}
+
+	doc.Heading("Customer")
+	doc.Field("Name", detail.Customer.Name)
+	doc.Field("Email", detail.Customer.Email)
+	doc.Field("Phone", detail.Customer.Phone)
+
+	doc.Heading("Devices")
+	for _, device := range detail.Devices {
+		doc.Text(fmt.Sprintf("%d. %s", device.Position, strings.TrimSpace(device.DeviceType+" "+device.DeviceModel)), pdfBodySize, true, 0)
+		doc.Field("  Serial", device.DeviceSerial)
+		doc.Field("  Note", device.Note)
+		for _, key := range sortedKeys(device.CustomFields) {
+			doc.Field("  "+key, device.CustomFields[key])
+		}
+	}
+
+	doc.Heading("Check-in checklist")
+	result := func(entry *ChecklistEntry) string {
+		if entry == nil {
+			return "-"
+		}
+		if entry.Notes != "" {
+			return entry.Result + " (" + entry.Notes + ")"
+		}
+		return entry.Result
+	}
+	for _, checklist := range detail.Checklist {
+		doc.Text(fmt.Sprintf("%d. %s", checklist.DevicePosition, checklist.DeviceType), pdfBodySize, true, 0)
+		for _, item := range checklist.Items {
+			line := fmt.Sprintf("%s: intake %s, delivery %s", item.Item, result(item.Intake), result(item.Delivery))
+			if item.Changed {
+				line += ", changed"
+			}
+			doc.Text(line, pdfBodySize, false, 12)
+		}
+	}
+
+	doc.Heading("Status history")
+	for _, change := range detail.StatusHistory {
+		line := locale.FormatDateTime(change.ChangedAt) + "  " + change.To
+		if change.From != "" {
+			line += " (from " + change.From + ")"
+		}
+		if change.ChangedBy != "" {
+			line += " by " + change.ChangedBy
+		}
+		doc.Text(line, pdfBodySize, false, 0)
+	}
+
+	notes, err := noteService.ListNotes(order.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	doc.Heading("Notes")
+	if len(notes) == 0 {
+		doc.Text("No notes.", pdfBodySize, false, 0)
+	}
+	for _, note := range notes {
+		author := note.AuthorName
+		if author == "" {
+			author = note.AuthorID
+		}
+		doc.Text(fmt.Sprintf("%s  %s (%s)", locale.FormatDateTime(note.CreatedAt), author, note.Visibility), pdfBodySize, true, 0)
+		doc.Text(note.Body, pdfBodySize, false, 12)
+	}
+
+	comparison, err := estimateService.Comparison(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	doc.Heading("Diagnosis")
+	if detail.Diagnosis == nil {
+		doc.Text("No diagnosis was written.", pdfBodySize, false, 0)
+	} else {
+		diagnosis := detail.Diagnosis
+		published := "not published"
+		if diagnosis.PublishedAt != nil {
+			published = "published " + locale.FormatDateTime(*diagnosis.PublishedAt)
+		}
+		doc.Text(fmt.Sprintf("Version %d by %s, %s (%s)", diagnosis.Version, diagnosis.CreatedBy,
+			locale.FormatDateTime(diagnosis.CreatedAt), published), pdfBodySize, true, 0)
+		doc.Field("Findings", diagnosis.Findings)
+		doc.Field("Root cause", diagnosis.RootCause)
+		doc.Field("Recommended actions", diagnosis.RecommendedActions)
+		for _, part := range diagnosis.PartsNeeded {
+			line := fmt.Sprintf("%d x %s", part.Quantity, part.Description)
+			if part.SKU != "" {
+				line += " (" + part.SKU + ")"
+			}
+			doc.Field("Part needed", line)
+		}
+	}
+
+	doc.Heading("Estimate")
+	if len(comparison.Options) == 0 {
+		doc.Text("No estimate was published.", pdfBodySize, false, 0)
+	}
+	for _, option := range comparison.Options {
+		line := fmt.Sprintf("Option %d: %s  %s", option.Position, option.Label, locale.FormatMoney(option.Amount))
+		if option.SelectedAt != nil {
+			line += "  (approved " + locale.FormatDateTime(*option.SelectedAt) + ")"
+		}
+		doc.Text(line, pdfBodySize, true, 0)
+		if option.Description != "" {
+			doc.Text(option.Description, pdfBodySize, false, 12)
+		}
+		for _, item := range option.Items {
+			doc.Text(item.Description+"  "+locale.FormatMoney(item.Amount), pdfBodySize, false, 12)
+		}
+	}
+	if comparison.RejectedAt != nil {
+		doc.Field("Rejected", locale.FormatDateTime(*comparison.RejectedAt))
+	}
+	doc.Field("Customer note", comparison.DecisionNote)
+
+	invoice, err := renderDocument(PrintJob{OrderID: order.ID, Document: "invoice"}, locale)
+	if err != nil {
+		return nil, err
+	}
+	doc.Heading("Invoice")
+	for _, section := range invoice.Sections {
+		doc.Text(section.Title, pdfBodySize, true, 0)
+		for _, item := range section.Items {
+			doc.Text(strings.TrimSpace(item.Label+"  "+item.Value), pdfBodySize, false, 12)
+		}
+		doc.Field("  Subtotal", section.Subtotal)
+	}
+	for _, total := range invoice.Totals {
+		doc.Field(total.Label, total.Value)
+	}
+	for _, payment := range detail.Financials.Payments {
+		line := fmt.Sprintf("Payment %s  %s by %s", locale.FormatDateTime(payment.RecordedAt), locale.FormatMoney(payment.Amount), payment.Method)
+		if payment.Reference != "" {
+			line += " (" + payment.Reference + ")"
+		}
+		doc.Text(line, pdfBodySize, false, 0)
+	}
+
+	attachments, _, err := attachmentService.ListAttachments(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	var documents []Attachment
+	doc.Heading("Photos")
+	photos := 0
+	for i := range attachments {
+		attachment := &attachments[i]
+		img, ok, err := caseFileImage(attachment)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			documents = append(documents, *attachment)
+			continue
+		}
+		photos++
+		doc.Image(img)
+		doc.Text(fmt.Sprintf("%s, uploaded %s", attachment.Filename, locale.FormatDateTime(attachment.CreatedAt)), 8, false, 0)
+		doc.Text("SHA-256 "+attachment.SHA256, 8, false, 0)
+	}
+	if photos == 0 {
+		doc.Text("No photos.", pdfBodySize, false, 0)
+	}
+
+	signatures, err := signatureService.List(order.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	doc.Heading("Signatures")
+	if len(signatures) == 0 {
+		doc.Text("No signatures.", pdfBodySize, false, 0)
+	}
+	for _, signature := range signatures {
+		doc.Text(fmt.Sprintf("%s: %s, %s", localize("en", "signature."+signature.Kind, nil), signature.SignerName,
+			locale.FormatDateTime(signature.SignedAt)), pdfBodySize, true, 0)
+		if img, ok := pdfImageFrom("image/png", signature.Image); ok {
+			doc.Image(img)
+		}
+		doc.Text("SHA-256 "+signature.SHA256, 8, false, 0)
+	}
+
+	doc.Heading("Signed forms and other documents")
+	if len(documents) == 0 {
+		doc.Text("None.", pdfBodySize, false, 0)
+	}
+	for _, attachment := range documents {
+		doc.Text(fmt.Sprintf("%s (%s, %d bytes), uploaded %s", attachment.Filename, attachment.ContentType,
+			attachment.SizeBytes, locale.FormatDateTime(attachment.CreatedAt)), pdfBodySize, false, 0)
+		doc.Text("SHA-256 "+attachment.SHA256, 8, false, 12)
+	}
+	return doc.Bytes(), nil
+}
+
+// sortedKeys orders custom field names for printing.
+func sortedKeys(values CustomFieldValues) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// caseFileImage reads an attachment that is a photo the case file can embed.
+func caseFileImage(attachment *Attachment) (pdfImage, bool, error) {
+	if !strings.HasPrefix(attachment.ContentType, "image/") || attachment.SizeBytes > caseFileMaxImageBytes {
+		return pdfImage{}, false, nil
+	}
+	reader, err := attachmentService.Open(attachment)
+	if err != nil {
+		return pdfImage{}, false, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, caseFileMaxImageBytes))
+	if err != nil {
+		return pdfImage{}, false, err
+	}
+	img, ok := pdfImageFrom(attachment.ContentType, data)
+	return img, ok, nil
+}
+
+// getOrderCaseFile serves GET /api/v1/orders/{id}/case-file.
+func getOrderCaseFile(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsCaseFile) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+	logged := withExportFilter(r, "order_id", orderID)
+	if !authorizeExport(w, logged, ExportCaseFile, "pdf") {
+		return
+	}
+
+	order, err := orderService.GetOrder(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order", http.StatusInternalServerError)
+		return
+	}
+	piiPolicyFor(r).shapeOrder(order)
+
+	file, err := BuildCaseFile(order, actorID(r))
+	if err != nil {
+		log.Printf("Error building case file of order %s: %v", orderID, err)
+		http.Error(w, "Failed to build case file", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Case file of order %s exported by %s", orderID, actorID(r))
+	recordExport(logged, ExportCaseFile, "pdf", 1)
+	auditService.Record(r, AuditCaseFileExported, "order", orderID, nil, map[string]int{"bytes": len(file)})
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="case-file-%s.pdf"`, orderID))
+	w.Write(file)
+}
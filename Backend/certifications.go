@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Staff certifications (e.g. "Apple ACMT") are recorded per user with the
+// date they expire, if they do. A background job reminds the holder and the
+// Admins by email, through the outbox, once when a certification comes
+// within CERTIFICATION_REMINDER_DAYS of expiring and again when it has
+// expired; renewing it with a new expiry date re-arms the reminders. A
+// ticket type can name a required certification: only engineers holding it,
+// unexpired, can then be assigned that type's tickets, at intake, by PATCH
+// or through /assign.
+
+const staffCertificationsTable = `
+	CREATE TABLE IF NOT EXISTS staff_certifications (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		user_id VARCHAR(50) NOT NULL,
+		certification VARCHAR(100) NOT NULL,
+		credential_id VARCHAR(100) NULL,
+		issued_on DATE NULL,
+		expires_on DATE NULL,
+		reminder_stage ENUM('expiring', 'expired') NULL,
+		updated_by VARCHAR(50) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		UNIQUE KEY uniq_staff_certification (user_id, certification),
+		INDEX idx_staff_certifications_expiry (expires_on),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Reminder stages already sent for a certification.
+const (
+	CertificationExpiring = "expiring"
+	CertificationExpired  = "expired"
+)
+
+// StaffCertification is a certification held by a member of staff.
+type StaffCertification struct {
+	ID            int64      `json:"id"`
+	UserID        string     `json:"user_id"`
+	UserName      string     `json:"user_name,omitempty"`
+	Certification string     `json:"certification"`
+	CredentialID  string     `json:"credential_id,omitempty"`
+	IssuedOn      *time.Time `json:"issued_on,omitempty"`
+	ExpiresOn     *time.Time `json:"expires_on,omitempty"` // Never expires when empty
+	Expired       bool       `json:"expired"`
+	ReminderStage string     `json:"reminder_stage,omitempty"` // Last reminder sent
+	UpdatedBy     string     `json:"updated_by,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// CertificationReminder is the outbox payload of one reminder email.
+type CertificationReminder struct {
+	CertificationID int64     `json:"certification_id"`
+	Recipient       string    `json:"recipient"`
+	Holder          string    `json:"holder"`
+	Certification   string    `json:"certification"`
+	ExpiresOn       time.Time `json:"expires_on"`
+	Stage           string    `json:"stage"`
+}
+
+// CertificationService handles staff certification database operations
+type CertificationService struct {
+	db *sql.DB
+}
+
+func NewCertificationService(database *sql.DB) *CertificationService {
+	return &CertificationService{db: database}
+}
+
+// List returns certifications, soonest expiry first. userID narrows to one
+// holder; expiringWithin (days) to those expiring by then, expired included.
+func (cs *CertificationService) List(userID string, expiringWithin *int) ([]StaffCertification, error) {
+	query := `
+		SELECT c.id, c.user_id, u.full_name, c.certification, c.credential_id, c.issued_on, c.expires_on,
+		       c.expires_on < CURDATE(), c.reminder_stage, c.updated_by, c.updated_at
+		FROM staff_certifications c JOIN users u ON u.id = c.user_id
+		WHERE TRUE`
+	var args []interface{}
+	if userID != "" {
+		query += ` AND c.user_id = ?`
+		args = append(args, userID)
+	}
+	if expiringWithin != nil {
+		query += ` AND c.expires_on < CURDATE() + INTERVAL ? DAY`
+		args = append(args, *expiringWithin+1)
+	}
+	rows, err := cs.db.Query(query+` ORDER BY c.expires_on IS NULL, c.expires_on, u.full_name, c.certification`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certifications := []StaffCertification{}
+	for rows.Next() {
+		var c StaffCertification
+		var credentialID, stage, updatedBy sql.NullString
+		var issuedOn, expiresOn sql.NullTime
+		var expired sql.NullBool
+		if err := rows.Scan(&c.ID, &c.UserID, &c.UserName, &c.Certification, &credentialID, &issuedOn, &expiresOn,
+			&expired, &stage, &updatedBy, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		c.CredentialID, c.ReminderStage, c.UpdatedBy = credentialID.String, stage.String, updatedBy.String
+		if issuedOn.Valid {
+			c.IssuedOn = &issuedOn.Time
+		}
+		if expiresOn.Valid {
+			c.ExpiresOn = &expiresOn.Time
+		}
+		c.Expired = expired.Bool
+		certifications = append(certifications, c)
+	}
+	return certifications, rows.Err()
+}
+
+// Save records a certification, or renews the one the user already holds
+// under the same name. A new expiry date re-arms the reminders.
+func (cs *CertificationService) Save(c *StaffCertification, actorID string) error {
+	_, err := cs.db.Exec(`
+		INSERT INTO staff_certifications (user_id, certification, credential_id, issued_on, expires_on, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			reminder_stage = IF(expires_on <=> VALUES(expires_on), reminder_stage, NULL),
+			credential_id = VALUES(credential_id), issued_on = VALUES(issued_on),
+			expires_on = VALUES(expires_on), updated_by = VALUES(updated_by)
+	`, c.UserID, c.Certification, nullString(c.CredentialID), c.IssuedOn, c.ExpiresOn, nullString(actorID))
+	return err
+}
+
+// Delete removes a certification. A missing one returns sql.ErrNoRows.
+func (cs *CertificationService) Delete(id int64) error {
+	result, err := cs.db.Exec(`DELETE FROM staff_certifications WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// checkEngineerCertification records a field error when the ticket type
+// requires a certification the engineer does not currently hold.
+func checkEngineerCertification(q rowQuerier, engineerID, ticketType, field string, fieldErrors *ValidationErrors) error {
+	var name string
+	var required sql.NullString
+	err := q.QueryRow(`SELECT name, required_certification FROM ticket_types WHERE code = ?`, ticketType).Scan(&name, &required)
+	if err == sql.ErrNoRows || (err == nil && required.String == "") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var held int
+	err = q.QueryRow(`
+		SELECT COUNT(*) FROM staff_certifications
+		WHERE user_id = ? AND certification = ? AND (expires_on IS NULL OR expires_on >= CURDATE())
+	`, engineerID, required.String).Scan(&held)
+	if err != nil {
+		return err
+	}
+	if held == 0 {
+		fieldErrors.Add(field, "must hold a current "+required.String+" certification for "+name+" tickets")
+	}
+	return nil
+}
+
+// SendReminders queues the reminders due: one when a certification comes
+// within leadDays of expiring and one once it has expired.
+func (cs *CertificationService) SendReminders(ctx context.Context, leadDays int) error {
+	rows, err := cs.db.QueryContext(ctx, `
+		SELECT c.id, c.reminder_stage, c.certification, c.expires_on, c.expires_on < CURDATE(), u.full_name, u.email
+		FROM staff_certifications c JOIN users u ON u.id = c.user_id
+		WHERE c.expires_on IS NOT NULL AND u.approved = TRUE
+		  AND ((c.reminder_stage IS NULL AND c.expires_on < CURDATE() + INTERVAL ? DAY)
+		       OR (c.reminder_stage = ? AND c.expires_on < CURDATE()))
+	`, leadDays+1, CertificationExpiring)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		id       int64
+		stage    sql.NullString
+		reminder CertificationReminder
+		email    string
+	}
+	var reminders []due
+	for rows.Next() {
+		var d due
+		var expired bool
+		if err := rows.Scan(&d.id, &d.stage, &d.reminder.Certification, &d.reminder.ExpiresOn, &expired,
+			&d.reminder.Holder, &d.email); err != nil {
+			rows.Close()
+			return err
+		}
+		d.reminder.CertificationID, d.reminder.Stage = d.id, CertificationExpiring
+		if expired {
+			d.reminder.Stage = CertificationExpired
+		}
+		reminders = append(reminders, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(reminders) == 0 {
+		return nil
+	}
+
+	admins, err := cs.adminEmails(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range reminders {
+		if err := cs.queueReminder(ctx, d.id, d.stage, d.reminder, append([]string{d.email}, admins...)); err != nil {
+			return err
+		}
+	}
+	log.Printf("Certification reminders: %d queued", len(reminders))
+	return nil
+}
+
+// queueReminder moves a certification to the reminder's stage and queues
+// an email to each recipient, unless another run got there first.
+func (cs *CertificationService) queueReminder(ctx context.Context, id int64, from sql.NullString, reminder CertificationReminder, recipients []string) error {
+	tx, err := cs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE staff_certifications SET reminder_stage = ? WHERE id = ? AND reminder_stage <=> ?`,
+		reminder.Stage, id, from)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil
+	}
+
+	sent := map[string]bool{}
+	for _, recipient := range recipients {
+		key := strings.ToLower(strings.TrimSpace(recipient))
+		if key == "" || sent[key] {
+			continue
+		}
+		sent[key] = true
+		reminder.Recipient = recipient
+		if err := enqueueOutbox(tx, "certification.reminder", strconv.FormatInt(id, 10), reminder); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// adminEmails returns the addresses of the approved Admins, who manage
+// staff certifications.
+func (cs *CertificationService) adminEmails(ctx context.Context) ([]string, error) {
+	rows, err := cs.db.QueryContext(ctx, `SELECT email FROM users WHERE role = ? AND approved = TRUE`, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// deliverCertificationReminder emails one certification reminder.
+func deliverCertificationReminder(msg OutboxMessage) error {
+	var reminder CertificationReminder
+	if err := json.Unmarshal(msg.Payload, &reminder); err != nil {
+		return err
+	}
+
+	expiry := reminder.ExpiresOn.Format("2 January 2006")
+	subject := fmt.Sprintf("%s certification of %s expires on %s", reminder.Certification, reminder.Holder, expiry)
+	status := "expires on " + expiry
+	if reminder.Stage == CertificationExpired {
+		subject = fmt.Sprintf("%s certification of %s has expired", reminder.Certification, reminder.Holder)
+		status = "expired on " + expiry + "; tickets that require it can no longer be assigned to them"
+	}
+	body := fmt.Sprintf("Hello,\n\nThe %s certification held by %s %s. Please arrange its renewal and record the new expiry date.\n\nPC Repair Hub",
+		reminder.Certification, reminder.Holder, status)
+	return emailService.Send("", msg.ID, reminder.Recipient, subject, body)
+}
+
+// certificationReminderJob queues certification expiry reminders.
+func certificationReminderJob() BackgroundJob {
+	leadDays := getEnvInt("CERTIFICATION_REMINDER_DAYS", 30)
+	return BackgroundJob{
+		Name:     "certification_reminders",
+		Interval: getEnvDuration("CERTIFICATION_REMINDER_INTERVAL", time.Hour),
+		Run: func(ctx context.Context) error {
+			return certificationService.SendReminders(ctx, leadDays)
+		},
+	}
+}
+
+var certificationService *CertificationService
+
+// CertificationsHandler lists certifications (GET ?user_id=&expiring_within=30),
+// records or renews one (POST {"user_id": "...", "certification": "Apple ACMT",
+// "credential_id": "...", "issued_on": "2024-01-15", "expires_on": "2026-01-15"})
+// or removes one (DELETE ?id=).
+func CertificationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		var expiringWithin *int
+		if value := r.URL.Query().Get("expiring_within"); value != "" {
+			days, err := strconv.Atoi(value)
+			if err != nil || days < 0 || days > 3650 {
+				http.Error(w, "expiring_within must be between 0 and 3650 days", http.StatusBadRequest)
+				return
+			}
+			expiringWithin = &days
+		}
+		certifications, err := certificationService.List(r.URL.Query().Get("user_id"), expiringWithin)
+		if err != nil {
+			log.Printf("Error listing certifications: %v", err)
+			http.Error(w, "Failed to retrieve certifications", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(certifications)
+
+	case "POST":
+		if !hasPermission(r, PermCertificationsManage) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		// Dates arrive as strings so they can be validated with field errors
+		var request struct {
+			UserID        string `json:"user_id"`
+			Certification string `json:"certification"`
+			CredentialID  string `json:"credential_id"`
+			IssuedOn      string `json:"issued_on"`
+			ExpiresOn     string `json:"expires_on"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		certification := StaffCertification{
+			UserID:        strings.TrimSpace(request.UserID),
+			Certification: strings.TrimSpace(request.Certification),
+			CredentialID:  strings.TrimSpace(request.CredentialID),
+			IssuedOn:      parseDateField("issued_on", request.IssuedOn, &fieldErrors),
+			ExpiresOn:     parseDateField("expires_on", request.ExpiresOn, &fieldErrors),
+		}
+		if certification.UserID == "" {
+			fieldErrors.Add("user_id", "is required")
+		} else {
+			var exists int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, certification.UserID).Scan(&exists); err != nil {
+				log.Printf("Error checking user %s: %v", certification.UserID, err)
+				http.Error(w, "Failed to save certification", http.StatusInternalServerError)
+				return
+			}
+			if exists == 0 {
+				fieldErrors.Add("user_id", "must be an existing user")
+			}
+		}
+		if certification.Certification == "" || len(certification.Certification) > 100 {
+			fieldErrors.Add("certification", "is required and at most 100 characters")
+		}
+		if len(certification.CredentialID) > 100 {
+			fieldErrors.Add("credential_id", "is too long")
+		}
+		if certification.IssuedOn != nil && certification.ExpiresOn != nil && !certification.IssuedOn.Before(*certification.ExpiresOn) {
+			fieldErrors.Add("expires_on", "must be after issued_on")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		if err := certificationService.Save(&certification, actorID(r)); err != nil {
+			log.Printf("Error saving certification %s of %s: %v", certification.Certification, certification.UserID, err)
+			http.Error(w, "Failed to save certification", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Certification %s of %s saved by %s", certification.Certification, certification.UserID, actorID(r))
+		auditService.Record(r, AuditCertificationSaved, "user", certification.UserID, nil, certification)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Certification saved successfully",
+		})
+
+	case "DELETE":
+		if !hasPermission(r, PermCertificationsManage) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		err = certificationService.Delete(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Certification not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting certification %d: %v", id, err)
+			http.Error(w, "Failed to delete certification", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditCertificationDeleted, "certification", strconv.FormatInt(id, 10), nil, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Certification deleted successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
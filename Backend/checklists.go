@@ -0,0 +1,498 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Devices are checked over at the counter when they are booked in and again
+// when they are handed back, so a scratch or a missing battery is on record
+// before anyone argues about it. Admins keep a checklist template per device
+// type (/api/v1/admin/checklist-templates); the "default" template covers
+// device types without one of their own. Staff record a pass, fail or n/a
+// with optional notes for every item at /api/v1/orders/{id}/checklist, per
+// device and per stage. Each result keeps the item's wording, so editing a
+// template later does not rewrite what was recorded. An item that passed at
+// intake and reads differently at delivery is flagged as changed.
+
+const checklistTemplatesTable = `
+	CREATE TABLE IF NOT EXISTS checklist_templates (
+		device_type VARCHAR(100) PRIMARY KEY,
+		items JSON NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		updated_by VARCHAR(50) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const ticketChecklistItemsTable = `
+	CREATE TABLE IF NOT EXISTS ticket_checklist_items (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		device_position INT NOT NULL,
+		stage ENUM('intake', 'delivery') NOT NULL,
+		position INT NOT NULL,
+		item VARCHAR(255) NOT NULL,
+		result ENUM('pass', 'fail', 'na') NOT NULL,
+		notes VARCHAR(500) NULL,
+		recorded_by VARCHAR(50) NULL,
+		recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uniq_ticket_checklist_item (order_id, device_position, stage, position),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// checklistTemplateSeedStatements install the stock templates once; admin
+// edits are never overwritten.
+var checklistTemplateSeedStatements = []string{
+	`INSERT IGNORE INTO checklist_templates (device_type, items) VALUES
+		('default', JSON_ARRAY('Physical condition', 'Powers on')),
+		('Laptop', JSON_ARRAY('Screen condition', 'Dents or cracks on the case', 'Powers on', 'Battery present', 'Keyboard and touchpad work', 'Charger included')),
+		('Desktop', JSON_ARRAY('Case condition', 'Powers on', 'Side panels and screws present')),
+		('Phone', JSON_ARRAY('Screen condition', 'Dents or cracks on the body', 'Powers on', 'Battery present', 'SIM tray present')),
+		('Tablet', JSON_ARRAY('Screen condition', 'Dents or cracks on the body', 'Powers on', 'Battery present'))`,
+}
+
+// defaultChecklistTemplate covers device types without a template.
+const defaultChecklistTemplate = "default"
+
+// maxChecklistItems keeps a template to what can be checked at the counter.
+const maxChecklistItems = 30
+
+// Checklist stages
+const (
+	ChecklistIntake   = "intake"
+	ChecklistDelivery = "delivery"
+)
+
+// Checklist results
+const (
+	ChecklistPass          = "pass"
+	ChecklistFail          = "fail"
+	ChecklistNotApplicable = "na"
+)
+
+var checklistResults = []string{ChecklistPass, ChecklistFail, ChecklistNotApplicable}
+
+// ChecklistTemplate is the list of checks for one device type.
+type ChecklistTemplate struct {
+	DeviceType string    `json:"device_type"`
+	Items      []string  `json:"items"`
+	Active     bool      `json:"active"`
+	UpdatedBy  string    `json:"updated_by,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ChecklistEntry is one item's result at one stage.
+type ChecklistEntry struct {
+	Result     string    `json:"result"`
+	Notes      string    `json:"notes,omitempty"`
+	RecordedBy string    `json:"recorded_by,omitempty"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// ChecklistItem is one check with its intake and delivery results, nil
+// until recorded.
+type ChecklistItem struct {
+	Item     string          `json:"item"`
+	Intake   *ChecklistEntry `json:"intake"`
+	Delivery *ChecklistEntry `json:"delivery"`
+	Changed  bool            `json:"changed"` // Passed at intake, reads differently at delivery
+}
+
+// checklistAnswer is one result being recorded.
+type checklistAnswer struct {
+	item, result, notes string
+}
+
+// DeviceChecklist is the checklist of one device on a ticket.
+type DeviceChecklist struct {
+	DevicePosition int             `json:"device_position"`
+	DeviceType     string          `json:"device_type"`
+	Items          []ChecklistItem `json:"items"`
+}
+
+// ChecklistService handles checklist templates and ticket checklists
+type ChecklistService struct {
+	db *sql.DB
+}
+
+func NewChecklistService(database *sql.DB) *ChecklistService {
+	return &ChecklistService{db: database}
+}
+
+var checklistService *ChecklistService
+
+func scanChecklistTemplate(row rowScanner) (*ChecklistTemplate, error) {
+	template := &ChecklistTemplate{}
+	var items []byte
+	var updatedBy sql.NullString
+	if err := row.Scan(&template.DeviceType, &items, &template.Active, &updatedBy, &template.UpdatedAt); err != nil {
+		return nil, err
+	}
+	template.UpdatedBy = updatedBy.String
+	if err := json.Unmarshal(items, &template.Items); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// ListTemplates returns every template by device type.
+func (cs *ChecklistService) ListTemplates() ([]ChecklistTemplate, error) {
+	rows, err := cs.db.Query(`SELECT device_type, items, active, updated_by, updated_at FROM checklist_templates ORDER BY device_type`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []ChecklistTemplate{}
+	for rows.Next() {
+		template, err := scanChecklistTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, *template)
+	}
+	return templates, rows.Err()
+}
+
+// TemplateFor returns the items checked on a device type: its own active
+// template, else the default one, else none.
+func (cs *ChecklistService) TemplateFor(deviceType string) ([]string, error) {
+	// The collation matches device types case-insensitively
+	template, err := scanChecklistTemplate(cs.db.QueryRow(`
+		SELECT device_type, items, active, updated_by, updated_at FROM checklist_templates
+		WHERE active AND device_type IN (?, ?)
+		ORDER BY device_type = ? LIMIT 1
+	`, deviceType, defaultChecklistTemplate, defaultChecklistTemplate))
+	if err == sql.ErrNoRows {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return template.Items, nil
+}
+
+// SaveTemplate creates a template or replaces an existing one.
+func (cs *ChecklistService) SaveTemplate(template *ChecklistTemplate, actorID string) error {
+	items, err := json.Marshal(template.Items)
+	if err != nil {
+		return err
+	}
+	_, err = cs.db.Exec(`
+		INSERT INTO checklist_templates (device_type, items, active, updated_by) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE items = VALUES(items), active = VALUES(active), updated_by = VALUES(updated_by)
+	`, template.DeviceType, string(items), template.Active, nullString(actorID))
+	return err
+}
+
+// ForOrder returns the checklist of every device on order: the items of
+// the device type's template, then any recorded items no longer on it.
+func (cs *ChecklistService) ForOrder(order *Order) ([]DeviceChecklist, error) {
+	rows, err := cs.db.Query(`
+		SELECT device_position, stage, item, result, notes, recorded_by, recorded_at
+		FROM ticket_checklist_items WHERE order_id = ?
+		ORDER BY device_position, stage, position
+	`, order.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type recorded struct {
+		stage, item string
+		entry       ChecklistEntry
+	}
+	byDevice := map[int][]recorded{}
+	for rows.Next() {
+		var position int
+		var r recorded
+		var notes, recordedBy sql.NullString
+		if err := rows.Scan(&position, &r.stage, &r.item, &r.entry.Result, &notes, &recordedBy, &r.entry.RecordedAt); err != nil {
+			return nil, err
+		}
+		r.entry.Notes, r.entry.RecordedBy = notes.String, recordedBy.String
+		byDevice[position] = append(byDevice[position], r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	checklists := []DeviceChecklist{}
+	for _, device := range order.Devices {
+		templateItems, err := cs.TemplateFor(device.DeviceType)
+		if err != nil {
+			return nil, err
+		}
+		checklist := DeviceChecklist{DevicePosition: device.Position, DeviceType: device.DeviceType, Items: []ChecklistItem{}}
+		index := map[string]int{}
+		add := func(item string) int {
+			if i, found := index[item]; found {
+				return i
+			}
+			index[item] = len(checklist.Items)
+			checklist.Items = append(checklist.Items, ChecklistItem{Item: item})
+			return index[item]
+		}
+		for _, item := range templateItems {
+			add(item)
+		}
+		for _, r := range byDevice[device.Position] {
+			entry := r.entry
+			item := &checklist.Items[add(r.item)]
+			if r.stage == ChecklistIntake {
+				item.Intake = &entry
+			} else {
+				item.Delivery = &entry
+			}
+		}
+		for i := range checklist.Items {
+			item := &checklist.Items[i]
+			item.Changed = item.Intake != nil && item.Delivery != nil &&
+				item.Intake.Result == ChecklistPass && item.Delivery.Result != ChecklistPass
+		}
+		checklists = append(checklists, checklist)
+	}
+	return checklists, nil
+}
+
+// Record replaces one device's results at one stage. Intake checks can be
+// corrected until the ticket is ready; delivery checks need it ready or
+// collected.
+func (cs *ChecklistService) Record(orderID string, devicePosition int, stage string, answers []checklistAnswer, actorID string) error {
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`SELECT status, deleted_at FROM orders WHERE id = ? FOR UPDATE`, orderID).Scan(&status, &deletedAt)
+	if err != nil {
+		return err
+	}
+	ready := status == "Ready for Delivery" || status == closedStatus
+	switch {
+	case deletedAt.Valid:
+		return &StatusGuardError{Reason: "the ticket is cancelled"}
+	case stage == ChecklistIntake && ready:
+		return &StatusGuardError{Reason: "intake checks cannot be changed once the ticket is ready"}
+	case stage == ChecklistDelivery && !ready:
+		return &StatusGuardError{Reason: "delivery checks can only be recorded once the ticket is ready"}
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM ticket_checklist_items WHERE order_id = ? AND device_position = ? AND stage = ?
+	`, orderID, devicePosition, stage); err != nil {
+		return err
+	}
+	for i, answer := range answers {
+		if _, err := tx.Exec(`
+			INSERT INTO ticket_checklist_items (order_id, device_position, stage, position, item, result, notes, recorded_by)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, orderID, devicePosition, stage, i+1, answer.item, answer.result, nullString(answer.notes),
+			nullString(actorID)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// orderChecklist serves /api/v1/orders/{id}/checklist: GET returns every
+// device's checklist, POST records one device's results at one stage
+// ({"stage": "intake", "device_position": 1, "items": [{"item": "Screen
+// condition", "result": "fail", "notes": "cracked corner"}]}). Every item of
+// the device's template must be answered.
+func orderChecklist(w http.ResponseWriter, r *http.Request, orderID string) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == "POST" && !hasPermission(r, PermTicketsEdit) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	order, err := orderService.GetOrder(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "GET" {
+		checklists, err := checklistService.ForOrder(order)
+		if err != nil {
+			log.Printf("Error loading checklist of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve checklist", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(checklists)
+		return
+	}
+
+	var request struct {
+		Stage          string `json:"stage"`
+		DevicePosition int    `json:"device_position"`
+		Items          []struct {
+			Item   string `json:"item"`
+			Result string `json:"result"`
+			Notes  string `json:"notes"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.Stage != ChecklistIntake && request.Stage != ChecklistDelivery {
+		fieldErrors.Add("stage", "must be intake or delivery")
+	}
+	if request.DevicePosition == 0 {
+		request.DevicePosition = 1
+	}
+	deviceIndex := slices.IndexFunc(order.Devices, func(device OrderDevice) bool {
+		return device.Position == request.DevicePosition
+	})
+	if deviceIndex < 0 {
+		fieldErrors.Add("device_position", "must be the position of a device on the ticket")
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	templateItems, err := checklistService.TemplateFor(order.Devices[deviceIndex].DeviceType)
+	if err != nil {
+		log.Printf("Error loading checklist template for %s: %v", order.Devices[deviceIndex].DeviceType, err)
+		http.Error(w, "Failed to record checklist", http.StatusInternalServerError)
+		return
+	}
+
+	// Results are stored in template order
+	given := map[string]checklistAnswer{}
+	for _, answer := range request.Items {
+		switch {
+		case !slices.Contains(templateItems, answer.Item):
+			fieldErrors.Add("items", answer.Item+" is not on the checklist for "+order.Devices[deviceIndex].DeviceType)
+		case !slices.Contains(checklistResults, answer.Result):
+			fieldErrors.Add("items", answer.Item+" result must be pass, fail or na")
+		case len(answer.Notes) > 500:
+			fieldErrors.Add("items", answer.Item+" notes must be at most 500 characters")
+		default:
+			given[answer.Item] = checklistAnswer{item: answer.Item, result: answer.Result, notes: strings.TrimSpace(answer.Notes)}
+		}
+	}
+	var answers []checklistAnswer
+	var missing []string
+	for _, item := range templateItems {
+		answer, found := given[item]
+		if !found {
+			missing = append(missing, item)
+			continue
+		}
+		answers = append(answers, answer)
+	}
+	if len(missing) > 0 {
+		fieldErrors.Add("items", "missing "+strings.Join(missing, ", "))
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err = checklistService.Record(orderID, request.DevicePosition, request.Stage, answers, actorID(r))
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording checklist on order %s: %v", orderID, err)
+		http.Error(w, "Failed to record checklist", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s checklist of device %d on order %s recorded by %s", request.Stage, request.DevicePosition, orderID, actorID(r))
+	auditService.Record(r, AuditChecklistRecorded, "order", orderID, nil, request)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Checklist recorded successfully",
+	})
+}
+
+// AdminChecklistTemplatesHandler lists every checklist template (GET) or
+// creates/updates one (PUT).
+func AdminChecklistTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		templates, err := checklistService.ListTemplates()
+		if err != nil {
+			log.Printf("Error listing checklist templates: %v", err)
+			http.Error(w, "Failed to retrieve checklist templates", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(templates)
+
+	case "PUT":
+		// Active defaults to true so new templates are used straight away
+		var request struct {
+			ChecklistTemplate
+			Active *bool `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		template := request.ChecklistTemplate
+		template.Active = request.Active == nil || *request.Active
+
+		var fieldErrors ValidationErrors
+		template.DeviceType = strings.TrimSpace(template.DeviceType)
+		if template.DeviceType == "" || len(template.DeviceType) > 100 {
+			fieldErrors.Add("device_type", "is required and at most 100 characters")
+		}
+		if len(template.Items) == 0 || len(template.Items) > maxChecklistItems {
+			fieldErrors.Add("items", fmt.Sprintf("must list between 1 and %d checks", maxChecklistItems))
+		}
+		seen := map[string]bool{}
+		for i, item := range template.Items {
+			item = strings.TrimSpace(item)
+			template.Items[i] = item
+			switch {
+			case item == "" || len(item) > 255:
+				fieldErrors.Add("items", "each check must be 1 to 255 characters")
+			case seen[strings.ToLower(item)]:
+				fieldErrors.Add("items", item+" is listed twice")
+			}
+			seen[strings.ToLower(item)] = true
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		if err := checklistService.SaveTemplate(&template, actorID(r)); err != nil {
+			log.Printf("Error saving checklist template %s: %v", template.DeviceType, err)
+			http.Error(w, "Failed to save checklist template", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Checklist template %s saved by %s", template.DeviceType, actorID(r))
+		auditService.Record(r, AuditChecklistTemplateSave, "checklist_template", template.DeviceType, nil, template)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Checklist template saved successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
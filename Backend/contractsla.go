@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A contract can commit the shop to a response time (booking in to work
+// starting, i.e. the ticket's first move out of New Order) and a resolution
+// time (booking in to Ready for Delivery), set as response_hours and
+// resolution_hours on the account. GET /api/v1/accounts/sla-report reports
+// one account's compliance over a billing period for the tickets booked in
+// it, with a line for every breach; ?format=pdf renders it as a PDF to attach
+// to the contract invoice, run and logged as a contract_sla export
+// (exportlog.go). As with ticket SLAs (sla.go), time on hold does not
+// count against the shop. A ticket still short of a target is pending until
+// the committed time has passed, and breached from then on.
+
+// SLA report targets
+const (
+	SLATargetResponse   = "response"
+	SLATargetResolution = "resolution"
+)
+
+// ContractSLAReport is an account's SLA compliance over a billing period.
+type ContractSLAReport struct {
+	AccountID         int64               `json:"account_id"`
+	Name              string              `json:"name"`
+	ContractReference string              `json:"contract_reference,omitempty"`
+	Period            ReportRange         `json:"period"`
+	ResponseHours     *int                `json:"response_hours"`
+	ResolutionHours   *int                `json:"resolution_hours"`
+	Tickets           int                 `json:"tickets"`
+	Response          *ContractSLATarget  `json:"response,omitempty"` // Nil when the contract commits to no response time
+	Resolution        *ContractSLATarget  `json:"resolution,omitempty"`
+	Breaches          []ContractSLABreach `json:"breaches"`
+	GeneratedAt       time.Time           `json:"generated_at"`
+}
+
+// ContractSLATarget counts the tickets against one committed time.
+// Compliance is over the tickets decided so far, met or breached.
+type ContractSLATarget struct {
+	Met               int      `json:"met"`
+	Breached          int      `json:"breached"`
+	Pending           int      `json:"pending"`
+	CompliancePercent *float64 `json:"compliance_percent"`
+}
+
+// ContractSLABreach is one ticket that missed a committed time. Hours
+// exclude time on hold and run to now while the ticket is outstanding.
+type ContractSLABreach struct {
+	OrderID        string     `json:"order_id"`
+	Target         string     `json:"target"`
+	Device         string     `json:"device"`
+	BookedAt       time.Time  `json:"booked_at"`
+	CompletedAt    *time.Time `json:"completed_at"` // Nil while outstanding
+	HeldHours      float64    `json:"held_hours"`
+	CommittedHours int        `json:"committed_hours"`
+	TookHours      float64    `json:"took_hours"`
+	OverHours      float64    `json:"over_hours"`
+}
+
+// holdSpan is one stretch of a ticket on hold; released is nil while held.
+type holdSpan struct {
+	started  time.Time
+	released *time.Time
+}
+
+// heldBetween returns how much of from..to the ticket spent on hold.
+func heldBetween(spans []holdSpan, from, to, now time.Time) time.Duration {
+	var held time.Duration
+	for _, span := range spans {
+		start, end := span.started, now
+		if span.released != nil {
+			end = *span.released
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			held += end.Sub(start)
+		}
+	}
+	return held
+}
+
+// SLAReport measures account's tickets booked in period against its
+// committed response and resolution times.
+func (as *AccountService) SLAReport(account *CorporateAccount, period ReportRange) (*ContractSLAReport, error) {
+	report := &ContractSLAReport{
+		AccountID:         account.ID,
+		Name:              account.Name,
+		ContractReference: account.ContractReference,
+		Period:            period,
+		ResponseHours:     account.ResponseHours,
+		ResolutionHours:   account.ResolutionHours,
+		Breaches:          []ContractSLABreach{},
+		GeneratedAt:       time.Now(),
+	}
+	now := report.GeneratedAt
+	if account.ResponseHours != nil {
+		report.Response = &ContractSLATarget{}
+	}
+	if account.ResolutionHours != nil {
+		report.Resolution = &ContractSLATarget{}
+	}
+
+	const periodTickets = `account_id = ? AND deleted_at IS NULL AND created_at >= ? AND created_at < ?`
+	holds := map[string][]holdSpan{}
+	holdRows, err := as.db.Query(`
+		SELECT order_id, started_at, released_at FROM ticket_holds
+		WHERE order_id IN (SELECT id FROM orders WHERE `+periodTickets+`)
+	`, account.ID, period.From, period.To)
+	if err != nil {
+		return nil, err
+	}
+	defer holdRows.Close()
+	for holdRows.Next() {
+		var orderID string
+		var span holdSpan
+		var released sql.NullTime
+		if err := holdRows.Scan(&orderID, &span.started, &released); err != nil {
+			return nil, err
+		}
+		span.released = timePtr(released)
+		holds[orderID] = append(holds[orderID], span)
+	}
+	if err := holdRows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := as.db.Query(`
+		SELECT o.id, o.device_type, COALESCE(o.device_model, ''), o.created_at,
+		       (SELECT MIN(h.changed_at) FROM ticket_status_history h
+		        WHERE h.order_id = o.id AND h.from_status = 'New Order' AND h.to_status <> 'New Order'),
+		       (SELECT MIN(h.changed_at) FROM ticket_status_history h
+		        WHERE h.order_id = o.id AND h.to_status IN ('Ready for Delivery', ?))
+		FROM orders o
+		WHERE o.`+periodTickets+`
+		ORDER BY o.created_at, o.id
+	`, closedStatus, account.ID, period.From, period.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID, deviceType, deviceModel string
+		var bookedAt time.Time
+		var respondedAt, resolvedAt sql.NullTime
+		if err := rows.Scan(&orderID, &deviceType, &deviceModel, &bookedAt, &respondedAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		report.Tickets++
+
+		for _, target := range []struct {
+			name        string
+			hours       *int
+			counts      *ContractSLATarget
+			completedAt *time.Time
+		}{
+			{SLATargetResponse, account.ResponseHours, report.Response, timePtr(respondedAt)},
+			{SLATargetResolution, account.ResolutionHours, report.Resolution, timePtr(resolvedAt)},
+		} {
+			if target.hours == nil {
+				continue
+			}
+			end := now
+			if target.completedAt != nil {
+				end = *target.completedAt
+			}
+			held := heldBetween(holds[orderID], bookedAt, end, now)
+			took := end.Sub(bookedAt) - held
+			committed := time.Duration(*target.hours) * time.Hour
+			switch {
+			case took <= committed && target.completedAt != nil:
+				target.counts.Met++
+				continue
+			case took <= committed:
+				target.counts.Pending++
+				continue
+			}
+			target.counts.Breached++
+			report.Breaches = append(report.Breaches, ContractSLABreach{
+				OrderID:        orderID,
+				Target:         target.name,
+				Device:         strings.TrimSpace(deviceType + " " + deviceModel),
+				BookedAt:       bookedAt,
+				CompletedAt:    target.completedAt,
+				HeldHours:      roundTenth(held.Hours()),
+				CommittedHours: *target.hours,
+				TookHours:      roundTenth(took.Hours()),
+				OverHours:      roundTenth((took - committed).Hours()),
+			})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, target := range []*ContractSLATarget{report.Response, report.Resolution} {
+		if target != nil && target.Met+target.Breached > 0 {
+			compliance := roundTenth(100 * float64(target.Met) / float64(target.Met+target.Breached))
+			target.CompliancePercent = &compliance
+		}
+	}
+	return report, nil
+}
+
+// BuildContractSLAReport renders report as a PDF: the contract and period,
+// a summary per committed time, then each breach.
+func BuildContractSLAReport(report *ContractSLAReport) []byte {
+	locale := shopLocale
+	// The period ends exclusively; print its last day
+	lastDay := report.Period.To.Add(-time.Nanosecond)
+
+	doc := newPDFDocument()
+	doc.Text("SLA compliance report: "+report.Name, 18, true, 0)
+	doc.Text(fmt.Sprintf("Generated %s", locale.FormatDateTime(report.GeneratedAt)), pdfBodySize, false, 0)
+
+	doc.Heading("Contract")
+	doc.Field("Account", report.Name)
+	doc.Field("Contract reference", report.ContractReference)
+	doc.Field("Billing period", locale.FormatDate(report.Period.From)+" to "+locale.FormatDate(lastDay))
+	doc.Field("Tickets booked in", strconv.Itoa(report.Tickets))
+
+	for _, target := range []struct {
+		title  string
+		hours  *int
+		counts *ContractSLATarget
+	}{
+		{"Response", report.ResponseHours, report.Response},
+		{"Resolution", report.ResolutionHours, report.Resolution},
+	} {
+		if target.counts == nil {
+			continue
+		}
+		doc.Heading(target.title)
+		doc.Field("Committed", fmt.Sprintf("%d hours", *target.hours))
+		doc.Field("Met", strconv.Itoa(target.counts.Met))
+		doc.Field("Breached", strconv.Itoa(target.counts.Breached))
+		doc.Field("Pending", strconv.Itoa(target.counts.Pending))
+		compliance := "n/a"
+		if target.counts.CompliancePercent != nil {
+			compliance = fmt.Sprintf("%.1f%%", *target.counts.CompliancePercent)
+		}
+		doc.Field("Compliance", compliance)
+	}
+
+	doc.Heading("Breaches")
+	if len(report.Breaches) == 0 {
+		doc.Text("No breaches in this period.", pdfBodySize, false, 0)
+	}
+	for _, breach := range report.Breaches {
+		doc.Text(fmt.Sprintf("%s, %s (%s)", breach.OrderID, breach.Target, breach.Device), pdfBodySize, true, 0)
+		completed := "outstanding"
+		if breach.CompletedAt != nil {
+			completed = locale.FormatDateTime(*breach.CompletedAt)
+		}
+		doc.Text(fmt.Sprintf("Booked in %s, completed %s", locale.FormatDateTime(breach.BookedAt), completed), pdfBodySize, false, 12)
+		line := fmt.Sprintf("Took %.1f h against %d h committed, %.1f h over", breach.TookHours, breach.CommittedHours, breach.OverHours)
+		if breach.HeldHours > 0 {
+			line += fmt.Sprintf(" (%.1f h on hold excluded)", breach.HeldHours)
+		}
+		doc.Text(line, pdfBodySize, false, 12)
+	}
+	return doc.Bytes()
+}
+
+// ContractSLAReportHandler reports one account's SLA compliance
+// (?account_id=) over ?from=&to= (default the last 30 days), as JSON or with
+// ?format=pdf as a PDF.
+func ContractSLAReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	accountID, err := strconv.ParseInt(r.URL.Query().Get("account_id"), 10, 64)
+	if err != nil || accountID <= 0 {
+		fieldErrors.Add("account_id", "is required and must be a positive integer")
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "pdf" {
+		fieldErrors.Add("format", "must be json or pdf")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if format == "pdf" && !authorizeExport(w, r, ExportContractSLA, format) {
+		return
+	}
+
+	account, err := accountService.GetAccount(accountID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving account %d: %v", accountID, err)
+		http.Error(w, "Failed to build SLA report", http.StatusInternalServerError)
+		return
+	}
+	if account.ResponseHours == nil && account.ResolutionHours == nil {
+		http.Error(w, "The account's contract has no committed response or resolution time", http.StatusConflict)
+		return
+	}
+
+	report, err := accountService.SLAReport(account, period)
+	if err != nil {
+		log.Printf("Error building SLA report of account %d: %v", accountID, err)
+		http.Error(w, "Failed to build SLA report", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "pdf" {
+		recordExport(r, ExportContractSLA, format, report.Tickets)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sla-report-%d-%s.pdf"`,
+			accountID, period.From.Format("2006-01-02")))
+		w.Write(BuildContractSLAReport(report))
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig controls which browser origins may call the API. Production
+// allows no cross-origin callers unless CORS_ALLOWED_ORIGINS lists them;
+// APP_ENV=development allows any origin unless a list is given.
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowAnyOrigin   bool
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+func getCORSConfig() CORSConfig {
+	development := getEnv("APP_ENV", "production") == "development"
+
+	config := CORSConfig{
+		AllowedOrigins:   splitList(getEnv("CORS_ALLOWED_ORIGINS", "")),
+		AllowedMethods:   splitList(getEnv("CORS_ALLOWED_METHODS", "GET, POST, PUT, PATCH, DELETE")),
+		AllowedHeaders:   splitList(getEnv("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, X-API-Key")),
+		ExposedHeaders:   splitList(getEnv("CORS_EXPOSED_HEADERS", "")),
+		AllowCredentials: getEnv("CORS_ALLOW_CREDENTIALS", "false") == "true",
+		MaxAge:           getEnvDuration("CORS_MAX_AGE", 10*time.Minute),
+	}
+
+	if slices.Contains(config.AllowedOrigins, "*") {
+		config.AllowedOrigins = slices.DeleteFunc(config.AllowedOrigins, func(o string) bool { return o == "*" })
+		if development {
+			config.AllowAnyOrigin = true
+		} else {
+			log.Printf("Ignoring wildcard CORS origin outside APP_ENV=development")
+		}
+	}
+	if development && len(config.AllowedOrigins) == 0 {
+		config.AllowAnyOrigin = true
+	}
+
+	// Browsers reject credentialed responses for a wildcard origin
+	if config.AllowAnyOrigin && config.AllowCredentials {
+		log.Printf("CORS_ALLOW_CREDENTIALS is ignored while any origin is allowed")
+		config.AllowCredentials = false
+	}
+
+	return config
+}
+
+// splitList parses a comma-separated setting, dropping blanks.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c CORSConfig) originAllowed(origin string) bool {
+	return c.AllowAnyOrigin || slices.Contains(c.AllowedOrigins, origin)
+}
+
+// corsMiddleware applies config to every response and answers preflight
+// requests. Requests without an Origin header are not cross-origin and pass
+// through untouched.
+func corsMiddleware(config CORSConfig) func(http.Handler) http.Handler {
+	methods := strings.Join(config.AllowedMethods, ", ")
+	headers := strings.Join(config.AllowedHeaders, ", ")
+	exposed := strings.Join(config.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(config.MaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			if !config.originAllowed(origin) {
+				if preflight {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				// The browser blocks the response without CORS headers
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if config.AllowAnyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if config.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if preflight {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if exposed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", exposed)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
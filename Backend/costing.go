@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Parts are costed at weighted average: a part's unit_cost is the average
+// purchase price of the stock on hand, recalculated by every receipt. Stock
+// leaving for a ticket (a part cost recorded by SKU, or an invoiced build)
+// is costed at the average of that moment and kept on its stock movement,
+// which makes it the ticket's cost of goods sold; later receipts do not
+// change it. Receipts may carry the supplier's lot number (lots.go).
+// supplier_cost is the supplier's current price, recorded from their price
+// list; a receipt's price only goes into the average. When the supplier
+// price drops below the average, the revalue_inventory task writes stock on
+// hand down to it (lower of cost and replacement cost) and records the loss
+// in inventory_revaluations; otherwise the average stands.
+
+const inventoryRevaluationsTable = `
+	CREATE TABLE IF NOT EXISTS inventory_revaluations (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		part_sku VARCHAR(64) NOT NULL,
+		quantity INT NOT NULL,
+		old_unit_cost DECIMAL(10,2) NOT NULL,
+		new_unit_cost DECIMAL(10,2) NOT NULL,
+		value_change DECIMAL(12,2) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_inventory_revaluations_created (created_at),
+		FOREIGN KEY (part_sku) REFERENCES parts(sku)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Stock movement reasons for costing
+const (
+	MovementReceipt  = "receipt"  // Bought from a supplier
+	MovementConsumed = "consumed" // Used on a ticket, recorded as a part cost
+)
+
+var errPartOutOfStock = errors.New("not enough of this part in stock")
+
+// weightedAverageCost is the unit cost of onHand units at average plus
+// quantity units bought at price, rounded half-up.
+func weightedAverageCost(onHand int, average Money, quantity int, price Money) Money {
+	if onHand < 0 {
+		onHand = 0
+	}
+	total := int64(onHand + quantity)
+	if total == 0 {
+		return price
+	}
+	value := int64(average)*int64(onHand) + int64(price)*int64(quantity)
+	return Money((value + total/2) / total)
+}
+
+// PartReceipt is stock bought from a supplier.
+type PartReceipt struct {
+	PartSKU   string `json:"part_sku"`
+	Quantity  int    `json:"quantity"`
+	UnitCost  Money  `json:"unit_cost"` // Purchase price per unit
+	Supplier  string `json:"supplier"`
+	Reference string `json:"reference"` // Supplier invoice number
+	Lot       string `json:"lot"`       // Supplier lot or batch number
+}
+
+// Receive adds bought stock, re-averages the part's unit cost and returns
+// the new average.
+func (ps *PartService) Receive(receipt *PartReceipt, actorID string) (Money, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var onHand int
+	var average Money
+	err = tx.QueryRow(`SELECT quantity_on_hand, unit_cost FROM parts WHERE sku = ? FOR UPDATE`, receipt.PartSKU).Scan(&onHand, &average)
+	if err == sql.ErrNoRows {
+		return 0, errUnknownPart
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	newAverage := weightedAverageCost(onHand, average, receipt.Quantity, receipt.UnitCost)
+	_, err = tx.Exec(`
+		UPDATE parts SET quantity_on_hand = quantity_on_hand + ?, unit_cost = ? WHERE sku = ?
+	`, receipt.Quantity, newAverage, receipt.PartSKU)
+	if err != nil {
+		return 0, err
+	}
+
+	if receipt.Lot != "" {
+		if err := receiveLot(tx, receipt); err != nil {
+			return 0, err
+		}
+	}
+	note := strings.TrimSpace(strings.Join([]string{receipt.Supplier, receipt.Reference}, " "))
+	err = recordStockMovement(tx, StockMovement{
+		PartSKU: receipt.PartSKU, Quantity: receipt.Quantity, Reason: MovementReceipt,
+		UnitCost: receipt.UnitCost, Lot: receipt.Lot, Note: note, ActorID: actorID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newAverage, tx.Commit()
+}
+
+// SetSupplierCosts records new supplier prices without receiving stock. The
+// revalue_inventory task applies them. Nothing is saved when a SKU is
+// unknown; the unknown SKUs are returned.
+func (ps *PartService) SetSupplierCosts(prices map[string]Money) ([]string, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var unknown []string
+	for sku, price := range prices {
+		result, err := tx.Exec(`UPDATE parts SET supplier_cost = ?, supplier_cost_at = NOW() WHERE sku = ?`, price, sku)
+		if err != nil {
+			return nil, err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			unknown = append(unknown, sku)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return unknown, nil
+	}
+	return nil, tx.Commit()
+}
+
+// Revalue writes the stock of parts whose supplier price fell below their
+// average cost down to the supplier price. Parts at or below their
+// supplier price keep their average.
+func (ps *PartService) Revalue(ctx context.Context) (int64, string, error) {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT sku, quantity_on_hand, unit_cost, supplier_cost FROM parts
+		WHERE supplier_cost IS NOT NULL AND supplier_cost < unit_cost
+		FOR UPDATE
+	`)
+	if err != nil {
+		return 0, "", err
+	}
+	type revaluation struct {
+		sku              string
+		quantity         int
+		oldCost, newCost Money
+	}
+	var revaluations []revaluation
+	for rows.Next() {
+		var rv revaluation
+		if err := rows.Scan(&rv.sku, &rv.quantity, &rv.oldCost, &rv.newCost); err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		revaluations = append(revaluations, rv)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	var loss Money
+	for _, rv := range revaluations {
+		if _, err := tx.ExecContext(ctx, `UPDATE parts SET unit_cost = ? WHERE sku = ?`, rv.newCost, rv.sku); err != nil {
+			return 0, "", err
+		}
+		quantity := max(rv.quantity, 0)
+		change := (rv.newCost - rv.oldCost) * Money(quantity)
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO inventory_revaluations (part_sku, quantity, old_unit_cost, new_unit_cost, value_change)
+			VALUES (?, ?, ?, ?, ?)
+		`, rv.sku, quantity, rv.oldCost, rv.newCost, change)
+		if err != nil {
+			return 0, "", err
+		}
+		loss -= change
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return int64(len(revaluations)), "stock written down by " + loss.String(), nil
+}
+
+// consumePart takes a ticket's part out of stock in tx, from lot if given,
+// and returns its cost at the current average and the lot it came from.
+func consumePart(tx *sql.Tx, sku string, quantity int, lot, orderID, actorID string) (Money, string, error) {
+	var onHand int
+	var average Money
+	err := tx.QueryRow(`SELECT quantity_on_hand, unit_cost FROM parts WHERE sku = ? FOR UPDATE`, sku).Scan(&onHand, &average)
+	if err == sql.ErrNoRows {
+		return 0, "", errUnknownPart
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if onHand < quantity {
+		return 0, "", errPartOutOfStock
+	}
+	if _, err := tx.Exec(`UPDATE parts SET quantity_on_hand = quantity_on_hand - ? WHERE sku = ?`, quantity, sku); err != nil {
+		return 0, "", err
+	}
+	lot, err = takeFromLots(tx, StockMovement{
+		PartSKU: sku, Quantity: -quantity, Reason: MovementConsumed, OrderID: orderID, ActorID: actorID,
+	}, lot)
+	return average * Money(quantity), lot, err
+}
+
+// COGSLine is the cost of one part's stock used on tickets.
+type COGSLine struct {
+	PartSKU  string `json:"part_sku"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+	Cost     Money  `json:"cost"`
+}
+
+// COGSReport is the cost of goods sold in a period with the inventory's
+// current value.
+type COGSReport struct {
+	Range          ReportRange `json:"range"`
+	Parts          []COGSLine  `json:"parts"`
+	Total          Money       `json:"total"`
+	Revaluations   Money       `json:"revaluations"`    // Write-downs in the period, negative
+	InventoryValue Money       `json:"inventory_value"` // Stock on hand at average cost, now
+}
+
+// COGS reports the stock used on tickets in a period, by part, at the cost
+// it left stock with.
+func (ps *PartService) COGS(period ReportRange) (*COGSReport, error) {
+	rows, err := ps.db.Query(`
+		SELECT m.part_sku, p.name, SUM(-m.quantity), SUM(-m.quantity * m.unit_cost)
+		FROM stock_movements m JOIN parts p ON p.sku = m.part_sku
+		WHERE m.reason IN (?, ?) AND m.created_at >= ? AND m.created_at < ?
+		GROUP BY m.part_sku, p.name
+		ORDER BY 4 DESC
+	`, MovementConsumed, MovementBuild, period.From, period.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &COGSReport{Range: period, Parts: []COGSLine{}}
+	for rows.Next() {
+		var line COGSLine
+		if err := rows.Scan(&line.PartSKU, &line.Name, &line.Quantity, &line.Cost); err != nil {
+			return nil, err
+		}
+		report.Total += line.Cost
+		report.Parts = append(report.Parts, line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = ps.db.QueryRow(`
+		SELECT COALESCE(SUM(value_change), 0) FROM inventory_revaluations WHERE created_at >= ? AND created_at < ?
+	`, period.From, period.To).Scan(&report.Revaluations)
+	if err != nil {
+		return nil, err
+	}
+	err = ps.db.QueryRow(`
+		SELECT COALESCE(SUM(GREATEST(quantity_on_hand, 0) * unit_cost), 0) FROM parts
+	`).Scan(&report.InventoryValue)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// PartReceiptsHandler receives stock bought from a supplier (POST
+// {"part_sku": "...", "quantity": 10, "unit_cost": "1450.00", "supplier":
+// "...", "reference": "INV-2231"}).
+func PartReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var receipt PartReceipt
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	receipt.Supplier = strings.TrimSpace(receipt.Supplier)
+	receipt.Reference = strings.TrimSpace(receipt.Reference)
+	receipt.Lot = strings.TrimSpace(receipt.Lot)
+	if receipt.PartSKU == "" {
+		fieldErrors.Add("part_sku", "is required")
+	}
+	if receipt.Quantity < 1 {
+		fieldErrors.Add("quantity", "must be at least 1")
+	}
+	if receipt.UnitCost <= 0 {
+		fieldErrors.Add("unit_cost", "must be positive")
+	}
+	if len(receipt.Supplier)+len(receipt.Reference) > 400 {
+		fieldErrors.Add("reference", "is too long")
+	}
+	if len(receipt.Lot) > 100 {
+		fieldErrors.Add("lot", "is too long")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	average, err := partService.Receive(&receipt, actorID(r))
+	if err == errUnknownPart {
+		http.Error(w, "Part not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error receiving part %s: %v", receipt.PartSKU, err)
+		http.Error(w, "Failed to receive stock", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%d x %s received by %s", receipt.Quantity, receipt.PartSKU, actorID(r))
+	auditService.Record(r, AuditPartReceived, "part", receipt.PartSKU, nil, receipt)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Stock received successfully",
+		"unit_cost": average,
+	})
+}
+
+// AdminSupplierPricesHandler records supplier price changes (PUT {"SSD-1TB":
+// "4200.00", ...}) for the revalue_inventory task.
+func AdminSupplierPricesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "PUT" {
+		http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var prices map[string]Money
+	if err := json.NewDecoder(r.Body).Decode(&prices); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if len(prices) == 0 {
+		fieldErrors.Add("prices", "are required")
+	}
+	for sku, price := range prices {
+		if price <= 0 {
+			fieldErrors.Add(sku, "must be positive")
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	unknown, err := partService.SetSupplierCosts(prices)
+	if err != nil {
+		log.Printf("Error saving supplier prices: %v", err)
+		http.Error(w, "Failed to save supplier prices", http.StatusInternalServerError)
+		return
+	}
+	if len(unknown) > 0 {
+		for _, sku := range unknown {
+			fieldErrors.Add(sku, errUnknownPart.Error())
+		}
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	auditService.Record(r, AuditSupplierPricesSaved, "part", "", nil, prices)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Supplier prices saved; stock is revalued by the revalue_inventory task",
+	})
+}
+
+// ReportCOGSHandler reports the cost of goods sold for a period.
+func ReportCOGSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, err := partService.COGS(period)
+	if err != nil {
+		log.Printf("Error building COGS report: %v", err)
+		http.Error(w, "Failed to build report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Customers are unique by email and by phone. The normalized values live in
+// email_key and phone_key under unique indexes, so concurrent intakes cannot
+// both create the same customer. A conflicting create answers 409 with the
+// existing record and a link to it; staff who know better (two family
+// members sharing a phone) can force the duplicate with a reason, which is
+// stored without the unique keys and points at the record it duplicates.
+
+const customersTable = `
+	CREATE TABLE IF NOT EXISTS customers (
+		id VARCHAR(50) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NULL,
+		phone VARCHAR(20) NULL,
+		email_key VARCHAR(255) NULL,
+		phone_key VARCHAR(20) NULL,
+		duplicate_of VARCHAR(50) NULL,
+		duplicate_reason VARCHAR(500) NULL,
+		preferred_language VARCHAR(10) NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uniq_customers_email (email_key),
+		UNIQUE KEY uniq_customers_phone (phone_key),
+		INDEX idx_customers_email (email),
+		INDEX idx_customers_phone (phone)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// mysqlDuplicateEntry is MySQL's error number for a unique key violation.
+const mysqlDuplicateEntry = 1062
+
+// errCustomerExists is returned when a customer with the same email or phone
+// already exists.
+var errCustomerExists = errors.New("a customer with this email or phone already exists")
+
+// Customer is a person the shop repairs devices for.
+type Customer struct {
+	ID                string            `json:"id"`
+	Name              string            `json:"name"`
+	Email             string            `json:"email,omitempty"`
+	Phone             string            `json:"phone,omitempty"`
+	DuplicateOf       string            `json:"duplicate_of,omitempty"`
+	DuplicateReason   string            `json:"duplicate_reason,omitempty"`
+	PreferredLanguage string            `json:"preferred_language,omitempty"` // Language for messages and documents (i18n.go)
+	CreatedBy         string            `json:"created_by,omitempty"`
+	CreatedAt         time.Time         `json:"created_at"`
+	CustomFields      CustomFieldValues `json:"custom_fields"` // Shop-defined customer fields (customfields.go)
+}
+
+// normalizeCustomerEmail is the form emails are compared in.
+func normalizeCustomerEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizeCustomerPhone keeps the digits of a phone number, dropping a
+// country or trunk prefix so +91 98450 12345 and 098450-12345 match.
+func normalizeCustomerPhone(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, phone)
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return digits
+}
+
+// CustomerService handles customer database operations
+type CustomerService struct {
+	db *sql.DB
+}
+
+func NewCustomerService(database *sql.DB) *CustomerService {
+	return &CustomerService{db: database}
+}
+
+// CreateCustomer inserts a customer, returning errCustomerExists when the
+// email or phone is taken. With force the duplicate is stored anyway,
+// linked to the first existing match.
+func (cs *CustomerService) CreateCustomer(customer *Customer, force bool) error {
+	id, err := idService.Next(EntityCustomer)
+	if err != nil {
+		return err
+	}
+	customer.ID = id
+	customer.CreatedAt = time.Now()
+
+	emailKey := nullString(normalizeCustomerEmail(customer.Email))
+	phoneKey := nullString(normalizeCustomerPhone(customer.Phone))
+	if force {
+		matches, err := cs.FindMatches(customer.Email, customer.Phone)
+		if err != nil {
+			return err
+		}
+		if len(matches) > 0 {
+			customer.DuplicateOf = matches[0].ID
+			emailKey, phoneKey = sql.NullString{}, sql.NullString{}
+		} else {
+			// Nothing to duplicate; the reason has no record to explain
+			customer.DuplicateReason = ""
+		}
+	}
+
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO customers (id, name, email, phone, email_key, phone_key, duplicate_of, duplicate_reason,
+		                       preferred_language, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, customer.ID, customer.Name, nullString(customer.Email), nullString(customer.Phone), emailKey, phoneKey,
+		nullString(customer.DuplicateOf), nullString(customer.DuplicateReason), nullString(customer.PreferredLanguage),
+		nullString(customer.CreatedBy), customer.CreatedAt)
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return errCustomerExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := saveCustomFieldValues(tx, CustomFieldScopeCustomer, customer.ID, customer.CustomFields); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const customerColumns = `id, name, email, phone, duplicate_of, duplicate_reason, preferred_language, created_by, created_at`
+
+func scanCustomer(row rowScanner) (*Customer, error) {
+	var customer Customer
+	var email, phone, duplicateOf, duplicateReason, preferredLanguage, createdBy sql.NullString
+	if err := row.Scan(&customer.ID, &customer.Name, &email, &phone, &duplicateOf, &duplicateReason,
+		&preferredLanguage, &createdBy, &customer.CreatedAt); err != nil {
+		return nil, err
+	}
+	customer.PreferredLanguage = preferredLanguage.String
+	customer.Email = email.String
+	customer.Phone = phone.String
+	customer.DuplicateOf = duplicateOf.String
+	customer.DuplicateReason = duplicateReason.String
+	customer.CreatedBy = createdBy.String
+	return &customer, nil
+}
+
+func (cs *CustomerService) queryCustomers(query string, args ...interface{}) ([]Customer, error) {
+	rows, err := cs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := []Customer{}
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, *customer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return customers, cs.loadCustomFields(customers)
+}
+
+// loadCustomFields fills in the custom field values of customers.
+func (cs *CustomerService) loadCustomFields(customers []Customer) error {
+	ids := make([]string, len(customers))
+	for i := range customers {
+		ids[i] = customers[i].ID
+	}
+	values, err := loadCustomFieldValues(cs.db, CustomFieldScopeCustomer, ids)
+	if err != nil {
+		return err
+	}
+	for i := range customers {
+		customers[i].CustomFields = values[customers[i].ID]
+	}
+	return nil
+}
+
+func (cs *CustomerService) GetCustomer(id string) (*Customer, error) {
+	customer, err := scanCustomer(cs.db.QueryRow(`SELECT `+customerColumns+` FROM customers WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	customers := []Customer{*customer}
+	if err := cs.loadCustomFields(customers); err != nil {
+		return nil, err
+	}
+	return &customers[0], nil
+}
+
+// SetPreferredLanguage sets the language a customer is addressed in; an
+// empty language falls back to DEFAULT_LANGUAGE.
+func (cs *CustomerService) SetPreferredLanguage(id, language string) error {
+	result, err := cs.db.Exec(`UPDATE customers SET preferred_language = ? WHERE id = ?`, nullString(language), id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		if _, err := cs.GetCustomer(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindMatches returns the customers holding the email or phone as their
+// unique keys; forced duplicates have none and never match.
+func (cs *CustomerService) FindMatches(email, phone string) ([]Customer, error) {
+	return cs.queryCustomers(`SELECT `+customerColumns+` FROM customers
+		WHERE (email_key = ? OR phone_key = ?) ORDER BY created_at`,
+		normalizeCustomerEmail(email), normalizeCustomerPhone(phone))
+}
+
+// SearchCustomers matches name, email, phone or a custom field value, most
+// recent first.
+func (cs *CustomerService) SearchCustomers(term string, limit int) ([]Customer, error) {
+	like := "%" + term + "%"
+	return cs.queryCustomers(`SELECT `+customerColumns+` FROM customers
+		WHERE name LIKE ? OR email LIKE ? OR phone LIKE ?
+			OR id IN (SELECT entity_id FROM custom_field_values WHERE scope = 'customer' AND value LIKE ?)
+		ORDER BY created_at DESC LIMIT ?`,
+		like, like, like, like, limit)
+}
+
+var customerService *CustomerService
+
+// customerLink is where a customer record can be fetched.
+func customerLink(id string) string {
+	return "/api/v1/customers?id=" + id
+}
+
+// CustomersHandler looks customers up (GET ?id= or ?q=), creates one (POST)
+// or sets a customer's language (PATCH ?id= {"preferred_language": "hi"}).
+// A create that matches an existing email or phone answers 409 with the
+// existing customers unless it is forced with a reason.
+func CustomersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		if id := r.URL.Query().Get("id"); id != "" {
+			customer, err := customerService.GetCustomer(id)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Customer not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Error loading customer %s: %v", id, err)
+				http.Error(w, "Failed to retrieve customer", http.StatusInternalServerError)
+				return
+			}
+			customers := []Customer{*customer}
+			piiPolicyFor(r).shapeCustomers(customers)
+			json.NewEncoder(w).Encode(customers[0])
+			return
+		}
+
+		customers, err := customerService.SearchCustomers(strings.TrimSpace(r.URL.Query().Get("q")), 50)
+		if err != nil {
+			log.Printf("Error searching customers: %v", err)
+			http.Error(w, "Failed to retrieve customers", http.StatusInternalServerError)
+			return
+		}
+		piiPolicyFor(r).shapeCustomers(customers)
+		json.NewEncoder(w).Encode(customers)
+
+	case "POST":
+		if !hasPermission(r, PermTicketsCreate) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			Customer
+			Force  bool   `json:"force"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		customer := request.Customer
+
+		var fieldErrors ValidationErrors
+		if strings.TrimSpace(customer.Name) == "" {
+			fieldErrors.Add("name", "is required")
+		}
+		if customer.Email == "" && customer.Phone == "" {
+			fieldErrors.Add("email", "email or phone is required")
+		}
+		if customer.Email != "" && !strings.Contains(customer.Email, "@") {
+			fieldErrors.Add("email", "must be an email address")
+		}
+		if customer.Phone != "" && len(normalizeCustomerPhone(customer.Phone)) < 6 {
+			fieldErrors.Add("phone", "must be a phone number")
+		}
+		if request.Force && strings.TrimSpace(request.Reason) == "" {
+			fieldErrors.Add("reason", "is required when forcing a duplicate")
+		}
+		if customer.PreferredLanguage != "" && !isSupportedLanguage(customer.PreferredLanguage) {
+			fieldErrors.Add("preferred_language", "must be one of "+strings.Join(supportedLanguages, ", "))
+		}
+		values, err := customFieldService.checkValues(CustomFieldScopeCustomer, customer.CustomFields, "custom_fields", &fieldErrors)
+		if err != nil {
+			log.Printf("Error checking custom fields: %v", err)
+			http.Error(w, "Failed to create customer", http.StatusInternalServerError)
+			return
+		}
+		customer.CustomFields = values
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		customer.DuplicateReason = truncate(strings.TrimSpace(request.Reason), 500)
+		customer.CreatedBy = actorID(r)
+		err = customerService.CreateCustomer(&customer, request.Force)
+		if err == errCustomerExists {
+			writeCustomerConflict(w, r, customer)
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating customer: %v", err)
+			http.Error(w, "Failed to create customer", http.StatusInternalServerError)
+			return
+		}
+
+		if customer.DuplicateOf != "" {
+			log.Printf("Customer %s created by %s as a forced duplicate of %s: %s", customer.ID, actorID(r),
+				customer.DuplicateOf, customer.DuplicateReason)
+		} else {
+			log.Printf("Customer %s created by %s", customer.ID, actorID(r))
+		}
+		auditService.Record(r, AuditCustomerCreated, "customer", customer.ID, nil, customer)
+		w.Header().Set("Location", customerLink(customer.ID))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(customer)
+
+	case "PATCH":
+		if !hasPermission(r, PermTicketsEdit) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		var request struct {
+			PreferredLanguage string `json:"preferred_language"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if id == "" {
+			fieldErrors.Add("id", "is required")
+		}
+		if request.PreferredLanguage != "" && !isSupportedLanguage(request.PreferredLanguage) {
+			fieldErrors.Add("preferred_language", "must be one of "+strings.Join(supportedLanguages, ", "))
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		before, err := customerService.GetCustomer(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = customerService.SetPreferredLanguage(id, request.PreferredLanguage)
+		}
+		if err != nil {
+			log.Printf("Error updating customer %s: %v", id, err)
+			http.Error(w, "Failed to update customer", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditCustomerUpdated, "customer", id,
+			map[string]string{"preferred_language": before.PreferredLanguage}, request)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Customer updated successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and PATCH methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeCustomerConflict answers 409 with the customers the new one clashes
+// with and how to force the create.
+func writeCustomerConflict(w http.ResponseWriter, r *http.Request, customer Customer) {
+	matches, err := customerService.FindMatches(customer.Email, customer.Phone)
+	if err != nil {
+		log.Printf("Error loading conflicting customers: %v", err)
+		http.Error(w, errCustomerExists.Error(), http.StatusConflict)
+		return
+	}
+
+	type match struct {
+		Customer
+		Link          string   `json:"link"`
+		MatchedFields []string `json:"matched_fields"`
+	}
+	policy := piiPolicyFor(r)
+	existing := []match{}
+	for i, c := range matches {
+		m := match{Customer: c, Link: customerLink(c.ID)}
+		if customer.Email != "" && normalizeCustomerEmail(c.Email) == normalizeCustomerEmail(customer.Email) {
+			m.MatchedFields = append(m.MatchedFields, "email")
+		}
+		if customer.Phone != "" && normalizeCustomerPhone(c.Phone) == normalizeCustomerPhone(customer.Phone) {
+			m.MatchedFields = append(m.MatchedFields, "phone")
+		}
+		policy.shapeCustomers(matches[i : i+1])
+		m.Customer = matches[i]
+		existing = append(existing, m)
+	}
+	if len(existing) > 0 {
+		w.Header().Set("Location", existing[0].Link)
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":    "duplicate_customer",
+		"message":  errCustomerExists.Error(),
+		"existing": existing,
+		"hint":     `Use the existing customer, or resend with "force": true and a "reason" to create a separate record`,
+	})
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shops capture different intake data, so admins can define extra fields
+// for tickets, devices and customers. A definition has a key, a type (text,
+// number, date or dropdown, also accepted as "select") and can be required.
+// Values travel as a "custom_fields" object on the records' existing
+// endpoints: ticket intake and PATCH /api/v1/orders/{id} (with
+// "device_custom_fields" for the primary device), each entry of an intake
+// "devices" list, and customer creation.
+// They are validated against the active definitions and stored one row per
+// value in custom_field_values; ticket values and edits also go through the
+// ticket's event stream so its history shows them. Deactivating a field
+// stops it being offered or required but keeps the values already captured.
+//
+// Ticket lists filter on values (?custom_fields.<key>=, priority.go),
+// customer search matches them, the ticket rows report carries the
+// structured ones and the anonymized export the ones EXPORT_ANONYMIZATION
+// names (export.go).
+
+const customFieldsTable = `
+	CREATE TABLE IF NOT EXISTS custom_fields (
+		scope ENUM('ticket', 'device', 'customer') NOT NULL,
+		field_key VARCHAR(50) NOT NULL,
+		label VARCHAR(100) NOT NULL,
+		field_type ENUM('text', 'number', 'date', 'dropdown') NOT NULL,
+		options JSON NULL,
+		required BOOLEAN NOT NULL DEFAULT FALSE,
+		position INT NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		updated_by VARCHAR(50) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (scope, field_key)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const customFieldValuesTable = `
+	CREATE TABLE IF NOT EXISTS custom_field_values (
+		scope ENUM('ticket', 'device', 'customer') NOT NULL,
+		entity_id VARCHAR(50) NOT NULL,
+		field_key VARCHAR(50) NOT NULL,
+		value VARCHAR(1000) NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (scope, entity_id, field_key),
+		INDEX idx_custom_field_values_key (scope, field_key, value(100))
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Records custom fields can be defined for. Device values belong to a
+// ticket_devices row.
+const (
+	CustomFieldScopeTicket   = "ticket"
+	CustomFieldScopeDevice   = "device"
+	CustomFieldScopeCustomer = "customer"
+)
+
+var customFieldScopes = []string{CustomFieldScopeTicket, CustomFieldScopeDevice, CustomFieldScopeCustomer}
+
+// Custom field types.
+const (
+	CustomFieldText     = "text"
+	CustomFieldNumber   = "number"
+	CustomFieldDate     = "date"     // Stored as YYYY-MM-DD
+	CustomFieldDropdown = "dropdown" // One of Options
+)
+
+var customFieldTypes = []string{CustomFieldText, CustomFieldNumber, CustomFieldDate, CustomFieldDropdown}
+
+// Prefixes of the TicketEdited change keys that carry custom field edits of
+// the ticket and of its primary device.
+const (
+	ticketCustomFieldsPrefix = "custom_fields."
+	deviceCustomFieldsPrefix = "device_custom_fields."
+)
+
+// maxCustomFieldValue is the longest value stored.
+const maxCustomFieldValue = 1000
+
+var customFieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// CustomField defines an extra field on tickets, devices or customers.
+type CustomField struct {
+	Scope     string    `json:"scope"`
+	Key       string    `json:"key"`
+	Label     string    `json:"label"`
+	Type      string    `json:"type"`
+	Options   []string  `json:"options,omitempty"` // Choices of a dropdown
+	Required  bool      `json:"required"`
+	Position  int       `json:"position"` // Display order within the scope
+	Active    bool      `json:"active"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CustomFieldValues are a record's custom field values by key. Numbers may
+// be given as JSON numbers; every value reads back as a string.
+type CustomFieldValues map[string]string
+
+func (values *CustomFieldValues) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*values = CustomFieldValues{}
+	for key, message := range raw {
+		value, err := customFieldString(message)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			(*values)[key] = *value
+		}
+	}
+	return nil
+}
+
+// customFieldString reads a custom field value given as a string, number
+// or null (nil).
+func customFieldString(message json.RawMessage) (*string, error) {
+	message = bytes.TrimSpace(message)
+	if string(message) == "null" {
+		return nil, nil
+	}
+	var value string
+	if err := json.Unmarshal(message, &value); err == nil {
+		return &value, nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(message, &number); err != nil {
+		return nil, errors.New("custom field values must be strings, numbers or null")
+	}
+	value = number.String()
+	return &value, nil
+}
+
+// normalizeValue checks a non-empty value against the field's type and
+// returns it in its stored form, or a message saying what is wrong.
+func (cf *CustomField) normalizeValue(value string) (string, string) {
+	switch cf.Type {
+	case CustomFieldNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", "must be a number"
+		}
+	case CustomFieldDate:
+		var dateErrors ValidationErrors
+		date := parseDateField(cf.Key, value, &dateErrors)
+		if date == nil {
+			return "", "must be a date in YYYY-MM-DD or RFC3339 format"
+		}
+		value = date.Format("2006-01-02")
+	case CustomFieldDropdown:
+		if !slices.Contains(cf.Options, value) {
+			return "", "must be one of " + strings.Join(cf.Options, ", ")
+		}
+	}
+	if len(value) > maxCustomFieldValue {
+		return "", "is too long"
+	}
+	return value, ""
+}
+
+// CustomFieldService handles custom field definitions and values
+type CustomFieldService struct {
+	db *sql.DB
+}
+
+func NewCustomFieldService(database *sql.DB) *CustomFieldService {
+	return &CustomFieldService{db: database}
+}
+
+const customFieldColumns = `scope, field_key, label, field_type, options, required, position, active, updated_by, updated_at`
+
+func scanCustomField(row rowScanner) (*CustomField, error) {
+	var cf CustomField
+	var options, updatedBy sql.NullString
+	err := row.Scan(&cf.Scope, &cf.Key, &cf.Label, &cf.Type, &options, &cf.Required, &cf.Position, &cf.Active,
+		&updatedBy, &cf.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if options.Valid {
+		if err := json.Unmarshal([]byte(options.String), &cf.Options); err != nil {
+			return nil, err
+		}
+	}
+	cf.UpdatedBy = updatedBy.String
+	return &cf, nil
+}
+
+func (cs *CustomFieldService) GetField(scope, key string) (*CustomField, error) {
+	return scanCustomField(cs.db.QueryRow(`SELECT `+customFieldColumns+` FROM custom_fields WHERE scope = ? AND field_key = ?`,
+		scope, key))
+}
+
+// ListFields returns the fields of scope (every scope when empty) in
+// display order.
+func (cs *CustomFieldService) ListFields(scope string, includeInactive bool) ([]CustomField, error) {
+	query := `SELECT ` + customFieldColumns + ` FROM custom_fields WHERE (scope = ? OR ? = '')`
+	if !includeInactive {
+		query += ` AND active`
+	}
+	rows, err := cs.db.Query(query+` ORDER BY scope, position, label`, scope, scope)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := []CustomField{}
+	for rows.Next() {
+		cf, err := scanCustomField(rows)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, *cf)
+	}
+	return fields, rows.Err()
+}
+
+// SaveField creates a custom field or replaces an existing one.
+func (cs *CustomFieldService) SaveField(cf *CustomField, actorID string) error {
+	var options interface{}
+	if cf.Type == CustomFieldDropdown {
+		encoded, err := json.Marshal(cf.Options)
+		if err != nil {
+			return err
+		}
+		options = string(encoded)
+	}
+	_, err := cs.db.Exec(`
+		INSERT INTO custom_fields (scope, field_key, label, field_type, options, required, position, active, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE label = VALUES(label), field_type = VALUES(field_type), options = VALUES(options),
+			required = VALUES(required), position = VALUES(position), active = VALUES(active),
+			updated_by = VALUES(updated_by)
+	`, cf.Scope, cf.Key, cf.Label, cf.Type, options, cf.Required, cf.Position, cf.Active, nullString(actorID))
+	return err
+}
+
+// activeFields returns the active fields of scope by key.
+func (cs *CustomFieldService) activeFields(scope string) (map[string]CustomField, error) {
+	fields, err := cs.ListFields(scope, false)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]CustomField, len(fields))
+	for _, cf := range fields {
+		byKey[cf.Key] = cf
+	}
+	return byKey, nil
+}
+
+// checkValues validates the custom field values given for a new record of
+// scope, reported under field, and returns them in stored form. Every
+// required field must have a value.
+func (cs *CustomFieldService) checkValues(scope string, values CustomFieldValues, field string, fieldErrors *ValidationErrors) (CustomFieldValues, error) {
+	fields, err := cs.activeFields(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized := CustomFieldValues{}
+	for key, value := range values {
+		cf, known := fields[key]
+		if !known {
+			fieldErrors.Add(field+"."+key, "is not a custom field")
+			continue
+		}
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		stored, problem := cf.normalizeValue(value)
+		if problem != "" {
+			fieldErrors.Add(field+"."+key, problem)
+			continue
+		}
+		normalized[key] = stored
+	}
+	for key, cf := range fields {
+		if cf.Required && strings.TrimSpace(values[key]) == "" {
+			fieldErrors.Add(field+"."+key, "is required")
+		}
+	}
+	return normalized, nil
+}
+
+// checkIntakeCustomFields validates the ticket and device custom field
+// values of a new ticket, putting them in stored form.
+func checkIntakeCustomFields(order *Order, fieldErrors *ValidationErrors) error {
+	values, err := customFieldService.checkValues(CustomFieldScopeTicket, order.CustomFields, "custom_fields", fieldErrors)
+	if err != nil {
+		return err
+	}
+	order.CustomFields = values
+	for i := range order.Devices {
+		device := &order.Devices[i]
+		field := fmt.Sprintf("devices[%d].custom_fields", i)
+		values, err := customFieldService.checkValues(CustomFieldScopeDevice, device.CustomFields, field, fieldErrors)
+		if err != nil {
+			return err
+		}
+		device.CustomFields = values
+	}
+	return nil
+}
+
+// parseEdits validates a PATCH "custom_fields" object of scope into ticket
+// edits keyed prefix plus the field key; null or "" clears a value.
+func (cs *CustomFieldService) parseEdits(scope string, body json.RawMessage, field, prefix string, fieldErrors *ValidationErrors) (map[string]*string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		fieldErrors.Add(field, "must be an object of custom field values")
+		return nil, nil
+	}
+	fields, err := cs.activeFields(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	edits := map[string]*string{}
+	for key, message := range raw {
+		cf, known := fields[key]
+		if !known {
+			fieldErrors.Add(field+"."+key, "is not a custom field")
+			continue
+		}
+		value, err := customFieldString(message)
+		if err != nil {
+			fieldErrors.Add(field+"."+key, "must be a string, number or null")
+			continue
+		}
+		if value != nil {
+			trimmed := strings.TrimSpace(*value)
+			value = &trimmed
+			if trimmed == "" {
+				value = nil
+			}
+		}
+		if value == nil {
+			if cf.Required {
+				fieldErrors.Add(field+"."+key, "cannot be cleared")
+			}
+			edits[prefix+key] = nil
+			continue
+		}
+		stored, problem := cf.normalizeValue(*value)
+		if problem != "" {
+			fieldErrors.Add(field+"."+key, problem)
+			continue
+		}
+		edits[prefix+key] = &stored
+	}
+	return edits, nil
+}
+
+// parseCustomFieldEdits takes the "custom_fields" and "device_custom_fields"
+// objects out of a ticket PATCH body and validates them into edits.
+func parseCustomFieldEdits(body map[string]json.RawMessage, fieldErrors *ValidationErrors) (map[string]*string, error) {
+	edits := map[string]*string{}
+	for _, part := range []struct{ field, scope, prefix string }{
+		{"custom_fields", CustomFieldScopeTicket, ticketCustomFieldsPrefix},
+		{"device_custom_fields", CustomFieldScopeDevice, deviceCustomFieldsPrefix},
+	} {
+		raw, given := body[part.field]
+		if !given {
+			continue
+		}
+		delete(body, part.field)
+		partEdits, err := customFieldService.parseEdits(part.scope, raw, part.field, part.prefix, fieldErrors)
+		if err != nil {
+			return nil, err
+		}
+		for field, value := range partEdits {
+			edits[field] = value
+		}
+	}
+	return edits, nil
+}
+
+// saveCustomFieldValues stores values for a record, leaving other values
+// alone.
+func saveCustomFieldValues(tx execer, scope, entityID string, values CustomFieldValues) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := values[key]
+		if err := setCustomFieldValue(tx, scope, entityID, key, &value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCustomFieldValue stores one value of a record; nil removes it.
+func setCustomFieldValue(tx execer, scope, entityID, key string, value *string) error {
+	if value == nil {
+		_, err := tx.Exec(`DELETE FROM custom_field_values WHERE scope = ? AND entity_id = ? AND field_key = ?`,
+			scope, entityID, key)
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO custom_field_values (scope, entity_id, field_key, value) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE value = VALUES(value)
+	`, scope, entityID, key, *value)
+	return err
+}
+
+// loadCustomFieldValues returns the values of the records of scope by
+// record ID; every record gets a (possibly empty) map.
+func loadCustomFieldValues(q queryer, scope string, entityIDs []string) (map[string]CustomFieldValues, error) {
+	values := make(map[string]CustomFieldValues, len(entityIDs))
+	if len(entityIDs) == 0 {
+		return values, nil
+	}
+	for _, id := range entityIDs {
+		values[id] = CustomFieldValues{}
+	}
+
+	err := forEachIDBatch(entityIDs, func(placeholders string, args []interface{}) error {
+		rows, err := q.Query(`
+			SELECT entity_id, field_key, value FROM custom_field_values
+			WHERE scope = ? AND entity_id IN (`+placeholders+`)
+		`, append([]interface{}{scope}, args...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entityID, key, value string
+			if err := rows.Scan(&entityID, &key, &value); err != nil {
+				return err
+			}
+			values[entityID][key] = value
+		}
+		return rows.Err()
+	})
+	return values, err
+}
+
+// loadCustomFields fills in the ticket custom field values of orders.
+func (os *OrderService) loadCustomFields(orders []Order) error {
+	ids := make([]string, len(orders))
+	for i := range orders {
+		ids[i] = orders[i].ID
+	}
+	values, err := loadCustomFieldValues(os.db, CustomFieldScopeTicket, ids)
+	if err != nil {
+		return err
+	}
+	for i := range orders {
+		orders[i].CustomFields = values[orders[i].ID]
+	}
+	return nil
+}
+
+// projectCustomFields records the ticket custom field values given at
+// intake and follows edits of them. Device values are kept by
+// projectTicketDevices along with the devices they belong to.
+func projectCustomFields(tx *sql.Tx, event *TicketEvent) error {
+	switch event.Type {
+	case EventTicketCreated:
+		var order Order
+		if err := json.Unmarshal(event.Payload, &order); err != nil {
+			return err
+		}
+		return saveCustomFieldValues(tx, CustomFieldScopeTicket, event.TicketID, order.CustomFields)
+
+	case EventTicketEdited:
+		var payload TicketEditedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		for field, change := range payload.Changes {
+			if key, found := strings.CutPrefix(field, ticketCustomFieldsPrefix); found {
+				if err := setCustomFieldValue(tx, CustomFieldScopeTicket, event.TicketID, key, change.To); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var customFieldService *CustomFieldService
+
+// CustomFieldsHandler lists the active custom fields offered on forms
+// (GET ?scope=ticket, every scope when omitted).
+func CustomFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scope := r.URL.Query().Get("scope")
+	if scope != "" && !slices.Contains(customFieldScopes, scope) {
+		http.Error(w, "scope must be one of "+strings.Join(customFieldScopes, ", "), http.StatusBadRequest)
+		return
+	}
+	fields, err := customFieldService.ListFields(scope, false)
+	if err != nil {
+		log.Printf("Error listing custom fields: %v", err)
+		http.Error(w, "Failed to retrieve custom fields", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(fields)
+}
+
+// AdminCustomFieldsHandler lists every custom field (GET ?scope=) or
+// creates/updates one (PUT). Fields are retired with "active": false.
+func AdminCustomFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		fields, err := customFieldService.ListFields(r.URL.Query().Get("scope"), true)
+		if err != nil {
+			log.Printf("Error listing custom fields: %v", err)
+			http.Error(w, "Failed to retrieve custom fields", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(fields)
+
+	case "PUT":
+		// Active defaults to true so new fields are offered straight away
+		var request struct {
+			CustomField
+			Active *bool `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		cf := request.CustomField
+		cf.Active = request.Active == nil || *request.Active
+		cf.Label = strings.TrimSpace(cf.Label)
+		if cf.Type == "select" {
+			cf.Type = CustomFieldDropdown
+		}
+
+		var fieldErrors ValidationErrors
+		if !slices.Contains(customFieldScopes, cf.Scope) {
+			fieldErrors.Add("scope", "must be one of "+strings.Join(customFieldScopes, ", "))
+		}
+		if !customFieldKeyPattern.MatchString(cf.Key) {
+			fieldErrors.Add("key", "must start with a letter and hold at most 50 lower-case letters, digits or underscores")
+		}
+		if cf.Label == "" || len(cf.Label) > 100 {
+			fieldErrors.Add("label", "is required and at most 100 characters")
+		}
+		if !slices.Contains(customFieldTypes, cf.Type) {
+			fieldErrors.Add("type", "must be one of "+strings.Join(customFieldTypes, ", "))
+		}
+		if cf.Type == CustomFieldDropdown {
+			for i := range cf.Options {
+				cf.Options[i] = strings.TrimSpace(cf.Options[i])
+				if cf.Options[i] == "" || len(cf.Options[i]) > maxCustomFieldValue {
+					fieldErrors.Add("options", "must not be empty or longer than 1000 characters")
+				}
+			}
+			if len(cf.Options) == 0 {
+				fieldErrors.Add("options", "is required for a dropdown")
+			}
+		} else {
+			cf.Options = nil
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		previous, err := customFieldService.GetField(cf.Scope, cf.Key)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error loading custom field %s.%s: %v", cf.Scope, cf.Key, err)
+			http.Error(w, "Failed to save custom field", http.StatusInternalServerError)
+			return
+		}
+
+		if err := customFieldService.SaveField(&cf, actorID(r)); err != nil {
+			log.Printf("Error saving custom field %s.%s: %v", cf.Scope, cf.Key, err)
+			http.Error(w, "Failed to save custom field", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Custom field %s.%s saved by %s", cf.Scope, cf.Key, actorID(r))
+		auditService.Record(r, AuditCustomFieldSave, "custom_field", cf.Scope+"."+cf.Key, previous, cf)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Custom field saved successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduled database housekeeping: refreshing optimizer statistics on hot
+// tables, rebuilding tables with heavy churn and purging rows that have
+// outlived their use. Tasks run from the background worker when due; a
+// MySQL named lock keeps two instances from running the same task at once,
+// and every run is recorded in maintenance_runs.
+
+const maintenanceRunsTable = `
+	CREATE TABLE IF NOT EXISTS maintenance_runs (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		task VARCHAR(50) NOT NULL,
+		trigger_source ENUM('schedule', 'manual') NOT NULL,
+		status ENUM('running', 'succeeded', 'failed') NOT NULL DEFAULT 'running',
+		rows_affected BIGINT NOT NULL DEFAULT 0,
+		detail TEXT NULL,
+		started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		finished_at TIMESTAMP NULL,
+		INDEX idx_maintenance_runs_task (task, started_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// MaintenanceTask is one housekeeping job and how often it is due.
+type MaintenanceTask struct {
+	Name        string
+	Description string
+	Interval    time.Duration
+	Run         func(ctx context.Context) (int64, string, error)
+}
+
+// MaintenanceRun is one recorded execution of a task.
+type MaintenanceRun struct {
+	ID           int64      `json:"id"`
+	Task         string     `json:"task"`
+	Trigger      string     `json:"trigger"`
+	Status       string     `json:"status"`
+	RowsAffected int64      `json:"rows_affected"`
+	Detail       string     `json:"detail,omitempty"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+var errMaintenanceBusy = errors.New("task is already running")
+
+// Tables read on nearly every request, whose statistics drift as they grow
+var hotTables = []string{"orders", "ticket_events", "audit_log", "sessions", "outbox"}
+
+// Tables whose rows are mostly deleted again, leaving free space behind
+var churnTables = []string{"outbox", "sessions", "revoked_tokens", "password_resets"}
+
+// tableTask runs ANALYZE or OPTIMIZE over tables, reporting any table MySQL
+// flagged with an error.
+func tableTask(statement string, tables []string) func(ctx context.Context) (int64, string, error) {
+	return func(ctx context.Context) (int64, string, error) {
+		rows, err := db.QueryContext(ctx, statement+" "+strings.Join(tables, ", "))
+		if err != nil {
+			return 0, "", err
+		}
+		defer rows.Close()
+
+		var problems []string
+		for rows.Next() {
+			var table, op, msgType, msgText string
+			if err := rows.Scan(&table, &op, &msgType, &msgText); err != nil {
+				return 0, "", err
+			}
+			if msgType == "error" {
+				problems = append(problems, table+": "+msgText)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return 0, "", err
+		}
+		if len(problems) > 0 {
+			return 0, "", errors.New(strings.Join(problems, "; "))
+		}
+		return int64(len(tables)), strings.Join(tables, ", "), nil
+	}
+}
+
+// purgeTask deletes rows matching query, whose only argument is the cutoff
+// time for the retention period.
+func purgeTask(query string, retention time.Duration) func(ctx context.Context) (int64, string, error) {
+	return func(ctx context.Context) (int64, string, error) {
+		cutoff := time.Now().Add(-retention)
+		result, err := db.ExecContext(ctx, query, cutoff)
+		if err != nil {
+			return 0, "", err
+		}
+		rows, _ := result.RowsAffected()
+		return rows, "older than " + cutoff.Format(time.RFC3339), nil
+	}
+}
+
+// maintenanceTasks lists the scheduled housekeeping. Retention periods are
+// measured past expiry, so nothing that could still be used is removed.
+func maintenanceTasks() []MaintenanceTask {
+	return []MaintenanceTask{
+		{
+			Name:        "analyze_tables",
+			Description: "Refresh optimizer statistics on " + strings.Join(hotTables, ", "),
+			Interval:    getEnvDuration("MAINTENANCE_ANALYZE_INTERVAL", 24*time.Hour),
+			Run:         tableTask("ANALYZE TABLE", hotTables),
+		},
+		{
+			Name:        "optimize_tables",
+			Description: "Rebuild " + strings.Join(churnTables, ", ") + " to reclaim space from deleted rows",
+			Interval:    getEnvDuration("MAINTENANCE_OPTIMIZE_INTERVAL", 7*24*time.Hour),
+			Run:         tableTask("OPTIMIZE TABLE", churnTables),
+		},
+		{
+			Name:        "purge_sessions",
+			Description: "Delete sessions that expired or were revoked before the retention period",
+			Interval:    getEnvDuration("MAINTENANCE_PURGE_INTERVAL", time.Hour),
+			Run: purgeTask(`DELETE FROM sessions WHERE LEAST(expires_at, COALESCE(revoked_at, expires_at)) < ?`,
+				getEnvDuration("SESSION_RETENTION", 7*24*time.Hour)),
+		},
+		{
+			Name:        "purge_revoked_tokens",
+			Description: "Delete revoked access tokens that have expired anyway",
+			Interval:    getEnvDuration("TOKEN_REVOCATION_CLEANUP_INTERVAL", time.Hour),
+			Run:         purgeTask(`DELETE FROM revoked_tokens WHERE expires_at < ?`, 0),
+		},
+		{
+			Name:        "purge_password_resets",
+			Description: "Delete expired password reset codes and tokens",
+			Interval:    getEnvDuration("MAINTENANCE_PURGE_INTERVAL", time.Hour),
+			Run: purgeTask(`DELETE FROM password_resets WHERE expires_at < ? AND (reset_expires_at IS NULL OR reset_expires_at < NOW())`,
+				24*time.Hour),
+		},
+		{
+			Name:        "purge_estimate_links",
+			Description: "Delete expired customer estimate approval links",
+			Interval:    getEnvDuration("MAINTENANCE_PURGE_INTERVAL", time.Hour),
+			Run:         purgeTask(`DELETE FROM estimate_links WHERE expires_at < ?`, 0),
+		},
+		{
+			Name:        "purge_outbox",
+			Description: "Delete delivered notifications past the retention period, except for tickets under legal hold",
+			Interval:    getEnvDuration("MAINTENANCE_PURGE_INTERVAL", time.Hour),
+			Run: purgeTask(`DELETE FROM outbox WHERE status = 'delivered' AND delivered_at < ? AND `+legalHoldClause("outbox.aggregate_id"),
+				getEnvDuration("OUTBOX_RETENTION", 30*24*time.Hour)),
+		},
+		{
+			Name:        "revalue_inventory",
+			Description: "Write stock down to supplier prices that fell below its average cost",
+			Interval:    getEnvDuration("INVENTORY_REVALUATION_INTERVAL", 24*time.Hour),
+			Run: func(ctx context.Context) (int64, string, error) {
+				return partService.Revalue(ctx)
+			},
+		},
+		{
+			Name:        "purge_id_images",
+			Description: "Delete customer ID photos past their location's retention period, except on tickets under legal hold",
+			Interval:    getEnvDuration("MAINTENANCE_PURGE_INTERVAL", time.Hour),
+			Run: func(ctx context.Context) (int64, string, error) {
+				return identityService.PurgeImages(ctx)
+			},
+		},
+	}
+}
+
+// DBMaintenanceService schedules the housekeeping tasks and records runs
+type DBMaintenanceService struct {
+	db    *sql.DB
+	tasks []MaintenanceTask
+}
+
+func NewDBMaintenanceService(database *sql.DB) *DBMaintenanceService {
+	return &DBMaintenanceService{db: database, tasks: maintenanceTasks()}
+}
+
+func (dms *DBMaintenanceService) task(name string) (MaintenanceTask, bool) {
+	for _, task := range dms.tasks {
+		if task.Name == name {
+			return task, true
+		}
+	}
+	return MaintenanceTask{}, false
+}
+
+// lastSuccess returns when a task last finished successfully.
+func (dms *DBMaintenanceService) lastSuccess(ctx context.Context, name string) (*time.Time, error) {
+	var finishedAt sql.NullTime
+	err := dms.db.QueryRowContext(ctx, `
+		SELECT MAX(finished_at) FROM maintenance_runs WHERE task = ? AND status = 'succeeded'
+	`, name).Scan(&finishedAt)
+	return timePtr(finishedAt), err
+}
+
+// RunDue runs every task whose interval has elapsed since its last success.
+// It is the background worker's entry point.
+func (dms *DBMaintenanceService) RunDue(ctx context.Context) error {
+	for _, task := range dms.tasks {
+		last, err := dms.lastSuccess(ctx, task.Name)
+		if err != nil {
+			return err
+		}
+		if last != nil && time.Since(*last) < task.Interval {
+			continue
+		}
+		if _, err := dms.Execute(ctx, task, "schedule"); err != nil && err != errMaintenanceBusy {
+			log.Printf("Maintenance task %s failed: %v", task.Name, err)
+		}
+	}
+	return nil
+}
+
+// Execute runs a task under a named lock and records the run.
+func (dms *DBMaintenanceService) Execute(ctx context.Context, task MaintenanceTask, trigger string) (*MaintenanceRun, error) {
+	// Named locks belong to a connection, so hold one for the whole run
+	conn, err := dms.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	lockName := "pcrepairhub.maintenance." + task.Name
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 0)`, lockName).Scan(&acquired); err != nil {
+		return nil, err
+	}
+	if acquired.Int64 != 1 {
+		return nil, errMaintenanceBusy
+	}
+	defer conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, lockName)
+
+	run := &MaintenanceRun{Task: task.Name, Trigger: trigger, Status: "running", StartedAt: time.Now()}
+	result, err := dms.db.ExecContext(ctx, `
+		INSERT INTO maintenance_runs (task, trigger_source, started_at) VALUES (?, ?, ?)
+	`, run.Task, run.Trigger, run.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+	run.ID, _ = result.LastInsertId()
+
+	rows, detail, runErr := task.Run(ctx)
+	run.RowsAffected, run.Detail, run.Status = rows, detail, "succeeded"
+	if runErr != nil {
+		run.Status, run.Detail = "failed", runErr.Error()
+	}
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+
+	_, err = dms.db.ExecContext(context.Background(), `
+		UPDATE maintenance_runs SET status = ?, rows_affected = ?, detail = ?, finished_at = ? WHERE id = ?
+	`, run.Status, run.RowsAffected, nullString(run.Detail), finishedAt, run.ID)
+	if err != nil {
+		log.Printf("Error recording maintenance run %d: %v", run.ID, err)
+	}
+
+	if runErr != nil {
+		return run, runErr
+	}
+	if run.RowsAffected > 0 {
+		log.Printf("Maintenance task %s finished: %d rows (%s)", task.Name, run.RowsAffected, run.Detail)
+	}
+	return run, nil
+}
+
+// ListRuns returns recent runs, newest first.
+func (dms *DBMaintenanceService) ListRuns(task string, limit int) ([]MaintenanceRun, error) {
+	query := `
+		SELECT id, task, trigger_source, status, rows_affected, detail, started_at, finished_at
+		FROM maintenance_runs`
+	var args []interface{}
+	if task != "" {
+		query += " WHERE task = ?"
+		args = append(args, task)
+	}
+	query += " ORDER BY started_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := dms.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []MaintenanceRun{}
+	for rows.Next() {
+		var run MaintenanceRun
+		var detail sql.NullString
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&run.ID, &run.Task, &run.Trigger, &run.Status, &run.RowsAffected, &detail,
+			&run.StartedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+		run.Detail = detail.String
+		run.FinishedAt = timePtr(finishedAt)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+var dbMaintenanceService *DBMaintenanceService
+
+// dbMaintenanceJob checks for due tasks in the background.
+func dbMaintenanceJob() BackgroundJob {
+	return BackgroundJob{
+		Name:     "db_maintenance",
+		Interval: getEnvDuration("MAINTENANCE_CHECK_INTERVAL", 5*time.Minute),
+		Run:      dbMaintenanceService.RunDue,
+	}
+}
+
+// MaintenanceTasksHandler lists the scheduled tasks with their last success
+// (GET) or runs one immediately (POST {"task": "..."}). Admin only.
+func MaintenanceTasksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		type taskStatus struct {
+			Name        string     `json:"name"`
+			Description string     `json:"description"`
+			Interval    string     `json:"interval"`
+			LastSuccess *time.Time `json:"last_success,omitempty"`
+			NextDue     *time.Time `json:"next_due,omitempty"`
+		}
+		tasks := []taskStatus{}
+		for _, task := range dbMaintenanceService.tasks {
+			last, err := dbMaintenanceService.lastSuccess(r.Context(), task.Name)
+			if err != nil {
+				log.Printf("Error loading maintenance history: %v", err)
+				http.Error(w, "Failed to retrieve maintenance tasks", http.StatusInternalServerError)
+				return
+			}
+			status := taskStatus{Name: task.Name, Description: task.Description, Interval: task.Interval.String(), LastSuccess: last}
+			if last != nil {
+				next := last.Add(task.Interval)
+				status.NextDue = &next
+			}
+			tasks = append(tasks, status)
+		}
+		json.NewEncoder(w).Encode(tasks)
+
+	case "POST":
+		var request struct {
+			Task string `json:"task"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		task, ok := dbMaintenanceService.task(request.Task)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown maintenance task %q", request.Task), http.StatusBadRequest)
+			return
+		}
+
+		run, err := dbMaintenanceService.Execute(r.Context(), task, "manual")
+		if err == errMaintenanceBusy {
+			http.Error(w, "Task is already running", http.StatusConflict)
+			return
+		}
+		if run == nil && err != nil {
+			log.Printf("Error starting maintenance task %s: %v", task.Name, err)
+			http.Error(w, "Failed to run maintenance task", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Maintenance task %s run manually by %s: %s", task.Name, actorID(r), run.Status)
+		json.NewEncoder(w).Encode(run)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MaintenanceRunsHandler returns the run history (GET ?task=&limit=50).
+// Admin only.
+func MaintenanceRunsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	runs, err := dbMaintenanceService.ListRuns(r.URL.Query().Get("task"), limit)
+	if err != nil {
+		log.Printf("Error listing maintenance runs: %v", err)
+		http.Error(w, "Failed to retrieve maintenance runs", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(runs)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A ticket can cover several devices brought in for one job: a laptop, its
+// charger and an external drive. They are kept in ticket_devices in the
+// order given at intake. The first is the ticket's primary device and stays
+// mirrored in the orders device_type, device_model and device_serial columns,
+// so single-device payloads and readers of those fields keep working.
+// Intake accepts either a "devices" list or the single device fields; every
+// read of a ticket returns the full "devices" list. Tickets booked in before
+// the table existed read their primary device from the orders row. Device
+// custom fields (customfields.go) belong to the ticket_devices row and move
+// with it when tickets are merged or split.
+
+const ticketDevicesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_devices (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		position INT NOT NULL,
+		device_type VARCHAR(255) NOT NULL,
+		device_model VARCHAR(255) NULL,
+		device_serial VARCHAR(100) NULL,
+		note VARCHAR(255) NULL,
+		UNIQUE KEY uniq_ticket_device_position (order_id, position),
+		INDEX idx_ticket_devices_serial (device_serial),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// maxTicketDevices keeps one ticket to one job's worth of devices.
+const maxTicketDevices = 10
+
+// OrderDevice is one device on a ticket. Position 1 is the primary device.
+type OrderDevice struct {
+	ID           int64             `json:"-"` // ticket_devices row; 0 for the primary device of older tickets
+	Position     int               `json:"position"`
+	DeviceType   string            `json:"device_type"`
+	DeviceModel  string            `json:"device_model,omitempty"`
+	DeviceSerial string            `json:"device_serial,omitempty"`
+	Note         string            `json:"note,omitempty"` // e.g. "charger, no case"
+	CustomFields CustomFieldValues `json:"custom_fields,omitempty"`
+}
+
+// primaryDevice returns the device held in the orders row.
+func primaryDevice(order *Order) OrderDevice {
+	return OrderDevice{
+		Position:     1,
+		DeviceType:   order.DeviceType,
+		DeviceModel:  order.DeviceModel,
+		DeviceSerial: order.DeviceSerial,
+	}
+}
+
+// normalizeIntakeDevices validates the devices of a new ticket and makes the
+// first one the primary device. A payload with only the single device fields
+// becomes a one-device list.
+func normalizeIntakeDevices(order *Order, fieldErrors *ValidationErrors) {
+	if len(order.Devices) == 0 {
+		if order.DeviceType != "" {
+			order.Devices = []OrderDevice{primaryDevice(order)}
+		}
+		return
+	}
+	if len(order.Devices) > maxTicketDevices {
+		fieldErrors.Add("devices", fmt.Sprintf("at most %d devices fit on one ticket", maxTicketDevices))
+		return
+	}
+
+	for i := range order.Devices {
+		device := &order.Devices[i]
+		field := fmt.Sprintf("devices[%d]", i)
+		device.Position = i + 1
+		device.DeviceType = strings.TrimSpace(device.DeviceType)
+		device.DeviceModel = strings.TrimSpace(device.DeviceModel)
+		device.DeviceSerial = strings.TrimSpace(device.DeviceSerial)
+		device.Note = strings.TrimSpace(device.Note)
+		if device.DeviceType == "" {
+			fieldErrors.Add(field+".device_type", "is required")
+		} else if len(device.DeviceType) > 255 {
+			fieldErrors.Add(field+".device_type", "is too long")
+		}
+		if len(device.DeviceModel) > 255 {
+			fieldErrors.Add(field+".device_model", "is too long")
+		}
+		if len(device.DeviceSerial) > 100 {
+			fieldErrors.Add(field+".device_serial", "is too long")
+		}
+		if len(device.Note) > 255 {
+			fieldErrors.Add(field+".note", "is too long")
+		}
+	}
+
+	primary := order.Devices[0]
+	order.DeviceType, order.DeviceModel, order.DeviceSerial = primary.DeviceType, primary.DeviceModel, primary.DeviceSerial
+}
+
+// intakeDevices returns the devices being booked in on a new ticket.
+func intakeDevices(order *Order) []OrderDevice {
+	if len(order.Devices) == 0 {
+		return []OrderDevice{primaryDevice(order)}
+	}
+	return order.Devices
+}
+
+// intakeSerials returns the distinct serials of the devices being booked in.
+func intakeSerials(order *Order) []string {
+	var serials []string
+	for _, device := range intakeDevices(order) {
+		serial := strings.TrimSpace(device.DeviceSerial)
+		if serial != "" && !slices.Contains(serials, serial) {
+			serials = append(serials, serial)
+		}
+	}
+	return serials
+}
+
+// projectTicketDevices records the devices of a new ticket and follows
+// edits of the primary device.
+func projectTicketDevices(tx *sql.Tx, event *TicketEvent) error {
+	switch event.Type {
+	case EventTicketCreated:
+		var order Order
+		if err := json.Unmarshal(event.Payload, &order); err != nil {
+			return err
+		}
+		devices := order.Devices
+		if len(devices) == 0 && order.DeviceType != "" {
+			devices = []OrderDevice{primaryDevice(&order)}
+		}
+		for i, device := range devices {
+			result, err := tx.Exec(`
+				INSERT INTO ticket_devices (order_id, position, device_type, device_model, device_serial, note)
+				VALUES (?, ?, ?, ?, ?, ?)
+			`, event.TicketID, i+1, device.DeviceType, nullString(device.DeviceModel),
+				nullString(device.DeviceSerial), nullString(device.Note))
+			if err != nil {
+				return err
+			}
+			if err := saveDeviceCustomFields(tx, result, device.CustomFields); err != nil {
+				return err
+			}
+		}
+
+	case EventTicketMerged:
+		var payload TicketMergedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		for _, device := range payload.Devices {
+			result, err := tx.Exec(`
+				INSERT INTO ticket_devices (order_id, position, device_type, device_model, device_serial, note)
+				SELECT ?, COALESCE(MAX(position), 1) + 1, ?, ?, ?, ? FROM ticket_devices WHERE order_id = ?
+			`, event.TicketID, device.DeviceType, nullString(device.DeviceModel), nullString(device.DeviceSerial),
+				nullString(device.Note), event.TicketID)
+			if err != nil {
+				return err
+			}
+			if err := saveDeviceCustomFields(tx, result, device.CustomFields); err != nil {
+				return err
+			}
+		}
+
+	case EventTicketSplit:
+		var payload TicketSplitPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		for _, position := range payload.Devices {
+			if _, err := tx.Exec(`
+				DELETE v FROM custom_field_values v JOIN ticket_devices d ON v.entity_id = CAST(d.id AS CHAR)
+				WHERE v.scope = ? AND d.order_id = ? AND d.position = ?
+			`, CustomFieldScopeDevice, event.TicketID, position); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM ticket_devices WHERE order_id = ? AND position = ?`, event.TicketID, position); err != nil {
+				return err
+			}
+		}
+
+	case EventTicketEdited:
+		var payload TicketEditedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		for _, field := range []string{"device_type", "device_model", "device_serial"} {
+			change, ok := payload.Changes[field]
+			if !ok {
+				continue
+			}
+			var value interface{}
+			if change.To != nil {
+				value = *change.To
+			}
+			if _, err := tx.Exec(`UPDATE ticket_devices SET `+field+` = ? WHERE order_id = ? AND position = 1`,
+				value, event.TicketID); err != nil {
+				return err
+			}
+		}
+		for field, change := range payload.Changes {
+			key, found := strings.CutPrefix(field, deviceCustomFieldsPrefix)
+			if !found {
+				continue
+			}
+			var deviceID int64
+			// Tickets that predate ticket_devices have no row to hold the value
+			err := tx.QueryRow(`SELECT id FROM ticket_devices WHERE order_id = ? AND position = 1`, event.TicketID).Scan(&deviceID)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := setCustomFieldValue(tx, CustomFieldScopeDevice, strconv.FormatInt(deviceID, 10), key, change.To); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveDeviceCustomFields stores the custom field values of the device row
+// just inserted.
+func saveDeviceCustomFields(tx *sql.Tx, inserted sql.Result, values CustomFieldValues) error {
+	if len(values) == 0 {
+		return nil
+	}
+	deviceID, err := inserted.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return saveCustomFieldValues(tx, CustomFieldScopeDevice, strconv.FormatInt(deviceID, 10), values)
+}
+
+// loadDevices fills in the devices of orders read from the orders table.
+func (os *OrderService) loadDevices(orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	index := make(map[string]int, len(orders))
+	ids := make([]string, len(orders))
+	for i := range orders {
+		index[orders[i].ID] = i
+		ids[i] = orders[i].ID
+		orders[i].Devices = nil
+	}
+
+	var deviceIDs []string
+	err := forEachIDBatch(ids, func(placeholders string, args []interface{}) error {
+		rows, err := os.db.Query(`
+			SELECT id, order_id, position, device_type, device_model, device_serial, note
+			FROM ticket_devices WHERE order_id IN (`+placeholders+`)
+			ORDER BY order_id, position
+		`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var orderID string
+			var device OrderDevice
+			var model, serial, note sql.NullString
+			if err := rows.Scan(&device.ID, &orderID, &device.Position, &device.DeviceType, &model, &serial, &note); err != nil {
+				return err
+			}
+			device.DeviceModel, device.DeviceSerial, device.Note = model.String, serial.String, note.String
+			order := &orders[index[orderID]]
+			order.Devices = append(order.Devices, device)
+			deviceIDs = append(deviceIDs, strconv.FormatInt(device.ID, 10))
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	values, err := loadCustomFieldValues(os.db, CustomFieldScopeDevice, deviceIDs)
+	if err != nil {
+		return err
+	}
+	for i := range orders {
+		for j := range orders[i].Devices {
+			device := &orders[i].Devices[j]
+			device.CustomFields = values[strconv.FormatInt(device.ID, 10)]
+		}
+	}
+
+	// Tickets that predate ticket_devices have only their primary device
+	for i := range orders {
+		if orders[i].Devices == nil {
+			orders[i].Devices = []OrderDevice{primaryDevice(&orders[i])}
+		}
+	}
+	return nil
+}
+
+// deviceSerialClause matches tickets with any device carrying the ? serial,
+// which must be passed twice.
+const deviceSerialClause = `(device_serial = ? OR id IN (SELECT order_id FROM ticket_devices WHERE device_serial = ?))`
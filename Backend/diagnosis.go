@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An engineer's diagnosis is kept apart from the customer's issue
+// description: what was found, the root cause, the recommended actions and
+// the parts needed. Engineers write it at /api/v1/orders/{id}/diagnosis and
+// every save is a new version, so earlier findings are never lost. Nothing
+// reaches the customer until a version is published; the latest published
+// version is shown on the estimate approval page and the ticket status
+// view, while staff see the latest version on the ticket detail and in the
+// case file.
+
+const ticketDiagnosesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_diagnoses (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		version INT NOT NULL,
+		findings TEXT NOT NULL,
+		root_cause TEXT NULL,
+		recommended_actions TEXT NULL,
+		parts_needed JSON NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		published_at TIMESTAMP NULL,
+		published_by VARCHAR(50) NULL,
+		UNIQUE KEY uniq_ticket_diagnoses_version (order_id, version),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Diagnosis limits
+const (
+	maxDiagnosisLength = 5000
+	maxDiagnosisParts  = 20
+)
+
+var errDiagnosisNone = errors.New("the ticket has no diagnosis")
+
+// DiagnosisPart is a part the repair needs.
+type DiagnosisPart struct {
+	Description string `json:"description"`
+	SKU         string `json:"sku,omitempty"`
+	Quantity    int    `json:"quantity"`
+}
+
+// DiagnosticReport is one version of a ticket's diagnosis.
+type DiagnosticReport struct {
+	OrderID            string          `json:"order_id"`
+	Version            int             `json:"version"`
+	Findings           string          `json:"findings"`
+	RootCause          string          `json:"root_cause,omitempty"`
+	RecommendedActions string          `json:"recommended_actions,omitempty"`
+	PartsNeeded        []DiagnosisPart `json:"parts_needed"`
+	CreatedBy          string          `json:"created_by,omitempty"`
+	CreatedAt          time.Time       `json:"created_at"`
+	PublishedAt        *time.Time      `json:"published_at,omitempty"`
+	PublishedBy        string          `json:"published_by,omitempty"`
+}
+
+// customerView strips the staff details from a published report.
+func (report DiagnosticReport) customerView() *DiagnosticReport {
+	report.CreatedBy, report.PublishedBy = "", ""
+	return &report
+}
+
+// DiagnosisService handles diagnostic report database operations
+type DiagnosisService struct {
+	db *sql.DB
+}
+
+func NewDiagnosisService(database *sql.DB) *DiagnosisService {
+	return &DiagnosisService{db: database}
+}
+
+var diagnosisService *DiagnosisService
+
+const diagnosisColumns = `order_id, version, findings, root_cause, recommended_actions, parts_needed,
+	created_by, created_at, published_at, published_by`
+
+func scanDiagnosis(row rowScanner) (*DiagnosticReport, error) {
+	report := &DiagnosticReport{}
+	var rootCause, actions, createdBy, publishedBy sql.NullString
+	var parts []byte
+	var publishedAt sql.NullTime
+	err := row.Scan(&report.OrderID, &report.Version, &report.Findings, &rootCause, &actions, &parts,
+		&createdBy, &report.CreatedAt, &publishedAt, &publishedBy)
+	if err != nil {
+		return nil, err
+	}
+	report.RootCause, report.RecommendedActions = rootCause.String, actions.String
+	report.CreatedBy, report.PublishedBy = createdBy.String, publishedBy.String
+	report.PublishedAt = timePtr(publishedAt)
+	report.PartsNeeded = []DiagnosisPart{}
+	if len(parts) > 0 {
+		if err := json.Unmarshal(parts, &report.PartsNeeded); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// Save stores report as the ticket's next version, published straight away
+// when publish is set.
+func (ds *DiagnosisService) Save(report *DiagnosticReport, publish bool) error {
+	parts, err := json.Marshal(report.PartsNeeded)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`SELECT deleted_at FROM orders WHERE id = ? FOR UPDATE`, report.OrderID).Scan(&deletedAt)
+	if err != nil {
+		return err
+	}
+	if deletedAt.Valid {
+		return &StatusGuardError{Reason: "the ticket is cancelled"}
+	}
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM ticket_diagnoses WHERE order_id = ?`, report.OrderID).
+		Scan(&report.Version)
+	if err != nil {
+		return err
+	}
+
+	report.CreatedAt = time.Now()
+	report.PublishedAt, report.PublishedBy = nil, ""
+	if publish {
+		report.PublishedAt, report.PublishedBy = &report.CreatedAt, report.CreatedBy
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ticket_diagnoses (order_id, version, findings, root_cause, recommended_actions, parts_needed,
+		                              created_by, created_at, published_at, published_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, report.OrderID, report.Version, report.Findings, nullString(report.RootCause),
+		nullString(report.RecommendedActions), string(parts), nullString(report.CreatedBy), report.CreatedAt,
+		report.PublishedAt, nullString(report.PublishedBy))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Publish shows a version to the customer; version 0 means the latest.
+// Publishing a version already published changes nothing.
+func (ds *DiagnosisService) Publish(orderID string, version int, actorID string) (*DiagnosticReport, error) {
+	if version == 0 {
+		err := ds.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ticket_diagnoses WHERE order_id = ?`, orderID).
+			Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		if version == 0 {
+			return nil, errDiagnosisNone
+		}
+	}
+	_, err := ds.db.Exec(`
+		UPDATE ticket_diagnoses SET published_at = NOW(), published_by = ?
+		WHERE order_id = ? AND version = ? AND published_at IS NULL
+	`, nullString(actorID), orderID, version)
+	if err != nil {
+		return nil, err
+	}
+	report, err := scanDiagnosis(ds.db.QueryRow(`
+		SELECT `+diagnosisColumns+` FROM ticket_diagnoses WHERE order_id = ? AND version = ?
+	`, orderID, version))
+	if err == sql.ErrNoRows {
+		return nil, errDiagnosisNone
+	}
+	return report, err
+}
+
+// Versions returns every version of a ticket's diagnosis, newest first.
+func (ds *DiagnosisService) Versions(orderID string) ([]DiagnosticReport, error) {
+	rows, err := ds.db.Query(`
+		SELECT `+diagnosisColumns+` FROM ticket_diagnoses WHERE order_id = ? ORDER BY version DESC
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []DiagnosticReport{}
+	for rows.Next() {
+		report, err := scanDiagnosis(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, rows.Err()
+}
+
+// Latest returns the newest version, or nil when there is none.
+func (ds *DiagnosisService) Latest(orderID string) (*DiagnosticReport, error) {
+	return ds.latest(`order_id = ?`, orderID)
+}
+
+// Published returns the newest published version without its staff
+// details, or nil when none has been published.
+func (ds *DiagnosisService) Published(orderID string) (*DiagnosticReport, error) {
+	report, err := ds.latest(`order_id = ? AND published_at IS NOT NULL`, orderID)
+	if report == nil {
+		return nil, err
+	}
+	return report.customerView(), nil
+}
+
+func (ds *DiagnosisService) latest(where string, args ...interface{}) (*DiagnosticReport, error) {
+	report, err := scanDiagnosis(ds.db.QueryRow(`
+		SELECT `+diagnosisColumns+` FROM ticket_diagnoses WHERE `+where+` ORDER BY version DESC LIMIT 1
+	`, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return report, err
+}
+
+// checkDiagnosis validates a report being saved.
+func checkDiagnosis(report *DiagnosticReport) ValidationErrors {
+	var fieldErrors ValidationErrors
+	report.Findings = strings.TrimSpace(report.Findings)
+	report.RootCause = strings.TrimSpace(report.RootCause)
+	report.RecommendedActions = strings.TrimSpace(report.RecommendedActions)
+	if report.Findings == "" {
+		fieldErrors.Add("findings", "is required")
+	}
+	for _, field := range []struct {
+		name, value string
+	}{{"findings", report.Findings}, {"root_cause", report.RootCause}, {"recommended_actions", report.RecommendedActions}} {
+		if len(field.value) > maxDiagnosisLength {
+			fieldErrors.Add(field.name, fmt.Sprintf("must be at most %d characters", maxDiagnosisLength))
+		}
+	}
+	if len(report.PartsNeeded) > maxDiagnosisParts {
+		fieldErrors.Add("parts_needed", fmt.Sprintf("must have at most %d parts", maxDiagnosisParts))
+	}
+	if report.PartsNeeded == nil {
+		report.PartsNeeded = []DiagnosisPart{}
+	}
+	for i := range report.PartsNeeded {
+		part := &report.PartsNeeded[i]
+		part.Description = strings.TrimSpace(part.Description)
+		part.SKU = strings.TrimSpace(part.SKU)
+		if part.Quantity == 0 {
+			part.Quantity = 1
+		}
+		field := fmt.Sprintf("parts_needed[%d]", i)
+		if part.Description == "" || len(part.Description) > 255 {
+			fieldErrors.Add(field+".description", "is required and must be at most 255 characters")
+		}
+		if len(part.SKU) > 100 {
+			fieldErrors.Add(field+".sku", "must be at most 100 characters")
+		}
+		if part.Quantity < 1 || part.Quantity > 99 {
+			fieldErrors.Add(field+".quantity", "must be between 1 and 99")
+		}
+	}
+	return fieldErrors
+}
+
+// orderDiagnosis serves /api/v1/orders/{id}/diagnosis: GET returns every
+// version newest first, PUT saves a new version ({"findings": "...",
+// "root_cause": "...", "recommended_actions": "...", "parts_needed":
+// [{"description": "...", "sku": "...", "quantity": 1}], "publish": true}).
+func orderDiagnosis(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		versions, err := diagnosisService.Versions(orderID)
+		if err != nil {
+			log.Printf("Error listing diagnosis of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve diagnosis", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(versions)
+
+	case "PUT":
+		if !hasPermission(r, PermDiagnosisEdit) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			DiagnosticReport
+			Publish bool `json:"publish"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		report := request.DiagnosticReport
+		if fieldErrors := checkDiagnosis(&report); len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		report.OrderID, report.CreatedBy = orderID, actorID(r)
+		err := diagnosisService.Save(&report, request.Publish)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if guardErr, ok := err.(*StatusGuardError); ok {
+			http.Error(w, guardErr.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving diagnosis of order %s: %v", orderID, err)
+			http.Error(w, "Failed to save diagnosis", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Diagnosis version %d of order %s saved by %s", report.Version, orderID, actorID(r))
+		auditService.Record(r, AuditDiagnosisSaved, "order", orderID, nil, report)
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// publishDiagnosis serves POST /api/v1/orders/{id}/diagnosis/publish
+// ({"version": 2}, the latest when left out).
+func publishDiagnosis(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermDiagnosisEdit) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Version int `json:"version"`
+	}
+	// An empty body publishes the latest version
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.Version < 0 {
+		var fieldErrors ValidationErrors
+		fieldErrors.Add("version", "must be a positive integer")
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, err := diagnosisService.Publish(orderID, request.Version, actorID(r))
+	if err == errDiagnosisNone {
+		http.Error(w, "Diagnosis not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error publishing diagnosis of order %s: %v", orderID, err)
+		http.Error(w, "Failed to publish diagnosis", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Diagnosis version %d of order %s published by %s", report.Version, orderID, actorID(r))
+	auditService.Record(r, AuditDiagnosisPublished, "order", orderID, nil, map[string]int{"version": report.Version})
+	json.NewEncoder(w).Encode(report)
+}
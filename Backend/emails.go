@@ -0,0 +1,1027 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Customer emails are sent by the outbox worker through an HTTP email API
+// and every one is kept in the communication log (email_messages). The
+// provider (SES via SNS, Mailgun or SendGrid) reports deliveries, bounces
+// and complaints to /api/v1/public/email-events/{provider}; each report is
+// stored against its message, and a hard bounce or complaint flags the
+// address so the shop stops mailing it until staff correct or clear it.
+// Reports are accepted only with the provider's own signature: SNS messages
+// signed by AWS for the configured topic, and Mailgun and SendGrid webhooks
+// signed with the shop's keys.
+
+const emailMessagesTable = `
+	CREATE TABLE IF NOT EXISTS email_messages (
+		id VARCHAR(50) PRIMARY KEY,
+		order_id VARCHAR(50) NULL,
+		outbox_id BIGINT NULL,
+		recipient VARCHAR(255) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		provider VARCHAR(20) NOT NULL,
+		provider_message_id VARCHAR(255) NULL,
+		status ENUM('sent', 'deferred', 'delivered', 'bounced', 'complained', 'suppressed', 'failed') NOT NULL,
+		status_detail VARCHAR(500) NULL,
+		sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX idx_email_messages_order (order_id, sent_at),
+		INDEX idx_email_messages_provider (provider, provider_message_id),
+		UNIQUE KEY uniq_email_messages_outbox (outbox_id)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const emailEventsTable = `
+	CREATE TABLE IF NOT EXISTS email_events (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		message_id VARCHAR(50) NULL,
+		provider VARCHAR(20) NOT NULL,
+		recipient VARCHAR(255) NOT NULL,
+		event ENUM('delivered', 'deferred', 'bounced', 'complained') NOT NULL,
+		permanent BOOLEAN NOT NULL DEFAULT FALSE,
+		detail VARCHAR(500) NULL,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_email_events_message (message_id)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const emailFlagsTable = `
+	CREATE TABLE IF NOT EXISTS email_flags (
+		email_key VARCHAR(255) PRIMARY KEY,
+		reason ENUM('bounced', 'complained') NOT NULL,
+		detail VARCHAR(500) NULL,
+		message_id VARCHAR(50) NULL,
+		flagged_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Email delivery states, in the order they may replace each other
+const (
+	EmailSent       = "sent"
+	EmailDeferred   = "deferred"
+	EmailDelivered  = "delivered"
+	EmailBounced    = "bounced"
+	EmailComplained = "complained"
+	EmailSuppressed = "suppressed"
+	EmailFailed     = "failed"
+)
+
+// emailStatusRank stops a late report from undoing a worse one: a complaint
+// may follow a delivery, but a delivery never clears a bounce.
+var emailStatusRank = map[string]int{
+	EmailSent: 0, EmailDeferred: 0, EmailDelivered: 1, EmailBounced: 2, EmailComplained: 3,
+}
+
+// EmailMessage is one entry of the communication log.
+type EmailMessage struct {
+	ID                string       `json:"id"`
+	OrderID           string       `json:"order_id,omitempty"`
+	Recipient         string       `json:"recipient"`
+	Subject           string       `json:"subject"`
+	Provider          string       `json:"provider"`
+	ProviderMessageID string       `json:"provider_message_id,omitempty"`
+	Status            string       `json:"status"`
+	StatusDetail      string       `json:"status_detail,omitempty"`
+	SentAt            time.Time    `json:"sent_at"`
+	UpdatedAt         time.Time    `json:"updated_at"`
+	Events            []EmailEvent `json:"events"`
+}
+
+// EmailEvent is a delivery report from the provider.
+type EmailEvent struct {
+	MessageID  string    `json:"-"`
+	Provider   string    `json:"provider"`
+	Recipient  string    `json:"recipient"`
+	Event      string    `json:"event"`
+	Permanent  bool      `json:"permanent,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+
+	providerMessageID string
+}
+
+// EmailFlag marks an address the shop should not send to.
+type EmailFlag struct {
+	Email     string    `json:"email"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	FlaggedAt time.Time `json:"flagged_at"`
+}
+
+// EmailAttachment is a file sent with an email. Its content is base64 in
+// the email API payload.
+type EmailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// EmailProvider sends one email and returns the provider's message ID.
+type EmailProvider interface {
+	Send(to, subject, body string, attachments ...EmailAttachment) (string, error)
+}
+
+// logEmailProvider prints emails to the log instead of sending them.
+type logEmailProvider struct{}
+
+func (logEmailProvider) Send(to, subject, body string, attachments ...EmailAttachment) (string, error) {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	for _, attachment := range attachments {
+		log.Printf("Email attachment %s (%s, %s)", attachment.Filename, attachment.ContentType, formatBytes(int64(len(attachment.Content))))
+	}
+	return fmt.Sprintf("log-%d", time.Now().UnixNano()), nil
+}
+
+// httpEmailProvider posts emails to a JSON email API and reads the message
+// ID from the response body (id, message_id or MessageId) or the
+// X-Message-Id header.
+type httpEmailProvider struct {
+	url    string
+	apiKey string
+	from   string
+	client *http.Client
+}
+
+func (hp *httpEmailProvider) Send(to, subject, body string, attachments ...EmailAttachment) (string, error) {
+	message := map[string]interface{}{"from": hp.from, "to": to, "subject": subject, "text": body}
+	if len(attachments) > 0 {
+		message["attachments"] = attachments
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", hp.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hp.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+hp.apiKey)
+	}
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("email API returned %s", resp.Status)
+	}
+
+	var result struct {
+		ID        string `json:"id"`
+		MessageID string `json:"message_id"`
+		SESID     string `json:"MessageId"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	for _, id := range []string{result.ID, result.MessageID, result.SESID, resp.Header.Get("X-Message-Id")} {
+		if id != "" {
+			return normalizeProviderMessageID(id), nil
+		}
+	}
+	return "", nil
+}
+
+// normalizeProviderMessageID strips the angle brackets Mailgun uses and the
+// ".filter..." suffix SendGrid adds to event message IDs.
+func normalizeProviderMessageID(id string) string {
+	id = strings.Trim(strings.TrimSpace(id), "<>")
+	if base, _, found := strings.Cut(id, ".filter"); found {
+		return base
+	}
+	return id
+}
+
+// emailProviderNames are the providers whose webhooks are understood.
+var emailProviderNames = []string{"ses", "mailgun", "sendgrid"}
+
+// EmailService sends customer emails and tracks their delivery
+type EmailService struct {
+	db       *sql.DB
+	provider EmailProvider
+	name     string // Provider whose webhooks report on our messages
+}
+
+func NewEmailService(database *sql.DB) *EmailService {
+	service := &EmailService{db: database, provider: logEmailProvider{}, name: "log"}
+	if url := getEnv("EMAIL_API_URL", ""); url != "" {
+		service.provider = &httpEmailProvider{
+			url:    url,
+			apiKey: getEnv("EMAIL_API_KEY", ""),
+			from:   getEnv("EMAIL_FROM", "PC Repair Hub <no-reply@pcrepairhub.local>"),
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+		service.name = strings.ToLower(getEnv("EMAIL_PROVIDER", "ses"))
+	}
+	return service
+}
+
+// Flag returns the flag on an address, or nil.
+func (es *EmailService) Flag(email string) (*EmailFlag, error) {
+	flag := EmailFlag{Email: normalizeCustomerEmail(email)}
+	var detail, messageID sql.NullString
+	err := es.db.QueryRow(`SELECT reason, detail, message_id, flagged_at FROM email_flags WHERE email_key = ?`, flag.Email).
+		Scan(&flag.Reason, &detail, &messageID, &flag.FlaggedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	flag.Detail = detail.String
+	flag.MessageID = messageID.String
+	return &flag, nil
+}
+
+// Send emails a customer about a ticket and logs the message. Flagged
+// addresses are not sent to; the message is logged as suppressed. A
+// message already sent or suppressed for the outbox entry is not sent
+// again; failed attempts are logged without the entry, so the outbox's
+// retry of the same entry sends it.
+func (es *EmailService) Send(orderID string, outboxID int64, to, subject, body string, attachments ...EmailAttachment) error {
+	var exists int
+	err := es.db.QueryRow(`SELECT COUNT(*) FROM email_messages WHERE outbox_id = ? AND status <> ?`, outboxID, EmailFailed).
+		Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	message := EmailMessage{
+		ID:        fmt.Sprintf("MSG-%d", time.Now().UnixNano()),
+		OrderID:   orderID,
+		Recipient: to,
+		Subject:   subject,
+		Provider:  es.name,
+		Status:    EmailSent,
+	}
+	flag, err := es.Flag(to)
+	if err != nil {
+		return err
+	}
+	// Failures logged against the entry before they were kept apart
+	if _, err := es.db.Exec(`UPDATE email_messages SET outbox_id = NULL WHERE outbox_id = ? AND status = ?`,
+		outboxID, EmailFailed); err != nil {
+		return err
+	}
+	if flag != nil {
+		message.Status, message.StatusDetail = EmailSuppressed, "address flagged as "+flag.Reason
+	} else if message.ProviderMessageID, err = es.provider.Send(to, subject, body, attachments...); err != nil {
+		message.Status, message.StatusDetail = EmailFailed, err.Error()
+	}
+
+	loggedOutboxID := sql.NullInt64{Int64: outboxID, Valid: message.Status != EmailFailed}
+	_, insertErr := es.db.Exec(`
+		INSERT INTO email_messages (id, order_id, outbox_id, recipient, subject, provider, provider_message_id, status, status_detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, message.ID, nullString(orderID), loggedOutboxID, to, truncate(subject, 255), message.Provider,
+		nullString(message.ProviderMessageID), message.Status, nullString(truncate(message.StatusDetail, 500)))
+	if insertErr != nil {
+		return insertErr
+	}
+	// A failed send is logged and the outbox retries the entry
+	if message.Status == EmailFailed {
+		return err
+	}
+	return nil
+}
+
+// RecordEvent stores a provider report, moves its message's status forward
+// and flags the address on a hard bounce or complaint.
+func (es *EmailService) RecordEvent(provider string, event EmailEvent) error {
+	tx, err := es.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`SELECT id, status FROM email_messages WHERE provider = ? AND provider_message_id = ? FOR UPDATE`,
+		provider, event.providerMessageID).Scan(&event.MessageID, &status)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO email_events (message_id, provider, recipient, event, permanent, detail)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, nullString(event.MessageID), provider, event.Recipient, event.Event, event.Permanent, nullString(truncate(event.Detail, 500)))
+	if err != nil {
+		return err
+	}
+
+	if event.MessageID != "" {
+		if rank, known := emailStatusRank[status]; known && emailStatusRank[event.Event] >= rank {
+			_, err = tx.Exec(`UPDATE email_messages SET status = ?, status_detail = ? WHERE id = ?`,
+				event.Event, nullString(truncate(event.Detail, 500)), event.MessageID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if (event.Event == EmailBounced && event.Permanent) || event.Event == EmailComplained {
+		_, err = tx.Exec(`
+			INSERT INTO email_flags (email_key, reason, detail, message_id) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE reason = VALUES(reason), detail = VALUES(detail), message_id = VALUES(message_id), flagged_at = NOW()
+		`, normalizeCustomerEmail(event.Recipient), event.Event, nullString(truncate(event.Detail, 500)), nullString(event.MessageID))
+		if err != nil {
+			return err
+		}
+		log.Printf("Flagged email address %s as %s: %s", maskEmail(event.Recipient), event.Event, event.Detail)
+	}
+
+	return tx.Commit()
+}
+
+// ListMessages returns a ticket's communication log with delivery reports.
+func (es *EmailService) ListMessages(orderID string) ([]EmailMessage, error) {
+	rows, err := es.db.Query(`
+		SELECT id, recipient, subject, provider, provider_message_id, status, status_detail, sent_at, updated_at
+		FROM email_messages WHERE order_id = ? ORDER BY sent_at
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []EmailMessage{}
+	index := map[string]int{}
+	for rows.Next() {
+		message := EmailMessage{OrderID: orderID, Events: []EmailEvent{}}
+		var providerMessageID, detail sql.NullString
+		if err := rows.Scan(&message.ID, &message.Recipient, &message.Subject, &message.Provider, &providerMessageID,
+			&message.Status, &detail, &message.SentAt, &message.UpdatedAt); err != nil {
+			return nil, err
+		}
+		message.ProviderMessageID = providerMessageID.String
+		message.StatusDetail = detail.String
+		index[message.ID] = len(messages)
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	eventRows, err := es.db.Query(`
+		SELECT e.message_id, e.provider, e.recipient, e.event, e.permanent, e.detail, e.received_at
+		FROM email_events e JOIN email_messages m ON m.id = e.message_id
+		WHERE m.order_id = ? ORDER BY e.received_at, e.id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer eventRows.Close()
+	for eventRows.Next() {
+		var event EmailEvent
+		var detail sql.NullString
+		if err := eventRows.Scan(&event.MessageID, &event.Provider, &event.Recipient, &event.Event, &event.Permanent,
+			&detail, &event.ReceivedAt); err != nil {
+			return nil, err
+		}
+		event.Detail = detail.String
+		if i, ok := index[event.MessageID]; ok {
+			messages[i].Events = append(messages[i].Events, event)
+		}
+	}
+	return messages, eventRows.Err()
+}
+
+func (es *EmailService) ListFlags() ([]EmailFlag, error) {
+	rows, err := es.db.Query(`SELECT email_key, reason, detail, message_id, flagged_at FROM email_flags ORDER BY flagged_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []EmailFlag{}
+	for rows.Next() {
+		var flag EmailFlag
+		var detail, messageID sql.NullString
+		if err := rows.Scan(&flag.Email, &flag.Reason, &detail, &messageID, &flag.FlaggedAt); err != nil {
+			return nil, err
+		}
+		flag.Detail = detail.String
+		flag.MessageID = messageID.String
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+// ClearFlag removes the flag on an address once it has been corrected.
+func (es *EmailService) ClearFlag(email string) error {
+	result, err := es.db.Exec(`DELETE FROM email_flags WHERE email_key = ?`, normalizeCustomerEmail(email))
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+var emailService *EmailService
+
+// emailNotifier emails the customer when their ticket changes status and
+// sends recall notices (recalls.go), subscribed reports
+// (reportsubscriptions.go), escalation notices (escalation.go), snooze
+// reminders (snooze.go) and notices to ticket watchers (watchers.go).
+type emailNotifier struct{}
+
+func (emailNotifier) Name() string { return "email" }
+
+func (emailNotifier) Deliver(msg OutboxMessage) error {
+	if msg.Topic == "recall.notice" {
+		return deliverRecallNotice(msg)
+	}
+	if msg.Topic == "certification.reminder" {
+		return deliverCertificationReminder(msg)
+	}
+	if msg.Topic == "report.subscription" {
+		return deliverReportSubscription(msg)
+	}
+	if msg.Topic == "escalation.notice" {
+		return deliverEscalationNotice(msg)
+	}
+	if msg.Topic == "snooze.reminder" {
+		return deliverSnoozeReminder(msg)
+	}
+	if msg.Topic == "watch.notice" {
+		return deliverWatchNotice(msg)
+	}
+	if msg.Topic != "ticket.status_changed" {
+		return nil
+	}
+	var event TicketEvent
+	if err := json.Unmarshal(msg.Payload, &event); err != nil {
+		return err
+	}
+	var change StatusChangedPayload
+	if err := json.Unmarshal(event.Payload, &change); err != nil {
+		return err
+	}
+
+	order, err := orderService.GetOrder(msg.AggregateID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if order.CustomerEmail == "" {
+		return nil
+	}
+
+	language, err := orderLanguage(order)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		"Name":   order.CustomerName,
+		"Device": strings.TrimSpace(order.DeviceType + " " + order.DeviceModel),
+		"Order":  order.ID,
+		"Status": localizeStatus(language, change.To),
+	}
+	subject := localize(language, "email.status.subject", data)
+	body := localize(language, "email.status.body", data)
+	return emailService.Send(order.ID, msg.ID, order.CustomerEmail, subject, body)
+}
+
+// parseEmailEvents turns a provider webhook body into delivery reports.
+func parseEmailEvents(provider string, body []byte) ([]EmailEvent, error) {
+	switch provider {
+	case "ses":
+		return parseSESEvents(body)
+	case "mailgun":
+		return parseMailgunEvents(body)
+	case "sendgrid":
+		return parseSendGridEvents(body)
+	}
+	return nil, fmt.Errorf("unknown provider %q", provider)
+}
+
+// parseSESEvents reads an SES notification delivered through SNS. SNS
+// subscription requests are logged for an admin to confirm by hand.
+func parseSESEvents(body []byte) ([]EmailEvent, error) {
+	var envelope struct {
+		Type         string `json:"Type"`
+		Message      string `json:"Message"`
+		SubscribeURL string `json:"SubscribeURL"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	switch envelope.Type {
+	case "SubscriptionConfirmation":
+		log.Printf("SES webhook subscription pending; confirm it at %s", envelope.SubscribeURL)
+		return nil, nil
+	case "Notification":
+		body = []byte(envelope.Message)
+	default:
+		return nil, nil
+	}
+
+	var notification struct {
+		NotificationType string `json:"notificationType"`
+		EventType        string `json:"eventType"`
+		Mail             struct {
+			MessageID string `json:"messageId"`
+		} `json:"mail"`
+		Bounce struct {
+			BounceType        string `json:"bounceType"`
+			BounceSubType     string `json:"bounceSubType"`
+			BouncedRecipients []struct {
+				EmailAddress   string `json:"emailAddress"`
+				DiagnosticCode string `json:"diagnosticCode"`
+			} `json:"bouncedRecipients"`
+		} `json:"bounce"`
+		Complaint struct {
+			ComplainedRecipients []struct {
+				EmailAddress string `json:"emailAddress"`
+			} `json:"complainedRecipients"`
+			FeedbackType string `json:"complaintFeedbackType"`
+		} `json:"complaint"`
+		Delivery struct {
+			Recipients []string `json:"recipients"`
+		} `json:"delivery"`
+	}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, err
+	}
+	kind := notification.NotificationType
+	if kind == "" {
+		kind = notification.EventType
+	}
+
+	var events []EmailEvent
+	messageID := normalizeProviderMessageID(notification.Mail.MessageID)
+	switch kind {
+	case "Delivery":
+		for _, recipient := range notification.Delivery.Recipients {
+			events = append(events, EmailEvent{Recipient: recipient, Event: EmailDelivered, providerMessageID: messageID})
+		}
+	case "Bounce":
+		permanent := notification.Bounce.BounceType == "Permanent"
+		event := EmailBounced
+		if !permanent {
+			event = EmailDeferred
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			detail := strings.TrimSpace(notification.Bounce.BounceType + " " + notification.Bounce.BounceSubType + ": " + recipient.DiagnosticCode)
+			events = append(events, EmailEvent{Recipient: recipient.EmailAddress, Event: event, Permanent: permanent,
+				Detail: detail, providerMessageID: messageID})
+		}
+	case "Complaint":
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			events = append(events, EmailEvent{Recipient: recipient.EmailAddress, Event: EmailComplained,
+				Detail: notification.Complaint.FeedbackType, providerMessageID: messageID})
+		}
+	}
+	return events, nil
+}
+
+// parseMailgunEvents reads a Mailgun webhook.
+func parseMailgunEvents(body []byte) ([]EmailEvent, error) {
+	var webhook struct {
+		EventData struct {
+			Event          string `json:"event"`
+			Severity       string `json:"severity"`
+			Recipient      string `json:"recipient"`
+			Reason         string `json:"reason"`
+			DeliveryStatus struct {
+				Description string `json:"description"`
+				Message     string `json:"message"`
+			} `json:"delivery-status"`
+			Message struct {
+				Headers struct {
+					MessageID string `json:"message-id"`
+				} `json:"headers"`
+			} `json:"message"`
+		} `json:"event-data"`
+	}
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, err
+	}
+
+	data := webhook.EventData
+	event := EmailEvent{
+		Recipient:         data.Recipient,
+		Detail:            strings.TrimSpace(data.Reason + " " + data.DeliveryStatus.Description + " " + data.DeliveryStatus.Message),
+		providerMessageID: normalizeProviderMessageID(data.Message.Headers.MessageID),
+	}
+	switch data.Event {
+	case "delivered":
+		event.Event = EmailDelivered
+	case "failed":
+		event.Permanent = data.Severity == "permanent"
+		event.Event = EmailDeferred
+		if event.Permanent {
+			event.Event = EmailBounced
+		}
+	case "complained":
+		event.Event = EmailComplained
+	default:
+		return nil, nil
+	}
+	return []EmailEvent{event}, nil
+}
+
+// parseSendGridEvents reads a SendGrid event webhook batch.
+func parseSendGridEvents(body []byte) ([]EmailEvent, error) {
+	var batch []struct {
+		Email     string `json:"email"`
+		Event     string `json:"event"`
+		Type      string `json:"type"`
+		Reason    string `json:"reason"`
+		MessageID string `json:"sg_message_id"`
+	}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+
+	var events []EmailEvent
+	for _, item := range batch {
+		event := EmailEvent{Recipient: item.Email, Detail: item.Reason, providerMessageID: normalizeProviderMessageID(item.MessageID)}
+		switch item.Event {
+		case "delivered":
+			event.Event = EmailDelivered
+		case "deferred":
+			event.Event = EmailDeferred
+		case "bounce":
+			// "blocked" bounces are temporary refusals, not bad addresses
+			event.Event, event.Permanent = EmailBounced, item.Type != "blocked"
+		case "dropped":
+			event.Event = EmailBounced
+		case "spamreport":
+			event.Event = EmailComplained
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+var errEmailWebhookSignature = errors.New("invalid webhook signature")
+
+// emailWebhookKeys names the setting each provider's webhook is verified
+// with. A provider's webhook is off until its setting is given.
+var emailWebhookKeys = map[string]string{
+	"ses":      "SES_SNS_TOPIC_ARN",
+	"mailgun":  "MAILGUN_WEBHOOK_SIGNING_KEY",
+	"sendgrid": "SENDGRID_WEBHOOK_PUBLIC_KEY",
+}
+
+// emailWebhookMaxAge is how far a signed webhook's timestamp may be from
+// now, so a captured request cannot be replayed later.
+const emailWebhookMaxAge = 15 * time.Minute
+
+// verifyEmailWebhook checks the provider's signature on a webhook body as
+// received, returning errEmailWebhookSignature when it does not hold.
+func verifyEmailWebhook(provider string, r *http.Request, body []byte) error {
+	switch provider {
+	case "ses":
+		return verifySNSMessage(body)
+	case "mailgun":
+		return verifyMailgunSignature(body)
+	case "sendgrid":
+		return verifySendGridSignature(r, body)
+	}
+	return errEmailWebhookSignature
+}
+
+// freshWebhookTimestamp reports whether a Unix timestamp is within
+// emailWebhookMaxAge of now.
+func freshWebhookTimestamp(value string) bool {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	return age < emailWebhookMaxAge && age > -emailWebhookMaxAge
+}
+
+// verifyMailgunSignature checks a Mailgun webhook's HMAC under
+// MAILGUN_WEBHOOK_SIGNING_KEY.
+func verifyMailgunSignature(body []byte) error {
+	var webhook struct {
+		Signature struct {
+			Timestamp string `json:"timestamp"`
+			Token     string `json:"token"`
+			Signature string `json:"signature"`
+		} `json:"signature"`
+	}
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return errEmailWebhookSignature
+	}
+	signature := webhook.Signature
+	if !freshWebhookTimestamp(signature.Timestamp) {
+		return errEmailWebhookSignature
+	}
+	mac := hmac.New(sha256.New, []byte(getEnv("MAILGUN_WEBHOOK_SIGNING_KEY", "")))
+	mac.Write([]byte(signature.Timestamp + signature.Token))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(signature.Signature)) {
+		return errEmailWebhookSignature
+	}
+	return nil
+}
+
+// verifySendGridSignature checks a SendGrid signed event webhook against
+// SENDGRID_WEBHOOK_PUBLIC_KEY, the base64 verification key SendGrid shows.
+func verifySendGridSignature(r *http.Request, body []byte) error {
+	der, err := base64.StdEncoding.DecodeString(getEnv("SENDGRID_WEBHOOK_PUBLIC_KEY", ""))
+	if err != nil {
+		return fmt.Errorf("SENDGRID_WEBHOOK_PUBLIC_KEY: %w", err)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("SENDGRID_WEBHOOK_PUBLIC_KEY: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("SENDGRID_WEBHOOK_PUBLIC_KEY is not an ECDSA key")
+	}
+
+	timestamp := r.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp")
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Twilio-Email-Event-Webhook-Signature"))
+	if err != nil || !freshWebhookTimestamp(timestamp) {
+		return errEmailWebhookSignature
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(key, digest[:], signature) {
+		return errEmailWebhookSignature
+	}
+	return nil
+}
+
+// snsCertHost matches the hosts AWS serves SNS signing certificates from.
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var (
+	snsCertClient = &http.Client{Timeout: 10 * time.Second}
+	snsCerts      sync.Map // SigningCertURL -> *x509.Certificate
+)
+
+// verifySNSMessage checks that an SNS message was published to
+// SES_SNS_TOPIC_ARN and is signed by an AWS signing certificate.
+func verifySNSMessage(body []byte) error {
+	var envelope struct {
+		Type             string `json:"Type"`
+		MessageID        string `json:"MessageId"`
+		Token            string `json:"Token"`
+		TopicArn         string `json:"TopicArn"`
+		Subject          string `json:"Subject"`
+		Message          string `json:"Message"`
+		SubscribeURL     string `json:"SubscribeURL"`
+		Timestamp        string `json:"Timestamp"`
+		SignatureVersion string `json:"SignatureVersion"`
+		Signature        string `json:"Signature"`
+		SigningCertURL   string `json:"SigningCertURL"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return errEmailWebhookSignature
+	}
+	if envelope.TopicArn != getEnv("SES_SNS_TOPIC_ARN", "") {
+		return errEmailWebhookSignature
+	}
+
+	// The signed string lists the message's fields in a fixed order
+	fields := []string{"Message", envelope.Message, "MessageId", envelope.MessageID}
+	switch envelope.Type {
+	case "Notification":
+		if envelope.Subject != "" {
+			fields = append(fields, "Subject", envelope.Subject)
+		}
+		fields = append(fields, "Timestamp", envelope.Timestamp, "TopicArn", envelope.TopicArn, "Type", envelope.Type)
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = append(fields, "SubscribeURL", envelope.SubscribeURL, "Timestamp", envelope.Timestamp,
+			"Token", envelope.Token, "TopicArn", envelope.TopicArn, "Type", envelope.Type)
+	default:
+		return errEmailWebhookSignature
+	}
+	signed := []byte(strings.Join(fields, "\n") + "\n")
+
+	var hash crypto.Hash
+	var digest []byte
+	switch envelope.SignatureVersion {
+	case "1":
+		sum := sha1.Sum(signed)
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256(signed)
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return errEmailWebhookSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return errEmailWebhookSignature
+	}
+	cert, err := snsSigningCert(envelope.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+		return errEmailWebhookSignature
+	}
+	return nil
+}
+
+// snsSigningCert fetches, and caches, the signing certificate an SNS message
+// names. Only HTTPS URLs on the SNS hosts are fetched.
+func snsSigningCert(rawURL string) (*x509.Certificate, error) {
+	if cert, ok := snsCerts.Load(rawURL); ok {
+		return cert.(*x509.Certificate), nil
+	}
+	certURL, err := url.Parse(rawURL)
+	if err != nil || certURL.Scheme != "https" || certURL.Port() != "" ||
+		!snsCertHost.MatchString(certURL.Hostname()) || !strings.HasSuffix(certURL.Path, ".pem") {
+		return nil, errEmailWebhookSignature
+	}
+
+	resp, err := snsCertClient.Get(certURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching SNS signing certificate: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("SNS signing certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	snsCerts.Store(rawURL, cert)
+	return cert, nil
+}
+
+// EmailEventsHandler receives delivery reports from the email provider at
+// /api/v1/public/email-events/{ses|mailgun|sendgrid}. Each provider's
+// webhook is off until its key in emailWebhookKeys is set, and reports whose
+// signature does not verify are refused with 401.
+func EmailEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	provider := strings.TrimPrefix(r.URL.Path, "/api/v1/public/email-events/")
+	if !containsFold(emailProviderNames, provider) {
+		http.NotFound(w, r)
+		return
+	}
+	provider = strings.ToLower(provider)
+	if getEnv(emailWebhookKeys[provider], "") == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	err = verifyEmailWebhook(provider, r, body)
+	if err == errEmailWebhookSignature {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying %s email webhook: %v", provider, err)
+		http.Error(w, "Failed to verify webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// Signatures cover the body as sent, so it is cleaned only now
+	events, err := parseEmailEvents(provider, sanitizeJSON(body))
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range events {
+		if event.Recipient == "" {
+			continue
+		}
+		if err := emailService.RecordEvent(provider, event); err != nil {
+			log.Printf("Error recording %s email event from %s: %v", event.Event, provider, err)
+			http.Error(w, "Failed to record email event", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recorded": len(events),
+	})
+}
+
+// CommunicationsHandler returns a ticket's communication log with the
+// delivery state of every message (GET ?order_id=).
+func CommunicationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		http.Error(w, "order_id is required", http.StatusBadRequest)
+		return
+	}
+	messages, err := emailService.ListMessages(orderID)
+	if err != nil {
+		log.Printf("Error listing communications of order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve communications", http.StatusInternalServerError)
+		return
+	}
+	if !piiPolicyFor(r).Contact {
+		for i := range messages {
+			messages[i].Recipient = maskEmail(messages[i].Recipient)
+			for j := range messages[i].Events {
+				messages[i].Events[j].Recipient = maskEmail(messages[i].Events[j].Recipient)
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(messages)
+}
+
+// EmailFlagsHandler lists flagged addresses (GET) or clears one after it
+// has been corrected (DELETE ?email=).
+func EmailFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		flags, err := emailService.ListFlags()
+		if err != nil {
+			log.Printf("Error listing email flags: %v", err)
+			http.Error(w, "Failed to retrieve email flags", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(flags)
+
+	case "DELETE":
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			http.Error(w, "email is required", http.StatusBadRequest)
+			return
+		}
+		err := emailService.ClearFlag(email)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Email address is not flagged", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error clearing email flag: %v", err)
+			http.Error(w, "Failed to clear email flag", http.StatusInternalServerError)
+			return
+		}
+		auditService.Record(r, AuditEmailFlagCleared, "email", normalizeCustomerEmail(email), nil, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Email flag cleared successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Escalation rules catch tickets that are stuck: one sitting in a status
+// longer than the rule allows, one past its SLA, or both. The escalation job
+// raises a matching ticket's priority (to the rule's priority, or one step
+// when the rule names none; never down), records a TicketEscalated event in
+// the ticket's history and emails the rule's manager, or every Admin. A rule
+// escalates a ticket once per stay in a status, so a ticket that moves on
+// and comes back can be escalated again. Held tickets are left alone: their
+// clock has stopped. Admins manage the rules at
+// /api/v1/admin/escalation-rules.
+
+const escalationRulesTable = `
+	CREATE TABLE IF NOT EXISTS escalation_rules (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		status VARCHAR(30) NULL,
+		hours_in_status INT NOT NULL DEFAULT 0,
+		overdue BOOLEAN NOT NULL DEFAULT FALSE,
+		priority VARCHAR(10) NULL,
+		notify BOOLEAN NOT NULL DEFAULT TRUE,
+		notify_user_id VARCHAR(50) NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		updated_by VARCHAR(50) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		FOREIGN KEY (notify_user_id) REFERENCES users(id) ON DELETE SET NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const ticketEscalationsTable = `
+	CREATE TABLE IF NOT EXISTS ticket_escalations (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		rule_id BIGINT NOT NULL,
+		event_version INT NOT NULL,
+		escalated_at TIMESTAMP NOT NULL,
+		INDEX idx_ticket_escalations_rule (order_id, rule_id, escalated_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// statusSinceExpr is when the ticket o entered its current status; a ticket
+// with no status history has been in it since it was booked in.
+const statusSinceExpr = `COALESCE((SELECT MAX(h.changed_at) FROM ticket_status_history h WHERE h.order_id = o.id), o.created_at)`
+
+// EscalationRule escalates tickets stuck in a status or past their SLA.
+type EscalationRule struct {
+	ID            int64     `json:"id"`
+	Name          string    `json:"name"`
+	Status        string    `json:"status,omitempty"`          // Empty watches New Order, Reopened and In Progress
+	HoursInStatus int       `json:"hours_in_status,omitempty"` // 0 when time in status does not matter
+	Overdue       bool      `json:"overdue"`                   // Only tickets past their SLA
+	Priority      string    `json:"priority,omitempty"`        // Empty raises the priority one step
+	Notify        bool      `json:"notify"`
+	NotifyUserID  string    `json:"notify_user_id,omitempty"` // Empty notifies every Admin
+	Active        bool      `json:"active"`
+	UpdatedBy     string    `json:"updated_by,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// reason describes what a ticket matching the rule has done.
+func (rule *EscalationRule) reason(status string) string {
+	var reasons []string
+	if rule.HoursInStatus > 0 {
+		reasons = append(reasons, fmt.Sprintf("%s for more than %d hours", status, rule.HoursInStatus))
+	}
+	if rule.Overdue {
+		reasons = append(reasons, "past its SLA")
+	}
+	return strings.Join(reasons, " and ")
+}
+
+// escalatedPriority returns the priority a ticket at current escalates to.
+func (rule *EscalationRule) escalatedPriority(current string) string {
+	rank := slices.Index(orderPriorities, current)
+	if rank < 0 {
+		rank = slices.Index(orderPriorities, PriorityNormal)
+	}
+	if rule.Priority == "" {
+		return orderPriorities[max(rank-1, 0)]
+	}
+	return orderPriorities[min(rank, slices.Index(orderPriorities, rule.Priority))]
+}
+
+// TicketEscalatedPayload records a rule escalating a ticket.
+type TicketEscalatedPayload struct {
+	RuleID       int64  `json:"rule_id"`
+	Rule         string `json:"rule"`
+	Reason       string `json:"reason"`
+	FromPriority string `json:"from_priority"`
+	ToPriority   string `json:"to_priority"`
+}
+
+// TicketEscalation is an escalation in a ticket detail.
+type TicketEscalation struct {
+	TicketEscalatedPayload
+	EscalatedAt time.Time `json:"escalated_at"`
+}
+
+// EscalationNotice is the outbox payload telling one manager about an
+// escalation.
+type EscalationNotice struct {
+	OrderID   string `json:"order_id"`
+	Rule      string `json:"rule"`
+	Reason    string `json:"reason"`
+	Priority  string `json:"priority"`
+	Recipient string `json:"recipient"`
+}
+
+// projectTicketEscalated applies an escalation to the orders read model.
+func projectTicketEscalated(tx *sql.Tx, event *TicketEvent) error {
+	var payload TicketEscalatedPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE orders SET priority = ?, updated_at = ? WHERE id = ?`,
+		payload.ToPriority, event.OccurredAt, event.TicketID)
+	return err
+}
+
+// projectTicketEscalations keeps ticket_escalations, which stops a rule
+// escalating the same stay twice.
+func projectTicketEscalations(tx *sql.Tx, event *TicketEvent) error {
+	if event.Type != EventTicketEscalated {
+		return nil
+	}
+	var payload TicketEscalatedPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO ticket_escalations (order_id, rule_id, event_version, escalated_at) VALUES (?, ?, ?, ?)`,
+		event.TicketID, payload.RuleID, event.Version, event.OccurredAt)
+	return err
+}
+
+// EscalationService stores escalation rules and applies them
+type EscalationService struct {
+	db *sql.DB
+}
+
+func NewEscalationService(database *sql.DB) *EscalationService {
+	return &EscalationService{db: database}
+}
+
+var escalationService *EscalationService
+
+const escalationRuleColumns = `id, name, status, hours_in_status, overdue, priority, notify, notify_user_id, active, updated_by, updated_at`
+
+func scanEscalationRule(row rowScanner) (*EscalationRule, error) {
+	var rule EscalationRule
+	var status, priority, notifyUserID, updatedBy sql.NullString
+	err := row.Scan(&rule.ID, &rule.Name, &status, &rule.HoursInStatus, &rule.Overdue, &priority,
+		&rule.Notify, &notifyUserID, &rule.Active, &updatedBy, &rule.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	rule.Status, rule.Priority = status.String, priority.String
+	rule.NotifyUserID, rule.UpdatedBy = notifyUserID.String, updatedBy.String
+	return &rule, nil
+}
+
+func (es *EscalationService) GetRule(id int64) (*EscalationRule, error) {
+	return scanEscalationRule(es.db.QueryRow(`SELECT `+escalationRuleColumns+` FROM escalation_rules WHERE id = ?`, id))
+}
+
+// ListRules returns the rules, or only the active ones.
+func (es *EscalationService) ListRules(activeOnly bool) ([]EscalationRule, error) {
+	query := `SELECT ` + escalationRuleColumns + ` FROM escalation_rules`
+	if activeOnly {
+		query += ` WHERE active = TRUE`
+	}
+	rows, err := es.db.Query(query + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []EscalationRule{}
+	for rows.Next() {
+		rule, err := scanEscalationRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+	return rules, rows.Err()
+}
+
+// SaveRule creates a rule, or updates the one with rule.ID.
+func (es *EscalationService) SaveRule(rule *EscalationRule, actorID string) error {
+	if rule.ID == 0 {
+		result, err := es.db.Exec(`
+			INSERT INTO escalation_rules (name, status, hours_in_status, overdue, priority, notify, notify_user_id, active, updated_by)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, rule.Name, nullString(rule.Status), rule.HoursInStatus, rule.Overdue, nullString(rule.Priority),
+			rule.Notify, nullString(rule.NotifyUserID), rule.Active, nullString(actorID))
+		if err != nil {
+			return err
+		}
+		rule.ID, err = result.LastInsertId()
+		return err
+	}
+	result, err := es.db.Exec(`
+		UPDATE escalation_rules SET name = ?, status = ?, hours_in_status = ?, overdue = ?, priority = ?,
+		       notify = ?, notify_user_id = ?, active = ?, updated_by = ?
+		WHERE id = ?
+	`, rule.Name, nullString(rule.Status), rule.HoursInStatus, rule.Overdue, nullString(rule.Priority),
+		rule.Notify, nullString(rule.NotifyUserID), rule.Active, nullString(actorID), rule.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		// MySQL reports no rows for an update that changes nothing
+		if _, err := es.GetRule(rule.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *EscalationService) DeleteRule(id int64) error {
+	result, err := es.db.Exec(`DELETE FROM escalation_rules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// matchClause returns the SQL condition, on orders o, for tickets the rule
+// escalates now, and its arguments.
+func (rule *EscalationRule) matchClause() (string, []interface{}) {
+	var where string
+	var args []interface{}
+	if rule.Status != "" {
+		where = `o.status = ?`
+		args = append(args, rule.Status)
+	} else {
+		where = `o.status IN ('New Order', 'Reopened', 'In Progress')`
+	}
+	where += ` AND o.deleted_at IS NULL AND o.hold_state IS NULL`
+	if rule.HoursInStatus > 0 {
+		where += ` AND ` + statusSinceExpr + ` < NOW() - INTERVAL ? HOUR`
+		args = append(args, rule.HoursInStatus)
+	}
+	if rule.Overdue {
+		where += ` AND o.sla_due_at < NOW()`
+	}
+	where += ` AND NOT EXISTS (SELECT 1 FROM ticket_escalations x
+		WHERE x.order_id = o.id AND x.rule_id = ? AND x.escalated_at >= ` + statusSinceExpr + `)`
+	return where, append(args, rule.ID)
+}
+
+// Escalate applies every active rule, escalating at most 100 tickets per
+// rule each run.
+func (es *EscalationService) Escalate(ctx context.Context) error {
+	rules, err := es.ListRules(true)
+	if err != nil {
+		return err
+	}
+	escalated := 0
+	for i := range rules {
+		rule := &rules[i]
+		where, args := rule.matchClause()
+		rows, err := es.db.QueryContext(ctx, `SELECT o.id FROM orders o WHERE `+where+` ORDER BY o.id LIMIT 100`, args...)
+		if err != nil {
+			return err
+		}
+		var orderIDs []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			orderIDs = append(orderIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, orderID := range orderIDs {
+			done, err := es.escalate(ctx, rule, orderID)
+			if err != nil {
+				return fmt.Errorf("escalating %s by rule %d: %w", orderID, rule.ID, err)
+			}
+			if done {
+				escalated++
+			}
+		}
+	}
+	if escalated > 0 {
+		log.Printf("Escalation: %d tickets escalated", escalated)
+	}
+	return nil
+}
+
+// escalate escalates one ticket by rule, checking again under the ticket's
+// lock that it still matches.
+func (es *EscalationService) escalate(ctx context.Context, rule *EscalationRule, orderID string) (bool, error) {
+	tx, err := es.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	status, err := orderService.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return false, err
+	}
+	where, args := rule.matchClause()
+	var priority string
+	err = tx.QueryRow(`SELECT o.priority FROM orders o WHERE o.id = ? AND `+where, append([]interface{}{orderID}, args...)...).Scan(&priority)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	payload := TicketEscalatedPayload{
+		RuleID:       rule.ID,
+		Rule:         rule.Name,
+		Reason:       rule.reason(status),
+		FromPriority: priority,
+		ToPriority:   rule.escalatedPriority(priority),
+	}
+	if _, err := orderService.events.Append(tx, orderID, EventTicketEscalated, "", payload); err != nil {
+		return false, err
+	}
+	if rule.Notify {
+		recipients, err := es.managerEmails(tx, rule.NotifyUserID)
+		if err != nil {
+			return false, err
+		}
+		for _, recipient := range recipients {
+			notice := EscalationNotice{OrderID: orderID, Rule: rule.Name, Reason: payload.Reason, Priority: payload.ToPriority, Recipient: recipient}
+			if err := enqueueOutbox(tx, "escalation.notice", orderID, notice); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// managerEmails returns the address of the manager userID, or of every
+// approved Admin when userID is empty or no longer approved.
+func (es *EscalationService) managerEmails(tx *sql.Tx, userID string) ([]string, error) {
+	if userID != "" {
+		var email string
+		err := tx.QueryRow(`SELECT email FROM users WHERE id = ? AND approved = TRUE`, userID).Scan(&email)
+		if err == nil {
+			return []string{email}, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	rows, err := tx.Query(`SELECT email FROM users WHERE role = ? AND approved = TRUE`, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// deliverEscalationNotice emails a manager about an escalated ticket.
+func deliverEscalationNotice(msg OutboxMessage) error {
+	var notice EscalationNotice
+	if err := json.Unmarshal(msg.Payload, &notice); err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("Ticket %s escalated to %s priority", notice.OrderID, notice.Priority)
+	body := fmt.Sprintf("Hello,\n\nTicket %s has been %s, so the escalation rule \"%s\" raised it to %s priority. Please check on it.\n\nPC Repair Hub",
+		notice.OrderID, notice.Reason, notice.Rule, notice.Priority)
+	return emailService.Send(notice.OrderID, msg.ID, notice.Recipient, subject, body)
+}
+
+// escalationJob applies the escalation rules.
+func escalationJob() BackgroundJob {
+	return BackgroundJob{
+		Name:     "escalation",
+		Interval: getEnvDuration("ESCALATION_CHECK_INTERVAL", 5*time.Minute),
+		Run:      escalationService.Escalate,
+	}
+}
+
+// EscalationRulesHandler lists the escalation rules (GET), creates or
+// updates one (PUT {"name": "Stuck in progress", "status": "In Progress",
+// "hours_in_status": 48, "priority": "Urgent", "notify": true}, with "id" to
+// update) or deletes one (DELETE ?id=).
+func EscalationRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		rules, err := escalationService.ListRules(false)
+		if err != nil {
+			log.Printf("Error listing escalation rules: %v", err)
+			http.Error(w, "Failed to retrieve escalation rules", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(rules)
+
+	case "PUT":
+		// Active and notify default to true so a new rule works straight away
+		var request struct {
+			EscalationRule
+			Notify *bool `json:"notify"`
+			Active *bool `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		rule := request.EscalationRule
+		rule.Notify = request.Notify == nil || *request.Notify
+		rule.Active = request.Active == nil || *request.Active
+		rule.Name = strings.TrimSpace(rule.Name)
+
+		var fieldErrors ValidationErrors
+		if rule.Name == "" || len(rule.Name) > 100 {
+			fieldErrors.Add("name", "is required and at most 100 characters")
+		}
+		if rule.Status != "" && (!slices.Contains(boardStatuses, rule.Status) || rule.Status == closedStatus) {
+			fieldErrors.Add("status", fmt.Sprintf("%q is not a status tickets can be stuck in", rule.Status))
+		}
+		if rule.HoursInStatus < 0 {
+			fieldErrors.Add("hours_in_status", "must not be negative")
+		}
+		if rule.HoursInStatus == 0 && !rule.Overdue {
+			fieldErrors.Add("hours_in_status", "is required unless the rule is for overdue tickets")
+		}
+		if rule.Priority != "" && !slices.Contains(orderPriorities, rule.Priority) {
+			fieldErrors.Add("priority", "must be one of "+strings.Join(orderPriorities, ", "))
+		}
+		if rule.NotifyUserID != "" {
+			var approved bool
+			err := db.QueryRow(`SELECT approved FROM users WHERE id = ?`, rule.NotifyUserID).Scan(&approved)
+			if err != nil && err != sql.ErrNoRows {
+				log.Printf("Error loading user %s: %v", rule.NotifyUserID, err)
+				http.Error(w, "Failed to save escalation rule", http.StatusInternalServerError)
+				return
+			}
+			if err == sql.ErrNoRows || !approved {
+				fieldErrors.Add("notify_user_id", "is not an approved user")
+			}
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		var previous *EscalationRule
+		if rule.ID != 0 {
+			var err error
+			previous, err = escalationService.GetRule(rule.ID)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Escalation rule not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Error loading escalation rule %d: %v", rule.ID, err)
+				http.Error(w, "Failed to save escalation rule", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := escalationService.SaveRule(&rule, actorID(r)); err != nil {
+			log.Printf("Error saving escalation rule: %v", err)
+			http.Error(w, "Failed to save escalation rule", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditEscalationRuleSaved, "escalation_rule", strconv.FormatInt(rule.ID, 10), previous, rule)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Escalation rule saved successfully",
+			"id":      rule.ID,
+		})
+
+	case "DELETE":
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		previous, err := escalationService.GetRule(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Escalation rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading escalation rule %d: %v", id, err)
+			http.Error(w, "Failed to delete escalation rule", http.StatusInternalServerError)
+			return
+		}
+		if err := escalationService.DeleteRule(id); err != nil && err != sql.ErrNoRows {
+			log.Printf("Error deleting escalation rule %d: %v", id, err)
+			http.Error(w, "Failed to delete escalation rule", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditEscalationRuleDeleted, "escalation_rule", strconv.FormatInt(id, 10), previous, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Escalation rule deleted",
+		})
+
+	default:
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Engineers can publish several estimate options on a ticket (repair it,
+// replace the SSD, quote a new device), each either a single amount or a
+// list of proposed line items. The customer compares them on the approval
+// page through a link token and approves one or rejects the estimate; staff
+// can record a decision taken by phone or at the counter instead. Until then
+// the ticket is held Awaiting Customer Approval (holds.go). Proposed items
+// are billable only once approved: the approved option's items are added to
+// the ticket as line items with their sections and warranties, and a
+// rejection bills nothing.
+
+const estimateOptionsTable = `
+	CREATE TABLE IF NOT EXISTS estimate_options (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		position INT NOT NULL,
+		label VARCHAR(100) NOT NULL,
+		description TEXT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		selected_at TIMESTAMP NULL,
+		selected_ip VARCHAR(45) NULL,
+		rejected_at TIMESTAMP NULL,
+		decided_by VARCHAR(50) NULL,
+		decision_note VARCHAR(500) NULL,
+		INDEX idx_estimate_options_order (order_id, position),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const estimateItemsTable = `
+	CREATE TABLE IF NOT EXISTS estimate_items (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		option_id BIGINT NOT NULL,
+		position INT NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		section VARCHAR(20) NULL,
+		warranty_kind VARCHAR(10) NULL,
+		warranty_days INT NOT NULL DEFAULT 0,
+		INDEX idx_estimate_items_option (option_id, position),
+		FOREIGN KEY (option_id) REFERENCES estimate_options(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const estimateLinksTable = `
+	CREATE TABLE IF NOT EXISTS estimate_links (
+		token_hash CHAR(64) PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_estimate_links_order (order_id),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// maxEstimateOptions keeps the comparison readable.
+const maxEstimateOptions = 5
+
+// maxEstimateItems bounds the line items proposed in one option.
+const maxEstimateItems = 20
+
+// EstimateOption is one choice offered to the customer. An option with
+// items costs their sum.
+type EstimateOption struct {
+	ID          int64          `json:"id"`
+	Position    int            `json:"position"`
+	Label       string         `json:"label"`
+	Description string         `json:"description,omitempty"`
+	Amount      Money          `json:"amount"`
+	Items       []EstimateItem `json:"items,omitempty"`
+	SelectedAt  *time.Time     `json:"selected_at,omitempty"`
+}
+
+// EstimateItem is a proposed line item, billed as one if its option is
+// approved.
+type EstimateItem struct {
+	Description  string `json:"description"`
+	Amount       Money  `json:"amount"`
+	Section      string `json:"section,omitempty"`       // Invoice section; defaults from the warranty kind
+	WarrantyKind string `json:"warranty_kind,omitempty"` // "labor" (default) or "parts"
+	WarrantyDays int    `json:"warranty_days,omitempty"` // 0 uses the configured default for the kind, -1 means none
+}
+
+// EstimateDecision is the customer's answer to an estimate: approve
+// OptionID, or Reject it all. ActorID is set when staff record it.
+type EstimateDecision struct {
+	OptionID int64
+	Reject   bool
+	Note     string
+	IP       string
+	ActorID  string
+}
+
+// EstimateComparison is what the customer sees on the approval page.
+type EstimateComparison struct {
+	OrderID      string            `json:"order_id"`
+	DeviceType   string            `json:"device_type"`
+	DeviceModel  string            `json:"device_model,omitempty"`
+	Options      []EstimateOption  `json:"options"`
+	SelectedID   int64             `json:"selected_option_id,omitempty"`
+	RejectedAt   *time.Time        `json:"rejected_at,omitempty"`
+	DecisionNote string            `json:"decision_note,omitempty"`
+	Diagnosis    *DiagnosticReport `json:"diagnosis,omitempty"` // Latest published diagnosis (diagnosis.go)
+	Language     string            `json:"language"`            // The customer's language, for the page to render in
+}
+
+var (
+	errEstimateChosen      = errors.New("the customer has already chosen an estimate option")
+	errEstimateRejected    = errors.New("the customer has rejected the estimate")
+	errEstimateNone        = errors.New("the ticket has no estimate waiting for a decision")
+	errEstimateLinkInvalid = errors.New("estimate link is invalid or has expired")
+)
+
+// EstimateService handles estimate option database operations
+type EstimateService struct {
+	db      *sql.DB
+	linkTTL time.Duration
+}
+
+func NewEstimateService(database *sql.DB) *EstimateService {
+	return &EstimateService{
+		db:      database,
+		linkTTL: getEnvDuration("ESTIMATE_LINK_TTL", 7*24*time.Hour),
+	}
+}
+
+// Publish replaces a ticket's estimate options and returns a fresh approval
+// link token. Options can no longer change once the customer has chosen.
+func (es *EstimateService) Publish(orderID string, options []EstimateOption, actorID string) (string, time.Time, error) {
+	tx, err := es.db.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := orderService.lockOrderStatus(tx, orderID); err != nil {
+		return "", time.Time{}, err
+	}
+
+	var chosen int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM estimate_options WHERE order_id = ? AND selected_at IS NOT NULL`, orderID).Scan(&chosen); err != nil {
+		return "", time.Time{}, err
+	}
+	if chosen > 0 {
+		return "", time.Time{}, errEstimateChosen
+	}
+
+	// A rejected estimate is replaced like an unanswered one
+	if _, err := tx.Exec(`DELETE FROM estimate_options WHERE order_id = ?`, orderID); err != nil {
+		return "", time.Time{}, err
+	}
+	for i, option := range options {
+		result, err := tx.Exec(`
+			INSERT INTO estimate_options (order_id, position, label, description, amount, created_by)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, orderID, i+1, option.Label, nullString(option.Description), option.Amount, nullString(actorID))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		optionID, err := result.LastInsertId()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		for j, item := range option.Items {
+			_, err := tx.Exec(`
+				INSERT INTO estimate_items (option_id, position, description, amount, section, warranty_kind, warranty_days)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, optionID, j+1, item.Description, item.Amount, nullString(item.Section), nullString(item.WarrantyKind), item.WarrantyDays)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+		}
+	}
+
+	// Older links keep working until they expire; they show the new options
+	token, err := randomToken(24)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(es.linkTTL)
+	if _, err := tx.Exec(`INSERT INTO estimate_links (token_hash, order_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), orderID, expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := holdIfOpen(tx, orderID, HoldAwaitingApproval, "Estimate sent for approval", actorID); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, tx.Commit()
+}
+
+// orderForLink resolves an approval link token to its order.
+func (es *EstimateService) orderForLink(token string) (string, error) {
+	var orderID string
+	err := es.db.QueryRow(`SELECT order_id FROM estimate_links WHERE token_hash = ? AND expires_at > NOW()`,
+		hashToken(token)).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		return "", errEstimateLinkInvalid
+	}
+	return orderID, err
+}
+
+// Comparison loads the options of an order side by side.
+func (es *EstimateService) Comparison(orderID string) (*EstimateComparison, error) {
+	comparison := &EstimateComparison{OrderID: orderID}
+	var deviceModel sql.NullString
+	err := es.db.QueryRow(`SELECT device_type, device_model FROM orders WHERE id = ?`, orderID).
+		Scan(&comparison.DeviceType, &deviceModel)
+	if err != nil {
+		return nil, err
+	}
+	comparison.DeviceModel = deviceModel.String
+
+	rows, err := es.db.Query(`
+		SELECT id, position, label, description, amount, selected_at, rejected_at, decision_note
+		FROM estimate_options WHERE order_id = ? ORDER BY position
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comparison.Options = []EstimateOption{}
+	index := map[int64]int{}
+	for rows.Next() {
+		var option EstimateOption
+		var description, note sql.NullString
+		var selectedAt, rejectedAt sql.NullTime
+		if err := rows.Scan(&option.ID, &option.Position, &option.Label, &description, &option.Amount,
+			&selectedAt, &rejectedAt, &note); err != nil {
+			return nil, err
+		}
+		option.Description = description.String
+		option.SelectedAt = timePtr(selectedAt)
+		if option.SelectedAt != nil {
+			comparison.SelectedID = option.ID
+		}
+		if rejectedAt.Valid {
+			comparison.RejectedAt = timePtr(rejectedAt)
+		}
+		if note.Valid {
+			comparison.DecisionNote = note.String
+		}
+		index[option.ID] = len(comparison.Options)
+		comparison.Options = append(comparison.Options, option)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	items, err := es.items(es.db, `o.order_id = ?`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	for optionID, optionItems := range items {
+		comparison.Options[index[optionID]].Items = optionItems
+	}
+	comparison.Diagnosis, err = diagnosisService.Published(orderID)
+	return comparison, err
+}
+
+// items loads the proposed items of the options matching where, by option.
+func (es *EstimateService) items(q queryer, where string, args ...interface{}) (map[int64][]EstimateItem, error) {
+	rows, err := q.Query(`
+		SELECT i.option_id, i.description, i.amount, i.section, i.warranty_kind, i.warranty_days
+		FROM estimate_items i JOIN estimate_options o ON o.id = i.option_id
+		WHERE `+where+` ORDER BY i.option_id, i.position
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := map[int64][]EstimateItem{}
+	for rows.Next() {
+		var optionID int64
+		var item EstimateItem
+		var section, warrantyKind sql.NullString
+		if err := rows.Scan(&optionID, &item.Description, &item.Amount, &section, &warrantyKind, &item.WarrantyDays); err != nil {
+			return nil, err
+		}
+		item.Section, item.WarrantyKind = section.String, warrantyKind.String
+		items[optionID] = append(items[optionID], item)
+	}
+	return items, rows.Err()
+}
+
+// Decide records the answer to a ticket's estimate. An approved option is
+// billed on the ticket, item by item when it has items; a rejection bills
+// nothing. Either way the approval hold is released.
+func (es *EstimateService) Decide(orderID string, decision EstimateDecision) error {
+	tx, err := es.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := orderService.lockOrderStatus(tx, orderID); err != nil {
+		return err
+	}
+
+	var options, chosen, rejected int
+	err = tx.QueryRow(`SELECT COUNT(*), COUNT(selected_at), COUNT(rejected_at) FROM estimate_options WHERE order_id = ?`, orderID).
+		Scan(&options, &chosen, &rejected)
+	if err != nil {
+		return err
+	}
+	switch {
+	case chosen > 0:
+		return errEstimateChosen
+	case rejected > 0:
+		return errEstimateRejected
+	case options == 0:
+		return errEstimateNone
+	}
+
+	if decision.Reject {
+		_, err := tx.Exec(`
+			UPDATE estimate_options SET rejected_at = NOW(), selected_ip = ?, decided_by = ?, decision_note = ?
+			WHERE order_id = ?
+		`, nullString(decision.IP), nullString(decision.ActorID), nullString(decision.Note), orderID)
+		if err != nil {
+			return err
+		}
+	} else {
+		var label string
+		var amount Money
+		err = tx.QueryRow(`SELECT label, amount FROM estimate_options WHERE id = ? AND order_id = ?`, decision.OptionID, orderID).
+			Scan(&label, &amount)
+		if err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			UPDATE estimate_options SET selected_at = NOW(), selected_ip = ?, decided_by = ?, decision_note = ?
+			WHERE id = ?
+		`, nullString(decision.IP), nullString(decision.ActorID), nullString(decision.Note), decision.OptionID)
+		if err != nil {
+			return err
+		}
+
+		items, err := es.items(tx, `i.option_id = ?`, decision.OptionID)
+		if err != nil {
+			return err
+		}
+		billed := []ItemAddedPayload{{Description: "Approved estimate: " + label, Amount: amount}}
+		if proposed := items[decision.OptionID]; len(proposed) > 0 {
+			billed = billed[:0]
+			for _, item := range proposed {
+				billed = append(billed, ItemAddedPayload{Description: item.Description, Amount: item.Amount,
+					WarrantyKind: item.WarrantyKind, WarrantyDays: item.WarrantyDays, Section: item.Section})
+			}
+		}
+		for _, item := range billed {
+			if _, err := orderService.events.Append(tx, orderID, EventItemAdded, decision.ActorID, item); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := releaseHold(tx, orderID, HoldAwaitingApproval, decision.ActorID); err != nil {
+		return err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+var estimateService *EstimateService
+
+// EstimatesHandler shows a ticket's options to staff (GET ?order_id=) or
+// publishes a new set (POST), returning the customer approval token.
+func EstimatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		orderID := r.URL.Query().Get("order_id")
+		if orderID == "" {
+			http.Error(w, "order_id is required", http.StatusBadRequest)
+			return
+		}
+
+		comparison, err := estimateService.Comparison(orderID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading estimates for %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve estimates", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(comparison)
+
+	case "POST":
+		if !hasPermission(r, PermEstimatesPublish) {
+			http.Error(w, "You do not have permission to publish estimates", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			OrderID string           `json:"order_id"`
+			Options []EstimateOption `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if len(request.Options) == 0 || len(request.Options) > maxEstimateOptions {
+			fieldErrors.Add("options", fmt.Sprintf("must list between 1 and %d options", maxEstimateOptions))
+		}
+		for i := range request.Options {
+			option := &request.Options[i]
+			if option.Label == "" || len(option.Label) > 100 {
+				fieldErrors.Add(fmt.Sprintf("options[%d].label", i), "is required and at most 100 characters")
+			}
+			if len(option.Items) > 0 {
+				option.Amount = checkEstimateItems(fmt.Sprintf("options[%d].items", i), option.Items, &fieldErrors)
+			}
+			if option.Amount < 0 {
+				fieldErrors.Add(fmt.Sprintf("options[%d].amount", i), "must not be negative")
+			}
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		token, expiresAt, err := estimateService.Publish(request.OrderID, request.Options, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errEstimateChosen {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error publishing estimates for %s: %v", request.OrderID, err)
+			http.Error(w, "Failed to publish estimates", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditEstimatePublished, "order", request.OrderID, nil, request.Options)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "Estimates published successfully",
+			"approval_token": token,
+			"expires_at":     expiresAt,
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// estimateLanguage is the language of the customer an estimate is for.
+func estimateLanguage(orderID string) (string, error) {
+	order, err := orderService.GetOrder(orderID)
+	if err != nil {
+		return "", err
+	}
+	return orderLanguage(order)
+}
+
+// PublicEstimatesHandler is the customer approval page's API: GET ?token=
+// compares the options, POST {token, option_id} records the choice.
+func PublicEstimatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		orderID, err := estimateService.orderForLink(r.URL.Query().Get("token"))
+		if err == errEstimateLinkInvalid {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error resolving estimate link: %v", err)
+			http.Error(w, "Failed to retrieve estimates", http.StatusInternalServerError)
+			return
+		}
+
+		comparison, err := estimateService.Comparison(orderID)
+		if err != nil {
+			log.Printf("Error loading estimates for %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve estimates", http.StatusInternalServerError)
+			return
+		}
+		if comparison.Language, err = estimateLanguage(orderID); err != nil {
+			log.Printf("Error resolving the language of %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve estimates", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(comparison)
+
+	case "POST":
+		var request struct {
+			Token    string `json:"token"`
+			OptionID int64  `json:"option_id"`
+			Reject   bool   `json:"reject"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		decision := EstimateDecision{OptionID: request.OptionID, Reject: request.Reject, Note: request.Reason, IP: clientIP(r)}
+		if fieldErrors := checkEstimateDecision(&decision); len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		orderID, err := estimateService.orderForLink(request.Token)
+		if err == errEstimateLinkInvalid {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error resolving estimate link: %v", err)
+			http.Error(w, "Failed to record your choice", http.StatusInternalServerError)
+			return
+		}
+
+		if !decideEstimate(w, orderID, decision, "Failed to record your choice") {
+			return
+		}
+
+		if decision.Reject {
+			log.Printf("Customer rejected the estimate on order %s", orderID)
+			auditService.RecordAs(r, "", AuditEstimateRejected, "order", orderID, nil, map[string]string{"reason": decision.Note})
+		} else {
+			log.Printf("Customer chose estimate option %d on order %s", request.OptionID, orderID)
+			auditService.RecordAs(r, "", AuditEstimateSelected, "order", orderID, nil, map[string]int64{"option_id": request.OptionID})
+		}
+		language, err := estimateLanguage(orderID)
+		if err != nil {
+			log.Printf("Error resolving the language of %s: %v", orderID, err)
+			language = shopLanguage
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": localize(language, "estimate.thanks", nil),
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkEstimateItems validates the proposed items of an option and returns
+// their sum.
+func checkEstimateItems(field string, items []EstimateItem, fieldErrors *ValidationErrors) Money {
+	if len(items) > maxEstimateItems {
+		fieldErrors.Add(field, fmt.Sprintf("must have at most %d items", maxEstimateItems))
+	}
+	var total Money
+	for i := range items {
+		item := &items[i]
+		itemField := fmt.Sprintf("%s[%d]", field, i)
+		item.Description = strings.TrimSpace(item.Description)
+		if item.Description == "" || len(item.Description) > 255 {
+			fieldErrors.Add(itemField+".description", "is required and at most 255 characters")
+		}
+		if item.Amount < 0 {
+			fieldErrors.Add(itemField+".amount", "must not be negative")
+		}
+		if item.WarrantyKind != "" && item.WarrantyKind != WarrantyLabor && item.WarrantyKind != WarrantyParts {
+			fieldErrors.Add(itemField+".warranty_kind", "must be labor or parts")
+		}
+		if item.WarrantyDays < noWarranty {
+			fieldErrors.Add(itemField+".warranty_days", "must be -1 (none), 0 (default) or a number of days")
+		}
+		if item.Section == "" {
+			item.Section = defaultSection(ItemAddedPayload{WarrantyKind: item.WarrantyKind})
+		} else if !validSection(item.Section) {
+			fieldErrors.Add(itemField+".section", "is not an invoice section")
+		}
+		total += item.Amount
+	}
+	return total
+}
+
+// checkEstimateDecision validates an approval or rejection.
+func checkEstimateDecision(decision *EstimateDecision) ValidationErrors {
+	var fieldErrors ValidationErrors
+	decision.Note = strings.TrimSpace(decision.Note)
+	if decision.Reject && decision.OptionID != 0 {
+		fieldErrors.Add("option_id", "cannot be given when rejecting the estimate")
+	}
+	if !decision.Reject && decision.OptionID <= 0 {
+		fieldErrors.Add("option_id", "is required unless the estimate is rejected")
+	}
+	if len(decision.Note) > 500 {
+		fieldErrors.Add("reason", "is too long")
+	}
+	return fieldErrors
+}
+
+// decideEstimate records decision on orderID, answering the request itself
+// when that fails.
+func decideEstimate(w http.ResponseWriter, orderID string, decision EstimateDecision, failure string) bool {
+	err := estimateService.Decide(orderID, decision)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Estimate option not found", http.StatusNotFound)
+		return false
+	}
+	if err == errEstimateChosen || err == errEstimateRejected || err == errEstimateNone {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error recording estimate decision for %s: %v", orderID, err)
+		http.Error(w, failure, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// EstimateDecisionHandler records a decision the customer gave staff by
+// phone or at the counter (POST {"order_id": "...", "option_id": 12,
+// "note": "Approved by phone"} or {"order_id": "...", "reject": true,
+// "note": "..."}).
+func EstimateDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasPermission(r, PermEstimatesDecide) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		OrderID  string `json:"order_id"`
+		OptionID int64  `json:"option_id"`
+		Reject   bool   `json:"reject"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	decision := EstimateDecision{OptionID: request.OptionID, Reject: request.Reject, Note: request.Note, ActorID: actorID(r)}
+	fieldErrors := checkEstimateDecision(&decision)
+	if request.OrderID == "" {
+		fieldErrors.Add("order_id", "is required")
+	}
+	if decision.Note == "" {
+		fieldErrors.Add("note", "is required to say how the customer answered")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if !decideEstimate(w, request.OrderID, decision, "Failed to record the decision") {
+		return
+	}
+
+	action := AuditEstimateSelected
+	if decision.Reject {
+		action = AuditEstimateRejected
+	}
+	auditService.Record(r, action, "order", request.OrderID, nil, request)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Estimate decision recorded successfully",
+	})
+}
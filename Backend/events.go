@@ -0,0 +1,478 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Ticket mutations are recorded as an append-only stream of domain events in
+// ticket_events. The orders table is a read model projected from that stream
+// inside the same transaction, so history, audit and sync all read from one
+// source of truth.
+
+const ticketEventsTable = `
+	CREATE TABLE IF NOT EXISTS ticket_events (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		ticket_id VARCHAR(50) NOT NULL,
+		version INT NOT NULL,
+		event_type VARCHAR(50) NOT NULL,
+		payload JSON NOT NULL,
+		actor_id VARCHAR(50),
+		occurred_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+		UNIQUE KEY uniq_ticket_version (ticket_id, version),
+		INDEX idx_event_type (event_type),
+		INDEX idx_occurred_at (occurred_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Domain event types
+const (
+	EventTicketCreated       = "TicketCreated"
+	EventStatusChanged       = "StatusChanged"
+	EventItemAdded           = "ItemAdded"
+	EventPaymentRecorded     = "PaymentRecorded"
+	EventItemsArranged       = "ItemsArranged"
+	EventTicketEdited        = "TicketEdited"
+	EventTicketCancelled     = "TicketCancelled"
+	EventTicketHeld          = "TicketHeld"
+	EventTicketReleased      = "TicketReleased"
+	EventTicketMerged        = "TicketMerged"
+	EventTicketSplit         = "TicketSplit"
+	EventTicketReopened      = "TicketReopened"
+	EventTicketEscalated     = "TicketEscalated"
+	EventDeliveryRescheduled = "DeliveryRescheduled"
+)
+
+// TicketEvent is one entry in a ticket's event stream.
+type TicketEvent struct {
+	ID         int64           `json:"id"`
+	TicketID   string          `json:"ticket_id"`
+	Version    int             `json:"version"`
+	Type       string          `json:"event_type"`
+	Payload    json.RawMessage `json:"payload"`
+	ActorID    string          `json:"actor_id,omitempty"`
+	OccurredAt time.Time       `json:"occurred_at"`
+}
+
+// StatusChangedPayload records a status transition.
+type StatusChangedPayload struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ItemAddedPayload records a billable item added to a ticket.
+type ItemAddedPayload struct {
+	Description  string `json:"description"`
+	Amount       Money  `json:"amount"`
+	WarrantyKind string `json:"warranty_kind,omitempty"` // "labor" (default) or "parts"
+	WarrantyDays int    `json:"warranty_days,omitempty"` // 0 uses the configured default for the kind, -1 means none
+	Section      string `json:"section,omitempty"`       // Invoice section; defaults from the warranty kind
+	PartSKU      string `json:"part_sku,omitempty"`      // Stocked part billed, taken from stock (ticketparts.go)
+	Quantity     int    `json:"quantity,omitempty"`      // Units of the part
+	PartCost     Money  `json:"part_cost,omitempty"`     // What the units cost from stock
+	CostID       int64  `json:"cost_id,omitempty"`       // The ticket_costs row of the part cost
+}
+
+// PaymentRecordedPayload records money received against a ticket.
+type PaymentRecordedPayload struct {
+	Amount    Money  `json:"amount"`
+	Method    string `json:"method"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// EventStore appends and loads ticket events.
+type EventStore struct {
+	db *sql.DB
+}
+
+func NewEventStore(database *sql.DB) *EventStore {
+	return &EventStore{db: database}
+}
+
+// Append writes the next event for a ticket and projects it onto the read
+// models within tx. The caller owns the transaction.
+func (es *EventStore) Append(tx *sql.Tx, ticketID, eventType, actorID string, payload interface{}) (*TicketEvent, error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// The unique (ticket_id, version) key rejects concurrent writers that
+	// computed the same version, so the stream never forks.
+	var version int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM ticket_events WHERE ticket_id = ? FOR UPDATE`,
+		ticketID).Scan(&version)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &TicketEvent{
+		TicketID:   ticketID,
+		Version:    version,
+		Type:       eventType,
+		Payload:    payloadJSON,
+		ActorID:    actorID,
+		OccurredAt: time.Now(),
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO ticket_events (ticket_id, version, event_type, payload, actor_id, occurred_at)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)
+	`, event.TicketID, event.Version, event.Type, string(event.Payload), event.ActorID, event.OccurredAt)
+	if err != nil {
+		return nil, err
+	}
+	event.ID, _ = result.LastInsertId()
+
+	if err := projectOrderEvent(tx, event); err != nil {
+		return nil, fmt.Errorf("projecting %s: %w", event.Type, err)
+	}
+	for _, project := range ticketProjections {
+		if err := project(tx, event); err != nil {
+			return nil, fmt.Errorf("projecting %s: %w", event.Type, err)
+		}
+	}
+
+	if topic, ok := outboxTopics[event.Type]; ok {
+		if err := enqueueOutbox(tx, topic, event.TicketID, event); err != nil {
+			return nil, err
+		}
+	}
+	if err := notifyEventWatchers(tx, event); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// Load returns a ticket's events in order.
+func (es *EventStore) Load(ticketID string) ([]TicketEvent, error) {
+	rows, err := es.db.Query(`
+		SELECT id, ticket_id, version, event_type, payload, COALESCE(actor_id, ''), occurred_at
+		FROM ticket_events WHERE ticket_id = ? ORDER BY version
+	`, ticketID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []TicketEvent
+	for rows.Next() {
+		var event TicketEvent
+		var payload []byte
+		if err := rows.Scan(&event.ID, &event.TicketID, &event.Version, &event.Type, &payload,
+			&event.ActorID, &event.OccurredAt); err != nil {
+			return nil, err
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// ticketProjections are the read models maintained alongside orders. Each
+// one ignores the event types it does not care about.
+var ticketProjections = []func(tx *sql.Tx, event *TicketEvent) error{
+	projectRepairWarranties,
+	projectProfitability,
+	projectStatusHistory,
+	projectSLA,
+	projectTicketHolds,
+	projectTicketDevices,
+	projectCustomFields,
+	projectTicketEscalations,
+	projectDeliveryDateChanges,
+	projectTicketSnoozes,
+}
+
+// projectOrderEvent applies an event to the orders read model.
+func projectOrderEvent(tx *sql.Tx, event *TicketEvent) error {
+	switch event.Type {
+	case EventTicketCreated:
+		var order Order
+		if err := json.Unmarshal(event.Payload, &order); err != nil {
+			return err
+		}
+		servicesJSON, err := json.Marshal(order.Services)
+		if err != nil {
+			return err
+		}
+		// Tickets created before priorities existed carry none
+		priority := order.Priority
+		if priority == "" {
+			priority = PriorityNormal
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO orders (id, customer_name, customer_email, customer_phone, device_type, 
+			                   device_model, device_serial, services, issue_description, status, total_cost, 
+			                   created_by, created_at, updated_at, last_updated_by, assigned_engineer_id,
+			                   expected_delivery_date, warranty_exp_date, warranty_claim_of, data_backup_consent,
+			                   ticket_type, priority, sla_due_at, split_from, parent_ticket_id, account_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, order.ID, order.CustomerName, order.CustomerEmail, order.CustomerPhone, order.DeviceType,
+			nullString(order.DeviceModel), nullString(order.DeviceSerial), string(servicesJSON),
+			nullString(order.IssueDescription), order.Status, order.TotalCost, nullString(order.CreatedBy),
+			event.OccurredAt, event.OccurredAt, nullString(order.CreatedBy), nullString(order.AssignedEngineerID),
+			order.ExpectedDeliveryDate, order.WarrantyExpDate, nullString(order.WarrantyClaimOf),
+			nullString(order.DataBackupConsent), nullString(order.TicketType), priority, order.SLADueAt, nullString(order.SplitFrom),
+			nullString(order.ParentTicketID), sql.NullInt64{Int64: order.AccountID, Valid: order.AccountID != 0})
+		return err
+
+	case EventStatusChanged:
+		var payload StatusChangedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE orders SET status = ?, updated_at = ?, last_updated_by = NULLIF(?, '') WHERE id = ?`,
+			payload.To, event.OccurredAt, event.ActorID, event.TicketID)
+		return err
+
+	case EventItemAdded:
+		var payload ItemAddedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE orders
+			SET services = JSON_ARRAY_APPEND(services, '$', ?), total_cost = total_cost + ?,
+			    updated_at = ?, last_updated_by = NULLIF(?, '')
+			WHERE id = ?
+		`, payload.Description, payload.Amount, event.OccurredAt, event.ActorID, event.TicketID)
+		return err
+
+	case EventPaymentRecorded:
+		var payload PaymentRecordedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE orders SET amount_paid = amount_paid + ?, updated_at = ? WHERE id = ?`,
+			payload.Amount, event.OccurredAt, event.TicketID)
+		return err
+
+	case EventTicketEdited:
+		return projectTicketEdit(tx, event)
+
+	case EventTicketCancelled:
+		return projectTicketCancelled(tx, event)
+
+	case EventTicketHeld:
+		return projectTicketHeld(tx, event)
+
+	case EventTicketReleased:
+		return projectTicketReleased(tx, event)
+
+	case EventTicketMerged:
+		return projectTicketMerged(tx, event)
+
+	case EventTicketSplit:
+		return projectTicketSplit(tx, event)
+
+	case EventTicketReopened:
+		return projectTicketReopened(tx, event)
+
+	case EventTicketEscalated:
+		return projectTicketEscalated(tx, event)
+
+	case EventDeliveryRescheduled:
+		return projectDeliveryRescheduled(tx, event)
+
+	case EventItemsArranged:
+		_, err := tx.Exec(`UPDATE orders SET updated_at = ?, last_updated_by = NULLIF(?, '') WHERE id = ?`,
+			event.OccurredAt, event.ActorID, event.TicketID)
+		return err
+	}
+
+	return fmt.Errorf("unknown event type %q", event.Type)
+}
+
+// ticketEventsBackfillMigration seeds a TicketCreated snapshot event for
+// orders created before event sourcing, so every ticket has a stream.
+var ticketEventsBackfillMigration = &OnlineMigration{
+	Name:        "ticket_events_backfill",
+	Description: "Seed TicketCreated events for orders created before event sourcing",
+	Table:       "orders",
+	Prepare: func(database *sql.DB) error {
+		return nil
+	},
+	DualWrite: func(tx execer, id string) error {
+		// New writes already append their own events
+		return nil
+	},
+	Backfill: func(database *sql.DB, cursor string, limit int) (string, int, error) {
+		var lastID string
+		var processed int
+		err := database.QueryRow(`
+			SELECT COALESCE(MAX(id), ''), COUNT(*) FROM (
+				SELECT id FROM orders WHERE id > ? ORDER BY id LIMIT ?
+			) batch
+		`, cursor, limit).Scan(&lastID, &processed)
+		if err != nil || processed == 0 {
+			return cursor, 0, err
+		}
+
+		_, err = database.Exec(`
+			INSERT INTO ticket_events (ticket_id, version, event_type, payload, actor_id, occurred_at)
+			SELECT o.id, 1, 'TicketCreated',
+			       JSON_OBJECT('id', o.id, 'customer_name', o.customer_name, 'customer_email', o.customer_email,
+			                   'customer_phone', o.customer_phone, 'device_type', o.device_type,
+			                   'device_model', o.device_model, 'services', o.services,
+			                   'issue_description', o.issue_description, 'status', o.status,
+			                   'total_cost', o.total_cost, 'created_by', o.created_by),
+			       o.created_by, o.created_at
+			FROM orders o
+			WHERE o.id > ? AND o.id <= ?
+			  AND NOT EXISTS (SELECT 1 FROM ticket_events e WHERE e.ticket_id = o.id)
+		`, cursor, lastID)
+		return lastID, processed, err
+	},
+	Remaining: func(database *sql.DB) (int64, error) {
+		var count int64
+		err := database.QueryRow(`
+			SELECT COUNT(*) FROM orders o
+			WHERE NOT EXISTS (SELECT 1 FROM ticket_events e WHERE e.ticket_id = o.id)
+		`).Scan(&count)
+		return count, err
+	},
+}
+
+// GetOrderEventsHandler returns the event stream of one order.
+func GetOrderEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		http.Error(w, "order_id is required", http.StatusBadRequest)
+		return
+	}
+
+	events, err := orderService.events.Load(orderID)
+	if err != nil {
+		log.Printf("Error loading events for order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order events", http.StatusInternalServerError)
+		return
+	}
+
+	if events == nil {
+		events = []TicketEvent{}
+	}
+	if err := piiPolicyFor(r).shapeEvents(events); err != nil {
+		log.Printf("Error masking events for order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order events", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
+// AddOrderItemHandler adds a billable item to an order.
+func AddOrderItemHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID string `json:"order_id"`
+		ItemAddedPayload
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	// Stocked parts are billed at /api/v1/orders/{id}/parts, which takes them
+	// from stock
+	request.PartSKU, request.Quantity, request.PartCost, request.CostID = "", 0, 0, 0
+	if request.OrderID == "" || request.Description == "" || request.Amount < 0 {
+		http.Error(w, "Order ID, description and a non-negative amount are required", http.StatusBadRequest)
+		return
+	}
+	if request.WarrantyDays < noWarranty {
+		http.Error(w, "warranty_days must be -1 (none), 0 (default) or positive", http.StatusBadRequest)
+		return
+	}
+	if request.WarrantyKind != "" && request.WarrantyKind != WarrantyLabor && request.WarrantyKind != WarrantyParts {
+		http.Error(w, "warranty_kind must be labor or parts", http.StatusBadRequest)
+		return
+	}
+	if request.Section != "" && !validSection(request.Section) {
+		http.Error(w, "section must be labor, parts or fees", http.StatusBadRequest)
+		return
+	}
+
+	err := orderService.AddItem(request.OrderID, request.ItemAddedPayload, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding item to order %s: %v", request.OrderID, err)
+		http.Error(w, "Failed to add item", http.StatusInternalServerError)
+		return
+	}
+	auditService.Record(r, AuditItemAdded, "order", request.OrderID, nil, request.ItemAddedPayload)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Item added successfully",
+	})
+}
+
+// RecordPaymentHandler records a payment against an order.
+func RecordPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID string `json:"order_id"`
+		PaymentRecordedPayload
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if request.OrderID == "" || request.Amount <= 0 || request.Method == "" {
+		http.Error(w, "Order ID, a positive amount and payment method are required", http.StatusBadRequest)
+		return
+	}
+
+	err := orderService.RecordPayment(request.OrderID, request.PaymentRecordedPayload, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording payment for order %s: %v", request.OrderID, err)
+		http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+		return
+	}
+	auditService.Record(r, AuditPayment, "order", request.OrderID, nil, request.PaymentRecordedPayload)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Payment recorded successfully",
+	})
+}
+
+// actorID returns the authenticated user's ID, or "" for anonymous requests.
+func actorID(r *http.Request) string {
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		return claims.Subject
+	}
+	return ""
+}
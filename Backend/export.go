@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The anonymized export is ticket data fit to hand to a consultant or a
+// benchmarking service: no names, identifiers replaced by keyed hashes and
+// locations reduced to a district. What happens to each field is set by
+// EXPORT_ANONYMIZATION, e.g. "device_serial=drop,location=keep", on top of
+// the defaults below. Ticket custom fields are left out unless named there
+// ("custom_fields.warranty_provider=keep"), since only the shop knows what
+// they hold; they can be kept or hashed.
+
+// Anonymization actions
+const (
+	AnonymizeKeep   = "keep"
+	AnonymizeHash   = "hash"
+	AnonymizeCoarse = "coarse"
+	AnonymizeDrop   = "drop"
+)
+
+// exportField is one column of the export and the actions it supports.
+type exportField struct {
+	Name    string
+	Default string
+	Coarse  func(string) string // nil when the field has no coarse form
+	PII     bool                // names and free text may never be kept
+}
+
+// exportFields lists the export columns in output order.
+var exportFields = []exportField{
+	{Name: "ticket", Default: AnonymizeHash},
+	{Name: "customer", Default: AnonymizeHash, PII: true},
+	{Name: "customer_phone", Default: AnonymizeDrop, PII: true},
+	{Name: "location", Default: AnonymizeCoarse, Coarse: coarseLocation, PII: true},
+	{Name: "device_type", Default: AnonymizeKeep},
+	{Name: "device_model", Default: AnonymizeKeep},
+	{Name: "device_serial", Default: AnonymizeHash, PII: true},
+	{Name: "ticket_type", Default: AnonymizeKeep},
+	{Name: "services", Default: AnonymizeKeep},
+	{Name: "issue_description", Default: AnonymizeDrop, PII: true},
+	{Name: "status", Default: AnonymizeKeep},
+	{Name: "engineer", Default: AnonymizeHash},
+	{Name: "total_cost", Default: AnonymizeKeep},
+	{Name: "amount_paid", Default: AnonymizeKeep},
+	{Name: "created_at", Default: AnonymizeCoarse, Coarse: coarseDate},
+}
+
+// AnonymizationRules maps each export field to its action.
+type AnonymizationRules map[string]string
+
+// parseAnonymizationRules applies "field=action" overrides to the defaults.
+func parseAnonymizationRules(spec string) (AnonymizationRules, error) {
+	rules := AnonymizationRules{}
+	fields := map[string]exportField{}
+	for _, field := range exportFields {
+		rules[field.Name] = field.Default
+		fields[field.Name] = field
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, action, found := strings.Cut(entry, "=")
+		name, action = strings.TrimSpace(name), strings.TrimSpace(action)
+		if key, custom := strings.CutPrefix(name, ticketCustomFieldsPrefix); custom && found {
+			if !customFieldKeyPattern.MatchString(key) {
+				return nil, fmt.Errorf("%q is not a custom field key", key)
+			}
+			if action != AnonymizeKeep && action != AnonymizeHash && action != AnonymizeDrop {
+				return nil, fmt.Errorf("custom fields can only be kept, hashed or dropped, not %q", action)
+			}
+			rules[name] = action
+			continue
+		}
+		field, known := fields[name]
+		if !found || !known {
+			return nil, fmt.Errorf("unknown export field in %q", entry)
+		}
+		switch action {
+		case AnonymizeHash, AnonymizeDrop:
+		case AnonymizeKeep:
+			if field.PII {
+				return nil, fmt.Errorf("%s identifies the customer and cannot be kept", name)
+			}
+		case AnonymizeCoarse:
+			if field.Coarse == nil {
+				return nil, fmt.Errorf("%s has no coarse form", name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown anonymization action %q for %s", action, name)
+		}
+		rules[name] = action
+	}
+	return rules, nil
+}
+
+// Columns returns the fields that are not dropped, in output order, with
+// exported custom fields last.
+func (rules AnonymizationRules) Columns() []string {
+	var columns []string
+	for _, field := range exportFields {
+		if rules[field.Name] != AnonymizeDrop {
+			columns = append(columns, field.Name)
+		}
+	}
+	return append(columns, rules.customFieldColumns()...)
+}
+
+// customFieldColumns returns the exported custom field columns in key order.
+func (rules AnonymizationRules) customFieldColumns() []string {
+	var columns []string
+	for name, action := range rules {
+		if strings.HasPrefix(name, ticketCustomFieldsPrefix) && action != AnonymizeDrop {
+			columns = append(columns, name)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// Apply anonymizes one raw row in place and removes dropped fields.
+func (rules AnonymizationRules) Apply(row map[string]string) {
+	for _, field := range exportFields {
+		value := row[field.Name]
+		switch rules[field.Name] {
+		case AnonymizeDrop:
+			delete(row, field.Name)
+		case AnonymizeHash:
+			row[field.Name] = pseudonymize(value)
+		case AnonymizeCoarse:
+			row[field.Name] = field.Coarse(value)
+		}
+	}
+	for _, column := range rules.customFieldColumns() {
+		if rules[column] == AnonymizeHash && row[column] != "" {
+			row[column] = pseudonymize(row[column])
+		}
+	}
+}
+
+var pinCodePattern = regexp.MustCompile(`\b(\d{3})\s?\d{3}\b`)
+
+// coarseLocation reduces an address to its postal district (the first three
+// digits of the PIN code), or to its last part, usually the city.
+func coarseLocation(address string) string {
+	if match := pinCodePattern.FindStringSubmatch(address); match != nil {
+		return match[1] + "xxx"
+	}
+	parts := strings.Split(address, ",")
+	return strings.TrimSpace(parts[len(parts)-1])
+}
+
+// coarseDate keeps only the month of a timestamp.
+func coarseDate(value string) string {
+	if len(value) < len("2006-01") {
+		return value
+	}
+	return value[:len("2006-01")]
+}
+
+var anonymizationRules AnonymizationRules
+
+// maxExportRows caps a single export; narrow the period for more.
+const maxExportRows = 100000
+
+// Export returns the period's tickets anonymized with rules.
+func (rs *ReportService) Export(period ReportRange, limit int, rules AnonymizationRules) ([]map[string]string, error) {
+	rows, err := rs.db.Query(`
+		SELECT o.id, LOWER(o.customer_email), o.customer_phone,
+			COALESCE((SELECT v.address FROM onsite_visits v WHERE v.order_id = o.id ORDER BY v.created_at DESC LIMIT 1), ''),
+			o.device_type, o.device_model, o.device_serial, o.ticket_type, o.services, o.issue_description,
+			o.status, o.assigned_engineer_id, o.total_cost, o.amount_paid, o.created_at
+		FROM orders o WHERE o.created_at >= ? AND o.created_at < ? AND o.deleted_at IS NULL
+		ORDER BY o.created_at LIMIT ?
+	`, period.From, period.To, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	export := []map[string]string{}
+	var ids []string
+	for rows.Next() {
+		var id, email, phone, location, deviceType, services, status string
+		var model, serial, ticketType, issue, engineer sql.NullString
+		var totalCost, amountPaid Money
+		var createdAt time.Time
+		if err := rows.Scan(&id, &email, &phone, &location, &deviceType, &model, &serial, &ticketType, &services,
+			&issue, &status, &engineer, &totalCost, &amountPaid, &createdAt); err != nil {
+			return nil, err
+		}
+		row := map[string]string{
+			"ticket":            id,
+			"customer":          email,
+			"customer_phone":    phone,
+			"location":          location,
+			"device_type":       deviceType,
+			"device_model":      model.String,
+			"device_serial":     serial.String,
+			"ticket_type":       ticketType.String,
+			"services":          services,
+			"issue_description": issue.String,
+			"status":            status,
+			"engineer":          engineer.String,
+			"total_cost":        totalCost.String(),
+			"amount_paid":       amountPaid.String(),
+			"created_at":        createdAt.UTC().Format(time.RFC3339),
+		}
+		export = append(export, row)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	customColumns := rules.customFieldColumns()
+	values := map[string]CustomFieldValues{}
+	for start := 0; len(customColumns) > 0 && start < len(ids); start += 1000 {
+		// In batches, to stay under the placeholder limit
+		batch, err := loadCustomFieldValues(rs.db, CustomFieldScopeTicket, ids[start:min(start+1000, len(ids))])
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(values, batch)
+	}
+	for i, row := range export {
+		for _, column := range customColumns {
+			row[column] = values[ids[i]][strings.TrimPrefix(column, ticketCustomFieldsPrefix)]
+		}
+		rules.Apply(row)
+	}
+	return export, nil
+}
+
+// ReportExportHandler downloads the anonymized export as JSON or CSV.
+func ReportExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		fieldErrors.Add("format", "must be json or csv")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if !authorizeExport(w, r, ExportTicketsAnonymized, format) {
+		return
+	}
+
+	rows, err := reportService.Export(period, maxExportRows, anonymizationRules)
+	if err != nil {
+		log.Printf("Error building anonymized export: %v", err)
+		http.Error(w, "Failed to build export", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Anonymized export of %d tickets (%s to %s) by %s", len(rows),
+		period.From.Format("2006-01-02"), period.To.Format("2006-01-02"), actorID(r))
+	recordExport(r, ExportTicketsAnonymized, format, len(rows))
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="tickets-anonymized.csv"`)
+		columns := anonymizationRules.Columns()
+		writer := csv.NewWriter(w)
+		writer.Write(columns)
+		for _, row := range rows {
+			record := make([]string, len(columns))
+			for i, column := range columns {
+				record[i] = row[column]
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"range":   period,
+		"rules":   anonymizationRules,
+		"tickets": rows,
+	})
+}
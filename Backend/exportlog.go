@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bulk exports are where customer data leaves the shop, so each one is
+// restricted to the roles in exportRoles and recorded in data_exports with
+// who ran it, from where, with which filters and how many rows it returned.
+// Refused attempts are recorded too. Admins review the log at
+// /api/v1/admin/exports.
+
+const dataExportsTable = `
+	CREATE TABLE IF NOT EXISTS data_exports (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		export_type VARCHAR(50) NOT NULL,
+		format VARCHAR(10) NOT NULL,
+		user_id VARCHAR(50) NULL,
+		role VARCHAR(20) NULL,
+		api_key_id VARCHAR(50) NULL,
+		filters JSON NULL,
+		row_count INT NOT NULL DEFAULT 0,
+		allowed BOOLEAN NOT NULL,
+		ip_address VARCHAR(45) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_data_exports_user (user_id, created_at),
+		INDEX idx_data_exports_created (created_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Export types
+const (
+	ExportTicketsAnonymized = "tickets_anonymized" // GET /api/v1/reports/export
+	ExportTicketRows        = "ticket_rows"        // GET /api/v1/reports/tickets
+	ExportCaseFile          = "case_file"          // GET /api/v1/orders/{id}/case-file
+	ExportContractSLA       = "contract_sla"       // GET /api/v1/accounts/sla-report?format=pdf
+	ExportWorkOrders        = "work_orders"        // GET /api/v1/engineers/work-orders?format=pdf
+)
+
+// exportRoutes maps each export to the route that serves it, so the IP
+// allowlist covers every export; "*" stands for one path segment.
+var exportRoutes = map[string]string{
+	ExportTicketsAnonymized: "/api/v1/reports/export",
+	ExportTicketRows:        "/api/v1/reports/tickets",
+	ExportCaseFile:          "/api/v1/orders/*/case-file",
+	ExportContractSLA:       "/api/v1/accounts/sla-report",
+	ExportWorkOrders:        "/api/v1/engineers/work-orders",
+}
+
+// exportRoles lists who may run each export. EXPORT_ROLES narrows or widens
+// them, e.g. "ticket_rows=Admin;tickets_anonymized=Admin|Reporting".
+var exportRoles = map[string][]string{
+	ExportTicketsAnonymized: {RoleAdmin, RoleReporting},
+	ExportTicketRows:        {RoleAdmin, RoleReporting},
+	ExportCaseFile:          {RoleAdmin, RoleFrontDesk},
+	ExportContractSLA:       {RoleAdmin},
+	ExportWorkOrders:        staffRoles,
+}
+
+// parseExportRoles applies "export=Role|Role" overrides to exportRoles.
+func parseExportRoles(spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, list, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if _, known := exportRoles[name]; !found || !known {
+			return fmt.Errorf("unknown export in %q", entry)
+		}
+		var roles []string
+		for _, role := range strings.Split(list, "|") {
+			role = strings.TrimSpace(role)
+			if !isValidRole(role) {
+				return fmt.Errorf("unknown role %q for %s", role, name)
+			}
+			roles = append(roles, role)
+		}
+		exportRoles[name] = roles
+	}
+	return nil
+}
+
+// DataExport is one recorded export or refused attempt.
+type DataExport struct {
+	ID         int64             `json:"id"`
+	ExportType string            `json:"export_type"`
+	Format     string            `json:"format"`
+	UserID     string            `json:"user_id,omitempty"`
+	UserName   string            `json:"user_name,omitempty"`
+	Role       string            `json:"role,omitempty"`
+	APIKeyID   string            `json:"api_key_id,omitempty"`
+	Filters    map[string]string `json:"filters"`
+	RowCount   int               `json:"row_count"`
+	Allowed    bool              `json:"allowed"`
+	IPAddress  string            `json:"ip_address,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// ExportActivity totals one user's exports over the queried period.
+type ExportActivity struct {
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name,omitempty"`
+	Exports  int    `json:"exports"`
+	Rows     int    `json:"rows"`
+	Refused  int    `json:"refused"`
+}
+
+// ExportLogFilter narrows the export log.
+type ExportLogFilter struct {
+	UserID     string
+	ExportType string
+	Period     ReportRange
+	Limit      int
+}
+
+// ExportLogService records and reports data exports
+type ExportLogService struct {
+	db *sql.DB
+}
+
+func NewExportLogService(database *sql.DB) *ExportLogService {
+	return &ExportLogService{db: database}
+}
+
+// Record stores an export made by the request's caller. The query string is
+// kept as the export's filters.
+func (es *ExportLogService) Record(r *http.Request, exportType, format string, rowCount int, allowed bool) error {
+	filters := map[string]string{}
+	for key, values := range r.URL.Query() {
+		filters[key] = strings.Join(values, ",")
+	}
+	encoded, err := json.Marshal(filters)
+	if err != nil {
+		return err
+	}
+
+	var role, apiKeyID string
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		role, apiKeyID = normalizeRole(claims.Role), claims.APIKeyID
+	}
+	_, err = es.db.Exec(`
+		INSERT INTO data_exports (export_type, format, user_id, role, api_key_id, filters, row_count, allowed, ip_address)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, exportType, format, nullString(actorID(r)), nullString(role), nullString(apiKeyID), string(encoded),
+		rowCount, allowed, nullString(clientIP(r)))
+	return err
+}
+
+func (filter ExportLogFilter) where() (string, []interface{}) {
+	where := []string{"e.created_at >= ?", "e.created_at < ?"}
+	args := []interface{}{filter.Period.From, filter.Period.To}
+	if filter.UserID != "" {
+		where = append(where, "e.user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.ExportType != "" {
+		where = append(where, "e.export_type = ?")
+		args = append(args, filter.ExportType)
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+// List returns the most recent exports matching filter.
+func (es *ExportLogService) List(filter ExportLogFilter) ([]DataExport, error) {
+	where, args := filter.where()
+	rows, err := es.db.Query(`
+		SELECT e.id, e.export_type, e.format, e.user_id, u.full_name, e.role, e.api_key_id, e.filters,
+		       e.row_count, e.allowed, e.ip_address, e.created_at
+		FROM data_exports e LEFT JOIN users u ON u.id = e.user_id`+where+`
+		ORDER BY e.created_at DESC, e.id DESC LIMIT ?
+	`, append(args, filter.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []DataExport{}
+	for rows.Next() {
+		var export DataExport
+		var userID, userName, role, apiKeyID, filters, ip sql.NullString
+		if err := rows.Scan(&export.ID, &export.ExportType, &export.Format, &userID, &userName, &role, &apiKeyID,
+			&filters, &export.RowCount, &export.Allowed, &ip, &export.CreatedAt); err != nil {
+			return nil, err
+		}
+		export.UserID = userID.String
+		export.UserName = userName.String
+		export.Role = role.String
+		export.APIKeyID = apiKeyID.String
+		export.IPAddress = ip.String
+		export.Filters = map[string]string{}
+		if filters.Valid {
+			if err := json.Unmarshal([]byte(filters.String), &export.Filters); err != nil {
+				return nil, err
+			}
+		}
+		exports = append(exports, export)
+	}
+	return exports, rows.Err()
+}
+
+// Activity totals exports per user, most rows first.
+func (es *ExportLogService) Activity(filter ExportLogFilter) ([]ExportActivity, error) {
+	where, args := filter.where()
+	rows, err := es.db.Query(`
+		SELECT COALESCE(e.user_id, ''), MAX(u.full_name),
+		       SUM(e.allowed), COALESCE(SUM(CASE WHEN e.allowed THEN e.row_count ELSE 0 END), 0), SUM(NOT e.allowed)
+		FROM data_exports e LEFT JOIN users u ON u.id = e.user_id`+where+`
+		GROUP BY e.user_id
+		ORDER BY 4 DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activity := []ExportActivity{}
+	for rows.Next() {
+		var entry ExportActivity
+		var userName sql.NullString
+		if err := rows.Scan(&entry.UserID, &userName, &entry.Exports, &entry.Rows, &entry.Refused); err != nil {
+			return nil, err
+		}
+		entry.UserName = userName.String
+		activity = append(activity, entry)
+	}
+	return activity, rows.Err()
+}
+
+var exportLogService *ExportLogService
+
+// authorizeExport checks that the caller's role may run an export. A
+// refusal is recorded and written as 403.
+func authorizeExport(w http.ResponseWriter, r *http.Request, exportType, format string) bool {
+	if hasRole(r, exportRoles[exportType]...) {
+		return true
+	}
+	if err := exportLogService.Record(r, exportType, format, 0, false); err != nil {
+		log.Printf("Error recording refused %s export: %v", exportType, err)
+	}
+	log.Printf("Refused %s export for %s", exportType, actorID(r))
+	http.Error(w, "You do not have permission to run this export", http.StatusForbidden)
+	return false
+}
+
+// withExportFilter returns a copy of r whose query string, which is kept as
+// the export's filters, also names what a path addresses (e.g. the order of
+// a case file).
+func withExportFilter(r *http.Request, name, value string) *http.Request {
+	logged := r.Clone(r.Context())
+	query := logged.URL.Query()
+	query.Set(name, value)
+	logged.URL.RawQuery = query.Encode()
+	return logged
+}
+
+// recordExport logs a completed export.
+func recordExport(r *http.Request, exportType, format string, rowCount int) {
+	if err := exportLogService.Record(r, exportType, format, rowCount, true); err != nil {
+		log.Printf("Error recording %s export: %v", exportType, err)
+	}
+}
+
+// ExportLogHandler reports export activity (GET ?from=&to=&user_id=
+// &export_type=&limit=): the most recent exports and the totals per user.
+// Admin only.
+func ExportLogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var fieldErrors ValidationErrors
+	filter := ExportLogFilter{
+		UserID:     query.Get("user_id"),
+		ExportType: query.Get("export_type"),
+		Period:     parseReportRange(r, &fieldErrors),
+		Limit:      200,
+	}
+	if filter.ExportType != "" {
+		if _, known := exportRoles[filter.ExportType]; !known {
+			fieldErrors.Add("export_type", "is not a known export")
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			fieldErrors.Add("limit", "must be between 1 and 1000")
+		} else {
+			filter.Limit = n
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	exports, err := exportLogService.List(filter)
+	if err != nil {
+		log.Printf("Error listing data exports: %v", err)
+		http.Error(w, "Failed to retrieve export log", http.StatusInternalServerError)
+		return
+	}
+	activity, err := exportLogService.Activity(filter)
+	if err != nil {
+		log.Printf("Error totalling data exports: %v", err)
+		http.Error(w, "Failed to retrieve export log", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"range":   filter.Period,
+		"roles":   exportRoles,
+		"by_user": activity,
+		"exports": exports,
+	})
+}
@@ -4,4 +4,16 @@ go 1.21
 
 require (
 	github.com/go-sql-driver/mysql v1.7.1
-)
\ No newline at end of file
+	github.com/golang-jwt/jwt/v5 v5.2.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.19.0
+	golang.org/x/oauth2 v0.15.0
+	golang.org/x/sync v0.5.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/appengine v1.6.7 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
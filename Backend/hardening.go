@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// securityHeadersMiddleware sets the standard browser security headers.
+// API responses also get a locked-down CSP and are never cached. The
+// frontend pages use inline scripts and CDN assets, so their CSP is only
+// sent when FRONTEND_CSP is set.
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	hsts := getEnv("TLS_CERT_FILE", "") != "" || getEnv("HSTS_ENABLED", "false") == "true"
+	frontendCSP := getEnv("FRONTEND_CSP", "")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(self)")
+		header.Set("Cross-Origin-Opener-Policy", "same-origin")
+		if hsts {
+			header.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+			header.Set("Cache-Control", "no-store")
+		} else if frontendCSP != "" {
+			header.Set("Content-Security-Policy", frontendCSP)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HardeningConfig controls request validation applied before handlers.
+type HardeningConfig struct {
+	MaxBodyBytes    int64
+	MultipartRoutes []MultipartRoute // Upload routes that take multipart/form-data
+	WebhookRoutes   []string         // Signed provider callbacks, passed on byte for byte; AWS SNS posts JSON as text/plain
+}
+
+// MultipartRoute is an upload route. Path is exact, or has one {id}
+// segment matching a single path element.
+type MultipartRoute struct {
+	Path     string
+	MaxBytes int64 // Body cap, envelope included; 0 leaves sizing to the handler
+}
+
+func (route MultipartRoute) matches(path string) bool {
+	prefix, suffix, found := strings.Cut(route.Path, "{id}")
+	if !found {
+		return path == route.Path
+	}
+	id, ok := strings.CutPrefix(path, prefix)
+	if !ok {
+		return false
+	}
+	id, ok = strings.CutSuffix(id, suffix)
+	return ok && id != "" && !strings.Contains(id, "/")
+}
+
+func getHardeningConfig() HardeningConfig {
+	return HardeningConfig{
+		MaxBodyBytes: int64(getEnvInt("MAX_REQUEST_BODY_BYTES", 1<<20)),
+		MultipartRoutes: []MultipartRoute{
+			{Path: "/api/v1/orders/attachments"},
+			{Path: "/api/v1/orders/identity/photo"},
+			// Leave headroom for the multipart envelope around the file
+			{Path: "/api/v1/orders/{id}/voice-notes", MaxBytes: maxVoiceNoteBytes + 1<<20},
+			{Path: "/api/v1/devices/label-scan", MaxBytes: maxLabelImageBytes + 1<<20},
+		},
+		WebhookRoutes: []string{
+			"/api/v1/public/email-events/ses",
+			"/api/v1/public/email-events/mailgun",
+			"/api/v1/public/email-events/sendgrid",
+		},
+	}
+}
+
+// requestHardeningMiddleware rejects API writes that are not JSON (415) or
+// are larger than MaxBodyBytes (413), and strips control characters from
+// every string in JSON bodies and query parameters so they cannot reach
+// logs, documents or SMS messages. Signed webhooks clean their bodies
+// themselves once the signature is checked.
+func requestHardeningMiddleware(config HardeningConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/api/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.URL.RawQuery != "" {
+				r.URL.RawQuery = sanitizeQuery(r.URL.Query()).Encode()
+			}
+
+			if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" || r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			for _, route := range config.MultipartRoutes {
+				if route.matches(r.URL.Path) {
+					if mediaType != "multipart/form-data" {
+						http.Error(w, "Content-Type must be multipart/form-data", http.StatusUnsupportedMediaType)
+						return
+					}
+					if route.MaxBytes > 0 {
+						r.Body = http.MaxBytesReader(w, r.Body, route.MaxBytes)
+					}
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			for _, route := range config.WebhookRoutes {
+				if r.URL.Path == route && (mediaType == "text/plain" || mediaType == "application/json") {
+					r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if mediaType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.MaxBodyBytes))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(sanitizeJSON(body)))
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// suspiciousRune reports control characters other than tab and newlines,
+// and the bidirectional overrides used to disguise text. Zero-width joiners
+// stay, as Indic scripts need them.
+func suspiciousRune(c rune) bool {
+	if c == '\t' || c == '\n' || c == '\r' {
+		return false
+	}
+	return unicode.IsControl(c) || (c >= 0x202A && c <= 0x202E) || (c >= 0x2066 && c <= 0x2069)
+}
+
+func stripControl(s string) string {
+	if strings.IndexFunc(s, suspiciousRune) < 0 {
+		return s
+	}
+	return strings.Map(func(c rune) rune {
+		if suspiciousRune(c) {
+			return -1
+		}
+		return c
+	}, s)
+}
+
+func sanitizeQuery(values url.Values) url.Values {
+	for key, list := range values {
+		for i := range list {
+			list[i] = stripControl(list[i])
+		}
+		values[key] = list
+	}
+	return values
+}
+
+// sanitizeJSON strips control characters from every string in a JSON
+// document. Bodies that are not valid JSON are passed on unchanged for the
+// handler to reject.
+func sanitizeJSON(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return body
+	}
+
+	changed := false
+	var walk func(value interface{}) interface{}
+	walk = func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case string:
+			clean := stripControl(v)
+			if clean != v {
+				changed = true
+			}
+			return clean
+		case []interface{}:
+			for i := range v {
+				v[i] = walk(v[i])
+			}
+		case map[string]interface{}:
+			for key, item := range v {
+				v[key] = walk(item)
+			}
+		}
+		return value
+	}
+	document = walk(document)
+	if !changed {
+		return body
+	}
+
+	sanitized, err := json.Marshal(document)
+	if err != nil {
+		return body
+	}
+	return sanitized
+}
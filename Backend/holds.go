@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A ticket that is New Order or In Progress can be put on hold while it
+// waits on something outside the bench: parts on order or the customer's
+// approval. The hold is a sub-state beside the status, with a reason and the
+// time it started, recorded as TicketHeld and TicketReleased events. While a
+// ticket is on hold its SLA clock stops: it is never overdue, and releasing
+// it moves sla_due_at on by the time spent on hold. Every hold is kept in
+// ticket_holds, from which time on hold is reported per ticket.
+//
+// Waiting on the customer (approval, a password, a payment) is customer
+// time, and those holds start and end by themselves where the shop can tell:
+// publishing estimates holds the ticket for approval until the customer
+// picks one, and a ticket type deposit holds a new ticket until a payment is
+// recorded. Turnaround analytics report shop time and customer time apart.
+
+const ticketHoldsTable = `
+	CREATE TABLE IF NOT EXISTS ticket_holds (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		hold_state VARCHAR(30) NOT NULL,
+		reason VARCHAR(500) NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		started_by VARCHAR(50) NULL,
+		released_at TIMESTAMP NULL,
+		released_by VARCHAR(50) NULL,
+		INDEX idx_ticket_holds_order (order_id, started_at),
+		INDEX idx_ticket_holds_started (started_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Hold states
+const (
+	HoldAwaitingParts    = "Awaiting Parts"
+	HoldAwaitingApproval = "Awaiting Customer Approval"
+	HoldAwaitingPassword = "Awaiting Customer Password"
+	HoldAwaitingPayment  = "Awaiting Payment"
+)
+
+// holdStates lists the states a ticket can be held in.
+var holdStates = []string{HoldAwaitingParts, HoldAwaitingApproval, HoldAwaitingPassword, HoldAwaitingPayment}
+
+// customerHoldStates are the holds that wait on the customer.
+var customerHoldStates = []string{HoldAwaitingApproval, HoldAwaitingPassword, HoldAwaitingPayment}
+
+// customerHoldClause is a SQL condition true for holds waiting on the
+// customer.
+const customerHoldClause = `hold_state IN ('Awaiting Customer Approval', 'Awaiting Customer Password', 'Awaiting Payment')`
+
+var errTicketNotOnHold = errors.New("the ticket is not on hold")
+
+// TicketHeldPayload records why a ticket was put on hold.
+type TicketHeldPayload struct {
+	HoldState string `json:"hold_state"`
+	Reason    string `json:"reason"`
+}
+
+// TicketReleasedPayload records the hold a ticket came off.
+type TicketReleasedPayload struct {
+	HoldState string `json:"hold_state"`
+}
+
+// slaResumeExpr is sla_due_at moved on by the time since hold_started_at,
+// for the hold ending at the ? timestamp. A breached SLA stays where it was.
+const slaResumeExpr = `IF(hold_started_at IS NULL OR sla_breached_at IS NOT NULL, sla_due_at,
+	sla_due_at + INTERVAL TIMESTAMPDIFF(SECOND, hold_started_at, ?) SECOND)`
+
+// HoldTicket puts an open ticket on hold, or moves it to another hold state.
+func (os *OrderService) HoldTicket(orderID, state, reason, actorID string) error {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := os.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(slaOpenStatuses, current) {
+		return &StatusGuardError{Reason: "only New Order and In Progress tickets can be put on hold"}
+	}
+
+	payload := TicketHeldPayload{HoldState: state, Reason: reason}
+	if _, err := os.events.Append(tx, orderID, EventTicketHeld, actorID, payload); err != nil {
+		return err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReleaseTicket takes a ticket off hold.
+func (os *OrderService) ReleaseTicket(orderID, actorID string) error {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := os.lockOrderStatus(tx, orderID); err != nil {
+		return err
+	}
+	var state sql.NullString
+	if err := tx.QueryRow(`SELECT hold_state FROM orders WHERE id = ?`, orderID).Scan(&state); err != nil {
+		return err
+	}
+	if !state.Valid {
+		return errTicketNotOnHold
+	}
+
+	payload := TicketReleasedPayload{HoldState: state.String}
+	if _, err := os.events.Append(tx, orderID, EventTicketReleased, actorID, payload); err != nil {
+		return err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// holdIfOpen puts a ticket locked in tx on hold in state, unless it is
+// already on hold or past the stages a hold applies to.
+func holdIfOpen(tx *sql.Tx, orderID, state, reason, actorID string) error {
+	var status string
+	var current sql.NullString
+	if err := tx.QueryRow(`SELECT status, hold_state FROM orders WHERE id = ?`, orderID).Scan(&status, &current); err != nil {
+		return err
+	}
+	if current.Valid || !slices.Contains(slaOpenStatuses, status) {
+		return nil
+	}
+	_, err := orderService.events.Append(tx, orderID, EventTicketHeld, actorID, TicketHeldPayload{HoldState: state, Reason: reason})
+	return err
+}
+
+// releaseHold takes a ticket locked in tx off hold if it is held in state.
+func releaseHold(tx *sql.Tx, orderID, state, actorID string) error {
+	var current sql.NullString
+	if err := tx.QueryRow(`SELECT hold_state FROM orders WHERE id = ?`, orderID).Scan(&current); err != nil {
+		return err
+	}
+	if current.String != state {
+		return nil
+	}
+	_, err := orderService.events.Append(tx, orderID, EventTicketReleased, actorID, TicketReleasedPayload{HoldState: state})
+	return err
+}
+
+// projectTicketHeld sets the orders row's hold, first crediting the SLA with
+// any hold the ticket is moving out of.
+func projectTicketHeld(tx *sql.Tx, event *TicketEvent) error {
+	var payload TicketHeldPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE orders
+		SET sla_due_at = `+slaResumeExpr+`, hold_state = ?, hold_reason = ?, hold_started_at = ?,
+		    updated_at = ?, last_updated_by = NULLIF(?, '')
+		WHERE id = ?
+	`, event.OccurredAt, payload.HoldState, payload.Reason, event.OccurredAt, event.OccurredAt, event.ActorID, event.TicketID)
+	return err
+}
+
+// projectTicketReleased clears the orders row's hold and restarts its SLA.
+func projectTicketReleased(tx *sql.Tx, event *TicketEvent) error {
+	_, err := tx.Exec(`
+		UPDATE orders
+		SET sla_due_at = `+slaResumeExpr+`, hold_state = NULL, hold_reason = NULL, hold_started_at = NULL,
+		    updated_at = ?, last_updated_by = NULLIF(?, '')
+		WHERE id = ?
+	`, event.OccurredAt, event.OccurredAt, event.ActorID, event.TicketID)
+	return err
+}
+
+// projectTicketHolds keeps ticket_holds: a hold closes when the ticket is
+// released, moved to another hold state or cancelled.
+func projectTicketHolds(tx *sql.Tx, event *TicketEvent) error {
+	switch event.Type {
+	case EventTicketHeld, EventTicketReleased, EventTicketCancelled:
+	default:
+		return nil
+	}
+
+	_, err := tx.Exec(`
+		UPDATE ticket_holds SET released_at = ?, released_by = NULLIF(?, '')
+		WHERE order_id = ? AND released_at IS NULL
+	`, event.OccurredAt, event.ActorID, event.TicketID)
+	if err != nil || event.Type != EventTicketHeld {
+		return err
+	}
+
+	var payload TicketHeldPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ticket_holds (order_id, hold_state, reason, started_at, started_by)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''))
+	`, event.TicketID, payload.HoldState, payload.Reason, event.OccurredAt, event.ActorID)
+	return err
+}
+
+// onHoldStatusGuard keeps a held ticket where it is until it is released.
+func onHoldStatusGuard(tx *sql.Tx, orderID, from, to string) error {
+	var state sql.NullString
+	if err := tx.QueryRow(`SELECT hold_state FROM orders WHERE id = ?`, orderID).Scan(&state); err != nil {
+		return err
+	}
+	if state.Valid {
+		return &StatusGuardError{Reason: "the ticket is on hold (" + state.String + "); release it first"}
+	}
+	return nil
+}
+
+// TicketHold is one period a ticket spent on hold.
+type TicketHold struct {
+	HoldState  string     `json:"hold_state"`
+	Reason     string     `json:"reason"`
+	StartedAt  time.Time  `json:"started_at"`
+	StartedBy  string     `json:"started_by,omitempty"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"` // Unset while the hold lasts
+	ReleasedBy string     `json:"released_by,omitempty"`
+	Hours      float64    `json:"hours"`
+	Customer   bool       `json:"customer"` // Waiting on the customer rather than the shop
+}
+
+// Holds returns a ticket's holds, oldest first.
+func (os *OrderService) Holds(orderID string) ([]TicketHold, error) {
+	rows, err := os.db.Query(`
+		SELECT hold_state, reason, started_at, started_by, released_at, released_by,
+		       TIMESTAMPDIFF(SECOND, started_at, COALESCE(released_at, NOW())) / 3600
+		FROM ticket_holds WHERE order_id = ? ORDER BY started_at, id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []TicketHold{}
+	for rows.Next() {
+		var hold TicketHold
+		var startedBy, releasedBy sql.NullString
+		var releasedAt sql.NullTime
+		if err := rows.Scan(&hold.HoldState, &hold.Reason, &hold.StartedAt, &startedBy, &releasedAt, &releasedBy, &hold.Hours); err != nil {
+			return nil, err
+		}
+		hold.StartedBy = startedBy.String
+		hold.ReleasedAt = timePtr(releasedAt)
+		hold.ReleasedBy = releasedBy.String
+		hold.Customer = slices.Contains(customerHoldStates, hold.HoldState)
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+// HoldReportRow is the time one ticket spent on hold.
+type HoldReportRow struct {
+	OrderID               string  `json:"order_id"`
+	Status                string  `json:"status"`
+	HoldState             string  `json:"hold_state,omitempty"` // Set while the ticket is still on hold
+	Holds                 int     `json:"holds"`
+	AwaitingPartsHours    float64 `json:"awaiting_parts_hours"`
+	AwaitingApprovalHours float64 `json:"awaiting_approval_hours"`
+	AwaitingPasswordHours float64 `json:"awaiting_password_hours"`
+	AwaitingPaymentHours  float64 `json:"awaiting_payment_hours"`
+	CustomerHours         float64 `json:"customer_hours"` // Approval, password and payment holds
+	TotalHours            float64 `json:"total_hours"`
+}
+
+// HoldReport returns time on hold per ticket for holds started in period,
+// longest first.
+func (rs *ReportService) HoldReport(period ReportRange) ([]HoldReportRow, error) {
+	rows, err := rs.db.Query(`
+		SELECT h.order_id, o.status, COALESCE(o.hold_state, ''), COUNT(*),
+		       SUM(CASE WHEN h.hold_state = ? THEN h.seconds ELSE 0 END) / 3600,
+		       SUM(CASE WHEN h.hold_state = ? THEN h.seconds ELSE 0 END) / 3600,
+		       SUM(CASE WHEN h.hold_state = ? THEN h.seconds ELSE 0 END) / 3600,
+		       SUM(CASE WHEN h.hold_state = ? THEN h.seconds ELSE 0 END) / 3600,
+		       SUM(CASE WHEN h.`+customerHoldClause+` THEN h.seconds ELSE 0 END) / 3600,
+		       SUM(h.seconds) / 3600 AS total
+		FROM (SELECT order_id, hold_state, TIMESTAMPDIFF(SECOND, started_at, COALESCE(released_at, NOW())) AS seconds
+		      FROM ticket_holds WHERE started_at >= ? AND started_at < ?) h
+		JOIN orders o ON o.id = h.order_id
+		GROUP BY h.order_id, o.status, o.hold_state
+		ORDER BY total DESC, h.order_id
+	`, HoldAwaitingParts, HoldAwaitingApproval, HoldAwaitingPassword, HoldAwaitingPayment, period.From, period.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []HoldReportRow{}
+	for rows.Next() {
+		var row HoldReportRow
+		if err := rows.Scan(&row.OrderID, &row.Status, &row.HoldState, &row.Holds,
+			&row.AwaitingPartsHours, &row.AwaitingApprovalHours, &row.AwaitingPasswordHours, &row.AwaitingPaymentHours,
+			&row.CustomerHours, &row.TotalHours); err != nil {
+			return nil, err
+		}
+		report = append(report, row)
+	}
+	return report, rows.Err()
+}
+
+// orderHolds serves /api/v1/orders/{id}/holds: the ticket's holds (GET),
+// putting it on hold (POST {"hold_state": "Awaiting Parts", "reason": "..."})
+// or releasing it (DELETE).
+func orderHolds(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		if _, err := orderService.GetOrder(orderID); err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error retrieving order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve holds", http.StatusInternalServerError)
+			return
+		}
+		holds, err := orderService.Holds(orderID)
+		if err != nil {
+			log.Printf("Error retrieving holds of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve holds", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id": orderID,
+			"holds":    holds,
+		})
+
+	case "POST":
+		if !hasPermission(r, PermTicketsUpdateStatus) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		var request TicketHeldPayload
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if !slices.Contains(holdStates, request.HoldState) {
+			fieldErrors.Add("hold_state", "must be one of "+strings.Join(holdStates, ", "))
+		}
+		request.Reason = strings.TrimSpace(request.Reason)
+		if request.Reason == "" {
+			fieldErrors.Add("reason", "is required")
+		} else if len(request.Reason) > 500 {
+			fieldErrors.Add("reason", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		err := orderService.HoldTicket(orderID, request.HoldState, request.Reason, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if guardErr, ok := err.(*StatusGuardError); ok {
+			http.Error(w, guardErr.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error putting order %s on hold: %v", orderID, err)
+			http.Error(w, "Failed to put order on hold", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Order %s on hold (%s): %s", orderID, request.HoldState, request.Reason)
+		auditService.Record(r, AuditTicketHeld, "order", orderID, nil, request)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Order put on hold successfully",
+		})
+
+	case "DELETE":
+		if !hasPermission(r, PermTicketsUpdateStatus) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		err := orderService.ReleaseTicket(orderID, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errTicketNotOnHold {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error releasing order %s from hold: %v", orderID, err)
+			http.Error(w, "Failed to release order", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Order %s released from hold", orderID)
+		auditService.Record(r, AuditTicketReleased, "order", orderID, nil, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Order released successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReportHoldsHandler serves GET /api/v1/reports/holds?from=&to=: time on
+// hold per ticket for holds started in the range.
+func ReportHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, err := reportService.HoldReport(period)
+	if err != nil {
+		log.Printf("Error building hold report: %v", err)
+		http.Error(w, "Failed to build hold report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"range":   period,
+		"tickets": report,
+	})
+}
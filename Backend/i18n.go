@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Everything the shop says to a customer - status and recall emails, SMS
+// replies, printed receipts, labels and invoices, and the public estimate
+// page - is written from messageCatalog: one text/template per message key
+// and language. A customer can have a preferred_language; messages about a
+// ticket use the language of the customer record matching its email or
+// phone, or DEFAULT_LANGUAGE when there is none. A message missing in a
+// language falls back to English. Numbers, money and dates still follow the
+// location's LOCALE (locale.go).
+
+// supportedLanguages are the languages with a catalogue, English first.
+var supportedLanguages = []string{"en", "hi", "de"}
+
+// messageCatalog holds the customer-facing text by language and key.
+var messageCatalog = map[string]map[string]string{
+	"en": {
+		"email.status.subject": "Ticket {{.Order}}: {{.Status}}",
+		"email.status.body":    "Hello {{.Name}},\n\nYour {{.Device}} (ticket {{.Order}}) is now: {{.Status}}.\n\nPC Repair Hub",
+		"email.recall.body":    "Hello {{.Name}},\n\n{{.Message}}\n\nThis concerns the repair of your {{.Device}} (ticket {{.Order}}).\n\nPC Repair Hub",
+
+		"sms.help":           "PC Repair Hub: reply STATUS for the progress of your repair, or the number of an estimate option to approve it.",
+		"sms.none":           "PC Repair Hub: we have no open repairs for this number.",
+		"sms.header":         "PC Repair Hub:",
+		"sms.more":           "and {{.Count}} more.",
+		"sms.status":         "{{.Order}} ({{.Device}}) is {{.Status}}",
+		"sms.expected":       ", expected {{.Date}}",
+		"sms.already_chosen": "PC Repair Hub: an option has already been chosen for {{.Order}}.",
+		"sms.approved":       "PC Repair Hub: thank you, {{printf \"%q\" .Label}} is approved for {{.Order}}. We will be in touch when it is ready.",
+		"sms.no_option":      "PC Repair Hub: there is no estimate option {{.Position}} waiting for your approval. Reply STATUS for your repairs.",
+
+		"status.New Order":          "New Order",
+		"status.In Progress":        "In Progress",
+		"status.Ready for Delivery": "Ready for Delivery",
+		"status.Collected":          "Collected",
+		"status.Cancelled":          "Cancelled",
+		"status.Reopened":           "Reopened",
+
+		"doc.receipt":       "Receipt",
+		"doc.label":         "Label",
+		"doc.invoice":       "Invoice",
+		"doc.jobsheet":      "Job sheet",
+		"doc.ticket":        "Ticket",
+		"doc.date":          "Date",
+		"doc.customer":      "Customer",
+		"doc.device":        "Device",
+		"doc.serial":        "Serial",
+		"doc.phone":         "Phone",
+		"doc.expected":      "Expected",
+		"doc.services":      "Services",
+		"doc.total":         "Total",
+		"doc.rounding":      "Rounding",
+		"doc.invoice_total": "Invoice total",
+		"doc.paid":          "Paid",
+		"doc.balance":       "Balance",
+		"doc.printed":       "Printed",
+		"doc.issue":         "Issue",
+		"section.labor":     "Labor",
+		"section.parts":     "Parts",
+		"section.fees":      "Fees",
+
+		"signature.intake_terms": "Intake terms accepted",
+		"signature.delivery_ack": "Device received back",
+
+		"estimate.thanks": "Thank you, your choice has been recorded",
+	},
+	"hi": {
+		"email.status.subject": "टिकट {{.Order}}: {{.Status}}",
+		"email.status.body":    "नमस्ते {{.Name}},\n\nआपका {{.Device}} (टिकट {{.Order}}) अब इस स्थिति में है: {{.Status}}।\n\nPC Repair Hub",
+		"email.recall.body":    "नमस्ते {{.Name}},\n\n{{.Message}}\n\nयह आपके {{.Device}} (टिकट {{.Order}}) की मरम्मत से संबंधित है।\n\nPC Repair Hub",
+
+		"sms.help":           "PC Repair Hub: अपनी मरम्मत की स्थिति जानने के लिए STATUS भेजें, या किसी अनुमान विकल्प को स्वीकृत करने के लिए उसकी संख्या भेजें।",
+		"sms.none":           "PC Repair Hub: इस नंबर पर हमारे पास कोई चालू मरम्मत नहीं है।",
+		"sms.header":         "PC Repair Hub:",
+		"sms.more":           "और {{.Count}} अन्य।",
+		"sms.status":         "{{.Order}} ({{.Device}}) की स्थिति: {{.Status}}",
+		"sms.expected":       ", अपेक्षित {{.Date}}",
+		"sms.already_chosen": "PC Repair Hub: {{.Order}} के लिए एक विकल्प पहले ही चुना जा चुका है।",
+		"sms.approved":       "PC Repair Hub: धन्यवाद, {{.Order}} के लिए \"{{.Label}}\" स्वीकृत है। तैयार होने पर हम आपसे संपर्क करेंगे।",
+		"sms.no_option":      "PC Repair Hub: आपकी स्वीकृति के लिए कोई अनुमान विकल्प {{.Position}} प्रतीक्षा में नहीं है। अपनी मरम्मत की जानकारी के लिए STATUS भेजें।",
+
+		"status.New Order":          "नया ऑर्डर",
+		"status.In Progress":        "प्रगति पर",
+		"status.Ready for Delivery": "डिलीवरी के लिए तैयार",
+		"status.Collected":          "प्राप्त कर लिया गया",
+		"status.Cancelled":          "रद्द",
+		"status.Reopened":           "फिर से खोला गया",
+
+		"doc.receipt":       "रसीद",
+		"doc.label":         "लेबल",
+		"doc.invoice":       "बिल",
+		"doc.jobsheet":      "जॉब शीट",
+		"doc.ticket":        "टिकट",
+		"doc.date":          "तारीख",
+		"doc.customer":      "ग्राहक",
+		"doc.device":        "डिवाइस",
+		"doc.serial":        "सीरियल नंबर",
+		"doc.phone":         "फ़ोन",
+		"doc.expected":      "अपेक्षित",
+		"doc.services":      "सेवाएँ",
+		"doc.total":         "कुल",
+		"doc.rounding":      "राउंडिंग",
+		"doc.invoice_total": "बिल की कुल राशि",
+		"doc.paid":          "भुगतान किया",
+		"doc.balance":       "बकाया",
+		"doc.printed":       "मुद्रित",
+		"doc.issue":         "समस्या",
+		"section.labor":     "श्रम",
+		"section.parts":     "पुर्ज़े",
+		"section.fees":      "शुल्क",
+
+		"signature.intake_terms": "मरम्मत की शर्तें स्वीकार कीं",
+		"signature.delivery_ack": "डिवाइस वापस प्राप्त किया",
+
+		"estimate.thanks": "धन्यवाद, आपका चयन दर्ज कर लिया गया है",
+	},
+	"de": {
+		"email.status.subject": "Auftrag {{.Order}}: {{.Status}}",
+		"email.status.body":    "Hallo {{.Name}},\n\nIhr {{.Device}} (Auftrag {{.Order}}) hat jetzt den Status: {{.Status}}.\n\nPC Repair Hub",
+		"email.recall.body":    "Hallo {{.Name}},\n\n{{.Message}}\n\nDies betrifft die Reparatur Ihres {{.Device}} (Auftrag {{.Order}}).\n\nPC Repair Hub",
+
+		"sms.help":           "PC Repair Hub: Antworten Sie mit STATUS für den Stand Ihrer Reparatur oder mit der Nummer einer Angebotsoption, um sie freizugeben.",
+		"sms.none":           "PC Repair Hub: Für diese Nummer haben wir keine offenen Reparaturen.",
+		"sms.header":         "PC Repair Hub:",
+		"sms.more":           "und {{.Count}} weitere.",
+		"sms.status":         "{{.Order}} ({{.Device}}): {{.Status}}",
+		"sms.expected":       ", voraussichtlich {{.Date}}",
+		"sms.already_chosen": "PC Repair Hub: Für {{.Order}} wurde bereits eine Option gewählt.",
+		"sms.approved":       "PC Repair Hub: Vielen Dank, „{{.Label}}“ ist für {{.Order}} freigegeben. Wir melden uns, sobald alles fertig ist.",
+		"sms.no_option":      "PC Repair Hub: Es wartet keine Angebotsoption {{.Position}} auf Ihre Freigabe. Antworten Sie mit STATUS für Ihre Reparaturen.",
+
+		"status.New Order":          "Neuer Auftrag",
+		"status.In Progress":        "In Bearbeitung",
+		"status.Ready for Delivery": "Abholbereit",
+		"status.Collected":          "Abgeholt",
+		"status.Cancelled":          "Storniert",
+		"status.Reopened":           "Wiedereröffnet",
+
+		"doc.receipt":       "Quittung",
+		"doc.label":         "Etikett",
+		"doc.invoice":       "Rechnung",
+		"doc.jobsheet":      "Auftragsblatt",
+		"doc.ticket":        "Auftrag",
+		"doc.date":          "Datum",
+		"doc.customer":      "Kunde",
+		"doc.device":        "Gerät",
+		"doc.serial":        "Seriennummer",
+		"doc.phone":         "Telefon",
+		"doc.expected":      "Voraussichtlich",
+		"doc.services":      "Leistungen",
+		"doc.total":         "Summe",
+		"doc.rounding":      "Rundung",
+		"doc.invoice_total": "Rechnungsbetrag",
+		"doc.paid":          "Bezahlt",
+		"doc.balance":       "Offen",
+		"doc.printed":       "Gedruckt",
+		"doc.issue":         "Fehlerbeschreibung",
+		"section.labor":     "Arbeit",
+		"section.parts":     "Teile",
+		"section.fees":      "Gebühren",
+
+		"signature.intake_terms": "Auftragsbedingungen akzeptiert",
+		"signature.delivery_ack": "Gerät zurückerhalten",
+
+		"estimate.thanks": "Vielen Dank, Ihre Auswahl wurde gespeichert",
+	},
+}
+
+// messageTemplates are messageCatalog parsed once at startup.
+var messageTemplates = parseMessageCatalog()
+
+func parseMessageCatalog() map[string]map[string]*template.Template {
+	parsed := make(map[string]map[string]*template.Template, len(messageCatalog))
+	for language, messages := range messageCatalog {
+		parsed[language] = make(map[string]*template.Template, len(messages))
+		for key, text := range messages {
+			parsed[language][key] = template.Must(template.New(language + ":" + key).Parse(text))
+		}
+	}
+	return parsed
+}
+
+// shopLanguage is DEFAULT_LANGUAGE, used for customers without a preference.
+var shopLanguage = "en"
+
+func isSupportedLanguage(language string) bool {
+	return slices.Contains(supportedLanguages, language)
+}
+
+// getLanguageConfig returns the location's default language (default en).
+func getLanguageConfig() (string, error) {
+	language := getEnv("DEFAULT_LANGUAGE", "en")
+	if !isSupportedLanguage(language) {
+		return "", fmt.Errorf("unsupported DEFAULT_LANGUAGE %q (%s)", language, strings.Join(supportedLanguages, ", "))
+	}
+	return language, nil
+}
+
+// localize renders message key in language with data, falling back to
+// English when the language lacks it.
+func localize(language, key string, data interface{}) string {
+	tmpl, ok := messageTemplates[language][key]
+	if !ok {
+		if tmpl, ok = messageTemplates["en"][key]; !ok {
+			log.Printf("Missing message %s", key)
+			return key
+		}
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		log.Printf("Error rendering message %s in %s: %v", key, language, err)
+		return key
+	}
+	return out.String()
+}
+
+// localizeStatus names a ticket status in language.
+func localizeStatus(language, status string) string {
+	if _, ok := messageTemplates["en"]["status."+status]; !ok {
+		return status
+	}
+	return localize(language, "status."+status, nil)
+}
+
+// customerLanguage returns the preferred language of the customer holding
+// email or phone, or shopLanguage when there is none.
+func customerLanguage(q rowQuerier, email, phone string) (string, error) {
+	var language string
+	err := q.QueryRow(`
+		SELECT preferred_language FROM customers
+		WHERE (email_key = ? OR phone_key = ?) AND preferred_language IS NOT NULL
+		ORDER BY created_at LIMIT 1
+	`, normalizeCustomerEmail(email), normalizeCustomerPhone(phone)).Scan(&language)
+	if err == sql.ErrNoRows || (err == nil && !isSupportedLanguage(language)) {
+		return shopLanguage, nil
+	}
+	return language, err
+}
+
+// orderLanguage is the language to address the customer of order in.
+func orderLanguage(order *Order) (string, error) {
+	return customerLanguage(db, order.CustomerEmail, order.CustomerPhone)
+}
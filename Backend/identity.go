@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Shops can require the customer's ID when booking in high-value devices.
+// The policy is set per shop location (SHOP_LOCATION): a minimum declared
+// device value, optionally limited to some device types. Intake records the
+// ID type and only the last digits of its number; a photo of the ID can be
+// uploaded as a ticket attachment and is deleted by the purge_id_images
+// maintenance task once the location's retention period has passed.
+
+const idPoliciesTable = `
+	CREATE TABLE IF NOT EXISTS id_policies (
+		location VARCHAR(50) PRIMARY KEY,
+		min_device_value DECIMAL(10,2) NOT NULL DEFAULT 0,
+		device_types VARCHAR(500) NULL,
+		retention_days INT NOT NULL DEFAULT 30,
+		updated_by VARCHAR(50) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const ticketIdentitiesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_identities (
+		order_id VARCHAR(50) PRIMARY KEY,
+		location VARCHAR(50) NOT NULL,
+		id_type VARCHAR(30) NOT NULL,
+		id_number_masked VARCHAR(30) NOT NULL,
+		declared_value DECIMAL(10,2) NULL,
+		photo_attachment_id VARCHAR(50) NULL,
+		photo_purged_at TIMESTAMP NULL,
+		verified_by VARCHAR(50) NULL,
+		verified_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ticket_identities_purge (photo_purged_at, verified_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// idTypes are the identity documents accepted at intake.
+var idTypes = []string{"passport", "driving_licence", "national_id", "aadhaar", "pan", "voter_id", "other"}
+
+var errIDPhotoOnFile = errors.New("an ID photo is already on file for this ticket")
+
+// IDPolicy decides when a location requires ID at intake. An empty
+// DeviceTypes list covers every device type.
+type IDPolicy struct {
+	Location       string    `json:"location"`
+	MinDeviceValue Money     `json:"min_device_value"`
+	DeviceTypes    []string  `json:"device_types"`
+	RetentionDays  int       `json:"retention_days"`
+	UpdatedBy      string    `json:"updated_by,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Covers reports whether the policy applies to a device type.
+func (p *IDPolicy) Covers(deviceType string) bool {
+	return len(p.DeviceTypes) == 0 || containsFold(p.DeviceTypes, deviceType)
+}
+
+// TicketIdentity is the ID a customer showed at intake. IDNumber is only
+// read from intake requests; just its masked form is stored.
+type TicketIdentity struct {
+	OrderID           string     `json:"order_id,omitempty"`
+	Location          string     `json:"location,omitempty"`
+	IDType            string     `json:"id_type"`
+	IDNumber          string     `json:"id_number,omitempty"`
+	IDNumberMasked    string     `json:"id_number_masked,omitempty"`
+	DeclaredValue     *Money     `json:"declared_value,omitempty"`
+	PhotoAttachmentID string     `json:"photo_attachment_id,omitempty"`
+	PhotoPurgedAt     *time.Time `json:"photo_purged_at,omitempty"`
+	VerifiedBy        string     `json:"verified_by,omitempty"`
+	VerifiedAt        time.Time  `json:"verified_at"`
+}
+
+// maskIDNumber keeps the last four characters of an ID number.
+func maskIDNumber(number string) string {
+	compact := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, number)
+	return maskTail(compact, 4)
+}
+
+// validateIdentity checks an intake identity and masks its number.
+func validateIdentity(identity *TicketIdentity, fieldErrors *ValidationErrors) {
+	if !slices.Contains(idTypes, identity.IDType) {
+		fieldErrors.Add("identity.id_type", "must be one of "+strings.Join(idTypes, ", "))
+	}
+	masked := maskIDNumber(identity.IDNumber)
+	if len(masked) < 4 || len(masked) > 30 {
+		fieldErrors.Add("identity.id_number", "must have between 4 and 30 letters or digits")
+	}
+	identity.IDNumberMasked = masked
+	identity.IDNumber = ""
+}
+
+// insertTicketIdentity stores the intake identity inside the ticket's
+// creation transaction; the booking user verified it.
+func insertTicketIdentity(tx *sql.Tx, order *Order) error {
+	identity := order.Identity
+	_, err := tx.Exec(`
+		INSERT INTO ticket_identities (order_id, location, id_type, id_number_masked, declared_value, verified_by)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, order.ID, identity.Location, identity.IDType, identity.IDNumberMasked, identity.DeclaredValue, nullString(order.CreatedBy))
+	return err
+}
+
+// checkIntakeIdentity validates the ID given at intake and enforces the
+// location's ID policy for the device.
+func (is *IdentityService) checkIntakeIdentity(order *Order, deviceValue *Money, fieldErrors *ValidationErrors) error {
+	if deviceValue != nil && *deviceValue < 0 {
+		fieldErrors.Add("device_value", "must not be negative")
+	}
+	if order.Identity != nil {
+		validateIdentity(order.Identity, fieldErrors)
+		order.Identity.Location = is.location
+		order.Identity.DeclaredValue = deviceValue
+	}
+
+	policy, err := is.Policy()
+	if err != nil || policy == nil || !policy.Covers(order.DeviceType) {
+		return err
+	}
+	if deviceValue == nil && policy.MinDeviceValue > 0 {
+		fieldErrors.Add("device_value", "is required by the ID policy of this location")
+		return nil
+	}
+	if order.Identity == nil && (deviceValue == nil || *deviceValue >= policy.MinDeviceValue) {
+		fieldErrors.Add("identity", fmt.Sprintf("is required for devices valued at %s or more", shopLocale.FormatMoney(policy.MinDeviceValue)))
+	}
+	return nil
+}
+
+// IdentityService handles ID policies and captured identities
+type IdentityService struct {
+	db            *sql.DB
+	location      string
+	retentionDays int // Used for locations without a policy
+}
+
+func NewIdentityService(database *sql.DB) *IdentityService {
+	return &IdentityService{
+		db:            database,
+		location:      getStorageConfig().Location,
+		retentionDays: getEnvInt("ID_IMAGE_RETENTION_DAYS", 30),
+	}
+}
+
+func scanIDPolicy(row rowScanner) (*IDPolicy, error) {
+	policy := &IDPolicy{DeviceTypes: []string{}}
+	var deviceTypes, updatedBy sql.NullString
+	err := row.Scan(&policy.Location, &policy.MinDeviceValue, &deviceTypes, &policy.RetentionDays, &updatedBy, &policy.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	policy.DeviceTypes = splitList(deviceTypes.String)
+	policy.UpdatedBy = updatedBy.String
+	return policy, nil
+}
+
+const idPolicyColumns = `location, min_device_value, device_types, retention_days, updated_by, updated_at`
+
+// Policy returns the ID policy of this shop's location, or nil when ID is
+// optional there.
+func (is *IdentityService) Policy() (*IDPolicy, error) {
+	policy, err := scanIDPolicy(is.db.QueryRow(`SELECT `+idPolicyColumns+` FROM id_policies WHERE location = ?`, is.location))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return policy, err
+}
+
+func (is *IdentityService) ListPolicies() ([]IDPolicy, error) {
+	rows, err := is.db.Query(`SELECT ` + idPolicyColumns + ` FROM id_policies ORDER BY location`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []IDPolicy{}
+	for rows.Next() {
+		policy, err := scanIDPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, *policy)
+	}
+	return policies, rows.Err()
+}
+
+func (is *IdentityService) SavePolicy(policy IDPolicy, actorID string) error {
+	_, err := is.db.Exec(`
+		INSERT INTO id_policies (location, min_device_value, device_types, retention_days, updated_by)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE min_device_value = VALUES(min_device_value), device_types = VALUES(device_types),
+			retention_days = VALUES(retention_days), updated_by = VALUES(updated_by)
+	`, policy.Location, policy.MinDeviceValue, nullString(strings.Join(policy.DeviceTypes, ",")), policy.RetentionDays, nullString(actorID))
+	return err
+}
+
+func (is *IdentityService) DeletePolicy(location string) error {
+	result, err := is.db.Exec(`DELETE FROM id_policies WHERE location = ?`, location)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (is *IdentityService) Get(orderID string) (*TicketIdentity, error) {
+	identity := &TicketIdentity{OrderID: orderID}
+	var declaredValue sql.NullString
+	var photoID, verifiedBy sql.NullString
+	var purgedAt sql.NullTime
+	err := is.db.QueryRow(`
+		SELECT location, id_type, id_number_masked, declared_value, photo_attachment_id, photo_purged_at, verified_by, verified_at
+		FROM ticket_identities WHERE order_id = ?
+	`, orderID).Scan(&identity.Location, &identity.IDType, &identity.IDNumberMasked, &declaredValue, &photoID,
+		&purgedAt, &verifiedBy, &identity.VerifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	if declaredValue.Valid {
+		value, err := ParseMoney(declaredValue.String)
+		if err != nil {
+			return nil, err
+		}
+		identity.DeclaredValue = &value
+	}
+	identity.PhotoAttachmentID = photoID.String
+	identity.PhotoPurgedAt = timePtr(purgedAt)
+	identity.VerifiedBy = verifiedBy.String
+	return identity, nil
+}
+
+// AttachPhoto links an uploaded attachment as the ticket's ID photo.
+func (is *IdentityService) AttachPhoto(orderID, attachmentID string) error {
+	result, err := is.db.Exec(`
+		UPDATE ticket_identities SET photo_attachment_id = ?
+		WHERE order_id = ? AND photo_attachment_id IS NULL AND photo_purged_at IS NULL
+	`, attachmentID, orderID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errIDPhotoOnFile
+	}
+	return nil
+}
+
+// PurgeImages deletes ID photos kept longer than their location's retention
+// period, except on tickets under legal hold. The identity record stays,
+// marked as purged.
+func (is *IdentityService) PurgeImages(ctx context.Context) (int64, string, error) {
+	rows, err := is.db.QueryContext(ctx, `
+		SELECT a.id, a.order_id, a.location, a.filename, a.content_type, a.size_bytes, a.sha256,
+		       a.storage_backend, a.storage_path, a.uploaded_by, a.created_at
+		FROM ticket_identities i
+		JOIN attachments a ON a.id = i.photo_attachment_id
+		LEFT JOIN id_policies p ON p.location = i.location
+		WHERE i.photo_purged_at IS NULL
+		  AND i.verified_at < NOW() - INTERVAL COALESCE(p.retention_days, ?) DAY
+		  AND `+legalHoldClause("i.order_id"), is.retentionDays)
+	if err != nil {
+		return 0, "", err
+	}
+	var photos []*Attachment
+	for rows.Next() {
+		photo, err := scanAttachment(rows)
+		if err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		photos = append(photos, photo)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	var purged int64
+	for _, photo := range photos {
+		if err := attachmentService.deleteFile(photo); err != nil {
+			return purged, "", err
+		}
+		tx, err := is.db.BeginTx(ctx, nil)
+		if err != nil {
+			return purged, "", err
+		}
+		_, err = tx.Exec(`UPDATE ticket_identities SET photo_attachment_id = NULL, photo_purged_at = NOW() WHERE order_id = ?`, photo.OrderID)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM attachments WHERE id = ?`, photo.ID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return purged, "", err
+		}
+		purged++
+	}
+	return purged, fmt.Sprintf("default retention %d days", is.retentionDays), nil
+}
+
+var identityService *IdentityService
+
+// TicketIdentityHandler returns the ID recorded for a ticket (GET
+// ?order_id=).
+func TicketIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		http.Error(w, "order_id is required", http.StatusBadRequest)
+		return
+	}
+	identity, err := identityService.Get(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No ID was recorded for this order", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving ID of order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve ID", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(identity)
+}
+
+// TicketIdentityPhotoHandler uploads the photo of a ticket's recorded ID as
+// multipart field "file" (POST ?order_id=).
+func TicketIdentityPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		http.Error(w, "order_id is required", http.StatusBadRequest)
+		return
+	}
+	identity, err := identityService.Get(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No ID was recorded for this order", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving ID of order %s: %v", orderID, err)
+		http.Error(w, "Failed to store ID photo", http.StatusInternalServerError)
+		return
+	}
+	if identity.PhotoAttachmentID != "" || identity.PhotoPurgedAt != nil {
+		http.Error(w, errIDPhotoOnFile.Error(), http.StatusConflict)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, attachmentService.config.MaxFileBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("File exceeds the %s upload limit", formatBytes(attachmentService.config.MaxFileBytes)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "A multipart file field named \"file\" is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	contentType := header.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") && contentType != "application/pdf" {
+		http.Error(w, "The ID photo must be an image or a PDF", http.StatusUnsupportedMediaType)
+		return
+	}
+	attachment := &Attachment{
+		OrderID:     orderID,
+		Filename:    truncate("id-"+filepath.Base(header.Filename), 255),
+		ContentType: truncate(contentType, 100),
+		UploadedBy:  actorID(r),
+	}
+
+	_, err = attachmentService.Store(attachment, file)
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		http.Error(w, quotaErr.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var typeErr *AttachmentTypeError
+	if errors.As(err, &typeErr) {
+		http.Error(w, typeErr.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err == errAttachmentTooLarge {
+		http.Error(w, fmt.Sprintf("File exceeds the %s upload limit", formatBytes(attachmentService.config.MaxFileBytes)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("Error storing ID photo for %s: %v", orderID, err)
+		http.Error(w, "Failed to store ID photo", http.StatusInternalServerError)
+		return
+	}
+
+	if err := identityService.AttachPhoto(orderID, attachment.ID); err != nil {
+		if deleteErr := attachmentService.Delete(attachment); deleteErr != nil {
+			log.Printf("Error removing unlinked ID photo %s: %v", attachment.ID, deleteErr)
+		}
+		if err == errIDPhotoOnFile {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error linking ID photo for %s: %v", orderID, err)
+		http.Error(w, "Failed to store ID photo", http.StatusInternalServerError)
+		return
+	}
+
+	auditService.Record(r, AuditIDPhotoUploaded, "order", orderID, nil, map[string]string{"attachment_id": attachment.ID})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":       "ID photo stored successfully",
+		"attachment_id": attachment.ID,
+	})
+}
+
+// IDPoliciesHandler lists the per-location ID policies (GET), sets one
+// (PUT) or removes one so ID becomes optional there (DELETE ?location=).
+func IDPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		policies, err := identityService.ListPolicies()
+		if err != nil {
+			log.Printf("Error listing ID policies: %v", err)
+			http.Error(w, "Failed to retrieve ID policies", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(policies)
+
+	case "PUT":
+		var policy IDPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		policy.Location = strings.TrimSpace(policy.Location)
+		if policy.Location == "" || len(policy.Location) > 50 {
+			fieldErrors.Add("location", "is required and at most 50 characters")
+		}
+		if policy.MinDeviceValue < 0 {
+			fieldErrors.Add("min_device_value", "must not be negative")
+		}
+		if policy.RetentionDays == 0 {
+			policy.RetentionDays = identityService.retentionDays
+		}
+		if policy.RetentionDays < 1 || policy.RetentionDays > 3650 {
+			fieldErrors.Add("retention_days", "must be between 1 and 3650")
+		}
+		if len(strings.Join(policy.DeviceTypes, ",")) > 500 {
+			fieldErrors.Add("device_types", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		if err := identityService.SavePolicy(policy, actorID(r)); err != nil {
+			log.Printf("Error saving ID policy for %s: %v", policy.Location, err)
+			http.Error(w, "Failed to save ID policy", http.StatusInternalServerError)
+			return
+		}
+		auditService.Record(r, AuditIDPolicyUpdated, "id_policy", policy.Location, nil, policy)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "ID policy saved successfully",
+		})
+
+	case "DELETE":
+		location := r.URL.Query().Get("location")
+		err := identityService.DeletePolicy(location)
+		if err == sql.ErrNoRows {
+			http.Error(w, "ID policy not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting ID policy for %s: %v", location, err)
+			http.Error(w, "Failed to delete ID policy", http.StatusInternalServerError)
+			return
+		}
+		auditService.Record(r, AuditIDPolicyUpdated, "id_policy", location, nil, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "ID policy deleted successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Human-facing identifiers are built from a branch code, an entity prefix
+// and a per-prefix sequence: BLR-TKT-000123. Each instance registers its
+// prefixes in id_prefixes at startup; a prefix already claimed by another
+// branch or entity stops the server, so two locations can never issue the
+// same identifier. ID_FORMAT lays the parts out and can add the year, as in
+// PCH-2025-00042; a format with the year numbers each year from 1 again.
+
+const idPrefixesTable = `
+	CREATE TABLE IF NOT EXISTS id_prefixes (
+		branch_code VARCHAR(10) NOT NULL,
+		entity VARCHAR(20) NOT NULL,
+		prefix VARCHAR(40) NOT NULL,
+		registered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (branch_code, entity),
+		UNIQUE KEY uniq_id_prefix (prefix)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const idSequencesTable = `
+	CREATE TABLE IF NOT EXISTS id_sequences (
+		prefix VARCHAR(40) PRIMARY KEY,
+		last_value BIGINT NOT NULL DEFAULT 0
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Entities with configurable ID prefixes
+const (
+	EntityTicket   = "ticket"
+	EntityCustomer = "customer"
+	EntityDevice   = "device"
+	EntityQuote    = "quote"
+)
+
+// idEntities maps each entity to its prefix setting and default. Tickets
+// keep ORD so single-branch shops see the identifiers they are used to.
+var idEntities = []struct {
+	Entity string
+	EnvKey string
+	Prefix string
+}{
+	{EntityTicket, "ID_PREFIX_TICKET", "ORD"},
+	{EntityCustomer, "ID_PREFIX_CUSTOMER", "CUST"},
+	{EntityDevice, "ID_PREFIX_DEVICE", "DEV"},
+	{EntityQuote, "ID_PREFIX_QUOTE", "QUO"},
+}
+
+var idCodePattern = regexp.MustCompile(`^[A-Z0-9]{2,8}$`)
+
+// Identifier format placeholders
+const (
+	idFormatPrefix = "{prefix}"
+	idFormatYear   = "{year}"
+	idFormatSeq    = "{seq}"
+)
+
+// idFormatLiteral is what a format may hold besides its placeholders.
+// Identifiers end up in URL paths and directory names, so no slashes.
+var idFormatLiteral = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// IDConfig is this instance's branch code and prefixes.
+type IDConfig struct {
+	BranchCode string            `json:"branch_code,omitempty"`
+	Prefixes   map[string]string `json:"prefixes"` // Full prefix per entity, e.g. BLR-TKT
+	Format     string            `json:"format"`
+	Digits     int               `json:"digits"`
+}
+
+// yearly reports whether identifiers carry the year, and so whether each
+// year has its own sequence.
+func (c IDConfig) yearly() bool {
+	return strings.Contains(c.Format, idFormatYear)
+}
+
+func getIDConfig() (IDConfig, error) {
+	config := IDConfig{
+		BranchCode: strings.ToUpper(getEnv("BRANCH_CODE", "")),
+		Prefixes:   map[string]string{},
+		Format:     getEnv("ID_FORMAT", idFormatPrefix+"-"+idFormatSeq),
+		Digits:     getEnvInt("ID_SEQUENCE_DIGITS", 6),
+	}
+	if config.BranchCode != "" && !idCodePattern.MatchString(config.BranchCode) {
+		return config, fmt.Errorf("BRANCH_CODE must be 2-8 letters or digits")
+	}
+	if config.Digits < 1 || config.Digits > 18 {
+		return config, fmt.Errorf("ID_SEQUENCE_DIGITS must be between 1 and 18")
+	}
+	if strings.Count(config.Format, idFormatPrefix) != 1 || strings.Count(config.Format, idFormatSeq) != 1 ||
+		strings.Count(config.Format, idFormatYear) > 1 {
+		return config, fmt.Errorf("ID_FORMAT must contain {prefix} and {seq} once, and {year} at most once")
+	}
+	literal := strings.NewReplacer(idFormatPrefix, "", idFormatYear, "", idFormatSeq, "").Replace(config.Format)
+	if !idFormatLiteral.MatchString(literal) {
+		return config, fmt.Errorf("ID_FORMAT may only add letters, digits, hyphens and underscores to its placeholders")
+	}
+
+	seen := map[string]string{}
+	for _, entity := range idEntities {
+		code := strings.ToUpper(getEnv(entity.EnvKey, entity.Prefix))
+		if !idCodePattern.MatchString(code) {
+			return config, fmt.Errorf("%s must be 2-8 letters or digits", entity.EnvKey)
+		}
+		if other, taken := seen[code]; taken {
+			return config, fmt.Errorf("%s and %s both use prefix %s", other, entity.EnvKey, code)
+		}
+		seen[code] = entity.EnvKey
+
+		prefix := code
+		if config.BranchCode != "" {
+			prefix = config.BranchCode + "-" + code
+		}
+		config.Prefixes[entity.Entity] = prefix
+	}
+	return config, nil
+}
+
+// RegisteredPrefix is a prefix claimed by a branch.
+type RegisteredPrefix struct {
+	BranchCode   string    `json:"branch_code"`
+	Entity       string    `json:"entity"`
+	Prefix       string    `json:"prefix"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// IDService issues sequential identifiers
+type IDService struct {
+	db     *sql.DB
+	config IDConfig
+}
+
+func NewIDService(database *sql.DB, config IDConfig) *IDService {
+	return &IDService{db: database, config: config}
+}
+
+// Register claims this instance's prefixes, failing if another branch or
+// entity already uses one of them.
+func (ids *IDService) Register() error {
+	tx, err := ids.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, entity := range idEntities {
+		prefix := ids.config.Prefixes[entity.Entity]
+		var branch, owner string
+		err := tx.QueryRow(`SELECT branch_code, entity FROM id_prefixes WHERE prefix = ? FOR UPDATE`, prefix).
+			Scan(&branch, &owner)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && (branch != ids.config.BranchCode || owner != entity.Entity) {
+			return fmt.Errorf("prefix %s for %s is already used for %s by branch %q", prefix, entity.Entity, owner, branch)
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO id_prefixes (branch_code, entity, prefix) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE prefix = VALUES(prefix)
+		`, ids.config.BranchCode, entity.Entity, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Next returns the next identifier for entity, e.g. BLR-TKT-000123. The
+// sequence row is locked while it is advanced, so concurrent requests (and
+// other instances of the same branch) never get the same number.
+func (ids *IDService) Next(entity string) (string, error) {
+	prefix, ok := ids.config.Prefixes[entity]
+	if !ok {
+		return "", fmt.Errorf("no ID prefix for %s", entity)
+	}
+	year := strconv.Itoa(time.Now().Year())
+	sequence := prefix
+	if ids.config.yearly() {
+		sequence = prefix + "-" + year
+	}
+
+	tx, err := ids.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT IGNORE INTO id_sequences (prefix) VALUES (?)`, sequence); err != nil {
+		return "", err
+	}
+	var value int64
+	if err := tx.QueryRow(`SELECT last_value + 1 FROM id_sequences WHERE prefix = ? FOR UPDATE`, sequence).Scan(&value); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE id_sequences SET last_value = ? WHERE prefix = ?`, value, sequence); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return strings.NewReplacer(
+		idFormatPrefix, prefix,
+		idFormatYear, year,
+		idFormatSeq, fmt.Sprintf("%0*d", ids.config.Digits, value),
+	).Replace(ids.config.Format), nil
+}
+
+func (ids *IDService) ListPrefixes() ([]RegisteredPrefix, error) {
+	rows, err := ids.db.Query(`SELECT branch_code, entity, prefix, registered_at FROM id_prefixes ORDER BY branch_code, entity`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefixes := []RegisteredPrefix{}
+	for rows.Next() {
+		var prefix RegisteredPrefix
+		if err := rows.Scan(&prefix.BranchCode, &prefix.Entity, &prefix.Prefix, &prefix.RegisteredAt); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, rows.Err()
+}
+
+var idService *IDService
+
+// IDPrefixesHandler shows this instance's ID configuration and the prefixes
+// registered by every branch.
+func IDPrefixesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefixes, err := idService.ListPrefixes()
+	if err != nil {
+		log.Printf("Error listing ID prefixes: %v", err)
+		http.Error(w, "Failed to retrieve ID prefixes", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":    idService.config,
+		"registered": prefixes,
+	})
+}
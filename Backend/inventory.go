@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Part categories
+var partCategories = []string{"cpu", "motherboard", "memory", "gpu", "storage", "psu", "case", "cooler", "other"}
+
+const partsTable = `
+	CREATE TABLE IF NOT EXISTS parts (
+		sku VARCHAR(64) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		category VARCHAR(30) NOT NULL,
+		attributes JSON NULL,
+		unit_price DECIMAL(10,2) NOT NULL DEFAULT 0,
+		unit_cost DECIMAL(10,2) NOT NULL DEFAULT 0,
+		quantity_on_hand INT NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX idx_parts_category (category)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Part is a stocked inventory item. Attributes carry the specs used for
+// compatibility checks, e.g. socket, memory_type, form_factor, wattage.
+type Part struct {
+	SKU            string            `json:"sku"`
+	Name           string            `json:"name"`
+	Category       string            `json:"category"`
+	Attributes     map[string]string `json:"attributes"`
+	UnitPrice      Money             `json:"unit_price"`
+	UnitCost       Money             `json:"unit_cost"`               // Weighted average of stock on hand (costing.go)
+	SupplierCost   Money             `json:"supplier_cost,omitempty"` // Supplier's current price, from their price list
+	QuantityOnHand int               `json:"quantity_on_hand"`
+	CoresOnHand    int               `json:"cores_on_hand"` // Defective parts awaiting vendor return (wastage.go)
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// PartService handles parts inventory database operations
+type PartService struct {
+	db *sql.DB
+}
+
+func NewPartService(database *sql.DB) *PartService {
+	return &PartService{db: database}
+}
+
+const partColumns = `sku, name, category, attributes, unit_price, unit_cost, supplier_cost, quantity_on_hand, cores_on_hand, updated_at`
+
+func scanPart(row rowScanner) (*Part, error) {
+	var part Part
+	var attributes sql.NullString
+	err := row.Scan(&part.SKU, &part.Name, &part.Category, &attributes, &part.UnitPrice, &part.UnitCost, &part.SupplierCost,
+		&part.QuantityOnHand, &part.CoresOnHand, &part.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	part.Attributes = map[string]string{}
+	if attributes.Valid {
+		if err := json.Unmarshal([]byte(attributes.String), &part.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	return &part, nil
+}
+
+func (ps *PartService) GetPart(sku string) (*Part, error) {
+	return scanPart(ps.db.QueryRow(`SELECT `+partColumns+` FROM parts WHERE sku = ?`, sku))
+}
+
+// ListParts returns the inventory, optionally limited to one category.
+func (ps *PartService) ListParts(category string) ([]Part, error) {
+	query := `SELECT ` + partColumns + ` FROM parts`
+	var args []interface{}
+	if category != "" {
+		query += ` WHERE category = ?`
+		args = append(args, category)
+	}
+
+	rows, err := ps.db.Query(query+` ORDER BY category, name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []Part{}
+	for rows.Next() {
+		part, err := scanPart(rows)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, *part)
+	}
+	return parts, rows.Err()
+}
+
+// SavePart creates a part or replaces an existing one. A changed
+// quantity_on_hand is recorded as an adjustment stock movement; a decrease
+// is taken from the oldest lots, like a stocktake shortfall.
+func (ps *PartService) SavePart(part *Part, actorID string) error {
+	attributes, err := json.Marshal(part.Attributes)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous int
+	err = tx.QueryRow(`SELECT quantity_on_hand FROM parts WHERE sku = ? FOR UPDATE`, part.SKU).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO parts (sku, name, category, attributes, unit_price, unit_cost, quantity_on_hand)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE name = VALUES(name), category = VALUES(category), attributes = VALUES(attributes),
+			unit_price = VALUES(unit_price), unit_cost = VALUES(unit_cost), quantity_on_hand = VALUES(quantity_on_hand)
+	`, part.SKU, part.Name, part.Category, string(attributes), part.UnitPrice, part.UnitCost, part.QuantityOnHand)
+	if err != nil {
+		return err
+	}
+
+	if delta := part.QuantityOnHand - previous; delta != 0 {
+		movement := StockMovement{PartSKU: part.SKU, Quantity: delta, Reason: MovementAdjustment, ActorID: actorID}
+		if delta > 0 {
+			err = recordStockMovement(tx, movement)
+		} else {
+			_, err = takeFromLots(tx, movement, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+var partService *PartService
+
+// PartsHandler lists the parts inventory (optionally ?category=).
+func PartsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts, err := partService.ListParts(r.URL.Query().Get("category"))
+	if err != nil {
+		log.Printf("Error listing parts: %v", err)
+		http.Error(w, "Failed to retrieve parts", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(parts)
+}
+
+// AdminPartsHandler creates or updates a part.
+func AdminPartsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "PUT" {
+		http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var part Part
+	if err := json.NewDecoder(r.Body).Decode(&part); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if part.SKU == "" || len(part.SKU) > 64 {
+		fieldErrors.Add("sku", "is required and at most 64 characters")
+	}
+	if part.Name == "" {
+		fieldErrors.Add("name", "is required")
+	}
+	if !slices.Contains(partCategories, part.Category) {
+		fieldErrors.Add("category", "must be one of cpu, motherboard, memory, gpu, storage, psu, case, cooler, other")
+	}
+	if part.UnitPrice < 0 {
+		fieldErrors.Add("unit_price", "must not be negative")
+	}
+	if part.UnitCost < 0 {
+		fieldErrors.Add("unit_cost", "must not be negative")
+	}
+	if part.QuantityOnHand < 0 {
+		fieldErrors.Add("quantity_on_hand", "must not be negative")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if part.Attributes == nil {
+		part.Attributes = map[string]string{}
+	}
+
+	previous, err := partService.GetPart(part.SKU)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading part %s: %v", part.SKU, err)
+		http.Error(w, "Failed to save part", http.StatusInternalServerError)
+		return
+	}
+
+	if err := partService.SavePart(&part, actorID(r)); err != nil {
+		log.Printf("Error saving part %s: %v", part.SKU, err)
+		http.Error(w, "Failed to save part", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Part %s saved by %s", part.SKU, actorID(r))
+	auditService.Record(r, AuditPartSaved, "part", part.SKU, previous, part)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Part saved successfully",
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// IPAllowlistConfig restricts sensitive routes (user management, the audit
+// log, exports) to the shop's own networks. With no ranges configured the
+// allowlist is off; IP_ALLOWLIST_BYPASS switches it off in development.
+type IPAllowlistConfig struct {
+	Ranges []*net.IPNet
+	Routes []string // Route prefixes the allowlist applies to
+	Bypass bool
+}
+
+// defaultAllowlistRoutes are the sensitive route prefixes besides exports,
+// whose routes come from exportRoutes and are always protected.
+const defaultAllowlistRoutes = "/api/v1/admin/, /api/v1/audit"
+
+func getIPAllowlistConfig() (IPAllowlistConfig, error) {
+	config := IPAllowlistConfig{
+		Routes: append(splitList(getEnv("IP_ALLOWLIST_ROUTES", defaultAllowlistRoutes)), exportRoutePatterns()...),
+		Bypass: getEnv("IP_ALLOWLIST_BYPASS", "false") == "true",
+	}
+
+	ranges, err := parseRanges("IP_ALLOWLIST")
+	if err != nil {
+		return config, err
+	}
+	config.Ranges = ranges
+
+	if config.Bypass && getEnv("APP_ENV", "production") != "development" {
+		log.Printf("Ignoring IP_ALLOWLIST_BYPASS outside APP_ENV=development")
+		config.Bypass = false
+	}
+	return config, nil
+}
+
+// parseRanges reads a comma-separated list of CIDR ranges or addresses from
+// the named setting.
+func parseRanges(key string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, entry := range splitList(getEnv(key, "")) {
+		// A bare address is a single-host range
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q in %s", entry, key)
+		}
+		ranges = append(ranges, network)
+	}
+	return ranges, nil
+}
+
+// inRanges reports whether address falls in any of the ranges.
+func inRanges(address string, ranges []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range ranges {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether requests are checked at all.
+func (c IPAllowlistConfig) Enabled() bool {
+	return len(c.Ranges) > 0 && !c.Bypass
+}
+
+// exportRoutePatterns returns the routes of every registered export.
+func exportRoutePatterns() []string {
+	var routes []string
+	for _, route := range exportRoutes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// protects reports whether a request path is under a protected route. Routes
+// with a "*" segment match that shape exactly; others match as prefixes.
+func (c IPAllowlistConfig) protects(requestPath string) bool {
+	for _, route := range c.Routes {
+		if strings.Contains(route, "*") {
+			if matched, _ := path.Match(route, requestPath); matched {
+				return true
+			}
+		} else if strings.HasPrefix(requestPath, route) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c IPAllowlistConfig) allows(address string) bool {
+	return inRanges(address, c.Ranges)
+}
+
+// ipAllowlistMiddleware rejects requests to protected routes from addresses
+// outside the allowlist. Behind a proxy set TRUST_PROXY_HEADERS so the
+// client address is read from X-Forwarded-For (see clientIP).
+func ipAllowlistMiddleware(config IPAllowlistConfig) func(http.Handler) http.Handler {
+	if config.Bypass {
+		log.Printf("IP allowlist bypassed (IP_ALLOWLIST_BYPASS)")
+	} else if len(config.Ranges) == 0 {
+		log.Printf("IP allowlist disabled; set IP_ALLOWLIST to restrict %s", strings.Join(config.Routes, ", "))
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !config.Enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.protects(r.URL.Path) {
+				if ip := clientIP(r); !config.allows(ip) {
+					log.Printf("Blocked %s %s from %s (not in IP allowlist)", r.Method, r.URL.Path, ip)
+					http.Error(w, "Access from this network is not allowed", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+// TestAllowlistProtectsExports checks that every export route is behind the
+// allowlist with the default settings, next to routes that must stay open.
+func TestAllowlistProtectsExports(t *testing.T) {
+	t.Setenv("IP_ALLOWLIST_ROUTES", "")
+	config, err := getIPAllowlistConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path      string
+		protected bool
+	}{
+		{"/api/v1/reports/export", true},
+		{"/api/v1/reports/tickets", true},
+		{"/api/v1/orders/ORD-1001/case-file", true},
+		{"/api/v1/accounts/sla-report", true},
+		{"/api/v1/engineers/work-orders", true},
+		{"/api/v1/admin/users", true},
+		{"/api/v1/audit", true},
+		{"/api/v1/orders/ORD-1001", false},
+		{"/api/v1/orders/ORD-1001/parts", false},
+		{"/api/v1/accounts", false},
+		{"/api/v1/engineers/workload", false},
+	}
+	for _, c := range cases {
+		if got := config.protects(c.path); got != c.protected {
+			t.Errorf("protects(%q) = %t, want %t", c.path, got, c.protected)
+		}
+	}
+}
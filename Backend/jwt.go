@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the JWT claims issued to authenticated users.
+// The user ID travels in the standard "sub" claim.
+type Claims struct {
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+
+	// Set instead of the JWT fields when the caller used an X-API-Key
+	APIKeyID string   `json:"-"`
+	Scopes   []string `json:"-"`
+}
+
+// TokenService signs and validates access tokens.
+type TokenService struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	issuer    string
+	ttl       time.Duration
+}
+
+// NewTokenService configures RS256 when JWT_PRIVATE_KEY_FILE/JWT_PUBLIC_KEY_FILE
+// are set, and HS256 with JWT_SECRET otherwise.
+func NewTokenService() (*TokenService, error) {
+	ts := &TokenService{
+		issuer: getEnv("JWT_ISSUER", "pcrepairhub"),
+		ttl:    getEnvDuration("JWT_TTL", 15*time.Minute),
+	}
+
+	privateKeyFile := getEnv("JWT_PRIVATE_KEY_FILE", "")
+	publicKeyFile := getEnv("JWT_PUBLIC_KEY_FILE", "")
+	if privateKeyFile != "" || publicKeyFile != "" {
+		privateKey, publicKey, err := loadRSAKeys(privateKeyFile, publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ts.method = jwt.SigningMethodRS256
+		ts.signKey = privateKey
+		ts.verifyKey = publicKey
+		return ts, nil
+	}
+
+	secret := getEnv("JWT_SECRET", "")
+	if secret == "" {
+		// Tokens signed with an ephemeral secret stop working after a restart
+		log.Println("JWT_SECRET is not set; using a random secret for this process only")
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	ts.method = jwt.SigningMethodHS256
+	ts.signKey = []byte(secret)
+	ts.verifyKey = []byte(secret)
+	return ts, nil
+}
+
+func loadRSAKeys(privateKeyFile, publicKeyFile string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	if privateKeyFile == "" || publicKeyFile == "" {
+		return nil, nil, errors.New("both JWT_PRIVATE_KEY_FILE and JWT_PUBLIC_KEY_FILE are required for RS256")
+	}
+
+	privatePEM, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading JWT private key: %w", err)
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing JWT private key: %w", err)
+	}
+
+	publicPEM, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading JWT public key: %w", err)
+	}
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing JWT public key: %w", err)
+	}
+
+	return privateKey, publicKey, nil
+}
+
+// IssueToken signs a short-lived access token for the given user and session.
+func (ts *TokenService) IssueToken(userID, email, role, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ts.ttl)
+
+	// The token ID lets a single token be revoked before it expires
+	tokenID, err := randomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	claims := Claims{
+		Email:     email,
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   userID,
+			Issuer:    ts.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(ts.method, claims).SignedString(ts.signKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// ParseToken validates the signature, algorithm, issuer and expiry of a token.
+func (ts *TokenService) ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return ts.verifyKey, nil
+	},
+		jwt.WithValidMethods([]string{ts.method.Alg()}),
+		jwt.WithIssuer(ts.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// claimsFromContext returns the authenticated user's claims, or nil.
+func claimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsContextKey).(*Claims)
+	return claims
+}
+
+// isPublicRoute reports whether a path is reachable without a token.
+func isPublicRoute(path string) bool {
+	if !strings.HasPrefix(path, "/api/v1/") {
+		// Static frontend files
+		return true
+	}
+	// The customer-facing pages authenticate with their own link tokens
+	return path == "/api/v1/health" || strings.HasPrefix(path, "/api/v1/auth/") ||
+		strings.HasPrefix(path, "/api/v1/public/")
+}
+
+var tokenService *TokenService
+
+// authMiddleware requires a valid bearer token on every /api/v1 route except
+// authentication and health endpoints.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicRoute(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Machine clients authenticate with a scoped API key instead of a JWT
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			claims := authenticateAPIKey(w, r, apiKey)
+			if claims == nil {
+				return
+			}
+			ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		tokenString, found := strings.CutPrefix(header, "Bearer ")
+		if !found || tokenString == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pcrepairhub"`)
+			http.Error(w, "Authorization token required", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := tokenService.ParseToken(tokenString)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pcrepairhub", error="invalid_token"`)
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		revoked, err := revocationService.IsRevoked(claims)
+		if err != nil {
+			log.Printf("Error checking token revocation: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pcrepairhub", error="invalid_token"`)
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+		if claims.SessionID != "" {
+			if err := sessionService.Touch(claims.SessionID, clientIP(r)); err != nil {
+				log.Printf("Error recording activity on session %s: %v", claims.SessionID, err)
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
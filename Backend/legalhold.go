@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A ticket can be placed under legal hold for a police or insurance
+// investigation. While the hold is active nothing about the ticket may be
+// destroyed: the ticket cannot be cancelled (which soft-deletes it), its
+// attachments cannot be deleted, and retention purges skip its ID photos and
+// notifications. Purges and deletions of ticket data check legalHoldClause
+// or checkLegalHold; releasing the hold lets them resume. Holds are kept
+// after release as a record of the investigation.
+
+const legalHoldsTable = `
+	CREATE TABLE IF NOT EXISTS legal_holds (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		reason VARCHAR(500) NOT NULL,
+		reference VARCHAR(100) NULL,
+		placed_by VARCHAR(50) NULL,
+		placed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		released_by VARCHAR(50) NULL,
+		released_at TIMESTAMP NULL,
+		release_reason VARCHAR(500) NULL,
+		INDEX idx_legal_holds_order (order_id, released_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+var (
+	errLegalHoldActive = errors.New("the ticket is already under legal hold")
+	errNoLegalHold     = errors.New("the ticket is not under legal hold")
+)
+
+// LegalHoldError is returned when an action would destroy data of a ticket
+// under legal hold.
+type LegalHoldError struct {
+	OrderID   string
+	Reference string
+}
+
+func (e *LegalHoldError) Error() string {
+	if e.Reference != "" {
+		return fmt.Sprintf("order %s is under legal hold (%s)", e.OrderID, e.Reference)
+	}
+	return fmt.Sprintf("order %s is under legal hold", e.OrderID)
+}
+
+// legalHoldClause is a SQL condition that is true when the ticket in column
+// has no active legal hold.
+func legalHoldClause(column string) string {
+	return `NOT EXISTS (SELECT 1 FROM legal_holds lh WHERE lh.order_id = ` + column + ` AND lh.released_at IS NULL)`
+}
+
+// checkLegalHold returns a *LegalHoldError when a ticket is under legal hold.
+func checkLegalHold(q rowQuerier, orderID string) error {
+	var reference sql.NullString
+	err := q.QueryRow(`
+		SELECT reference FROM legal_holds WHERE order_id = ? AND released_at IS NULL LIMIT 1
+	`, orderID).Scan(&reference)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return &LegalHoldError{OrderID: orderID, Reference: reference.String}
+}
+
+// LegalHold is a hold placed on a ticket.
+type LegalHold struct {
+	ID            int64      `json:"id"`
+	OrderID       string     `json:"order_id"`
+	Reason        string     `json:"reason"`
+	Reference     string     `json:"reference,omitempty"` // Police or insurance case number
+	PlacedBy      string     `json:"placed_by,omitempty"`
+	PlacedAt      time.Time  `json:"placed_at"`
+	ReleasedBy    string     `json:"released_by,omitempty"`
+	ReleasedAt    *time.Time `json:"released_at,omitempty"`
+	ReleaseReason string     `json:"release_reason,omitempty"`
+}
+
+// LegalHoldService places and releases legal holds
+type LegalHoldService struct {
+	db *sql.DB
+}
+
+func NewLegalHoldService(database *sql.DB) *LegalHoldService {
+	return &LegalHoldService{db: database}
+}
+
+// Place puts a ticket under legal hold.
+func (ls *LegalHoldService) Place(hold *LegalHold) error {
+	tx, err := ls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the ticket keeps two holds from being placed at once
+	if _, err := orderService.lockOrderStatus(tx, hold.OrderID); err != nil {
+		return err
+	}
+	if err := checkLegalHold(tx, hold.OrderID); err != nil {
+		var holdErr *LegalHoldError
+		if errors.As(err, &holdErr) {
+			return errLegalHoldActive
+		}
+		return err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO legal_holds (order_id, reason, reference, placed_by) VALUES (?, ?, ?, ?)
+	`, hold.OrderID, hold.Reason, nullString(hold.Reference), nullString(hold.PlacedBy))
+	if err != nil {
+		return err
+	}
+	if hold.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Release ends a ticket's active legal hold.
+func (ls *LegalHoldService) Release(orderID, reason, actorID string) error {
+	result, err := ls.db.Exec(`
+		UPDATE legal_holds SET released_at = NOW(), released_by = ?, release_reason = ?
+		WHERE order_id = ? AND released_at IS NULL
+	`, nullString(actorID), reason, orderID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errNoLegalHold
+	}
+	return nil
+}
+
+// Active returns a ticket's active legal hold, or nil.
+func (ls *LegalHoldService) Active(orderID string) (*LegalHold, error) {
+	holds, err := ls.queryHolds(`WHERE order_id = ? AND released_at IS NULL`, orderID)
+	if err != nil || len(holds) == 0 {
+		return nil, err
+	}
+	return &holds[0], nil
+}
+
+// List returns the holds on one ticket, or every active hold when orderID
+// is empty.
+func (ls *LegalHoldService) List(orderID string) ([]LegalHold, error) {
+	if orderID != "" {
+		return ls.queryHolds(`WHERE order_id = ?`, orderID)
+	}
+	return ls.queryHolds(`WHERE released_at IS NULL`)
+}
+
+func (ls *LegalHoldService) queryHolds(where string, args ...interface{}) ([]LegalHold, error) {
+	rows, err := ls.db.Query(`
+		SELECT id, order_id, reason, reference, placed_by, placed_at, released_by, released_at, release_reason
+		FROM legal_holds `+where+` ORDER BY placed_at DESC, id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []LegalHold{}
+	for rows.Next() {
+		var hold LegalHold
+		var reference, placedBy, releasedBy, releaseReason sql.NullString
+		var releasedAt sql.NullTime
+		if err := rows.Scan(&hold.ID, &hold.OrderID, &hold.Reason, &reference, &placedBy, &hold.PlacedAt,
+			&releasedBy, &releasedAt, &releaseReason); err != nil {
+			return nil, err
+		}
+		hold.Reference = reference.String
+		hold.PlacedBy = placedBy.String
+		hold.ReleasedBy = releasedBy.String
+		hold.ReleasedAt = timePtr(releasedAt)
+		hold.ReleaseReason = releaseReason.String
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+var legalHoldService *LegalHoldService
+
+// LegalHoldsHandler lists active holds, or every hold of one ticket (GET
+// ?order_id=), places a hold (POST {"order_id": "...", "reason": "...",
+// "reference": "FIR 118/2024"}) or releases one (DELETE {"order_id": "...",
+// "reason": "..."}). Admin only.
+func LegalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		holds, err := legalHoldService.List(r.URL.Query().Get("order_id"))
+		if err != nil {
+			log.Printf("Error listing legal holds: %v", err)
+			http.Error(w, "Failed to retrieve legal holds", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(holds)
+
+	case "POST":
+		var request struct {
+			OrderID   string `json:"order_id"`
+			Reason    string `json:"reason"`
+			Reference string `json:"reference"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		request.Reason = strings.TrimSpace(request.Reason)
+		request.Reference = strings.TrimSpace(request.Reference)
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if request.Reason == "" {
+			fieldErrors.Add("reason", "is required")
+		} else if len(request.Reason) > 500 {
+			fieldErrors.Add("reason", "is too long")
+		}
+		if len(request.Reference) > 100 {
+			fieldErrors.Add("reference", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		hold := &LegalHold{OrderID: request.OrderID, Reason: request.Reason, Reference: request.Reference, PlacedBy: actorID(r)}
+		err := legalHoldService.Place(hold)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errLegalHoldActive {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error placing legal hold on %s: %v", request.OrderID, err)
+			http.Error(w, "Failed to place legal hold", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Order %s placed under legal hold", request.OrderID)
+		auditService.Record(r, AuditLegalHoldPlaced, "order", request.OrderID, nil, request)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Legal hold placed successfully",
+			"id":      hold.ID,
+		})
+
+	case "DELETE":
+		var request struct {
+			OrderID string `json:"order_id"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		request.Reason = strings.TrimSpace(request.Reason)
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if request.Reason == "" {
+			fieldErrors.Add("reason", "is required")
+		} else if len(request.Reason) > 500 {
+			fieldErrors.Add("reason", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		err := legalHoldService.Release(request.OrderID, request.Reason, actorID(r))
+		if err == errNoLegalHold {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error releasing legal hold on %s: %v", request.OrderID, err)
+			http.Error(w, "Failed to release legal hold", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Legal hold on order %s released", request.OrderID)
+		auditService.Record(r, AuditLegalHoldReleased, "order", request.OrderID, nil, request)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Legal hold released successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
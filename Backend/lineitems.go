@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Line items are shown in sections (Labor, Parts, Fees) in an order staff
+// choose. Each item is identified by the version of the event that added it;
+// an ItemsArranged event records the chosen section and order of every
+// item, so the arrangement is part of the ticket's history like any other
+// change. Items added after an arrangement go to the end of their section.
+
+// Line item sections, in invoice order
+const (
+	SectionLabor = "labor"
+	SectionParts = "parts"
+	SectionFees  = "fees"
+)
+
+var lineItemSections = []struct {
+	Key   string
+	Title string
+}{
+	{SectionLabor, "Labor"},
+	{SectionParts, "Parts"},
+	{SectionFees, "Fees"},
+}
+
+func validSection(section string) bool {
+	for _, s := range lineItemSections {
+		if s.Key == section {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultSection places an item that was added without a section.
+func defaultSection(item ItemAddedPayload) string {
+	if item.WarrantyKind == WarrantyParts {
+		return SectionParts
+	}
+	return SectionLabor
+}
+
+var errArrangementMismatch = errors.New("the arrangement must list every line item of the ticket exactly once")
+
+// ItemPlacement puts one line item in a section.
+type ItemPlacement struct {
+	ID      int    `json:"id"`
+	Section string `json:"section"`
+}
+
+// ItemsArrangedPayload is the full order of a ticket's line items.
+type ItemsArrangedPayload struct {
+	Items []ItemPlacement `json:"items"`
+}
+
+// ticketLineItems returns a ticket's line items from its events, grouped by
+// section and in the latest arrangement's order. The intake quote counts as
+// an item when it has an amount.
+func ticketLineItems(events []TicketEvent) ([]TicketLineItem, error) {
+	var items []TicketLineItem
+	var arrangement []ItemPlacement
+
+	for _, event := range events {
+		switch event.Type {
+		case EventTicketCreated:
+			var created Order
+			if err := json.Unmarshal(event.Payload, &created); err != nil {
+				return nil, err
+			}
+			if created.TotalCost != 0 {
+				items = append(items, TicketLineItem{
+					ID: event.Version, Description: strings.Join(created.Services, ", "), Amount: created.TotalCost,
+					Section: SectionLabor, AddedBy: event.ActorID, AddedAt: event.OccurredAt,
+				})
+			}
+
+		case EventItemAdded:
+			var item ItemAddedPayload
+			if err := json.Unmarshal(event.Payload, &item); err != nil {
+				return nil, err
+			}
+			section := item.Section
+			if section == "" {
+				section = defaultSection(item)
+			}
+			items = append(items, TicketLineItem{
+				ID: event.Version, Description: item.Description, Amount: item.Amount, Section: section,
+				WarrantyKind: item.WarrantyKind, WarrantyDays: item.WarrantyDays, PartSKU: item.PartSKU, Quantity: item.Quantity, PartCost: item.PartCost,
+				CostID: item.CostID, AddedBy: event.ActorID, AddedAt: event.OccurredAt,
+			})
+
+		case EventItemsArranged:
+			var arranged ItemsArrangedPayload
+			if err := json.Unmarshal(event.Payload, &arranged); err != nil {
+				return nil, err
+			}
+			arrangement = arranged.Items
+
+		case EventTicketSplit:
+			var split TicketSplitPayload
+			if err := json.Unmarshal(event.Payload, &split); err != nil {
+				return nil, err
+			}
+			items = slices.DeleteFunc(items, func(item TicketLineItem) bool {
+				return slices.ContainsFunc(split.Items, func(moved SplitItem) bool { return moved.ID == item.ID })
+			})
+		}
+	}
+
+	position := map[int]int{}
+	for i, placement := range arrangement {
+		position[placement.ID] = i
+		for j := range items {
+			if items[j].ID == placement.ID {
+				items[j].Section = placement.Section
+			}
+		}
+	}
+	rank := func(item TicketLineItem) int {
+		if p, ok := position[item.ID]; ok {
+			return p
+		}
+		return len(arrangement) + item.ID
+	}
+
+	arranged := make([]TicketLineItem, 0, len(items))
+	for _, section := range lineItemSections {
+		start := len(arranged)
+		for _, item := range items {
+			if item.Section == section.Key {
+				arranged = append(arranged, item)
+			}
+		}
+		slices.SortStableFunc(arranged[start:], func(a, b TicketLineItem) int { return rank(a) - rank(b) })
+	}
+	return arranged, nil
+}
+
+// ArrangeItems records a new section and order for every line item of a
+// ticket.
+func (os *OrderService) ArrangeItems(orderID string, placements []ItemPlacement, actorID string) error {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := os.lockOrderStatus(tx, orderID); err != nil {
+		return err
+	}
+
+	events, err := os.events.Load(orderID)
+	if err != nil {
+		return err
+	}
+	items, err := ticketLineItems(events)
+	if err != nil {
+		return err
+	}
+	if len(items) != len(placements) {
+		return errArrangementMismatch
+	}
+	listed := map[int]bool{}
+	for _, placement := range placements {
+		listed[placement.ID] = true
+	}
+	for _, item := range items {
+		if !listed[item.ID] {
+			return errArrangementMismatch
+		}
+	}
+
+	if _, err := os.events.Append(tx, orderID, EventItemsArranged, actorID, ItemsArrangedPayload{Items: placements}); err != nil {
+		return err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ArrangeOrderItemsHandler sets the section and order of a ticket's line
+// items (PUT {"order_id": "...", "items": [{"id": 3, "section": "parts"}, ...]}).
+func ArrangeOrderItemsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "PUT" {
+		http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OrderID string          `json:"order_id"`
+		Items   []ItemPlacement `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.OrderID == "" {
+		fieldErrors.Add("order_id", "is required")
+	}
+	if len(request.Items) == 0 {
+		fieldErrors.Add("items", "is required")
+	}
+	for i, placement := range request.Items {
+		if !validSection(placement.Section) {
+			fieldErrors.Add(fmt.Sprintf("items[%d].section", i), "must be labor, parts or fees")
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := orderService.ArrangeItems(request.OrderID, request.Items, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err == errArrangementMismatch {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error arranging items of order %s: %v", request.OrderID, err)
+		http.Error(w, "Failed to arrange items", http.StatusInternalServerError)
+		return
+	}
+	auditService.Record(r, AuditItemsArranged, "order", request.OrderID, nil, request.Items)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Items arranged successfully",
+	})
+}
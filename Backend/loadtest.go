@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Load testing support, run as one-off commands of the server binary:
+//
+//	./main seed-loadtest 50000   create synthetic tickets through the normal write path
+//	./main purge-loadtest        delete them again
+//	./main explain-check         fail if a key query has lost its index
+//
+// The k6 and vegeta profiles in /loadtest drive CreateTicket and GetAllOrders
+// against a seeded database, and the Go benchmarks in loadtest_test.go time
+// the same paths without HTTP. Synthetic tickets announce nothing: the
+// outbox skips them, so seeding never emails or calls webhooks.
+
+// loadTestIDPrefix marks synthetic tickets so they can be purged.
+const loadTestIDPrefix = "ORD-LT-"
+
+// isLoadTestTicket reports whether id is a synthetic ticket.
+func isLoadTestTicket(id string) bool {
+	return strings.HasPrefix(id, loadTestIDPrefix)
+}
+
+// runCommand runs a command given on the command line and reports whether
+// one was given.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "seed-loadtest":
+		count := 10000
+		if len(args) > 1 {
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 1 {
+				log.Fatalf("Usage: seed-loadtest [ticket count]")
+			}
+		}
+		err = seedLoadTest(count)
+	case "purge-loadtest":
+		err = purgeLoadTest(loadTestIDPrefix)
+	case "explain-check":
+		var failures []string
+		if failures, err = explainCheck(context.Background()); err == nil && len(failures) > 0 {
+			for _, failure := range failures {
+				log.Printf("Query plan regression: %s", failure)
+			}
+			os.Exit(1)
+		}
+	default:
+		log.Fatalf("Unknown command %q (expected seed-loadtest, purge-loadtest or explain-check)", args[0])
+	}
+
+	if err != nil {
+		log.Fatalf("%s failed: %v", args[0], err)
+	}
+	return true
+}
+
+var (
+	loadTestDevices  = []string{"Laptop", "Desktop", "Phone", "Tablet", "Console"}
+	loadTestServices = []string{"Screen replacement", "Battery replacement", "Diagnostics", "Data recovery", "OS reinstall"}
+	loadTestStatuses = []string{"New Order", "In Progress", "Ready for Delivery", "Collected"}
+)
+
+// seedLoadTest creates count synthetic tickets spread over the last year,
+// moving a share of them along the workflow and taking payments so reports
+// and status queries see a realistic mix.
+func seedLoadTest(count int) error {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	start := time.Now()
+	prefix := fmt.Sprintf("%s%d-", loadTestIDPrefix, start.UnixNano())
+
+	for i := 0; i < count; i++ {
+		order := loadTestOrder(random, prefix+strconv.Itoa(i), count/3+1)
+		if err := orderService.CreateOrder(&order); err != nil {
+			return err
+		}
+		if err := ageLoadTestTicket(random, &order, start); err != nil {
+			return err
+		}
+
+		if (i+1)%1000 == 0 {
+			log.Printf("Seeded %d/%d tickets", i+1, count)
+		}
+	}
+
+	log.Printf("Seeded %d load test tickets in %s", count, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// loadTestOrder returns a synthetic ticket for one of customers customers.
+func loadTestOrder(random *rand.Rand, id string, customers int) Order {
+	customer := random.Intn(customers)
+	return Order{
+		ID:            id,
+		CustomerName:  fmt.Sprintf("Load Test %d", customer),
+		CustomerEmail: fmt.Sprintf("loadtest+%d@example.com", customer),
+		CustomerPhone: fmt.Sprintf("9%09d", customer),
+		DeviceType:    loadTestDevices[random.Intn(len(loadTestDevices))],
+		DeviceSerial:  fmt.Sprintf("LT%010d", random.Int63n(1e10)),
+		Services:      []string{loadTestServices[random.Intn(len(loadTestServices))]},
+		Status:        "New Order",
+		TotalCost:     Money(500+random.Intn(20000)) * 100,
+		TicketType:    defaultTicketType,
+	}
+}
+
+// ageLoadTestTicket backdates a new synthetic ticket into the year before
+// now and moves it a random way along the workflow, taking payment for
+// those it collects.
+func ageLoadTestTicket(random *rand.Rand, order *Order, now time.Time) error {
+	createdAt := now.Add(-time.Duration(random.Int63n(int64(365 * 24 * time.Hour))))
+	if _, err := db.Exec(`UPDATE orders SET created_at = ? WHERE id = ?`, createdAt, order.ID); err != nil {
+		return err
+	}
+
+	target := random.Intn(len(loadTestStatuses))
+	for _, status := range loadTestStatuses[1 : target+1] {
+		if _, err := orderService.UpdateOrderStatus(order.ID, status, ""); err != nil {
+			return err
+		}
+	}
+	if target == len(loadTestStatuses)-1 {
+		payment := PaymentRecordedPayload{Amount: order.TotalCost, Method: "cash"}
+		if err := orderService.RecordPayment(order.ID, payment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeLoadTest deletes the synthetic tickets whose IDs start with prefix,
+// their events and any outbox messages about them queued before the outbox
+// skipped synthetic tickets.
+func purgeLoadTest(prefix string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM ticket_events WHERE ticket_id LIKE ?`, prefix+"%"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM outbox WHERE aggregate_id LIKE ?`, prefix+"%"); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM orders WHERE id LIKE ?`, prefix+"%")
+	if err != nil {
+		return err
+	}
+	deleted, _ := result.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Purged %d load test tickets", deleted)
+	return nil
+}
+
+// planCheck is a key query whose listed tables must be read through an index.
+type planCheck struct {
+	Name    string
+	Query   string
+	Args    []interface{}
+	Indexed []string
+}
+
+// planChecks cover the lookups and joins that slow down first as the
+// tickets table grows. Keep them in step with the queries they mirror.
+var planChecks = []planCheck{
+	{
+		Name:    "orders by status",
+		Query:   `SELECT ` + orderColumns + ` FROM orders WHERE status IN (?, ?) AND deleted_at IS NULL ORDER BY updated_at DESC, id LIMIT 50`,
+		Args:    []interface{}{"New Order", "In Progress"},
+		Indexed: []string{"orders"},
+	},
+	{
+		Name:    "ticket event stream",
+		Query:   `SELECT id, version, event_type, payload FROM ticket_events WHERE ticket_id = ? ORDER BY version`,
+		Args:    []interface{}{"ORD-0"},
+		Indexed: []string{"ticket_events"},
+	},
+	{
+		Name: "warranty lookup by serial",
+		Query: `SELECT w.id FROM repair_warranties w JOIN orders o ON o.id = w.order_id
+			WHERE o.device_serial = ? AND w.expires_at > NOW() ORDER BY w.starts_at DESC LIMIT 1`,
+		Args:    []interface{}{"SN-0"},
+		Indexed: []string{"o"},
+	},
+	{
+		Name: "report turnaround join",
+		Query: `SELECT AVG(TIMESTAMPDIFF(MINUTE, o.created_at, e.collected_at)) / 60
+			FROM orders o
+			JOIN (SELECT ticket_id, MAX(occurred_at) AS collected_at FROM ticket_events
+			      WHERE event_type = ? AND JSON_UNQUOTE(JSON_EXTRACT(payload, '$.to')) = 'Collected'
+			      GROUP BY ticket_id) e ON e.ticket_id = o.id
+			WHERE e.collected_at >= ? AND e.collected_at < ? AND o.deleted_at IS NULL`,
+		Args:    []interface{}{EventStatusChanged, time.Now().AddDate(0, -1, 0), time.Now()},
+		Indexed: []string{"o", "ticket_events"},
+	},
+	{
+		Name:    "visits of a ticket",
+		Query:   `SELECT address FROM onsite_visits WHERE order_id = ? ORDER BY created_at DESC LIMIT 1`,
+		Args:    []interface{}{"ORD-0"},
+		Indexed: []string{"onsite_visits"},
+	},
+	{
+		Name:    "attachment usage of a ticket",
+		Query:   `SELECT COALESCE(SUM(size_bytes), 0) FROM attachments WHERE order_id = ?`,
+		Args:    []interface{}{"ORD-0"},
+		Indexed: []string{"attachments"},
+	},
+}
+
+// explainCheck runs EXPLAIN on every plan check and returns a description of
+// each indexed table that is read with a full scan. Tables smaller than
+// EXPLAIN_SCAN_THRESHOLD rows are ignored, as the optimiser rightly scans
+// them, so run it against a seeded database.
+func explainCheck(ctx context.Context) ([]string, error) {
+	threshold := getEnvInt("EXPLAIN_SCAN_THRESHOLD", 1000)
+
+	var failures []string
+	for _, check := range planChecks {
+		plan, err := explain(ctx, check.Query, check.Args...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", check.Name, err)
+		}
+		for _, step := range plan {
+			scanned, _ := strconv.Atoi(step["rows"])
+			if step["type"] == "ALL" && scanned >= threshold && containsFold(check.Indexed, step["table"]) {
+				failures = append(failures, fmt.Sprintf("%s: full scan of %s (~%d rows, possible keys: %s)",
+					check.Name, step["table"], scanned, step["possible_keys"]))
+			}
+		}
+		log.Printf("Checked plan for %s", check.Name)
+	}
+	return failures, nil
+}
+
+// explain returns the rows of EXPLAIN for query keyed by column name, so it
+// works across MySQL versions that add columns.
+func explain(ctx context.Context, query string, args ...interface{}) ([]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var plan []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		step := map[string]string{}
+		for i, column := range columns {
+			step[strings.ToLower(column)] = values[i].String
+		}
+		plan = append(plan, step)
+	}
+	return plan, rows.Err()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Benchmarks of the paths the k6 and vegeta profiles drive, without HTTP.
+// They need the database in the DB_* settings and write synthetic tickets
+// there, purged again afterwards, so they only run with LOADTEST_BENCH set:
+//
+//	LOADTEST_BENCH=1 go test -run '^$' -bench . -benchtime 2000x
+//
+// Seed the database first (./main seed-loadtest 50000) for realistic reads.
+
+var benchmarkSetup sync.Once
+
+// setupBenchmark connects to the database and starts the services once, or
+// skips the benchmark when LOADTEST_BENCH is unset.
+func setupBenchmark(b *testing.B) {
+	b.Helper()
+	if os.Getenv("LOADTEST_BENCH") == "" {
+		b.Skip("set LOADTEST_BENCH=1 to benchmark against the DB_* database")
+	}
+	benchmarkSetup.Do(func() {
+		initDatabase()
+		initServices()
+	})
+}
+
+// benchmarkPrefix returns an ID prefix for one benchmark's synthetic
+// tickets and purges them when it ends.
+func benchmarkPrefix(b *testing.B) string {
+	b.Helper()
+	prefix := fmt.Sprintf("%sB%d-", loadTestIDPrefix, time.Now().UnixNano())
+	b.Cleanup(func() {
+		if err := purgeLoadTest(prefix); err != nil {
+			b.Errorf("purging %s: %v", prefix, err)
+		}
+	})
+	return prefix
+}
+
+func BenchmarkCreateOrder(b *testing.B) {
+	setupBenchmark(b)
+	prefix := benchmarkPrefix(b)
+	random := rand.New(rand.NewSource(1))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		order := loadTestOrder(random, prefix+strconv.Itoa(i), 1000)
+		if err := orderService.CreateOrder(&order); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdateOrderStatus(b *testing.B) {
+	setupBenchmark(b)
+	prefix := benchmarkPrefix(b)
+	random := rand.New(rand.NewSource(1))
+
+	ids := make([]string, b.N)
+	for i := range ids {
+		order := loadTestOrder(random, prefix+strconv.Itoa(i), 1000)
+		if err := orderService.CreateOrder(&order); err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = order.ID
+	}
+
+	b.ResetTimer()
+	for _, id := range ids {
+		if _, err := orderService.UpdateOrderStatus(id, "In Progress", ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// seedBenchmarkTickets makes sure the reads have count synthetic tickets
+// to find beyond whatever the database already holds.
+func seedBenchmarkTickets(b *testing.B, count int) {
+	b.Helper()
+	prefix := benchmarkPrefix(b)
+	random := rand.New(rand.NewSource(1))
+	now := time.Now()
+	for i := 0; i < count; i++ {
+		order := loadTestOrder(random, prefix+strconv.Itoa(i), count/3+1)
+		if err := orderService.CreateOrder(&order); err != nil {
+			b.Fatal(err)
+		}
+		if err := ageLoadTestTicket(random, &order, now); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetAllOrders(b *testing.B) {
+	setupBenchmark(b)
+	seedBenchmarkTickets(b, 500)
+	var fieldErrors ValidationErrors
+	filter := parseOrderListFilter(url.Values{}, "created", &fieldErrors)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := orderService.GetAllOrders(false, filter); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetOrdersByStatus(b *testing.B) {
+	setupBenchmark(b)
+	seedBenchmarkTickets(b, 500)
+	var fieldErrors ValidationErrors
+	filter := parseOrderListFilter(url.Values{}, "updated", &fieldErrors)
+	statuses := []string{"New Order", "In Progress"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := orderService.GetOrdersByStatus(statuses, false, filter, 1, 50); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
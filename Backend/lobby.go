@@ -0,0 +1,389 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Walk-in customers take a numbered token, from the lobby kiosk (API key
+// scope lobby:kiosk) or the front desk, and wait to be called. Staff move a
+// token on to called, served or abandoned (the customer left before being
+// seen); numbers restart each day. The lobby report turns the tokens into
+// staffing figures: average and longest wait until called, abandonment and a
+// heatmap of arrivals by weekday and hour. Tokens still open at the end of
+// the day they were issued count as abandoned.
+
+const lobbyTokensTable = `
+	CREATE TABLE IF NOT EXISTS lobby_tokens (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		token_number INT NOT NULL,
+		reason VARCHAR(100) NULL,
+		customer_name VARCHAR(255) NULL,
+		status ENUM('waiting', 'called', 'served', 'abandoned') NOT NULL DEFAULT 'waiting',
+		issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		called_at TIMESTAMP NULL,
+		called_by VARCHAR(50) NULL,
+		closed_at TIMESTAMP NULL,
+		closed_by VARCHAR(50) NULL,
+		order_id VARCHAR(50) NULL,
+		INDEX idx_lobby_tokens_issued (issued_at),
+		INDEX idx_lobby_tokens_status (status)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Lobby token states.
+const (
+	LobbyWaiting   = "waiting"
+	LobbyCalled    = "called"
+	LobbyServed    = "served"
+	LobbyAbandoned = "abandoned"
+)
+
+var errLobbyTokenClosed = errors.New("the token has already been served or abandoned")
+
+// lobbyAbandonedClause matches tokens that ended without being served,
+// including ones left open past the day they were issued.
+const lobbyAbandonedClause = `(status = 'abandoned' OR (status IN ('waiting', 'called') AND issued_at < CURDATE()))`
+
+// LobbyToken is one walk-in customer's place in the queue.
+type LobbyToken struct {
+	ID           int64      `json:"id"`
+	TokenNumber  int        `json:"token_number"`
+	Reason       string     `json:"reason,omitempty"` // e.g. drop-off, collection, enquiry
+	CustomerName string     `json:"customer_name,omitempty"`
+	Status       string     `json:"status"`
+	IssuedAt     time.Time  `json:"issued_at"`
+	CalledAt     *time.Time `json:"called_at,omitempty"`
+	ClosedAt     *time.Time `json:"closed_at,omitempty"`
+	OrderID      string     `json:"order_id,omitempty"` // Ticket booked while serving the customer
+}
+
+// LobbyHour is one cell of the arrivals heatmap.
+type LobbyHour struct {
+	Weekday            string   `json:"weekday"`
+	Hour               int      `json:"hour"`
+	Tokens             int      `json:"tokens"`
+	Abandoned          int      `json:"abandoned"`
+	AverageWaitMinutes *float64 `json:"average_wait_minutes,omitempty"`
+}
+
+// LobbyReport summarises the walk-in queue over a period.
+type LobbyReport struct {
+	Range              ReportRange `json:"range"`
+	Tokens             int         `json:"tokens"`
+	Served             int         `json:"served"`
+	Abandoned          int         `json:"abandoned"`
+	AbandonmentRate    float64     `json:"abandonment_rate"`               // Abandoned share of tokens, 0-1
+	AverageWaitMinutes *float64    `json:"average_wait_minutes,omitempty"` // Issue to first call
+	LongestWaitMinutes *float64    `json:"longest_wait_minutes,omitempty"`
+	AverageLeftAfter   *float64    `json:"average_left_after_minutes,omitempty"` // How long abandoning customers waited
+	Heatmap            []LobbyHour `json:"heatmap"`
+}
+
+// LobbyService handles the walk-in queue
+type LobbyService struct {
+	db *sql.DB
+}
+
+func NewLobbyService(database *sql.DB) *LobbyService {
+	return &LobbyService{db: database}
+}
+
+const lobbyTokenColumns = `id, token_number, reason, customer_name, status, issued_at, called_at, closed_at, order_id`
+
+func scanLobbyToken(row rowScanner) (*LobbyToken, error) {
+	var token LobbyToken
+	var reason, customerName, orderID sql.NullString
+	var calledAt, closedAt sql.NullTime
+	if err := row.Scan(&token.ID, &token.TokenNumber, &reason, &customerName, &token.Status, &token.IssuedAt,
+		&calledAt, &closedAt, &orderID); err != nil {
+		return nil, err
+	}
+	token.Reason, token.CustomerName, token.OrderID = reason.String, customerName.String, orderID.String
+	if calledAt.Valid {
+		token.CalledAt = &calledAt.Time
+	}
+	if closedAt.Valid {
+		token.ClosedAt = &closedAt.Time
+	}
+	return &token, nil
+}
+
+// Issue hands out the day's next token number.
+func (ls *LobbyService) Issue(token *LobbyToken) error {
+	tx, err := ls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(`
+		SELECT COALESCE(MAX(token_number), 0) + 1 FROM lobby_tokens WHERE issued_at >= CURDATE() FOR UPDATE
+	`).Scan(&token.TokenNumber); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`INSERT INTO lobby_tokens (token_number, reason, customer_name) VALUES (?, ?, ?)`,
+		token.TokenNumber, nullString(token.Reason), nullString(token.CustomerName))
+	if err != nil {
+		return err
+	}
+	if token.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	if err := tx.QueryRow(`SELECT issued_at FROM lobby_tokens WHERE id = ?`, token.ID).Scan(&token.IssuedAt); err != nil {
+		return err
+	}
+	token.Status = LobbyWaiting
+	return tx.Commit()
+}
+
+// Queue returns today's open tokens in number order.
+func (ls *LobbyService) Queue() ([]LobbyToken, error) {
+	rows, err := ls.db.Query(`
+		SELECT ` + lobbyTokenColumns + ` FROM lobby_tokens
+		WHERE issued_at >= CURDATE() AND status IN ('waiting', 'called') ORDER BY token_number
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []LobbyToken{}
+	for rows.Next() {
+		token, err := scanLobbyToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+// Advance moves an open token to status. The first call sets called_at;
+// serving a token nobody called counts it as called then.
+func (ls *LobbyService) Advance(id int64, status, orderID, actorID string) error {
+	tx, err := ls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRow(`SELECT status FROM lobby_tokens WHERE id = ? FOR UPDATE`, id).Scan(&current); err != nil {
+		return err
+	}
+	if current != LobbyWaiting && current != LobbyCalled {
+		return errLobbyTokenClosed
+	}
+
+	switch status {
+	case LobbyCalled:
+		_, err = tx.Exec(`
+			UPDATE lobby_tokens SET status = ?, called_at = COALESCE(called_at, NOW()),
+			       called_by = COALESCE(called_by, ?) WHERE id = ?
+		`, status, nullString(actorID), id)
+	case LobbyServed:
+		_, err = tx.Exec(`
+			UPDATE lobby_tokens SET status = ?, called_at = COALESCE(called_at, NOW()),
+			       called_by = COALESCE(called_by, ?), closed_at = NOW(), closed_by = ?, order_id = ? WHERE id = ?
+		`, status, nullString(actorID), nullString(actorID), nullString(orderID), id)
+	default:
+		_, err = tx.Exec(`UPDATE lobby_tokens SET status = ?, closed_at = NOW(), closed_by = ? WHERE id = ?`,
+			status, nullString(actorID), id)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LobbyReport summarises the tokens issued in period.
+func (rs *ReportService) LobbyReport(period ReportRange) (*LobbyReport, error) {
+	report := &LobbyReport{Range: period, Heatmap: []LobbyHour{}}
+	var average, longest, leftAfter sql.NullFloat64
+	err := rs.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(status = 'served'), 0), COALESCE(SUM(`+lobbyAbandonedClause+`), 0),
+		       AVG(TIMESTAMPDIFF(SECOND, issued_at, called_at)) / 60,
+		       MAX(TIMESTAMPDIFF(SECOND, issued_at, called_at)) / 60,
+		       AVG(CASE WHEN status = 'abandoned' THEN TIMESTAMPDIFF(SECOND, issued_at, closed_at) END) / 60
+		FROM lobby_tokens WHERE issued_at >= ? AND issued_at < ?
+	`, period.From, period.To).Scan(&report.Tokens, &report.Served, &report.Abandoned, &average, &longest, &leftAfter)
+	if err != nil {
+		return nil, err
+	}
+	if report.Tokens > 0 {
+		report.AbandonmentRate = float64(report.Abandoned) / float64(report.Tokens)
+	}
+	if average.Valid {
+		report.AverageWaitMinutes, report.LongestWaitMinutes = &average.Float64, &longest.Float64
+	}
+	if leftAfter.Valid {
+		report.AverageLeftAfter = &leftAfter.Float64
+	}
+
+	rows, err := rs.db.Query(`
+		SELECT DAYOFWEEK(issued_at), HOUR(issued_at), COUNT(*), COALESCE(SUM(`+lobbyAbandonedClause+`), 0),
+		       AVG(TIMESTAMPDIFF(SECOND, issued_at, called_at)) / 60
+		FROM lobby_tokens WHERE issued_at >= ? AND issued_at < ?
+		GROUP BY DAYOFWEEK(issued_at), HOUR(issued_at)
+		ORDER BY DAYOFWEEK(issued_at), HOUR(issued_at)
+	`, period.From, period.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cell LobbyHour
+		var weekday int
+		var wait sql.NullFloat64
+		if err := rows.Scan(&weekday, &cell.Hour, &cell.Tokens, &cell.Abandoned, &wait); err != nil {
+			return nil, err
+		}
+		// DAYOFWEEK counts from 1 = Sunday
+		cell.Weekday = time.Weekday(weekday - 1).String()
+		if wait.Valid {
+			cell.AverageWaitMinutes = &wait.Float64
+		}
+		report.Heatmap = append(report.Heatmap, cell)
+	}
+	return report, rows.Err()
+}
+
+var lobbyService *LobbyService
+
+// LobbyTokensHandler lists today's open tokens (GET) or issues the next one
+// (POST {"reason": "collection", "customer_name": "..."}).
+func LobbyTokensHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		tokens, err := lobbyService.Queue()
+		if err != nil {
+			log.Printf("Error listing lobby queue: %v", err)
+			http.Error(w, "Failed to retrieve queue", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(tokens)
+
+	case "POST":
+		var token LobbyToken
+		if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		token.Reason = strings.TrimSpace(token.Reason)
+		token.CustomerName = strings.TrimSpace(token.CustomerName)
+
+		var fieldErrors ValidationErrors
+		if len(token.Reason) > 100 {
+			fieldErrors.Add("reason", "is too long")
+		}
+		if len(token.CustomerName) > 255 {
+			fieldErrors.Add("customer_name", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		if err := lobbyService.Issue(&token); err != nil {
+			log.Printf("Error issuing lobby token: %v", err)
+			http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(token)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// LobbyTokenStatusHandler moves a token on (PUT {"id": 12, "status":
+// "called|served|abandoned", "order_id": "..."}); order_id links the ticket
+// booked while serving the customer.
+func LobbyTokenStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "PUT" {
+		http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ID      int64  `json:"id"`
+		Status  string `json:"status"`
+		OrderID string `json:"order_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.ID <= 0 {
+		fieldErrors.Add("id", "is required")
+	}
+	switch request.Status {
+	case LobbyCalled, LobbyServed, LobbyAbandoned:
+	default:
+		fieldErrors.Add("status", "must be one of called, served, abandoned")
+	}
+	if request.OrderID != "" && request.Status != LobbyServed {
+		fieldErrors.Add("order_id", "can only be given when serving a token")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := lobbyService.Advance(request.ID, request.Status, request.OrderID, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err == errLobbyTokenClosed {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating lobby token %d: %v", request.ID, err)
+		http.Error(w, "Failed to update token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Token updated successfully",
+	})
+}
+
+// ReportLobbyHandler serves GET /api/v1/reports/lobby?from=&to=: walk-in
+// waits, abandonment and arrivals by weekday and hour.
+func ReportLobbyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, err := reportService.LobbyReport(period)
+	if err != nil {
+		log.Printf("Error building lobby report: %v", err)
+		http.Error(w, "Failed to build lobby report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receipts, invoices and customer messages show money, numbers and dates the
+// way the shop's customers read them: ₹1,23,456.00 with lakh grouping in
+// India, 123,456.00 elsewhere. Each location runs with its own LOCALE (and
+// optionally CURRENCY_SYMBOL); amounts stay in Money everywhere else and are
+// only formatted at the edge.
+
+// Locale describes how one market writes numbers and dates.
+type Locale struct {
+	Tag            string `json:"tag"`
+	CurrencySymbol string `json:"currency_symbol"`
+	SymbolAfter    bool   `json:"symbol_after,omitempty"` // 1.234,50 € rather than €1.234,50
+	DecimalSep     string `json:"decimal_separator"`
+	GroupSep       string `json:"group_separator"`
+	IndianGrouping bool   `json:"indian_grouping,omitempty"` // 1,23,45,678: thousands, then groups of two
+	DateLayout     string `json:"date_layout"`
+	DateTimeLayout string `json:"datetime_layout"`
+}
+
+// locales are the supported presets, selected with LOCALE.
+var locales = map[string]Locale{
+	"en-IN": {Tag: "en-IN", CurrencySymbol: "₹", DecimalSep: ".", GroupSep: ",", IndianGrouping: true,
+		DateLayout: "02/01/2006", DateTimeLayout: "02/01/2006 03:04 PM"},
+	"en-US": {Tag: "en-US", CurrencySymbol: "$", DecimalSep: ".", GroupSep: ",",
+		DateLayout: "01/02/2006", DateTimeLayout: "01/02/2006 03:04 PM"},
+	"en-GB": {Tag: "en-GB", CurrencySymbol: "£", DecimalSep: ".", GroupSep: ",",
+		DateLayout: "02/01/2006", DateTimeLayout: "02/01/2006 15:04"},
+	"de-DE": {Tag: "de-DE", CurrencySymbol: "€", SymbolAfter: true, DecimalSep: ",", GroupSep: ".",
+		DateLayout: "02.01.2006", DateTimeLayout: "02.01.2006 15:04"},
+}
+
+// getLocaleConfig returns the location's locale (default en-IN), with the
+// currency symbol overridden by CURRENCY_SYMBOL when set.
+func getLocaleConfig() (Locale, error) {
+	tag := getEnv("LOCALE", "en-IN")
+	locale, ok := locales[tag]
+	if !ok {
+		return Locale{}, fmt.Errorf("unsupported LOCALE %q", tag)
+	}
+	if symbol := getEnv("CURRENCY_SYMBOL", ""); symbol != "" {
+		locale.CurrencySymbol = symbol
+	}
+	return locale, nil
+}
+
+var shopLocale = locales["en-IN"]
+
+// group inserts the group separator into a string of digits.
+func (l Locale) group(digits string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+
+	head, tail := digits[:len(digits)-3], digits[len(digits)-3:]
+	size := 3
+	if l.IndianGrouping {
+		size = 2
+	}
+	var parts []string
+	for len(head) > size {
+		parts = append([]string{head[len(head)-size:]}, parts...)
+		head = head[:len(head)-size]
+	}
+	parts = append([]string{head}, parts...)
+	return strings.Join(append(parts, tail), l.GroupSep)
+}
+
+// FormatNumber writes a whole number with grouping, e.g. 1,23,456.
+func (l Locale) FormatNumber(n int64) string {
+	if n < 0 {
+		return "-" + l.group(strconv.FormatInt(-n, 10))
+	}
+	return l.group(strconv.FormatInt(n, 10))
+}
+
+// FormatAmount writes Money with grouping and the locale's decimal
+// separator but no currency symbol, e.g. 1,23,456.00.
+func (l Locale) FormatAmount(m Money) string {
+	value := int64(m)
+	sign := ""
+	if value < 0 {
+		sign, value = "-", -value
+	}
+	return fmt.Sprintf("%s%s%s%02d", sign, l.group(strconv.FormatInt(value/100, 10)), l.DecimalSep, value%100)
+}
+
+// FormatMoney writes Money with the currency symbol, e.g. ₹1,23,456.00.
+func (l Locale) FormatMoney(m Money) string {
+	amount := l.FormatAmount(m)
+	if l.SymbolAfter {
+		return amount + " " + l.CurrencySymbol
+	}
+	if strings.HasPrefix(amount, "-") {
+		return "-" + l.CurrencySymbol + amount[1:]
+	}
+	return l.CurrencySymbol + amount
+}
+
+func (l Locale) FormatDate(t time.Time) string {
+	return t.Format(l.DateLayout)
+}
+
+func (l Locale) FormatDateTime(t time.Time) string {
+	return t.Format(l.DateTimeLayout)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Stock received with a supplier lot (batch) number is counted per lot in
+// part_lots. Stock leaving for a ticket, a build or the scrap bin is taken
+// from the lot named, or else from the oldest lots first, and each lot's
+// share is its own stock movement carrying the lot. The movements against a
+// ticket therefore say which lots went into it: the list of tickets per lot
+// backs vendor quality disputes, and recalls (recalls.go) can select by lot.
+// Stock received before lots were recorded, or without one, leaves untracked.
+
+const partLotsTable = `
+	CREATE TABLE IF NOT EXISTS part_lots (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		part_sku VARCHAR(64) NOT NULL,
+		lot VARCHAR(100) NOT NULL,
+		supplier VARCHAR(255) NULL,
+		reference VARCHAR(255) NULL,
+		quantity_received INT NOT NULL DEFAULT 0,
+		quantity_remaining INT NOT NULL DEFAULT 0,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uniq_part_lot (part_sku, lot),
+		FOREIGN KEY (part_sku) REFERENCES parts(sku)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+var errLotInsufficient = errors.New("not enough of this lot in stock")
+
+// PartLot is one supplier lot of a part.
+type PartLot struct {
+	PartSKU           string    `json:"part_sku"`
+	Lot               string    `json:"lot"`
+	Supplier          string    `json:"supplier,omitempty"`
+	Reference         string    `json:"reference,omitempty"` // Invoice it was first received on
+	QuantityReceived  int       `json:"quantity_received"`
+	QuantityRemaining int       `json:"quantity_remaining"`
+	ReceivedAt        time.Time `json:"received_at"`
+}
+
+// LotTicket is a ticket that received parts of a lot.
+type LotTicket struct {
+	OrderID      string    `json:"order_id"`
+	Reason       string    `json:"reason"` // consumed or build
+	Quantity     int       `json:"quantity"`
+	CustomerName string    `json:"customer_name"`
+	Status       string    `json:"status"`
+	FittedAt     time.Time `json:"fitted_at"`
+}
+
+// receiveLot adds received stock to its lot.
+func receiveLot(tx *sql.Tx, receipt *PartReceipt) error {
+	_, err := tx.Exec(`
+		INSERT INTO part_lots (part_sku, lot, supplier, reference, quantity_received, quantity_remaining)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE quantity_received = quantity_received + VALUES(quantity_received),
+		                        quantity_remaining = quantity_remaining + VALUES(quantity_remaining)
+	`, receipt.PartSKU, receipt.Lot, nullString(receipt.Supplier), nullString(receipt.Reference), receipt.Quantity, receipt.Quantity)
+	return err
+}
+
+// takeFromLots records stock leaving as movement (a negative quantity),
+// split into one movement per lot it came from. The stock comes from lot
+// when one is named, else from the oldest lots with stock left; whatever
+// the lots do not cover leaves untracked. It returns the lot when all the
+// stock came from a single one.
+func takeFromLots(tx *sql.Tx, movement StockMovement, lot string) (string, error) {
+	quantity := -movement.Quantity
+	if lot != "" {
+		result, err := tx.Exec(`
+			UPDATE part_lots SET quantity_remaining = quantity_remaining - ?
+			WHERE part_sku = ? AND lot = ? AND quantity_remaining >= ?
+		`, quantity, movement.PartSKU, lot, quantity)
+		if err != nil {
+			return "", err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return "", errLotInsufficient
+		}
+		movement.Lot = lot
+		return lot, recordStockMovement(tx, movement)
+	}
+
+	type share struct {
+		lot      string
+		quantity int
+	}
+	rows, err := tx.Query(`
+		SELECT lot, quantity_remaining FROM part_lots
+		WHERE part_sku = ? AND quantity_remaining > 0 ORDER BY received_at, id FOR UPDATE
+	`, movement.PartSKU)
+	if err != nil {
+		return "", err
+	}
+	var shares []share
+	for rows.Next() && quantity > 0 {
+		var s share
+		if err := rows.Scan(&s.lot, &s.quantity); err != nil {
+			rows.Close()
+			return "", err
+		}
+		s.quantity = min(s.quantity, quantity)
+		quantity -= s.quantity
+		shares = append(shares, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if quantity > 0 {
+		shares = append(shares, share{quantity: quantity})
+	}
+
+	for _, s := range shares {
+		if s.lot != "" {
+			if _, err := tx.Exec(`UPDATE part_lots SET quantity_remaining = quantity_remaining - ? WHERE part_sku = ? AND lot = ?`,
+				s.quantity, movement.PartSKU, s.lot); err != nil {
+				return "", err
+			}
+		}
+		slice := movement
+		slice.Quantity, slice.Lot = -s.quantity, s.lot
+		if err := recordStockMovement(tx, slice); err != nil {
+			return "", err
+		}
+	}
+	if len(shares) == 1 {
+		return shares[0].lot, nil
+	}
+	return "", nil
+}
+
+// Lots returns a part's lots, newest first.
+func (ps *PartService) Lots(sku string) ([]PartLot, error) {
+	rows, err := ps.db.Query(`
+		SELECT part_sku, lot, supplier, reference, quantity_received, quantity_remaining, received_at
+		FROM part_lots WHERE part_sku = ? ORDER BY received_at DESC, id DESC
+	`, sku)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lots := []PartLot{}
+	for rows.Next() {
+		var lot PartLot
+		var supplier, reference sql.NullString
+		if err := rows.Scan(&lot.PartSKU, &lot.Lot, &supplier, &reference, &lot.QuantityReceived, &lot.QuantityRemaining,
+			&lot.ReceivedAt); err != nil {
+			return nil, err
+		}
+		lot.Supplier, lot.Reference = supplier.String, reference.String
+		lots = append(lots, lot)
+	}
+	return lots, rows.Err()
+}
+
+// LotTickets returns the tickets that received parts of a lot.
+func (ps *PartService) LotTickets(sku, lot string) ([]LotTicket, error) {
+	rows, err := ps.db.Query(`
+		SELECT m.order_id, m.reason, -SUM(m.quantity), o.customer_name, o.status, MIN(m.created_at)
+		FROM stock_movements m JOIN orders o ON o.id = m.order_id
+		WHERE m.part_sku = ? AND m.lot = ? AND m.reason IN (?, ?)
+		GROUP BY m.order_id, m.reason, o.customer_name, o.status
+		ORDER BY MIN(m.created_at), m.order_id
+	`, sku, lot, MovementConsumed, MovementBuild)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []LotTicket{}
+	for rows.Next() {
+		var ticket LotTicket
+		if err := rows.Scan(&ticket.OrderID, &ticket.Reason, &ticket.Quantity, &ticket.CustomerName, &ticket.Status,
+			&ticket.FittedAt); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
+
+// PartLotsHandler lists a part's lots (GET ?sku=), or the tickets the parts
+// of one lot went into (GET ?sku=&lot=).
+func PartLotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sku, lot := r.URL.Query().Get("sku"), r.URL.Query().Get("lot")
+	if sku == "" {
+		http.Error(w, "sku is required", http.StatusBadRequest)
+		return
+	}
+	if lot != "" {
+		tickets, err := partService.LotTickets(sku, lot)
+		if err != nil {
+			log.Printf("Error listing tickets of lot %s of %s: %v", lot, sku, err)
+			http.Error(w, "Failed to retrieve lot tickets", http.StatusInternalServerError)
+			return
+		}
+		piiPolicyFor(r).shapeLotTickets(tickets)
+		json.NewEncoder(w).Encode(tickets)
+		return
+	}
+
+	lots, err := partService.Lots(sku)
+	if err != nil {
+		log.Printf("Error listing lots of %s: %v", sku, err)
+		http.Error(w, "Failed to retrieve lots", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(lots)
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"golang.org/x/sync/errgroup"
 )
 
 // --- Domain Models (structs) ---
@@ -21,135 +27,419 @@ type Order struct {
 	CustomerEmail    string    `json:"customer_email" db:"customer_email"`
 	CustomerPhone    string    `json:"customer_phone" db:"customer_phone"`
 	DeviceType       string    `json:"device_type" db:"device_type"`
-	DeviceModel      string    `json:"device_model" db:"device_model"`
+	DeviceModel      string    `json:"device_model,omitempty" db:"device_model"`
+	DeviceSerial     string    `json:"device_serial,omitempty" db:"device_serial"`
+	Devices          []OrderDevice `json:"devices" db:"-"` // Every device on the ticket, primary first (devices.go)
+	Tags             []string  `json:"tags" db:"-"` // Free-form labels such as "rush" (tags.go)
+	CustomFields     CustomFieldValues `json:"custom_fields" db:"-"` // Shop-defined ticket fields (customfields.go)
 	Services         []string  `json:"services" db:"services"` // Will be JSON in DB
-	IssueDescription string    `json:"issue_description" db:"issue_description"`
+	IssueDescription string    `json:"issue_description,omitempty" db:"issue_description"`
 	Status           string    `json:"status" db:"status"`
-	TotalCost        float64   `json:"total_cost" db:"total_cost"`
-	CreatedBy        string    `json:"created_by" db:"created_by"`
+	Priority         string    `json:"priority" db:"priority"` // Low, Normal, High or Urgent (priority.go)
+	TotalCost        Money     `json:"total_cost" db:"total_cost"`
+	AmountPaid       Money     `json:"amount_paid" db:"amount_paid"`
+	CreatedBy        string    `json:"created_by,omitempty" db:"created_by"`
 	CreatedAt        time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
-	LastUpdatedBy    string    `json:"last_updated_by" db:"last_updated_by"`
+	LastUpdatedBy    string    `json:"last_updated_by,omitempty" db:"last_updated_by"`
+
+	// Nullable columns: absent from JSON until set
+	AssignedEngineerID   string     `json:"assigned_engineer_id,omitempty" db:"assigned_engineer_id"`
+	ExpectedDeliveryDate *time.Time `json:"expected_delivery_date,omitempty" db:"expected_delivery_date"`
+	WarrantyExpDate      *time.Time `json:"warranty_exp_date,omitempty" db:"warranty_exp_date"`
+	WarrantyClaimOf      string     `json:"warranty_claim_of,omitempty" db:"warranty_claim_of"` // Original order whose repair warranty covers this one
+	DataBackupConsent    string     `json:"data_backup_consent,omitempty" db:"data_backup_consent"`
+	TicketType           string     `json:"ticket_type,omitempty" db:"ticket_type"`
+	DevicePassword       string     `json:"device_password,omitempty" db:"device_password"` // Kept out of ticket events; masked by role
+	Identity             *TicketIdentity `json:"identity,omitempty" db:"-"` // ID shown at intake; kept out of ticket events
+	TheftChecks          []*TheftCheck `json:"-" db:"-"` // Registry checks made at intake, one per device serial
+	DeletedAt            *time.Time `json:"deleted_at,omitempty" db:"deleted_at"` // Set when the ticket is cancelled
+	CancelReason         string     `json:"cancel_reason,omitempty" db:"cancel_reason"`
+	SLADueAt             *time.Time `json:"sla_due_at,omitempty" db:"sla_due_at"` // When the ticket type's SLA runs out (sla.go)
+	SLABreachedAt        *time.Time `json:"sla_breached_at,omitempty" db:"sla_breached_at"`
+	IsOverdue            bool       `json:"is_overdue" db:"-"` // Past its SLA with the clock still running
+	HoldState            string     `json:"hold_state,omitempty" db:"hold_state"` // Awaiting Parts or Awaiting Customer Approval (holds.go)
+	HoldReason           string     `json:"hold_reason,omitempty" db:"hold_reason"`
+	HoldStartedAt        *time.Time `json:"hold_started_at,omitempty" db:"hold_started_at"`
+	MergedInto           string     `json:"merged_into,omitempty" db:"merged_into"` // Ticket this duplicate was merged into (merge.go)
+	SplitFrom            string     `json:"split_from,omitempty" db:"split_from"` // Ticket this one was split off
+	ParentTicketID       string     `json:"parent_ticket_id,omitempty" db:"parent_ticket_id"` // Collected ticket this rework ticket returns to (rework.go)
+	AccountID            int64      `json:"account_id,omitempty" db:"account_id"` // Corporate account the ticket is billed under (accounts.go)
 }
 
-// OrderService handles order database operations
+// OrderService handles order database operations. Writes go through the
+// ticket event store, which projects them onto the orders table.
 type OrderService struct {
-	db *sql.DB
+	db     *sql.DB
+	events *EventStore
 }
 
 func NewOrderService(database *sql.DB) *OrderService {
-	return &OrderService{db: database}
+	return &OrderService{db: database, events: NewEventStore(database)}
 }
 
 func (os *OrderService) CreateOrder(order *Order) error {
-	servicesJSON, err := json.Marshal(order.Services)
+	tx, err := os.db.Begin()
 	if err != nil {
 		return err
 	}
-	
-	query := `
-		INSERT INTO orders (id, customer_name, customer_email, customer_phone, device_type, 
-		                   device_model, services, issue_description, status, total_cost, 
-		                   created_by, created_at, updated_at, last_updated_by)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW(), ?)
-	`
-	
-	_, err = os.db.Exec(query, order.ID, order.CustomerName, order.CustomerEmail, 
-		order.CustomerPhone, order.DeviceType, order.DeviceModel, string(servicesJSON),
-		order.IssueDescription, order.Status, order.TotalCost, order.CreatedBy, order.CreatedBy)
-	
-	return err
+	defer tx.Rollback()
+
+	if err := os.createOrder(tx, order); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (os *OrderService) GetAllOrders() ([]Order, error) {
-	query := `
-		SELECT id, customer_name, customer_email, customer_phone, device_type, device_model,
-		       services, issue_description, status, total_cost, created_by, created_at, 
-		       updated_at, COALESCE(last_updated_by, created_by)
-		FROM orders ORDER BY created_at DESC
-	`
-	
-	rows, err := os.db.Query(query)
+// createOrder records a new ticket within tx.
+func (os *OrderService) createOrder(tx *sql.Tx, order *Order) error {
+	// The device password never enters the event stream or outbox
+	snapshot := *order
+	snapshot.DevicePassword = ""
+	snapshot.Identity = nil
+	snapshot.HoldState, snapshot.HoldReason = "", ""
+	snapshot.Tags = nil
+	if _, err := os.events.Append(tx, order.ID, EventTicketCreated, order.CreatedBy, snapshot); err != nil {
+		return err
+	}
+	if order.HoldState != "" {
+		if err := holdIfOpen(tx, order.ID, order.HoldState, order.HoldReason, order.CreatedBy); err != nil {
+			return err
+		}
+	}
+	if order.DevicePassword != "" {
+		if _, err := tx.Exec(`UPDATE orders SET device_password = ? WHERE id = ?`, order.DevicePassword, order.ID); err != nil {
+			return err
+		}
+	}
+	if order.Identity != nil {
+		if err := insertTicketIdentity(tx, order); err != nil {
+			return err
+		}
+	}
+	for _, check := range order.TheftChecks {
+		if err := insertTheftCheck(tx, order.ID, check); err != nil {
+			return err
+		}
+	}
+	if err := insertTicketTags(tx, order.ID, order.Tags, order.CreatedBy); err != nil {
+		return err
+	}
+
+	// Keep in-flight online migrations in sync with the new row
+	return migrationService.DualWrite(tx, "orders", order.ID)
+}
+
+// lockOrderStatus locks an order row for the rest of tx and returns its status.
+func (os *OrderService) lockOrderStatus(tx *sql.Tx, orderID string) (string, error) {
+	var status string
+	err := tx.QueryRow(`SELECT status FROM orders WHERE id = ? FOR UPDATE`, orderID).Scan(&status)
+	return status, err
+}
+
+// AddItem appends an ItemAdded event to the order.
+func (os *OrderService) AddItem(orderID string, item ItemAddedPayload, actorID string) error {
+	return os.appendOrderEvent(orderID, EventItemAdded, actorID, item)
+}
+
+// RecordPayment appends a PaymentRecorded event to the order and releases a
+// hold awaiting payment.
+func (os *OrderService) RecordPayment(orderID string, payment PaymentRecordedPayload, actorID string) error {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := os.lockOrderStatus(tx, orderID); err != nil {
+		return err
+	}
+	if _, err := os.events.Append(tx, orderID, EventPaymentRecorded, actorID, payment); err != nil {
+		return err
+	}
+	if err := releaseHold(tx, orderID, HoldAwaitingPayment, actorID); err != nil {
+		return err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (os *OrderService) appendOrderEvent(orderID, eventType, actorID string, payload interface{}) error {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := os.lockOrderStatus(tx, orderID); err != nil {
+		return err
+	}
+
+	if _, err := os.events.Append(tx, orderID, eventType, actorID, payload); err != nil {
+		return err
+	}
+
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// orderColumns is the column list scanned by scanOrder.
+const orderColumns = `
+		id, customer_name, customer_email, customer_phone, device_type, device_model,
+		services, issue_description, status, total_cost, amount_paid, created_by, created_at,
+		updated_at, COALESCE(last_updated_by, created_by), device_serial, assigned_engineer_id,
+		expected_delivery_date, warranty_exp_date, warranty_claim_of, data_backup_consent, ticket_type, device_password,
+		deleted_at, cancel_reason, priority, sla_due_at, sla_breached_at, hold_state, hold_reason, hold_started_at, merged_into, split_from, parent_ticket_id, account_id`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanOrder reads one orders row selected with orderColumns. Nullable
+// columns go through sql.Null* so a NULL never aborts the scan.
+func scanOrder(row rowScanner) (*Order, error) {
+	var order Order
+	var servicesJSON string
+	var deviceModel, issueDescription, createdBy, lastUpdatedBy, deviceSerial, assignedEngineerID, warrantyClaimOf, dataBackupConsent, ticketType, devicePassword, cancelReason, holdState, holdReason, mergedInto, splitFrom, parentTicketID sql.NullString
+	var expectedDeliveryDate, warrantyExpDate, deletedAt, slaDueAt, slaBreachedAt, holdStartedAt sql.NullTime
+	var accountID sql.NullInt64
+
+	err := row.Scan(&order.ID, &order.CustomerName, &order.CustomerEmail,
+		&order.CustomerPhone, &order.DeviceType, &deviceModel,
+		&servicesJSON, &issueDescription, &order.Status, &order.TotalCost, &order.AmountPaid,
+		&createdBy, &order.CreatedAt, &order.UpdatedAt, &lastUpdatedBy, &deviceSerial,
+		&assignedEngineerID, &expectedDeliveryDate, &warrantyExpDate, &warrantyClaimOf, &dataBackupConsent, &ticketType, &devicePassword,
+		&deletedAt, &cancelReason, &order.Priority, &slaDueAt, &slaBreachedAt, &holdState, &holdReason, &holdStartedAt, &mergedInto, &splitFrom, &parentTicketID, &accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	order.DeviceModel = deviceModel.String
+	order.IssueDescription = issueDescription.String
+	order.CreatedBy = createdBy.String
+	order.LastUpdatedBy = lastUpdatedBy.String
+	order.DeviceSerial = deviceSerial.String
+	order.AssignedEngineerID = assignedEngineerID.String
+	order.ExpectedDeliveryDate = timePtr(expectedDeliveryDate)
+	order.WarrantyExpDate = timePtr(warrantyExpDate)
+	order.WarrantyClaimOf = warrantyClaimOf.String
+	order.DataBackupConsent = dataBackupConsent.String
+	order.TicketType = ticketType.String
+	order.DevicePassword = devicePassword.String
+	order.DeletedAt = timePtr(deletedAt)
+	order.CancelReason = cancelReason.String
+	order.SLADueAt = timePtr(slaDueAt)
+	order.SLABreachedAt = timePtr(slaBreachedAt)
+	order.HoldState = holdState.String
+	order.HoldReason = holdReason.String
+	order.HoldStartedAt = timePtr(holdStartedAt)
+	order.MergedInto = mergedInto.String
+	order.SplitFrom = splitFrom.String
+	order.ParentTicketID = parentTicketID.String
+	order.AccountID = accountID.Int64
+	order.IsOverdue = isOverdue(&order, time.Now())
+
+	// Parse services JSON
+	if err := json.Unmarshal([]byte(servicesJSON), &order.Services); err != nil {
+		return nil, err
+	}
+
+	return &order, nil
+}
+
+// inListBatch is how many IDs one IN (...) lookup binds, so the details
+// loaded for a long order list come in a few bounded queries rather than
+// one with a placeholder per order.
+const inListBatch = 500
+
+// forEachIDBatch calls fn for ids in batches of inListBatch with the
+// batch's placeholders and arguments.
+func forEachIDBatch(ids []string, fn func(placeholders string, args []interface{}) error) error {
+	for start := 0; start < len(ids); start += inListBatch {
+		batch := ids[start:min(start+inListBatch, len(ids))]
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		if err := fn(strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", "), args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryOrders runs a SELECT over orderColumns and scans every row.
+func (os *OrderService) queryOrders(query string, args ...interface{}) ([]Order, error) {
+	rows, err := os.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	
-	var orders []Order
+	orders := []Order{}
 	for rows.Next() {
-		var order Order
-		var servicesJSON string
-		
-		err := rows.Scan(&order.ID, &order.CustomerName, &order.CustomerEmail,
-			&order.CustomerPhone, &order.DeviceType, &order.DeviceModel,
-			&servicesJSON, &order.IssueDescription, &order.Status, &order.TotalCost,
-			&order.CreatedBy, &order.CreatedAt, &order.UpdatedAt, &order.LastUpdatedBy)
-		
+		order, err := scanOrder(rows)
 		if err != nil {
 			return nil, err
 		}
-		
-		// Parse services JSON
-		if err := json.Unmarshal([]byte(servicesJSON), &order.Services); err != nil {
-			return nil, err
-		}
-		
-		orders = append(orders, order)
+		orders = append(orders, *order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 	
-	return orders, nil
+	if err := os.loadDevices(orders); err != nil {
+		return nil, err
+	}
+	if err := os.loadTags(orders); err != nil {
+		return nil, err
+	}
+	return orders, os.loadCustomFields(orders)
 }
 
-func (os *OrderService) UpdateOrderStatus(orderID, status, updatedBy string) error {
-	query := `UPDATE orders SET status = ?, updated_at = NOW(), last_updated_by = ? WHERE id = ?`
-	_, err := os.db.Exec(query, status, updatedBy, orderID)
-	return err
+// GetAllOrders returns every order matching filter, in its sort order.
+// Cancelled orders are left out unless includeCancelled is set.
+func (os *OrderService) GetAllOrders(includeCancelled bool, filter OrderListFilter) ([]Order, error) {
+	where := ` WHERE deleted_at IS NULL`
+	if includeCancelled {
+		where = ` WHERE TRUE`
+	}
+	priorityWhere, args := filter.where()
+	return os.queryOrders(`SELECT `+orderColumns+` FROM orders`+where+priorityWhere+` ORDER BY `+orderSorts[filter.Sort], args...)
 }
 
-func (os *OrderService) GetOrdersByStatus(status string) ([]Order, error) {
-	query := `
-		SELECT id, customer_name, customer_email, customer_phone, device_type, device_model,
-		       services, issue_description, status, total_cost, created_by, created_at, 
-		       updated_at, COALESCE(last_updated_by, created_by)
-		FROM orders WHERE status = ? ORDER BY created_at DESC
-	`
-	
-	rows, err := os.db.Query(query, status)
+// StatusGuardError reports a status change refused by a workflow rule.
+type StatusGuardError struct {
+	Reason string
+}
+
+func (e *StatusGuardError) Error() string {
+	return "status change blocked: " + e.Reason
+}
+
+// statusGuards run inside the status change transaction with the order row
+// locked. Returning a *StatusGuardError refuses the change.
+var statusGuards = []func(tx *sql.Tx, orderID, from, to string) error{
+	cancelledStatusGuard,
+	backupStatusGuard,
+	onHoldStatusGuard,
+}
+
+// UpdateOrderStatus moves an order to status and returns the status it had
+// before.
+func (os *OrderService) UpdateOrderStatus(orderID, status, updatedBy string) (string, error) {
+	tx, err := os.db.Begin()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer rows.Close()
-	
-	var orders []Order
-	for rows.Next() {
-		var order Order
-		var servicesJSON string
-		
-		err := rows.Scan(&order.ID, &order.CustomerName, &order.CustomerEmail,
-			&order.CustomerPhone, &order.DeviceType, &order.DeviceModel,
-			&servicesJSON, &order.IssueDescription, &order.Status, &order.TotalCost,
-			&order.CreatedBy, &order.CreatedAt, &order.UpdatedAt, &order.LastUpdatedBy)
-		
-		if err != nil {
-			return nil, err
+	defer tx.Rollback()
+
+	current, err := os.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.changeStatus(tx, orderID, current, status, updatedBy); err != nil {
+		return "", err
+	}
+
+	return current, tx.Commit()
+}
+
+// changeStatus moves an order locked by lockOrderStatus from current to
+// status inside tx, running the status guards.
+func (os *OrderService) changeStatus(tx *sql.Tx, orderID, current, status, updatedBy string) error {
+	for _, guard := range statusGuards {
+		if err := guard(tx, orderID, current, status); err != nil {
+			return err
 		}
-		
-		// Parse services JSON
-		if err := json.Unmarshal([]byte(servicesJSON), &order.Services); err != nil {
-			return nil, err
+	}
+
+	payload := StatusChangedPayload{From: current, To: status}
+	if _, err := os.events.Append(tx, orderID, EventStatusChanged, updatedBy, payload); err != nil {
+		return err
+	}
+
+	// The ticket's place on the board belonged to its old column
+	if current != status {
+		if _, err := tx.Exec(`UPDATE orders SET board_position = NULL, updated_at = updated_at WHERE id = ?`, orderID); err != nil {
+			return err
 		}
-		
-		orders = append(orders, order)
 	}
-	
-	return orders, nil
+
+	return migrationService.DualWrite(tx, "orders", orderID)
+}
+
+func (os *OrderService) GetOrder(orderID string) (*Order, error) {
+	order, err := scanOrder(os.db.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE id = ?`, orderID))
+	if err != nil {
+		return nil, err
+	}
+	orders := []Order{*order}
+	if err := os.loadDevices(orders); err != nil {
+		return nil, err
+	}
+	if err := os.loadTags(orders); err != nil {
+		return nil, err
+	}
+	if err := os.loadCustomFields(orders); err != nil {
+		return nil, err
+	}
+	return &orders[0], nil
+}
+
+// orderStatuses are the ticket workflow statuses in order.
+var orderStatuses = []string{"New Order", "In Progress", "Ready for Delivery", "Collected"}
+
+// GetOrdersByStatus returns one page of the orders in any of statuses that
+// match filter, in its sort order, and the number of matching orders on all
+// pages. Cancelled orders are left out unless includeCancelled is set.
+func (os *OrderService) GetOrdersByStatus(statuses []string, includeCancelled bool, filter OrderListFilter, page, pageSize int) ([]Order, int, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(statuses)), ", ")
+	where := `status IN (` + placeholders + `)`
+	if !includeCancelled {
+		where += ` AND deleted_at IS NULL`
+	}
+	args := make([]interface{}, 0, len(statuses)+2)
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+	priorityWhere, priorityArgs := filter.where()
+	where += priorityWhere
+	args = append(args, priorityArgs...)
+
+	var total int
+	if err := os.db.QueryRow(`SELECT COUNT(*) FROM orders WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	orders, err := os.queryOrders(`SELECT `+orderColumns+` FROM orders WHERE `+where+`
+		ORDER BY `+orderSorts[filter.Sort]+` LIMIT ? OFFSET ?`, append(args, pageSize, (page-1)*pageSize)...)
+	return orders, total, err
 }
 
 // DashboardMetrics holds the aggregated data for the operational dashboard.
 type DashboardMetrics struct {
 	TotalOpenOrders    int `json:"total_open_orders"`
 	ReadyForDelivery   int `json:"ready_for_delivery"`
-	TotalRevenueYTD    float64 `json:"total_revenue_ytd"`
+	OpenByPriority     PriorityCounts `json:"open_by_priority"`
+	SLABreached        int `json:"sla_breached"` // Open tickets past their SLA
+	OnHold             int `json:"on_hold"` // Open tickets on hold (holds.go)
+	TotalRevenueYTD    *Money `json:"total_revenue_ytd,omitempty"` // Only for roles allowed to see revenue
+	Partial            bool              `json:"partial,omitempty"` // Set when some metrics could not be computed
+	Errors             map[string]string `json:"errors,omitempty"`
+}
+
+// dashboardQuery computes one dashboard metric into dest.
+type dashboardQuery struct {
+	name  string
+	query string
+	dest  interface{}
 }
 
 // --- Global Database Connection ---
@@ -220,7 +510,7 @@ func createTables() {
 		email VARCHAR(255) UNIQUE NOT NULL,
 		phone VARCHAR(20) NOT NULL,
 		password VARCHAR(255) NOT NULL,
-		role VARCHAR(50) DEFAULT 'User',
+		role VARCHAR(50) DEFAULT 'FrontDesk',
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 		INDEX idx_email (email),
@@ -238,7 +528,7 @@ func createTables() {
 		device_model VARCHAR(255),
 		services JSON NOT NULL,
 		issue_description TEXT,
-		status ENUM('New Order', 'In Progress', 'Ready for Delivery', 'Collected') DEFAULT 'New Order',
+		status ENUM('New Order', 'In Progress', 'Ready for Delivery', 'Collected', 'Cancelled', 'Reopened') DEFAULT 'New Order',
 		total_cost DECIMAL(10,2) NOT NULL,
 		created_by VARCHAR(50),
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -259,6 +549,8 @@ func createTables() {
 	if _, err := db.Exec(ordersTable); err != nil {
 		log.Fatalf("Failed to create orders table: %v", err)
 	}
+
+	createSubsystemTables()
 	
 	log.Println("Database tables created/verified successfully.")
 }
@@ -271,41 +563,73 @@ type User struct {
 	FullName  string    `json:"full_name" db:"full_name"`
 	Email     string    `json:"email" db:"email"`
 	Phone     string    `json:"phone" db:"phone"`
-	Password  string    `json:"password" db:"password"` // In production, this would be hashed
+	Password  string    `json:"password" db:"password"` // bcrypt hash once stored
 	Role      string    `json:"role" db:"role"`
+	Approved  bool      `json:"approved" db:"approved"` // False for self-registered and SSO-provisioned accounts until an admin approves them
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
 // UserService handles user database operations
 type UserService struct {
-	db *sql.DB
+	db         *sql.DB
+	bcryptCost int
 }
 
 func NewUserService(database *sql.DB) *UserService {
-	return &UserService{db: database}
+	return &UserService{db: database, bcryptCost: getBcryptCost()}
 }
 
+// CreateUser hashes the plaintext password on user and stores the account.
 func (us *UserService) CreateUser(user *User) error {
+	hashedPassword, err := us.HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+
 	query := `
-		INSERT INTO users (id, full_name, email, phone, password, role, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())
+		INSERT INTO users (id, full_name, email, phone, password, role, approved, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
 	`
 	
-	_, err := us.db.Exec(query, user.ID, user.FullName, user.Email, user.Phone, user.Password, user.Role)
-	return err
+	_, err = us.db.Exec(query, user.ID, user.FullName, user.Email, user.Phone, hashedPassword, user.Role, user.Approved)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hashedPassword
+	return nil
 }
 
 func (us *UserService) GetUserByEmail(email string) (*User, error) {
 	user := &User{}
 	query := `
-		SELECT id, full_name, email, phone, password, role, created_at, updated_at
+		SELECT id, full_name, email, phone, password, role, approved, created_at, updated_at
 		FROM users WHERE email = ?
 	`
 	
 	err := us.db.QueryRow(query, email).Scan(
 		&user.ID, &user.FullName, &user.Email, &user.Phone,
-		&user.Password, &user.Role, &user.CreatedAt, &user.UpdatedAt,
+		&user.Password, &user.Role, &user.Approved, &user.CreatedAt, &user.UpdatedAt,
+	)
+	
+	if err != nil {
+		return nil, err
+	}
+	
+	return user, nil
+}
+
+func (us *UserService) GetUserByID(id string) (*User, error) {
+	user := &User{}
+	query := `
+		SELECT id, full_name, email, phone, password, role, approved, created_at, updated_at
+		FROM users WHERE id = ?
+	`
+	
+	err := us.db.QueryRow(query, id).Scan(
+		&user.ID, &user.FullName, &user.Email, &user.Phone,
+		&user.Password, &user.Role, &user.Approved, &user.CreatedAt, &user.UpdatedAt,
 	)
 	
 	if err != nil {
@@ -318,13 +642,13 @@ func (us *UserService) GetUserByEmail(email string) (*User, error) {
 func (us *UserService) GetUserByEmailAndPhone(email, phone string) (*User, error) {
 	user := &User{}
 	query := `
-		SELECT id, full_name, email, phone, password, role, created_at, updated_at
+		SELECT id, full_name, email, phone, password, role, approved, created_at, updated_at
 		FROM users WHERE email = ? AND phone = ?
 	`
 	
 	err := us.db.QueryRow(query, email, phone).Scan(
 		&user.ID, &user.FullName, &user.Email, &user.Phone,
-		&user.Password, &user.Role, &user.CreatedAt, &user.UpdatedAt,
+		&user.Password, &user.Role, &user.Approved, &user.CreatedAt, &user.UpdatedAt,
 	)
 	
 	if err != nil {
@@ -334,9 +658,15 @@ func (us *UserService) GetUserByEmailAndPhone(email, phone string) (*User, error
 	return user, nil
 }
 
+// UpdateUserPassword hashes newPassword and stores it for the user.
 func (us *UserService) UpdateUserPassword(userID, newPassword string) error {
+	hashedPassword, err := us.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
 	query := `UPDATE users SET password = ?, updated_at = NOW() WHERE id = ?`
-	_, err := us.db.Exec(query, newPassword, userID)
+	_, err = us.db.Exec(query, hashedPassword, userID)
 	return err
 }
 
@@ -392,15 +722,13 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set required fields for the new user
+	// Set required fields for the new user. Self-registered accounts can
+	// read customer details once active, so an admin approves them first.
 	newUser.ID = fmt.Sprintf("USER-%d", time.Now().UnixNano())
-	newUser.Role = "User"
-
-	// TODO: Hash the password before storing (use bcrypt)
-	// hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
-	// newUser.Password = string(hashedPassword)
+	newUser.Role = RoleFrontDesk
+	newUser.Approved = false
 
-	// Create user in database
+	// Create user in database (the password is hashed by the service)
 	err = userService.CreateUser(&newUser)
 	if err != nil {
 		log.Printf("Error creating user: %v", err)
@@ -408,10 +736,12 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("User %s registered with email %s.", newUser.ID, newUser.Email)
+	log.Printf("User %s registered with email %s, pending approval.", newUser.ID, newUser.Email)
+	auditService.RecordAs(r, newUser.ID, AuditRegister, "user", newUser.ID, nil,
+		map[string]string{"email": newUser.Email, "role": newUser.Role})
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
-		"message": "User registered successfully", 
+		"message": "User registered successfully; an administrator must approve the account before you can sign in",
 		"user_id": newUser.ID,
 		"email": newUser.Email,
 	})
@@ -443,22 +773,6 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Demo admin account (hardcoded)
-	if loginRequest.Email == "admin@pchub.com" && loginRequest.Password == "admin123" {
-		log.Printf("Admin user %s logged in successfully.", loginRequest.Email)
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message": "Login successful",
-			"user": map[string]string{
-				"email": loginRequest.Email,
-				"name":  "Admin User",
-				"role":  "Administrator",
-			},
-			"token": "demo-jwt-token", // In real app, generate actual JWT
-		})
-		return
-	}
-
 	// Check database for registered users
 	user, err := userService.GetUserByEmail(loginRequest.Email)
 	if err != nil {
@@ -474,16 +788,35 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Use bcrypt to compare hashed password
-	// err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginRequest.Password))
-	// For now, direct comparison (NOT SECURE - use bcrypt in production)
-	if user.Password != loginRequest.Password {
+	// Compare against the bcrypt hash (legacy plaintext passwords are re-hashed here)
+	valid, err := userService.VerifyPassword(user, loginRequest.Password)
+	if err != nil {
+		log.Printf("Error verifying password: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		auditService.RecordAs(r, user.ID, AuditLoginFailed, "user", user.ID, nil, nil)
 		time.Sleep(100 * time.Millisecond) // Prevent timing attacks
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
+	if !user.Approved {
+		http.Error(w, "Your account is waiting for an administrator to approve it", http.StatusForbidden)
+		return
+	}
+
+	tokens, err := startSession(r, user.ID, user.Email, user.Role)
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	log.Printf("User %s logged in successfully.", user.Email)
+	auditService.RecordAs(r, user.ID, AuditLogin, "user", user.ID, nil, nil)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Login successful",
@@ -494,7 +827,10 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			"phone": user.Phone,
 			"role":  user.Role,
 		},
-		"token": "demo-jwt-token", // In real app, generate actual JWT
+		"token":              tokens.Token,
+		"expires_at":         tokens.ExpiresAt,
+		"refresh_token":      tokens.RefreshToken,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
 	})
 }
 
@@ -503,60 +839,101 @@ func GetDashboardMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// --- Concurrency / Scale Feature ---
-	// This function shows how Go handles multiple database queries concurrently
-	// using goroutines, which is crucial for high-speed dashboard loading.
+	// The dashboard queries run concurrently in an errgroup, each bounded by
+	// its own timeout. A failing query does not cancel the others: its metric
+	// is reported as missing and the response is flagged as partial.
+	queryTimeout := getEnvDuration("DASHBOARD_QUERY_TIMEOUT", 2*time.Second)
+
+	var (
+		metrics DashboardMetrics
+		mu      sync.Mutex
+		errs    = map[string]string{}
+	)
 
-	type result struct {
-		Metric string
-		Count  int
-		Value  float64
+	record := func(name string, err error) {
+		if err == nil {
+			return
+		}
+		log.Printf("Dashboard metric %s failed: %v", name, err)
+		mu.Lock()
+		errs[name] = "unavailable"
+		mu.Unlock()
 	}
 
-	results := make(chan result)
-	
-	// Goroutine 1: Get Total Open Orders
-	go func() {
-		// Mocked DB query: SELECT COUNT(*) FROM orders WHERE status NOT IN ('Ready', 'Collected')
-		// In a real app: row := db.QueryRow(query)
-		time.Sleep(10 * time.Millisecond) // Simulate DB latency
-		results <- result{Metric: "OpenOrders", Count: 150} // Mocked result
-	}()
-
-	// Goroutine 2: Get Ready for Delivery Count
-	go func() {
-		// Mocked DB query: SELECT COUNT(*) FROM orders WHERE status = 'Ready for Delivery'
-		time.Sleep(5 * time.Millisecond)
-		results <- result{Metric: "ReadyCount", Count: 35} // Mocked result
-	}()
-
-	// Goroutine 3: Calculate YTD Revenue
-	go func() {
-		// Mocked DB query: SELECT SUM(estimated_cost) FROM orders WHERE status = 'Collected' AND YEAR(created_at) = YEAR(CURDATE())
-		time.Sleep(20 * time.Millisecond)
-		results <- result{Metric: "Revenue", Value: 28550.75} // Mocked result
-	}()
-
-	// Collect results from goroutines
-	metrics := DashboardMetrics{}
-	received := 0
-	for res := range results {
-		switch res.Metric {
-		case "OpenOrders":
-			metrics.TotalOpenOrders = res.Count
-		case "ReadyCount":
-			metrics.ReadyForDelivery = res.Count
-		case "Revenue":
-			metrics.TotalRevenueYTD = res.Value
-		}
-		received++
-		if received == 3 {
-			close(results)
-		}
+	queries := []dashboardQuery{
+		{"total_open_orders", `SELECT COUNT(*) FROM orders WHERE status NOT IN ('Ready for Delivery', 'Collected') AND deleted_at IS NULL`, &metrics.TotalOpenOrders},
+		{"ready_for_delivery", `SELECT COUNT(*) FROM orders WHERE status = 'Ready for Delivery' AND deleted_at IS NULL`, &metrics.ReadyForDelivery},
+		{"sla_breached", `SELECT COUNT(*) FROM orders WHERE sla_breached_at IS NOT NULL AND ` + slaOpenClause, &metrics.SLABreached},
+		{"on_hold", `SELECT COUNT(*) FROM orders WHERE hold_state IS NOT NULL AND deleted_at IS NULL`, &metrics.OnHold},
+	}
+	for _, priority := range orderPriorities {
+		queries = append(queries, dashboardQuery{"open_" + strings.ToLower(priority), `SELECT COUNT(*) FROM orders WHERE status NOT IN ('Ready for Delivery', 'Collected') AND deleted_at IS NULL AND priority = '` + priority + `'`, metrics.OpenByPriority.dest(priority)})
+	}
+	if hasPermission(r, PermReportsViewRevenue) {
+		metrics.TotalRevenueYTD = new(Money)
+		queries = append(queries, dashboardQuery{"total_revenue_ytd", `SELECT COALESCE(SUM(total_cost), 0) FROM orders WHERE status = 'Collected' AND deleted_at IS NULL AND YEAR(created_at) = YEAR(CURDATE())`, metrics.TotalRevenueYTD})
+	}
+
+	g, ctx := errgroup.WithContext(r.Context())
+	for _, q := range queries {
+		q := q
+		g.Go(func() error {
+			qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+			defer cancel()
+
+			// Each goroutine writes only its own field, so no lock is needed here
+			record(q.name, db.QueryRowContext(qctx, q.query).Scan(q.dest))
+			return nil
+		})
+	}
+	g.Wait()
+
+	if len(errs) == len(queries) {
+		http.Error(w, "Failed to retrieve dashboard metrics", http.StatusServiceUnavailable)
+		return
+	}
+	if len(errs) > 0 {
+		metrics.Partial = true
+		metrics.Errors = errs
 	}
 
 	json.NewEncoder(w).Encode(metrics)
 }
 
+// checkIntake runs the checks every ticket goes through when it is booked
+// in, from the intake form or from a quote: its devices, tags and custom
+// fields, the ticket type (nil when the code names none) and its required
+// fields, the assigned engineer's certification, the rework parent, the
+// account and the ID policy. Problems with the ticket are added to
+// fieldErrors; the error is for failed lookups.
+func checkIntake(order *Order, ticketType *TicketType, deviceValue *Money, fieldErrors *ValidationErrors) error {
+	normalizeIntakeDevices(order, fieldErrors)
+	order.Tags = normalizeTags("tags", order.Tags, fieldErrors)
+	if err := checkIntakeCustomFields(order, fieldErrors); err != nil {
+		return fmt.Errorf("custom fields: %w", err)
+	}
+	if ticketType == nil || !ticketType.Active {
+		fieldErrors.Add("ticket_type", "is not an active ticket type")
+	} else {
+		ticketType.checkRequiredFields(order, fieldErrors)
+	}
+	if order.AssignedEngineerID != "" {
+		if err := checkEngineerCertification(db, order.AssignedEngineerID, order.TicketType, "assigned_engineer_id", fieldErrors); err != nil {
+			return fmt.Errorf("certification of %s: %w", order.AssignedEngineerID, err)
+		}
+	}
+	if err := orderService.checkReworkParent(order, fieldErrors); err != nil {
+		return fmt.Errorf("parent ticket %s: %w", order.ParentTicketID, err)
+	}
+	if err := accountService.checkIntakeAccount(order, fieldErrors); err != nil {
+		return fmt.Errorf("account %d: %w", order.AccountID, err)
+	}
+	if err := identityService.checkIntakeIdentity(order, deviceValue, fieldErrors); err != nil {
+		return fmt.Errorf("ID policy: %w", err)
+	}
+	return nil
+}
+
 // CreateOrderHandler handles the submission of a new service order.
 func CreateOrderHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -566,12 +943,20 @@ func CreateOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var newOrder Order
-	err := json.NewDecoder(r.Body).Decode(&newOrder)
+	// Dates arrive as strings so they can be validated with field errors
+	var request struct {
+		Order
+		ExpectedDeliveryDate string `json:"expected_delivery_date"`
+		WarrantyExpDate      string `json:"warranty_exp_date"`
+		DeviceValue          *Money `json:"device_value"` // Checked against the location's ID policy
+		TheftOverrideReason  string `json:"theft_override_reason"` // Books in a device the theft registry flagged
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	newOrder := request.Order
 
 	// Basic validation
 	if newOrder.CustomerName == "" || newOrder.CustomerEmail == "" || newOrder.CustomerPhone == "" {
@@ -579,9 +964,76 @@ func CreateOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var fieldErrors ValidationErrors
+	newOrder.ExpectedDeliveryDate = parseDateField("expected_delivery_date", request.ExpectedDeliveryDate, &fieldErrors)
+	newOrder.WarrantyExpDate = parseDateField("warranty_exp_date", request.WarrantyExpDate, &fieldErrors)
+	if newOrder.Priority != "" && !slices.Contains(orderPriorities, newOrder.Priority) {
+		fieldErrors.Add("priority", "must be one of Low, Normal, High, Urgent")
+	}
+	if newOrder.DataBackupConsent != "" && !slices.Contains(backupConsents, newOrder.DataBackupConsent) {
+		fieldErrors.Add("data_backup_consent", "must be one of declined, customer_backed_up, request_backup")
+	}
+	if newOrder.TicketType == "" && newOrder.ParentTicketID != "" {
+		newOrder.TicketType = reworkTicketType
+	} else if newOrder.TicketType == "" {
+		newOrder.TicketType = defaultTicketType
+	}
+	ticketType, err := ticketTypeService.GetTicketType(newOrder.TicketType)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading ticket type %s: %v", newOrder.TicketType, err)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows {
+		ticketType = nil
+	}
+	if err := checkIntake(&newOrder, ticketType, request.DeviceValue, &fieldErrors); err != nil {
+		log.Printf("Error checking intake: %v", err)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if !screenIntakeDevices(w, r, &newOrder, request.DeviceValue, request.TheftOverrideReason) {
+		return
+	}
+
+	// The ticket type's SLA sets the due time, and the promised date unless
+	// intake gave one
+	newOrder.SLADueAt = slaDueAt(ticketType, time.Now())
+	if newOrder.ExpectedDeliveryDate == nil && newOrder.SLADueAt != nil {
+		due := *newOrder.SLADueAt
+		newOrder.ExpectedDeliveryDate = &due
+	}
+
+	// Bounce-backs within a repair warranty window become warranty tickets
+	if _, err := warrantyService.markWarrantyClaim(&newOrder); err != nil {
+		log.Printf("Error checking repair warranty for order devices: %v", err)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	if newOrder.Priority == "" {
+		newOrder.Priority = defaultOrderPriority(&newOrder, time.Now())
+	}
+
 	// Set required fields for the new order
-	newOrder.ID = fmt.Sprintf("ORD-%d", time.Now().UnixNano())
+	newOrder.ID, err = idService.Next(EntityTicket)
+	if err != nil {
+		log.Printf("Error generating ticket ID: %v", err)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
 	newOrder.Status = "New Order"
+	newOrder.HoldState, newOrder.HoldReason = "", ""
+	if deposit := ticketType.RequiredDeposit(newOrder.TotalCost); deposit > 0 {
+		newOrder.HoldState, newOrder.HoldReason = HoldAwaitingPayment, "Deposit of "+deposit.String()+" required"
+	}
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		newOrder.CreatedBy = claims.Subject
+	}
 
 	// Create order in database
 	err = orderService.CreateOrder(&newOrder)
@@ -592,14 +1044,35 @@ func CreateOrderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Order %s created for %s.", newOrder.ID, newOrder.CustomerName)
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
+	audited := newOrder
+	audited.DevicePassword = ""
+	audited.Identity = nil
+	auditService.Record(r, AuditTicketCreated, "order", newOrder.ID, nil, audited)
+	for _, check := range newOrder.TheftChecks {
+		if check.OverriddenBy != "" {
+			auditService.Record(r, AuditTheftCheckOverridden, "order", newOrder.ID, nil, check)
+		}
+	}
+	response := map[string]string{
 		"message": "Order created successfully", 
 		"order_id": newOrder.ID,
-	})
+	}
+	if newOrder.WarrantyClaimOf != "" {
+		response["warranty_claim_of"] = newOrder.WarrantyClaimOf
+	}
+	if newOrder.ParentTicketID != "" {
+		response["parent_ticket_id"] = newOrder.ParentTicketID
+	}
+	if deposit := ticketType.RequiredDeposit(newOrder.TotalCost); deposit > 0 {
+		response["deposit_required"] = deposit.String()
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
 }
 
-// GetOrdersHandler retrieves all orders
+// GetOrdersHandler retrieves all orders, or one page of the orders in the
+// comma-separated ?status= list. Cancelled orders are listed only with
+// ?include_cancelled=true or when the Cancelled status is asked for.
 func GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
@@ -608,16 +1081,146 @@ func GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orders, err := orderService.GetAllOrders()
+	if r.URL.Query().Has("status") {
+		getOrdersByStatus(w, r)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	filter := parseOrderListFilter(r.URL.Query(), "created", &fieldErrors)
+	filter.SnoozedBy = actorID(r)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	orders, err := orderService.GetAllOrders(r.URL.Query().Get("include_cancelled") == "true", filter)
 	if err != nil {
 		log.Printf("Error retrieving orders: %v", err)
 		http.Error(w, "Failed to retrieve orders", http.StatusInternalServerError)
 		return
 	}
 
+	piiPolicyFor(r).shapeOrders(orders)
 	json.NewEncoder(w).Encode(orders)
 }
 
+// getOrdersByStatus serves GET /api/v1/orders?status=&page=&page_size=.
+func getOrdersByStatus(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var fieldErrors ValidationErrors
+
+	statuses := splitList(query.Get("status"))
+	if len(statuses) == 0 {
+		fieldErrors.Add("status", "is required")
+	}
+	includeCancelled := query.Get("include_cancelled") == "true"
+	for _, status := range statuses {
+		if status == StatusCancelled {
+			includeCancelled = true
+		} else if !slices.Contains(orderStatuses, status) && status != StatusReopened {
+			fieldErrors.Add("status", fmt.Sprintf("%q is not a status (%s, %s, %s)", status, strings.Join(orderStatuses, ", "), StatusReopened, StatusCancelled))
+		}
+	}
+
+	filter := parseOrderListFilter(query, "updated", &fieldErrors)
+	filter.SnoozedBy = actorID(r)
+
+	page, pageSize := 1, 50
+	if raw := query.Get("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			fieldErrors.Add("page", "must be a positive number")
+		} else {
+			page = n
+		}
+	}
+	if raw := query.Get("page_size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 200 {
+			fieldErrors.Add("page_size", "must be between 1 and 200")
+		} else {
+			pageSize = n
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	orders, total, err := orderService.GetOrdersByStatus(statuses, includeCancelled, filter, page, pageSize)
+	if err != nil {
+		log.Printf("Error retrieving orders by status: %v", err)
+		http.Error(w, "Failed to retrieve orders", http.StatusInternalServerError)
+		return
+	}
+
+	piiPolicyFor(r).shapeOrders(orders)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orders":      orders,
+		"page":        page,
+		"page_size":   pageSize,
+		"total":       total,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetOrderStatusHandler returns only the progress of one order and its
+// customer-visible notes, for kiosk displays and other clients that must not
+// see customer details
+func GetOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		http.Error(w, "order_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	var expectedDelivery sql.NullTime
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT status, expected_delivery_date, updated_at FROM orders WHERE id = ?`, orderID).
+		Scan(&status, &expectedDelivery, &updatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving status of order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order status", http.StatusInternalServerError)
+		return
+	}
+
+	notes, err := noteService.CustomerNotes(orderID)
+	if err != nil {
+		log.Printf("Error retrieving notes of order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order status", http.StatusInternalServerError)
+		return
+	}
+
+	diagnosis, err := diagnosisService.Published(orderID)
+	if err != nil {
+		log.Printf("Error retrieving diagnosis of order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order status", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id":               orderID,
+		"status":                 status,
+		"expected_delivery_date": timePtr(expectedDelivery),
+		"updated_at":             updatedAt,
+		"notes":                  notes,
+		"diagnosis":              diagnosis,
+	})
+}
+
 // UpdateOrderStatusHandler updates the status of an order
 func UpdateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -639,6 +1242,11 @@ func UpdateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The acting user comes from the token, not the payload
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		updateRequest.UpdatedBy = claims.Subject
+	}
+
 	// Validate required fields
 	if updateRequest.OrderID == "" || updateRequest.Status == "" {
 		http.Error(w, "Order ID and status are required", http.StatusBadRequest)
@@ -646,9 +1254,8 @@ func UpdateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate status values
-	validStatuses := []string{"New Order", "In Progress", "Ready for Delivery", "Collected"}
 	isValidStatus := false
-	for _, status := range validStatuses {
+	for _, status := range orderStatuses {
 		if updateRequest.Status == status {
 			isValidStatus = true
 			break
@@ -660,7 +1267,20 @@ func UpdateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = orderService.UpdateOrderStatus(updateRequest.OrderID, updateRequest.Status, updateRequest.UpdatedBy)
+	if !canSetStatus(r, updateRequest.Status) {
+		http.Error(w, "Your role cannot move tickets to this status", http.StatusForbidden)
+		return
+	}
+
+	previousStatus, err := orderService.UpdateOrderStatus(updateRequest.OrderID, updateRequest.Status, updateRequest.UpdatedBy)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Error updating order status: %v", err)
 		http.Error(w, "Failed to update order status", http.StatusInternalServerError)
@@ -668,12 +1288,16 @@ func UpdateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Order %s status updated to %s by %s", updateRequest.OrderID, updateRequest.Status, updateRequest.UpdatedBy)
+	auditService.Record(r, AuditStatusChanged, "order", updateRequest.OrderID,
+		map[string]string{"status": previousStatus}, map[string]string{"status": updateRequest.Status})
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Order status updated successfully",
 	})
 }
 
-// ForgotPasswordHandler handles password reset requests
+// ForgotPasswordHandler handles password reset requests in three steps:
+// "request" texts a one-time code to the account's phone, "verify" exchanges
+// a correct code for a reset token, and "reset" sets the new password.
 func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
@@ -683,10 +1307,12 @@ func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resetRequest struct {
-		Email    string `json:"email"`
-		Phone    string `json:"phone"`
-		Password string `json:"new_password,omitempty"`
-		Step     string `json:"step"` // "verify" or "reset"
+		Email      string `json:"email"`
+		Phone      string `json:"phone"`
+		Code       string `json:"code,omitempty"`
+		ResetToken string `json:"reset_token,omitempty"`
+		Password   string `json:"new_password,omitempty"`
+		Step       string `json:"step"` // "request", "verify" or "reset"
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&resetRequest)
@@ -695,106 +1321,398 @@ func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if resetRequest.Step == "verify" {
-		// Verify user exists with email and phone
+	switch resetRequest.Step {
+	case "request":
+		// Always answer the same way so the endpoint cannot be used to
+		// discover which email/phone pairs have accounts.
+		user, err := userService.GetUserByEmailAndPhone(resetRequest.Email, resetRequest.Phone)
+		if err == nil {
+			if err := passwordResetService.SendCode(user); err != nil {
+				log.Printf("Error sending reset code to user %s: %v", user.ID, err)
+			}
+		} else if err != sql.ErrNoRows {
+			log.Printf("Error finding user: %v", err)
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "If an account matches, a verification code has been sent to its phone",
+		})
+
+	case "verify":
+		if resetRequest.Code == "" {
+			http.Error(w, "Verification code is required", http.StatusBadRequest)
+			return
+		}
+
 		user, err := userService.GetUserByEmailAndPhone(resetRequest.Email, resetRequest.Phone)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "No account found with this email and phone combination", http.StatusNotFound)
-				return
+			if err != sql.ErrNoRows {
+				log.Printf("Error verifying user: %v", err)
 			}
-			log.Printf("Error verifying user: %v", err)
+			http.Error(w, ErrOTPInvalid.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resetToken, err := passwordResetService.VerifyCode(user, resetRequest.Code)
+		if err == ErrOTPInvalid {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == ErrOTPTooManyTries {
+			http.Error(w, "Too many incorrect attempts; request a new code", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			log.Printf("Error verifying reset code: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message": "User verified successfully",
-			"user_id": user.ID,
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":     "Code verified successfully",
+			"reset_token": resetToken,
 		})
-	} else if resetRequest.Step == "reset" {
-		// Reset password
-		if resetRequest.Password == "" {
-			http.Error(w, "New password is required", http.StatusBadRequest)
+
+	case "reset":
+		if resetRequest.ResetToken == "" || resetRequest.Password == "" {
+			http.Error(w, "Reset token and new password are required", http.StatusBadRequest)
 			return
 		}
 
-		user, err := userService.GetUserByEmailAndPhone(resetRequest.Email, resetRequest.Phone)
+		userID, err := passwordResetService.ConsumeResetToken(resetRequest.ResetToken)
+		if err == ErrResetTokenInvalid {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "No account found with this email and phone combination", http.StatusNotFound)
-				return
-			}
-			log.Printf("Error finding user: %v", err)
+			log.Printf("Error consuming reset token: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		// TODO: Hash the new password before storing
-		err = userService.UpdateUserPassword(user.ID, resetRequest.Password)
+		err = userService.UpdateUserPassword(userID, resetRequest.Password)
 		if err != nil {
 			log.Printf("Error updating password: %v", err)
 			http.Error(w, "Failed to update password", http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("Password reset successfully for user %s", user.Email)
+		// Anyone holding the old credentials is signed out
+		if _, err := sessionService.RevokeUserSessions(userID); err != nil {
+			log.Printf("Error revoking sessions after password reset for %s: %v", userID, err)
+		}
+
+		log.Printf("Password reset successfully for user %s", userID)
+		auditService.RecordAs(r, userID, AuditPasswordReset, "user", userID, nil, nil)
 		json.NewEncoder(w).Encode(map[string]string{
 			"message": "Password reset successfully",
 		})
-	} else {
+
+	default:
 		http.Error(w, "Invalid step parameter", http.StatusBadRequest)
 	}
 }
 
 // --- Main Server Function ---
 
+// initServices sets up the services over db, failing on bad configuration.
+// The server, the one-off commands and the benchmarks share it.
+func initServices() {
+	userService = NewUserService(db)
+	orderService = NewOrderService(db)
+	sessionService = NewSessionService(db)
+	outboxService = NewOutboxService(db)
+	apiKeyService = NewAPIKeyService(db)
+	passwordResetService = NewPasswordResetService(db, newSMSProvider())
+	warrantyService = NewWarrantyService(db)
+	backupService = NewBackupService(db)
+	ticketTypeService = NewTicketTypeService(db)
+	visitService = NewVisitService(db)
+	auditService = NewAuditService(db)
+	partService = NewPartService(db)
+	ssoProviderSet = ssoProviders()
+	tradeInService = NewTradeInService(db)
+	estimateService = NewEstimateService(db)
+	smsInboundService = NewSMSInboundService(db, newSMSProvider())
+	printService = NewPrintService(db)
+	revocationService = NewRevocationService(db)
+	identityService = NewIdentityService(db)
+	noteService = NewNoteService(db)
+	legalHoldService = NewLegalHoldService(db)
+	exportLogService = NewExportLogService(db)
+	wastageService = NewWastageService(db)
+	recallService = NewRecallService(db)
+	customFieldService = NewCustomFieldService(db)
+	certificationService = NewCertificationService(db)
+	lobbyService = NewLobbyService(db)
+	accountService = NewAccountService(db)
+	quoteService = NewQuoteService(db)
+	signatureService = NewSignatureService(db)
+	checklistService = NewChecklistService(db)
+	diagnosisService = NewDiagnosisService(db)
+	boardService = NewBoardService(db)
+	myDayService = NewMyDayService(db)
+	reportSubscriptionService = NewReportSubscriptionService(db)
+	escalationService = NewEscalationService(db)
+	presenceService = NewPresenceService(db)
+	snoozeService = NewSnoozeService(db)
+	watcherService = NewWatcherService(db)
+	timeService = NewTimeService(db)
+	stocktakeService = NewStocktakeService(db)
+	dbMaintenanceService = NewDBMaintenanceService(db)
+	serviceAccountService = NewServiceAccountService(db)
+	reportService = NewReportService(db)
+	customerService = NewCustomerService(db)
+	permissionService = NewPermissionService(db)
+	if err := permissionService.Reload(context.Background()); err != nil {
+		log.Fatalf("Failed to load permissions: %v", err)
+	}
+	buildService = NewBuildService(db)
+
+	migrationService = NewMigrationService(db)
+	migrationService.Register(ordersPublicIDMigration)
+	migrationService.Register(ticketEventsBackfillMigration)
+	migrationService.Register(statusHistoryBackfillMigration)
+	migrationService.Resume()
+
+	var err error
+	tokenService, err = NewTokenService()
+	if err != nil {
+		log.Fatalf("Failed to initialize JWT signing: %v", err)
+	}
+	if anonymizationRules, err = parseAnonymizationRules(getEnv("EXPORT_ANONYMIZATION", "")); err != nil {
+		log.Fatalf("Invalid EXPORT_ANONYMIZATION: %v", err)
+	}
+	if err := parseExportRoles(getEnv("EXPORT_ROLES", "")); err != nil {
+		log.Fatalf("Invalid EXPORT_ROLES: %v", err)
+	}
+
+	idConfig, err := getIDConfig()
+	if err != nil {
+		log.Fatalf("Invalid ID configuration: %v", err)
+	}
+	idService = NewIDService(db, idConfig)
+	if err := idService.Register(); err != nil {
+		log.Fatalf("Failed to register ID prefixes: %v", err)
+	}
+
+	if shopLocale, err = getLocaleConfig(); err != nil {
+		log.Fatalf("Invalid locale: %v", err)
+	}
+	if shopLanguage, err = getLanguageConfig(); err != nil {
+		log.Fatalf("Invalid language: %v", err)
+	}
+
+	laborRate, err := getLaborLoadedRate()
+	if err != nil {
+		log.Fatalf("Invalid labor rate: %v", err)
+	}
+	profitabilityService = NewProfitabilityService(db, laborRate)
+	emailService = NewEmailService(db)
+
+	if attachmentService, err = NewAttachmentService(db); err != nil {
+		log.Fatalf("Invalid attachment storage configuration: %v", err)
+	}
+
+	theftCheckConfig, err := getTheftCheckConfig()
+	if err != nil {
+		log.Fatalf("Invalid theft check configuration: %v", err)
+	}
+	theftCheckService = NewTheftCheckService(db, theftCheckConfig)
+	ocrConfig, err := getOCRConfig()
+	if err != nil {
+		log.Fatalf("Invalid OCR configuration: %v", err)
+	}
+	labelScanService = NewLabelScanService(ocrConfig)
+	transcriptionConfig, err := getTranscriptionConfig()
+	if err != nil {
+		log.Fatalf("Invalid transcription configuration: %v", err)
+	}
+	voiceNoteService = NewVoiceNoteService(db, transcriptionConfig)
+}
+
 func main() {
 	// Initialize database connection
 	initDatabase()
 	defer db.Close()
 
-	// Initialize services
-	userService = NewUserService(db)
-	orderService = NewOrderService(db)
+	initServices()
 
-	// Enable CORS for frontend integration
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		
-		// Handle other requests normally
-		http.DefaultServeMux.ServeHTTP(w, r)
-	})
+	ipAllowlist, err := getIPAllowlistConfig()
+	if err != nil {
+		log.Fatalf("Invalid IP allowlist: %v", err)
+	}
+
+	// One-off commands such as seed-loadtest run instead of the server
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	if err := userService.bootstrapAdmin(); err != nil {
+		log.Fatalf("Failed to bootstrap the admin account: %v", err)
+	}
+
+	mux := http.NewServeMux()
 
 	// Define the API routes
-	http.HandleFunc("/api/v1/health", HealthCheckHandler)
-	http.HandleFunc("/api/v1/dashboard/metrics", GetDashboardMetricsHandler)
-	http.HandleFunc("/api/v1/orders", GetOrdersHandler)
-	http.HandleFunc("/api/v1/orders/create", CreateOrderHandler)
-	http.HandleFunc("/api/v1/orders/update-status", UpdateOrderStatusHandler)
-	http.HandleFunc("/api/v1/auth/register", RegisterHandler)
-	http.HandleFunc("/api/v1/auth/login", LoginHandler)
-	http.HandleFunc("/api/v1/auth/forgot-password", ForgotPasswordHandler)
+	mux.HandleFunc("/api/v1/health", HealthCheckHandler)
+	mux.HandleFunc("/api/v1/dashboard/metrics", anyStaff(GetDashboardMetricsHandler))
+	mux.HandleFunc("/api/v1/reports/summary", reporting(ReportSummaryHandler))
+	mux.HandleFunc("/api/v1/reports/tickets", requireRoles(allRoles...)(ReportTicketsHandler)) // exportRoles
+	mux.HandleFunc("/api/v1/reports/export", requireRoles(allRoles...)(ReportExportHandler)) // exportRoles
+	mux.HandleFunc("/api/v1/reports/profitability", reporting(ReportProfitabilityHandler))
+	mux.HandleFunc("/api/v1/reports/wastage", reporting(ReportWastageHandler))
+	mux.HandleFunc("/api/v1/reports/cogs", reporting(ReportCOGSHandler))
+	mux.HandleFunc("/api/v1/reports/holds", reporting(ReportHoldsHandler))
+	mux.HandleFunc("/api/v1/reports/reschedules", reporting(ReportReschedulesHandler))
+	mux.HandleFunc("/api/v1/reports/utilization", reporting(ReportUtilizationHandler))
+	mux.HandleFunc("/api/v1/reports/lobby", reporting(ReportLobbyHandler))
+	mux.HandleFunc("/api/v1/report-subscriptions", reporting(ReportSubscriptionsHandler))
+	mux.HandleFunc("/api/v1/orders", anyStaff(GetOrdersHandler))
+	mux.HandleFunc("/api/v1/orders/", anyStaff(OrderDetailHandler))
+	mux.HandleFunc("/api/v1/orders/create", requirePermission(PermTicketsCreate)(CreateOrderHandler))
+	mux.HandleFunc("/api/v1/orders/update-status", requirePermission(PermTicketsUpdateStatus)(UpdateOrderStatusHandler))
+	mux.HandleFunc("/api/v1/orders/status", anyStaff(GetOrderStatusHandler))
+	mux.HandleFunc("/api/v1/orders/events", anyStaff(GetOrderEventsHandler))
+	mux.HandleFunc("/api/v1/board", anyStaff(BoardHandler))
+	mux.HandleFunc("/api/v1/board/move", requirePermission(PermTicketsUpdateStatus)(BoardMoveHandler))
+	mux.HandleFunc("/api/v1/me/today", anyStaff(MyDayHandler))
+	mux.HandleFunc("/api/v1/me/presence", anyStaff(MyPresenceHandler))
+	mux.HandleFunc("/api/v1/me/snoozes", anyStaff(MySnoozesHandler))
+	mux.HandleFunc("/api/v1/staff/presence", anyStaff(StaffPresenceHandler))
+	mux.HandleFunc("/api/v1/me/mentions/read", anyStaff(MentionsReadHandler))
+	mux.HandleFunc("/api/v1/orders/notes", anyStaff(TicketNotesHandler))
+	mux.HandleFunc("/api/v1/orders/items", requirePermission(PermTicketsUpdatePrice)(AddOrderItemHandler))
+	mux.HandleFunc("/api/v1/orders/items/arrange", requirePermission(PermTicketsUpdatePrice)(ArrangeOrderItemsHandler))
+	mux.HandleFunc("/api/v1/orders/payments", requirePermission(PermPaymentsRecord)(RecordPaymentHandler))
+	mux.HandleFunc("/api/v1/orders/costs", anyStaff(TicketCostsHandler))
+	mux.HandleFunc("/api/v1/orders/profitability", anyStaff(TicketProfitabilityHandler))
+	mux.HandleFunc("/api/v1/orders/backup", anyStaff(BackupJobHandler))
+	mux.HandleFunc("/api/v1/orders/backup/verify", requirePermission(PermBackupsVerify)(VerifyBackupHandler))
+	mux.HandleFunc("/api/v1/orders/visits", anyStaff(VisitsHandler))
+	mux.HandleFunc("/api/v1/orders/visits/check-in", requirePermission(PermVisitsAttend)(VisitCheckInHandler))
+	mux.HandleFunc("/api/v1/orders/visits/check-out", requirePermission(PermVisitsAttend)(VisitCheckOutHandler))
+	mux.HandleFunc("/api/v1/orders/attachments", anyStaff(AttachmentsHandler))
+	mux.HandleFunc("/api/v1/orders/attachments/download", anyStaff(DownloadAttachmentHandler))
+	mux.HandleFunc("/api/v1/orders/attachments/url", anyStaff(AttachmentURLHandler))
+	mux.HandleFunc("/api/v1/orders/identity", anyStaff(TicketIdentityHandler))
+	mux.HandleFunc("/api/v1/orders/identity/photo", requirePermission(PermTicketsCreate)(TicketIdentityPhotoHandler))
+	mux.HandleFunc("/api/v1/customers", anyStaff(CustomersHandler))
+	mux.HandleFunc("/api/v1/engineers/workload", anyStaff(EngineerWorkloadHandler))
+	mux.HandleFunc("/api/v1/engineers/work-orders", anyStaff(WorkOrdersHandler))
+	mux.HandleFunc("/api/v1/devices/history", anyStaff(DeviceHistoryHandler))
+	mux.HandleFunc("/api/v1/devices/theft-checks", anyStaff(TheftChecksHandler))
+	mux.HandleFunc("/api/v1/devices/label-scan", anyStaff(LabelScanHandler))
+	mux.HandleFunc("/api/v1/ticket-types", anyStaff(TicketTypesHandler))
+	mux.HandleFunc("/api/v1/parts", anyStaff(PartsHandler))
+	mux.HandleFunc("/api/v1/parts/scrap", requirePermission(PermPartsWastage)(PartScrapHandler))
+	mux.HandleFunc("/api/v1/parts/cores", anyStaff(PartCoresHandler))
+	mux.HandleFunc("/api/v1/parts/movements", anyStaff(PartMovementsHandler))
+	mux.HandleFunc("/api/v1/parts/receipts", requirePermission(PermPartsReceive)(PartReceiptsHandler))
+	mux.HandleFunc("/api/v1/parts/lots", anyStaff(PartLotsHandler))
+	mux.HandleFunc("/api/v1/parts/stocktakes", requirePermission(PermPartsStocktake)(StocktakesHandler))
+	mux.HandleFunc("/api/v1/parts/stocktakes/", requirePermission(PermPartsStocktake)(StocktakeDetailHandler))
+	mux.HandleFunc("/api/v1/recalls", anyStaff(RecallsHandler))
+	mux.HandleFunc("/api/v1/tags", anyStaff(TagsHandler))
+	mux.HandleFunc("/api/v1/custom-fields", anyStaff(CustomFieldsHandler))
+	mux.HandleFunc("/api/v1/certifications", anyStaff(CertificationsHandler))
+	mux.HandleFunc("/api/v1/lobby/tokens", anyStaff(LobbyTokensHandler))
+	mux.HandleFunc("/api/v1/accounts", anyStaff(AccountsHandler))
+	mux.HandleFunc("/api/v1/accounts/health", adminOnly(AccountHealthHandler))
+	mux.HandleFunc("/api/v1/accounts/sla-report", adminOnly(ContractSLAReportHandler))
+	mux.HandleFunc("/api/v1/quotes", anyStaff(QuotesHandler))
+	mux.HandleFunc("/api/v1/quotes/", anyStaff(QuoteDetailHandler))
+	mux.HandleFunc("/api/v1/lobby/tokens/status", anyStaff(LobbyTokenStatusHandler))
+	mux.HandleFunc("/api/v1/recalls/affected", anyStaff(RecallAffectedHandler))
+	mux.HandleFunc("/api/v1/recalls/tickets", anyStaff(RecallTicketsHandler))
+	mux.HandleFunc("/api/v1/orders/estimates", anyStaff(EstimatesHandler))
+	mux.HandleFunc("/api/v1/orders/estimates/decision", anyStaff(EstimateDecisionHandler))
+	mux.HandleFunc("/api/v1/public/estimates", PublicEstimatesHandler)
+	mux.HandleFunc("/api/v1/public/email-events/", EmailEventsHandler)
+	mux.HandleFunc("/api/v1/public/sms-inbound", SMSInboundHandler)
+	mux.HandleFunc("/api/v1/public/attachments", PublicAttachmentHandler)
+	mux.HandleFunc("/api/v1/communications", anyStaff(CommunicationsHandler))
+	mux.HandleFunc("/api/v1/email-flags", adminOnly(EmailFlagsHandler))
+	mux.HandleFunc("/api/v1/orders/print", anyStaff(OrderPrintJobsHandler))
+	mux.HandleFunc("/api/v1/print-jobs", anyStaff(PrintQueueHandler))
+	mux.HandleFunc("/api/v1/print-jobs/status", anyStaff(PrintJobStatusHandler))
+	mux.HandleFunc("/api/v1/tradein/quote", anyStaff(TradeInQuoteHandler))
+	mux.HandleFunc("/api/v1/tradein/purchases", requirePermission(PermTradeInPurchase)(BuybackPurchasesHandler))
+	mux.HandleFunc("/api/v1/tradein/purchases/resell", requirePermission(PermTradeInPurchase)(BuybackResaleHandler))
+	mux.HandleFunc("/api/v1/builds", anyStaff(BuildsHandler))
+	mux.HandleFunc("/api/v1/builds/components", anyStaff(BuildComponentsHandler))
+	mux.HandleFunc("/api/v1/builds/checklist", requirePermission(PermBuildsAssemble)(BuildChecklistHandler))
+	mux.HandleFunc("/api/v1/builds/burn-in", requirePermission(PermBuildsAssemble)(BuildBurnInHandler))
+	mux.HandleFunc("/api/v1/builds/invoice", requirePermission(PermBuildsInvoice)(InvoiceBuildHandler))
+	mux.HandleFunc("/api/v1/auth/register", RegisterHandler)
+	mux.HandleFunc("/api/v1/auth/login", LoginHandler)
+	mux.HandleFunc("/api/v1/auth/forgot-password", ForgotPasswordHandler)
+	mux.HandleFunc("/api/v1/auth/refresh", RefreshTokenHandler)
+	mux.HandleFunc("/api/v1/auth/logout", LogoutHandler)
+	mux.HandleFunc("/api/v1/auth/sso/start", SSOStartHandler)
+	mux.HandleFunc("/api/v1/auth/sso/callback", SSOCallbackHandler)
+	mux.HandleFunc("/api/v1/audit", adminOnly(AuditLogHandler))
+	mux.HandleFunc("/api/v1/admin/maintenance", adminOnly(MaintenanceHandler))
+	mux.HandleFunc("/api/v1/admin/maintenance/tasks", adminOnly(MaintenanceTasksHandler))
+	mux.HandleFunc("/api/v1/admin/maintenance/runs", adminOnly(MaintenanceRunsHandler))
+	mux.HandleFunc("/api/v1/admin/migrations", adminOnly(MigrationsHandler))
+	mux.HandleFunc("/api/v1/admin/migrations/control", adminOnly(MigrationControlHandler))
+	mux.HandleFunc("/api/v1/admin/sessions", adminOnly(ActiveSessionsHandler))
+	mux.HandleFunc("/api/v1/admin/sessions/revoke", adminOnly(RevokeUserSessionsHandler))
+	mux.HandleFunc("/api/v1/admin/tokens/revoke", adminOnly(RevokeTokenHandler))
+	mux.HandleFunc("/api/v1/admin/users/role", adminOnly(UpdateUserRoleHandler))
+	mux.HandleFunc("/api/v1/admin/users/approve", adminOnly(ApproveUserHandler))
+	mux.HandleFunc("/api/v1/admin/permissions", adminOnly(PermissionsHandler))
+	mux.HandleFunc("/api/v1/admin/id-prefixes", adminOnly(IDPrefixesHandler))
+	mux.HandleFunc("/api/v1/admin/storage", adminOnly(StorageUsageHandler))
+	mux.HandleFunc("/api/v1/admin/id-policies", adminOnly(IDPoliciesHandler))
+	mux.HandleFunc("/api/v1/admin/legal-holds", adminOnly(LegalHoldsHandler))
+	mux.HandleFunc("/api/v1/admin/exports", adminOnly(ExportLogHandler))
+	mux.HandleFunc("/api/v1/admin/api-keys", adminOnly(APIKeysHandler))
+	mux.HandleFunc("/api/v1/admin/api-keys/revoke", adminOnly(RevokeAPIKeyHandler))
+	mux.HandleFunc("/api/v1/admin/service-accounts", adminOnly(ServiceAccountsHandler))
+	mux.HandleFunc("/api/v1/admin/service-accounts/tokens", adminOnly(ServiceAccountTokenHandler))
+	mux.HandleFunc("/api/v1/admin/service-accounts/disable", adminOnly(DisableServiceAccountHandler))
+	mux.HandleFunc("/api/v1/admin/ticket-types", adminOnly(AdminTicketTypesHandler))
+	mux.HandleFunc("/api/v1/admin/checklist-templates", adminOnly(AdminChecklistTemplatesHandler))
+	mux.HandleFunc("/api/v1/admin/custom-fields", adminOnly(AdminCustomFieldsHandler))
+	mux.HandleFunc("/api/v1/admin/escalation-rules", adminOnly(EscalationRulesHandler))
+	mux.HandleFunc("/api/v1/admin/parts", adminOnly(AdminPartsHandler))
+	mux.HandleFunc("/api/v1/admin/parts/supplier-prices", adminOnly(AdminSupplierPricesHandler))
+	mux.HandleFunc("/api/v1/admin/tradein/rules", adminOnly(ValuationRulesHandler))
+
+	// Serve the embedded frontend (built with -tags embedui) from the same binary
+	if static := frontendFS(); static != nil && getEnv("SERVE_FRONTEND", "true") == "true" {
+		mux.Handle("/api/", http.NotFoundHandler())
+		mux.Handle("/", frontendHandler(static))
+		log.Println("Serving embedded frontend on /")
+	}
+
+	// Subscribed reports run through the same routes as API requests
+	reportSubscriptionService.handler = mux
+
+	// Start background jobs
+	worker.Register(BackgroundJob{Name: "outbox", Interval: getEnvDuration("OUTBOX_POLL_INTERVAL", 2*time.Second), Run: outboxService.Drain})
+	worker.Register(dbMaintenanceJob())
+	worker.Register(permissionReloadJob())
+	worker.Register(slaCheckJob())
+	worker.Register(certificationReminderJob())
+	worker.Register(voiceNoteTranscriptionJob())
+	worker.Register(reportSubscriptionJob())
+	worker.Register(escalationJob())
+	worker.Register(snoozeReminderJob())
+	worker.Start(context.Background())
 
 	// Start the server
-	port := getEnv("PORT", "8080")
-	if port[0] != ':' {
-		port = ":" + port
-	}
-	
-	log.Printf("PC Repair Hub Backend API starting on http://localhost%s", port)
+	serverConfig := getServerConfig()
+	server := newHTTPServer(serverConfig, securityHeadersMiddleware(corsMiddleware(getCORSConfig())(ipAllowlistMiddleware(ipAllowlist)(requestHardeningMiddleware(getHardeningConfig())(authMiddleware(maintenanceMiddleware(mux)))))))
+
+	log.Printf("PC Repair Hub Backend API starting on http://localhost%s", serverConfig.Addr)
 	log.Printf("Database: %s", getDBConfig().Database)
 	
-	// ListenAndServe uses a new goroutine for every incoming request, 
+	// The server uses a new goroutine for every incoming request, 
 	// leveraging Go's highly efficient concurrency model (goroutines) to handle scale.
-	if err := http.ListenAndServe(port, nil); err != nil {
+	if err := startServer(server, serverConfig); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
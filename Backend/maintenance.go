@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceState describes whether write endpoints are temporarily disabled.
+type MaintenanceState struct {
+	Enabled   bool       `json:"enabled"`
+	Message   string     `json:"message"`
+	Routes    []string   `json:"routes,omitempty"` // Route prefixes; empty means every write endpoint
+	Since     *time.Time `json:"since,omitempty"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+}
+
+// MaintenanceService holds the maintenance flag. It lives in process memory:
+// a restart clears it, and each instance behind a load balancer keeps its own,
+// so multi-instance deployments must toggle every instance.
+type MaintenanceService struct {
+	mu    sync.RWMutex
+	state MaintenanceState
+}
+
+const defaultMaintenanceMessage = "The system is undergoing scheduled maintenance. Changes are temporarily disabled; viewing data still works."
+
+// maintenanceExemptRoutes stay writable during maintenance so staff can still
+// sign in and an administrator can switch maintenance off again.
+var maintenanceExemptRoutes = []string{
+	"/api/v1/admin/maintenance",
+	"/api/v1/auth/login",
+	"/api/v1/auth/refresh",
+	"/api/v1/auth/logout",
+}
+
+func NewMaintenanceService() *MaintenanceService {
+	return &MaintenanceService{}
+}
+
+func (ms *MaintenanceService) State() MaintenanceState {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.state
+}
+
+func (ms *MaintenanceService) SetState(state MaintenanceState) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if state.Enabled {
+		if state.Message == "" {
+			state.Message = defaultMaintenanceMessage
+		}
+		now := time.Now()
+		state.Since = &now
+	} else {
+		state = MaintenanceState{UpdatedBy: state.UpdatedBy}
+	}
+	ms.state = state
+}
+
+// Blocks reports whether the request is a write that maintenance mode rejects.
+func (ms *MaintenanceService) Blocks(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return false
+	}
+
+	for _, route := range maintenanceExemptRoutes {
+		if r.URL.Path == route {
+			return false
+		}
+	}
+
+	state := ms.State()
+	if !state.Enabled {
+		return false
+	}
+	if len(state.Routes) == 0 {
+		return true
+	}
+
+	for _, prefix := range state.Routes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var maintenanceService = NewMaintenanceService()
+
+// maintenanceMiddleware rejects write requests with 503 while maintenance is enabled.
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maintenanceService.Blocks(r) {
+			state := maintenanceService.State()
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "300")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":   "maintenance",
+				"message": state.Message,
+				"since":   state.Since,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MaintenanceHandler reports (GET) or toggles (PUT) maintenance mode.
+func MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(maintenanceService.State())
+	case "PUT":
+		var request struct {
+			Enabled bool     `json:"enabled"`
+			Message string   `json:"message"`
+			Routes  []string `json:"routes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		for _, route := range request.Routes {
+			if !strings.HasPrefix(route, "/api/") {
+				http.Error(w, "Routes must be API path prefixes such as /api/v1/orders", http.StatusBadRequest)
+				return
+			}
+		}
+
+		before := maintenanceService.State()
+		maintenanceService.SetState(MaintenanceState{
+			Enabled:   request.Enabled,
+			Message:   request.Message,
+			Routes:    request.Routes,
+			UpdatedBy: actorID(r),
+		})
+		after := maintenanceService.State()
+		log.Printf("Maintenance mode set to %t by %s (routes: %v)", after.Enabled, after.UpdatedBy, after.Routes)
+		auditService.Record(r, AuditMaintenanceChanged, "maintenance", "", before, after)
+		json.NewEncoder(w).Encode(after)
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// piiPolicy says which sensitive fields a caller may see in full. Anything
+// not granted is masked (contact details, serials) or dropped (device
+// passwords) before the response is written.
+type piiPolicy struct {
+	Contact        bool // customer email and phone
+	Address        bool // visit addresses
+	Serial         bool // device serial numbers
+	DevicePassword bool // device unlock passwords left at intake
+
+	// Pseudonymous replaces names with initials and contact details with a
+	// keyed hash, so records can be counted and joined but not identified.
+	Pseudonymous bool
+}
+
+// piiPolicies grants each role what its job needs: front desk talks to the
+// customer, engineers need to unlock and identify the device.
+var piiPolicies = map[string]piiPolicy{
+	RoleAdmin:     {Contact: true, Address: true, Serial: true, DevicePassword: true},
+	RoleEngineer:  {Address: true, Serial: true, DevicePassword: true},
+	RoleFrontDesk: {Contact: true, Address: true},
+	RoleReporting: {Pseudonymous: true},
+}
+
+// piiPolicyFor returns the policy for the caller of r. API keys and unknown
+// roles see everything masked.
+func piiPolicyFor(r *http.Request) piiPolicy {
+	claims := claimsFromContext(r.Context())
+	if claims == nil || claims.APIKeyID != "" {
+		return piiPolicy{}
+	}
+	return piiPolicies[normalizeRole(claims.Role)]
+}
+
+func (p piiPolicy) shapeOrder(order *Order) {
+	if p.Pseudonymous {
+		order.CustomerName = initials(order.CustomerName)
+		order.CustomerEmail = pseudonymize(strings.ToLower(order.CustomerEmail))
+		order.CustomerPhone = pseudonymize(order.CustomerPhone)
+	} else if !p.Contact {
+		order.CustomerEmail = maskEmail(order.CustomerEmail)
+		order.CustomerPhone = maskTail(order.CustomerPhone, 4)
+	}
+	if !p.Serial {
+		order.DeviceSerial = maskTail(order.DeviceSerial, 4)
+		for i := range order.Devices {
+			order.Devices[i].DeviceSerial = maskTail(order.Devices[i].DeviceSerial, 4)
+		}
+	}
+	if !p.DevicePassword {
+		order.DevicePassword = ""
+	}
+}
+
+func (p piiPolicy) shapeOrders(orders []Order) {
+	for i := range orders {
+		p.shapeOrder(&orders[i])
+	}
+}
+
+func (p piiPolicy) shapeCustomers(customers []Customer) {
+	for i := range customers {
+		if p.Pseudonymous {
+			customers[i].Name = initials(customers[i].Name)
+			customers[i].Email = pseudonymize(strings.ToLower(customers[i].Email))
+			customers[i].Phone = pseudonymize(customers[i].Phone)
+		} else if !p.Contact {
+			customers[i].Email = maskEmail(customers[i].Email)
+			customers[i].Phone = maskTail(customers[i].Phone, 4)
+		}
+	}
+}
+
+func (p piiPolicy) shapeRecallTickets(tickets []RecallTicket) {
+	for i := range tickets {
+		if p.Pseudonymous {
+			tickets[i].CustomerName = initials(tickets[i].CustomerName)
+			tickets[i].CustomerEmail = pseudonymize(strings.ToLower(tickets[i].CustomerEmail))
+			tickets[i].CustomerPhone = pseudonymize(tickets[i].CustomerPhone)
+		} else if !p.Contact {
+			tickets[i].CustomerEmail = maskEmail(tickets[i].CustomerEmail)
+			tickets[i].CustomerPhone = maskTail(tickets[i].CustomerPhone, 4)
+		}
+	}
+}
+
+// shapeLotTickets reduces customer names to initials for callers without
+// contact access; the ticket ID is what traces a part.
+func (p piiPolicy) shapeLotTickets(tickets []LotTicket) {
+	if p.Contact && !p.Pseudonymous {
+		return
+	}
+	for i := range tickets {
+		tickets[i].CustomerName = initials(tickets[i].CustomerName)
+	}
+}
+
+func (p piiPolicy) shapeVisits(visits []OnsiteVisit) {
+	if p.Address {
+		return
+	}
+	for i := range visits {
+		visits[i].Address = maskAddress(visits[i].Address)
+	}
+}
+
+// shapeTicketEdit masks serial numbers in the changes of a ticket edit.
+func (p piiPolicy) shapeTicketEdit(payload *TicketEditedPayload) {
+	change, ok := payload.Changes["device_serial"]
+	if !ok || p.Serial {
+		return
+	}
+	for _, value := range []*string{change.From, change.To} {
+		if value != nil {
+			*value = maskTail(*value, 4)
+		}
+	}
+}
+
+// shapeEvents masks the order snapshot carried by TicketCreated events and
+// the changes of TicketEdited events.
+func (p piiPolicy) shapeEvents(events []TicketEvent) error {
+	for i := range events {
+		if events[i].Type == EventTicketEdited {
+			var edit TicketEditedPayload
+			if err := json.Unmarshal(events[i].Payload, &edit); err != nil {
+				return err
+			}
+			p.shapeTicketEdit(&edit)
+			payload, err := json.Marshal(edit)
+			if err != nil {
+				return err
+			}
+			events[i].Payload = payload
+			continue
+		}
+		if events[i].Type != EventTicketCreated {
+			continue
+		}
+		var order Order
+		if err := json.Unmarshal(events[i].Payload, &order); err != nil {
+			return err
+		}
+		p.shapeOrder(&order)
+		payload, err := json.Marshal(order)
+		if err != nil {
+			return err
+		}
+		events[i].Payload = payload
+	}
+	return nil
+}
+
+// maskEmail keeps the first character and the domain: "j***@example.com".
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return maskTail(email, 0)
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// maskTail replaces all but the last keep characters with '*'.
+func maskTail(value string, keep int) string {
+	runes := []rune(value)
+	if len(runes) <= keep {
+		keep = len(runes) / 2
+	}
+	return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+}
+
+// maskAddress keeps only the last comma-separated part, usually the city or
+// postcode.
+func maskAddress(address string) string {
+	if address == "" {
+		return ""
+	}
+	parts := strings.Split(address, ",")
+	return "***, " + strings.TrimSpace(parts[len(parts)-1])
+}
+
+// initials reduces a name to its initials: "Priya Raman" becomes "P.R.".
+func initials(name string) string {
+	var b strings.Builder
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) {
+				b.WriteRune(unicode.ToUpper(r))
+				b.WriteByte('.')
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// piiHashKey keys pseudonymize. Phone numbers are too few to protect with a
+// plain hash, so without PII_HASH_SECRET a per-process key is used and
+// hashes only match within one run.
+var piiHashKey = func() []byte {
+	if secret := getEnv("PII_HASH_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate PII hash key: %v", err)
+	}
+	return key
+}()
+
+// pseudonymize returns a stable keyed hash of value for joining records
+// without revealing it.
+func pseudonymize(value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, piiHashKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Duplicate tickets are merged into the ticket that is kept: every line item
+// of the duplicate is added to it again with its warranty, its payments,
+// devices, tags, notes, attachments and recorded costs move across, and the duplicate is cancelled
+// with merged_into pointing at the survivor. Its own events stay, so its
+// history remains readable by ID.
+//
+// A ticket is split when a customer adds devices or work midway that should
+// be a job of its own: chosen line items and extra devices move to a new
+// ticket for the same customer with split_from set, and the original's
+// total drops by the amount moved. A stocked part's recorded cost moves
+// with its line. Payments stay with the original.
+//
+// Both run in one transaction over both tickets and are recorded as events
+// (TicketMerged, TicketSplit) on the ticket whose totals change.
+
+var (
+	errMergeSelf             = errors.New("a ticket cannot be merged into itself")
+	errMergeCustomerMismatch = errors.New("only tickets of the same customer can be merged")
+)
+
+// TicketMergedPayload records a duplicate absorbed by the ticket.
+type TicketMergedPayload struct {
+	SourceID   string        `json:"source_id"`
+	AmountPaid Money         `json:"amount_paid"`
+	Devices    []OrderDevice `json:"devices,omitempty"`
+	Reason     string        `json:"reason,omitempty"`
+}
+
+// SplitItem is a line item moved to another ticket.
+type SplitItem struct {
+	ID          int    `json:"id"`
+	Description string `json:"description"`
+	Amount      Money  `json:"amount"`
+}
+
+// TicketSplitPayload records work moved out to a new ticket.
+type TicketSplitPayload struct {
+	NewTicketID string      `json:"new_ticket_id"`
+	Items       []SplitItem `json:"items,omitempty"`
+	Devices     []int       `json:"devices,omitempty"` // Positions of the devices moved
+	Amount      Money       `json:"amount"`
+}
+
+// splittableStatus reports whether a ticket in status can still be merged
+// or split.
+func splittableStatus(status string) error {
+	switch status {
+	case StatusCancelled:
+		return &StatusGuardError{Reason: "the ticket is cancelled"}
+	case closedStatus:
+		return &StatusGuardError{Reason: "the ticket has been collected"}
+	}
+	return nil
+}
+
+// MergeTickets merges the duplicate sourceID into targetID.
+func (os *OrderService) MergeTickets(targetID, sourceID, reason, actorID string) error {
+	if targetID == sourceID {
+		return errMergeSelf
+	}
+
+	tx, err := os.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock in ID order so two merges of the same pair cannot deadlock
+	ids := []string{targetID, sourceID}
+	slices.Sort(ids)
+	statuses := map[string]string{}
+	for _, id := range ids {
+		status, err := os.lockOrderStatus(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := splittableStatus(status); err != nil {
+			return err
+		}
+		statuses[id] = status
+	}
+	if err := checkLegalHold(tx, sourceID); err != nil {
+		return err
+	}
+
+	var sameCustomer bool
+	err = tx.QueryRow(`
+		SELECT LOWER(TRIM(t.customer_email)) = LOWER(TRIM(s.customer_email)) OR t.customer_phone = s.customer_phone
+		FROM orders t, orders s WHERE t.id = ? AND s.id = ?
+	`, targetID, sourceID).Scan(&sameCustomer)
+	if err != nil {
+		return err
+	}
+	if !sameCustomer {
+		return errMergeCustomerMismatch
+	}
+
+	source, err := scanOrder(tx.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE id = ?`, sourceID))
+	if err != nil {
+		return err
+	}
+	sources := []Order{*source}
+	if err := os.loadDevices(sources); err != nil {
+		return err
+	}
+	events, err := os.events.Load(sourceID)
+	if err != nil {
+		return err
+	}
+	items, err := ticketLineItems(events)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		payload := ItemAddedPayload{Description: item.Description, Amount: item.Amount, WarrantyKind: item.WarrantyKind,
+			WarrantyDays: item.WarrantyDays, Section: item.Section, PartSKU: item.PartSKU, Quantity: item.Quantity,
+			PartCost: item.PartCost, CostID: item.CostID}
+		if _, err := os.events.Append(tx, targetID, EventItemAdded, actorID, payload); err != nil {
+			return err
+		}
+	}
+	merged := TicketMergedPayload{SourceID: sourceID, AmountPaid: source.AmountPaid, Devices: sources[0].Devices, Reason: reason}
+	if _, err := os.events.Append(tx, targetID, EventTicketMerged, actorID, merged); err != nil {
+		return err
+	}
+	cancelled := TicketCancelledPayload{From: statuses[sourceID], Reason: "Merged into " + targetID, MergedInto: targetID}
+	if reason != "" {
+		cancelled.Reason += ": " + reason
+	}
+	if _, err := os.events.Append(tx, sourceID, EventTicketCancelled, actorID, cancelled); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"ticket_notes", "attachments", "ticket_costs"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET order_id = ? WHERE order_id = ?`, targetID, sourceID); err != nil {
+			return fmt.Errorf("moving %s: %w", table, err)
+		}
+	}
+	// Tags are keyed by ticket, so the target keeps one of any tag both carry
+	_, err = tx.Exec(`
+		INSERT IGNORE INTO ticket_tags (order_id, tag, created_by, created_at)
+		SELECT ?, tag, created_by, created_at FROM ticket_tags WHERE order_id = ?
+	`, targetID, sourceID)
+	if err != nil {
+		return fmt.Errorf("moving ticket_tags: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM ticket_tags WHERE order_id = ?`, sourceID); err != nil {
+		return fmt.Errorf("moving ticket_tags: %w", err)
+	}
+
+	for _, id := range []string{targetID, sourceID} {
+		if err := migrationService.DualWrite(tx, "orders", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SplitTicket moves the line items itemIDs and the devices at positions to a
+// new ticket and returns its ID. Items and devices the ticket does not have
+// are recorded in fieldErrors and nothing is split.
+func (os *OrderService) SplitTicket(orderID string, itemIDs, positions []int, actorID string, fieldErrors *ValidationErrors) (string, error) {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	status, err := os.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if err := splittableStatus(status); err != nil {
+		return "", err
+	}
+
+	order, err := scanOrder(tx.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE id = ?`, orderID))
+	if err != nil {
+		return "", err
+	}
+	orders := []Order{*order}
+	if err := os.loadDevices(orders); err != nil {
+		return "", err
+	}
+	original := orders[0]
+	events, err := os.events.Load(orderID)
+	if err != nil {
+		return "", err
+	}
+	items, err := ticketLineItems(events)
+	if err != nil {
+		return "", err
+	}
+
+	split := TicketSplitPayload{Devices: positions}
+	for _, id := range itemIDs {
+		index := slices.IndexFunc(items, func(item TicketLineItem) bool { return item.ID == id })
+		if index < 0 {
+			fieldErrors.Add("items", fmt.Sprintf("%d is not a line item of the ticket", id))
+			continue
+		}
+		split.Items = append(split.Items, SplitItem{ID: id, Description: items[index].Description, Amount: items[index].Amount})
+		split.Amount += items[index].Amount
+	}
+	var devices []OrderDevice
+	for _, position := range positions {
+		index := slices.IndexFunc(original.Devices, func(device OrderDevice) bool { return device.Position == position })
+		switch {
+		case position == 1:
+			fieldErrors.Add("devices", "the primary device stays on the ticket")
+		case index < 0:
+			fieldErrors.Add("devices", fmt.Sprintf("%d is not a device of the ticket", position))
+		default:
+			devices = append(devices, original.Devices[index])
+		}
+	}
+	if len(split.Items) == 0 && len(devices) == 0 && len(*fieldErrors) == 0 {
+		fieldErrors.Add("items", "choose at least one line item or device to split off")
+	}
+	if len(*fieldErrors) > 0 {
+		return "", nil
+	}
+
+	// Work split off without a device of its own is for the primary device
+	if len(devices) == 0 {
+		devices = []OrderDevice{primaryDevice(&original)}
+	}
+	for i := range devices {
+		devices[i].Position = i + 1
+	}
+
+	split.NewTicketID, err = idService.Next(EntityTicket)
+	if err != nil {
+		return "", err
+	}
+	created := Order{
+		ID:                   split.NewTicketID,
+		CustomerName:         original.CustomerName,
+		CustomerEmail:        original.CustomerEmail,
+		CustomerPhone:        original.CustomerPhone,
+		DeviceType:           devices[0].DeviceType,
+		DeviceModel:          devices[0].DeviceModel,
+		DeviceSerial:         devices[0].DeviceSerial,
+		Devices:              devices,
+		Services:             []string{},
+		Status:               "New Order",
+		Priority:             original.Priority,
+		CreatedBy:            actorID,
+		AssignedEngineerID:   original.AssignedEngineerID,
+		ExpectedDeliveryDate: original.ExpectedDeliveryDate,
+		TicketType:           original.TicketType,
+		SLADueAt:             original.SLADueAt,
+		SplitFrom:            orderID,
+		AccountID:            original.AccountID,
+	}
+	if _, err := os.events.Append(tx, created.ID, EventTicketCreated, actorID, created); err != nil {
+		return "", err
+	}
+	for _, item := range split.Items {
+		index := slices.IndexFunc(items, func(line TicketLineItem) bool { return line.ID == item.ID })
+		payload := ItemAddedPayload{Description: item.Description, Amount: item.Amount,
+			WarrantyKind: items[index].WarrantyKind, WarrantyDays: items[index].WarrantyDays, Section: items[index].Section,
+			PartSKU: items[index].PartSKU, Quantity: items[index].Quantity, PartCost: items[index].PartCost,
+			CostID: items[index].CostID}
+		if payload.PartSKU != "" {
+			// The part's cost goes with it so both tickets' margins stay right
+			if payload.CostID, err = moveItemCost(tx, orderID, created.ID, items[index]); err != nil {
+				return "", err
+			}
+		}
+		if _, err := os.events.Append(tx, created.ID, EventItemAdded, actorID, payload); err != nil {
+			return "", err
+		}
+	}
+	if _, err := os.events.Append(tx, orderID, EventTicketSplit, actorID, split); err != nil {
+		return "", err
+	}
+	for _, id := range []string{orderID, created.ID} {
+		if err := profitabilityService.refreshSnapshot(tx, id); err != nil {
+			return "", err
+		}
+	}
+
+	for _, id := range []string{orderID, created.ID} {
+		if err := migrationService.DualWrite(tx, "orders", id); err != nil {
+			return "", err
+		}
+	}
+	return created.ID, tx.Commit()
+}
+
+// moveItemCost moves the ticket_costs row of a billed part line from one
+// ticket to another and returns its ID. Lines billed before the row was
+// kept on the item are matched on part, quantity and cost; a line with no
+// matching row moves nothing.
+func moveItemCost(tx *sql.Tx, fromID, toID string, item TicketLineItem) (int64, error) {
+	costID := item.CostID
+	if costID == 0 {
+		err := tx.QueryRow(`
+			SELECT id FROM ticket_costs
+			WHERE order_id = ? AND kind = ? AND part_sku = ? AND quantity = ? AND amount = ?
+			ORDER BY id LIMIT 1
+		`, fromID, CostPart, item.PartSKU, item.Quantity, item.PartCost).Scan(&costID)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := tx.Exec(`UPDATE ticket_costs SET order_id = ? WHERE id = ? AND order_id = ?`, toID, costID, fromID)
+	return costID, err
+}
+
+// projectTicketMerged credits the surviving ticket with the duplicate's
+// payments.
+func projectTicketMerged(tx *sql.Tx, event *TicketEvent) error {
+	var payload TicketMergedPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE orders SET amount_paid = amount_paid + ?, updated_at = ?, last_updated_by = NULLIF(?, '')
+		WHERE id = ?
+	`, payload.AmountPaid, event.OccurredAt, event.ActorID, event.TicketID)
+	return err
+}
+
+// projectTicketSplit takes the amount moved off the original ticket.
+func projectTicketSplit(tx *sql.Tx, event *TicketEvent) error {
+	var payload TicketSplitPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE orders SET total_cost = total_cost - ?, updated_at = ?, last_updated_by = NULLIF(?, '')
+		WHERE id = ?
+	`, payload.Amount, event.OccurredAt, event.ActorID, event.TicketID)
+	return err
+}
+
+// mergeOrder serves POST /api/v1/orders/{id}/merge
+// ({"duplicate_id": "...", "reason": "..."}).
+func mergeOrder(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsMerge) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		DuplicateID string `json:"duplicate_id"`
+		Reason      string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.DuplicateID == "" {
+		fieldErrors.Add("duplicate_id", "is required")
+	} else if request.DuplicateID == orderID {
+		fieldErrors.Add("duplicate_id", errMergeSelf.Error())
+	}
+	if len(request.Reason) > 400 {
+		fieldErrors.Add("reason", "is too long")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := orderService.MergeTickets(orderID, request.DuplicateID, request.Reason, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err == errMergeCustomerMismatch {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if holdErr, ok := err.(*LegalHoldError); ok {
+		http.Error(w, holdErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error merging order %s into %s: %v", request.DuplicateID, orderID, err)
+		http.Error(w, "Failed to merge orders", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Order %s merged into %s by %s", request.DuplicateID, orderID, actorID(r))
+	auditService.Record(r, AuditTicketMerged, "order", orderID, nil, request)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Orders merged successfully",
+	})
+}
+
+// splitOrder serves POST /api/v1/orders/{id}/split
+// ({"items": [3, 5], "devices": [2]}): line item IDs and device positions
+// to move to a new ticket.
+func splitOrder(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsMerge) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Items   []int `json:"items"`
+		Devices []int `json:"devices"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	slices.Sort(request.Items)
+	request.Items = slices.Compact(request.Items)
+	slices.Sort(request.Devices)
+	request.Devices = slices.Compact(request.Devices)
+
+	var fieldErrors ValidationErrors
+	newID, err := orderService.SplitTicket(orderID, request.Items, request.Devices, actorID(r), &fieldErrors)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err == nil && len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error splitting order %s: %v", orderID, err)
+		http.Error(w, "Failed to split order", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Order %s split into %s by %s", orderID, newID, actorID(r))
+	auditService.Record(r, AuditTicketSplit, "order", orderID, nil, map[string]interface{}{
+		"new_order_id": newID, "items": request.Items, "devices": request.Devices,
+	})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":  "Order split successfully",
+		"order_id": newID,
+	})
+}
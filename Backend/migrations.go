@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Online migrations roll out a schema change against the live database in
+// three phases: Prepare applies additive DDL, DualWrite mirrors every new
+// write into the new shape, and Backfill converts existing rows in small
+// batches. Progress is persisted so a restart resumes where it stopped.
+
+const onlineMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS online_migrations (
+		name VARCHAR(100) PRIMARY KEY,
+		status ENUM('pending', 'running', 'paused', 'completed', 'failed') NOT NULL DEFAULT 'pending',
+		cursor_id VARCHAR(50) NOT NULL DEFAULT '',
+		rows_processed BIGINT NOT NULL DEFAULT 0,
+		rows_total BIGINT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		started_at TIMESTAMP NULL,
+		completed_at TIMESTAMP NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// OnlineMigration describes one online schema change.
+type OnlineMigration struct {
+	Name        string
+	Description string
+	Table       string
+	// Prepare applies additive, non-blocking DDL. It must be idempotent.
+	Prepare func(database *sql.DB) error
+	// DualWrite mirrors a freshly written row (by primary key) into the new shape.
+	DualWrite func(tx execer, id string) error
+	// Backfill converts up to limit rows with primary keys after cursor and
+	// returns the last key it handled; an empty result means it is finished.
+	Backfill func(database *sql.DB, cursor string, limit int) (lastID string, processed int, err error)
+	// Remaining counts rows still to be converted, for progress reporting.
+	Remaining func(database *sql.DB) (int64, error)
+}
+
+// MigrationProgress is the persisted state of an online migration.
+type MigrationProgress struct {
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	Status        string     `json:"status"`
+	Cursor        string     `json:"cursor"`
+	RowsProcessed int64      `json:"rows_processed"`
+	RowsTotal     int64      `json:"rows_total"`
+	Percent       float64    `json:"percent"`
+	LastError     string     `json:"last_error,omitempty"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+// MigrationService registers online migrations and runs their backfills.
+type MigrationService struct {
+	db         *sql.DB
+	batchSize  int
+	pause      time.Duration
+	mu         sync.Mutex
+	migrations []*OnlineMigration
+	running    map[string]chan struct{}
+	dualWrite  map[string]bool
+}
+
+func NewMigrationService(database *sql.DB) *MigrationService {
+	return &MigrationService{
+		db:        database,
+		batchSize: getEnvInt("MIGRATION_BATCH_SIZE", 500),
+		pause:     getEnvDuration("MIGRATION_BATCH_PAUSE", 200*time.Millisecond),
+		running:   make(map[string]chan struct{}),
+		dualWrite: make(map[string]bool),
+	}
+}
+
+func (ms *MigrationService) Register(m *OnlineMigration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.migrations = append(ms.migrations, m)
+}
+
+func (ms *MigrationService) find(name string) *OnlineMigration {
+	for _, m := range ms.migrations {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Resume re-enables dual writes for migrations that were already started and
+// restarts any backfill that was interrupted by a restart.
+func (ms *MigrationService) Resume() {
+	for _, m := range ms.migrations {
+		if _, err := ms.db.Exec(`INSERT IGNORE INTO online_migrations (name) VALUES (?)`, m.Name); err != nil {
+			log.Printf("Error registering migration %s: %v", m.Name, err)
+			continue
+		}
+
+		progress, err := ms.progress(m)
+		if err != nil {
+			log.Printf("Error loading migration %s: %v", m.Name, err)
+			continue
+		}
+
+		if progress.Status != "pending" {
+			ms.mu.Lock()
+			ms.dualWrite[m.Name] = true
+			ms.mu.Unlock()
+		}
+		if progress.Status == "running" {
+			log.Printf("Resuming online migration %s from cursor %q", m.Name, progress.Cursor)
+			ms.launch(m)
+		}
+	}
+}
+
+// Start prepares the schema, switches on dual writes and begins the backfill.
+func (ms *MigrationService) Start(name string) error {
+	m := ms.find(name)
+	if m == nil {
+		return fmt.Errorf("unknown migration %q", name)
+	}
+
+	if err := m.Prepare(ms.db); err != nil {
+		ms.fail(m, err)
+		return err
+	}
+
+	// Dual writes must be live before the backfill reads its first batch so no
+	// row written in between is missed.
+	ms.mu.Lock()
+	ms.dualWrite[m.Name] = true
+	ms.mu.Unlock()
+
+	total, err := m.Remaining(ms.db)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE online_migrations
+		SET status = 'running', last_error = NULL, rows_total = rows_processed + ?,
+		    started_at = COALESCE(started_at, NOW())
+		WHERE name = ? AND status IN ('pending', 'paused', 'failed')
+	`
+	if _, err := ms.db.Exec(query, total, name); err != nil {
+		return err
+	}
+
+	ms.launch(m)
+	return nil
+}
+
+// Pause stops the backfill after its current batch; dual writes stay active.
+func (ms *MigrationService) Pause(name string) error {
+	ms.mu.Lock()
+	stop, ok := ms.running[name]
+	if ok {
+		close(stop)
+		delete(ms.running, name)
+	}
+	ms.mu.Unlock()
+
+	_, err := ms.db.Exec(`UPDATE online_migrations SET status = 'paused' WHERE name = ? AND status = 'running'`, name)
+	return err
+}
+
+func (ms *MigrationService) launch(m *OnlineMigration) {
+	ms.mu.Lock()
+	if _, ok := ms.running[m.Name]; ok {
+		ms.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	ms.running[m.Name] = stop
+	ms.mu.Unlock()
+
+	go ms.backfill(m, stop)
+}
+
+func (ms *MigrationService) backfill(m *OnlineMigration, stop chan struct{}) {
+	defer func() {
+		ms.mu.Lock()
+		delete(ms.running, m.Name)
+		ms.mu.Unlock()
+	}()
+
+	progress, err := ms.progress(m)
+	if err != nil {
+		ms.fail(m, err)
+		return
+	}
+	cursor := progress.Cursor
+
+	for {
+		select {
+		case <-stop:
+			log.Printf("Online migration %s paused at cursor %q", m.Name, cursor)
+			return
+		default:
+		}
+
+		lastID, processed, err := m.Backfill(ms.db, cursor, ms.batchSize)
+		if err != nil {
+			ms.fail(m, err)
+			return
+		}
+
+		if processed == 0 {
+			ms.db.Exec(`UPDATE online_migrations SET status = 'completed', completed_at = NOW() WHERE name = ?`, m.Name)
+			log.Printf("Online migration %s completed", m.Name)
+			return
+		}
+
+		cursor = lastID
+		_, err = ms.db.Exec(`UPDATE online_migrations SET cursor_id = ?, rows_processed = rows_processed + ? WHERE name = ?`,
+			cursor, processed, m.Name)
+		if err != nil {
+			ms.fail(m, err)
+			return
+		}
+
+		// Throttle so the backfill never starves live traffic
+		time.Sleep(ms.pause)
+	}
+}
+
+func (ms *MigrationService) fail(m *OnlineMigration, cause error) {
+	log.Printf("Online migration %s failed: %v", m.Name, cause)
+	ms.db.Exec(`UPDATE online_migrations SET status = 'failed', last_error = ? WHERE name = ?`, cause.Error(), m.Name)
+}
+
+// DualWrite mirrors a write on table into every active migration for it.
+// Call it inside the same transaction as the original write.
+func (ms *MigrationService) DualWrite(tx execer, table, id string) error {
+	if ms == nil {
+		return nil
+	}
+
+	ms.mu.Lock()
+	var active []*OnlineMigration
+	for _, m := range ms.migrations {
+		if m.Table == table && ms.dualWrite[m.Name] {
+			active = append(active, m)
+		}
+	}
+	ms.mu.Unlock()
+
+	for _, m := range active {
+		if err := m.DualWrite(tx, id); err != nil {
+			return fmt.Errorf("dual write for %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (ms *MigrationService) progress(m *OnlineMigration) (*MigrationProgress, error) {
+	p := &MigrationProgress{Name: m.Name, Description: m.Description}
+	var lastError sql.NullString
+	var startedAt, completedAt sql.NullTime
+
+	query := `
+		SELECT status, cursor_id, rows_processed, rows_total, last_error, started_at, completed_at
+		FROM online_migrations WHERE name = ?
+	`
+	err := ms.db.QueryRow(query, m.Name).Scan(&p.Status, &p.Cursor, &p.RowsProcessed, &p.RowsTotal,
+		&lastError, &startedAt, &completedAt)
+	if err == sql.ErrNoRows {
+		p.Status = "pending"
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.LastError = lastError.String
+	p.StartedAt = timePtr(startedAt)
+	p.CompletedAt = timePtr(completedAt)
+
+	switch {
+	case p.Status == "completed":
+		p.Percent = 100
+	case p.RowsTotal > 0:
+		p.Percent = float64(p.RowsProcessed) * 100 / float64(p.RowsTotal)
+	}
+	return p, nil
+}
+
+func (ms *MigrationService) AllProgress() ([]MigrationProgress, error) {
+	var all []MigrationProgress
+	for _, m := range ms.migrations {
+		p, err := ms.progress(m)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *p)
+	}
+	return all, nil
+}
+
+// ordersPublicIDMigration gives every order a UUID so external systems can
+// reference tickets without exposing sequential internal IDs.
+var ordersPublicIDMigration = &OnlineMigration{
+	Name:        "orders_public_id",
+	Description: "Add a UUID public_id to orders",
+	Table:       "orders",
+	Prepare: func(database *sql.DB) error {
+		if err := ensureColumn(database, "orders", "public_id", "CHAR(36) NULL"); err != nil {
+			return err
+		}
+		var count int
+		database.QueryRow(`
+			SELECT COUNT(*) FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND INDEX_NAME = 'idx_orders_public_id'
+		`).Scan(&count)
+		if count == 0 {
+			_, err := database.Exec(`CREATE UNIQUE INDEX idx_orders_public_id ON orders(public_id)`)
+			return err
+		}
+		return nil
+	},
+	DualWrite: func(tx execer, id string) error {
+		_, err := tx.Exec(`UPDATE orders SET public_id = UUID() WHERE id = ? AND public_id IS NULL`, id)
+		return err
+	},
+	Backfill: func(database *sql.DB, cursor string, limit int) (string, int, error) {
+		var lastID string
+		var processed int
+		err := database.QueryRow(`
+			SELECT COALESCE(MAX(id), ''), COUNT(*) FROM (
+				SELECT id FROM orders WHERE id > ? ORDER BY id LIMIT ?
+			) batch
+		`, cursor, limit).Scan(&lastID, &processed)
+		if err != nil || processed == 0 {
+			return cursor, 0, err
+		}
+
+		_, err = database.Exec(`UPDATE orders SET public_id = UUID() WHERE id > ? AND id <= ? AND public_id IS NULL`,
+			cursor, lastID)
+		return lastID, processed, err
+	},
+	Remaining: func(database *sql.DB) (int64, error) {
+		var count int64
+		err := database.QueryRow(`SELECT COUNT(*) FROM orders WHERE public_id IS NULL`).Scan(&count)
+		if err != nil {
+			// The column does not exist until Prepare has run
+			err = database.QueryRow(`SELECT COUNT(*) FROM orders`).Scan(&count)
+		}
+		return count, err
+	},
+}
+
+var migrationService *MigrationService
+
+// MigrationsHandler reports progress for every registered online migration.
+func MigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	progress, err := migrationService.AllProgress()
+	if err != nil {
+		log.Printf("Error retrieving migration progress: %v", err)
+		http.Error(w, "Failed to retrieve migration progress", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(progress)
+}
+
+// MigrationControlHandler starts or pauses an online migration.
+func MigrationControlHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Name   string `json:"name"`
+		Action string `json:"action"` // "start" or "pause"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if migrationService.find(request.Name) == nil {
+		http.Error(w, "Unknown migration", http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch request.Action {
+	case "start":
+		err = migrationService.Start(request.Name)
+	case "pause":
+		err = migrationService.Pause(request.Name)
+	default:
+		http.Error(w, "Invalid action parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error running %s on migration %s: %v", request.Action, request.Name, err)
+		http.Error(w, "Failed to update migration", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Online migration %s: %s", request.Name, request.Action)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Migration " + request.Action + " accepted",
+	})
+}
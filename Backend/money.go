@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in integer minor currency units (paise for INR, cents
+// for USD). Amounts are never held in floating point, so repeated additions
+// cannot drift. On the wire and in DECIMAL(10,2) columns Money is written as
+// an exact two-decimal number such as 1499.50.
+type Money int64
+
+// minorUnitDigits is the number of decimal places in the minor unit.
+const minorUnitDigits = 2
+
+// RoundingMode decides what happens to digits beyond the minor unit.
+type RoundingMode int
+
+const (
+	RoundHalfUp   RoundingMode = iota // 0.005 -> 0.01, commercial rounding
+	RoundHalfEven                     // 0.005 -> 0.00, 0.015 -> 0.02, banker's rounding
+)
+
+// RoundingRule describes how a tax jurisdiction rounds money.
+type RoundingRule struct {
+	Jurisdiction string
+	Mode         RoundingMode
+	// InvoiceIncrement is the step invoice totals are rounded to, in minor
+	// units (e.g. 100 to round Indian invoices to the nearest rupee).
+	InvoiceIncrement Money
+}
+
+// roundingRules are the supported jurisdictions, selected with TAX_JURISDICTION.
+var roundingRules = map[string]RoundingRule{
+	"IN": {Jurisdiction: "IN", Mode: RoundHalfUp, InvoiceIncrement: 100},
+	"US": {Jurisdiction: "US", Mode: RoundHalfUp, InvoiceIncrement: 1},
+	"EU": {Jurisdiction: "EU", Mode: RoundHalfUp, InvoiceIncrement: 1},
+	"GB": {Jurisdiction: "GB", Mode: RoundHalfEven, InvoiceIncrement: 1},
+}
+
+// activeRoundingRule returns the configured jurisdiction's rule (default IN).
+func activeRoundingRule() RoundingRule {
+	if rule, ok := roundingRules[strings.ToUpper(getEnv("TAX_JURISDICTION", "IN"))]; ok {
+		return rule
+	}
+	return roundingRules["IN"]
+}
+
+// ParseMoney converts a decimal string ("1499", "1499.5", "-12.345") to
+// Money without going through float64. Digits beyond the minor unit are
+// rounded with the active jurisdiction's rule.
+func ParseMoney(s string) (Money, error) {
+	return parseMoneyWithRule(s, activeRoundingRule())
+}
+
+func parseMoneyWithRule(s string, rule RoundingRule) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("empty amount")
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if !isDigits(whole) || (frac != "" && !isDigits(frac)) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	kept := frac
+	dropped := ""
+	if len(frac) > minorUnitDigits {
+		kept, dropped = frac[:minorUnitDigits], frac[minorUnitDigits:]
+	}
+	kept += strings.Repeat("0", minorUnitDigits-len(kept))
+
+	if len(whole)+len(kept) > 18 {
+		return 0, fmt.Errorf("amount %q is too large", s)
+	}
+	value, err := strconv.ParseInt(whole+kept, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if roundUp(dropped, value, rule.Mode) {
+		value++
+	}
+	if negative {
+		value = -value
+	}
+	return Money(value), nil
+}
+
+// roundUp decides whether the dropped digits carry into the last kept digit.
+// Rounding is applied to the magnitude, so negatives round symmetrically.
+func roundUp(dropped string, kept int64, mode RoundingMode) bool {
+	if dropped == "" || dropped[0] < '5' {
+		return false
+	}
+	if dropped[0] > '5' || strings.Trim(dropped[1:], "0") != "" {
+		return true
+	}
+	// Exactly half
+	if mode == RoundHalfEven {
+		return kept%2 == 1
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// String formats Money as an exact decimal, e.g. 1499.50.
+func (m Money) String() string {
+	sign := ""
+	value := int64(m)
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, value/100, value%100)
+}
+
+// RoundForInvoice rounds a total to the jurisdiction's invoice increment.
+func (m Money) RoundForInvoice(rule RoundingRule) Money {
+	step := int64(rule.InvoiceIncrement)
+	if step <= 1 {
+		return m
+	}
+
+	value := int64(m)
+	negative := value < 0
+	if negative {
+		value = -value
+	}
+	remainder := value % step
+	value -= remainder
+	half := step / 2
+	if remainder > half || (remainder == half && (rule.Mode == RoundHalfUp || (value/step)%2 == 1)) {
+		value += step
+	}
+	if negative {
+		value = -value
+	}
+	return Money(value)
+}
+
+// MulBasisPoints applies a rate given in basis points (1800 = 18%), e.g. for
+// tax or percentage discounts, rounding the result per the rule.
+func (m Money) MulBasisPoints(bps int64, rule RoundingRule) Money {
+	product := int64(m) * bps
+	negative := product < 0
+	if negative {
+		product = -product
+	}
+
+	quotient, remainder := product/10000, product%10000
+	if remainder*2 > 10000 || (remainder*2 == 10000 && (rule.Mode == RoundHalfUp || quotient%2 == 1)) {
+		quotient++
+	}
+	if negative {
+		quotient = -quotient
+	}
+	return Money(quotient)
+}
+
+// MarshalJSON writes Money as a JSON number with exactly two decimals.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or numeric string.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" {
+		*m = 0
+		return nil
+	}
+
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Scan reads DECIMAL columns, which the MySQL driver returns as text.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case []byte:
+		parsed, err := ParseMoney(string(v))
+		*m = parsed
+		return err
+	case string:
+		parsed, err := ParseMoney(v)
+		*m = parsed
+		return err
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into Money", src)
+}
+
+// Value writes Money to DECIMAL columns as an exact decimal string.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
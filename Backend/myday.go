@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// GET /api/v1/me/today gathers what the signed-in engineer has to deal with
+// today, for the app's home screen: their tickets due today and overdue,
+// their finished tickets still waiting on the delivery checks that sign
+// them off, their tickets held for parts once every part the diagnosis asked
+// for is in stock, and notes where someone mentioned them. A mention is
+// @ followed by the local part of the user's email (@priya for
+// priya@shop.example); mentions stay unread until POST
+// /api/v1/me/mentions/read. Tickets they have snoozed stay off it until
+// the snooze is due, then come back as follow_ups (snooze.go).
+
+const mentionReadsTable = `
+	CREATE TABLE IF NOT EXISTS mention_reads (
+		user_id VARCHAR(50) PRIMARY KEY,
+		read_at TIMESTAMP NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// mentionLookback is how far back mentions are looked for when the user
+// has never marked them read.
+const mentionLookback = 7 * 24 * time.Hour
+
+// myDayOpenClause is a SQL condition true for tickets still on the bench.
+const myDayOpenClause = `status IN ('New Order', 'Reopened', 'In Progress') AND deleted_at IS NULL`
+
+// myDayOverdueClause is true for open tickets past their promised date or
+// their running SLA. It takes today's date.
+const myDayOverdueClause = `(expected_delivery_date < ? OR (sla_due_at < NOW() AND hold_state IS NULL))`
+
+// PartsArrival is a ticket held for parts whose parts are all in stock.
+type PartsArrival struct {
+	Order Order           `json:"order"`
+	Parts []DiagnosisPart `json:"parts"`
+}
+
+// MyDay is an engineer's home screen.
+type MyDay struct {
+	Date           string         `json:"date"`
+	DueToday       []Order        `json:"due_today"`
+	Overdue        []Order        `json:"overdue"`
+	PendingQA      []Order        `json:"pending_qa"` // Ready, delivery checks not yet recorded
+	PartsArrived   []PartsArrival `json:"parts_arrived"`
+	Mentions       []TicketNote   `json:"mentions"`
+	UnreadMentions int            `json:"unread_mentions"`
+	FollowUps      []TicketSnooze `json:"follow_ups"` // Snoozes that have come due
+}
+
+// MyDayService builds engineers' home screens
+type MyDayService struct {
+	db *sql.DB
+}
+
+func NewMyDayService(database *sql.DB) *MyDayService {
+	return &MyDayService{db: database}
+}
+
+var myDayService *MyDayService
+
+// Today returns userID's day as of now.
+func (ms *MyDayService) Today(userID string, now time.Time) (*MyDay, error) {
+	today := now.Format("2006-01-02")
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := &MyDay{Date: today}
+
+	var err error
+	day.Overdue, err = orderService.queryOrders(`SELECT `+orderColumns+` FROM orders
+		WHERE assigned_engineer_id = ? AND `+myDayOpenClause+` AND `+myDayOverdueClause+` AND NOT `+snoozedClause+`
+		ORDER BY COALESCE(sla_due_at, expected_delivery_date), id`, userID, today, userID)
+	if err != nil {
+		return nil, err
+	}
+	day.DueToday, err = orderService.queryOrders(`SELECT `+orderColumns+` FROM orders
+		WHERE assigned_engineer_id = ? AND `+myDayOpenClause+` AND NOT `+myDayOverdueClause+`
+			AND (expected_delivery_date = ? OR (sla_due_at >= ? AND sla_due_at < ?)) AND NOT `+snoozedClause+`
+		ORDER BY COALESCE(sla_due_at, expected_delivery_date), id`,
+		userID, today, today, dayStart, dayStart.AddDate(0, 0, 1), userID)
+	if err != nil {
+		return nil, err
+	}
+	day.PendingQA, err = orderService.queryOrders(`SELECT `+orderColumns+` FROM orders
+		WHERE assigned_engineer_id = ? AND status = 'Ready for Delivery' AND deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM ticket_checklist_items c WHERE c.order_id = orders.id AND c.stage = ?)
+			AND NOT `+snoozedClause+`
+		ORDER BY updated_at, id`, userID, ChecklistDelivery, userID)
+	if err != nil {
+		return nil, err
+	}
+	if day.PartsArrived, err = ms.partsArrived(userID); err != nil {
+		return nil, err
+	}
+	if day.Mentions, err = ms.unreadMentions(userID, now); err != nil {
+		return nil, err
+	}
+	day.UnreadMentions = len(day.Mentions)
+	if day.FollowUps, err = snoozeService.List(userID, true); err != nil {
+		return nil, err
+	}
+	return day, nil
+}
+
+// partsArrived returns userID's tickets held for parts where every part
+// with a SKU in the latest diagnosis is now in stock.
+func (ms *MyDayService) partsArrived(userID string) ([]PartsArrival, error) {
+	held, err := orderService.queryOrders(`SELECT `+orderColumns+` FROM orders
+		WHERE assigned_engineer_id = ? AND hold_state = ? AND deleted_at IS NULL AND NOT `+snoozedClause+`
+		ORDER BY hold_started_at, id`, userID, HoldAwaitingParts, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	arrivals := []PartsArrival{}
+	for _, order := range held {
+		diagnosis, err := diagnosisService.Latest(order.ID)
+		if err != nil {
+			return nil, err
+		}
+		if diagnosis == nil {
+			continue
+		}
+		var parts []DiagnosisPart
+		inStock := true
+		for _, part := range diagnosis.PartsNeeded {
+			if part.SKU == "" {
+				continue
+			}
+			var onHand int
+			err := ms.db.QueryRow(`SELECT quantity_on_hand FROM parts WHERE sku = ?`, part.SKU).Scan(&onHand)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			if err == sql.ErrNoRows || onHand < part.Quantity {
+				inStock = false
+				break
+			}
+			parts = append(parts, part)
+		}
+		if inStock && len(parts) > 0 {
+			arrivals = append(arrivals, PartsArrival{Order: order, Parts: parts})
+		}
+	}
+	return arrivals, nil
+}
+
+// unreadMentions returns notes by others mentioning userID since they last
+// marked their mentions read, oldest first.
+func (ms *MyDayService) unreadMentions(userID string, now time.Time) ([]TicketNote, error) {
+	var email string
+	var readAt sql.NullTime
+	err := ms.db.QueryRow(`
+		SELECT u.email, m.read_at FROM users u LEFT JOIN mention_reads m ON m.user_id = u.id WHERE u.id = ?
+	`, userID).Scan(&email, &readAt)
+	if err != nil {
+		return nil, err
+	}
+	handle, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if handle == "" {
+		return []TicketNote{}, nil
+	}
+	since := now.Add(-mentionLookback)
+	if readAt.Valid {
+		since = readAt.Time
+	}
+
+	// LIKE narrows the notes down; the pattern stops @priya matching @priyanka
+	candidates, err := noteService.queryNotes(`WHERE n.body LIKE ? AND n.created_at > ? AND (n.author_id IS NULL OR n.author_id <> ?)`,
+		"%@"+handle+"%", since, userID)
+	if err != nil {
+		return nil, err
+	}
+	pattern := regexp.MustCompile(`(?i)(^|[^A-Za-z0-9._%+-])@` + regexp.QuoteMeta(handle) + `($|[^A-Za-z0-9._%+-]|\.(\s|$))`)
+	mentions := []TicketNote{}
+	for _, note := range candidates {
+		if pattern.MatchString(note.Body) {
+			mentions = append(mentions, note)
+		}
+	}
+	return mentions, nil
+}
+
+// MarkMentionsRead marks every mention of userID up to now as read.
+func (ms *MyDayService) MarkMentionsRead(userID string, now time.Time) error {
+	_, err := ms.db.Exec(`
+		INSERT INTO mention_reads (user_id, read_at) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE read_at = VALUES(read_at)
+	`, userID, now)
+	return err
+}
+
+// MyDayHandler returns the signed-in user's day.
+func MyDayHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := actorID(r)
+	if userID == "" {
+		http.Error(w, "This endpoint needs a signed-in user", http.StatusForbidden)
+		return
+	}
+
+	day, err := myDayService.Today(userID, time.Now())
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error building the day of %s: %v", userID, err)
+		http.Error(w, "Failed to retrieve your day", http.StatusInternalServerError)
+		return
+	}
+
+	policy := piiPolicyFor(r)
+	policy.shapeOrders(day.DueToday)
+	policy.shapeOrders(day.Overdue)
+	policy.shapeOrders(day.PendingQA)
+	for i := range day.PartsArrived {
+		orders := []Order{day.PartsArrived[i].Order}
+		policy.shapeOrders(orders)
+		day.PartsArrived[i].Order = orders[0]
+	}
+	json.NewEncoder(w).Encode(day)
+}
+
+// MentionsReadHandler marks the signed-in user's mentions read (POST).
+func MentionsReadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := actorID(r)
+	if userID == "" {
+		http.Error(w, "This endpoint needs a signed-in user", http.StatusForbidden)
+		return
+	}
+
+	if err := myDayService.MarkMentionsRead(userID, time.Now()); err != nil {
+		log.Printf("Error marking mentions of %s read: %v", userID, err)
+		http.Error(w, "Failed to mark mentions read", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Mentions marked as read",
+	})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Staff keep notes on a ticket: engineers log their findings, front desk
+// records what was said to the customer. A note is internal unless it is
+// marked customer-visible; customer-visible notes are shown on the order
+// tracker (GET /api/v1/orders/status) without their author. Only the author
+// or an Admin can edit a note, and edits keep the original timestamps.
+
+const ticketNotesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_notes (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		author_id VARCHAR(50) NULL,
+		visibility ENUM('internal', 'customer') NOT NULL DEFAULT 'internal',
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NULL,
+		updated_by VARCHAR(50) NULL,
+		INDEX idx_ticket_notes_order (order_id, created_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Note visibilities
+const (
+	NoteInternal = "internal"
+	NoteCustomer = "customer" // Shown on the order tracker
+)
+
+var noteVisibilities = []string{NoteInternal, NoteCustomer}
+
+// maxNoteLength caps the body of a note.
+const maxNoteLength = 5000
+
+// TicketNote is a staff note on a ticket.
+type TicketNote struct {
+	ID         int64      `json:"id"`
+	OrderID    string     `json:"order_id"`
+	AuthorID   string     `json:"author_id,omitempty"`
+	AuthorName string     `json:"author_name,omitempty"`
+	Visibility string     `json:"visibility"`
+	Body       string     `json:"body"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy  string     `json:"updated_by,omitempty"`
+}
+
+// CustomerNote is a customer-visible note as the order tracker shows it.
+type CustomerNote struct {
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NoteService handles ticket notes
+type NoteService struct {
+	db *sql.DB
+}
+
+func NewNoteService(database *sql.DB) *NoteService {
+	return &NoteService{db: database}
+}
+
+// AddNote stores a note on an existing ticket and tells its watchers.
+func (ns *NoteService) AddNote(note *TicketNote) error {
+	tx, err := ns.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow(`SELECT 1 FROM orders WHERE id = ?`, note.OrderID).Scan(&exists); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO ticket_notes (order_id, author_id, visibility, body) VALUES (?, ?, ?, ?)
+	`, note.OrderID, nullString(note.AuthorID), note.Visibility, note.Body)
+	if err != nil {
+		return err
+	}
+	if note.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	if err := notifyWatchers(tx, note.OrderID, note.AuthorID, "has a new "+note.Visibility+" note", truncate(note.Body, 500)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ns *NoteService) GetNote(id int64) (*TicketNote, error) {
+	notes, err := ns.queryNotes(`WHERE n.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(notes) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &notes[0], nil
+}
+
+// ListNotes returns a ticket's notes, oldest first, optionally only those
+// of one visibility.
+func (ns *NoteService) ListNotes(orderID, visibility string) ([]TicketNote, error) {
+	if visibility != "" {
+		return ns.queryNotes(`WHERE n.order_id = ? AND n.visibility = ?`, orderID, visibility)
+	}
+	return ns.queryNotes(`WHERE n.order_id = ?`, orderID)
+}
+
+// SearchNotes finds the notes containing term, newest first, across every
+// ticket or only orderID's. Voice note transcripts are found here too.
+func (ns *NoteService) SearchNotes(term, orderID string, limit int) ([]TicketNote, error) {
+	where := `body LIKE ?`
+	args := []interface{}{"%" + term + "%"}
+	if orderID != "" {
+		where += ` AND order_id = ?`
+		args = append(args, orderID)
+	}
+	// The extra derived table lets MySQL take a LIMIT inside IN
+	notes, err := ns.queryNotes(`WHERE n.id IN (SELECT id FROM (
+		SELECT id FROM ticket_notes WHERE `+where+` ORDER BY created_at DESC, id DESC LIMIT ?) matches)`,
+		append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(notes)
+	return notes, nil
+}
+
+// UpdateNote changes the body and visibility of a note.
+func (ns *NoteService) UpdateNote(id int64, body, visibility, actorID string) error {
+	result, err := ns.db.Exec(`
+		UPDATE ticket_notes SET body = ?, visibility = ?, updated_at = NOW(), updated_by = ? WHERE id = ?
+	`, body, visibility, nullString(actorID), id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CustomerNotes returns the notes shown on a ticket's order tracker.
+func (ns *NoteService) CustomerNotes(orderID string) ([]CustomerNote, error) {
+	rows, err := ns.db.Query(`
+		SELECT body, created_at FROM ticket_notes WHERE order_id = ? AND visibility = ? ORDER BY created_at, id
+	`, orderID, NoteCustomer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []CustomerNote{}
+	for rows.Next() {
+		var note CustomerNote
+		if err := rows.Scan(&note.Body, &note.CreatedAt); err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+func (ns *NoteService) queryNotes(where string, args ...interface{}) ([]TicketNote, error) {
+	rows, err := ns.db.Query(`
+		SELECT n.id, n.order_id, n.author_id, u.full_name, n.visibility, n.body, n.created_at, n.updated_at, n.updated_by
+		FROM ticket_notes n LEFT JOIN users u ON u.id = n.author_id
+		`+where+` ORDER BY n.created_at, n.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []TicketNote{}
+	for rows.Next() {
+		var note TicketNote
+		var authorID, authorName, updatedBy sql.NullString
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&note.ID, &note.OrderID, &authorID, &authorName, &note.Visibility, &note.Body,
+			&note.CreatedAt, &updatedAt, &updatedBy); err != nil {
+			return nil, err
+		}
+		note.AuthorID = authorID.String
+		note.AuthorName = authorName.String
+		note.UpdatedAt = timePtr(updatedAt)
+		note.UpdatedBy = updatedBy.String
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+var noteService *NoteService
+
+// validateNote checks a note's body and visibility, defaulting the
+// visibility to internal.
+func validateNote(body, visibility *string, fieldErrors *ValidationErrors) {
+	*body = strings.TrimSpace(*body)
+	if *body == "" {
+		fieldErrors.Add("body", "is required")
+	} else if len(*body) > maxNoteLength {
+		fieldErrors.Add("body", "is too long")
+	}
+	if *visibility == "" {
+		*visibility = NoteInternal
+	}
+	if !slices.Contains(noteVisibilities, *visibility) {
+		fieldErrors.Add("visibility", "must be internal or customer")
+	}
+}
+
+// TicketNotesHandler lists a ticket's notes (GET ?order_id=&visibility=),
+// searches notes on one ticket or all of them (GET ?q=&order_id=), adds one
+// (POST {"order_id": "...", "body": "...", "visibility": "customer"}) or
+// edits one (PUT {"id": 12, "body": "...", "visibility": "internal"}).
+func TicketNotesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		orderID := r.URL.Query().Get("order_id")
+		if term := strings.TrimSpace(r.URL.Query().Get("q")); term != "" {
+			notes, err := noteService.SearchNotes(term, orderID, 50)
+			if err != nil {
+				log.Printf("Error searching notes for %q: %v", term, err)
+				http.Error(w, "Failed to search notes", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(notes)
+			return
+		}
+		if orderID == "" {
+			http.Error(w, "order_id is required", http.StatusBadRequest)
+			return
+		}
+		visibility := r.URL.Query().Get("visibility")
+		if visibility != "" && !slices.Contains(noteVisibilities, visibility) {
+			http.Error(w, "visibility must be internal or customer", http.StatusBadRequest)
+			return
+		}
+
+		notes, err := noteService.ListNotes(orderID, visibility)
+		if err != nil {
+			log.Printf("Error listing notes of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve notes", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(notes)
+
+	case "POST":
+		var request struct {
+			OrderID    string `json:"order_id"`
+			Body       string `json:"body"`
+			Visibility string `json:"visibility"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		validateNote(&request.Body, &request.Visibility, &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		note := &TicketNote{
+			OrderID:    request.OrderID,
+			AuthorID:   actorID(r),
+			Visibility: request.Visibility,
+			Body:       request.Body,
+		}
+		err := noteService.AddNote(note)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error adding note to order %s: %v", request.OrderID, err)
+			http.Error(w, "Failed to add note", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditTicketNoteAdded, "order", note.OrderID, nil, request)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Note added successfully",
+			"id":      note.ID,
+		})
+
+	case "PUT":
+		var request struct {
+			ID         int64  `json:"id"`
+			Body       string `json:"body"`
+			Visibility string `json:"visibility"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if request.ID == 0 {
+			fieldErrors.Add("id", "is required")
+		}
+		validateNote(&request.Body, &request.Visibility, &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		note, err := noteService.GetNote(request.ID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Note not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrieving note %d: %v", request.ID, err)
+			http.Error(w, "Failed to update note", http.StatusInternalServerError)
+			return
+		}
+		if note.AuthorID != actorID(r) && !hasRole(r, RoleAdmin) {
+			http.Error(w, "Only the author can edit this note", http.StatusForbidden)
+			return
+		}
+
+		if err := noteService.UpdateNote(request.ID, request.Body, request.Visibility, actorID(r)); err != nil {
+			log.Printf("Error updating note %d: %v", request.ID, err)
+			http.Error(w, "Failed to update note", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditTicketNoteEdited, "order", note.OrderID,
+			map[string]string{"body": note.Body, "visibility": note.Visibility}, request)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Note updated successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
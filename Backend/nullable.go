@@ -0,0 +1,31 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Helpers for moving values between nullable columns and read models.
+// Read models expose optional strings with omitempty and optional times as
+// pointers, so a NULL renders as an absent field rather than "" or 0001-01-01.
+
+// nullString stores "" as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func timePtr(nt sql.NullTime) *time.Time {
+	if !nt.Valid {
+		return nil
+	}
+	t := nt.Time
+	return &t
+}
+
+func intPtr(ni sql.NullInt64) *int {
+	if !ni.Valid {
+		return nil
+	}
+	i := int(ni.Int64)
+	return &i
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Typing a 20-character serial off a device label is slow and error-prone.
+// At intake, staff can photograph the label and POST it to
+// /api/v1/devices/label-scan, which runs it through a label reader and
+// returns the serial (or IMEI) and model it found so the device fields can be
+// pre-filled for staff to confirm. Nothing is stored. The reader is chosen
+// with OCR_PROVIDER: "tesseract" runs the local Tesseract binary, "http"
+// posts the image to a cloud OCR service, and the scan is off when it is
+// unset. Readers only return the text; picking out the fields is done here
+// from the usual label markings (S/N, IMEI, Model).
+
+// Label reader providers
+const (
+	OCRTesseract = "tesseract"
+	OCRHTTP      = "http"
+)
+
+// maxLabelImageBytes caps the photo of a device label.
+const maxLabelImageBytes = 10 << 20
+
+// labelImageTypes are the photo formats label readers accept.
+var labelImageTypes = []string{"image/jpeg", "image/png"}
+
+// OCRConfig selects and configures the label reader.
+type OCRConfig struct {
+	Provider      string
+	TesseractPath string
+	APIURL        string
+	APIKey        string
+	Timeout       time.Duration
+}
+
+// getOCRConfig reads the OCR_* environment variables.
+func getOCRConfig() (OCRConfig, error) {
+	config := OCRConfig{
+		Provider:      getEnv("OCR_PROVIDER", ""),
+		TesseractPath: getEnv("OCR_TESSERACT_PATH", "tesseract"),
+		APIURL:        getEnv("OCR_API_URL", ""),
+		APIKey:        getEnv("OCR_API_KEY", ""),
+	}
+	timeout, err := time.ParseDuration(getEnv("OCR_TIMEOUT", "20s"))
+	if err != nil || timeout <= 0 {
+		return config, fmt.Errorf("OCR_TIMEOUT must be a positive duration")
+	}
+	config.Timeout = timeout
+	switch config.Provider {
+	case "", OCRTesseract:
+	case OCRHTTP:
+		if config.APIURL == "" {
+			return config, fmt.Errorf("OCR_API_URL is required when OCR_PROVIDER is http")
+		}
+	default:
+		return config, fmt.Errorf("OCR_PROVIDER must be tesseract or http")
+	}
+	return config, nil
+}
+
+// LabelReader returns the text printed on a photographed label.
+type LabelReader interface {
+	ReadText(ctx context.Context, image []byte, contentType string) (string, error)
+}
+
+// tesseractLabelReader pipes the image through the tesseract command line.
+type tesseractLabelReader struct {
+	path string
+}
+
+func (tr *tesseractLabelReader) ReadText(ctx context.Context, image []byte, contentType string) (string, error) {
+	// Page segmentation mode 11 finds sparse text, as on a sticker
+	cmd := exec.CommandContext(ctx, tr.path, "stdin", "stdout", "--psm", "11")
+	cmd.Stdin = bytes.NewReader(image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract: %w: %s", err, truncate(strings.TrimSpace(stderr.String()), 200))
+	}
+	return string(out), nil
+}
+
+// httpLabelReader posts the image to {url} with its content type and reads
+// {"text": "..."}.
+type httpLabelReader struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (hr *httpLabelReader) ReadText(ctx context.Context, image []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hr.url, bytes.NewReader(image))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	if hr.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+hr.apiKey)
+	}
+
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("OCR service returned %s", resp.Status)
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", fmt.Errorf("OCR service response: %w", err)
+	}
+	return result.Text, nil
+}
+
+// LabelScanService reads device labels with the configured reader
+type LabelScanService struct {
+	reader  LabelReader // nil when scanning is off
+	timeout time.Duration
+}
+
+func NewLabelScanService(config OCRConfig) *LabelScanService {
+	service := &LabelScanService{timeout: config.Timeout}
+	switch config.Provider {
+	case OCRTesseract:
+		service.reader = &tesseractLabelReader{path: config.TesseractPath}
+	case OCRHTTP:
+		service.reader = &httpLabelReader{url: config.APIURL, apiKey: config.APIKey, client: &http.Client{Timeout: config.Timeout}}
+	}
+	return service
+}
+
+var labelScanService *LabelScanService
+
+// Enabled reports whether a label reader is configured.
+func (ls *LabelScanService) Enabled() bool {
+	return ls.reader != nil
+}
+
+// Scan reads image and picks the device fields out of its text.
+func (ls *LabelScanService) Scan(ctx context.Context, image []byte, contentType string) (*LabelScan, error) {
+	ctx, cancel := context.WithTimeout(ctx, ls.timeout)
+	defer cancel()
+	text, err := ls.reader.ReadText(ctx, image, contentType)
+	if err != nil {
+		return nil, err
+	}
+	scan := parseDeviceLabel(text)
+	return &scan, nil
+}
+
+// LabelScan is what was read off a device label. DeviceSerial and
+// DeviceModel are the best guesses; the candidates list everything that
+// looked like one, for staff to pick from.
+type LabelScan struct {
+	DeviceSerial     string   `json:"device_serial,omitempty"`
+	DeviceModel      string   `json:"device_model,omitempty"`
+	SerialCandidates []string `json:"serial_candidates"`
+	ModelCandidates  []string `json:"model_candidates"`
+	Text             string   `json:"text"`
+}
+
+var (
+	labelSerialPattern = regexp.MustCompile(`(?i)\b(?:S/?N|SERIAL(?:\s*(?:NO|NUMBER))?|SERVICE\s*TAG)[\s.:#]+([A-Z0-9][A-Z0-9-]{4,29})\b`)
+	labelIMEIPattern   = regexp.MustCompile(`(?i)\bIMEI\s*\d?[\s.:#]+(\d{15})\b`)
+	labelModelPattern  = regexp.MustCompile(`(?i)\b(?:MODEL(?:\s*(?:NO|NUMBER|NAME))?|MOD|M/N)[\s.:#]+([A-Z0-9][A-Z0-9 ./()-]{1,48})`)
+	// labelFieldStart ends a model name running into the next marking
+	labelFieldStart = regexp.MustCompile(`(?i)\s+(?:S/?N|SERIAL|SERVICE\s*TAG|IMEI|P/N|REV|FCC|MADE IN)\b.*$`)
+)
+
+// luhnValid reports whether digits pass the Luhn check, as every IMEI does.
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// parseDeviceLabel picks serials, IMEIs and model names out of label text,
+// line by line. A labelled serial number is preferred over an IMEI.
+func parseDeviceLabel(text string) LabelScan {
+	scan := LabelScan{SerialCandidates: []string{}, ModelCandidates: []string{}, Text: text}
+	var imeis []string
+	addUnique := func(list []string, value string) []string {
+		if value == "" || slices.Contains(list, value) {
+			return list
+		}
+		return append(list, value)
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		for _, match := range labelIMEIPattern.FindAllStringSubmatch(line, -1) {
+			if luhnValid(match[1]) {
+				imeis = addUnique(imeis, match[1])
+			}
+		}
+		for _, match := range labelSerialPattern.FindAllStringSubmatch(line, -1) {
+			scan.SerialCandidates = addUnique(scan.SerialCandidates, strings.ToUpper(match[1]))
+		}
+		for _, match := range labelModelPattern.FindAllStringSubmatch(line, -1) {
+			model := labelFieldStart.ReplaceAllString(match[1], "")
+			scan.ModelCandidates = addUnique(scan.ModelCandidates, strings.TrimSpace(model))
+		}
+	}
+	for _, imei := range imeis {
+		scan.SerialCandidates = addUnique(scan.SerialCandidates, imei)
+	}
+	if len(scan.SerialCandidates) > 0 {
+		scan.DeviceSerial = scan.SerialCandidates[0]
+	}
+	if len(scan.ModelCandidates) > 0 {
+		scan.DeviceModel = scan.ModelCandidates[0]
+	}
+	return scan
+}
+
+// LabelScanHandler reads a photo of a device label, sent as the multipart
+// field "file", and returns the fields found on it.
+func LabelScanHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasPermission(r, PermTicketsCreate) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+	if !labelScanService.Enabled() {
+		http.Error(w, "Label scanning is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Image must be at most %d MB", maxLabelImageBytes>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "A multipart file field named \"file\" is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxLabelImageBytes {
+		http.Error(w, fmt.Sprintf("Image must be at most %d MB", maxLabelImageBytes>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	image, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read image", http.StatusBadRequest)
+		return
+	}
+	contentType := detectContentType(header.Header.Get("Content-Type"), image[:min(len(image), 512)])
+	if !slices.Contains(labelImageTypes, contentType) {
+		http.Error(w, "Image must be a JPEG or PNG photo", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	scan, err := labelScanService.Scan(r.Context(), image, contentType)
+	if err != nil {
+		log.Printf("Error reading device label for %s: %v", actorID(r), err)
+		http.Error(w, "Failed to read label", http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("Device label scanned by %s: %d serial and %d model candidates", actorID(r),
+		len(scan.SerialCandidates), len(scan.ModelCandidates))
+	json.NewEncoder(w).Encode(scan)
+}
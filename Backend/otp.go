@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const passwordResetsTable = `
+	CREATE TABLE IF NOT EXISTS password_resets (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		user_id VARCHAR(50) NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP NOT NULL,
+		verified_at TIMESTAMP NULL,
+		reset_token_hash CHAR(64) NULL UNIQUE,
+		reset_expires_at TIMESTAMP NULL,
+		consumed_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_password_resets_user (user_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Errors returned by the OTP flow
+var (
+	ErrOTPInvalid        = errors.New("verification code is invalid or expired")
+	ErrOTPTooManyTries   = errors.New("too many incorrect attempts")
+	ErrResetTokenInvalid = errors.New("reset token is invalid or expired")
+)
+
+// SMSProvider sends text messages.
+type SMSProvider interface {
+	Send(phone, message string) error
+}
+
+// logSMSProvider prints messages to the log instead of sending them; it is
+// used when no SMS gateway is configured (development).
+type logSMSProvider struct{}
+
+func (logSMSProvider) Send(phone, message string) error {
+	log.Printf("SMS to %s: %s", phone, message)
+	return nil
+}
+
+// httpSMSProvider posts messages to a generic JSON SMS gateway.
+type httpSMSProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (hp *httpSMSProvider) Send(phone, message string) error {
+	body, err := json.Marshal(map[string]string{"to": phone, "message": message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", hp.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+hp.apiKey)
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+func newSMSProvider() SMSProvider {
+	url := getEnv("SMS_API_URL", "")
+	if url == "" {
+		return logSMSProvider{}
+	}
+	return &httpSMSProvider{
+		url:    url,
+		apiKey: getEnv("SMS_API_KEY", ""),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PasswordResetService issues and checks one-time codes for password resets.
+type PasswordResetService struct {
+	db          *sql.DB
+	sms         SMSProvider
+	codeTTL     time.Duration
+	resetTTL    time.Duration
+	maxAttempts int
+}
+
+func NewPasswordResetService(database *sql.DB, sms SMSProvider) *PasswordResetService {
+	return &PasswordResetService{
+		db:          database,
+		sms:         sms,
+		codeTTL:     getEnvDuration("OTP_TTL", 10*time.Minute),
+		resetTTL:    getEnvDuration("RESET_TOKEN_TTL", 15*time.Minute),
+		maxAttempts: getEnvInt("OTP_MAX_ATTEMPTS", 5),
+	}
+}
+
+func generateOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// otpHash binds the code to the user so equal codes never share a hash.
+func otpHash(userID, code string) string {
+	return hashToken(userID + ":" + code)
+}
+
+// SendCode replaces any outstanding code for the user and texts a new one.
+// The code is sent synchronously: it is useless once it expires, so it is
+// not queued through the outbox.
+func (prs *PasswordResetService) SendCode(user *User) error {
+	code, err := generateOTP()
+	if err != nil {
+		return err
+	}
+
+	tx, err := prs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE password_resets SET consumed_at = NOW() WHERE user_id = ? AND consumed_at IS NULL`, user.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO password_resets (user_id, code_hash, expires_at) VALUES (?, ?, ?)`,
+		user.ID, otpHash(user.ID, code), time.Now().Add(prs.codeTTL))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Your PC Repair Hub password reset code is %s. It expires in %d minutes.",
+		code, int(prs.codeTTL.Minutes()))
+	return prs.sms.Send(user.Phone, message)
+}
+
+// VerifyCode checks a code and, if it matches, returns a single-use reset token.
+func (prs *PasswordResetService) VerifyCode(user *User, code string) (string, error) {
+	var id int64
+	var codeHash string
+	var attempts int
+	err := prs.db.QueryRow(`
+		SELECT id, code_hash, attempts FROM password_resets
+		WHERE user_id = ? AND consumed_at IS NULL AND verified_at IS NULL AND expires_at > NOW()
+		ORDER BY id DESC LIMIT 1
+	`, user.ID).Scan(&id, &codeHash, &attempts)
+	if err == sql.ErrNoRows {
+		return "", ErrOTPInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if attempts >= prs.maxAttempts {
+		return "", ErrOTPTooManyTries
+	}
+
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(otpHash(user.ID, code))) != 1 {
+		prs.db.Exec(`UPDATE password_resets SET attempts = attempts + 1 WHERE id = ?`, id)
+		if attempts+1 >= prs.maxAttempts {
+			return "", ErrOTPTooManyTries
+		}
+		return "", ErrOTPInvalid
+	}
+
+	resetToken, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = prs.db.Exec(`
+		UPDATE password_resets SET verified_at = NOW(), reset_token_hash = ?, reset_expires_at = ?
+		WHERE id = ?
+	`, hashToken(resetToken), time.Now().Add(prs.resetTTL), id)
+	if err != nil {
+		return "", err
+	}
+
+	return resetToken, nil
+}
+
+// ConsumeResetToken marks a reset token used and returns its user ID.
+func (prs *PasswordResetService) ConsumeResetToken(resetToken string) (string, error) {
+	tx, err := prs.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var userID string
+	err = tx.QueryRow(`
+		SELECT id, user_id FROM password_resets
+		WHERE reset_token_hash = ? AND consumed_at IS NULL AND reset_expires_at > NOW()
+		FOR UPDATE
+	`, hashToken(resetToken)).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		return "", ErrResetTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec(`UPDATE password_resets SET consumed_at = NOW() WHERE id = ?`, id); err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
+
+var passwordResetService *PasswordResetService
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notifications and webhooks are never sent from request handlers. Instead a
+// message is written to the outbox in the same transaction as the ticket
+// change, and the worker delivers it afterwards. A message is only marked
+// delivered after every notifier accepted it, so delivery is at-least-once
+// even if the process crashes mid-way.
+
+const outboxTable = `
+	CREATE TABLE IF NOT EXISTS outbox (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		topic VARCHAR(100) NOT NULL,
+		aggregate_id VARCHAR(50) NOT NULL,
+		payload JSON NOT NULL,
+		status ENUM('pending', 'delivered', 'dead') NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		locked_until TIMESTAMP NULL,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP NULL,
+		INDEX idx_outbox_pending (status, next_attempt_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// OutboxMessage is a notification waiting to be delivered.
+type OutboxMessage struct {
+	ID          int64           `json:"id"`
+	Topic       string          `json:"topic"`
+	AggregateID string          `json:"aggregate_id"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// outboxTopics maps ticket events to the notification topics they publish.
+var outboxTopics = map[string]string{
+	EventTicketCreated:   "ticket.created",
+	EventStatusChanged:   "ticket.status_changed",
+	EventPaymentRecorded: "ticket.payment_recorded",
+	EventTicketCancelled: "ticket.cancelled",
+	EventTicketHeld:      "ticket.held",
+	EventTicketReleased:  "ticket.released",
+	EventTicketReopened:  "ticket.reopened",
+}
+
+// enqueueOutbox stores a message for later delivery. It must be called with
+// the transaction that performs the change being announced.
+func enqueueOutbox(tx *sql.Tx, topic, aggregateID string, payload interface{}) error {
+	// Synthetic load test tickets (loadtest.go) announce nothing
+	if isLoadTestTicket(aggregateID) {
+		return nil
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO outbox (topic, aggregate_id, payload) VALUES (?, ?, ?)`,
+		topic, aggregateID, string(payloadJSON))
+	return err
+}
+
+// Notifier delivers an outbox message to one destination.
+type Notifier interface {
+	Name() string
+	Deliver(msg OutboxMessage) error
+}
+
+// logNotifier writes messages to the server log; useful in development.
+type logNotifier struct{}
+
+func (logNotifier) Name() string { return "log" }
+
+func (logNotifier) Deliver(msg OutboxMessage) error {
+	log.Printf("Notification %s for %s: %s", msg.Topic, msg.AggregateID, msg.Payload)
+	return nil
+}
+
+// webhookNotifier POSTs messages to an HTTP endpoint, signing the body with
+// HMAC-SHA256 so receivers can verify it came from us.
+type webhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (wn *webhookNotifier) Name() string { return "webhook" }
+
+func (wn *webhookNotifier) Deliver(msg OutboxMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-PCHub-Topic", msg.Topic)
+	// Receivers de-duplicate redeliveries on this ID
+	req.Header.Set("X-PCHub-Delivery", fmt.Sprintf("%d", msg.ID))
+	if wn.secret != "" {
+		mac := hmac.New(sha256.New, []byte(wn.secret))
+		mac.Write(body)
+		req.Header.Set("X-PCHub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OutboxService drains the outbox.
+type OutboxService struct {
+	db          *sql.DB
+	notifiers   []Notifier
+	batchSize   int
+	maxAttempts int
+	lease       time.Duration
+}
+
+func NewOutboxService(database *sql.DB) *OutboxService {
+	service := &OutboxService{
+		db:          database,
+		notifiers:   []Notifier{logNotifier{}},
+		batchSize:   getEnvInt("OUTBOX_BATCH_SIZE", 50),
+		maxAttempts: getEnvInt("OUTBOX_MAX_ATTEMPTS", 10),
+		lease:       getEnvDuration("OUTBOX_LEASE", time.Minute),
+	}
+
+	if url := getEnv("WEBHOOK_URL", ""); url != "" {
+		service.notifiers = append(service.notifiers, &webhookNotifier{
+			url:    url,
+			secret: getEnv("WEBHOOK_SECRET", ""),
+			client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
+	if getEnv("EMAIL_API_URL", "") != "" {
+		service.notifiers = append(service.notifiers, emailNotifier{})
+	}
+
+	return service
+}
+
+// claimBatch leases due messages so concurrent workers never pick the same
+// rows. An expired lease (e.g. after a crash) makes a message due again.
+func (obs *OutboxService) claimBatch(ctx context.Context) ([]OutboxMessage, error) {
+	tx, err := obs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, topic, aggregate_id, payload, attempts, created_at
+		FROM outbox
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		  AND (locked_until IS NULL OR locked_until < NOW())
+		ORDER BY id
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	`, obs.batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []OutboxMessage
+	var ids []interface{}
+	for rows.Next() {
+		var msg OutboxMessage
+		var payload []byte
+		if err := rows.Scan(&msg.ID, &msg.Topic, &msg.AggregateID, &payload, &msg.Attempts, &msg.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		msg.Payload = payload
+		messages = append(messages, msg)
+		ids = append(ids, msg.ID)
+	}
+	rows.Close()
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := append([]interface{}{int(obs.lease.Seconds())}, ids...)
+	_, err = tx.ExecContext(ctx, `
+		UPDATE outbox SET locked_until = DATE_ADD(NOW(), INTERVAL ? SECOND), attempts = attempts + 1
+		WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, tx.Commit()
+}
+
+// Drain delivers one batch of due messages.
+func (obs *OutboxService) Drain(ctx context.Context) error {
+	messages, err := obs.claimBatch(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		if err := obs.deliver(msg); err != nil {
+			obs.retry(msg, err)
+			continue
+		}
+		obs.db.Exec(`UPDATE outbox SET status = 'delivered', delivered_at = NOW(), locked_until = NULL WHERE id = ?`, msg.ID)
+	}
+	return nil
+}
+
+func (obs *OutboxService) deliver(msg OutboxMessage) error {
+	for _, notifier := range obs.notifiers {
+		if err := notifier.Deliver(msg); err != nil {
+			return fmt.Errorf("%s: %w", notifier.Name(), err)
+		}
+	}
+	return nil
+}
+
+// retry schedules the next attempt with exponential backoff, or parks the
+// message as dead once it has used up its attempts.
+func (obs *OutboxService) retry(msg OutboxMessage, cause error) {
+	attempts := msg.Attempts + 1
+	log.Printf("Outbox message %d (%s) attempt %d failed: %v", msg.ID, msg.Topic, attempts, cause)
+
+	if attempts >= obs.maxAttempts {
+		obs.db.Exec(`UPDATE outbox SET status = 'dead', last_error = ?, locked_until = NULL WHERE id = ?`, cause.Error(), msg.ID)
+		return
+	}
+
+	backoff := time.Duration(1<<uint(attempts)) * 5 * time.Second
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	obs.db.Exec(`
+		UPDATE outbox SET last_error = ?, locked_until = NULL, next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+		WHERE id = ?
+	`, cause.Error(), int(backoff.Seconds()), msg.ID)
+}
+
+var outboxService *OutboxService
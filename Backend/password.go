@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func getBcryptCost() int {
+	cost := getEnvInt("BCRYPT_COST", bcrypt.DefaultCost)
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		log.Printf("BCRYPT_COST %d is out of range, using %d", cost, bcrypt.DefaultCost)
+		return bcrypt.DefaultCost
+	}
+	return cost
+}
+
+// isBcryptHash reports whether a stored password is already a bcrypt hash
+// rather than a legacy plaintext value.
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// HashPassword returns the bcrypt hash of password using the configured cost.
+func (us *UserService) HashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), us.bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// VerifyPassword checks password against the user's stored credential.
+// Accounts still holding a legacy plaintext password, or a hash made with a
+// different cost, are transparently re-hashed after a successful match.
+func (us *UserService) VerifyPassword(user *User, password string) (bool, error) {
+	if !isBcryptHash(user.Password) {
+		if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+			return false, nil
+		}
+
+		log.Printf("Migrating legacy plaintext password for user %s to bcrypt", user.ID)
+		return true, us.UpdateUserPassword(user.ID, password)
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if cost, err := bcrypt.Cost([]byte(user.Password)); err == nil && cost != us.bcryptCost {
+		if err := us.UpdateUserPassword(user.ID, password); err != nil {
+			log.Printf("Error re-hashing password for user %s: %v", user.ID, err)
+		}
+	}
+
+	return true, nil
+}
+
+// bootstrapAdminID is the administrator account the schema seeds.
+const bootstrapAdminID = "ADMIN-001"
+
+// minBootstrapPasswordLength keeps the first admin password out of reach of
+// guessing.
+const minBootstrapPasswordLength = 12
+
+// legacyAdminPassword is the password older seeds gave the admin account;
+// it is treated as no password at all.
+const legacyAdminPassword = "admin123"
+
+// bootstrapAdmin gives the seeded admin account its password from
+// ADMIN_BOOTSTRAP_PASSWORD while it has none (or still has the old default),
+// creating the account as ADMIN_BOOTSTRAP_EMAIL when no admin exists. Once
+// the admin has a password of its own the setting is ignored.
+func (us *UserService) bootstrapAdmin() error {
+	var stored string
+	err := us.db.QueryRow(`SELECT password FROM users WHERE id = ?`, bootstrapAdminID).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	exists := err == nil
+	if !exists {
+		var admins int
+		if err := us.db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, RoleAdmin).Scan(&admins); err != nil {
+			return err
+		}
+		if admins > 0 {
+			return nil
+		}
+	} else if stored != "" && stored != legacyAdminPassword {
+		return nil
+	}
+
+	password := getEnv("ADMIN_BOOTSTRAP_PASSWORD", "")
+	if len(password) < minBootstrapPasswordLength || password == legacyAdminPassword {
+		return fmt.Errorf("the admin account has no password: set ADMIN_BOOTSTRAP_PASSWORD (at least %d characters)",
+			minBootstrapPasswordLength)
+	}
+	if exists {
+		log.Printf("Setting the password of admin account %s from ADMIN_BOOTSTRAP_PASSWORD", bootstrapAdminID)
+		return us.UpdateUserPassword(bootstrapAdminID, password)
+	}
+
+	admin := &User{
+		ID:       bootstrapAdminID,
+		FullName: "System Administrator",
+		Email:    getEnv("ADMIN_BOOTSTRAP_EMAIL", "admin@pchub.com"),
+		Password: password,
+		Role:     RoleAdmin,
+		Approved: true,
+	}
+	log.Printf("Creating admin account %s for %s from ADMIN_BOOTSTRAP_PASSWORD", admin.ID, admin.Email)
+	return us.CreateUser(admin)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Roles decide who is staff; permissions decide what each staff role may do.
+// Shop owners edit the role-permission matrix at runtime instead of waiting
+// for a code change. Admin always holds every permission so the matrix can
+// never lock the owner out.
+
+const permissionsTable = `
+	CREATE TABLE IF NOT EXISTS permissions (
+		name VARCHAR(64) PRIMARY KEY,
+		description VARCHAR(255) NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const rolePermissionsTable = `
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role VARCHAR(20) NOT NULL,
+		permission VARCHAR(64) NOT NULL,
+		granted_by VARCHAR(50) NULL,
+		granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (role, permission),
+		FOREIGN KEY (permission) REFERENCES permissions(name) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Permissions checked by handlers
+const (
+	PermTicketsCreate        = "tickets.create"
+	PermTicketsUpdateStatus  = "tickets.update_status"
+	PermTicketsUpdatePrice   = "tickets.update_price"
+	PermTicketsEdit          = "tickets.edit"
+	PermTicketsCancel        = "tickets.cancel"
+	PermPaymentsRecord       = "payments.record"
+	PermEstimatesPublish     = "estimates.publish"
+	PermBackupsVerify        = "backups.verify"
+	PermVisitsAttend         = "visits.attend"
+	PermBuildsAssemble       = "builds.assemble"
+	PermBuildsInvoice        = "builds.invoice"
+	PermTradeInPurchase      = "tradein.purchase"
+	PermTradeInOverride      = "tradein.override_price"
+	PermReportsViewRevenue   = "reports.view_revenue"
+	PermCostsRecord          = "costs.record"
+	PermTheftOverride        = "tickets.theft_override"
+	PermTicketsAssign        = "tickets.assign"
+	PermPartsWastage         = "parts.record_wastage"
+	PermPartsCores           = "parts.return_cores"
+	PermPartsReceive         = "parts.receive"
+	PermTicketsMerge         = "tickets.merge"
+	PermRecallsManage        = "recalls.manage"
+	PermCertificationsManage = "certifications.manage"
+	PermTicketsReopen        = "tickets.reopen"
+	PermEstimatesDecide      = "estimates.record_decision"
+	PermTicketsCaseFile      = "tickets.export_case_file"
+	PermAccountsManage       = "accounts.manage"
+	PermQuotesIssue          = "quotes.issue"
+	PermDiagnosisEdit        = "diagnosis.edit"
+	PermVoiceNotesRecord     = "voice_notes.record"
+	PermPartsStocktake       = "parts.stocktake"
+)
+
+// Permission is one entry of the catalogue with the roles it starts with.
+type Permission struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	DefaultRoles []string `json:"-"`
+}
+
+// permissionCatalog lists every permission. Defaults match what each role
+// could do before the matrix existed and are applied only the first time a
+// permission is seen, so an owner's changes survive restarts.
+var permissionCatalog = []Permission{
+	{PermTicketsCreate, "Book in new tickets", []string{RoleEngineer, RoleFrontDesk}},
+	{PermTicketsUpdateStatus, "Change ticket status (subject to the per-status role rules)", []string{RoleEngineer, RoleFrontDesk}},
+	{PermTicketsUpdatePrice, "Add billable items to a ticket", []string{RoleEngineer}},
+	{PermTicketsEdit, "Edit ticket details after intake", []string{RoleEngineer, RoleFrontDesk}},
+	{PermTicketsCancel, "Cancel a ticket with a reason", []string{RoleFrontDesk}},
+	{PermPaymentsRecord, "Record payments against a ticket", []string{RoleFrontDesk}},
+	{PermEstimatesPublish, "Publish estimate options for the customer", []string{RoleEngineer}},
+	{PermBackupsVerify, "Verify data backup jobs", []string{RoleEngineer}},
+	{PermVisitsAttend, "Check in and out of on-site visits", []string{RoleEngineer}},
+	{PermBuildsAssemble, "Complete build checklists and burn-in tests", []string{RoleEngineer}},
+	{PermBuildsInvoice, "Invoice finished builds", []string{RoleFrontDesk}},
+	{PermTradeInPurchase, "Record buyback purchases and resales", []string{RoleFrontDesk}},
+	{PermTradeInOverride, "Pay other than the valuation matrix offer", nil},
+	{PermReportsViewRevenue, "See revenue figures on the dashboard", []string{RoleEngineer, RoleFrontDesk}},
+	{PermCostsRecord, "Record part, labor and outsourced costs against a ticket", []string{RoleEngineer}},
+	{PermTheftOverride, "Book in a device the stolen-device registry reports stolen", nil},
+	{PermTicketsAssign, "Move tickets between engineers", nil},
+	{PermPartsWastage, "Record scrapped parts and cores pulled from devices", []string{RoleEngineer}},
+	{PermPartsCores, "Return cores to vendors and record their credit", nil},
+	{PermPartsReceive, "Receive stock bought from suppliers", []string{RoleFrontDesk}},
+	{PermTicketsMerge, "Merge duplicate tickets and split tickets into separate jobs", []string{RoleFrontDesk}},
+	{PermRecallsManage, "Run part recalls and record customer responses", []string{RoleFrontDesk}},
+	{PermCertificationsManage, "Record and remove staff certifications", nil},
+	{PermTicketsReopen, "Reopen collected tickets whose fault persists", []string{RoleFrontDesk}},
+	{PermEstimatesDecide, "Record estimate approvals and rejections customers give in person or by phone", []string{RoleEngineer, RoleFrontDesk}},
+	{PermTicketsCaseFile, "Export a ticket case file PDF for insurance claims and disputes", []string{RoleFrontDesk}},
+	{PermAccountsManage, "Add corporate accounts on contract", nil},
+	{PermQuotesIssue, "Issue quotes before a ticket is booked in", []string{RoleFrontDesk}},
+	{PermDiagnosisEdit, "Write and publish diagnostic reports on tickets", []string{RoleEngineer}},
+	{PermVoiceNotesRecord, "Record voice notes on tickets", []string{RoleEngineer}},
+	{PermPartsStocktake, "Open stocktakes and record counted stock", []string{RoleEngineer, RoleFrontDesk}},
+}
+
+func isKnownPermission(name string) bool {
+	for _, permission := range permissionCatalog {
+		if permission.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionSeedStatements grant the default roles of permissions the
+// database has not seen yet, then register them.
+func permissionSeedStatements() []string {
+	var statements []string
+	for _, permission := range permissionCatalog {
+		for _, role := range permission.DefaultRoles {
+			statements = append(statements, fmt.Sprintf(`
+				INSERT IGNORE INTO role_permissions (role, permission)
+				SELECT '%s', '%s' FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE name = '%s')`,
+				role, permission.Name, permission.Name))
+		}
+		statements = append(statements, fmt.Sprintf(`INSERT IGNORE INTO permissions (name, description) VALUES ('%s', '%s')`,
+			permission.Name, permission.Description))
+	}
+	return statements
+}
+
+// PermissionService handles the role-permission matrix. The matrix is held
+// in memory and reloaded periodically so other instances pick up changes.
+type PermissionService struct {
+	db     *sql.DB
+	mu     sync.RWMutex
+	grants map[string]map[string]bool
+}
+
+func NewPermissionService(database *sql.DB) *PermissionService {
+	return &PermissionService{db: database, grants: map[string]map[string]bool{}}
+}
+
+// Reload reads the matrix from the database.
+func (ps *PermissionService) Reload(ctx context.Context) error {
+	rows, err := ps.db.QueryContext(ctx, `SELECT role, permission FROM role_permissions`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	grants := map[string]map[string]bool{}
+	for rows.Next() {
+		var role, permission string
+		if err := rows.Scan(&role, &permission); err != nil {
+			return err
+		}
+		if grants[role] == nil {
+			grants[role] = map[string]bool{}
+		}
+		grants[role][permission] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	ps.grants = grants
+	ps.mu.Unlock()
+	return nil
+}
+
+// Allows reports whether role holds permission.
+func (ps *PermissionService) Allows(role, permission string) bool {
+	if role == RoleAdmin {
+		return true
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.grants[role][permission]
+}
+
+// Matrix returns the permissions granted to each role.
+func (ps *PermissionService) Matrix() map[string][]string {
+	matrix := map[string][]string{}
+	for _, role := range staffRoles {
+		matrix[role] = []string{}
+		for _, permission := range permissionCatalog {
+			if ps.Allows(role, permission.Name) {
+				matrix[role] = append(matrix[role], permission.Name)
+			}
+		}
+	}
+	return matrix
+}
+
+// SetGrant grants or revokes a permission for a role.
+func (ps *PermissionService) SetGrant(role, permission string, granted bool, actorID string) error {
+	var err error
+	if granted {
+		_, err = ps.db.Exec(`INSERT IGNORE INTO role_permissions (role, permission, granted_by) VALUES (?, ?, ?)`,
+			role, permission, nullString(actorID))
+	} else {
+		_, err = ps.db.Exec(`DELETE FROM role_permissions WHERE role = ? AND permission = ?`, role, permission)
+	}
+	if err != nil {
+		return err
+	}
+	return ps.Reload(context.Background())
+}
+
+var permissionService *PermissionService
+
+// hasPermission reports whether the request's user may perform permission.
+func hasPermission(r *http.Request, permission string) bool {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return false
+	}
+
+	// API keys have the permissions of their scope's role on its endpoints
+	role := normalizeRole(claims.Role)
+	if claims.APIKeyID != "" {
+		role = apiKeyRole(claims.Scopes, r.URL.Path)
+	}
+	return role != "" && permissionService.Allows(role, permission)
+}
+
+// requirePermission restricts a handler to roles granted permission.
+func requirePermission(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !hasPermission(r, permission) {
+				http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// permissionReloadJob keeps this instance's copy of the matrix current.
+func permissionReloadJob() BackgroundJob {
+	return BackgroundJob{
+		Name:     "permissions_reload",
+		Interval: getEnvDuration("PERMISSIONS_RELOAD_INTERVAL", time.Minute),
+		Run:      permissionService.Reload,
+	}
+}
+
+// PermissionsHandler shows the catalogue and matrix (GET) or grants or
+// revokes one permission for a role (PUT). Admin only.
+func PermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"permissions": permissionCatalog,
+			"roles":       permissionService.Matrix(),
+		})
+
+	case "PUT":
+		var request struct {
+			Role       string `json:"role"`
+			Permission string `json:"permission"`
+			Granted    bool   `json:"granted"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		switch request.Role {
+		case RoleEngineer, RoleFrontDesk:
+		case RoleAdmin:
+			fieldErrors.Add("role", "Admin always holds every permission")
+		case RoleReporting:
+			fieldErrors.Add("role", "Reporting is read-only and cannot be granted permissions")
+		default:
+			fieldErrors.Add("role", "must be Engineer or FrontDesk")
+		}
+		if !isKnownPermission(request.Permission) {
+			fieldErrors.Add("permission", "is not a known permission")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		before := permissionService.Allows(request.Role, request.Permission)
+		if err := permissionService.SetGrant(request.Role, request.Permission, request.Granted, actorID(r)); err != nil {
+			log.Printf("Error updating permission %s for %s: %v", request.Permission, request.Role, err)
+			http.Error(w, "Failed to update permission", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Permission %s for %s set to %t by %s", request.Permission, request.Role, request.Granted, actorID(r))
+		auditService.Record(r, AuditPermissionChanged, "role", request.Role,
+			map[string]bool{request.Permission: before}, map[string]bool{request.Permission: request.Granted})
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Permission updated successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
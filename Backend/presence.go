@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Presence shows who is around: a staff member is active while their
+// session tokens are being used, idle for a while after, and offline once
+// they stop or sign out. Every authenticated request refreshes the session's
+// last_used_at (sessions.go), so an open app keeps its user present by
+// sending POST /api/v1/me/presence as a heartbeat. The same request can mark
+// them away ("Lunch") until they are back. Presence is listed at
+// GET /api/v1/staff/presence for the app's activity feed and comes with
+// each engineer on the workload list used to pick assignees, and with the
+// engineer a ticket is assigned to.
+
+const staffPresenceTable = `
+	CREATE TABLE IF NOT EXISTS staff_presence (
+		user_id VARCHAR(50) PRIMARY KEY,
+		away_note VARCHAR(200) NOT NULL,
+		away_since TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Presence states
+const (
+	PresenceActive  = "active"
+	PresenceIdle    = "idle"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// StaffPresence is whether a staff member is around.
+type StaffPresence struct {
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Role       string     `json:"role"`
+	State      string     `json:"state"` // active, idle, away or offline
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	AwayNote   string     `json:"away_note,omitempty"`
+	AwaySince  *time.Time `json:"away_since,omitempty"`
+}
+
+// PresenceService works out staff presence from session activity
+type PresenceService struct {
+	db           *sql.DB
+	activeWindow time.Duration // Seen this recently is active
+	idleWindow   time.Duration // Seen this recently is idle; later is offline
+}
+
+func NewPresenceService(database *sql.DB) *PresenceService {
+	return &PresenceService{
+		db: database,
+		// Longer than SESSION_ACTIVITY_INTERVAL, which throttles last_used_at
+		activeWindow: getEnvDuration("PRESENCE_ACTIVE_WINDOW", 3*time.Minute),
+		idleWindow:   getEnvDuration("PRESENCE_IDLE_WINDOW", 15*time.Minute),
+	}
+}
+
+var presenceService *PresenceService
+
+// state returns the presence state of someone last seen at lastSeen.
+func (ps *PresenceService) state(lastSeen *time.Time, away bool, now time.Time) string {
+	switch {
+	case lastSeen == nil || now.Sub(*lastSeen) > ps.idleWindow:
+		return PresenceOffline
+	case away:
+		return PresenceAway
+	case now.Sub(*lastSeen) > ps.activeWindow:
+		return PresenceIdle
+	}
+	return PresenceActive
+}
+
+// List returns the presence of approved staff, or of userIDs when given,
+// by name.
+func (ps *PresenceService) List(userIDs ...string) ([]StaffPresence, error) {
+	query := `
+		SELECT u.id, u.full_name, u.role,
+		       (SELECT MAX(s.last_used_at) FROM sessions s
+		        WHERE s.user_id = u.id AND s.revoked_at IS NULL AND s.expires_at > NOW()),
+		       p.away_note, p.away_since
+		FROM users u LEFT JOIN staff_presence p ON p.user_id = u.id
+		WHERE u.approved = TRUE`
+	var args []interface{}
+	if len(userIDs) > 0 {
+		query += ` AND u.id IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(userIDs)), ", ") + `)`
+		for _, id := range userIDs {
+			args = append(args, id)
+		}
+	}
+	rows, err := ps.db.Query(query+` ORDER BY u.full_name, u.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	presence := []StaffPresence{}
+	for rows.Next() {
+		var p StaffPresence
+		var lastSeen, awaySince sql.NullTime
+		var awayNote sql.NullString
+		if err := rows.Scan(&p.UserID, &p.Name, &p.Role, &lastSeen, &awayNote, &awaySince); err != nil {
+			return nil, err
+		}
+		p.Role = normalizeRole(p.Role)
+		p.LastSeenAt = timePtr(lastSeen)
+		p.State = ps.state(p.LastSeenAt, awaySince.Valid, now)
+		if p.State == PresenceAway {
+			p.AwayNote = awayNote.String
+			p.AwaySince = timePtr(awaySince)
+		}
+		presence = append(presence, p)
+	}
+	return presence, rows.Err()
+}
+
+// Get returns one user's presence, or nil for an unknown or unapproved user.
+func (ps *PresenceService) Get(userID string) (*StaffPresence, error) {
+	presence, err := ps.List(userID)
+	if err != nil || len(presence) == 0 {
+		return nil, err
+	}
+	return &presence[0], nil
+}
+
+// SetAway marks userID away with note, or back when note is empty.
+func (ps *PresenceService) SetAway(userID, note string) error {
+	if note == "" {
+		_, err := ps.db.Exec(`DELETE FROM staff_presence WHERE user_id = ?`, userID)
+		return err
+	}
+	_, err := ps.db.Exec(`
+		INSERT INTO staff_presence (user_id, away_note, away_since) VALUES (?, ?, NOW())
+		ON DUPLICATE KEY UPDATE away_note = VALUES(away_note)
+	`, userID, note)
+	return err
+}
+
+// addWorkloadPresence fills in each engineer's presence for the assignee
+// picker.
+func addWorkloadPresence(engineers []EngineerWorkload) error {
+	if len(engineers) == 0 {
+		return nil
+	}
+	ids := make([]string, len(engineers))
+	for i, engineer := range engineers {
+		ids[i] = engineer.EngineerID
+	}
+	presence, err := presenceService.List(ids...)
+	if err != nil {
+		return err
+	}
+	byUser := make(map[string]StaffPresence, len(presence))
+	for _, p := range presence {
+		byUser[p.UserID] = p
+	}
+	for i := range engineers {
+		p, ok := byUser[engineers[i].EngineerID]
+		if !ok {
+			engineers[i].Presence = PresenceOffline
+			continue
+		}
+		engineers[i].Presence = p.State
+		engineers[i].AwayNote = p.AwayNote
+	}
+	return nil
+}
+
+// MyPresenceHandler is the app's heartbeat (POST with no body), and sets
+// the signed-in user away (POST {"away": "Lunch"}) or back
+// (POST {"away": ""}). It returns their presence.
+func MyPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := actorID(r)
+	if userID == "" || claimsFromContext(r.Context()).SessionID == "" {
+		http.Error(w, "Presence needs a signed-in user", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Away *string `json:"away"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Away != nil {
+		note := strings.TrimSpace(*request.Away)
+		if len(note) > 200 {
+			var fieldErrors ValidationErrors
+			fieldErrors.Add("away", "is too long")
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+		if err := presenceService.SetAway(userID, note); err != nil {
+			log.Printf("Error setting presence of %s: %v", userID, err)
+			http.Error(w, "Failed to update presence", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	presence, err := presenceService.Get(userID)
+	if err != nil {
+		log.Printf("Error retrieving presence of %s: %v", userID, err)
+		http.Error(w, "Failed to retrieve presence", http.StatusInternalServerError)
+		return
+	}
+	if presence == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(presence)
+}
+
+// StaffPresenceHandler lists the presence of approved staff (GET), or of
+// one role with ?role=Engineer.
+func StaffPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	presence, err := presenceService.List()
+	if err != nil {
+		log.Printf("Error listing staff presence: %v", err)
+		http.Error(w, "Failed to retrieve presence", http.StatusInternalServerError)
+		return
+	}
+	if role := r.URL.Query().Get("role"); role != "" {
+		filtered := []StaffPresence{}
+		for _, p := range presence {
+			if p.Role == normalizeRole(role) {
+				filtered = append(filtered, p)
+			}
+		}
+		presence = filtered
+	}
+	json.NewEncoder(w).Encode(presence)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Every receipt, device label, job sheet and invoice goes through a print queue that a
+// print agent at the counter drains. Keeping the jobs lets the shop answer "I
+// never got a receipt" from the record, and stops the same document printing
+// twice unless someone asks for a reprint and says why.
+
+const printJobsTable = `
+	CREATE TABLE IF NOT EXISTS print_jobs (
+		id VARCHAR(50) PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		document ENUM('receipt', 'label', 'invoice', 'jobsheet') NOT NULL,
+		printer VARCHAR(100) NOT NULL,
+		status ENUM('queued', 'printed', 'failed') NOT NULL DEFAULT 'queued',
+		copy_number INT NOT NULL DEFAULT 1,
+		reprint_of VARCHAR(50) NULL,
+		reprint_reason VARCHAR(255) NULL,
+		error VARCHAR(500) NULL,
+		requested_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		printed_at TIMESTAMP NULL,
+		INDEX idx_print_jobs_order (order_id, document),
+		INDEX idx_print_jobs_queue (printer, status, created_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Print job statuses
+const (
+	PrintQueued  = "queued"
+	PrintPrinted = "printed"
+	PrintFailed  = "failed"
+)
+
+var printDocuments = []string{"receipt", "label", "invoice", "jobsheet"}
+
+// printDocumentEnumStatements extend the document ENUM of existing
+// databases with the job sheet.
+var printDocumentEnumStatements = []string{
+	`ALTER TABLE print_jobs MODIFY COLUMN document ENUM('receipt', 'label', 'invoice', 'jobsheet') NOT NULL`,
+}
+
+var (
+	errPrintPending  = errors.New("this document is already waiting in the print queue")
+	errReprintReason = errors.New("this document has already been printed; a reprint needs a reason")
+	errPrintSettled  = errors.New("print job has already been completed")
+)
+
+// PrintJob is one request to print a document for a ticket.
+type PrintJob struct {
+	ID            string     `json:"id"`
+	OrderID       string     `json:"order_id"`
+	Document      string     `json:"document"`
+	Printer       string     `json:"printer"`
+	Status        string     `json:"status"`
+	CopyNumber    int        `json:"copy_number"`
+	ReprintOf     string     `json:"reprint_of,omitempty"`
+	ReprintReason string     `json:"reprint_reason,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	RequestedBy   string     `json:"requested_by,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	PrintedAt     *time.Time `json:"printed_at,omitempty"`
+
+	Content *PrintDocument `json:"content,omitempty"` // Rendered for the print agent
+}
+
+// PrintDocument is a document laid out as labelled lines, with every
+// amount and date already formatted for the shop's locale so the print
+// agent only has to place the text.
+type PrintDocument struct {
+	Title    string            `json:"title"`
+	Locale   string            `json:"locale"`
+	Language string            `json:"language"` // The customer's language (i18n.go)
+	Fields   []DocumentLine    `json:"fields"`
+	Sections []DocumentSection `json:"sections,omitempty"`
+	Totals   []DocumentLine    `json:"totals,omitempty"`
+
+	Signatures []DocumentSignature `json:"signatures,omitempty"` // Job sheets only
+}
+
+// DocumentSignature is a signature to print with its caption.
+type DocumentSignature struct {
+	Label      string `json:"label"`
+	SignerName string `json:"signer_name"`
+	SignedAt   string `json:"signed_at"`
+	Image      []byte `json:"image"` // PNG, base64 in JSON
+}
+
+// DocumentSection is a titled group of line items with its subtotal.
+type DocumentSection struct {
+	Title    string         `json:"title"`
+	Items    []DocumentLine `json:"items"`
+	Subtotal string         `json:"subtotal,omitempty"`
+}
+
+// DocumentLine is one label and its formatted value.
+type DocumentLine struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// PrintService handles print queue database operations
+type PrintService struct {
+	db *sql.DB
+}
+
+func NewPrintService(database *sql.DB) *PrintService {
+	return &PrintService{db: database}
+}
+
+// defaultPrinter picks the configured printer for a document, e.g.
+// PRINTER_LABEL for device labels, falling back to PRINTER_DEFAULT.
+func defaultPrinter(document string) string {
+	return getEnv("PRINTER_"+strings.ToUpper(document), getEnv("PRINTER_DEFAULT", ""))
+}
+
+// Enqueue queues a document for printing. The first copy needs no reason;
+// later copies are reprints linked to the first one and must give a reason.
+// Failed jobs don't count, so a jammed printer can simply be retried.
+func (ps *PrintService) Enqueue(job *PrintJob) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := orderService.lockOrderStatus(tx, job.OrderID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, status, copy_number FROM print_jobs
+		WHERE order_id = ? AND document = ? AND status <> ?
+		ORDER BY copy_number
+	`, job.OrderID, job.Document, PrintFailed)
+	if err != nil {
+		return err
+	}
+	var firstID string
+	copies := 0
+	for rows.Next() {
+		var id, status string
+		var copyNumber int
+		if err := rows.Scan(&id, &status, &copyNumber); err != nil {
+			rows.Close()
+			return err
+		}
+		if status == PrintQueued {
+			rows.Close()
+			return errPrintPending
+		}
+		if firstID == "" {
+			firstID = id
+		}
+		copies = copyNumber
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if firstID != "" && job.ReprintReason == "" {
+		return errReprintReason
+	}
+	if firstID == "" {
+		job.ReprintReason = ""
+	}
+
+	job.ID = fmt.Sprintf("PRN-%d", time.Now().UnixNano())
+	job.Status = PrintQueued
+	job.CopyNumber = copies + 1
+	job.ReprintOf = firstID
+	job.CreatedAt = time.Now()
+
+	_, err = tx.Exec(`
+		INSERT INTO print_jobs (id, order_id, document, printer, status, copy_number, reprint_of, reprint_reason, requested_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, job.OrderID, job.Document, job.Printer, job.Status, job.CopyNumber,
+		nullString(job.ReprintOf), nullString(job.ReprintReason), nullString(job.RequestedBy), job.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Complete records the print agent's outcome for a queued job.
+func (ps *PrintService) Complete(id string, printed bool, failure string) error {
+	status, printedAt := PrintFailed, sql.NullTime{}
+	if printed {
+		status, printedAt, failure = PrintPrinted, sql.NullTime{Time: time.Now(), Valid: true}, ""
+	}
+
+	result, err := ps.db.Exec(`
+		UPDATE print_jobs SET status = ?, printed_at = ?, error = ?
+		WHERE id = ? AND status = ?
+	`, status, printedAt, nullString(truncate(failure, 500)), id, PrintQueued)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		return nil
+	}
+
+	var current string
+	err = ps.db.QueryRow(`SELECT status FROM print_jobs WHERE id = ?`, id).Scan(&current)
+	if err != nil {
+		return err
+	}
+	return errPrintSettled
+}
+
+// ListJobs returns print jobs for an order's history or a printer's queue.
+func (ps *PrintService) ListJobs(orderID, printer, status string) ([]PrintJob, error) {
+	query := `
+		SELECT id, order_id, document, printer, status, copy_number, reprint_of, reprint_reason,
+			error, requested_by, created_at, printed_at
+		FROM print_jobs WHERE 1 = 1`
+	var args []interface{}
+	if orderID != "" {
+		query += " AND order_id = ?"
+		args = append(args, orderID)
+	}
+	if printer != "" {
+		query += " AND printer = ?"
+		args = append(args, printer)
+	}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at, copy_number"
+
+	rows, err := ps.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []PrintJob{}
+	for rows.Next() {
+		var job PrintJob
+		var reprintOf, reason, failure, requestedBy sql.NullString
+		var printedAt sql.NullTime
+		if err := rows.Scan(&job.ID, &job.OrderID, &job.Document, &job.Printer, &job.Status, &job.CopyNumber,
+			&reprintOf, &reason, &failure, &requestedBy, &job.CreatedAt, &printedAt); err != nil {
+			return nil, err
+		}
+		job.ReprintOf = reprintOf.String
+		job.ReprintReason = reason.String
+		job.Error = failure.String
+		job.RequestedBy = requestedBy.String
+		job.PrintedAt = timePtr(printedAt)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// renderDocument lays out a job's document from the ticket and its billed
+// items, grouped into their sections in the arranged order. Invoices show
+// the total rounded per the tax jurisdiction. Labels and titles are in the
+// customer's language.
+func renderDocument(job PrintJob, locale Locale) (*PrintDocument, error) {
+	order, err := orderService.GetOrder(job.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	language, err := orderLanguage(order)
+	if err != nil {
+		return nil, err
+	}
+	label := func(key string) string {
+		return localize(language, key, nil)
+	}
+
+	device := strings.TrimSpace(order.DeviceType + " " + order.DeviceModel)
+	doc := &PrintDocument{
+		Title:    label("doc." + job.Document),
+		Locale:   locale.Tag,
+		Language: language,
+		Fields: []DocumentLine{
+			{label("doc.ticket"), order.ID},
+			{label("doc.date"), locale.FormatDate(order.CreatedAt)},
+			{label("doc.customer"), order.CustomerName},
+			{label("doc.device"), device},
+		},
+	}
+	if len(order.Devices) > 1 {
+		for _, extra := range order.Devices[1:] {
+			doc.Fields = append(doc.Fields, DocumentLine{label("doc.device"), strings.TrimSpace(extra.DeviceType + " " + extra.DeviceModel)})
+		}
+	}
+	if job.Document == "label" {
+		if order.DeviceSerial != "" {
+			doc.Fields = append(doc.Fields, DocumentLine{label("doc.serial"), order.DeviceSerial})
+		}
+		return doc, nil
+	}
+
+	doc.Fields = append(doc.Fields, DocumentLine{label("doc.phone"), order.CustomerPhone})
+	if order.ExpectedDeliveryDate != nil {
+		doc.Fields = append(doc.Fields, DocumentLine{label("doc.expected"), locale.FormatDate(*order.ExpectedDeliveryDate)})
+	}
+	if job.Document == "jobsheet" {
+		if order.DeviceSerial != "" {
+			doc.Fields = append(doc.Fields, DocumentLine{label("doc.serial"), order.DeviceSerial})
+		}
+		if order.IssueDescription != "" {
+			doc.Fields = append(doc.Fields, DocumentLine{label("doc.issue"), order.IssueDescription})
+		}
+		signatures, err := signatureService.List(order.ID, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, signature := range signatures {
+			doc.Signatures = append(doc.Signatures, DocumentSignature{
+				Label:      label("signature." + signature.Kind),
+				SignerName: signature.SignerName,
+				SignedAt:   locale.FormatDateTime(signature.SignedAt),
+				Image:      signature.Image,
+			})
+		}
+	}
+
+	events, err := orderService.events.Load(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ticketLineItems(events)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range lineItemSections {
+		group := DocumentSection{Title: label("section." + section.Key)}
+		var subtotal Money
+		for _, item := range items {
+			if item.Section == section.Key {
+				group.Items = append(group.Items, DocumentLine{item.Description, locale.FormatMoney(item.Amount)})
+				subtotal += item.Amount
+			}
+		}
+		if len(group.Items) > 0 {
+			group.Subtotal = locale.FormatMoney(subtotal)
+			doc.Sections = append(doc.Sections, group)
+		}
+	}
+	if len(doc.Sections) == 0 {
+		group := DocumentSection{Title: label("doc.services")}
+		for _, service := range order.Services {
+			group.Items = append(group.Items, DocumentLine{service, ""})
+		}
+		doc.Sections = append(doc.Sections, group)
+	}
+
+	total := order.TotalCost
+	doc.Totals = append(doc.Totals, DocumentLine{label("doc.total"), locale.FormatMoney(total)})
+	if job.Document == "invoice" {
+		if rounded := total.RoundForInvoice(activeRoundingRule()); rounded != total {
+			doc.Totals = append(doc.Totals,
+				DocumentLine{label("doc.rounding"), locale.FormatMoney(rounded - total)},
+				DocumentLine{label("doc.invoice_total"), locale.FormatMoney(rounded)})
+			total = rounded
+		}
+	}
+	doc.Totals = append(doc.Totals,
+		DocumentLine{label("doc.paid"), locale.FormatMoney(order.AmountPaid)},
+		DocumentLine{label("doc.balance"), locale.FormatMoney(total - order.AmountPaid)},
+		DocumentLine{label("doc.printed"), locale.FormatDateTime(time.Now())})
+	return doc, nil
+}
+
+var printService *PrintService
+
+// OrderPrintJobsHandler shows a ticket's print history (GET ?order_id=) or
+// queues a receipt, label, invoice or job sheet (POST).
+func OrderPrintJobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		orderID := r.URL.Query().Get("order_id")
+		if orderID == "" {
+			http.Error(w, "order_id is required", http.StatusBadRequest)
+			return
+		}
+
+		jobs, err := printService.ListJobs(orderID, "", "")
+		if err != nil {
+			log.Printf("Error listing print jobs for %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve print jobs", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(jobs)
+
+	case "POST":
+		var job PrintJob
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if job.Printer == "" {
+			job.Printer = defaultPrinter(job.Document)
+		}
+
+		var fieldErrors ValidationErrors
+		if job.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if !slices.Contains(printDocuments, job.Document) {
+			fieldErrors.Add("document", "must be receipt, label, invoice or jobsheet")
+		}
+		if job.Printer == "" || len(job.Printer) > 100 {
+			fieldErrors.Add("printer", "is required when no default printer is configured")
+		}
+		if len(job.ReprintReason) > 255 {
+			fieldErrors.Add("reprint_reason", "must be at most 255 characters")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		job.RequestedBy = actorID(r)
+		err := printService.Enqueue(&job)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errPrintPending || err == errReprintReason {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error queueing %s for %s: %v", job.Document, job.OrderID, err)
+			http.Error(w, "Failed to queue print job", http.StatusInternalServerError)
+			return
+		}
+
+		if job.ReprintOf != "" {
+			log.Printf("Reprint %d of %s for order %s requested by %s: %s", job.CopyNumber, job.Document, job.OrderID, job.RequestedBy, job.ReprintReason)
+		}
+		auditService.Record(r, AuditPrintRequested, "order", job.OrderID, nil, job)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(job)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PrintQueueHandler lists jobs for a printer (GET ?printer=&status=), which
+// the print agent polls for queued work. Queued jobs carry their rendered
+// content.
+func PrintQueueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = PrintQueued
+	}
+	jobs, err := printService.ListJobs("", r.URL.Query().Get("printer"), status)
+	if err != nil {
+		log.Printf("Error listing print queue: %v", err)
+		http.Error(w, "Failed to retrieve print queue", http.StatusInternalServerError)
+		return
+	}
+	for i := range jobs {
+		if jobs[i].Status != PrintQueued {
+			continue
+		}
+		if jobs[i].Content, err = renderDocument(jobs[i], shopLocale); err != nil {
+			log.Printf("Error rendering %s for print job %s: %v", jobs[i].Document, jobs[i].ID, err)
+		}
+	}
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// PrintJobStatusHandler lets the print agent report a job as printed or
+// failed.
+func PrintJobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.ID == "" || (request.Status != PrintPrinted && request.Status != PrintFailed) {
+		http.Error(w, "Job ID and a status of printed or failed are required", http.StatusBadRequest)
+		return
+	}
+
+	err := printService.Complete(request.ID, request.Status == PrintPrinted, request.Error)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Print job not found", http.StatusNotFound)
+		return
+	}
+	if err == errPrintSettled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating print job %s: %v", request.ID, err)
+		http.Error(w, "Failed to update print job", http.StatusInternalServerError)
+		return
+	}
+
+	if request.Status == PrintFailed {
+		log.Printf("Print job %s failed: %s", request.ID, request.Error)
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Print job updated successfully",
+	})
+}
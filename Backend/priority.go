@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Every ticket has a priority. Intake may set it; otherwise
+// defaultOrderPriority picks one: warranty comebacks and jobs due the same
+// day start at High, everything else at Normal. It can be changed later as a
+// ticket edit. Ticket lists filter on ?priority= and sort on
+// ?sort=priority, and the dashboard counts open tickets per priority. The
+// same list filter also narrows on ticket custom field values
+// (?custom_fields.warranty_provider=AppleCare, customfields.go).
+
+// Ticket priorities
+const (
+	PriorityLow    = "Low"
+	PriorityNormal = "Normal"
+	PriorityHigh   = "High"
+	PriorityUrgent = "Urgent"
+)
+
+// orderPriorities lists the priorities, most pressing first.
+var orderPriorities = []string{PriorityUrgent, PriorityHigh, PriorityNormal, PriorityLow}
+
+// priorityRank orders tickets most pressing first in ORDER BY.
+const priorityRank = `FIELD(priority, 'Urgent', 'High', 'Normal', 'Low')`
+
+// defaultOrderPriority returns the priority of a ticket booked in without
+// one.
+func defaultOrderPriority(order *Order, now time.Time) string {
+	if order.WarrantyClaimOf != "" || order.ParentTicketID != "" {
+		return PriorityHigh
+	}
+	if due := order.ExpectedDeliveryDate; due != nil && !due.After(endOfDay(now)) {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+func endOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 23, 59, 59, 0, t.Location())
+}
+
+// orderSorts are the ?sort= orders of ticket lists.
+var orderSorts = map[string]string{
+	"created":  `created_at DESC, id`,
+	"updated":  `updated_at DESC, id`,
+	"priority": priorityRank + `, expected_delivery_date IS NULL, expected_delivery_date, created_at, id`,
+}
+
+// OrderListFilter narrows and orders a ticket list.
+type OrderListFilter struct {
+	Priorities []string
+	Overdue    bool     // Only tickets past their SLA with the clock running
+	Tags       []string // Only tickets carrying every one of these tags
+	// CustomFields are ticket custom field values, by key, tickets must hold
+	CustomFields map[string]string
+	// SnoozedBy hides the tickets this user has snoozed (snooze.go); with
+	// Snoozed "true" only those are listed, and "all" lists them as well
+	SnoozedBy string
+	Snoozed   string
+	Sort      string
+}
+
+// parseOrderListFilter reads ?priority= and ?tag= (comma-separated),
+// ?overdue=, ?custom_fields.<key>=, ?snoozed= and ?sort=, defaulting the
+// sort to defaultSort.
+func parseOrderListFilter(query url.Values, defaultSort string, fieldErrors *ValidationErrors) OrderListFilter {
+	filter := OrderListFilter{Priorities: splitList(query.Get("priority")), Sort: query.Get("sort")}
+	for _, priority := range filter.Priorities {
+		if !slices.Contains(orderPriorities, priority) {
+			fieldErrors.Add("priority", fmt.Sprintf("%q is not a priority (%s)", priority, strings.Join(orderPriorities, ", ")))
+		}
+	}
+	filter.Tags = normalizeTags("tag", splitList(query.Get("tag")), fieldErrors)
+	switch query.Get("overdue") {
+	case "", "false":
+	case "true":
+		filter.Overdue = true
+	default:
+		fieldErrors.Add("overdue", "must be true or false")
+	}
+	switch filter.Snoozed = query.Get("snoozed"); filter.Snoozed {
+	case "", "false", "true", "all":
+	default:
+		fieldErrors.Add("snoozed", "must be true, false or all")
+	}
+	for name, values := range query {
+		key, found := strings.CutPrefix(name, ticketCustomFieldsPrefix)
+		if !found {
+			continue
+		}
+		if !customFieldKeyPattern.MatchString(key) {
+			fieldErrors.Add(name, "is not a custom field key")
+			continue
+		}
+		if filter.CustomFields == nil {
+			filter.CustomFields = map[string]string{}
+		}
+		filter.CustomFields[key] = strings.TrimSpace(values[0])
+	}
+	if filter.Sort == "" {
+		filter.Sort = defaultSort
+	}
+	if _, known := orderSorts[filter.Sort]; !known {
+		fieldErrors.Add("sort", "must be created, updated or priority")
+	}
+	return filter
+}
+
+// where returns the filter's condition, starting with " AND ", and its
+// arguments.
+func (filter OrderListFilter) where() (string, []interface{}) {
+	var where string
+	var args []interface{}
+	if len(filter.Priorities) > 0 {
+		for _, priority := range filter.Priorities {
+			args = append(args, priority)
+		}
+		where += ` AND priority IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ") + `)`
+	}
+	if filter.Overdue {
+		where += ` AND sla_due_at < NOW() AND ` + slaOpenClause
+	}
+	// Sorted so the same filter always builds the same query
+	keys := make([]string, 0, len(filter.CustomFields))
+	for key := range filter.CustomFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		where += ` AND id IN (SELECT entity_id FROM custom_field_values WHERE scope = 'ticket' AND field_key = ? AND value = ?)`
+		args = append(args, key, filter.CustomFields[key])
+	}
+	if filter.SnoozedBy != "" {
+		switch filter.Snoozed {
+		case "true":
+			where += ` AND ` + snoozedClause
+			args = append(args, filter.SnoozedBy)
+		case "all":
+		default:
+			where += ` AND NOT ` + snoozedClause
+			args = append(args, filter.SnoozedBy)
+		}
+	}
+	tagWhere, tagArgs := tagsWhere("id", filter.Tags)
+	return where + tagWhere, append(args, tagArgs...)
+}
+
+// PriorityCounts are the open tickets of each priority.
+type PriorityCounts struct {
+	Urgent int `json:"Urgent"`
+	High   int `json:"High"`
+	Normal int `json:"Normal"`
+	Low    int `json:"Low"`
+}
+
+// dest returns the field counting priority.
+func (counts *PriorityCounts) dest(priority string) *int {
+	switch priority {
+	case PriorityUrgent:
+		return &counts.Urgent
+	case PriorityHigh:
+		return &counts.High
+	case PriorityLow:
+		return &counts.Low
+	}
+	return &counts.Normal
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A ticket's profit is its line-item revenue less what it cost: parts
+// (recorded against the ticket or picked for a build, at the weighted
+// average cost they left stock with), labor time at the loaded hourly rate
+// (recorded bench time plus on-site visits) and outsourced work. The figure is computed live while the ticket is open
+// and snapshotted into ticket_profitability when it is collected, so
+// reports read a fixed number; costs recorded after closure refresh the
+// snapshot.
+
+const ticketCostsTable = `
+	CREATE TABLE IF NOT EXISTS ticket_costs (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		kind ENUM('part', 'labor', 'outsourced') NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		part_sku VARCHAR(64) NULL,
+		quantity INT NOT NULL DEFAULT 1,
+		amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+		minutes INT NOT NULL DEFAULT 0,
+		engineer_id VARCHAR(50) NULL,
+		vendor VARCHAR(255) NULL,
+		recorded_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ticket_costs_order (order_id),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const ticketProfitabilityTable = `
+	CREATE TABLE IF NOT EXISTS ticket_profitability (
+		order_id VARCHAR(50) PRIMARY KEY,
+		revenue DECIMAL(10,2) NOT NULL,
+		part_cost DECIMAL(10,2) NOT NULL,
+		labor_minutes INT NOT NULL,
+		labor_rate DECIMAL(10,2) NOT NULL,
+		labor_cost DECIMAL(10,2) NOT NULL,
+		outsourced_cost DECIMAL(10,2) NOT NULL,
+		profit DECIMAL(10,2) NOT NULL,
+		closed_at TIMESTAMP NOT NULL,
+		computed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ticket_profitability_closed (closed_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Ticket cost kinds
+const (
+	CostPart       = "part"
+	CostLabor      = "labor"
+	CostOutsourced = "outsourced"
+)
+
+var costKinds = []string{CostPart, CostLabor, CostOutsourced}
+
+var errUnknownPart = errors.New("no part with this SKU")
+
+// closedStatus is the status at which a ticket's profitability is fixed.
+const closedStatus = "Collected"
+
+// TicketCost is a cost recorded against a ticket.
+type TicketCost struct {
+	ID          int64     `json:"id"`
+	OrderID     string    `json:"order_id"`
+	Kind        string    `json:"kind"`
+	Description string    `json:"description"`
+	PartSKU     string    `json:"part_sku,omitempty"`
+	PartSerial  string    `json:"part_serial,omitempty"` // Serial of the part fitted, for recalls
+	PartLot     string    `json:"part_lot,omitempty"`    // Supplier lot the part was taken from (lots.go)
+	Quantity    int       `json:"quantity"`
+	Amount      Money     `json:"amount"`            // Total cost for parts and outsourced work
+	Minutes     int       `json:"minutes,omitempty"` // Time spent, for labor
+	EngineerID  string    `json:"engineer_id,omitempty"`
+	Vendor      string    `json:"vendor,omitempty"`
+	RecordedBy  string    `json:"recorded_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TicketProfitability is the profit of one ticket.
+type TicketProfitability struct {
+	OrderID        string     `json:"order_id"`
+	Revenue        Money      `json:"revenue"`
+	PartCost       Money      `json:"part_cost"`
+	LaborMinutes   int        `json:"labor_minutes"`
+	LaborRate      Money      `json:"labor_rate"` // Loaded cost per hour
+	LaborCost      Money      `json:"labor_cost"`
+	OutsourcedCost Money      `json:"outsourced_cost"`
+	Profit         Money      `json:"profit"`
+	MarginBps      *int64     `json:"margin_bps"` // Profit as basis points of revenue; null without revenue
+	ClosedAt       *time.Time `json:"closed_at,omitempty"`
+	ComputedAt     time.Time  `json:"computed_at"`
+	Snapshot       bool       `json:"snapshot"` // Read from the closure snapshot rather than computed live
+}
+
+func (p *TicketProfitability) finish() {
+	p.Profit = p.Revenue - p.PartCost - p.LaborCost - p.OutsourcedCost
+	p.MarginBps = nil
+	if p.Revenue > 0 {
+		margin := int64(p.Profit) * 10000 / int64(p.Revenue)
+		p.MarginBps = &margin
+	}
+}
+
+// getLaborLoadedRate reads LABOR_LOADED_RATE, the hourly cost of an
+// engineer including overheads.
+func getLaborLoadedRate() (Money, error) {
+	rate, err := ParseMoney(getEnv("LABOR_LOADED_RATE", "600"))
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("LABOR_LOADED_RATE must be a non-negative amount")
+	}
+	return rate, nil
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// ProfitabilityService handles ticket costs and profitability
+type ProfitabilityService struct {
+	db        *sql.DB
+	laborRate Money
+}
+
+func NewProfitabilityService(database *sql.DB, laborRate Money) *ProfitabilityService {
+	return &ProfitabilityService{db: database, laborRate: laborRate}
+}
+
+// compute works out a ticket's profitability from its current state.
+func (ps *ProfitabilityService) compute(q rowQuerier, orderID string) (*TicketProfitability, error) {
+	p := &TicketProfitability{OrderID: orderID, LaborRate: ps.laborRate, ComputedAt: time.Now()}
+
+	if err := q.QueryRow(`SELECT total_cost FROM orders WHERE id = ?`, orderID).Scan(&p.Revenue); err != nil {
+		return nil, err
+	}
+
+	var recordedParts, buildParts, outsourced Money
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN kind = 'part' THEN amount END), 0),
+		       COALESCE(SUM(CASE WHEN kind = 'outsourced' THEN amount END), 0)
+		FROM ticket_costs WHERE order_id = ?
+	`, orderID).Scan(&recordedParts, &outsourced)
+	if err != nil {
+		return nil, err
+	}
+	// An invoiced build's components left stock at their average cost of
+	// that moment; until then they are estimated at today's
+	var invoicedMovements int
+	err = q.QueryRow(`
+		SELECT COALESCE(SUM(-quantity * unit_cost), 0), COUNT(*)
+		FROM stock_movements WHERE order_id = ? AND reason = ?
+	`, orderID, MovementBuild).Scan(&buildParts, &invoicedMovements)
+	if err != nil {
+		return nil, err
+	}
+	if invoicedMovements == 0 {
+		err = q.QueryRow(`
+			SELECT COALESCE(SUM(c.quantity * p.unit_cost), 0)
+			FROM build_components c JOIN parts p ON p.sku = c.part_sku WHERE c.order_id = ?
+		`, orderID).Scan(&buildParts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.LaborMinutes, err = ticketLaborMinutes(q, orderID); err != nil {
+		return nil, err
+	}
+
+	p.PartCost = recordedParts + buildParts
+	p.OutsourcedCost = outsourced
+	// Half-up to the minor unit: rate per hour times minutes over 60
+	p.LaborCost = Money((int64(ps.laborRate)*int64(p.LaborMinutes) + 30) / 60)
+	p.finish()
+	return p, nil
+}
+
+// snapshot stores the ticket's profitability as of closure.
+func (ps *ProfitabilityService) snapshot(tx *sql.Tx, orderID string, closedAt time.Time) error {
+	p, err := ps.compute(tx, orderID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ticket_profitability (order_id, revenue, part_cost, labor_minutes, labor_rate, labor_cost,
+			outsourced_cost, profit, closed_at, computed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE revenue = VALUES(revenue), part_cost = VALUES(part_cost),
+			labor_minutes = VALUES(labor_minutes), labor_rate = VALUES(labor_rate), labor_cost = VALUES(labor_cost),
+			outsourced_cost = VALUES(outsourced_cost), profit = VALUES(profit), computed_at = VALUES(computed_at)
+	`, orderID, p.Revenue, p.PartCost, p.LaborMinutes, p.LaborRate, p.LaborCost, p.OutsourcedCost, p.Profit,
+		closedAt, p.ComputedAt)
+	return err
+}
+
+// projectProfitability snapshots a ticket's profitability when it is
+// collected, and refreshes an existing snapshot when revenue changes.
+func projectProfitability(tx *sql.Tx, event *TicketEvent) error {
+	switch event.Type {
+	case EventStatusChanged:
+		var payload StatusChangedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		if payload.To == closedStatus {
+			return profitabilityService.snapshot(tx, event.TicketID, event.OccurredAt)
+		}
+	case EventItemAdded:
+		return profitabilityService.refreshSnapshot(tx, event.TicketID)
+	}
+	return nil
+}
+
+// refreshSnapshot recomputes a closed ticket's snapshot, keeping its
+// closure time. Open tickets have none and are left alone.
+func (ps *ProfitabilityService) refreshSnapshot(tx *sql.Tx, orderID string) error {
+	var closedAt time.Time
+	err := tx.QueryRow(`SELECT closed_at FROM ticket_profitability WHERE order_id = ? FOR UPDATE`, orderID).Scan(&closedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ps.snapshot(tx, orderID, closedAt)
+}
+
+// Get returns the closure snapshot of a collected ticket, or the live
+// figure of an open one.
+func (ps *ProfitabilityService) Get(orderID string) (*TicketProfitability, error) {
+	rows, err := ps.querySnapshots(`WHERE order_id = ?`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		return &rows[0], nil
+	}
+	return ps.compute(ps.db, orderID)
+}
+
+func (ps *ProfitabilityService) querySnapshots(where string, args ...interface{}) ([]TicketProfitability, error) {
+	rows, err := ps.db.Query(`
+		SELECT order_id, revenue, part_cost, labor_minutes, labor_rate, labor_cost, outsourced_cost, closed_at, computed_at
+		FROM ticket_profitability `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []TicketProfitability{}
+	for rows.Next() {
+		var p TicketProfitability
+		var closedAt time.Time
+		if err := rows.Scan(&p.OrderID, &p.Revenue, &p.PartCost, &p.LaborMinutes, &p.LaborRate, &p.LaborCost,
+			&p.OutsourcedCost, &closedAt, &p.ComputedAt); err != nil {
+			return nil, err
+		}
+		p.ClosedAt = &closedAt
+		p.Snapshot = true
+		p.finish()
+		snapshots = append(snapshots, p)
+	}
+	return snapshots, rows.Err()
+}
+
+// ListClosed returns the snapshots of tickets closed in a period.
+func (ps *ProfitabilityService) ListClosed(period ReportRange) ([]TicketProfitability, error) {
+	return ps.querySnapshots(`WHERE closed_at >= ? AND closed_at < ? ORDER BY closed_at`, period.From, period.To)
+}
+
+// RecordCost stores a cost against a ticket. Part costs given by SKU take
+// the part out of stock at its weighted average cost (costing.go). A closed
+// ticket's snapshot is refreshed.
+func (ps *ProfitabilityService) RecordCost(cost *TicketCost) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ps.recordCost(tx, cost); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordCost records a cost within tx, taking parts from stock.
+func (ps *ProfitabilityService) recordCost(tx *sql.Tx, cost *TicketCost) error {
+	if _, err := orderService.lockOrderStatus(tx, cost.OrderID); err != nil {
+		return err
+	}
+	if cost.Kind == CostPart && cost.PartSKU != "" {
+		amount, lot, err := consumePart(tx, cost.PartSKU, cost.Quantity, cost.PartLot, cost.OrderID, cost.RecordedBy)
+		if err != nil {
+			return err
+		}
+		cost.Amount, cost.PartLot = amount, lot
+	}
+
+	cost.CreatedAt = time.Now()
+	result, err := tx.Exec(`
+		INSERT INTO ticket_costs (order_id, kind, description, part_sku, part_serial, part_lot, quantity, amount, minutes, engineer_id, vendor, recorded_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, cost.OrderID, cost.Kind, cost.Description, nullString(cost.PartSKU), nullString(cost.PartSerial), nullString(cost.PartLot), cost.Quantity, cost.Amount, cost.Minutes,
+		nullString(cost.EngineerID), nullString(cost.Vendor), nullString(cost.RecordedBy), cost.CreatedAt)
+	if err != nil {
+		return err
+	}
+	cost.ID, _ = result.LastInsertId()
+
+	return ps.refreshSnapshot(tx, cost.OrderID)
+}
+
+func (ps *ProfitabilityService) ListCosts(orderID string) ([]TicketCost, error) {
+	rows, err := ps.db.Query(`
+		SELECT id, order_id, kind, description, part_sku, part_serial, part_lot, quantity, amount, minutes, engineer_id, vendor, recorded_by, created_at
+		FROM ticket_costs WHERE order_id = ? ORDER BY created_at, id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	costs := []TicketCost{}
+	for rows.Next() {
+		var cost TicketCost
+		var partSKU, partSerial, partLot, engineerID, vendor, recordedBy sql.NullString
+		if err := rows.Scan(&cost.ID, &cost.OrderID, &cost.Kind, &cost.Description, &partSKU, &partSerial, &partLot, &cost.Quantity,
+			&cost.Amount, &cost.Minutes, &engineerID, &vendor, &recordedBy, &cost.CreatedAt); err != nil {
+			return nil, err
+		}
+		cost.PartSKU = partSKU.String
+		cost.PartSerial = partSerial.String
+		cost.PartLot = partLot.String
+		cost.EngineerID = engineerID.String
+		cost.Vendor = vendor.String
+		cost.RecordedBy = recordedBy.String
+		costs = append(costs, cost)
+	}
+	return costs, rows.Err()
+}
+
+var profitabilityService *ProfitabilityService
+
+// TicketCostsHandler lists a ticket's costs (GET ?order_id=) or records one
+// (POST).
+func TicketCostsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		if !hasPermission(r, PermReportsViewRevenue) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		orderID := r.URL.Query().Get("order_id")
+		if orderID == "" {
+			http.Error(w, "order_id is required", http.StatusBadRequest)
+			return
+		}
+		costs, err := profitabilityService.ListCosts(orderID)
+		if err != nil {
+			log.Printf("Error listing costs of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve costs", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(costs)
+
+	case "POST":
+		if !hasPermission(r, PermCostsRecord) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var cost TicketCost
+		if err := json.NewDecoder(r.Body).Decode(&cost); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		cost.Description = strings.TrimSpace(cost.Description)
+		if cost.Quantity == 0 {
+			cost.Quantity = 1
+		}
+
+		var fieldErrors ValidationErrors
+		if cost.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if !slices.Contains(costKinds, cost.Kind) {
+			fieldErrors.Add("kind", "must be part, labor or outsourced")
+		}
+		if cost.Description == "" || len(cost.Description) > 255 {
+			fieldErrors.Add("description", "is required and must be at most 255 characters")
+		}
+		if cost.Quantity < 1 {
+			fieldErrors.Add("quantity", "must be positive")
+		}
+		switch cost.Kind {
+		case CostLabor:
+			if cost.Minutes < 1 {
+				fieldErrors.Add("minutes", "must be positive for labor")
+			}
+			cost.Amount, cost.PartSKU, cost.PartSerial, cost.PartLot = 0, "", "", ""
+		case CostPart, CostOutsourced:
+			if cost.Amount < 0 || (cost.Amount == 0 && cost.PartSKU == "") {
+				fieldErrors.Add("amount", "must be positive (or give a part_sku)")
+			}
+			cost.Minutes = 0
+		}
+		if len(cost.Vendor) > 255 {
+			fieldErrors.Add("vendor", "must be at most 255 characters")
+		}
+		cost.PartSerial = strings.TrimSpace(cost.PartSerial)
+		if cost.PartSerial != "" && cost.Kind != CostPart {
+			fieldErrors.Add("part_serial", "is only recorded for parts")
+		} else if len(cost.PartSerial) > 100 {
+			fieldErrors.Add("part_serial", "must be at most 100 characters")
+		}
+		cost.PartLot = strings.TrimSpace(cost.PartLot)
+		if cost.PartLot != "" && cost.PartSKU == "" {
+			fieldErrors.Add("part_lot", "needs a part_sku to take stock from")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		cost.RecordedBy = actorID(r)
+		err := profitabilityService.RecordCost(&cost)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errUnknownPart {
+			writeValidationErrors(w, ValidationErrors{{Field: "part_sku", Message: err.Error()}})
+			return
+		}
+		if err == errPartOutOfStock || err == errLotInsufficient {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error recording cost for order %s: %v", cost.OrderID, err)
+			http.Error(w, "Failed to record cost", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditTicketCostRecorded, "order", cost.OrderID, nil, cost)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(cost)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TicketProfitabilityHandler returns one ticket's profitability
+// (GET ?order_id=).
+func TicketProfitabilityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasPermission(r, PermReportsViewRevenue) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	orderID := r.URL.Query().Get("order_id")
+	if orderID == "" {
+		http.Error(w, "order_id is required", http.StatusBadRequest)
+		return
+	}
+	profitability, err := profitabilityService.Get(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error computing profitability of order %s: %v", orderID, err)
+		http.Error(w, "Failed to compute profitability", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(profitability)
+}
+
+// ReportProfitabilityHandler lists the profitability snapshots of tickets
+// closed in a period with their totals.
+func ReportProfitabilityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	tickets, err := profitabilityService.ListClosed(period)
+	if err != nil {
+		log.Printf("Error building profitability report: %v", err)
+		http.Error(w, "Failed to build report", http.StatusInternalServerError)
+		return
+	}
+	totals := TicketProfitability{LaborRate: profitabilityService.laborRate, ComputedAt: time.Now()}
+	for _, ticket := range tickets {
+		totals.Revenue += ticket.Revenue
+		totals.PartCost += ticket.PartCost
+		totals.LaborMinutes += ticket.LaborMinutes
+		totals.LaborCost += ticket.LaborCost
+		totals.OutsourcedCost += ticket.OutsourcedCost
+	}
+	totals.finish()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"range":   period,
+		"tickets": tickets,
+		"totals":  totals,
+	})
+}
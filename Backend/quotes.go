@@ -0,0 +1,581 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Front desk quotes a repair before the device is booked in. A quote has its
+// own numbering (ID_PREFIX_QUOTE, default QUO), the customer and device,
+// proposed line items in the estimate item format, and a validity date.
+// POST /api/v1/quotes/{id}/convert books an open, unexpired quote in as a
+// ticket through the same intake checks as a new ticket (checkIntake, the
+// theft registry and the repair warranty lookup), with every quoted item
+// billed on it. A quote is converted once, and expiry is checked again
+// under the quote's row lock.
+
+const quotesTable = `
+	CREATE TABLE IF NOT EXISTS quotes (
+		id VARCHAR(50) PRIMARY KEY,
+		customer_name VARCHAR(255) NOT NULL,
+		customer_email VARCHAR(255) NULL,
+		customer_phone VARCHAR(20) NULL,
+		device_type VARCHAR(100) NOT NULL,
+		device_model VARCHAR(255) NULL,
+		device_serial VARCHAR(100) NULL,
+		issue_description TEXT NULL,
+		total DECIMAL(10,2) NOT NULL,
+		valid_until DATE NOT NULL,
+		status ENUM('open', 'converted') NOT NULL DEFAULT 'open',
+		converted_order_id VARCHAR(50) NULL,
+		converted_by VARCHAR(50) NULL,
+		converted_at TIMESTAMP NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_quotes_status (status, valid_until),
+		INDEX idx_quotes_created (created_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const quoteItemsTable = `
+	CREATE TABLE IF NOT EXISTS quote_items (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		quote_id VARCHAR(50) NOT NULL,
+		position INT NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		section VARCHAR(20) NULL,
+		warranty_kind VARCHAR(10) NULL,
+		warranty_days INT NOT NULL DEFAULT 0,
+		INDEX idx_quote_items_quote (quote_id, position),
+		FOREIGN KEY (quote_id) REFERENCES quotes(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Quote statuses
+const (
+	QuoteOpen      = "open"
+	QuoteConverted = "converted"
+	QuoteExpired   = "expired" // An open quote past valid_until; never stored
+)
+
+var errQuoteConverted = errors.New("the quote has already been converted to a ticket")
+
+var errQuoteExpired = errors.New("the quote has expired")
+
+// Quote is a priced proposal for a repair not yet booked in.
+type Quote struct {
+	ID               string         `json:"id"`
+	CustomerName     string         `json:"customer_name"`
+	CustomerEmail    string         `json:"customer_email,omitempty"`
+	CustomerPhone    string         `json:"customer_phone,omitempty"`
+	DeviceType       string         `json:"device_type"`
+	DeviceModel      string         `json:"device_model,omitempty"`
+	DeviceSerial     string         `json:"device_serial,omitempty"`
+	IssueDescription string         `json:"issue_description,omitempty"`
+	Items            []EstimateItem `json:"items,omitempty"` // Left out of lists
+	Total            Money          `json:"total"`
+	ValidUntil       time.Time      `json:"valid_until"`
+	Status           string         `json:"status"`
+	ConvertedOrderID string         `json:"converted_order_id,omitempty"`
+	ConvertedBy      string         `json:"converted_by,omitempty"`
+	ConvertedAt      *time.Time     `json:"converted_at,omitempty"`
+	CreatedBy        string         `json:"created_by,omitempty"`
+	CreatedAt        time.Time      `json:"created_at"`
+}
+
+// expired reports whether an open quote is past its last valid day.
+func (q *Quote) expired(now time.Time) bool {
+	return q.Status == QuoteOpen && !now.Before(q.ValidUntil.AddDate(0, 0, 1))
+}
+
+// quoteValidity is how long a new quote stays valid by default.
+func quoteValidity() int {
+	return getEnvInt("QUOTE_VALIDITY_DAYS", 14)
+}
+
+// QuoteService handles quote database operations
+type QuoteService struct {
+	db *sql.DB
+}
+
+func NewQuoteService(database *sql.DB) *QuoteService {
+	return &QuoteService{db: database}
+}
+
+var quoteService *QuoteService
+
+const quoteColumns = `id, customer_name, customer_email, customer_phone, device_type, device_model, device_serial,
+	issue_description, total, valid_until, status, converted_order_id, converted_by, converted_at, created_by, created_at`
+
+func scanQuote(row rowScanner) (*Quote, error) {
+	quote := &Quote{Items: []EstimateItem{}}
+	var email, phone, model, serial, issue, convertedOrderID, convertedBy, createdBy sql.NullString
+	var convertedAt sql.NullTime
+	err := row.Scan(&quote.ID, &quote.CustomerName, &email, &phone, &quote.DeviceType, &model, &serial,
+		&issue, &quote.Total, &quote.ValidUntil, &quote.Status, &convertedOrderID, &convertedBy, &convertedAt,
+		&createdBy, &quote.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	quote.CustomerEmail, quote.CustomerPhone = email.String, phone.String
+	quote.DeviceModel, quote.DeviceSerial, quote.IssueDescription = model.String, serial.String, issue.String
+	quote.ConvertedOrderID, quote.ConvertedBy = convertedOrderID.String, convertedBy.String
+	quote.ConvertedAt = timePtr(convertedAt)
+	quote.CreatedBy = createdBy.String
+	if quote.expired(time.Now()) {
+		quote.Status = QuoteExpired
+	}
+	return quote, nil
+}
+
+// GetQuote returns a quote with its items.
+func (qs *QuoteService) GetQuote(id string) (*Quote, error) {
+	quote, err := scanQuote(qs.db.QueryRow(`SELECT `+quoteColumns+` FROM quotes WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := qs.db.Query(`
+		SELECT description, amount, section, warranty_kind, warranty_days
+		FROM quote_items WHERE quote_id = ? ORDER BY position
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item EstimateItem
+		var section, warrantyKind sql.NullString
+		if err := rows.Scan(&item.Description, &item.Amount, &section, &warrantyKind, &item.WarrantyDays); err != nil {
+			return nil, err
+		}
+		item.Section, item.WarrantyKind = section.String, warrantyKind.String
+		quote.Items = append(quote.Items, item)
+	}
+	return quote, rows.Err()
+}
+
+// List returns quotes newest first, optionally only those with status
+// (open, converted or expired). Items are left out.
+func (qs *QuoteService) List(status string, limit int) ([]Quote, error) {
+	where := ""
+	var args []interface{}
+	switch status {
+	case QuoteOpen:
+		where, args = `WHERE status = ? AND valid_until >= CURDATE()`, []interface{}{QuoteOpen}
+	case QuoteExpired:
+		where, args = `WHERE status = ? AND valid_until < CURDATE()`, []interface{}{QuoteOpen}
+	case QuoteConverted:
+		where, args = `WHERE status = ?`, []interface{}{QuoteConverted}
+	}
+	rows, err := qs.db.Query(`SELECT `+quoteColumns+` FROM quotes `+where+` ORDER BY created_at DESC LIMIT ?`,
+		append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotes := []Quote{}
+	for rows.Next() {
+		quote, err := scanQuote(rows)
+		if err != nil {
+			return nil, err
+		}
+		quote.Items = nil
+		quotes = append(quotes, *quote)
+	}
+	return quotes, rows.Err()
+}
+
+// Create numbers and stores a new quote with its items.
+func (qs *QuoteService) Create(quote *Quote) error {
+	id, err := idService.Next(EntityQuote)
+	if err != nil {
+		return err
+	}
+	tx, err := qs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO quotes (id, customer_name, customer_email, customer_phone, device_type, device_model,
+		                    device_serial, issue_description, total, valid_until, status, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, quote.CustomerName, nullString(quote.CustomerEmail), nullString(quote.CustomerPhone), quote.DeviceType,
+		nullString(quote.DeviceModel), nullString(quote.DeviceSerial), nullString(quote.IssueDescription),
+		quote.Total, quote.ValidUntil, QuoteOpen, nullString(quote.CreatedBy))
+	if err != nil {
+		return err
+	}
+	for i, item := range quote.Items {
+		_, err := tx.Exec(`
+			INSERT INTO quote_items (quote_id, position, description, amount, section, warranty_kind, warranty_days)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, id, i+1, item.Description, item.Amount, nullString(item.Section), nullString(item.WarrantyKind), item.WarrantyDays)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	quote.ID, quote.Status = id, QuoteOpen
+	return nil
+}
+
+// Convert books order in as the ticket of an open quote and bills the
+// quote's items on it, free where a warranty cover covers them.
+func (qs *QuoteService) Convert(quote *Quote, order *Order, cover *WarrantyCover) error {
+	tx, err := qs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var validUntil time.Time
+	err = tx.QueryRow(`SELECT status, valid_until FROM quotes WHERE id = ? FOR UPDATE`, quote.ID).Scan(&status, &validUntil)
+	if err != nil {
+		return err
+	}
+	if status != QuoteOpen {
+		return errQuoteConverted
+	}
+	if (&Quote{Status: status, ValidUntil: validUntil}).expired(time.Now()) {
+		return errQuoteExpired
+	}
+
+	if err := orderService.createOrder(tx, order); err != nil {
+		return err
+	}
+	for _, item := range quote.Items {
+		payload := ItemAddedPayload{Description: item.Description, Amount: item.Amount,
+			WarrantyKind: item.WarrantyKind, WarrantyDays: item.WarrantyDays, Section: item.Section}
+		if cover.Covers(item.Description) {
+			payload.Amount = 0
+		}
+		if _, err := orderService.events.Append(tx, order.ID, EventItemAdded, order.CreatedBy, payload); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+		UPDATE quotes SET status = ?, converted_order_id = ?, converted_by = ?, converted_at = NOW() WHERE id = ?
+	`, QuoteConverted, order.ID, nullString(order.CreatedBy), quote.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// QuotesHandler lists quotes (GET ?status=open|converted|expired&limit=) or
+// issues one (POST).
+func QuotesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		status := r.URL.Query().Get("status")
+		var fieldErrors ValidationErrors
+		if status != "" && status != QuoteOpen && status != QuoteConverted && status != QuoteExpired {
+			fieldErrors.Add("status", "must be open, converted or expired")
+		}
+		limit := 100
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 500 {
+				fieldErrors.Add("limit", "must be between 1 and 500")
+			} else {
+				limit = n
+			}
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		quotes, err := quoteService.List(status, limit)
+		if err != nil {
+			log.Printf("Error listing quotes: %v", err)
+			http.Error(w, "Failed to retrieve quotes", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(quotes)
+
+	case "POST":
+		if !hasPermission(r, PermQuotesIssue) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			Quote
+			ValidUntil string `json:"valid_until"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		quote := request.Quote
+
+		var fieldErrors ValidationErrors
+		quote.CustomerName = strings.TrimSpace(quote.CustomerName)
+		quote.DeviceType = strings.TrimSpace(quote.DeviceType)
+		quote.IssueDescription = strings.TrimSpace(quote.IssueDescription)
+		if quote.CustomerName == "" || len(quote.CustomerName) > 255 {
+			fieldErrors.Add("customer_name", "is required and must be at most 255 characters")
+		}
+		if quote.CustomerEmail == "" && quote.CustomerPhone == "" {
+			fieldErrors.Add("customer_email", "email or phone is required")
+		}
+		if quote.CustomerEmail != "" && !strings.Contains(quote.CustomerEmail, "@") {
+			fieldErrors.Add("customer_email", "must be an email address")
+		}
+		if len(quote.CustomerPhone) > 20 {
+			fieldErrors.Add("customer_phone", "must be at most 20 characters")
+		}
+		if quote.DeviceType == "" || len(quote.DeviceType) > 100 {
+			fieldErrors.Add("device_type", "is required and must be at most 100 characters")
+		}
+		if len(quote.IssueDescription) > 5000 {
+			fieldErrors.Add("issue_description", "must be at most 5000 characters")
+		}
+		if len(quote.Items) == 0 {
+			fieldErrors.Add("items", "at least one item is required")
+		}
+		quote.Total = checkEstimateItems("items", quote.Items, &fieldErrors)
+
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		quote.ValidUntil = today.AddDate(0, 0, quoteValidity())
+		if validUntil := parseDateField("valid_until", request.ValidUntil, &fieldErrors); validUntil != nil {
+			if validUntil.Before(today) {
+				fieldErrors.Add("valid_until", "must not be in the past")
+			}
+			quote.ValidUntil = *validUntil
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		quote.CreatedBy = actorID(r)
+		if err := quoteService.Create(&quote); err != nil {
+			log.Printf("Error creating quote for %s: %v", quote.CustomerName, err)
+			http.Error(w, "Failed to create quote", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Quote %s issued to %s by %s", quote.ID, quote.CustomerName, actorID(r))
+		auditService.Record(r, AuditQuoteIssued, "quote", quote.ID, nil, quote)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(quote)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// QuoteDetailHandler returns one quote with its items at
+// /api/v1/quotes/{id} and converts it to a ticket at
+// /api/v1/quotes/{id}/convert.
+func QuoteDetailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	quoteID := strings.TrimPrefix(r.URL.Path, "/api/v1/quotes/")
+	if id, found := strings.CutSuffix(quoteID, "/convert"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		convertQuote(w, r, id)
+		return
+	}
+	if quoteID == "" || strings.Contains(quoteID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	quote, err := quoteService.GetQuote(quoteID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Quote not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving quote %s: %v", quoteID, err)
+		http.Error(w, "Failed to retrieve quote", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(quote)
+}
+
+// convertQuote serves POST /api/v1/quotes/{id}/convert. The body is
+// optional and completes what intake needs beyond the quote: ticket_type,
+// a missing customer_email or customer_phone, device_serial, identity,
+// device_value and theft_override_reason.
+func convertQuote(w http.ResponseWriter, r *http.Request, quoteID string) {
+	if !hasPermission(r, PermTicketsCreate) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		TicketType          string          `json:"ticket_type"`
+		CustomerEmail       string          `json:"customer_email"`
+		CustomerPhone       string          `json:"customer_phone"`
+		DeviceSerial        string          `json:"device_serial"`
+		Identity            *TicketIdentity `json:"identity"`
+		DeviceValue         *Money          `json:"device_value"`
+		TheftOverrideReason string          `json:"theft_override_reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	quote, err := quoteService.GetQuote(quoteID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Quote not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving quote %s: %v", quoteID, err)
+		http.Error(w, "Failed to convert quote", http.StatusInternalServerError)
+		return
+	}
+	switch quote.Status {
+	case QuoteConverted:
+		http.Error(w, errQuoteConverted.Error()+" ("+quote.ConvertedOrderID+")", http.StatusConflict)
+		return
+	case QuoteExpired:
+		http.Error(w, "the quote expired on "+quote.ValidUntil.Format("2006-01-02"), http.StatusConflict)
+		return
+	}
+
+	order := Order{
+		CustomerName:     quote.CustomerName,
+		CustomerEmail:    quote.CustomerEmail,
+		CustomerPhone:    quote.CustomerPhone,
+		DeviceType:       quote.DeviceType,
+		DeviceModel:      quote.DeviceModel,
+		DeviceSerial:     quote.DeviceSerial,
+		Services:         []string{},
+		IssueDescription: quote.IssueDescription,
+		TicketType:       request.TicketType,
+		Identity:         request.Identity,
+	}
+	if order.CustomerEmail == "" {
+		order.CustomerEmail = strings.TrimSpace(request.CustomerEmail)
+	}
+	if order.CustomerPhone == "" {
+		order.CustomerPhone = strings.TrimSpace(request.CustomerPhone)
+	}
+	if order.DeviceSerial == "" {
+		order.DeviceSerial = strings.TrimSpace(request.DeviceSerial)
+	}
+	if order.TicketType == "" {
+		order.TicketType = defaultTicketType
+	}
+
+	var fieldErrors ValidationErrors
+	if order.CustomerEmail == "" {
+		fieldErrors.Add("customer_email", "is required to book the quote in")
+	}
+	if order.CustomerPhone == "" {
+		fieldErrors.Add("customer_phone", "is required to book the quote in")
+	}
+	ticketType, err := ticketTypeService.GetTicketType(order.TicketType)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading ticket type %s: %v", order.TicketType, err)
+		http.Error(w, "Failed to convert quote", http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows {
+		ticketType = nil
+	}
+	if err := checkIntake(&order, ticketType, request.DeviceValue, &fieldErrors); err != nil {
+		log.Printf("Error checking intake: %v", err)
+		http.Error(w, "Failed to convert quote", http.StatusInternalServerError)
+		return
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if !screenIntakeDevices(w, r, &order, request.DeviceValue, request.TheftOverrideReason) {
+		return
+	}
+	cover, err := warrantyService.markWarrantyClaim(&order)
+	if err != nil {
+		log.Printf("Error checking repair warranty for quote %s: %v", quoteID, err)
+		http.Error(w, "Failed to convert quote", http.StatusInternalServerError)
+		return
+	}
+
+	order.SLADueAt = slaDueAt(ticketType, time.Now())
+	if order.SLADueAt != nil {
+		due := *order.SLADueAt
+		order.ExpectedDeliveryDate = &due
+	}
+	order.Priority = defaultOrderPriority(&order, time.Now())
+	if order.ID, err = idService.Next(EntityTicket); err != nil {
+		log.Printf("Error generating ticket ID: %v", err)
+		http.Error(w, "Failed to convert quote", http.StatusInternalServerError)
+		return
+	}
+	order.Status = "New Order"
+	// Work the warranty covers is billed free and needs no deposit
+	billable := quote.Total
+	for _, item := range quote.Items {
+		if cover.Covers(item.Description) {
+			billable -= item.Amount
+		}
+	}
+	if deposit := ticketType.RequiredDeposit(billable); deposit > 0 {
+		order.HoldState, order.HoldReason = HoldAwaitingPayment, "Deposit of "+deposit.String()+" required"
+	}
+	order.CreatedBy = actorID(r)
+
+	err = quoteService.Convert(quote, &order, cover)
+	if err == errQuoteConverted || err == errQuoteExpired {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error converting quote %s: %v", quoteID, err)
+		http.Error(w, "Failed to convert quote", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Quote %s converted to order %s by %s", quoteID, order.ID, actorID(r))
+	audited := order
+	audited.Identity = nil
+	auditService.Record(r, AuditTicketCreated, "order", order.ID, nil, audited)
+	auditService.Record(r, AuditQuoteConverted, "quote", quoteID, map[string]string{"status": QuoteOpen},
+		map[string]string{"status": QuoteConverted, "order_id": order.ID})
+	for _, check := range order.TheftChecks {
+		if check.OverriddenBy != "" {
+			auditService.Record(r, AuditTheftCheckOverridden, "order", order.ID, nil, check)
+		}
+	}
+	response := map[string]string{
+		"message":  "Quote converted successfully",
+		"order_id": order.ID,
+	}
+	if deposit := ticketType.RequiredDeposit(billable); deposit > 0 {
+		response["deposit_required"] = deposit.String()
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
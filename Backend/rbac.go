@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Staff roles
+const (
+	RoleAdmin     = "Admin"
+	RoleEngineer  = "Engineer"
+	RoleFrontDesk = "FrontDesk"
+	RoleReporting = "Reporting"
+)
+
+// staffRoles work tickets; Reporting is a read-only role for the accountant
+// or an analyst and only reaches the report endpoints.
+var (
+	staffRoles = []string{RoleAdmin, RoleEngineer, RoleFrontDesk}
+	allRoles   = []string{RoleAdmin, RoleEngineer, RoleFrontDesk, RoleReporting}
+)
+
+// legacyRoles maps role names used before RBAC to their current equivalent.
+var legacyRoles = map[string]string{
+	"Administrator": RoleAdmin,
+	"User":          RoleFrontDesk,
+}
+
+// normalizeRole resolves legacy role names, so tokens issued before the
+// rename keep working until they expire.
+func normalizeRole(role string) string {
+	if mapped, ok := legacyRoles[role]; ok {
+		return mapped
+	}
+	return role
+}
+
+func isValidRole(role string) bool {
+	for _, r := range allRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRole(r *http.Request, roles ...string) bool {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return false
+	}
+
+	// API keys act as the role of the scope that opened the endpoint
+	role := normalizeRole(claims.Role)
+	if claims.APIKeyID != "" {
+		role = apiKeyRole(claims.Scopes, r.URL.Path)
+	}
+	if role == "" {
+		return false
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRoles restricts a handler to users holding one of roles.
+func requireRoles(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !hasRole(r, roles...) {
+				http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// Finer-grained checks go through requirePermission (permissions.go).
+var (
+	adminOnly = requireRoles(RoleAdmin)
+	anyStaff  = requireRoles(staffRoles...)
+	reporting = requireRoles(RoleAdmin, RoleReporting)
+)
+
+// statusRoles lists who may move a ticket into each status. Front desk books
+// devices in and hands them back; the repair stages in between belong to
+// engineers.
+var statusRoles = map[string][]string{
+	"New Order":          staffRoles,
+	"In Progress":        {RoleAdmin, RoleEngineer},
+	"Ready for Delivery": {RoleAdmin, RoleEngineer},
+	"Collected":          staffRoles,
+}
+
+// canSetStatus reports whether the request's user may move a ticket to status.
+func canSetStatus(r *http.Request, status string) bool {
+	return hasRole(r, statusRoles[status]...)
+}
+
+// roleMigrationStatements rename legacy roles in place.
+var roleMigrationStatements = []string{
+	`UPDATE users SET role = 'Admin' WHERE role = 'Administrator'`,
+	`UPDATE users SET role = 'FrontDesk' WHERE role = 'User'`,
+	`ALTER TABLE users ALTER COLUMN role SET DEFAULT 'FrontDesk'`,
+}
+
+func (us *UserService) UpdateUserRole(userID, role string) error {
+	result, err := us.db.Exec(`UPDATE users SET role = ?, updated_at = NOW() WHERE id = ?`, role, userID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		if _, err := us.GetUserByID(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateUserRoleHandler changes a user's role. Admin only.
+func UpdateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "PUT" {
+		http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		UserID string `json:"user_id"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if request.UserID == "" || !isValidRole(request.Role) {
+		http.Error(w, "User ID and a valid role (Admin, Engineer, FrontDesk, Reporting) are required", http.StatusBadRequest)
+		return
+	}
+
+	if request.UserID == actorID(r) && request.Role != RoleAdmin {
+		http.Error(w, "You cannot remove your own Admin role", http.StatusBadRequest)
+		return
+	}
+
+	var previousRole string
+	if user, err := userService.GetUserByID(request.UserID); err == nil {
+		previousRole = user.Role
+	}
+
+	err := userService.UpdateUserRole(request.UserID, request.Role)
+	if err != nil {
+		log.Printf("Error updating role for user %s: %v", request.UserID, err)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %s role changed to %s by %s", request.UserID, request.Role, actorID(r))
+	auditService.Record(r, AuditRoleChanged, "user", request.UserID,
+		map[string]string{"role": previousRole}, map[string]string{"role": request.Role})
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "User role updated successfully",
+	})
+}
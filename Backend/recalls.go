@@ -0,0 +1,576 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A recall is run when a batch of repairs turns out to have used faulty
+// parts. The affected tickets are those whose part costs (profitability.go)
+// took the part, optionally narrowed to a supplier lot (lots.go), a serial
+// range and when the part was fitted. Creating the campaign records every affected ticket and
+// queues a recall notice to each customer through the outbox; staff then
+// record whether the customer responded and link the ticket they were
+// rebooked on. Cancelled tickets are never recalled.
+
+const recallCampaignsTable = `
+	CREATE TABLE IF NOT EXISTS recall_campaigns (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		title VARCHAR(255) NOT NULL,
+		message TEXT NOT NULL,
+		part_sku VARCHAR(64) NOT NULL,
+		lot VARCHAR(100) NULL,
+		serial_from VARCHAR(100) NULL,
+		serial_to VARCHAR(100) NULL,
+		fitted_from TIMESTAMP NULL,
+		fitted_to TIMESTAMP NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (part_sku) REFERENCES parts(sku)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const recallTicketsTable = `
+	CREATE TABLE IF NOT EXISTS recall_tickets (
+		recall_id BIGINT NOT NULL,
+		order_id VARCHAR(50) NOT NULL,
+		notified TINYINT(1) NOT NULL DEFAULT 0,
+		response ENUM('pending', 'accepted', 'declined', 'unreachable') NOT NULL DEFAULT 'pending',
+		responded_at TIMESTAMP NULL,
+		rebooked_order_id VARCHAR(50) NULL,
+		updated_by VARCHAR(50) NULL,
+		PRIMARY KEY (recall_id, order_id),
+		INDEX idx_recall_tickets_order (order_id),
+		FOREIGN KEY (recall_id) REFERENCES recall_campaigns(id) ON DELETE CASCADE,
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Recall responses
+const (
+	RecallPending     = "pending"
+	RecallAccepted    = "accepted" // The customer will bring the device back
+	RecallDeclined    = "declined"
+	RecallUnreachable = "unreachable"
+)
+
+var recallResponses = []string{RecallPending, RecallAccepted, RecallDeclined, RecallUnreachable}
+
+var errRecallNoTickets = errors.New("no tickets match the recall criteria")
+
+// RecallCriteria selects the tickets a recall covers. Serials are compared
+// as text, so a range only works for serials of the same format.
+type RecallCriteria struct {
+	PartSKU    string     `json:"part_sku"`
+	Lot        string     `json:"lot,omitempty"`
+	SerialFrom string     `json:"serial_from,omitempty"`
+	SerialTo   string     `json:"serial_to,omitempty"`
+	FittedFrom *time.Time `json:"fitted_from,omitempty"`
+	FittedTo   *time.Time `json:"fitted_to,omitempty"`
+}
+
+// RecallCampaign is a recall with counts of its tickets' progress.
+type RecallCampaign struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"` // Sent to every affected customer
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	RecallCriteria
+	Tickets   int `json:"tickets"`
+	Notified  int `json:"notified"` // Tickets whose customer has an email to send the notice to
+	Responded int `json:"responded"`
+	Rebooked  int `json:"rebooked"`
+}
+
+// RecallTicket is a ticket affected by a recall.
+type RecallTicket struct {
+	RecallID        int64      `json:"recall_id,omitempty"`
+	OrderID         string     `json:"order_id"`
+	CustomerName    string     `json:"customer_name"`
+	CustomerEmail   string     `json:"customer_email,omitempty"`
+	CustomerPhone   string     `json:"customer_phone,omitempty"`
+	DeviceType      string     `json:"device_type"`
+	DeviceModel     string     `json:"device_model,omitempty"`
+	PartSerial      string     `json:"part_serial,omitempty"`
+	FittedAt        time.Time  `json:"fitted_at"`
+	Notified        bool       `json:"notified"`
+	Response        string     `json:"response,omitempty"`
+	RespondedAt     *time.Time `json:"responded_at,omitempty"`
+	RebookedOrderID string     `json:"rebooked_order_id,omitempty"`
+}
+
+// RecallNotice is the outbox payload asking a customer to bring a device back.
+type RecallNotice struct {
+	RecallID int64  `json:"recall_id"`
+	OrderID  string `json:"order_id"`
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+}
+
+// RecallService handles recall campaigns
+type RecallService struct {
+	db *sql.DB
+}
+
+func NewRecallService(database *sql.DB) *RecallService {
+	return &RecallService{db: database}
+}
+
+// Affected returns the tickets matching criteria, one row per ticket with
+// the earliest matching part.
+func (rs *RecallService) Affected(q queryer, criteria RecallCriteria) ([]RecallTicket, error) {
+	where := []string{`c.kind = 'part'`, `c.part_sku = ?`, `o.deleted_at IS NULL`}
+	args := []interface{}{criteria.PartSKU}
+	if criteria.Lot != "" {
+		where = append(where, `EXISTS (SELECT 1 FROM stock_movements m
+			WHERE m.order_id = c.order_id AND m.part_sku = c.part_sku AND m.lot = ? AND m.reason = 'consumed')`)
+		args = append(args, criteria.Lot)
+	}
+	if criteria.SerialFrom != "" {
+		where = append(where, `c.part_serial BETWEEN ? AND ?`)
+		args = append(args, criteria.SerialFrom, criteria.SerialTo)
+	}
+	if criteria.FittedFrom != nil {
+		where = append(where, `c.created_at >= ?`)
+		args = append(args, *criteria.FittedFrom)
+	}
+	if criteria.FittedTo != nil {
+		where = append(where, `c.created_at < ?`)
+		args = append(args, *criteria.FittedTo)
+	}
+
+	rows, err := q.Query(`
+		SELECT o.id, o.customer_name, o.customer_email, o.customer_phone, o.device_type, o.device_model,
+		       MIN(c.part_serial), MIN(c.created_at)
+		FROM ticket_costs c JOIN orders o ON o.id = c.order_id
+		WHERE `+strings.Join(where, " AND ")+`
+		GROUP BY o.id, o.customer_name, o.customer_email, o.customer_phone, o.device_type, o.device_model
+		ORDER BY MIN(c.created_at), o.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []RecallTicket{}
+	for rows.Next() {
+		var ticket RecallTicket
+		var email, phone, model, serial sql.NullString
+		if err := rows.Scan(&ticket.OrderID, &ticket.CustomerName, &email, &phone, &ticket.DeviceType, &model,
+			&serial, &ticket.FittedAt); err != nil {
+			return nil, err
+		}
+		ticket.CustomerEmail, ticket.CustomerPhone = email.String, phone.String
+		ticket.DeviceModel, ticket.PartSerial = model.String, serial.String
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
+
+// Create records a campaign with every affected ticket and queues a notice
+// to each customer with an email address.
+func (rs *RecallService) Create(campaign *RecallCampaign) error {
+	tx, err := rs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM parts WHERE sku = ?`, campaign.PartSKU).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return errUnknownPart
+	}
+	if err != nil {
+		return err
+	}
+	tickets, err := rs.Affected(tx, campaign.RecallCriteria)
+	if err != nil {
+		return err
+	}
+	if len(tickets) == 0 {
+		return errRecallNoTickets
+	}
+
+	campaign.CreatedAt = time.Now()
+	result, err := tx.Exec(`
+		INSERT INTO recall_campaigns (title, message, part_sku, lot, serial_from, serial_to, fitted_from, fitted_to, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, campaign.Title, campaign.Message, campaign.PartSKU, nullString(campaign.Lot), nullString(campaign.SerialFrom), nullString(campaign.SerialTo),
+		campaign.FittedFrom, campaign.FittedTo, nullString(campaign.CreatedBy), campaign.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if campaign.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	campaign.Tickets = len(tickets)
+	for _, ticket := range tickets {
+		notified := ticket.CustomerEmail != ""
+		if _, err := tx.Exec(`INSERT INTO recall_tickets (recall_id, order_id, notified) VALUES (?, ?, ?)`,
+			campaign.ID, ticket.OrderID, notified); err != nil {
+			return err
+		}
+		if !notified {
+			continue
+		}
+		campaign.Notified++
+		notice := RecallNotice{RecallID: campaign.ID, OrderID: ticket.OrderID, Title: campaign.Title, Message: campaign.Message}
+		if err := enqueueOutbox(tx, "recall.notice", ticket.OrderID, notice); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// List returns every campaign, newest first.
+func (rs *RecallService) List() ([]RecallCampaign, error) {
+	rows, err := rs.db.Query(`
+		SELECT c.id, c.title, c.message, c.part_sku, c.lot, c.serial_from, c.serial_to, c.fitted_from, c.fitted_to,
+		       c.created_by, c.created_at, COUNT(t.order_id), COALESCE(SUM(t.notified), 0),
+		       COALESCE(SUM(t.response <> 'pending'), 0), COUNT(t.rebooked_order_id)
+		FROM recall_campaigns c LEFT JOIN recall_tickets t ON t.recall_id = c.id
+		GROUP BY c.id ORDER BY c.created_at DESC, c.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []RecallCampaign{}
+	for rows.Next() {
+		var campaign RecallCampaign
+		var lot, serialFrom, serialTo, createdBy sql.NullString
+		var fittedFrom, fittedTo sql.NullTime
+		if err := rows.Scan(&campaign.ID, &campaign.Title, &campaign.Message, &campaign.PartSKU, &lot, &serialFrom, &serialTo,
+			&fittedFrom, &fittedTo, &createdBy, &campaign.CreatedAt, &campaign.Tickets, &campaign.Notified,
+			&campaign.Responded, &campaign.Rebooked); err != nil {
+			return nil, err
+		}
+		campaign.Lot, campaign.SerialFrom, campaign.SerialTo = lot.String, serialFrom.String, serialTo.String
+		campaign.CreatedBy = createdBy.String
+		campaign.FittedFrom, campaign.FittedTo = timePtr(fittedFrom), timePtr(fittedTo)
+		campaigns = append(campaigns, campaign)
+	}
+	return campaigns, rows.Err()
+}
+
+// Tickets returns the tickets of a campaign with their responses.
+func (rs *RecallService) Tickets(recallID int64) ([]RecallTicket, error) {
+	var exists int
+	if err := rs.db.QueryRow(`SELECT 1 FROM recall_campaigns WHERE id = ?`, recallID).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	rows, err := rs.db.Query(`
+		SELECT t.recall_id, t.order_id, o.customer_name, o.customer_email, o.customer_phone, o.device_type, o.device_model,
+		       t.notified, t.response, t.responded_at, t.rebooked_order_id
+		FROM recall_tickets t JOIN orders o ON o.id = t.order_id
+		WHERE t.recall_id = ? ORDER BY t.order_id
+	`, recallID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []RecallTicket{}
+	for rows.Next() {
+		var ticket RecallTicket
+		var email, phone, model, rebooked sql.NullString
+		var respondedAt sql.NullTime
+		if err := rows.Scan(&ticket.RecallID, &ticket.OrderID, &ticket.CustomerName, &email, &phone, &ticket.DeviceType,
+			&model, &ticket.Notified, &ticket.Response, &respondedAt, &rebooked); err != nil {
+			return nil, err
+		}
+		ticket.CustomerEmail, ticket.CustomerPhone, ticket.DeviceModel = email.String, phone.String, model.String
+		ticket.RespondedAt, ticket.RebookedOrderID = timePtr(respondedAt), rebooked.String
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
+
+// RecordResponse records a customer's answer to a recall. A ticket the
+// customer was rebooked on implies they accepted.
+func (rs *RecallService) RecordResponse(recallID int64, orderID, response, rebookedOrderID, actorID string) error {
+	if rebookedOrderID != "" {
+		if err := checkOrderExists(rs.db, rebookedOrderID); err != nil {
+			return err
+		}
+		response = RecallAccepted
+	}
+	var respondedAt interface{}
+	if response != RecallPending {
+		respondedAt = time.Now()
+	}
+
+	result, err := rs.db.Exec(`
+		UPDATE recall_tickets SET response = ?, responded_at = ?, rebooked_order_id = ?, updated_by = ?
+		WHERE recall_id = ? AND order_id = ?
+	`, response, respondedAt, nullString(rebookedOrderID), nullString(actorID), recallID, orderID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var exists int
+		return rs.db.QueryRow(`SELECT 1 FROM recall_tickets WHERE recall_id = ? AND order_id = ?`, recallID, orderID).Scan(&exists)
+	}
+	return nil
+}
+
+var recallService *RecallService
+
+// deliverRecallNotice emails a recall notice to the customer of its ticket.
+func deliverRecallNotice(msg OutboxMessage) error {
+	var notice RecallNotice
+	if err := json.Unmarshal(msg.Payload, &notice); err != nil {
+		return err
+	}
+	order, err := orderService.GetOrder(notice.OrderID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if order.CustomerEmail == "" {
+		return nil
+	}
+
+	// The notice itself is written by staff; the greeting and context
+	// follow the customer's language
+	language, err := orderLanguage(order)
+	if err != nil {
+		return err
+	}
+	body := localize(language, "email.recall.body", map[string]string{
+		"Name":    order.CustomerName,
+		"Message": notice.Message,
+		"Device":  strings.TrimSpace(order.DeviceType + " " + order.DeviceModel),
+		"Order":   order.ID,
+	})
+	return emailService.Send(order.ID, msg.ID, order.CustomerEmail, notice.Title, body)
+}
+
+// parseRecallCriteria reads and validates the criteria of a recall request.
+func parseRecallCriteria(criteria *RecallCriteria, fieldErrors *ValidationErrors) {
+	criteria.PartSKU = strings.TrimSpace(criteria.PartSKU)
+	criteria.Lot = strings.TrimSpace(criteria.Lot)
+	criteria.SerialFrom = strings.TrimSpace(criteria.SerialFrom)
+	criteria.SerialTo = strings.TrimSpace(criteria.SerialTo)
+	if criteria.PartSKU == "" {
+		fieldErrors.Add("part_sku", "is required")
+	}
+	if (criteria.SerialFrom == "") != (criteria.SerialTo == "") {
+		fieldErrors.Add("serial_to", "serial_from and serial_to must be given together")
+	} else if criteria.SerialFrom > criteria.SerialTo {
+		fieldErrors.Add("serial_to", "must not sort before serial_from")
+	}
+	if len(criteria.Lot) > 100 {
+		fieldErrors.Add("lot", "is too long")
+	}
+	if len(criteria.SerialFrom) > 100 || len(criteria.SerialTo) > 100 {
+		fieldErrors.Add("serial_from", "is too long")
+	}
+	if criteria.FittedFrom != nil && criteria.FittedTo != nil && !criteria.FittedFrom.Before(*criteria.FittedTo) {
+		fieldErrors.Add("fitted_to", "must be after fitted_from")
+	}
+}
+
+// RecallsHandler lists recall campaigns (GET) or starts one (POST {"title":
+// "...", "message": "...", "part_sku": "...", "lot": "...", "serial_from": "...",
+// "serial_to": "...", "fitted_from": "...", "fitted_to": "..."}).
+func RecallsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		campaigns, err := recallService.List()
+		if err != nil {
+			log.Printf("Error listing recalls: %v", err)
+			http.Error(w, "Failed to retrieve recalls", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(campaigns)
+
+	case "POST":
+		if !hasPermission(r, PermRecallsManage) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var campaign RecallCampaign
+		if err := json.NewDecoder(r.Body).Decode(&campaign); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		campaign.Title = strings.TrimSpace(campaign.Title)
+		campaign.Message = strings.TrimSpace(campaign.Message)
+		if campaign.Title == "" || len(campaign.Title) > 255 {
+			fieldErrors.Add("title", "is required and must be at most 255 characters")
+		}
+		if campaign.Message == "" || len(campaign.Message) > 5000 {
+			fieldErrors.Add("message", "is required and must be at most 5000 characters")
+		}
+		parseRecallCriteria(&campaign.RecallCriteria, &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		campaign.CreatedBy = actorID(r)
+		err := recallService.Create(&campaign)
+		switch {
+		case err == errUnknownPart:
+			writeValidationErrors(w, ValidationErrors{{Field: "part_sku", Message: err.Error()}})
+			return
+		case err == errRecallNoTickets:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("Error creating recall for %s: %v", campaign.PartSKU, err)
+			http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Recall %d for %s created by %s: %d tickets", campaign.ID, campaign.PartSKU, actorID(r), campaign.Tickets)
+		auditService.Record(r, AuditRecallCreated, "recall", strconv.FormatInt(campaign.ID, 10), nil, campaign)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(campaign)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RecallAffectedHandler previews the tickets a recall would cover (GET
+// ?part_sku=&lot=&serial_from=&serial_to=&fitted_from=&fitted_to=).
+func RecallAffectedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasPermission(r, PermRecallsManage) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	var fieldErrors ValidationErrors
+	criteria := RecallCriteria{
+		PartSKU:    query.Get("part_sku"),
+		Lot:        query.Get("lot"),
+		SerialFrom: query.Get("serial_from"),
+		SerialTo:   query.Get("serial_to"),
+		FittedFrom: parseDateField("fitted_from", query.Get("fitted_from"), &fieldErrors),
+		FittedTo:   parseDateField("fitted_to", query.Get("fitted_to"), &fieldErrors),
+	}
+	parseRecallCriteria(&criteria, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	tickets, err := recallService.Affected(recallService.db, criteria)
+	if err != nil {
+		log.Printf("Error finding tickets for recall of %s: %v", criteria.PartSKU, err)
+		http.Error(w, "Failed to find affected tickets", http.StatusInternalServerError)
+		return
+	}
+	piiPolicyFor(r).shapeRecallTickets(tickets)
+	json.NewEncoder(w).Encode(tickets)
+}
+
+// RecallTicketsHandler lists a campaign's tickets (GET ?recall_id=) or
+// records a customer's response (PUT {"recall_id": 3, "order_id": "...",
+// "response": "accepted", "rebooked_order_id": "..."}).
+func RecallTicketsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		recallID, err := strconv.ParseInt(r.URL.Query().Get("recall_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "recall_id is required", http.StatusBadRequest)
+			return
+		}
+		tickets, err := recallService.Tickets(recallID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Recall not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error listing tickets of recall %d: %v", recallID, err)
+			http.Error(w, "Failed to retrieve recall tickets", http.StatusInternalServerError)
+			return
+		}
+		piiPolicyFor(r).shapeRecallTickets(tickets)
+		json.NewEncoder(w).Encode(tickets)
+
+	case "PUT":
+		if !hasPermission(r, PermRecallsManage) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			RecallID        int64  `json:"recall_id"`
+			OrderID         string `json:"order_id"`
+			Response        string `json:"response"`
+			RebookedOrderID string `json:"rebooked_order_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		request.RebookedOrderID = strings.TrimSpace(request.RebookedOrderID)
+		if request.RecallID == 0 {
+			fieldErrors.Add("recall_id", "is required")
+		}
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if request.RebookedOrderID == "" && !slices.Contains(recallResponses, request.Response) {
+			fieldErrors.Add("response", "must be pending, accepted, declined or unreachable")
+		}
+		if request.RebookedOrderID != "" && request.Response != "" && request.Response != RecallAccepted {
+			fieldErrors.Add("response", "a rebooked customer has accepted the recall")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		err := recallService.RecordResponse(request.RecallID, request.OrderID, request.Response,
+			request.RebookedOrderID, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Recall ticket or rebooked order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error recording response to recall %d for %s: %v", request.RecallID, request.OrderID, err)
+			http.Error(w, "Failed to record response", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditRecallResponse, "order", request.OrderID, nil, request)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Response recorded successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
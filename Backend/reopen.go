@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A customer who reports soon after collection that the fault persists gets
+// their ticket reopened: POST /api/v1/orders/{id}/reopen records a
+// TicketReopened event with the reason and moves the ticket from Collected
+// to Reopened, from where it goes through the workflow again. The SLA clock
+// starts afresh from the reopen under the ticket type's SLA. Its items,
+// payments and profitability snapshot are left as they were. The work can
+// instead go on a zero-cost warranty ticket cloned from the original: a
+// Rework ticket for the same customer and devices whose parent_ticket_id and
+// warranty_claim_of point back at it.
+
+// StatusReopened is the status of a collected ticket brought back because
+// the fault persists. Like Cancelled it is reached only through its own
+// endpoint; the status endpoint moves the ticket on from there.
+const StatusReopened = "Reopened"
+
+// TicketReopenedPayload records why a collected ticket was reopened and the
+// warranty ticket cloned from it, if any.
+type TicketReopenedPayload struct {
+	From             string     `json:"from"`
+	Reason           string     `json:"reason"`
+	WarrantyTicketID string     `json:"warranty_ticket_id,omitempty"`
+	SLADueAt         *time.Time `json:"sla_due_at,omitempty"` // The restarted SLA; none when the type has no SLA
+}
+
+// reopenWindow is how long after collection a ticket can be reopened; zero
+// or less means no limit.
+func reopenWindow() int {
+	return getEnvInt("REOPEN_WINDOW_DAYS", 30)
+}
+
+// ReopenTicket moves a collected ticket to Reopened and returns the ID of
+// the warranty ticket cloned from it when cloneWarranty is set.
+func (os *OrderService) ReopenTicket(orderID, reason string, cloneWarranty bool, actorID string) (string, error) {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	current, err := os.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if current != closedStatus {
+		return "", &StatusGuardError{Reason: "only a collected ticket can be reopened"}
+	}
+	if days := reopenWindow(); days > 0 {
+		var collectedAt sql.NullTime
+		err := tx.QueryRow(`SELECT MAX(changed_at) FROM ticket_status_history WHERE order_id = ? AND to_status = ?`,
+			orderID, closedStatus).Scan(&collectedAt)
+		if err != nil {
+			return "", err
+		}
+		if collectedAt.Valid && time.Since(collectedAt.Time) > time.Duration(days)*24*time.Hour {
+			return "", &StatusGuardError{Reason: fmt.Sprintf("the ticket was collected more than %d days ago", days)}
+		}
+	}
+
+	// The collected ticket's SLA ran out long ago; the reopened work gets a
+	// fresh one rather than an instant breach
+	var typeCode sql.NullString
+	if err := tx.QueryRow(`SELECT ticket_type FROM orders WHERE id = ?`, orderID).Scan(&typeCode); err != nil {
+		return "", err
+	}
+	if !typeCode.Valid {
+		typeCode.String = defaultTicketType
+	}
+	ticketType, err := ticketTypeService.GetTicketType(typeCode.String)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if err == sql.ErrNoRows {
+		ticketType = nil
+	}
+
+	payload := TicketReopenedPayload{From: current, Reason: reason, SLADueAt: slaDueAt(ticketType, time.Now())}
+	if cloneWarranty {
+		created, err := os.warrantyClone(tx, orderID, reason, actorID)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.events.Append(tx, created.ID, EventTicketCreated, actorID, created); err != nil {
+			return "", err
+		}
+		payload.WarrantyTicketID = created.ID
+	}
+	if _, err := os.events.Append(tx, orderID, EventTicketReopened, actorID, payload); err != nil {
+		return "", err
+	}
+
+	for _, id := range []string{orderID, payload.WarrantyTicketID} {
+		if id == "" {
+			continue
+		}
+		if err := migrationService.DualWrite(tx, "orders", id); err != nil {
+			return "", err
+		}
+	}
+	return payload.WarrantyTicketID, tx.Commit()
+}
+
+// warrantyClone builds the zero-cost Rework ticket that takes over the work
+// of a reopened ticket.
+func (os *OrderService) warrantyClone(tx *sql.Tx, orderID, reason, actorID string) (*Order, error) {
+	order, err := scanOrder(tx.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE id = ?`, orderID))
+	if err != nil {
+		return nil, err
+	}
+	orders := []Order{*order}
+	if err := os.loadDevices(orders); err != nil {
+		return nil, err
+	}
+	original := orders[0]
+
+	ticketType, err := ticketTypeService.GetTicketType(reworkTicketType)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	devices := original.Devices
+	if len(devices) == 0 && original.DeviceType != "" {
+		devices = []OrderDevice{primaryDevice(&original)}
+	}
+	for i := range devices {
+		devices[i].Position = i + 1
+	}
+	// Reopening a warranty ticket claims against the original repair
+	claimOf := orderID
+	if original.WarrantyClaimOf != "" {
+		claimOf = original.WarrantyClaimOf
+	}
+
+	created := &Order{
+		CustomerName:       original.CustomerName,
+		CustomerEmail:      original.CustomerEmail,
+		CustomerPhone:      original.CustomerPhone,
+		DeviceType:         original.DeviceType,
+		DeviceModel:        original.DeviceModel,
+		DeviceSerial:       original.DeviceSerial,
+		Devices:            devices,
+		Services:           []string{},
+		IssueDescription:   reason,
+		Status:             "New Order",
+		CreatedBy:          actorID,
+		AssignedEngineerID: original.AssignedEngineerID,
+		DataBackupConsent:  original.DataBackupConsent,
+		TicketType:         reworkTicketType,
+		WarrantyClaimOf:    claimOf,
+		ParentTicketID:     orderID,
+		AccountID:          original.AccountID,
+	}
+	created.SLADueAt = slaDueAt(ticketType, time.Now())
+	if created.SLADueAt != nil {
+		due := *created.SLADueAt
+		created.ExpectedDeliveryDate = &due
+	}
+	created.Priority = defaultOrderPriority(created, time.Now())
+	if created.ID, err = idService.Next(EntityTicket); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// projectTicketReopened moves the orders row to Reopened. Totals and
+// payments stay as they were at collection.
+func projectTicketReopened(tx *sql.Tx, event *TicketEvent) error {
+	var payload TicketReopenedPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE orders SET status = ?, sla_due_at = ?, sla_breached_at = NULL, updated_at = ?, last_updated_by = NULLIF(?, '')
+		WHERE id = ?
+	`, StatusReopened, payload.SLADueAt, event.OccurredAt, event.ActorID, event.TicketID)
+	return err
+}
+
+// reopenOrder serves POST /api/v1/orders/{id}/reopen
+// ({"reason": "...", "create_warranty_ticket": true}).
+func reopenOrder(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsReopen) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Reason               string `json:"reason"`
+		CreateWarrantyTicket bool   `json:"create_warranty_ticket"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Reason == "" {
+		fieldErrors.Add("reason", "is required")
+	} else if len(request.Reason) > 500 {
+		fieldErrors.Add("reason", "is too long")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	warrantyID, err := orderService.ReopenTicket(orderID, request.Reason, request.CreateWarrantyTicket, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reopening order %s: %v", orderID, err)
+		http.Error(w, "Failed to reopen order", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Order %s reopened by %s", orderID, actorID(r))
+	auditService.Record(r, AuditTicketReopened, "order", orderID, map[string]string{"status": closedStatus},
+		map[string]string{"status": StatusReopened, "reason": request.Reason, "warranty_ticket_id": warrantyID})
+	response := map[string]string{
+		"message": "Order reopened successfully",
+	}
+	if warrantyID != "" {
+		response["warranty_ticket_id"] = warrantyID
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report endpoints serve the Reporting role (the accountant, an analyst) as
+// well as administrators. They return aggregates, and where rows are needed
+// customers are pseudonymized: initials only, with contact details replaced
+// by a keyed hash so repeat customers can still be counted.
+
+// ReportRange is the period a report covers; To is exclusive. Reports that
+// support it narrow to the tickets carrying Tag (tags.go).
+type ReportRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Tag  string    `json:"tag,omitempty"`
+}
+
+// tagWhere returns the condition narrowing column to the period's tag, if
+// any, and its arguments.
+func (period ReportRange) tagWhere(column string) (string, []interface{}) {
+	if period.Tag == "" {
+		return "", nil
+	}
+	return tagsWhere(column, []string{period.Tag})
+}
+
+// ReportBucket is one row of a grouped count.
+type ReportBucket struct {
+	Key     string `json:"key"`
+	Tickets int    `json:"tickets"`
+	Billed  Money  `json:"billed"`
+}
+
+// ReportSummary aggregates the tickets booked in a period.
+type ReportSummary struct {
+	Range                ReportRange    `json:"range"`
+	Tickets              int            `json:"tickets"`
+	UniqueCustomers      int            `json:"unique_customers"`
+	Billed               Money          `json:"billed"`
+	Outstanding          Money          `json:"outstanding"`
+	PaymentsReceived     Money          `json:"payments_received"`
+	AverageTurnaroundHrs *float64       `json:"average_turnaround_hours,omitempty"`
+	AverageShopHrs       *float64       `json:"average_shop_hours,omitempty"`     // Turnaround less customer time
+	AverageCustomerHrs   *float64       `json:"average_customer_hours,omitempty"` // Time on hold waiting on the customer
+	ByStatus             []ReportBucket `json:"by_status"`
+	ByTicketType         []ReportBucket `json:"by_ticket_type"`
+	ByMonth              []ReportBucket `json:"by_month"`
+}
+
+// ReportTicket is a pseudonymized ticket row.
+type ReportTicket struct {
+	ID           string    `json:"id"`
+	Customer     string    `json:"customer"`
+	CustomerHash string    `json:"customer_hash"`
+	PhoneHash    string    `json:"phone_hash"`
+	DeviceType   string    `json:"device_type"`
+	TicketType   string    `json:"ticket_type,omitempty"`
+	Status       string    `json:"status"`
+	TotalCost    Money     `json:"total_cost"`
+	AmountPaid   Money     `json:"amount_paid"`
+	CreatedAt    time.Time `json:"created_at"`
+	// CustomFields holds the ticket's number, date and dropdown custom
+	// fields; free text fields are left out as they may name the customer
+	CustomFields CustomFieldValues `json:"custom_fields"`
+}
+
+// ReportService runs read-only reporting queries
+type ReportService struct {
+	db *sql.DB
+}
+
+func NewReportService(database *sql.DB) *ReportService {
+	return &ReportService{db: database}
+}
+
+func (rs *ReportService) Summary(period ReportRange) (*ReportSummary, error) {
+	summary := &ReportSummary{Range: period}
+	tagWhere, tagArgs := period.tagWhere("id")
+	err := rs.db.QueryRow(`
+		SELECT COUNT(*), COUNT(DISTINCT LOWER(customer_email)),
+			COALESCE(SUM(total_cost), 0), COALESCE(SUM(GREATEST(total_cost - amount_paid, 0)), 0)
+		FROM orders WHERE created_at >= ? AND created_at < ? AND deleted_at IS NULL`+tagWhere,
+		append([]interface{}{period.From, period.To}, tagArgs...)...).Scan(&summary.Tickets, &summary.UniqueCustomers, &summary.Billed, &summary.Outstanding)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentTagWhere, _ := period.tagWhere("ticket_id")
+	err = rs.db.QueryRow(`
+		SELECT COALESCE(SUM(CAST(JSON_UNQUOTE(JSON_EXTRACT(payload, '$.amount')) AS DECIMAL(10,2))), 0)
+		FROM ticket_events WHERE event_type = ? AND occurred_at >= ? AND occurred_at < ?`+paymentTagWhere,
+		append([]interface{}{EventPaymentRecorded, period.From, period.To}, tagArgs...)...).Scan(&summary.PaymentsReceived)
+	if err != nil {
+		return nil, err
+	}
+
+	// Turnaround runs from booking to collection for tickets collected in the
+	// period; holds waiting on the customer count as customer time (holds.go)
+	var turnaround, customer sql.NullFloat64
+	turnaroundTagWhere, _ := period.tagWhere("o.id")
+	err = rs.db.QueryRow(`
+		SELECT AVG(TIMESTAMPDIFF(MINUTE, o.created_at, e.collected_at)) / 60,
+		       AVG(COALESCE(h.minutes, 0)) / 60
+		FROM orders o
+		JOIN (SELECT ticket_id, MAX(occurred_at) AS collected_at FROM ticket_events
+		      WHERE event_type = ? AND JSON_UNQUOTE(JSON_EXTRACT(payload, '$.to')) = 'Collected'
+		      GROUP BY ticket_id) e ON e.ticket_id = o.id
+		LEFT JOIN (SELECT order_id, SUM(TIMESTAMPDIFF(MINUTE, started_at, COALESCE(released_at, NOW()))) AS minutes
+		           FROM ticket_holds WHERE `+customerHoldClause+` GROUP BY order_id) h ON h.order_id = o.id
+		WHERE e.collected_at >= ? AND e.collected_at < ? AND o.deleted_at IS NULL`+turnaroundTagWhere,
+		append([]interface{}{EventStatusChanged, period.From, period.To}, tagArgs...)...).Scan(&turnaround, &customer)
+	if err != nil {
+		return nil, err
+	}
+	if turnaround.Valid && customer.Valid {
+		shop := turnaround.Float64 - customer.Float64
+		summary.AverageTurnaroundHrs = &turnaround.Float64
+		summary.AverageShopHrs = &shop
+		summary.AverageCustomerHrs = &customer.Float64
+	}
+
+	groups := []struct {
+		expr string
+		dest *[]ReportBucket
+	}{
+		{"status", &summary.ByStatus},
+		{"COALESCE(ticket_type, '')", &summary.ByTicketType},
+		{"DATE_FORMAT(created_at, '%Y-%m')", &summary.ByMonth},
+	}
+	for _, group := range groups {
+		buckets, err := rs.buckets(group.expr, period)
+		if err != nil {
+			return nil, err
+		}
+		*group.dest = buckets
+	}
+	return summary, nil
+}
+
+// buckets groups the period's tickets by a fixed column expression.
+func (rs *ReportService) buckets(expr string, period ReportRange) ([]ReportBucket, error) {
+	tagWhere, tagArgs := period.tagWhere("id")
+	rows, err := rs.db.Query(`
+		SELECT `+expr+` AS bucket, COUNT(*), COALESCE(SUM(total_cost), 0)
+		FROM orders WHERE created_at >= ? AND created_at < ? AND deleted_at IS NULL`+tagWhere+`
+		GROUP BY bucket ORDER BY bucket
+	`, append([]interface{}{period.From, period.To}, tagArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []ReportBucket{}
+	for rows.Next() {
+		var bucket ReportBucket
+		if err := rows.Scan(&bucket.Key, &bucket.Tickets, &bucket.Billed); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+// Tickets lists the period's tickets with customers pseudonymized.
+func (rs *ReportService) Tickets(period ReportRange, limit int) ([]ReportTicket, error) {
+	tagWhere, tagArgs := period.tagWhere("id")
+	args := append([]interface{}{period.From, period.To}, tagArgs...)
+	rows, err := rs.db.Query(`
+		SELECT id, customer_name, customer_email, customer_phone, device_type, ticket_type,
+			status, total_cost, amount_paid, created_at
+		FROM orders WHERE created_at >= ? AND created_at < ? AND deleted_at IS NULL`+tagWhere+`
+		ORDER BY created_at DESC LIMIT ?
+	`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []ReportTicket{}
+	for rows.Next() {
+		var ticket ReportTicket
+		var name, email, phone string
+		var ticketType sql.NullString
+		if err := rows.Scan(&ticket.ID, &name, &email, &phone, &ticket.DeviceType, &ticketType,
+			&ticket.Status, &ticket.TotalCost, &ticket.AmountPaid, &ticket.CreatedAt); err != nil {
+			return nil, err
+		}
+		ticket.Customer = initials(name)
+		ticket.CustomerHash = pseudonymize(strings.ToLower(email))
+		ticket.PhoneHash = pseudonymize(phone)
+		ticket.TicketType = ticketType.String
+		tickets = append(tickets, ticket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fields, err := customFieldService.ListFields(CustomFieldScopeTicket, true)
+	if err != nil {
+		return nil, err
+	}
+	structured := map[string]bool{}
+	for _, field := range fields {
+		structured[field.Key] = field.Type != CustomFieldText
+	}
+	ids := make([]string, len(tickets))
+	for i := range tickets {
+		ids[i] = tickets[i].ID
+	}
+	values, err := loadCustomFieldValues(rs.db, CustomFieldScopeTicket, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tickets {
+		tickets[i].CustomFields = CustomFieldValues{}
+		for key, value := range values[tickets[i].ID] {
+			if structured[key] {
+				tickets[i].CustomFields[key] = value
+			}
+		}
+	}
+	return tickets, nil
+}
+
+var reportService *ReportService
+
+// parseReportRange reads from/to (default: the last 30 days). A date-only
+// "to" includes that whole day.
+func parseReportRange(r *http.Request, fieldErrors *ValidationErrors) ReportRange {
+	query := r.URL.Query()
+	now := time.Now()
+	period := ReportRange{From: now.AddDate(0, 0, -30), To: now}
+
+	if from := parseDateField("from", query.Get("from"), fieldErrors); from != nil {
+		period.From = *from
+	}
+	if to := parseDateField("to", query.Get("to"), fieldErrors); to != nil {
+		period.To = *to
+		if len(query.Get("to")) == len("2006-01-02") {
+			period.To = to.AddDate(0, 0, 1)
+		}
+	}
+	if len(*fieldErrors) == 0 && !period.From.Before(period.To) {
+		fieldErrors.Add("to", "must be after from")
+	}
+	return period
+}
+
+// parseReportTag reads ?tag= into period for the reports that filter by tag.
+func parseReportTag(r *http.Request, period *ReportRange, fieldErrors *ValidationErrors) {
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		if tags := normalizeTags("tag", []string{tag}, fieldErrors); len(tags) == 1 {
+			period.Tag = tags[0]
+		}
+	}
+}
+
+// ReportSummaryHandler returns ticket and revenue aggregates for a period,
+// optionally narrowed to one tag (?tag=).
+func ReportSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	parseReportTag(r, &period, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	summary, err := reportService.Summary(period)
+	if err != nil {
+		log.Printf("Error building report summary: %v", err)
+		http.Error(w, "Failed to build report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(summary)
+}
+
+// ReportTicketsHandler returns pseudonymized ticket rows for a period,
+// optionally narrowed to one tag (?tag=).
+func ReportTicketsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	parseReportTag(r, &period, &fieldErrors)
+	limit := 500
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 5000 {
+			fieldErrors.Add("limit", "must be between 1 and 5000")
+		} else {
+			limit = n
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if !authorizeExport(w, r, ExportTicketRows, "json") {
+		return
+	}
+
+	tickets, err := reportService.Tickets(period, limit)
+	if err != nil {
+		log.Printf("Error building ticket report: %v", err)
+		http.Error(w, "Failed to build report", http.StatusInternalServerError)
+		return
+	}
+	recordExport(r, ExportTicketRows, "json", len(tickets))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"range":   period,
+		"tickets": tickets,
+	})
+}
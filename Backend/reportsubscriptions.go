@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Managers can have a report emailed to them on a schedule instead of
+// fetching it: a subscription names a report, its filters and whether it
+// comes daily, weekly or monthly, and is managed at
+// /api/v1/report-subscriptions. A background job queues each due report as
+// an outbox message covering the period just ended (the previous day, the
+// previous 7 days or the previous month); the email notifier then runs the
+// report through its own endpoint as the subscriber, so role checks and
+// filters behave exactly as over the API, and sends the result as an
+// attachment. A subscriber who has lost access to a report gets nothing, and
+// the error is kept on the subscription. Exports are not subscribable: they
+// are confined to the IP allow-list and logged per download, so no
+// subscription may set format, which is what turns a report such as the
+// contract SLA report into an export (its PDF).
+
+const reportSubscriptionsTable = `
+	CREATE TABLE IF NOT EXISTS report_subscriptions (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		user_id VARCHAR(50) NOT NULL,
+		report VARCHAR(50) NOT NULL,
+		filters JSON NULL,
+		frequency ENUM('daily', 'weekly', 'monthly') NOT NULL,
+		next_run_at TIMESTAMP NOT NULL,
+		last_sent_at TIMESTAMP NULL,
+		last_error VARCHAR(500) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_report_subscriptions_due (next_run_at),
+		INDEX idx_report_subscriptions_user (user_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Report subscription frequencies
+const (
+	ReportDaily   = "daily"
+	ReportWeekly  = "weekly"
+	ReportMonthly = "monthly"
+)
+
+var reportFrequencies = []string{ReportDaily, ReportWeekly, ReportMonthly}
+
+// subscribableReports maps the reports that can be subscribed to onto their
+// endpoints. Each takes the from/to range the schedule sets.
+var subscribableReports = map[string]string{
+	"summary":        "/api/v1/reports/summary",
+	"profitability":  "/api/v1/reports/profitability",
+	"wastage":        "/api/v1/reports/wastage",
+	"cogs":           "/api/v1/reports/cogs",
+	"holds":          "/api/v1/reports/holds",
+	"reschedules":    "/api/v1/reports/reschedules",
+	"utilization":    "/api/v1/reports/utilization",
+	"lobby":          "/api/v1/reports/lobby",
+	"account-health": "/api/v1/accounts/health",
+	"contract-sla":   "/api/v1/accounts/sla-report",
+}
+
+const (
+	maxReportFilters         = 10
+	maxReportAttachmentBytes = 10 << 20
+)
+
+var reportFilterKeyPattern = regexp.MustCompile(`^[a-z_]{1,30}$`)
+
+// reportExportFilter is the parameter that makes a report an export.
+const reportExportFilter = "format"
+
+// ReportSubscription is a report emailed to a user on a schedule.
+type ReportSubscription struct {
+	ID         int64             `json:"id"`
+	UserID     string            `json:"user_id"`
+	Report     string            `json:"report"`
+	Filters    map[string]string `json:"filters"`
+	Frequency  string            `json:"frequency"`
+	NextRunAt  time.Time         `json:"next_run_at"`
+	LastSentAt *time.Time        `json:"last_sent_at,omitempty"`
+	LastError  string            `json:"last_error,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// ReportDelivery is the outbox payload for one subscribed report.
+type ReportDelivery struct {
+	SubscriptionID int64     `json:"subscription_id"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+}
+
+// nextReportRun returns when a subscription runs next after now: the start
+// of the next day, Monday or first of the month, at hour.
+func nextReportRun(frequency string, now time.Time, hour int) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var next time.Time
+	switch frequency {
+	case ReportWeekly:
+		days := (8 - int(midnight.Weekday())) % 7
+		if days == 0 {
+			days = 7
+		}
+		next = midnight.AddDate(0, 0, days)
+	case ReportMonthly:
+		next = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	default:
+		next = midnight.AddDate(0, 0, 1)
+	}
+	return next.Add(time.Duration(hour) * time.Hour)
+}
+
+// reportPeriod is the period a run at runAt covers, ending at the start of
+// its day.
+func reportPeriod(frequency string, runAt time.Time) (time.Time, time.Time) {
+	to := time.Date(runAt.Year(), runAt.Month(), runAt.Day(), 0, 0, 0, 0, runAt.Location())
+	switch frequency {
+	case ReportWeekly:
+		return to.AddDate(0, 0, -7), to
+	case ReportMonthly:
+		return to.AddDate(0, -1, 0), to
+	}
+	return to.AddDate(0, 0, -1), to
+}
+
+// ReportSubscriptionService stores subscriptions and runs them
+type ReportSubscriptionService struct {
+	db      *sql.DB
+	hour    int          // Hour of the day reports are sent
+	handler http.Handler // The API routes reports are run through
+}
+
+func NewReportSubscriptionService(database *sql.DB) *ReportSubscriptionService {
+	return &ReportSubscriptionService{db: database, hour: getEnvInt("REPORT_SUBSCRIPTION_HOUR", 7)}
+}
+
+var reportSubscriptionService *ReportSubscriptionService
+
+// Create stores a subscription, due at its first scheduled run.
+func (rs *ReportSubscriptionService) Create(subscription *ReportSubscription) error {
+	filters, err := json.Marshal(subscription.Filters)
+	if err != nil {
+		return err
+	}
+	subscription.NextRunAt = nextReportRun(subscription.Frequency, time.Now(), rs.hour)
+	subscription.CreatedAt = time.Now()
+	result, err := rs.db.Exec(`
+		INSERT INTO report_subscriptions (user_id, report, filters, frequency, next_run_at) VALUES (?, ?, ?, ?, ?)
+	`, subscription.UserID, subscription.Report, string(filters), subscription.Frequency, subscription.NextRunAt)
+	if err != nil {
+		return err
+	}
+	subscription.ID, err = result.LastInsertId()
+	return err
+}
+
+const reportSubscriptionColumns = `id, user_id, report, filters, frequency, next_run_at, last_sent_at, last_error, created_at`
+
+func scanReportSubscription(row rowScanner) (*ReportSubscription, error) {
+	var subscription ReportSubscription
+	var filters []byte
+	var lastSentAt sql.NullTime
+	var lastError sql.NullString
+	err := row.Scan(&subscription.ID, &subscription.UserID, &subscription.Report, &filters, &subscription.Frequency,
+		&subscription.NextRunAt, &lastSentAt, &lastError, &subscription.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	subscription.Filters = map[string]string{}
+	if len(filters) > 0 {
+		if err := json.Unmarshal(filters, &subscription.Filters); err != nil {
+			return nil, err
+		}
+	}
+	subscription.LastSentAt = timePtr(lastSentAt)
+	subscription.LastError = lastError.String
+	return &subscription, nil
+}
+
+func (rs *ReportSubscriptionService) Get(id int64) (*ReportSubscription, error) {
+	return scanReportSubscription(rs.db.QueryRow(`SELECT `+reportSubscriptionColumns+` FROM report_subscriptions WHERE id = ?`, id))
+}
+
+// List returns userID's subscriptions, or everyone's when userID is empty.
+func (rs *ReportSubscriptionService) List(userID string) ([]ReportSubscription, error) {
+	query := `SELECT ` + reportSubscriptionColumns + ` FROM report_subscriptions`
+	var args []interface{}
+	if userID != "" {
+		query += ` WHERE user_id = ?`
+		args = append(args, userID)
+	}
+	rows, err := rs.db.Query(query+` ORDER BY created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []ReportSubscription{}
+	for rows.Next() {
+		subscription, err := scanReportSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, *subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+func (rs *ReportSubscriptionService) Delete(id int64) error {
+	result, err := rs.db.Exec(`DELETE FROM report_subscriptions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// QueueDue queues a delivery for every subscription that is due and moves
+// it on to its next run. Runs missed while the server was down are sent
+// once, for the period before the missed run.
+func (rs *ReportSubscriptionService) QueueDue(ctx context.Context) error {
+	tx, err := rs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, frequency, next_run_at FROM report_subscriptions
+		WHERE next_run_at <= NOW() ORDER BY next_run_at LIMIT 50 FOR UPDATE SKIP LOCKED
+	`)
+	if err != nil {
+		return err
+	}
+	type dueSubscription struct {
+		id        int64
+		frequency string
+		runAt     time.Time
+	}
+	var due []dueSubscription
+	for rows.Next() {
+		var d dueSubscription
+		if err := rows.Scan(&d.id, &d.frequency, &d.runAt); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for _, d := range due {
+		from, to := reportPeriod(d.frequency, d.runAt)
+		delivery := ReportDelivery{SubscriptionID: d.id, From: from, To: to}
+		if err := enqueueOutbox(tx, "report.subscription", strconv.FormatInt(d.id, 10), delivery); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE report_subscriptions SET next_run_at = ? WHERE id = ?`,
+			nextReportRun(d.frequency, now, rs.hour), d.id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Report subscriptions: %d reports queued", len(due))
+	return nil
+}
+
+// reportCapture collects a report response run in-process.
+type reportCapture struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *reportCapture) Header() http.Header { return c.header }
+
+func (c *reportCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *reportCapture) Write(p []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	if c.body.Len()+len(p) > maxReportAttachmentBytes {
+		return 0, fmt.Errorf("report is larger than %s", formatBytes(maxReportAttachmentBytes))
+	}
+	return c.body.Write(p)
+}
+
+// Run produces a subscribed report for the period as its subscriber would
+// get it from the API.
+func (rs *ReportSubscriptionService) Run(subscription *ReportSubscription, claims *Claims, from, to time.Time) (*EmailAttachment, error) {
+	if _, export := subscription.Filters[reportExportFilter]; export {
+		return nil, &reportRunError{status: http.StatusForbidden, message: "exports are not subscribable"}
+	}
+	query := url.Values{}
+	for key, value := range subscription.Filters {
+		query.Set(key, value)
+	}
+	query.Set("from", from.Format(time.RFC3339))
+	query.Set("to", to.Format(time.RFC3339))
+
+	ctx := context.WithValue(context.Background(), claimsContextKey, claims)
+	req, err := http.NewRequestWithContext(ctx, "GET", subscribableReports[subscription.Report]+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	capture := &reportCapture{header: http.Header{}}
+	rs.handler.ServeHTTP(capture, req)
+	if capture.status != http.StatusOK {
+		return nil, &reportRunError{status: capture.status, message: strings.TrimSpace(capture.body.String())}
+	}
+
+	contentType, _, _ := mime.ParseMediaType(capture.header.Get("Content-Type"))
+	extension := "json"
+	switch contentType {
+	case "application/pdf":
+		extension = "pdf"
+	case "text/csv":
+		extension = "csv"
+	}
+	return &EmailAttachment{
+		Filename:    fmt.Sprintf("%s-%s.%s", subscription.Report, from.Format("2006-01-02"), extension),
+		ContentType: contentType,
+		Content:     capture.body.Bytes(),
+	}, nil
+}
+
+// reportRunError is a report refused or failed by its endpoint.
+type reportRunError struct {
+	status  int
+	message string
+}
+
+func (e *reportRunError) Error() string {
+	return fmt.Sprintf("report returned %d: %s", e.status, truncate(e.message, 200))
+}
+
+// recordResult notes the outcome of a delivery on its subscription.
+func (rs *ReportSubscriptionService) recordResult(id int64, cause error) {
+	var err error
+	if cause != nil {
+		_, err = rs.db.Exec(`UPDATE report_subscriptions SET last_error = ? WHERE id = ?`, truncate(cause.Error(), 500), id)
+	} else {
+		_, err = rs.db.Exec(`UPDATE report_subscriptions SET last_sent_at = NOW(), last_error = NULL WHERE id = ?`, id)
+	}
+	if err != nil {
+		log.Printf("Error recording delivery of report subscription %d: %v", id, err)
+	}
+}
+
+// deliverReportSubscription runs one subscribed report and emails it to the
+// subscriber. Reports the subscriber may no longer see are dropped; server
+// errors are retried by the outbox.
+func deliverReportSubscription(msg OutboxMessage) error {
+	var delivery ReportDelivery
+	if err := json.Unmarshal(msg.Payload, &delivery); err != nil {
+		return err
+	}
+	subscription, err := reportSubscriptionService.Get(delivery.SubscriptionID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var name, email, role string
+	var approved bool
+	err = db.QueryRow(`SELECT full_name, email, role, approved FROM users WHERE id = ?`, subscription.UserID).
+		Scan(&name, &email, &role, &approved)
+	if err != nil {
+		return err
+	}
+	if !approved {
+		reportSubscriptionService.recordResult(subscription.ID, fmt.Errorf("the subscriber's account is not approved"))
+		return nil
+	}
+	claims := &Claims{Email: email, Role: role, RegisteredClaims: jwt.RegisteredClaims{Subject: subscription.UserID}}
+
+	attachment, err := reportSubscriptionService.Run(subscription, claims, delivery.From, delivery.To)
+	if runErr, ok := err.(*reportRunError); ok && runErr.status < 500 {
+		reportSubscriptionService.recordResult(subscription.ID, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lastDay := delivery.To.AddDate(0, 0, -1)
+	subject := fmt.Sprintf("Your %s %s report, %s to %s", subscription.Frequency, subscription.Report,
+		shopLocale.FormatDate(delivery.From), shopLocale.FormatDate(lastDay))
+	body := fmt.Sprintf("Hello %s,\n\nAttached is the %s report for %s to %s, as you subscribed to. You can change or cancel your report subscriptions in PC Repair Hub.\n\nPC Repair Hub",
+		name, subscription.Report, shopLocale.FormatDate(delivery.From), shopLocale.FormatDate(lastDay))
+	if err := emailService.Send("", msg.ID, email, subject, body, *attachment); err != nil {
+		return err
+	}
+	reportSubscriptionService.recordResult(subscription.ID, nil)
+	return nil
+}
+
+// reportSubscriptionJob queues the subscribed reports that are due.
+func reportSubscriptionJob() BackgroundJob {
+	return BackgroundJob{
+		Name:     "report_subscriptions",
+		Interval: getEnvDuration("REPORT_SUBSCRIPTION_INTERVAL", 5*time.Minute),
+		Run:      reportSubscriptionService.QueueDue,
+	}
+}
+
+// ReportSubscriptionsHandler lists the caller's report subscriptions (GET,
+// every user's for Admins with ?all=true), subscribes them to a report (POST
+// {"report": "summary", "frequency": "weekly", "filters": {"tag": "vip"}})
+// or cancels a subscription (DELETE ?id=).
+func ReportSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		userID := actorID(r)
+		if r.URL.Query().Get("all") == "true" && hasRole(r, RoleAdmin) {
+			userID = ""
+		}
+		subscriptions, err := reportSubscriptionService.List(userID)
+		if err != nil {
+			log.Printf("Error listing report subscriptions: %v", err)
+			http.Error(w, "Failed to retrieve report subscriptions", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(subscriptions)
+
+	case "POST":
+		if actorID(r) == "" || claimsFromContext(r.Context()).APIKeyID != "" {
+			http.Error(w, "Report subscriptions need a signed-in user", http.StatusForbidden)
+			return
+		}
+		var request struct {
+			Report    string            `json:"report"`
+			Frequency string            `json:"frequency"`
+			Filters   map[string]string `json:"filters"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if _, ok := subscribableReports[request.Report]; !ok {
+			reports := make([]string, 0, len(subscribableReports))
+			for report := range subscribableReports {
+				reports = append(reports, report)
+			}
+			slices.Sort(reports)
+			fieldErrors.Add("report", "must be one of "+strings.Join(reports, ", "))
+		}
+		if !slices.Contains(reportFrequencies, request.Frequency) {
+			fieldErrors.Add("frequency", "must be daily, weekly or monthly")
+		}
+		if len(request.Filters) > maxReportFilters {
+			fieldErrors.Add("filters", fmt.Sprintf("can have at most %d entries", maxReportFilters))
+		}
+		for key, value := range request.Filters {
+			switch {
+			case key == "from" || key == "to":
+				fieldErrors.Add("filters", "cannot set from or to; the schedule sets the period")
+			case key == reportExportFilter:
+				fieldErrors.Add("filters", "cannot set format; exports are not subscribable")
+			case !reportFilterKeyPattern.MatchString(key):
+				fieldErrors.Add("filters", fmt.Sprintf("%q is not a report parameter", key))
+			case len(value) > 200:
+				fieldErrors.Add("filters", fmt.Sprintf("%s is too long", key))
+			}
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+		if request.Filters == nil {
+			request.Filters = map[string]string{}
+		}
+
+		subscription := &ReportSubscription{
+			UserID:    actorID(r),
+			Report:    request.Report,
+			Filters:   request.Filters,
+			Frequency: request.Frequency,
+		}
+		if err := reportSubscriptionService.Create(subscription); err != nil {
+			log.Printf("Error creating report subscription for %s: %v", actorID(r), err)
+			http.Error(w, "Failed to create report subscription", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditReportSubscribed, "report_subscription", strconv.FormatInt(subscription.ID, 10), nil, subscription)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(subscription)
+
+	case "DELETE":
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		subscription, err := reportSubscriptionService.Get(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Report subscription not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrieving report subscription %d: %v", id, err)
+			http.Error(w, "Failed to cancel report subscription", http.StatusInternalServerError)
+			return
+		}
+		if subscription.UserID != actorID(r) && !hasRole(r, RoleAdmin) {
+			http.Error(w, "Only the subscriber can cancel this subscription", http.StatusForbidden)
+			return
+		}
+
+		if err := reportSubscriptionService.Delete(id); err != nil && err != sql.ErrNoRows {
+			log.Printf("Error deleting report subscription %d: %v", id, err)
+			http.Error(w, "Failed to cancel report subscription", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditReportUnsubscribed, "report_subscription", strconv.FormatInt(id, 10), subscription, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Report subscription cancelled",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
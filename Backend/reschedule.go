@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A ticket's expected delivery date is set at intake and afterwards moved
+// only through POST /api/v1/orders/{id}/delivery-date, which needs a reason.
+// Each move is a DeliveryRescheduled event; ticket_delivery_date_changes
+// keeps them as the ticket's reschedule history and orders.times_rescheduled
+// counts them. The reschedule report lists the tickets moved most often in
+// a period, for chasing chronic delays.
+
+const deliveryDateChangesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_delivery_date_changes (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		event_version INT NOT NULL,
+		from_date DATE NULL,
+		to_date DATE NOT NULL,
+		reason VARCHAR(500) NOT NULL,
+		changed_by VARCHAR(50) NULL,
+		changed_at TIMESTAMP NOT NULL,
+		UNIQUE KEY uniq_delivery_date_change_event (order_id, event_version),
+		INDEX idx_delivery_date_changes_changed (changed_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// DeliveryRescheduledPayload records a move of the expected delivery date.
+// From is empty when the ticket had no date.
+type DeliveryRescheduledPayload struct {
+	From   string `json:"from,omitempty"` // YYYY-MM-DD
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// DeliveryDateChange is one entry of a ticket's reschedule history.
+type DeliveryDateChange struct {
+	From          string    `json:"from,omitempty"`
+	To            string    `json:"to"`
+	Direction     string    `json:"direction"` // postponed, advanced or set
+	Days          int       `json:"days"`      // Days moved; negative when advanced
+	Reason        string    `json:"reason"`
+	ChangedBy     string    `json:"changed_by,omitempty"`
+	ChangedByName string    `json:"changed_by_name,omitempty"`
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// rescheduleDays returns how many days a move shifts the date, and whether
+// it postponed, advanced or first set it.
+func rescheduleDays(from, to string) (int, string) {
+	fromDate, err := time.Parse("2006-01-02", from)
+	toDate, toErr := time.Parse("2006-01-02", to)
+	if err != nil || toErr != nil {
+		return 0, "set"
+	}
+	days := int(toDate.Sub(fromDate).Hours() / 24)
+	if days < 0 {
+		return days, "advanced"
+	}
+	return days, "postponed"
+}
+
+// RescheduleDelivery moves a ticket's expected delivery date to date. It
+// returns the date it had.
+func (os *OrderService) RescheduleDelivery(orderID string, date time.Time, reason, actorID string) (string, error) {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	status, err := os.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	var current sql.NullTime
+	var deletedAt sql.NullTime
+	if err := tx.QueryRow(`SELECT expected_delivery_date, deleted_at FROM orders WHERE id = ?`, orderID).Scan(&current, &deletedAt); err != nil {
+		return "", err
+	}
+	if deletedAt.Valid || status == closedStatus {
+		return "", &StatusGuardError{Reason: "the delivery date of a collected or cancelled ticket cannot be changed"}
+	}
+
+	payload := DeliveryRescheduledPayload{To: date.Format("2006-01-02"), Reason: reason}
+	if current.Valid {
+		payload.From = current.Time.Format("2006-01-02")
+	}
+	if payload.From == payload.To {
+		return "", errNoTicketChanges
+	}
+	if _, err := os.events.Append(tx, orderID, EventDeliveryRescheduled, actorID, payload); err != nil {
+		return "", err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return "", err
+	}
+	return payload.From, tx.Commit()
+}
+
+// projectDeliveryRescheduled moves the date on the orders read model.
+func projectDeliveryRescheduled(tx *sql.Tx, event *TicketEvent) error {
+	var payload DeliveryRescheduledPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE orders SET expected_delivery_date = ?, times_rescheduled = times_rescheduled + 1,
+		       updated_at = ?, last_updated_by = NULLIF(?, '')
+		WHERE id = ?
+	`, payload.To, event.OccurredAt, event.ActorID, event.TicketID)
+	return err
+}
+
+// projectDeliveryDateChanges keeps the reschedule history.
+func projectDeliveryDateChanges(tx *sql.Tx, event *TicketEvent) error {
+	if event.Type != EventDeliveryRescheduled {
+		return nil
+	}
+	var payload DeliveryRescheduledPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO ticket_delivery_date_changes (order_id, event_version, from_date, to_date, reason, changed_by, changed_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)
+	`, event.TicketID, event.Version, nullString(payload.From), payload.To, payload.Reason, event.ActorID, event.OccurredAt)
+	return err
+}
+
+// DeliveryDateChanges returns a ticket's reschedule history, oldest first.
+func (os *OrderService) DeliveryDateChanges(orderID string) ([]DeliveryDateChange, error) {
+	rows, err := os.db.Query(`
+		SELECT c.from_date, c.to_date, c.reason, COALESCE(c.changed_by, ''), COALESCE(u.full_name, ''), c.changed_at
+		FROM ticket_delivery_date_changes c LEFT JOIN users u ON u.id = c.changed_by
+		WHERE c.order_id = ? ORDER BY c.event_version
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []DeliveryDateChange{}
+	for rows.Next() {
+		var change DeliveryDateChange
+		var from sql.NullTime
+		var to time.Time
+		if err := rows.Scan(&from, &to, &change.Reason, &change.ChangedBy, &change.ChangedByName, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		if from.Valid {
+			change.From = from.Time.Format("2006-01-02")
+		}
+		change.To = to.Format("2006-01-02")
+		change.Days, change.Direction = rescheduleDays(change.From, change.To)
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// RescheduleReportRow is a ticket rescheduled in the report period.
+type RescheduleReportRow struct {
+	OrderID          string `json:"order_id"`
+	Status           string `json:"status"`
+	EngineerID       string `json:"assigned_engineer_id,omitempty"`
+	Reschedules      int    `json:"reschedules"`       // Moves in the period
+	TimesRescheduled int    `json:"times_rescheduled"` // Moves ever
+	Postponed        int    `json:"postponed"`
+	DaysSlipped      int    `json:"days_slipped"` // Net days moved in the period
+	ExpectedDelivery string `json:"expected_delivery_date,omitempty"`
+	LastReason       string `json:"last_reason"`
+}
+
+// RescheduleReport returns the tickets whose delivery date moved in period
+// at least minTimes times, most moved first.
+func (rs *ReportService) RescheduleReport(period ReportRange, minTimes int) ([]RescheduleReportRow, error) {
+	rows, err := rs.db.Query(`
+		SELECT c.order_id, o.status, COALESCE(o.assigned_engineer_id, ''), COUNT(*), o.times_rescheduled,
+		       SUM(c.from_date IS NOT NULL AND c.to_date > c.from_date),
+		       COALESCE(SUM(DATEDIFF(c.to_date, c.from_date)), 0), o.expected_delivery_date,
+		       (SELECT l.reason FROM ticket_delivery_date_changes l WHERE l.order_id = c.order_id
+		        ORDER BY l.event_version DESC LIMIT 1)
+		FROM ticket_delivery_date_changes c JOIN orders o ON o.id = c.order_id
+		WHERE c.changed_at >= ? AND c.changed_at < ?
+		GROUP BY c.order_id, o.status, o.assigned_engineer_id, o.times_rescheduled, o.expected_delivery_date
+		HAVING COUNT(*) >= ?
+		ORDER BY COUNT(*) DESC, c.order_id
+	`, period.From, period.To, minTimes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []RescheduleReportRow{}
+	for rows.Next() {
+		var row RescheduleReportRow
+		var expected sql.NullTime
+		if err := rows.Scan(&row.OrderID, &row.Status, &row.EngineerID, &row.Reschedules, &row.TimesRescheduled,
+			&row.Postponed, &row.DaysSlipped, &expected, &row.LastReason); err != nil {
+			return nil, err
+		}
+		if expected.Valid {
+			row.ExpectedDelivery = expected.Time.Format("2006-01-02")
+		}
+		report = append(report, row)
+	}
+	return report, rows.Err()
+}
+
+// orderDeliveryDate lists a ticket's reschedule history (GET) or moves its
+// expected delivery date (POST {"expected_delivery_date": "2024-06-20",
+// "reason": "Replacement screen delayed by the supplier"}).
+func orderDeliveryDate(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		if _, err := orderService.GetOrder(orderID); err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error retrieving order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve delivery date changes", http.StatusInternalServerError)
+			return
+		}
+		changes, err := orderService.DeliveryDateChanges(orderID)
+		if err != nil {
+			log.Printf("Error retrieving delivery date changes of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve delivery date changes", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id":          orderID,
+			"times_rescheduled": len(changes),
+			"changes":           changes,
+		})
+
+	case "POST":
+		if !hasPermission(r, PermTicketsEdit) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		var request struct {
+			ExpectedDeliveryDate string `json:"expected_delivery_date"`
+			Reason               string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		date := parseDateField("expected_delivery_date", request.ExpectedDeliveryDate, &fieldErrors)
+		if request.ExpectedDeliveryDate == "" {
+			fieldErrors.Add("expected_delivery_date", "is required")
+		}
+		request.Reason = strings.TrimSpace(request.Reason)
+		if request.Reason == "" {
+			fieldErrors.Add("reason", "is required")
+		} else if len(request.Reason) > 500 {
+			fieldErrors.Add("reason", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		previous, err := orderService.RescheduleDelivery(orderID, *date, request.Reason, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errNoTicketChanges {
+			http.Error(w, "The ticket is already due on that date", http.StatusConflict)
+			return
+		}
+		if guardErr, ok := err.(*StatusGuardError); ok {
+			http.Error(w, guardErr.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error rescheduling order %s: %v", orderID, err)
+			http.Error(w, "Failed to change delivery date", http.StatusInternalServerError)
+			return
+		}
+
+		to := date.Format("2006-01-02")
+		days, direction := rescheduleDays(previous, to)
+		auditService.Record(r, AuditDeliveryRescheduled, "order", orderID,
+			map[string]string{"expected_delivery_date": previous},
+			map[string]string{"expected_delivery_date": to, "reason": request.Reason})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":   "Delivery date changed successfully",
+			"from":      previous,
+			"to":        to,
+			"direction": direction,
+			"days":      days,
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReportReschedulesHandler lists the tickets whose delivery date moved in
+// the period, optionally only those moved at least ?min_times= times.
+func ReportReschedulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	minTimes := 1
+	if value := r.URL.Query().Get("min_times"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			fieldErrors.Add("min_times", "must be between 1 and 100")
+		} else {
+			minTimes = n
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, err := reportService.RescheduleReport(period, minTimes)
+	if err != nil {
+		log.Printf("Error building reschedule report: %v", err)
+		http.Error(w, "Failed to build reschedule report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"range":   period,
+		"tickets": report,
+	})
+}
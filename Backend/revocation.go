@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Access tokens are stateless, so signing out or revoking a session would
+// otherwise leave them usable until they expire. The middleware checks each
+// token's ID (jti) against revoked_tokens and its session against the
+// sessions table. Entries are purged by the purge_revoked_tokens maintenance
+// task once the token they block has expired.
+
+const revokedTokensTable = `
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti VARCHAR(64) PRIMARY KEY,
+		user_id VARCHAR(50) NULL,
+		reason VARCHAR(50) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_by VARCHAR(50) NULL,
+		revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_revoked_tokens_expires (expires_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// RevocationService handles the access token blacklist
+type RevocationService struct {
+	db *sql.DB
+}
+
+func NewRevocationService(database *sql.DB) *RevocationService {
+	return &RevocationService{db: database}
+}
+
+// RevokeToken blacklists an access token until it expires on its own.
+func (rs *RevocationService) RevokeToken(claims *Claims, reason, revokedBy string) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		// Tokens issued before jti was added can only be cut off via their session
+		return nil
+	}
+	_, err := rs.db.Exec(`
+		INSERT IGNORE INTO revoked_tokens (jti, user_id, reason, expires_at, revoked_by)
+		VALUES (?, ?, ?, ?, ?)
+	`, claims.ID, nullString(claims.Subject), reason, claims.ExpiresAt.Time, nullString(revokedBy))
+	return err
+}
+
+// IsRevoked reports whether the token itself or its session has been revoked.
+func (rs *RevocationService) IsRevoked(claims *Claims) (bool, error) {
+	var revoked bool
+	err := rs.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = ?)
+			OR EXISTS(SELECT 1 FROM sessions WHERE id = ? AND revoked_at IS NOT NULL)
+	`, claims.ID, claims.SessionID).Scan(&revoked)
+	return revoked, err
+}
+
+var revocationService *RevocationService
+
+// bearerClaims parses the request's bearer token on routes the auth
+// middleware leaves alone, returning nil when there is no valid token.
+func bearerClaims(r *http.Request) *Claims {
+	tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || tokenString == "" {
+		return nil
+	}
+	claims, err := tokenService.ParseToken(tokenString)
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// RevokeTokenHandler lets an administrator blacklist a compromised access
+// token before it expires.
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := tokenService.ParseToken(request.Token)
+	if err != nil {
+		// Expired or forged tokens are already rejected
+		http.Error(w, "Token is not valid; nothing to revoke", http.StatusBadRequest)
+		return
+	}
+	if claims.ID == "" {
+		http.Error(w, "Token has no ID; revoke the user's sessions instead", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := revocationService.RevokeToken(claims, "compromised", actorID(r)); err != nil {
+		log.Printf("Error revoking token %s: %v", claims.ID, err)
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Access token %s of user %s revoked by %s", claims.ID, claims.Subject, actorID(r))
+	auditService.Record(r, AuditTokenRevoked, "user", claims.Subject, nil, map[string]string{"jti": claims.ID})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Token revoked successfully",
+		"jti":        claims.ID,
+		"expires_at": claims.ExpiresAt.Time,
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// A device that comes back with the same fault after collection is booked in
+// as a rework ticket: a new ticket whose parent_ticket_id points at the
+// collected original. Giving parent_ticket_id at intake defaults the ticket
+// type to Rework, and a Rework ticket must name its parent. The detail of
+// each side shows the link: the parent on the rework ticket, every rework
+// ticket on the parent.
+
+// reworkTicketType is the stock ticket type for returned repairs.
+const reworkTicketType = "rework"
+
+// checkReworkParent validates the parent of an intake that names one, or
+// must name one because it is a rework ticket.
+func (os *OrderService) checkReworkParent(order *Order, fieldErrors *ValidationErrors) error {
+	if order.ParentTicketID == "" {
+		if order.TicketType == reworkTicketType {
+			fieldErrors.Add("parent_ticket_id", "is required for a rework ticket")
+		}
+		return nil
+	}
+
+	var status string
+	var deletedAt sql.NullTime
+	err := os.db.QueryRow(`SELECT status, deleted_at FROM orders WHERE id = ?`, order.ParentTicketID).Scan(&status, &deletedAt)
+	if err == sql.ErrNoRows {
+		fieldErrors.Add("parent_ticket_id", "must be an existing order")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status != closedStatus || deletedAt.Valid {
+		fieldErrors.Add("parent_ticket_id", "must be a collected order")
+	}
+	return nil
+}
+
+// reworkTickets returns the IDs of the rework tickets booked against an
+// order, oldest first.
+func (os *OrderService) reworkTickets(orderID string) ([]string, error) {
+	rows, err := os.db.Query(`SELECT id FROM orders WHERE parent_ticket_id = ? ORDER BY created_at, id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
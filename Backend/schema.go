@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// schemaTable is a CREATE TABLE IF NOT EXISTS statement owned by a subsystem.
+type schemaTable struct {
+	name string
+	ddl  string
+}
+
+// schemaTables lists subsystem tables in dependency order; they are created
+// after the core users and orders tables.
+var schemaTables = []schemaTable{
+	{"online_migrations", onlineMigrationsTable},
+	{"ticket_events", ticketEventsTable},
+	{"sessions", sessionsTable},
+	{"outbox", outboxTable},
+	{"api_keys", apiKeysTable},
+	{"password_resets", passwordResetsTable},
+	{"repair_warranties", repairWarrantiesTable},
+	{"backup_jobs", backupJobsTable},
+	{"ticket_types", ticketTypesTable},
+	{"onsite_visits", onsiteVisitsTable},
+	{"audit_log", auditLogTable},
+	{"parts", partsTable},
+	{"build_orders", buildOrdersTable},
+	{"build_components", buildComponentsTable},
+	{"valuation_rules", valuationRulesTable},
+	{"buyback_purchases", buybackPurchasesTable},
+	{"estimate_options", estimateOptionsTable},
+	{"estimate_items", estimateItemsTable},
+	{"estimate_links", estimateLinksTable},
+	{"print_jobs", printJobsTable},
+	{"attachments", attachmentsTable},
+	{"maintenance_runs", maintenanceRunsTable},
+	{"service_accounts", serviceAccountsTable},
+	{"revoked_tokens", revokedTokensTable},
+	{"permissions", permissionsTable},
+	{"role_permissions", rolePermissionsTable},
+	{"id_prefixes", idPrefixesTable},
+	{"id_sequences", idSequencesTable},
+	{"customers", customersTable},
+	{"ticket_costs", ticketCostsTable},
+	{"ticket_profitability", ticketProfitabilityTable},
+	{"email_messages", emailMessagesTable},
+	{"email_events", emailEventsTable},
+	{"email_flags", emailFlagsTable},
+	{"ticket_status_history", ticketStatusHistoryTable},
+	{"sms_inbound", smsInboundTable},
+	{"id_policies", idPoliciesTable},
+	{"ticket_identities", ticketIdentitiesTable},
+	{"device_theft_checks", deviceTheftChecksTable},
+	{"ticket_notes", ticketNotesTable},
+	{"legal_holds", legalHoldsTable},
+	{"data_exports", dataExportsTable},
+	{"stock_movements", stockMovementsTable},
+	{"part_cores", partCoresTable},
+	{"inventory_revaluations", inventoryRevaluationsTable},
+	{"ticket_holds", ticketHoldsTable},
+	{"ticket_devices", ticketDevicesTable},
+	{"recall_campaigns", recallCampaignsTable},
+	{"recall_tickets", recallTicketsTable},
+	{"part_lots", partLotsTable},
+	{"ticket_tags", ticketTagsTable},
+	{"custom_fields", customFieldsTable},
+	{"custom_field_values", customFieldValuesTable},
+	{"staff_certifications", staffCertificationsTable},
+	{"lobby_tokens", lobbyTokensTable},
+	{"corporate_accounts", corporateAccountsTable},
+	{"ticket_ratings", ticketRatingsTable},
+	{"quotes", quotesTable},
+	{"quote_items", quoteItemsTable},
+	{"ticket_signatures", ticketSignaturesTable},
+	{"checklist_templates", checklistTemplatesTable},
+	{"ticket_checklist_items", ticketChecklistItemsTable},
+	{"ticket_diagnoses", ticketDiagnosesTable},
+	{"ticket_voice_notes", ticketVoiceNotesTable},
+	{"mention_reads", mentionReadsTable},
+	{"report_subscriptions", reportSubscriptionsTable},
+	{"escalation_rules", escalationRulesTable},
+	{"ticket_escalations", ticketEscalationsTable},
+	{"ticket_delivery_date_changes", deliveryDateChangesTable},
+	{"staff_presence", staffPresenceTable},
+	{"ticket_snoozes", ticketSnoozesTable},
+	{"ticket_watchers", ticketWatchersTable},
+	{"ticket_timers", ticketTimersTable},
+	{"stocktakes", stocktakesTable},
+	{"stocktake_counts", stocktakeCountsTable},
+}
+
+// schemaColumn is an additive column change applied to an existing table.
+type schemaColumn struct {
+	table      string
+	column     string
+	definition string
+}
+
+// schemaColumns lists columns added to tables after their initial release.
+var schemaColumns = []schemaColumn{
+	{"users", "approved", "BOOLEAN NOT NULL DEFAULT TRUE"},
+	{"users", "auth_provider", "VARCHAR(20) NULL"},
+	{"orders", "amount_paid", "DECIMAL(10,2) NOT NULL DEFAULT 0"},
+	{"orders", "device_serial", "VARCHAR(100) NULL"},
+	{"orders", "assigned_engineer_id", "VARCHAR(50) NULL"},
+	{"orders", "expected_delivery_date", "DATE NULL"},
+	{"orders", "warranty_exp_date", "DATE NULL"},
+	{"orders", "warranty_claim_of", "VARCHAR(50) NULL"},
+	{"orders", "data_backup_consent", "VARCHAR(20) NULL"},
+	{"orders", "ticket_type", "VARCHAR(50) NULL"},
+	{"orders", "device_password", "VARCHAR(255) NULL"},
+	{"orders", "deleted_at", "TIMESTAMP NULL"},
+	{"orders", "cancel_reason", "VARCHAR(500) NULL"},
+	{"orders", "priority", "VARCHAR(10) NOT NULL DEFAULT 'Normal'"},
+	{"orders", "sla_due_at", "TIMESTAMP NULL"},
+	{"orders", "sla_breached_at", "TIMESTAMP NULL"},
+	{"orders", "hold_state", "VARCHAR(30) NULL"},
+	{"orders", "hold_reason", "VARCHAR(500) NULL"},
+	{"orders", "hold_started_at", "TIMESTAMP NULL"},
+	{"orders", "merged_into", "VARCHAR(50) NULL"},
+	{"orders", "split_from", "VARCHAR(50) NULL"},
+	{"orders", "parent_ticket_id", "VARCHAR(50) NULL"},
+	{"parts", "cores_on_hand", "INT NOT NULL DEFAULT 0 AFTER quantity_on_hand"},
+	{"parts", "supplier_cost", "DECIMAL(10,2) NULL AFTER unit_cost"},
+	{"parts", "supplier_cost_at", "TIMESTAMP NULL AFTER supplier_cost"},
+	{"attachments", "storage_backend", "VARCHAR(20) NOT NULL DEFAULT 'local' AFTER sha256"},
+	{"api_keys", "service_account_id", "VARCHAR(50) NULL"},
+	{"api_keys", "expires_at", "TIMESTAMP NULL"},
+	{"ticket_types", "required_fields", "JSON NULL AFTER questionnaire"},
+	{"ticket_costs", "part_serial", "VARCHAR(100) NULL AFTER part_sku"},
+	{"ticket_costs", "part_lot", "VARCHAR(100) NULL AFTER part_serial"},
+	{"stock_movements", "lot", "VARCHAR(100) NULL AFTER unit_cost"},
+	{"recall_campaigns", "lot", "VARCHAR(100) NULL AFTER part_sku"},
+	{"ticket_types", "required_certification", "VARCHAR(100) NULL AFTER required_fields"},
+	{"customers", "preferred_language", "VARCHAR(10) NULL AFTER duplicate_reason"},
+	{"estimate_options", "rejected_at", "TIMESTAMP NULL AFTER selected_ip"},
+	{"estimate_options", "decided_by", "VARCHAR(50) NULL AFTER rejected_at"},
+	{"estimate_options", "decision_note", "VARCHAR(500) NULL AFTER decided_by"},
+	{"orders", "account_id", "BIGINT NULL"},
+	{"orders", "board_position", "INT NULL"},
+	{"orders", "times_rescheduled", "INT NOT NULL DEFAULT 0"},
+	{"corporate_accounts", "response_hours", "INT NULL AFTER payment_terms_days"},
+	{"corporate_accounts", "resolution_hours", "INT NULL AFTER response_hours"},
+}
+
+// schemaIndex is a secondary index added to an existing table.
+type schemaIndex struct {
+	table   string
+	name    string
+	columns string
+}
+
+// schemaIndexes lists indexes added alongside schemaColumns.
+var schemaIndexes = []schemaIndex{
+	{"orders", "idx_assigned_engineer", "assigned_engineer_id"},
+	{"orders", "idx_ticket_type", "ticket_type"},
+	{"orders", "idx_deleted_at", "deleted_at"},
+	{"orders", "idx_priority", "priority"},
+	{"orders", "idx_sla_breached_at", "sla_breached_at"},
+	{"orders", "idx_hold_state", "hold_state"},
+	{"orders", "idx_split_from", "split_from"},
+	{"orders", "idx_parent_ticket", "parent_ticket_id"},
+	{"api_keys", "idx_api_keys_service_account", "service_account_id"},
+	{"stock_movements", "idx_stock_movements_lot", "part_sku, lot"},
+	{"orders", "idx_account", "account_id"},
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// schemaStatements are idempotent data/DDL fixes run after tables exist.
+var schemaStatements = [][]string{
+	roleMigrationStatements,
+	orderStatusEnumStatements,
+	printDocumentEnumStatements,
+	ticketTypeSeedStatements,
+	checklistTemplateSeedStatements,
+	permissionSeedStatements(),
+	snoozeCleanupStatements,
+}
+
+func createSubsystemTables() {
+	for _, table := range schemaTables {
+		if _, err := db.Exec(table.ddl); err != nil {
+			log.Fatalf("Failed to create %s table: %v", table.name, err)
+		}
+	}
+
+	for _, column := range schemaColumns {
+		if err := ensureColumn(db, column.table, column.column, column.definition); err != nil {
+			log.Fatalf("Failed to add %s.%s column: %v", column.table, column.column, err)
+		}
+	}
+
+	for _, index := range schemaIndexes {
+		if err := ensureIndex(db, index.table, index.name, index.columns); err != nil {
+			log.Fatalf("Failed to add %s.%s index: %v", index.table, index.name, err)
+		}
+	}
+
+	for _, statements := range schemaStatements {
+		for _, statement := range statements {
+			if _, err := db.Exec(statement); err != nil {
+				log.Fatalf("Failed to apply schema statement %q: %v", statement, err)
+			}
+		}
+	}
+}
+
+// ensureColumn adds a column unless it already exists. MySQL 8 has no
+// ADD COLUMN IF NOT EXISTS, so the check goes through information_schema.
+func ensureColumn(database *sql.DB, table, column, definition string) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+	`
+	if err := database.QueryRow(query, table, column).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err := database.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// ensureIndex adds an index unless one with the same name already exists on
+// the table; like ensureColumn, MySQL 8 has no CREATE INDEX IF NOT EXISTS.
+func ensureIndex(database *sql.DB, table, name, columns string) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+	`
+	if err := database.QueryRow(query, table, name).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err := database.Exec(fmt.Sprintf("ALTER TABLE %s ADD INDEX %s (%s)", table, name, columns))
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServerConfig holds the HTTP server tuning knobs.
+type ServerConfig struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	TLSCertFile       string
+	TLSKeyFile        string
+	H2C               bool
+	MaxStreams        uint32
+}
+
+func getServerConfig() ServerConfig {
+	port := getEnv("PORT", "8080")
+	if port[0] != ':' {
+		port = ":" + port
+	}
+
+	return ServerConfig{
+		Addr:              port,
+		ReadTimeout:       getEnvDuration("SERVER_READ_TIMEOUT", 15*time.Second),
+		ReadHeaderTimeout: getEnvDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:      getEnvDuration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       getEnvDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    getEnvInt("SERVER_MAX_HEADER_BYTES", 1<<20),
+		TLSCertFile:       getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:        getEnv("TLS_KEY_FILE", ""),
+		H2C:               getEnv("HTTP2_CLEARTEXT", "false") == "true",
+		MaxStreams:        uint32(getEnvInt("HTTP2_MAX_CONCURRENT_STREAMS", 250)),
+	}
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s (%q), using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s (%q), using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// newHTTPServer builds an http.Server with timeouts so slow or idle clients
+// cannot hold connections open indefinitely.
+func newHTTPServer(config ServerConfig, handler http.Handler) *http.Server {
+	h2 := &http2.Server{
+		MaxConcurrentStreams: config.MaxStreams,
+		IdleTimeout:          config.IdleTimeout,
+	}
+
+	// Cleartext HTTP/2 is only useful behind a proxy that speaks h2c to us
+	if config.H2C {
+		handler = h2c.NewHandler(handler, h2)
+	}
+
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(true)
+
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		log.Fatalf("Failed to configure HTTP/2: %v", err)
+	}
+
+	return server
+}
+
+// startServer serves over TLS (with HTTP/2 negotiated via ALPN) when a
+// certificate is configured, and plain HTTP/1.1 (or h2c) otherwise.
+func startServer(server *http.Server, config ServerConfig) error {
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+		return server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Service accounts are the non-interactive clients of the shop: lobby kiosk
+// displays, label printers, the website intake form. Each account is granted
+// a fixed set of API key scopes and is issued long-lived tokens (API keys
+// that expire) restricted to those scopes. Disabling an account cuts off all
+// of its tokens at once.
+
+const serviceAccountsTable = `
+	CREATE TABLE IF NOT EXISTS service_accounts (
+		id VARCHAR(50) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		description VARCHAR(500) NULL,
+		scopes JSON NOT NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		disabled_at TIMESTAMP NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+var (
+	errServiceAccountDisabled = errors.New("service account is disabled")
+	errScopeNotGranted        = errors.New("token scopes must be granted to the service account")
+)
+
+// ServiceAccount is a non-interactive client identity.
+type ServiceAccount struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Description  string     `json:"description,omitempty"`
+	Scopes       []string   `json:"scopes"`
+	ActiveTokens int        `json:"active_tokens"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DisabledAt   *time.Time `json:"disabled_at,omitempty"`
+}
+
+// ServiceAccountService handles service account database operations
+type ServiceAccountService struct {
+	db       *sql.DB
+	tokenTTL time.Duration
+}
+
+func NewServiceAccountService(database *sql.DB) *ServiceAccountService {
+	return &ServiceAccountService{
+		db:       database,
+		tokenTTL: getEnvDuration("SERVICE_TOKEN_TTL", 365*24*time.Hour),
+	}
+}
+
+func (sas *ServiceAccountService) CreateAccount(account *ServiceAccount) error {
+	account.ID = fmt.Sprintf("SVC-%d", time.Now().UnixNano())
+	account.CreatedAt = time.Now()
+
+	scopesJSON, err := json.Marshal(account.Scopes)
+	if err != nil {
+		return err
+	}
+	_, err = sas.db.Exec(`
+		INSERT INTO service_accounts (id, name, description, scopes, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, account.ID, account.Name, nullString(account.Description), string(scopesJSON), nullString(account.CreatedBy), account.CreatedAt)
+	return err
+}
+
+func (sas *ServiceAccountService) ListAccounts() ([]ServiceAccount, error) {
+	rows, err := sas.db.Query(`
+		SELECT sa.id, sa.name, sa.description, sa.scopes, sa.created_by, sa.created_at, sa.disabled_at,
+			(SELECT COUNT(*) FROM api_keys k
+			 WHERE k.service_account_id = sa.id AND k.revoked_at IS NULL
+			   AND (k.expires_at IS NULL OR k.expires_at > NOW()))
+		FROM service_accounts sa ORDER BY sa.created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []ServiceAccount{}
+	for rows.Next() {
+		var account ServiceAccount
+		var description, createdBy sql.NullString
+		var scopesJSON string
+		var disabledAt sql.NullTime
+		if err := rows.Scan(&account.ID, &account.Name, &description, &scopesJSON, &createdBy, &account.CreatedAt,
+			&disabledAt, &account.ActiveTokens); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(scopesJSON), &account.Scopes); err != nil {
+			return nil, err
+		}
+		account.Description = description.String
+		account.CreatedBy = createdBy.String
+		account.DisabledAt = timePtr(disabledAt)
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// IssueToken creates an expiring API key for the account. Scopes default to
+// everything the account holds and may only narrow it.
+func (sas *ServiceAccountService) IssueToken(accountID, name string, scopes []string, ttl time.Duration, createdBy string) (*APIKey, string, error) {
+	var accountName, scopesJSON string
+	var disabledAt sql.NullTime
+	err := sas.db.QueryRow(`SELECT name, scopes, disabled_at FROM service_accounts WHERE id = ?`, accountID).
+		Scan(&accountName, &scopesJSON, &disabledAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if disabledAt.Valid {
+		return nil, "", errServiceAccountDisabled
+	}
+
+	var granted []string
+	if err := json.Unmarshal([]byte(scopesJSON), &granted); err != nil {
+		return nil, "", err
+	}
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return nil, "", errScopeNotGranted
+		}
+	}
+
+	if name == "" {
+		name = accountName
+	}
+	if ttl <= 0 {
+		ttl = sas.tokenTTL
+	}
+	expiresAt := time.Now().Add(ttl)
+	return apiKeyService.CreateKey(name, scopes, createdBy, accountID, &expiresAt)
+}
+
+// DisableAccount switches an account off and revokes its tokens.
+func (sas *ServiceAccountService) DisableAccount(accountID string) (int64, error) {
+	tx, err := sas.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE service_accounts SET disabled_at = NOW() WHERE id = ? AND disabled_at IS NULL`, accountID)
+	if err != nil {
+		return 0, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM service_accounts WHERE id = ?`, accountID).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if exists == 0 {
+			return 0, sql.ErrNoRows
+		}
+	}
+
+	result, err = tx.Exec(`UPDATE api_keys SET revoked_at = NOW() WHERE service_account_id = ? AND revoked_at IS NULL`, accountID)
+	if err != nil {
+		return 0, err
+	}
+	revoked, _ := result.RowsAffected()
+	return revoked, tx.Commit()
+}
+
+var serviceAccountService *ServiceAccountService
+
+// validScopes checks every scope against the API key scope catalogue.
+func validScopes(scopes []string) (string, bool) {
+	for _, scope := range scopes {
+		if _, ok := apiKeyScopes[scope]; !ok {
+			return scope, false
+		}
+	}
+	return "", true
+}
+
+// ServiceAccountsHandler lists (GET) or creates (POST) service accounts.
+func ServiceAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		accounts, err := serviceAccountService.ListAccounts()
+		if err != nil {
+			log.Printf("Error listing service accounts: %v", err)
+			http.Error(w, "Failed to retrieve service accounts", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(accounts)
+
+	case "POST":
+		var account ServiceAccount
+		if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if account.Name == "" || len(account.Scopes) == 0 {
+			http.Error(w, "Name and at least one scope are required", http.StatusBadRequest)
+			return
+		}
+		if scope, ok := validScopes(account.Scopes); !ok {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+
+		account.Description = truncate(account.Description, 500)
+		account.CreatedBy = actorID(r)
+		if err := serviceAccountService.CreateAccount(&account); err != nil {
+			log.Printf("Error creating service account: %v", err)
+			http.Error(w, "Failed to create service account", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Service account %s (%s) created by %s with scopes %v", account.ID, account.Name, actorID(r), account.Scopes)
+		auditService.Record(r, AuditServiceAccountSaved, "service_account", account.ID, nil, account)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(account)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ServiceAccountTokenHandler issues a long-lived token for a service account.
+func ServiceAccountTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ServiceAccountID string   `json:"service_account_id"`
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		TTL              string   `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.ServiceAccountID == "" {
+		http.Error(w, "Service account ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var ttl time.Duration
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "ttl must be a positive duration such as 8760h", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	key, plaintext, err := serviceAccountService.IssueToken(request.ServiceAccountID, request.Name, request.Scopes, ttl, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Service account not found", http.StatusNotFound)
+		return
+	}
+	if err == errServiceAccountDisabled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == errScopeNotGranted {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error issuing token for service account %s: %v", request.ServiceAccountID, err)
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Token %s issued for service account %s by %s", key.ID, request.ServiceAccountID, actorID(r))
+	auditService.Record(r, AuditAPIKeyCreated, "service_account", request.ServiceAccountID, nil, key)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Token issued. Store it now; it cannot be shown again.",
+		"api_key": key,
+		"key":     plaintext,
+	})
+}
+
+// DisableServiceAccountHandler disables a service account and revokes all
+// of its tokens.
+func DisableServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ID == "" {
+		http.Error(w, "Service account ID is required", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := serviceAccountService.DisableAccount(request.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Service account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error disabling service account %s: %v", request.ID, err)
+		http.Error(w, "Failed to disable service account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Service account %s disabled by %s (%d tokens revoked)", request.ID, actorID(r), revoked)
+	auditService.Record(r, AuditServiceAccountDisabled, "service_account", request.ID, nil, map[string]int64{"revoked_tokens": revoked})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Service account disabled successfully",
+		"revoked_tokens": revoked,
+	})
+}
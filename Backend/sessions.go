@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionsTable = `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR(64) PRIMARY KEY,
+		user_id VARCHAR(50) NOT NULL,
+		refresh_token_hash CHAR(64) NOT NULL UNIQUE,
+		user_agent VARCHAR(255),
+		ip_address VARCHAR(45),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP NULL,
+		INDEX idx_sessions_user (user_id),
+		INDEX idx_sessions_expires (expires_at),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// ErrSessionInvalid is returned for unknown, expired or revoked refresh tokens.
+var ErrSessionInvalid = errors.New("session is invalid or expired")
+
+// Session is a signed-in device holding a long-lived refresh token.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// AuthTokens is the token pair handed to clients at login and refresh.
+type AuthTokens struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// ActiveSession is a session listed for administrators, with its user.
+type ActiveSession struct {
+	Session
+	UserEmail string `json:"user_email"`
+	UserName  string `json:"user_name"`
+	Current   bool   `json:"current,omitempty"` // The session making the request
+}
+
+// SessionService handles session database operations
+type SessionService struct {
+	db               *sql.DB
+	refreshTTL       time.Duration
+	activityInterval time.Duration
+}
+
+func NewSessionService(database *sql.DB) *SessionService {
+	return &SessionService{
+		db:               database,
+		refreshTTL:       getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		activityInterval: getEnvDuration("SESSION_ACTIVITY_INTERVAL", time.Minute),
+	}
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken stores refresh tokens as SHA-256 digests so a database leak does
+// not hand out working credentials.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession opens a session and returns it with its plaintext refresh token.
+func (ss *SessionService) CreateSession(userID, userAgent, ipAddress string) (*Session, string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:         id,
+		UserID:     userID,
+		UserAgent:  truncate(userAgent, 255),
+		IPAddress:  ipAddress,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(ss.refreshTTL),
+	}
+
+	query := `
+		INSERT INTO sessions (id, user_id, refresh_token_hash, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = ss.db.Exec(query, session.ID, session.UserID, hashToken(refreshToken), session.UserAgent,
+		session.IPAddress, session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, refreshToken, nil
+}
+
+// RotateRefreshToken exchanges a valid refresh token for a new one on the
+// same session. The old token stops working immediately.
+func (ss *SessionService) RotateRefreshToken(refreshToken, ipAddress string) (*Session, string, error) {
+	session := &Session{}
+	query := `
+		SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE refresh_token_hash = ? AND revoked_at IS NULL AND expires_at > NOW()
+	`
+	err := ss.db.QueryRow(query, hashToken(refreshToken)).Scan(&session.ID, &session.UserID, &session.UserAgent,
+		&session.IPAddress, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrSessionInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	newToken, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := ss.db.Exec(`
+		UPDATE sessions SET refresh_token_hash = ?, last_used_at = NOW(), ip_address = ?
+		WHERE id = ? AND refresh_token_hash = ? AND revoked_at IS NULL
+	`, hashToken(newToken), ipAddress, session.ID, hashToken(refreshToken))
+	if err != nil {
+		return nil, "", err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		// Another request rotated this token first
+		return nil, "", ErrSessionInvalid
+	}
+
+	session.IPAddress = ipAddress
+	session.LastUsedAt = time.Now()
+	return session, newToken, nil
+}
+
+// Touch records activity on a session. Writes are throttled to one per
+// SESSION_ACTIVITY_INTERVAL so busy clients do not update the row on every
+// request.
+func (ss *SessionService) Touch(sessionID, ipAddress string) error {
+	_, err := ss.db.Exec(`
+		UPDATE sessions SET last_used_at = NOW(), ip_address = ?
+		WHERE id = ? AND revoked_at IS NULL AND last_used_at < ?
+	`, ipAddress, sessionID, time.Now().Add(-ss.activityInterval))
+	return err
+}
+
+// ListActiveSessions returns unexpired, unrevoked sessions, most recently
+// active first, optionally for one user.
+func (ss *SessionService) ListActiveSessions(userID string) ([]ActiveSession, error) {
+	query := `
+		SELECT s.id, s.user_id, COALESCE(s.user_agent, ''), COALESCE(s.ip_address, ''), s.created_at,
+			s.last_used_at, s.expires_at, u.email, u.full_name
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.revoked_at IS NULL AND s.expires_at > NOW()`
+	var args []interface{}
+	if userID != "" {
+		query += ` AND s.user_id = ?`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY s.last_used_at DESC`
+
+	rows, err := ss.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []ActiveSession{}
+	for rows.Next() {
+		var session ActiveSession
+		if err := rows.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IPAddress, &session.CreatedAt,
+			&session.LastUsedAt, &session.ExpiresAt, &session.UserEmail, &session.UserName); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeByRefreshToken ends the session that owns refreshToken.
+func (ss *SessionService) RevokeByRefreshToken(refreshToken string) error {
+	_, err := ss.db.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE refresh_token_hash = ? AND revoked_at IS NULL`,
+		hashToken(refreshToken))
+	return err
+}
+
+// RevokeSession ends a single session by ID.
+func (ss *SessionService) RevokeSession(sessionID string) error {
+	_, err := ss.db.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL`, sessionID)
+	return err
+}
+
+// RevokeSessions ends the given sessions and returns how many were active.
+func (ss *SessionService) RevokeSessions(sessionIDs []string) (int64, error) {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE revoked_at IS NULL AND id IN (?` +
+		strings.Repeat(", ?", len(sessionIDs)-1) + `)`
+	args := make([]interface{}, len(sessionIDs))
+	for i, id := range sessionIDs {
+		args[i] = id
+	}
+	result, err := ss.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RevokeUserSessions ends every active session of a user.
+func (ss *SessionService) RevokeUserSessions(userID string) (int64, error) {
+	result, err := ss.db.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// startSession opens a session for the user and issues the token pair.
+func startSession(r *http.Request, userID, email, role string) (*AuthTokens, error) {
+	session, refreshToken, err := sessionService.CreateSession(userID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return nil, err
+	}
+
+	token, expiresAt, err := tokenService.IssueToken(userID, email, role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthTokens{
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []*net.IPNet
+)
+
+// trustedProxyRanges returns the TRUSTED_PROXIES ranges, read once.
+func trustedProxyRanges() []*net.IPNet {
+	trustedProxiesOnce.Do(func() {
+		ranges, err := parseRanges("TRUSTED_PROXIES")
+		if err != nil {
+			log.Printf("Ignoring TRUSTED_PROXIES: %v", err)
+			return
+		}
+		trustedProxies = ranges
+	})
+	return trustedProxies
+}
+
+// clientIP returns the caller's address, honouring X-Forwarded-For only when
+// the server is configured to sit behind a trusted proxy. Clients can put
+// anything at the start of the header, so the address is the rightmost entry
+// not added by one of the TRUSTED_PROXIES; with none listed the connecting
+// proxy is the only one trusted and its entry is the rightmost.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if getEnv("TRUST_PROXY_HEADERS", "false") != "true" || forwarded == "" {
+		return host
+	}
+	proxies := trustedProxyRanges()
+	if len(proxies) > 0 && !inRanges(host, proxies) {
+		// Not connected through a proxy, so the header is the client's own
+		return host
+	}
+
+	entries := strings.Split(forwarded, ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(entries[i])
+		if i == 0 || !inRanges(address, proxies) {
+			return address
+		}
+	}
+	return host
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
+
+var sessionService *SessionService
+
+// RefreshTokenHandler exchanges a refresh token for a new access token.
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		http.Error(w, "Refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	session, refreshToken, err := sessionService.RotateRefreshToken(request.RefreshToken, clientIP(r))
+	if err == ErrSessionInvalid {
+		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error refreshing session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := userService.GetUserByID(session.UserID)
+	if err != nil {
+		log.Printf("Error loading user %s for refresh: %v", session.UserID, err)
+		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	}
+	if !user.Approved {
+		http.Error(w, "Account is not approved", http.StatusForbidden)
+		return
+	}
+
+	token, expiresAt, err := tokenService.IssueToken(user.ID, user.Email, user.Role, session.ID)
+	if err != nil {
+		log.Printf("Error issuing token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(AuthTokens{
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+	})
+}
+
+// LogoutHandler revokes the session owning the given refresh token.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Either credential signs the device out; sending both also blacklists
+	// the access token so it stops working before it expires.
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	claims := bearerClaims(r)
+	if request.RefreshToken == "" && claims == nil {
+		http.Error(w, "Refresh token or access token is required", http.StatusBadRequest)
+		return
+	}
+
+	if request.RefreshToken != "" {
+		if err := sessionService.RevokeByRefreshToken(request.RefreshToken); err != nil {
+			log.Printf("Error revoking session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if claims != nil {
+		if err := revocationService.RevokeToken(claims, "logout", claims.Subject); err != nil {
+			log.Printf("Error revoking access token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if claims.SessionID != "" {
+			if err := sessionService.RevokeSession(claims.SessionID); err != nil {
+				log.Printf("Error revoking session %s: %v", claims.SessionID, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Logged out successfully",
+	})
+}
+
+// ActiveSessionsHandler lists signed-in devices, optionally for one user
+// (?user_id=), so an administrator can see where an account is in use.
+func ActiveSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions, err := sessionService.ListActiveSessions(r.URL.Query().Get("user_id"))
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		http.Error(w, "Failed to retrieve sessions", http.StatusInternalServerError)
+		return
+	}
+
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == claims.SessionID
+		}
+	}
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// RevokeUserSessionsHandler lets an administrator sign out individual
+// sessions (session_ids) or a user everywhere (user_id), e.g. when a staff
+// member leaves.
+func RevokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		UserID     string   `json:"user_id"`
+		SessionIDs []string `json:"session_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil ||
+		(request.UserID == "") == (len(request.SessionIDs) == 0) {
+		http.Error(w, "Either user_id or session_ids is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(request.SessionIDs) > 0 {
+		revoked, err := sessionService.RevokeSessions(request.SessionIDs)
+		if err != nil {
+			log.Printf("Error revoking sessions %v: %v", request.SessionIDs, err)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Revoked %d of sessions %v by %s", revoked, request.SessionIDs, actorID(r))
+		auditService.Record(r, AuditSessionsRevoke, "session", strings.Join(request.SessionIDs, ","), nil,
+			map[string]int64{"revoked_sessions": revoked})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":          "Sessions revoked successfully",
+			"revoked_sessions": revoked,
+		})
+		return
+	}
+
+	revoked, err := sessionService.RevokeUserSessions(request.UserID)
+	if err != nil {
+		log.Printf("Error revoking sessions for user %s: %v", request.UserID, err)
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Revoked %d sessions for user %s by %s", revoked, request.UserID, actorID(r))
+	auditService.Record(r, AuditSessionsRevoke, "user", request.UserID, nil, map[string]int64{"revoked_sessions": revoked})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          "Sessions revoked successfully",
+		"revoked_sessions": revoked,
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Customers sign on the counter tablet when they accept the intake terms and
+// when they take the device back. POST /api/v1/orders/{id}/signatures stores
+// the PNG (base64, optionally as a data URL) with the signer's name and the
+// time; the image and its SHA-256 are kept in the database next to the
+// ticket. The ticket detail lists the signatures, the printed job sheet
+// carries the images, and the case file (casefile.go) embeds them.
+
+const ticketSignaturesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_signatures (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		kind ENUM('intake_terms', 'delivery_ack') NOT NULL,
+		signer_name VARCHAR(255) NOT NULL,
+		image MEDIUMBLOB NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		ip_address VARCHAR(45) NULL,
+		recorded_by VARCHAR(50) NULL,
+		signed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ticket_signatures_order (order_id, signed_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Signature kinds
+const (
+	SignatureIntakeTerms = "intake_terms" // Accepting the repair terms at intake
+	SignatureDeliveryAck = "delivery_ack" // Acknowledging the device was handed back
+)
+
+var signatureKinds = []string{SignatureIntakeTerms, SignatureDeliveryAck}
+
+// Signature images are small; anything bigger is not a pen stroke.
+const (
+	maxSignatureBytes = 256 << 10
+	maxSignatureSide  = 2000
+)
+
+// TicketSignature is one signature on a ticket. Image is the PNG, sent
+// base64-encoded; it is left out of the ticket detail.
+type TicketSignature struct {
+	ID         int64     `json:"id"`
+	OrderID    string    `json:"order_id"`
+	Kind       string    `json:"kind"`
+	SignerName string    `json:"signer_name"`
+	SHA256     string    `json:"sha256"`
+	RecordedBy string    `json:"recorded_by,omitempty"`
+	SignedAt   time.Time `json:"signed_at"`
+	Image      []byte    `json:"image,omitempty"`
+	ipAddress  string
+}
+
+// SignatureService handles ticket signature database operations
+type SignatureService struct {
+	db *sql.DB
+}
+
+func NewSignatureService(database *sql.DB) *SignatureService {
+	return &SignatureService{db: database}
+}
+
+var signatureService *SignatureService
+
+// Record stores a signature. A delivery acknowledgment needs the ticket to
+// be ready or collected.
+func (ss *SignatureService) Record(signature *TicketSignature) error {
+	var status string
+	var deletedAt sql.NullTime
+	err := ss.db.QueryRow(`SELECT status, deleted_at FROM orders WHERE id = ?`, signature.OrderID).Scan(&status, &deletedAt)
+	if err != nil {
+		return err
+	}
+	if deletedAt.Valid {
+		return &StatusGuardError{Reason: "the ticket is cancelled"}
+	}
+	if signature.Kind == SignatureDeliveryAck && status != "Ready for Delivery" && status != closedStatus {
+		return &StatusGuardError{Reason: "delivery can only be acknowledged once the ticket is ready"}
+	}
+
+	sum := sha256.Sum256(signature.Image)
+	signature.SHA256 = hex.EncodeToString(sum[:])
+	signature.SignedAt = time.Now()
+	result, err := ss.db.Exec(`
+		INSERT INTO ticket_signatures (order_id, kind, signer_name, image, sha256, ip_address, recorded_by, signed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, signature.OrderID, signature.Kind, signature.SignerName, signature.Image, signature.SHA256,
+		nullString(signature.ipAddress), nullString(signature.RecordedBy), signature.SignedAt)
+	if err != nil {
+		return err
+	}
+	signature.ID, err = result.LastInsertId()
+	return err
+}
+
+// List returns a ticket's signatures oldest first, with their images when
+// withImages is set.
+func (ss *SignatureService) List(orderID string, withImages bool) ([]TicketSignature, error) {
+	image := "NULL"
+	if withImages {
+		image = "image"
+	}
+	rows, err := ss.db.Query(`
+		SELECT id, order_id, kind, signer_name, sha256, recorded_by, signed_at, `+image+`
+		FROM ticket_signatures WHERE order_id = ? ORDER BY signed_at, id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signatures := []TicketSignature{}
+	for rows.Next() {
+		var signature TicketSignature
+		var recordedBy sql.NullString
+		if err := rows.Scan(&signature.ID, &signature.OrderID, &signature.Kind, &signature.SignerName,
+			&signature.SHA256, &recordedBy, &signature.SignedAt, &signature.Image); err != nil {
+			return nil, err
+		}
+		signature.RecordedBy = recordedBy.String
+		signatures = append(signatures, signature)
+	}
+	return signatures, rows.Err()
+}
+
+// decodeSignatureImage reads a base64 PNG, with or without a
+// data:image/png;base64, prefix, and checks it is a signature-sized PNG.
+func decodeSignatureImage(encoded string, fieldErrors *ValidationErrors) []byte {
+	if encoded == "" {
+		fieldErrors.Add("image", "is required")
+		return nil
+	}
+	if prefix, data, found := strings.Cut(encoded, ","); found && strings.HasPrefix(prefix, "data:") {
+		if prefix != "data:image/png;base64" {
+			fieldErrors.Add("image", "must be a PNG")
+			return nil
+		}
+		encoded = data
+	}
+	image, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		fieldErrors.Add("image", "must be base64")
+		return nil
+	}
+	if len(image) > maxSignatureBytes {
+		fieldErrors.Add("image", fmt.Sprintf("must be at most %d KB", maxSignatureBytes>>10))
+		return nil
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(image))
+	if err != nil {
+		fieldErrors.Add("image", "must be a PNG")
+		return nil
+	}
+	if config.Width == 0 || config.Height == 0 || config.Width > maxSignatureSide || config.Height > maxSignatureSide {
+		fieldErrors.Add("image", fmt.Sprintf("must be at most %dx%d pixels", maxSignatureSide, maxSignatureSide))
+		return nil
+	}
+	return image
+}
+
+// orderSignatures lists a ticket's signatures with their images (GET) or
+// records one (POST) at /api/v1/orders/{id}/signatures.
+func orderSignatures(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		signatures, err := signatureService.List(orderID, true)
+		if err != nil {
+			log.Printf("Error listing signatures of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve signatures", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(signatures)
+
+	case "POST":
+		if !hasPermission(r, PermTicketsEdit) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			Kind       string `json:"kind"`
+			SignerName string `json:"signer_name"`
+			Image      string `json:"image"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxSignatureBytes)).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		signature := TicketSignature{
+			OrderID:    orderID,
+			Kind:       request.Kind,
+			SignerName: strings.TrimSpace(request.SignerName),
+			RecordedBy: actorID(r),
+			ipAddress:  clientIP(r),
+		}
+		if !slices.Contains(signatureKinds, signature.Kind) {
+			fieldErrors.Add("kind", "must be intake_terms or delivery_ack")
+		}
+		if signature.SignerName == "" || len(signature.SignerName) > 255 {
+			fieldErrors.Add("signer_name", "is required and must be at most 255 characters")
+		}
+		signature.Image = decodeSignatureImage(request.Image, &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		err := signatureService.Record(&signature)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if guardErr, ok := err.(*StatusGuardError); ok {
+			http.Error(w, guardErr.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error recording signature on order %s: %v", orderID, err)
+			http.Error(w, "Failed to record signature", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Signature %s by %s recorded on order %s by %s", signature.Kind, signature.SignerName, orderID, actorID(r))
+		signature.Image = nil
+		auditService.Record(r, AuditSignatureCaptured, "order", orderID, nil, signature)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(signature)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
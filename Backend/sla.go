@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Each ticket type's sla_hours is its service level: the time from booking
+// in to Ready for Delivery (e.g. diagnostics within 48 hours). Intake stamps
+// the ticket's sla_due_at from it. A ticket whose clock is still running
+// past that moment is overdue (is_overdue in ticket lists); the clock stops
+// while the ticket is on hold (holds.go). The sla_check
+// job marks breaches by setting sla_breached_at, and so does reaching Ready
+// for Delivery late; the dashboard counts open breached tickets.
+
+// slaOpenStatuses are the statuses in which a ticket's SLA clock runs.
+var slaOpenStatuses = []string{"New Order", "In Progress"}
+
+// slaOpenClause is a SQL condition true while a ticket's SLA clock runs.
+const slaOpenClause = `status IN ('New Order', 'In Progress') AND hold_state IS NULL AND deleted_at IS NULL`
+
+// slaDueAt returns when a ticket booked in at created must be ready, or nil
+// when its type has no SLA.
+func slaDueAt(ticketType *TicketType, created time.Time) *time.Time {
+	if ticketType == nil || ticketType.SLAHours <= 0 {
+		return nil
+	}
+	due := created.Add(time.Duration(ticketType.SLAHours) * time.Hour)
+	return &due
+}
+
+// isOverdue reports whether an order is past its SLA with the clock running.
+func isOverdue(order *Order, now time.Time) bool {
+	if order.SLADueAt == nil || order.DeletedAt != nil || order.HoldState != "" || !now.After(*order.SLADueAt) {
+		return false
+	}
+	for _, status := range slaOpenStatuses {
+		if order.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// projectSLA marks a breach when a ticket reaches Ready for Delivery after
+// its SLA ran out.
+func projectSLA(tx *sql.Tx, event *TicketEvent) error {
+	if event.Type != EventStatusChanged {
+		return nil
+	}
+	var payload StatusChangedPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	if payload.To != "Ready for Delivery" && payload.To != closedStatus {
+		return nil
+	}
+	_, err := tx.Exec(`
+		UPDATE orders SET sla_breached_at = sla_due_at
+		WHERE id = ? AND sla_breached_at IS NULL AND sla_due_at < ?
+	`, event.TicketID, event.OccurredAt)
+	return err
+}
+
+// flagSLABreaches marks open tickets that have run past their SLA.
+func flagSLABreaches(ctx context.Context) error {
+	result, err := db.ExecContext(ctx, `
+		UPDATE orders SET sla_breached_at = sla_due_at
+		WHERE sla_breached_at IS NULL AND sla_due_at < NOW() AND `+slaOpenClause)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Printf("SLA check: %d tickets breached their SLA", rows)
+	}
+	return nil
+}
+
+// slaCheckJob flags SLA breaches for the dashboard.
+func slaCheckJob() BackgroundJob {
+	return BackgroundJob{
+		Name:     "sla_check",
+		Interval: getEnvDuration("SLA_CHECK_INTERVAL", 5*time.Minute),
+		Run:      flagSLABreaches,
+	}
+}
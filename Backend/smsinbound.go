@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Customers can text the shop back. The SMS gateway posts each inbound
+// message to /api/v1/public/sms-inbound; the first word picks the action:
+// STATUS replies with the progress of the customer's open tickets, a number
+// approves that estimate option through the same EstimateService the
+// approval page uses, and anything else gets the list of keywords. Tickets
+// are found by the sender's phone number, and every message is kept in
+// sms_inbound with the reply it got.
+
+const smsInboundTable = `
+	CREATE TABLE IF NOT EXISTS sms_inbound (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		from_phone VARCHAR(20) NOT NULL,
+		body VARCHAR(1000) NOT NULL,
+		keyword VARCHAR(20) NOT NULL,
+		order_id VARCHAR(50) NULL,
+		reply VARCHAR(1000) NOT NULL,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_sms_inbound_phone (from_phone, received_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Inbound SMS keywords
+const (
+	SMSKeywordStatus  = "STATUS"
+	SMSKeywordApprove = "APPROVE" // A bare option number
+	SMSKeywordHelp    = "HELP"
+)
+
+// maxStatusReplies caps the tickets listed in one STATUS reply.
+const maxStatusReplies = 3
+
+// SMSReply is the outcome of an inbound message.
+type SMSReply struct {
+	Keyword  string `json:"keyword"`
+	OrderID  string `json:"order_id,omitempty"`
+	Reply    string `json:"reply"`
+	Approved bool   `json:"approved,omitempty"` // An estimate option was selected
+}
+
+// SMSInboundService answers inbound customer messages
+type SMSInboundService struct {
+	db  *sql.DB
+	sms SMSProvider
+}
+
+func NewSMSInboundService(database *sql.DB, sms SMSProvider) *SMSInboundService {
+	return &SMSInboundService{db: database, sms: sms}
+}
+
+// openTicketsForPhone returns the customer's tickets that are not collected
+// or cancelled, newest first.
+func (ss *SMSInboundService) openTicketsForPhone(phone string) ([]Order, error) {
+	key := normalizeCustomerPhone(phone)
+	if len(key) < 6 {
+		return nil, nil
+	}
+	// The suffix narrows the scan; the exact match is on the normalized number
+	candidates, err := orderService.queryOrders(`SELECT `+orderColumns+` FROM orders
+		WHERE customer_phone LIKE ? AND status <> ? AND deleted_at IS NULL
+		ORDER BY created_at DESC`, "%"+key[len(key)-4:], closedStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	var orders []Order
+	for _, order := range candidates {
+		if normalizeCustomerPhone(order.CustomerPhone) == key {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// statusReply describes the progress of each open ticket in language.
+func (ss *SMSInboundService) statusReply(orders []Order, language string) SMSReply {
+	reply := SMSReply{Keyword: SMSKeywordStatus}
+	if len(orders) == 0 {
+		reply.Reply = localize(language, "sms.none", nil)
+		return reply
+	}
+
+	lines := []string{localize(language, "sms.header", nil)}
+	for i, order := range orders {
+		if i == maxStatusReplies {
+			lines = append(lines, localize(language, "sms.more", map[string]int{"Count": len(orders) - maxStatusReplies}))
+			break
+		}
+		line := localize(language, "sms.status", map[string]string{
+			"Order": order.ID, "Device": order.DeviceType, "Status": localizeStatus(language, order.Status),
+		})
+		if order.ExpectedDeliveryDate != nil && order.Status != "Ready for Delivery" {
+			line += localize(language, "sms.expected", map[string]string{"Date": shopLocale.FormatDate(*order.ExpectedDeliveryDate)})
+		}
+		lines = append(lines, line+".")
+	}
+	reply.OrderID = orders[0].ID
+	reply.Reply = strings.Join(lines, " ")
+	return reply
+}
+
+// approveReply selects estimate option position on the newest open ticket
+// that has unchosen options behind a live approval link, replying in
+// language.
+func (ss *SMSInboundService) approveReply(orders []Order, position int, language string) (SMSReply, error) {
+	reply := SMSReply{Keyword: SMSKeywordApprove}
+	for _, order := range orders {
+		var optionID int64
+		var label string
+		err := ss.db.QueryRow(`
+			SELECT o.id, o.label FROM estimate_options o
+			WHERE o.order_id = ? AND o.position = ?
+			  AND NOT EXISTS (SELECT 1 FROM estimate_options c WHERE c.order_id = o.order_id AND (c.selected_at IS NOT NULL OR c.rejected_at IS NOT NULL))
+			  AND EXISTS (SELECT 1 FROM estimate_links l WHERE l.order_id = o.order_id AND l.expires_at > NOW())
+		`, order.ID, position).Scan(&optionID, &label)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return reply, err
+		}
+
+		reply.OrderID = order.ID
+		err = estimateService.Decide(order.ID, EstimateDecision{OptionID: optionID})
+		if err == errEstimateChosen {
+			reply.Reply = localize(language, "sms.already_chosen", map[string]string{"Order": order.ID})
+			return reply, nil
+		}
+		if err != nil {
+			return reply, err
+		}
+		reply.Approved = true
+		reply.Reply = localize(language, "sms.approved", map[string]string{"Label": label, "Order": order.ID})
+		return reply, nil
+	}
+	reply.Reply = localize(language, "sms.no_option", map[string]int{"Position": position})
+	return reply, nil
+}
+
+// Handle routes an inbound message by its first word, records it and texts
+// the reply back.
+func (ss *SMSInboundService) Handle(from, body string) (SMSReply, error) {
+	words := strings.Fields(body)
+	keyword := ""
+	if len(words) > 0 {
+		keyword = strings.ToUpper(strings.Trim(words[0], ".!"))
+	}
+
+	orders, err := ss.openTicketsForPhone(from)
+	if err != nil {
+		return SMSReply{}, err
+	}
+	language, err := customerLanguage(ss.db, "", from)
+	if err != nil {
+		return SMSReply{}, err
+	}
+
+	var reply SMSReply
+	if position, convErr := strconv.Atoi(keyword); convErr == nil && position >= 1 && position <= maxEstimateOptions {
+		if reply, err = ss.approveReply(orders, position, language); err != nil {
+			return SMSReply{}, err
+		}
+	} else if keyword == SMSKeywordStatus {
+		reply = ss.statusReply(orders, language)
+	} else {
+		reply = SMSReply{Keyword: SMSKeywordHelp, Reply: localize(language, "sms.help", nil)}
+	}
+
+	_, err = ss.db.Exec(`
+		INSERT INTO sms_inbound (from_phone, body, keyword, order_id, reply) VALUES (?, ?, ?, ?, ?)
+	`, truncate(from, 20), truncate(body, 1000), reply.Keyword, nullString(reply.OrderID), truncate(reply.Reply, 1000))
+	if err != nil {
+		return SMSReply{}, err
+	}
+
+	if err := ss.sms.Send(from, reply.Reply); err != nil {
+		log.Printf("Error sending SMS reply to %s: %v", maskTail(from, 4), err)
+	}
+	return reply, nil
+}
+
+var smsInboundService *SMSInboundService
+
+// webhookTokenValid reports whether a webhook request carries token as its
+// basic auth password or X-Webhook-Token header. Tokens are never taken
+// from the URL, where they would end up in access logs.
+func webhookTokenValid(r *http.Request, token string) bool {
+	given := r.Header.Get("X-Webhook-Token")
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	}
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// SMSInboundHandler receives customer texts from the SMS gateway
+// (POST {"from": "+919845012345", "message": "STATUS"}). The request must
+// carry SMS_WEBHOOK_TOKEN (see webhookTokenValid); without one configured
+// the webhook is off.
+func SMSInboundHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := getEnv("SMS_WEBHOOK_TOKEN", "")
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !webhookTokenValid(r, token) {
+		http.Error(w, "Invalid webhook token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		From    string `json:"from"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if strings.TrimSpace(request.From) == "" {
+		fieldErrors.Add("from", "is required")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	reply, err := smsInboundService.Handle(request.From, request.Message)
+	if err != nil {
+		log.Printf("Error handling SMS from %s: %v", maskTail(request.From, 4), err)
+		http.Error(w, "Failed to handle message", http.StatusInternalServerError)
+		return
+	}
+
+	if reply.Approved {
+		log.Printf("Customer approved an estimate on order %s by SMS", reply.OrderID)
+		auditService.RecordAs(r, "", AuditEstimateSelected, "order", reply.OrderID, nil,
+			map[string]string{"channel": "sms", "message": request.Message})
+	}
+	json.NewEncoder(w).Encode(reply)
+}
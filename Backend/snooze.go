@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Staff snooze a ticket they can't move on yet with a follow-up time and a
+// note ("call customer Tuesday"). A snooze belongs to the person who set it:
+// until it is due the ticket drops out of their order lists, board and day,
+// and no one else's. When it comes due the snooze job emails them a
+// reminder and the ticket resurfaces, listed in their day's follow_ups
+// until they dismiss the snooze or snooze the ticket again. Collecting or
+// cancelling a ticket clears its snoozes. Snoozes are set and dismissed at
+// /api/v1/orders/{id}/snooze and listed at /api/v1/me/snoozes.
+
+const ticketSnoozesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_snoozes (
+		order_id VARCHAR(50) NOT NULL,
+		user_id VARCHAR(50) NOT NULL,
+		snoozed_until TIMESTAMP NOT NULL,
+		note VARCHAR(500) NOT NULL,
+		snoozed_at TIMESTAMP NOT NULL,
+		reminded_at TIMESTAMP NULL,
+		PRIMARY KEY (order_id, user_id),
+		INDEX idx_ticket_snoozes_user (user_id, snoozed_until),
+		INDEX idx_ticket_snoozes_due (reminded_at, snoozed_until),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// snoozeCleanupStatements clear snoozes left on tickets closed before
+// closing cleared them.
+var snoozeCleanupStatements = []string{
+	`DELETE s FROM ticket_snoozes s JOIN orders o ON o.id = s.order_id WHERE o.status IN ('Collected', 'Cancelled')`,
+}
+
+// projectTicketSnoozes clears a ticket's snoozes when it is collected or
+// cancelled, so no reminder or follow-up is left for a closed ticket.
+func projectTicketSnoozes(tx *sql.Tx, event *TicketEvent) error {
+	switch event.Type {
+	case EventStatusChanged:
+		var payload StatusChangedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		if payload.To != closedStatus {
+			return nil
+		}
+	case EventTicketCancelled:
+	default:
+		return nil
+	}
+	_, err := tx.Exec(`DELETE FROM ticket_snoozes WHERE order_id = ?`, event.TicketID)
+	return err
+}
+
+// snoozedClause is a SQL condition, on orders, true for tickets the ? user
+// has snoozed and that are not yet due.
+const snoozedClause = `id IN (SELECT order_id FROM ticket_snoozes WHERE user_id = ? AND snoozed_until > NOW())`
+
+// TicketSnooze is one user's snooze of a ticket.
+type TicketSnooze struct {
+	OrderID      string     `json:"order_id"`
+	Until        time.Time  `json:"until"`
+	Note         string     `json:"note"`
+	SnoozedAt    time.Time  `json:"snoozed_at"`
+	Due          bool       `json:"due"` // The follow-up time has passed
+	RemindedAt   *time.Time `json:"reminded_at,omitempty"`
+	TicketStatus string     `json:"ticket_status"`
+}
+
+// SnoozeReminder emails a user that a ticket they snoozed is due.
+type SnoozeReminder struct {
+	OrderID   string    `json:"order_id"`
+	Note      string    `json:"note"`
+	Until     time.Time `json:"until"`
+	Recipient string    `json:"recipient"`
+}
+
+// SnoozeService keeps staff's ticket snoozes
+type SnoozeService struct {
+	db *sql.DB
+}
+
+func NewSnoozeService(database *sql.DB) *SnoozeService {
+	return &SnoozeService{db: database}
+}
+
+var snoozeService *SnoozeService
+
+const ticketSnoozeColumns = `s.order_id, s.snoozed_until, s.note, s.snoozed_at, s.snoozed_until <= NOW(), s.reminded_at, o.status`
+
+func scanTicketSnooze(row rowScanner) (*TicketSnooze, error) {
+	var snooze TicketSnooze
+	var remindedAt sql.NullTime
+	err := row.Scan(&snooze.OrderID, &snooze.Until, &snooze.Note, &snooze.SnoozedAt, &snooze.Due, &remindedAt, &snooze.TicketStatus)
+	if err != nil {
+		return nil, err
+	}
+	snooze.RemindedAt = timePtr(remindedAt)
+	return &snooze, nil
+}
+
+// Get returns userID's snooze of orderID, or nil when they have none.
+func (ss *SnoozeService) Get(orderID, userID string) (*TicketSnooze, error) {
+	snooze, err := scanTicketSnooze(ss.db.QueryRow(`
+		SELECT `+ticketSnoozeColumns+` FROM ticket_snoozes s JOIN orders o ON o.id = s.order_id
+		WHERE s.order_id = ? AND s.user_id = ?
+	`, orderID, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return snooze, err
+}
+
+// List returns userID's snoozes, or only the due ones, soonest first.
+func (ss *SnoozeService) List(userID string, dueOnly bool) ([]TicketSnooze, error) {
+	query := `SELECT ` + ticketSnoozeColumns + ` FROM ticket_snoozes s JOIN orders o ON o.id = s.order_id
+		WHERE s.user_id = ?`
+	if dueOnly {
+		query += ` AND s.snoozed_until <= NOW()`
+	}
+	rows, err := ss.db.Query(query+` ORDER BY s.snoozed_until, s.order_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snoozes := []TicketSnooze{}
+	for rows.Next() {
+		snooze, err := scanTicketSnooze(rows)
+		if err != nil {
+			return nil, err
+		}
+		snoozes = append(snoozes, *snooze)
+	}
+	return snoozes, rows.Err()
+}
+
+// Snooze snoozes an open ticket for userID until until, replacing any
+// snooze they already had on it.
+func (ss *SnoozeService) Snooze(orderID, userID string, until time.Time, note string) error {
+	order, err := orderService.GetOrder(orderID)
+	if err != nil {
+		return err
+	}
+	if order.Status == closedStatus || order.Status == StatusCancelled {
+		return &StatusGuardError{Reason: fmt.Sprintf("a %s ticket can't be snoozed", order.Status)}
+	}
+	_, err = ss.db.Exec(`
+		INSERT INTO ticket_snoozes (order_id, user_id, snoozed_until, note, snoozed_at) VALUES (?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE snoozed_until = VALUES(snoozed_until), note = VALUES(note),
+			snoozed_at = VALUES(snoozed_at), reminded_at = NULL
+	`, orderID, userID, until, note)
+	return err
+}
+
+// Dismiss removes userID's snooze of orderID, whether or not it is due.
+func (ss *SnoozeService) Dismiss(orderID, userID string) error {
+	result, err := ss.db.Exec(`DELETE FROM ticket_snoozes WHERE order_id = ? AND user_id = ?`, orderID, userID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Remind queues a reminder for every snooze that has come due, at most 100
+// each run.
+func (ss *SnoozeService) Remind(ctx context.Context) error {
+	rows, err := ss.db.QueryContext(ctx, `
+		SELECT order_id, user_id FROM ticket_snoozes
+		WHERE reminded_at IS NULL AND snoozed_until <= NOW()
+		ORDER BY snoozed_until LIMIT 100
+	`)
+	if err != nil {
+		return err
+	}
+	type dueSnooze struct{ orderID, userID string }
+	var due []dueSnooze
+	for rows.Next() {
+		var snooze dueSnooze
+		if err := rows.Scan(&snooze.orderID, &snooze.userID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, snooze)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, snooze := range due {
+		if err := ss.remind(ctx, snooze.orderID, snooze.userID); err != nil {
+			return fmt.Errorf("reminding %s of %s: %w", snooze.userID, snooze.orderID, err)
+		}
+	}
+	if len(due) > 0 {
+		log.Printf("Snooze: %d follow-up reminders queued", len(due))
+	}
+	return nil
+}
+
+// remind marks one due snooze reminded and queues its email, unless it was
+// snoozed again or dismissed in the meantime.
+func (ss *SnoozeService) remind(ctx context.Context, orderID, userID string) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var reminder SnoozeReminder
+	var email sql.NullString
+	err = tx.QueryRow(`
+		SELECT s.note, s.snoozed_until, u.email FROM ticket_snoozes s JOIN users u ON u.id = s.user_id
+		WHERE s.order_id = ? AND s.user_id = ? AND s.reminded_at IS NULL AND s.snoozed_until <= NOW()
+		FOR UPDATE
+	`, orderID, userID).Scan(&reminder.Note, &reminder.Until, &email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE ticket_snoozes SET reminded_at = NOW() WHERE order_id = ? AND user_id = ?`, orderID, userID); err != nil {
+		return err
+	}
+	if email.String != "" {
+		reminder.OrderID = orderID
+		reminder.Recipient = email.String
+		if err := enqueueOutbox(tx, "snooze.reminder", orderID, reminder); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deliverSnoozeReminder emails a user that a ticket they snoozed is due.
+func deliverSnoozeReminder(msg OutboxMessage) error {
+	var reminder SnoozeReminder
+	if err := json.Unmarshal(msg.Payload, &reminder); err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("Follow up on ticket %s", reminder.OrderID)
+	body := fmt.Sprintf("Hello,\n\nYou snoozed ticket %s until %s with the note:\n\n%s\n\nIt is back in your queue.\n\nPC Repair Hub",
+		reminder.OrderID, reminder.Until.Format("02 Jan 2006 15:04"), reminder.Note)
+	return emailService.Send(reminder.OrderID, msg.ID, reminder.Recipient, subject, body)
+}
+
+// snoozeReminderJob reminds staff of snoozes that have come due.
+func snoozeReminderJob() BackgroundJob {
+	return BackgroundJob{
+		Name:     "snooze_reminders",
+		Interval: getEnvDuration("SNOOZE_CHECK_INTERVAL", time.Minute),
+		Run:      snoozeService.Remind,
+	}
+}
+
+// orderSnooze snoozes a ticket for the signed-in user (POST {"until":
+// "2025-06-03T10:00:00+05:30", "note": "Call customer Tuesday"}) or
+// dismisses their snooze (DELETE).
+func orderSnooze(w http.ResponseWriter, r *http.Request, orderID string) {
+	userID := actorID(r)
+	if userID == "" {
+		http.Error(w, "This endpoint needs a signed-in user", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		var request struct {
+			Until string `json:"until"`
+			Note  string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		until := parseDateField("until", request.Until, &fieldErrors)
+		if request.Until == "" {
+			fieldErrors.Add("until", "is required")
+		} else if until != nil && !until.After(time.Now()) {
+			fieldErrors.Add("until", "must be in the future")
+		}
+		request.Note = strings.TrimSpace(request.Note)
+		if request.Note == "" {
+			fieldErrors.Add("note", "is required")
+		} else if len(request.Note) > 500 {
+			fieldErrors.Add("note", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		err := snoozeService.Snooze(orderID, userID, *until, request.Note)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if guardErr, ok := err.(*StatusGuardError); ok {
+			http.Error(w, guardErr.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error snoozing order %s for %s: %v", orderID, userID, err)
+			http.Error(w, "Failed to snooze ticket", http.StatusInternalServerError)
+			return
+		}
+		snooze, err := snoozeService.Get(orderID, userID)
+		if err != nil {
+			log.Printf("Error retrieving snooze of order %s for %s: %v", orderID, userID, err)
+			http.Error(w, "Failed to snooze ticket", http.StatusInternalServerError)
+			return
+		}
+		auditService.Record(r, AuditTicketSnoozed, "order", orderID, nil, snooze)
+		json.NewEncoder(w).Encode(snooze)
+
+	case "DELETE":
+		err := snoozeService.Dismiss(orderID, userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "You have not snoozed this ticket", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error dismissing snooze of order %s for %s: %v", orderID, userID, err)
+			http.Error(w, "Failed to dismiss snooze", http.StatusInternalServerError)
+			return
+		}
+		auditService.Record(r, AuditTicketSnoozeDismissed, "order", orderID, nil, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Snooze dismissed successfully",
+		})
+
+	default:
+		http.Error(w, "Only POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MySnoozesHandler lists the signed-in user's snoozes (GET), or only the
+// due ones with ?due=true.
+func MySnoozesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := actorID(r)
+	if userID == "" {
+		http.Error(w, "This endpoint needs a signed-in user", http.StatusForbidden)
+		return
+	}
+
+	snoozes, err := snoozeService.List(userID, r.URL.Query().Get("due") == "true")
+	if err != nil {
+		log.Printf("Error listing snoozes of %s: %v", userID, err)
+		http.Error(w, "Failed to retrieve snoozes", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(snoozes)
+}
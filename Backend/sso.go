@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Staff can sign in with their Google Workspace or Microsoft 365 account.
+// Verified emails map onto existing users; unknown staff are provisioned as
+// Engineers that stay locked out until an admin approves them.
+
+const ssoCookieName = "pchub_sso"
+
+// ssoProvider is an OpenID Connect identity provider.
+type ssoProvider struct {
+	config      *oauth2.Config
+	userInfoURL string
+	// trustEmail marks providers whose userinfo email is verified by the
+	// directory even without an email_verified claim (work accounts).
+	trustEmail bool
+}
+
+// ssoUserInfo is the subset of the OIDC userinfo response we use.
+type ssoUserInfo struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// ssoProviders builds the configured providers. A provider is enabled when
+// its client ID and secret are set.
+func ssoProviders() map[string]*ssoProvider {
+	providers := map[string]*ssoProvider{}
+	baseURL := strings.TrimSuffix(getEnv("SSO_REDIRECT_BASE_URL", "http://localhost:8080"), "/")
+	redirect := baseURL + "/api/v1/auth/sso/callback"
+
+	if id, secret := getEnv("SSO_GOOGLE_CLIENT_ID", ""), getEnv("SSO_GOOGLE_CLIENT_SECRET", ""); id != "" && secret != "" {
+		providers["google"] = &ssoProvider{
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: secret,
+				RedirectURL:  redirect,
+				Scopes:       []string{"openid", "email", "profile"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+					TokenURL: "https://oauth2.googleapis.com/token",
+				},
+			},
+			userInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+		}
+	}
+
+	// Microsoft sign-in is pinned to the shop's own tenant: the multi-tenant
+	// endpoints accept any directory, whose admins can put any email on an
+	// account, and accounts are matched by email.
+	if id, secret := getEnv("SSO_MICROSOFT_CLIENT_ID", ""), getEnv("SSO_MICROSOFT_CLIENT_SECRET", ""); id != "" && secret != "" {
+		tenant := getEnv("SSO_MICROSOFT_TENANT", "")
+		switch strings.ToLower(tenant) {
+		case "", "organizations", "common", "consumers":
+			log.Printf("Microsoft SSO disabled: SSO_MICROSOFT_TENANT must be the shop's tenant ID, not %q", tenant)
+			return providers
+		}
+		providers["microsoft"] = &ssoProvider{
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: secret,
+				RedirectURL:  redirect,
+				Scopes:       []string{"openid", "email", "profile"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/authorize",
+					TokenURL: "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/token",
+				},
+			},
+			userInfoURL: "https://graph.microsoft.com/oidc/userinfo",
+			trustEmail:  true,
+		}
+	}
+
+	return providers
+}
+
+var ssoProviderSet map[string]*ssoProvider
+
+// ssoDomainAllowed checks the email against SSO_ALLOWED_DOMAINS, a comma
+// separated list of workspace domains. An empty list allows any domain.
+func ssoDomainAllowed(email string) bool {
+	allowed := getEnv("SSO_ALLOWED_DOMAINS", "")
+	if allowed == "" {
+		return true
+	}
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, d := range strings.Split(allowed, ",") {
+		if strings.ToLower(strings.TrimSpace(d)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchUserInfo exchanges the code and reads the caller's verified email.
+func (p *ssoProvider) fetchUserInfo(ctx context.Context, code, verifier string) (*ssoUserInfo, error) {
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.config.Client(ctx, token).Get(p.userInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo returned %s", resp.Status)
+	}
+
+	var info ssoUserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	info.Email = strings.ToLower(strings.TrimSpace(info.Email))
+	return &info, nil
+}
+
+func (p *ssoProvider) emailVerified(info *ssoUserInfo) bool {
+	if info.Email == "" || !strings.Contains(info.Email, "@") {
+		return false
+	}
+	if info.EmailVerified != nil {
+		return *info.EmailVerified
+	}
+	return p.trustEmail
+}
+
+// SSOStartHandler redirects to the provider's consent page. The state and
+// PKCE verifier travel in a short-lived HttpOnly cookie.
+func SSOStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("provider")
+	provider, ok := ssoProviderSet[name]
+	if !ok {
+		http.Error(w, "Unknown or unconfigured SSO provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := randomToken(24)
+	if err != nil {
+		log.Printf("Error generating SSO state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookieName,
+		Value:    strings.Join([]string{name, state, verifier}, "|"),
+		Path:     "/api/v1/auth/sso",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(getEnv("SSO_REDIRECT_BASE_URL", ""), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := provider.config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("prompt", "select_account"))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// SSOCallbackHandler completes the login. Known, approved users get the
+// same tokens as a password login; unknown users are provisioned pending
+// approval.
+func SSOCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie(ssoCookieName)
+	if err != nil {
+		http.Error(w, "SSO session expired; start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoCookieName, Path: "/api/v1/auth/sso", MaxAge: -1})
+
+	parts := strings.SplitN(cookie.Value, "|", 3)
+	if len(parts) != 3 || parts[1] != r.URL.Query().Get("state") {
+		http.Error(w, "Invalid SSO state", http.StatusBadRequest)
+		return
+	}
+	provider, ok := ssoProviderSet[parts[0]]
+	if !ok {
+		http.Error(w, "Unknown or unconfigured SSO provider", http.StatusBadRequest)
+		return
+	}
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		http.Error(w, "Sign-in was cancelled or refused: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	info, err := provider.fetchUserInfo(ctx, r.URL.Query().Get("code"), parts[2])
+	if err != nil {
+		log.Printf("Error completing %s SSO: %v", parts[0], err)
+		http.Error(w, "Could not complete sign-in with the provider", http.StatusBadGateway)
+		return
+	}
+	if !provider.emailVerified(info) {
+		http.Error(w, "Your account has no verified email address", http.StatusForbidden)
+		return
+	}
+	if !ssoDomainAllowed(info.Email) {
+		http.Error(w, "Your email domain is not allowed to sign in", http.StatusForbidden)
+		return
+	}
+
+	user, err := userService.GetUserByEmail(info.Email)
+	if err == sql.ErrNoRows {
+		user, err = provisionSSOUser(info, parts[0])
+		if err != nil {
+			log.Printf("Error provisioning SSO user %s: %v", info.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Provisioned %s via %s SSO pending approval.", user.ID, parts[0])
+		auditService.RecordAs(r, user.ID, AuditRegister, "user", user.ID, nil,
+			map[string]string{"email": user.Email, "role": user.Role, "provider": parts[0]})
+	} else if err != nil {
+		log.Printf("Error retrieving user: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !user.Approved {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "approval_pending",
+			"message": "Your account is waiting for an administrator to approve it",
+		})
+		return
+	}
+
+	tokens, err := startSession(r, user.ID, user.Email, user.Role)
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s logged in via %s SSO.", user.Email, parts[0])
+	auditService.RecordAs(r, user.ID, AuditLogin, "user", user.ID, nil, map[string]string{"provider": parts[0]})
+
+	// Browser flows hand the tokens to the frontend in the URL fragment,
+	// which is never sent back to a server.
+	if target := getEnv("SSO_SUCCESS_REDIRECT", ""); target != "" {
+		fragment := url.Values{
+			"token":         {tokens.Token},
+			"refresh_token": {tokens.RefreshToken},
+		}
+		http.Redirect(w, r, target+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Login successful",
+		"user": map[string]interface{}{
+			"id":    user.ID,
+			"email": user.Email,
+			"name":  user.FullName,
+			"phone": user.Phone,
+			"role":  user.Role,
+		},
+		"token":              tokens.Token,
+		"expires_at":         tokens.ExpiresAt,
+		"refresh_token":      tokens.RefreshToken,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+	})
+}
+
+// provisionSSOUser creates an unapproved Engineer for a first-time SSO
+// login. The password is random; the account signs in through SSO.
+func provisionSSOUser(info *ssoUserInfo, provider string) (*User, error) {
+	password, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	name := info.Name
+	if name == "" {
+		name = info.Email
+	}
+	user := &User{
+		ID:       fmt.Sprintf("USER-%d", time.Now().UnixNano()),
+		FullName: name,
+		Email:    info.Email,
+		Password: password,
+		Role:     RoleEngineer,
+		Approved: false, // Created pending, so a failure below leaves it blocked
+	}
+	if err := userService.CreateUser(user); err != nil {
+		return nil, err
+	}
+	if err := userService.SetAuthProvider(user.ID, provider); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SetAuthProvider records the SSO provider that provisioned an account.
+func (us *UserService) SetAuthProvider(userID, provider string) error {
+	_, err := us.db.Exec(`UPDATE users SET auth_provider = ? WHERE id = ?`, provider, userID)
+	return err
+}
+
+func (us *UserService) SetApproved(userID string, approved bool) error {
+	result, err := us.db.Exec(`UPDATE users SET approved = ?, updated_at = NOW() WHERE id = ?`, approved, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ApproveUserHandler lets an admin approve (or re-block) an account.
+func ApproveUserHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		UserID   string `json:"user_id"`
+		Approved *bool  `json:"approved"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.UserID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	approved := request.Approved == nil || *request.Approved
+
+	err := userService.SetApproved(request.UserID, approved)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating approval for user %s: %v", request.UserID, err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	// Blocking an account also signs it out everywhere
+	if !approved {
+		if _, err := sessionService.RevokeUserSessions(request.UserID); err != nil {
+			log.Printf("Error revoking sessions for blocked user %s: %v", request.UserID, err)
+		}
+	}
+
+	log.Printf("User %s approval set to %t by %s", request.UserID, approved, actorID(r))
+	auditService.Record(r, AuditUserApproval, "user", request.UserID, nil, map[string]bool{"approved": approved})
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "User approval updated successfully",
+	})
+}
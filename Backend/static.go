@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// hashedAssetPattern matches fingerprinted build output such as app.3f9a1c2b.js,
+// which can safely be cached forever because its name changes with its content.
+var hashedAssetPattern = regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// frontendHandler serves the static frontend from fsys with SPA fallback routing:
+// unknown extension-less paths are answered with index.html so client-side routes
+// survive a page refresh, while missing assets still return 404.
+func frontendHandler(fsys fs.FS) http.Handler {
+	fileServer := http.FileServer(http.FS(fsys))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" {
+			name = "index.html"
+		}
+
+		if info, err := fs.Stat(fsys, name); err != nil || info.IsDir() {
+			if path.Ext(name) != "" {
+				http.NotFound(w, r)
+				return
+			}
+			// SPA fallback: let the frontend resolve the route
+			name = "index.html"
+			r.URL.Path = "/"
+		}
+
+		setStaticCacheHeaders(w, name)
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// setStaticCacheHeaders picks a cache policy based on the kind of file served.
+func setStaticCacheHeaders(w http.ResponseWriter, name string) {
+	switch {
+	case strings.HasSuffix(name, ".html"):
+		// HTML must always be revalidated so new deployments are picked up immediately
+		w.Header().Set("Cache-Control", "no-cache")
+	case hashedAssetPattern.MatchString(name):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+}
@@ -0,0 +1,30 @@
+//go:build embedui
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+)
+
+// embeddedFrontend holds the built frontend copied into web/dist before building.
+//
+//go:embed all:web/dist
+var embeddedFrontend embed.FS
+
+// frontendFS returns the embedded frontend, or nil if nothing was embedded.
+func frontendFS() fs.FS {
+	sub, err := fs.Sub(embeddedFrontend, "web/dist")
+	if err != nil {
+		log.Printf("Embedded frontend unavailable: %v", err)
+		return nil
+	}
+
+	if _, err := fs.Stat(sub, "index.html"); err != nil {
+		log.Printf("Embedded frontend has no index.html; copy the frontend into web/dist before building")
+		return nil
+	}
+
+	return sub
+}
@@ -0,0 +1,10 @@
+//go:build !embedui
+
+package main
+
+import "io/fs"
+
+// frontendFS returns nil when the binary is built without the embedui tag.
+func frontendFS() fs.FS {
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Every status a ticket passes through is kept in ticket_status_history, a
+// projection of the ticket's TicketCreated, StatusChanged, TicketCancelled
+// and TicketReopened events. GET /api/v1/orders/{id}/history serves it as the
+// timeline of the order tracker. Tickets created before the table existed
+// get their rows from the status_history_backfill online migration.
+
+const ticketStatusHistoryTable = `
+	CREATE TABLE IF NOT EXISTS ticket_status_history (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		event_version INT NOT NULL,
+		from_status VARCHAR(30) NULL,
+		to_status VARCHAR(30) NOT NULL,
+		changed_by VARCHAR(50) NULL,
+		note VARCHAR(500) NULL,
+		changed_at TIMESTAMP NOT NULL,
+		UNIQUE KEY uniq_status_history_event (order_id, event_version),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// StatusHistoryEntry is one step of a ticket's timeline.
+type StatusHistoryEntry struct {
+	From          string    `json:"from,omitempty"`
+	To            string    `json:"to"`
+	ChangedBy     string    `json:"changed_by,omitempty"`
+	ChangedByName string    `json:"changed_by_name,omitempty"`
+	Note          string    `json:"note,omitempty"` // Reason given for a cancellation or reopening
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// projectStatusHistory records a status transition.
+func projectStatusHistory(tx *sql.Tx, event *TicketEvent) error {
+	var from, to, note string
+	switch event.Type {
+	case EventTicketCreated:
+		var order Order
+		if err := json.Unmarshal(event.Payload, &order); err != nil {
+			return err
+		}
+		to = order.Status
+
+	case EventStatusChanged:
+		var payload StatusChangedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		from, to = payload.From, payload.To
+
+	case EventTicketCancelled:
+		var payload TicketCancelledPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		from, to, note = payload.From, StatusCancelled, payload.Reason
+
+	case EventTicketReopened:
+		var payload TicketReopenedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		from, to, note = payload.From, StatusReopened, payload.Reason
+
+	default:
+		return nil
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO ticket_status_history (order_id, event_version, from_status, to_status, changed_by, note, changed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, event.TicketID, event.Version, nullString(from), to, nullString(event.ActorID), nullString(note), event.OccurredAt)
+	return err
+}
+
+// StatusHistory returns a ticket's timeline, oldest first.
+func (os *OrderService) StatusHistory(orderID string) ([]StatusHistoryEntry, error) {
+	rows, err := os.db.Query(`
+		SELECT h.from_status, h.to_status, h.changed_by, u.full_name, h.note, h.changed_at
+		FROM ticket_status_history h LEFT JOIN users u ON u.id = h.changed_by
+		WHERE h.order_id = ? ORDER BY h.event_version
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []StatusHistoryEntry{}
+	for rows.Next() {
+		var entry StatusHistoryEntry
+		var from, changedBy, changedByName, note sql.NullString
+		if err := rows.Scan(&from, &entry.To, &changedBy, &changedByName, &note, &entry.ChangedAt); err != nil {
+			return nil, err
+		}
+		entry.From = from.String
+		entry.ChangedBy = changedBy.String
+		entry.ChangedByName = changedByName.String
+		entry.Note = note.String
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+// statusHistoryBackfillMigration fills ticket_status_history from the event
+// streams of tickets that predate it.
+var statusHistoryBackfillMigration = &OnlineMigration{
+	Name:        "status_history_backfill",
+	Description: "Build the status history of existing tickets from their events",
+	Table:       "orders",
+	Prepare: func(database *sql.DB) error {
+		return nil
+	},
+	DualWrite: func(tx execer, id string) error {
+		// New transitions are recorded by projectStatusHistory
+		return nil
+	},
+	Backfill: func(database *sql.DB, cursor string, limit int) (string, int, error) {
+		var lastID string
+		var processed int
+		err := database.QueryRow(`
+			SELECT COALESCE(MAX(id), ''), COUNT(*) FROM (
+				SELECT id FROM orders WHERE id > ? ORDER BY id LIMIT ?
+			) batch
+		`, cursor, limit).Scan(&lastID, &processed)
+		if err != nil || processed == 0 {
+			return cursor, 0, err
+		}
+
+		_, err = database.Exec(`
+			INSERT IGNORE INTO ticket_status_history (order_id, event_version, from_status, to_status, changed_by, note, changed_at)
+			SELECT e.ticket_id, e.version,
+			       CASE WHEN e.event_type = ? THEN NULL ELSE JSON_UNQUOTE(JSON_EXTRACT(e.payload, '$.from')) END,
+			       CASE e.event_type
+			           WHEN ? THEN JSON_UNQUOTE(JSON_EXTRACT(e.payload, '$.status'))
+			           WHEN ? THEN JSON_UNQUOTE(JSON_EXTRACT(e.payload, '$.to'))
+			           ELSE ?
+			       END,
+			       e.actor_id,
+			       CASE WHEN e.event_type = ? THEN JSON_UNQUOTE(JSON_EXTRACT(e.payload, '$.reason')) END,
+			       e.occurred_at
+			FROM ticket_events e
+			WHERE e.ticket_id > ? AND e.ticket_id <= ? AND e.event_type IN (?, ?, ?)
+		`, EventTicketCreated, EventTicketCreated, EventStatusChanged, StatusCancelled, EventTicketCancelled,
+			cursor, lastID, EventTicketCreated, EventStatusChanged, EventTicketCancelled)
+		return lastID, processed, err
+	},
+	Remaining: func(database *sql.DB) (int64, error) {
+		var count int64
+		err := database.QueryRow(`
+			SELECT COUNT(*) FROM orders o
+			WHERE NOT EXISTS (SELECT 1 FROM ticket_status_history h WHERE h.order_id = o.id)
+		`).Scan(&count)
+		return count, err
+	},
+}
+
+// getOrderHistory serves GET /api/v1/orders/{id}/history.
+func getOrderHistory(w http.ResponseWriter, r *http.Request, orderID string) {
+	var status string
+	err := db.QueryRow(`SELECT status FROM orders WHERE id = ?`, orderID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve status history", http.StatusInternalServerError)
+		return
+	}
+
+	history, err := orderService.StatusHistory(orderID)
+	if err != nil {
+		log.Printf("Error retrieving status history of order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve status history", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"status":   status,
+		"timeline": history,
+	})
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stocktake (cycle count) checks the stock on the shelves against the
+// book. Staff open a count session, for the whole store or one category,
+// and count into it at /api/v1/parts/stocktakes/{id}/counts: each scan of a
+// SKU adds one, or a quantity, and "set" replaces a miscount. A part's book
+// quantity is taken when it is first counted (or recounted), so stock that
+// moves later in the day does not show as variance. The variance report
+// lists each counted part's variance and its value at unit cost, and the
+// parts in scope with stock that nobody counted. An admin posts the
+// approved lines in one transaction: each variance becomes a stocktake
+// stock movement (taken from the oldest lots when stock is missing) and
+// the session closes. Lines not approved are left unposted.
+
+const stocktakesTable = `
+	CREATE TABLE IF NOT EXISTS stocktakes (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		category VARCHAR(30) NULL,
+		status ENUM('open', 'posted', 'cancelled') NOT NULL DEFAULT 'open',
+		opened_by VARCHAR(50) NULL,
+		opened_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		closed_by VARCHAR(50) NULL,
+		closed_at TIMESTAMP NULL,
+		INDEX idx_stocktakes_status (status, opened_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const stocktakeCountsTable = `
+	CREATE TABLE IF NOT EXISTS stocktake_counts (
+		stocktake_id BIGINT NOT NULL,
+		part_sku VARCHAR(64) NOT NULL,
+		counted INT NOT NULL,
+		book_quantity INT NOT NULL,
+		adjustment INT NULL,
+		counted_by VARCHAR(50) NULL,
+		counted_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (stocktake_id, part_sku),
+		FOREIGN KEY (stocktake_id) REFERENCES stocktakes(id) ON DELETE CASCADE,
+		FOREIGN KEY (part_sku) REFERENCES parts(sku)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// MovementStocktake is stock found or missing at a stocktake.
+const MovementStocktake = "stocktake"
+
+// Stocktake statuses
+const (
+	StocktakeOpen      = "open"
+	StocktakePosted    = "posted"
+	StocktakeCancelled = "cancelled"
+)
+
+var stocktakeStatuses = []string{StocktakeOpen, StocktakePosted, StocktakeCancelled}
+
+var (
+	errStocktakeClosed     = errors.New("the stocktake is no longer open")
+	errStocktakeCategory   = errors.New("the part is outside the stocktake's category")
+	errStocktakeNegative   = errors.New("a count cannot go below zero")
+	errStocktakeNotCounted = errors.New("the part has not been counted in this stocktake")
+)
+
+// Stocktake is a count session.
+type Stocktake struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Category   string     `json:"category,omitempty"` // Empty counts every category
+	Status     string     `json:"status"`
+	OpenedBy   string     `json:"opened_by,omitempty"`
+	OpenedAt   time.Time  `json:"opened_at"`
+	ClosedBy   string     `json:"closed_by,omitempty"`
+	ClosedAt   *time.Time `json:"closed_at,omitempty"` // Posted or cancelled
+	PartsCount int        `json:"parts_counted"`
+}
+
+// StocktakeLine is one counted part against the book.
+type StocktakeLine struct {
+	PartSKU       string `json:"part_sku"`
+	Name          string `json:"name"`
+	Book          int    `json:"book"` // Book quantity when counted
+	Counted       int    `json:"counted"`
+	Variance      int    `json:"variance"` // Counted less book
+	OnHand        int    `json:"on_hand"`  // Book quantity now
+	UnitCost      Money  `json:"unit_cost"`
+	VarianceValue Money  `json:"variance_value"`
+	Adjustment    *int   `json:"adjustment,omitempty"` // Posted to stock
+	CountedBy     string `json:"counted_by,omitempty"`
+}
+
+// StocktakeUncounted is a part in scope with stock that was not counted.
+type StocktakeUncounted struct {
+	PartSKU string `json:"part_sku"`
+	Name    string `json:"name"`
+	OnHand  int    `json:"on_hand"`
+}
+
+// StocktakeReport is a session's variance report.
+type StocktakeReport struct {
+	Stocktake     *Stocktake           `json:"stocktake"`
+	Lines         []StocktakeLine      `json:"lines"`
+	Uncounted     []StocktakeUncounted `json:"uncounted"`
+	NetVariance   int                  `json:"net_variance"`
+	VarianceValue Money                `json:"variance_value"`
+}
+
+// StocktakeService runs stocktakes
+type StocktakeService struct {
+	db *sql.DB
+}
+
+func NewStocktakeService(database *sql.DB) *StocktakeService {
+	return &StocktakeService{db: database}
+}
+
+var stocktakeService *StocktakeService
+
+const stocktakeColumns = `s.id, s.name, s.category, s.status, s.opened_by, s.opened_at, s.closed_by, s.closed_at,
+	(SELECT COUNT(*) FROM stocktake_counts c WHERE c.stocktake_id = s.id)`
+
+func scanStocktake(row rowScanner) (*Stocktake, error) {
+	var stocktake Stocktake
+	var category, openedBy, closedBy sql.NullString
+	var closedAt sql.NullTime
+	err := row.Scan(&stocktake.ID, &stocktake.Name, &category, &stocktake.Status, &openedBy, &stocktake.OpenedAt,
+		&closedBy, &closedAt, &stocktake.PartsCount)
+	if err != nil {
+		return nil, err
+	}
+	stocktake.ClosedAt = timePtr(closedAt)
+	stocktake.Category, stocktake.OpenedBy, stocktake.ClosedBy = category.String, openedBy.String, closedBy.String
+	return &stocktake, nil
+}
+
+// Open starts a count session.
+func (ss *StocktakeService) Open(name, category, actorID string) (*Stocktake, error) {
+	result, err := ss.db.Exec(`INSERT INTO stocktakes (name, category, opened_by) VALUES (?, ?, ?)`,
+		name, nullString(category), nullString(actorID))
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return ss.Get(id)
+}
+
+// Get returns a count session.
+func (ss *StocktakeService) Get(id int64) (*Stocktake, error) {
+	return scanStocktake(ss.db.QueryRow(`SELECT `+stocktakeColumns+` FROM stocktakes s WHERE s.id = ?`, id))
+}
+
+// List returns count sessions, newest first, optionally by status.
+func (ss *StocktakeService) List(status string) ([]Stocktake, error) {
+	query := `SELECT ` + stocktakeColumns + ` FROM stocktakes s`
+	var args []interface{}
+	if status != "" {
+		query += ` WHERE s.status = ?`
+		args = append(args, status)
+	}
+	rows, err := ss.db.Query(query+` ORDER BY s.opened_at DESC, s.id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stocktakes := []Stocktake{}
+	for rows.Next() {
+		stocktake, err := scanStocktake(rows)
+		if err != nil {
+			return nil, err
+		}
+		stocktakes = append(stocktakes, *stocktake)
+	}
+	return stocktakes, rows.Err()
+}
+
+// lockOpenStocktake locks a session for a change and returns its category.
+// Counts against one session are taken one at a time.
+func lockOpenStocktake(tx *sql.Tx, id int64) (string, error) {
+	var status string
+	var category sql.NullString
+	err := tx.QueryRow(`SELECT status, category FROM stocktakes WHERE id = ? FOR UPDATE`, id).Scan(&status, &category)
+	if err != nil {
+		return "", err
+	}
+	if status != StocktakeOpen {
+		return "", errStocktakeClosed
+	}
+	return category.String, nil
+}
+
+// Count records quantity of a part counted. It adds to the part's count,
+// or with set replaces it and takes the book quantity afresh.
+func (ss *StocktakeService) Count(id int64, sku string, quantity int, set bool, actorID string) (*StocktakeLine, error) {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	category, err := lockOpenStocktake(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	var partCategory string
+	var onHand int
+	err = tx.QueryRow(`SELECT category, quantity_on_hand FROM parts WHERE sku = ?`, sku).Scan(&partCategory, &onHand)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownPart
+	}
+	if err != nil {
+		return nil, err
+	}
+	if category != "" && partCategory != category {
+		return nil, errStocktakeCategory
+	}
+
+	update := `counted = counted + VALUES(counted)`
+	if set {
+		update = `counted = VALUES(counted), book_quantity = VALUES(book_quantity)`
+	}
+	_, err = tx.Exec(`
+		INSERT INTO stocktake_counts (stocktake_id, part_sku, counted, book_quantity, counted_by, counted_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE `+update+`, counted_by = VALUES(counted_by), counted_at = VALUES(counted_at)
+	`, id, sku, quantity, onHand, nullString(actorID))
+	if err != nil {
+		return nil, err
+	}
+
+	line, err := scanStocktakeLine(tx.QueryRow(`SELECT `+stocktakeLineColumns+` FROM stocktake_counts c
+		JOIN parts p ON p.sku = c.part_sku WHERE c.stocktake_id = ? AND c.part_sku = ?`, id, sku))
+	if err != nil {
+		return nil, err
+	}
+	if line.Counted < 0 {
+		return nil, errStocktakeNegative
+	}
+	return line, tx.Commit()
+}
+
+const stocktakeLineColumns = `c.part_sku, p.name, c.book_quantity, c.counted, p.quantity_on_hand, p.unit_cost, c.adjustment, c.counted_by`
+
+func scanStocktakeLine(row rowScanner) (*StocktakeLine, error) {
+	var line StocktakeLine
+	var adjustment sql.NullInt64
+	var countedBy sql.NullString
+	err := row.Scan(&line.PartSKU, &line.Name, &line.Book, &line.Counted, &line.OnHand, &line.UnitCost, &adjustment, &countedBy)
+	if err != nil {
+		return nil, err
+	}
+	line.Variance = line.Counted - line.Book
+	line.VarianceValue = Money(line.Variance) * line.UnitCost
+	if adjustment.Valid {
+		posted := int(adjustment.Int64)
+		line.Adjustment = &posted
+	}
+	line.CountedBy = countedBy.String
+	return &line, nil
+}
+
+// Report returns a session's variance report.
+func (ss *StocktakeService) Report(id int64) (*StocktakeReport, error) {
+	stocktake, err := ss.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	report := &StocktakeReport{Stocktake: stocktake, Lines: []StocktakeLine{}, Uncounted: []StocktakeUncounted{}}
+
+	rows, err := ss.db.Query(`SELECT `+stocktakeLineColumns+` FROM stocktake_counts c
+		JOIN parts p ON p.sku = c.part_sku WHERE c.stocktake_id = ? ORDER BY c.part_sku`, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		line, err := scanStocktakeLine(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.Lines = append(report.Lines, *line)
+		report.NetVariance += line.Variance
+		report.VarianceValue += line.VarianceValue
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT p.sku, p.name, p.quantity_on_hand FROM parts p
+		WHERE p.quantity_on_hand > 0
+		  AND NOT EXISTS (SELECT 1 FROM stocktake_counts c WHERE c.stocktake_id = ? AND c.part_sku = p.sku)`
+	args := []interface{}{id}
+	if stocktake.Category != "" {
+		query += ` AND p.category = ?`
+		args = append(args, stocktake.Category)
+	}
+	rows, err = ss.db.Query(query+` ORDER BY p.sku`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var part StocktakeUncounted
+		if err := rows.Scan(&part.PartSKU, &part.Name, &part.OnHand); err != nil {
+			return nil, err
+		}
+		report.Uncounted = append(report.Uncounted, part)
+	}
+	return report, rows.Err()
+}
+
+// Post applies the variances of the approved SKUs to stock and closes the
+// session, all in one transaction. A variance that would take stock below
+// zero (stock used since the count) takes it to zero.
+func (ss *StocktakeService) Post(id int64, skus []string, actorID string) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOpenStocktake(tx, id); err != nil {
+		return err
+	}
+	for _, sku := range skus {
+		var counted, book int
+		err := tx.QueryRow(`SELECT counted, book_quantity FROM stocktake_counts WHERE stocktake_id = ? AND part_sku = ?`,
+			id, sku).Scan(&counted, &book)
+		if err == sql.ErrNoRows {
+			return errStocktakeNotCounted
+		}
+		if err != nil {
+			return err
+		}
+
+		var onHand int
+		if err := tx.QueryRow(`SELECT quantity_on_hand FROM parts WHERE sku = ? FOR UPDATE`, sku).Scan(&onHand); err != nil {
+			return err
+		}
+		adjustment := max(counted-book, -onHand)
+		if adjustment != 0 {
+			if _, err := tx.Exec(`UPDATE parts SET quantity_on_hand = quantity_on_hand + ? WHERE sku = ?`, adjustment, sku); err != nil {
+				return err
+			}
+			movement := StockMovement{
+				PartSKU: sku, Quantity: adjustment, Reason: MovementStocktake,
+				Note: fmt.Sprintf("Stocktake %d", id), ActorID: actorID,
+			}
+			if adjustment > 0 {
+				err = recordStockMovement(tx, movement)
+			} else {
+				_, err = takeFromLots(tx, movement, "")
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE stocktake_counts SET adjustment = ? WHERE stocktake_id = ? AND part_sku = ?`,
+			adjustment, id, sku); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE stocktakes SET status = ?, closed_by = ?, closed_at = NOW() WHERE id = ?`,
+		StocktakePosted, nullString(actorID), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Cancel closes a session without changing stock.
+func (ss *StocktakeService) Cancel(id int64, actorID string) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOpenStocktake(tx, id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE stocktakes SET status = ?, closed_by = ?, closed_at = NOW() WHERE id = ?`,
+		StocktakeCancelled, nullString(actorID), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StocktakesHandler lists count sessions (GET ?status=) or opens one (POST
+// {"name": "Shelf B", "category": "memory"}).
+func StocktakesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		status := r.URL.Query().Get("status")
+		if status != "" && !slices.Contains(stocktakeStatuses, status) {
+			var fieldErrors ValidationErrors
+			fieldErrors.Add("status", "must be open, posted or cancelled")
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+		stocktakes, err := stocktakeService.List(status)
+		if err != nil {
+			log.Printf("Error listing stocktakes: %v", err)
+			http.Error(w, "Failed to retrieve stocktakes", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(stocktakes)
+
+	case "POST":
+		var request struct {
+			Name     string `json:"name"`
+			Category string `json:"category"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || len(request.Name) > 255 {
+			fieldErrors.Add("name", "is required and at most 255 characters")
+		}
+		if request.Category != "" && !slices.Contains(partCategories, request.Category) {
+			fieldErrors.Add("category", "must be one of cpu, motherboard, memory, gpu, storage, psu, case, cooler, other")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		stocktake, err := stocktakeService.Open(request.Name, request.Category, actorID(r))
+		if err != nil {
+			log.Printf("Error opening stocktake: %v", err)
+			http.Error(w, "Failed to open stocktake", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Stocktake %d opened by %s", stocktake.ID, actorID(r))
+		auditService.Record(r, AuditStocktakeOpened, "stocktake", strconv.FormatInt(stocktake.ID, 10), nil, stocktake)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(stocktake)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// StocktakeDetailHandler serves a count session: GET /{id} is the variance
+// report and DELETE /{id} cancels it, POST /{id}/counts records a count and
+// POST /{id}/post posts approved adjustments. Cancelling and posting are
+// for admins.
+func StocktakeDetailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/parts/stocktakes/")
+	path, action, _ := strings.Cut(path, "/")
+	id, err := strconv.ParseInt(path, 10, 64)
+	if err != nil || id <= 0 || strings.Contains(action, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "counts":
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stocktakeCount(w, r, id)
+	case "post":
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !hasRole(r, RoleAdmin) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		stocktakePost(w, r, id)
+	case "":
+		switch r.Method {
+		case "GET":
+			report, err := stocktakeService.Report(id)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Stocktake not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Error building variance report of stocktake %d: %v", id, err)
+				http.Error(w, "Failed to retrieve stocktake", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(report)
+		case "DELETE":
+			if !hasRole(r, RoleAdmin) {
+				http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+				return
+			}
+			stocktakeCancel(w, r, id)
+		default:
+			http.Error(w, "Only GET and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// stocktakeCount records a count. Built for barcode scanners: a scan posts
+// {"part_sku": "RAM-16-3200"} and counts one; "quantity" counts several,
+// or removes a misscan when negative, and "set": true replaces the count.
+func stocktakeCount(w http.ResponseWriter, r *http.Request, id int64) {
+	var request struct {
+		PartSKU  string `json:"part_sku"`
+		Quantity *int   `json:"quantity"`
+		Set      bool   `json:"set"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	request.PartSKU = strings.TrimSpace(request.PartSKU) // Scanners end with a newline
+	if request.PartSKU == "" {
+		fieldErrors.Add("part_sku", "is required")
+	}
+	quantity := 1
+	if request.Quantity != nil {
+		quantity = *request.Quantity
+	}
+	if request.Set && quantity < 0 {
+		fieldErrors.Add("quantity", "must not be negative")
+	} else if !request.Set && quantity == 0 {
+		fieldErrors.Add("quantity", "must not be zero")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	line, err := stocktakeService.Count(id, request.PartSKU, quantity, request.Set, actorID(r))
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Stocktake not found", http.StatusNotFound)
+		return
+	case err == errUnknownPart:
+		http.Error(w, "Part not found", http.StatusNotFound)
+		return
+	case err == errStocktakeClosed, err == errStocktakeCategory, err == errStocktakeNegative:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Error counting %s in stocktake %d: %v", request.PartSKU, id, err)
+		http.Error(w, "Failed to record count", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(line)
+}
+
+// stocktakePost posts the variances of the counted parts listed in
+// {"part_skus": [...]} and closes the stocktake.
+func stocktakePost(w http.ResponseWriter, r *http.Request, id int64) {
+	var request struct {
+		PartSKUs []string `json:"part_skus"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	before, err := stocktakeService.Report(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Stocktake not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error building variance report of stocktake %d: %v", id, err)
+		http.Error(w, "Failed to post stocktake", http.StatusInternalServerError)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	counted := map[string]bool{}
+	for _, line := range before.Lines {
+		counted[line.PartSKU] = true
+	}
+	for _, sku := range request.PartSKUs {
+		if !counted[sku] {
+			fieldErrors.Add("part_skus", sku+" was not counted in this stocktake")
+		}
+	}
+	slices.Sort(request.PartSKUs)
+	request.PartSKUs = slices.Compact(request.PartSKUs)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err = stocktakeService.Post(id, request.PartSKUs, actorID(r))
+	switch {
+	case err == errStocktakeClosed, err == errStocktakeNotCounted:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Error posting stocktake %d: %v", id, err)
+		http.Error(w, "Failed to post stocktake", http.StatusInternalServerError)
+		return
+	}
+
+	report, err := stocktakeService.Report(id)
+	if err != nil {
+		log.Printf("Error building variance report of stocktake %d: %v", id, err)
+		http.Error(w, "Failed to retrieve stocktake", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Stocktake %d posted by %s (%d parts adjusted)", id, actorID(r), len(request.PartSKUs))
+	auditService.Record(r, AuditStocktakePosted, "stocktake", strconv.FormatInt(id, 10), before, report)
+	json.NewEncoder(w).Encode(report)
+}
+
+// stocktakeCancel closes a stocktake without changing stock.
+func stocktakeCancel(w http.ResponseWriter, r *http.Request, id int64) {
+	err := stocktakeService.Cancel(id, actorID(r))
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Stocktake not found", http.StatusNotFound)
+		return
+	case err == errStocktakeClosed:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Error cancelling stocktake %d: %v", id, err)
+		http.Error(w, "Failed to cancel stocktake", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stocktake %d cancelled by %s", id, actorID(r))
+	auditService.Record(r, AuditStocktakeCancelled, "stocktake", strconv.FormatInt(id, 10), nil, nil)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Stocktake cancelled successfully",
+	})
+}
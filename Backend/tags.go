@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Tags are free-form labels on tickets ("water-damage", "data-recovery",
+// "rush"). They are stored lower-case with spaces turned into hyphens, so
+// "Water Damage" and "water-damage" are one tag. Tags can be given at
+// intake and added or removed later; ticket lists (?tag=) and the summary
+// and ticket reports filter by them, and /api/v1/tags completes tag names
+// from the ones in use. Tags are labels rather than ticket history, so they
+// are kept outside the event stream.
+
+const ticketTagsTable = `
+	CREATE TABLE IF NOT EXISTS ticket_tags (
+		order_id VARCHAR(50) NOT NULL,
+		tag VARCHAR(40) NOT NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (order_id, tag),
+		INDEX idx_ticket_tags_tag (tag),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// maxTicketTags keeps tags to labels rather than notes.
+const maxTicketTags = 20
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// normalizeTags cleans up tags given in field, dropping duplicates. Invalid
+// tags are recorded in fieldErrors.
+func normalizeTags(field string, tags []string, fieldErrors *ValidationErrors) []string {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+		if !tagPattern.MatchString(tag) {
+			fieldErrors.Add(field, fmt.Sprintf("%q must be 1-40 letters, digits or hyphens", tag))
+			continue
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTicketTags {
+		fieldErrors.Add(field, fmt.Sprintf("at most %d tags fit on one ticket", maxTicketTags))
+	}
+	return normalized
+}
+
+// tagsWhere returns a condition, starting with " AND ", matching tickets in
+// column that carry every one of tags, and its arguments.
+func tagsWhere(column string, tags []string) (string, []interface{}) {
+	var where string
+	var args []interface{}
+	for _, tag := range tags {
+		where += ` AND ` + column + ` IN (SELECT order_id FROM ticket_tags WHERE tag = ?)`
+		args = append(args, tag)
+	}
+	return where, args
+}
+
+// insertTicketTags adds tags to a ticket in tx; tags it already has are
+// left alone.
+func insertTicketTags(tx execer, orderID string, tags []string, actorID string) error {
+	for _, tag := range tags {
+		_, err := tx.Exec(`INSERT IGNORE INTO ticket_tags (order_id, tag, created_by) VALUES (?, ?, ?)`,
+			orderID, tag, nullString(actorID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTags fills in the tags of orders.
+func (os *OrderService) loadTags(orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	index := make(map[string]int, len(orders))
+	ids := make([]string, len(orders))
+	for i := range orders {
+		index[orders[i].ID] = i
+		ids[i] = orders[i].ID
+		orders[i].Tags = []string{}
+	}
+
+	return forEachIDBatch(ids, func(placeholders string, args []interface{}) error {
+		rows, err := os.db.Query(`
+			SELECT order_id, tag FROM ticket_tags
+			WHERE order_id IN (`+placeholders+`)
+			ORDER BY order_id, tag
+		`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var orderID, tag string
+			if err := rows.Scan(&orderID, &tag); err != nil {
+				return err
+			}
+			order := &orders[index[orderID]]
+			order.Tags = append(order.Tags, tag)
+		}
+		return rows.Err()
+	})
+}
+
+// TagTicket adds tags to a ticket and returns its tags.
+func (os *OrderService) TagTicket(orderID string, tags []string, actorID string) ([]string, error) {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := os.lockOrderStatus(tx, orderID); err != nil {
+		return nil, err
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM ticket_tags WHERE order_id = ?`, orderID).Scan(&count); err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		var exists int
+		err := tx.QueryRow(`SELECT 1 FROM ticket_tags WHERE order_id = ? AND tag = ?`, orderID, tag).Scan(&exists)
+		if err == sql.ErrNoRows {
+			count++
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if count > maxTicketTags {
+		return nil, errTooManyTags
+	}
+	if err := insertTicketTags(tx, orderID, tags, actorID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return os.ticketTags(orderID)
+}
+
+// UntagTicket removes a tag from a ticket. A tag the ticket does not have
+// returns sql.ErrNoRows.
+func (os *OrderService) UntagTicket(orderID, tag string) error {
+	result, err := os.db.Exec(`DELETE FROM ticket_tags WHERE order_id = ? AND tag = ?`, orderID, tag)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (os *OrderService) ticketTags(orderID string) ([]string, error) {
+	orders := []Order{{ID: orderID}}
+	if err := os.loadTags(orders); err != nil {
+		return nil, err
+	}
+	return orders[0].Tags, nil
+}
+
+var errTooManyTags = fmt.Errorf("at most %d tags fit on one ticket", maxTicketTags)
+
+// TagCount is a tag in use with the number of tickets carrying it.
+type TagCount struct {
+	Tag     string `json:"tag"`
+	Tickets int    `json:"tickets"`
+}
+
+// SuggestTags returns the tags starting with prefix, most used first. The
+// prefix must already be normalized, so it holds no LIKE wildcards.
+func (os *OrderService) SuggestTags(prefix string, limit int) ([]TagCount, error) {
+	rows, err := os.db.Query(`
+		SELECT tag, COUNT(*) AS tickets FROM ticket_tags WHERE tag LIKE ?
+		GROUP BY tag ORDER BY tickets DESC, tag LIMIT ?
+	`, prefix+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Tag, &tag.Tickets); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// orderTags lists a ticket's tags (GET), adds tags (POST {"tags": ["rush"]})
+// or removes one (DELETE ?tag=).
+func orderTags(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		if _, err := orderService.GetOrder(orderID); err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error retrieving order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve tags", http.StatusInternalServerError)
+			return
+		}
+		tags, err := orderService.ticketTags(orderID)
+		if err != nil {
+			log.Printf("Error retrieving tags of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve tags", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id": orderID,
+			"tags":     tags,
+		})
+
+	case "POST":
+		if !hasPermission(r, PermTicketsEdit) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		var request struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		request.Tags = normalizeTags("tags", request.Tags, &fieldErrors)
+		if len(request.Tags) == 0 && len(fieldErrors) == 0 {
+			fieldErrors.Add("tags", "is required")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		tags, err := orderService.TagTicket(orderID, request.Tags, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errTooManyTags {
+			writeValidationErrors(w, ValidationErrors{{Field: "tags", Message: err.Error()}})
+			return
+		}
+		if err != nil {
+			log.Printf("Error tagging order %s: %v", orderID, err)
+			http.Error(w, "Failed to tag order", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditTicketTagged, "order", orderID, nil, request)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Order tagged successfully",
+			"tags":    tags,
+		})
+
+	case "DELETE":
+		if !hasPermission(r, PermTicketsEdit) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		var fieldErrors ValidationErrors
+		tags := normalizeTags("tag", []string{r.URL.Query().Get("tag")}, &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		err := orderService.UntagTicket(orderID, tags[0])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order does not carry this tag", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error untagging order %s: %v", orderID, err)
+			http.Error(w, "Failed to untag order", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditTicketUntagged, "order", orderID, map[string]string{"tag": tags[0]}, nil)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Tag removed successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TagsHandler completes tag names (GET ?prefix=wa&limit=10) from the tags
+// in use, most used first.
+func TagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	prefix := strings.Join(strings.Fields(strings.ToLower(r.URL.Query().Get("prefix"))), "-")
+	if prefix != "" && !tagPattern.MatchString(prefix) {
+		json.NewEncoder(w).Encode([]TagCount{})
+		return
+	}
+
+	tags, err := orderService.SuggestTags(prefix, limit)
+	if err != nil {
+		log.Printf("Error suggesting tags for %q: %v", prefix, err)
+		http.Error(w, "Failed to retrieve tags", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tags)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Before a high-value phone or laptop is booked in, its serial or IMEI can be
+// checked against a stolen-device registry (THEFT_CHECK_API_URL; the check
+// is off when it is unset). Every check is kept in device_theft_checks
+// against the serial and, once the ticket exists, its order. A registry hit
+// blocks intake unless a user with tickets.theft_override books the device
+// in anyway with a reason. A registry that cannot be reached does not block
+// intake; the check is recorded as an error.
+
+const deviceTheftChecksTable = `
+	CREATE TABLE IF NOT EXISTS device_theft_checks (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NULL,
+		serial VARCHAR(100) NOT NULL,
+		result ENUM('clear', 'stolen', 'error') NOT NULL,
+		reference VARCHAR(100) NULL,
+		source VARCHAR(100) NULL,
+		checked_by VARCHAR(50) NULL,
+		checked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		overridden_by VARCHAR(50) NULL,
+		override_reason VARCHAR(500) NULL,
+		INDEX idx_device_theft_checks_serial (serial, checked_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Theft check results
+const (
+	TheftCheckClear  = "clear"
+	TheftCheckStolen = "stolen"
+	TheftCheckError  = "error" // The registry could not be reached
+)
+
+// TheftCheck is the registry's answer for one device serial.
+type TheftCheck struct {
+	ID             int64     `json:"id"`
+	OrderID        string    `json:"order_id,omitempty"`
+	Serial         string    `json:"serial"`
+	Result         string    `json:"result"`
+	Reference      string    `json:"reference,omitempty"` // The registry's report number
+	Source         string    `json:"source,omitempty"`
+	CheckedBy      string    `json:"checked_by,omitempty"`
+	CheckedAt      time.Time `json:"checked_at"`
+	OverriddenBy   string    `json:"overridden_by,omitempty"`
+	OverrideReason string    `json:"override_reason,omitempty"`
+}
+
+// TheftCheckConfig decides which devices are checked. An empty DeviceTypes
+// list covers every device type.
+type TheftCheckConfig struct {
+	APIURL      string
+	APIKey      string
+	DeviceTypes []string
+	MinValue    Money // Devices declared below this value are not checked
+}
+
+// getTheftCheckConfig reads the THEFT_CHECK_* environment variables.
+func getTheftCheckConfig() (TheftCheckConfig, error) {
+	config := TheftCheckConfig{
+		APIURL:      getEnv("THEFT_CHECK_API_URL", ""),
+		APIKey:      getEnv("THEFT_CHECK_API_KEY", ""),
+		DeviceTypes: splitList(getEnv("THEFT_CHECK_DEVICE_TYPES", "Phone,Laptop")),
+	}
+	minValue, err := ParseMoney(getEnv("THEFT_CHECK_MIN_VALUE", "0"))
+	if err != nil || minValue < 0 {
+		return config, fmt.Errorf("THEFT_CHECK_MIN_VALUE must be a non-negative amount")
+	}
+	config.MinValue = minValue
+	return config, nil
+}
+
+// StolenDeviceRegistry looks a serial or IMEI up in a stolen-device registry.
+type StolenDeviceRegistry interface {
+	Check(serial string) (TheftCheck, error)
+}
+
+// httpStolenDeviceRegistry queries GET {url}?serial= and reads
+// {"stolen": true, "reference": "...", "source": "..."}.
+type httpStolenDeviceRegistry struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (hr *httpStolenDeviceRegistry) Check(serial string) (TheftCheck, error) {
+	check := TheftCheck{Serial: serial}
+	req, err := http.NewRequest("GET", hr.url+"?serial="+url.QueryEscape(serial), nil)
+	if err != nil {
+		return check, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if hr.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+hr.apiKey)
+	}
+
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return check, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return check, fmt.Errorf("theft registry returned %s", resp.Status)
+	}
+
+	var result struct {
+		Stolen    bool   `json:"stolen"`
+		Reference string `json:"reference"`
+		Source    string `json:"source"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return check, fmt.Errorf("theft registry response: %w", err)
+	}
+	check.Result = TheftCheckClear
+	if result.Stolen {
+		check.Result = TheftCheckStolen
+	}
+	check.Reference = truncate(result.Reference, 100)
+	check.Source = truncate(result.Source, 100)
+	return check, nil
+}
+
+// TheftCheckService screens devices at intake and keeps the check results
+type TheftCheckService struct {
+	db       *sql.DB
+	registry StolenDeviceRegistry // nil when checks are off
+	config   TheftCheckConfig
+}
+
+func NewTheftCheckService(database *sql.DB, config TheftCheckConfig) *TheftCheckService {
+	service := &TheftCheckService{db: database, config: config}
+	if config.APIURL != "" {
+		service.registry = &httpStolenDeviceRegistry{
+			url:    config.APIURL,
+			apiKey: config.APIKey,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return service
+}
+
+// Applies reports whether a device must be checked. A device without a
+// declared value is checked.
+func (ts *TheftCheckService) Applies(device OrderDevice, deviceValue *Money) bool {
+	if ts.registry == nil || strings.TrimSpace(device.DeviceSerial) == "" {
+		return false
+	}
+	if len(ts.config.DeviceTypes) > 0 && !containsFold(ts.config.DeviceTypes, device.DeviceType) {
+		return false
+	}
+	return deviceValue == nil || *deviceValue >= ts.config.MinValue
+}
+
+// Check asks the registry about a device. A registry failure is logged and
+// returned as an error result.
+func (ts *TheftCheckService) Check(serial, actorID string) *TheftCheck {
+	check, err := ts.registry.Check(strings.TrimSpace(serial))
+	if err != nil {
+		log.Printf("Error checking %s against the theft registry: %v", serial, err)
+		check.Result = TheftCheckError
+	}
+	check.CheckedBy = actorID
+	check.CheckedAt = time.Now()
+	return &check
+}
+
+// insertTheftCheck stores a check inside the ticket's creation transaction.
+func insertTheftCheck(tx execer, orderID string, check *TheftCheck) error {
+	_, err := tx.Exec(`
+		INSERT INTO device_theft_checks (order_id, serial, result, reference, source, checked_by, checked_at, overridden_by, override_reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, nullString(orderID), truncate(check.Serial, 100), check.Result, nullString(check.Reference), nullString(check.Source),
+		nullString(check.CheckedBy), check.CheckedAt, nullString(check.OverriddenBy), nullString(check.OverrideReason))
+	return err
+}
+
+// RecordBlocked stores a hit that stopped an intake, before any ticket exists.
+func (ts *TheftCheckService) RecordBlocked(check *TheftCheck) error {
+	return insertTheftCheck(ts.db, "", check)
+}
+
+// ChecksForSerial lists the checks of a device, newest first.
+func (ts *TheftCheckService) ChecksForSerial(serial string) ([]TheftCheck, error) {
+	return ts.queryChecks(`
+		SELECT id, order_id, serial, result, reference, source, checked_by, checked_at, overridden_by, override_reason
+		FROM device_theft_checks WHERE serial = ? ORDER BY checked_at DESC, id DESC
+	`, serial)
+}
+
+// CheckForOrder returns the check made when a ticket was booked in, or nil.
+func (ts *TheftCheckService) CheckForOrder(orderID string) (*TheftCheck, error) {
+	checks, err := ts.queryChecks(`
+		SELECT id, order_id, serial, result, reference, source, checked_by, checked_at, overridden_by, override_reason
+		FROM device_theft_checks WHERE order_id = ? ORDER BY id DESC LIMIT 1
+	`, orderID)
+	if err != nil || len(checks) == 0 {
+		return nil, err
+	}
+	return &checks[0], nil
+}
+
+func (ts *TheftCheckService) queryChecks(query string, args ...interface{}) ([]TheftCheck, error) {
+	rows, err := ts.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := []TheftCheck{}
+	for rows.Next() {
+		var check TheftCheck
+		var orderID, reference, source, checkedBy, overriddenBy, overrideReason sql.NullString
+		if err := rows.Scan(&check.ID, &orderID, &check.Serial, &check.Result, &reference, &source, &checkedBy,
+			&check.CheckedAt, &overriddenBy, &overrideReason); err != nil {
+			return nil, err
+		}
+		check.OrderID = orderID.String
+		check.Reference = reference.String
+		check.Source = source.String
+		check.CheckedBy = checkedBy.String
+		check.OverriddenBy = overriddenBy.String
+		check.OverrideReason = overrideReason.String
+		checks = append(checks, check)
+	}
+	return checks, rows.Err()
+}
+
+var theftCheckService *TheftCheckService
+
+// screenIntakeDevices runs the theft check for every device being booked in
+// and attaches the results to the order. A hit without an authorised
+// override writes the refusal and returns false.
+func screenIntakeDevices(w http.ResponseWriter, r *http.Request, order *Order, deviceValue *Money, overrideReason string) bool {
+	overrideReason = strings.TrimSpace(overrideReason)
+	order.TheftChecks = nil
+	var screened []string
+	for _, device := range intakeDevices(order) {
+		serial := strings.TrimSpace(device.DeviceSerial)
+		if slices.Contains(screened, serial) || !theftCheckService.Applies(device, deviceValue) {
+			continue
+		}
+		screened = append(screened, serial)
+
+		check := theftCheckService.Check(serial, actorID(r))
+		if check.Result == TheftCheckStolen {
+			if overrideReason != "" && !hasPermission(r, PermTheftOverride) {
+				http.Error(w, "You do not have permission to override a theft check", http.StatusForbidden)
+				return false
+			}
+			if overrideReason == "" {
+				if err := theftCheckService.RecordBlocked(check); err != nil {
+					log.Printf("Error recording theft check for %s: %v", check.Serial, err)
+				}
+				log.Printf("Intake of %s blocked: reported stolen (%s)", check.Serial, check.Reference)
+				auditService.Record(r, AuditTheftCheckBlocked, "device", check.Serial, nil, check)
+				http.Error(w, fmt.Sprintf("Device %s is reported stolen (reference %s); intake needs a manager override with theft_override_reason",
+					check.Serial, check.Reference), http.StatusConflict)
+				return false
+			}
+			check.OverriddenBy = actorID(r)
+			check.OverrideReason = truncate(overrideReason, 500)
+		}
+		order.TheftChecks = append(order.TheftChecks, check)
+	}
+	return true
+}
+
+// TheftChecksHandler lists the theft checks made for a device (GET
+// ?serial=).
+func TheftChecksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serial := r.URL.Query().Get("serial")
+	if serial == "" {
+		http.Error(w, "serial is required", http.StatusBadRequest)
+		return
+	}
+	checks, err := theftCheckService.ChecksForSerial(serial)
+	if err != nil {
+		log.Printf("Error retrieving theft checks for %s: %v", serial, err)
+		http.Error(w, "Failed to retrieve theft checks", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(checks)
+}
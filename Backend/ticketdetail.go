@@ -0,0 +1,501 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The ticket detail screen loads everything about one ticket in a single
+// request: the order row for the current state, its event stream for line
+// items (in their invoice sections), payments and status history, and the
+// assigned engineer.
+
+// TicketCustomer is the customer block of a ticket detail.
+type TicketCustomer struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+	// EmailFlag is set when the customer's address bounced or complained
+	EmailFlag *EmailFlag `json:"email_flag,omitempty"`
+}
+
+// TicketDevice is the device block of a ticket detail.
+type TicketDevice struct {
+	Type              string `json:"type"`
+	Model             string `json:"model,omitempty"`
+	Serial            string `json:"serial,omitempty"`
+	Password          string `json:"password,omitempty"`
+	DataBackupConsent string `json:"data_backup_consent,omitempty"`
+}
+
+// TicketLineItem is a billed line: the intake quote or an added item. Its ID
+// is the version of the event that added it.
+type TicketLineItem struct {
+	ID           int       `json:"id"`
+	Section      string    `json:"section"`
+	Description  string    `json:"description"`
+	Amount       Money     `json:"amount"`
+	WarrantyKind string    `json:"warranty_kind,omitempty"`
+	WarrantyDays int       `json:"warranty_days,omitempty"` // As added: 0 for the default, -1 for none
+	PartSKU      string    `json:"part_sku,omitempty"`      // A stocked part (ticketparts.go)
+	Quantity     int       `json:"quantity,omitempty"`
+	PartCost     Money     `json:"-"` // Shown with the margin to those who see revenue
+	CostID       int64     `json:"-"` // The ticket_costs row of the part cost
+	AddedBy      string    `json:"added_by,omitempty"`
+	AddedAt      time.Time `json:"added_at"`
+}
+
+// TicketStatusChange is one step of the ticket's status history.
+type TicketStatusChange struct {
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	ChangedBy string    `json:"changed_by,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// TicketPayment is money received against the ticket.
+type TicketPayment struct {
+	Amount     Money     `json:"amount"`
+	Method     string    `json:"method"`
+	Reference  string    `json:"reference,omitempty"`
+	RecordedBy string    `json:"recorded_by,omitempty"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// TicketEngineer is the engineer a ticket is assigned to.
+type TicketEngineer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// TicketFinancials summarises what the ticket costs and what is still owed.
+type TicketFinancials struct {
+	Total        Money           `json:"total"`
+	InvoiceTotal Money           `json:"invoice_total"` // Total rounded per the tax jurisdiction
+	AmountPaid   Money           `json:"amount_paid"`
+	Balance      Money           `json:"balance"`
+	Payments     []TicketPayment `json:"payments"`
+}
+
+// TicketDetail is the complete ticket returned by GET /api/v1/orders/{id}.
+type TicketDetail struct {
+	ID                   string               `json:"id"`
+	Status               string               `json:"status"`
+	TicketType           string               `json:"ticket_type,omitempty"`
+	Services             []string             `json:"services"`
+	IssueDescription     string               `json:"issue_description,omitempty"`
+	Customer             TicketCustomer       `json:"customer"`
+	Device               TicketDevice         `json:"device"`  // Primary device
+	Devices              []OrderDevice        `json:"devices"` // Every device on the ticket
+	CustomFields         CustomFieldValues    `json:"custom_fields"`
+	LineItems            []TicketLineItem     `json:"line_items"`
+	StatusHistory        []TicketStatusChange `json:"status_history"`
+	AssignedEngineer     *TicketEngineer      `json:"assigned_engineer"`
+	Financials           TicketFinancials     `json:"financials"`
+	ExpectedDeliveryDate *time.Time           `json:"expected_delivery_date,omitempty"`
+	WarrantyExpDate      *time.Time           `json:"warranty_exp_date,omitempty"`
+	WarrantyClaimOf      string               `json:"warranty_claim_of,omitempty"`
+	CancelledAt          *time.Time           `json:"cancelled_at,omitempty"`
+	CancelReason         string               `json:"cancel_reason,omitempty"`
+	MergedInto           string               `json:"merged_into,omitempty"`
+	MergedFrom           []string             `json:"merged_from,omitempty"` // Duplicates merged into this ticket
+	SplitFrom            string               `json:"split_from,omitempty"`
+	SplitInto            []string             `json:"split_into,omitempty"`       // Tickets split off this one
+	Escalations          []TicketEscalation   `json:"escalations,omitempty"`      // Escalations by rule (escalation.go)
+	TimesRescheduled     int                  `json:"times_rescheduled"`          // Delivery date moves (reschedule.go)
+	LaborHours           float64              `json:"labor_hours"`                // Logged bench time and on-site visits (timetracking.go)
+	ParentTicketID       string               `json:"parent_ticket_id,omitempty"` // Collected ticket this one reworks
+	AccountID            int64                `json:"account_id,omitempty"`       // Corporate account (accounts.go)
+	ReworkTickets        []string             `json:"rework_tickets,omitempty"`   // Rework tickets booked against this one
+	Hold                 *TicketHold          `json:"hold,omitempty"`             // Current hold, if any
+	Signatures           []TicketSignature    `json:"signatures"`                 // Without their images (signatures.go)
+	Watchers             []TicketWatcher      `json:"watchers"`                   // Staff notified of its changes (watchers.go)
+	Checklist            []DeviceChecklist    `json:"checklist"`                  // Intake and delivery checks (checklists.go)
+	Diagnosis            *DiagnosticReport    `json:"diagnosis,omitempty"`        // Latest version, published or not (diagnosis.go)
+	LegalHold            *LegalHold           `json:"legal_hold,omitempty"`
+	Snooze               *TicketSnooze        `json:"snooze,omitempty"` // The signed-in user's snooze (snooze.go)
+	CreatedBy            string               `json:"created_by,omitempty"`
+	CreatedAt            time.Time            `json:"created_at"`
+	UpdatedAt            time.Time            `json:"updated_at"`
+}
+
+// GetTicketDetail assembles the detail of a ticket whose order row has
+// already been loaded (and masked for the caller).
+func (os *OrderService) GetTicketDetail(order *Order) (*TicketDetail, error) {
+	events, err := os.events.Load(order.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &TicketDetail{
+		ID:               order.ID,
+		Status:           order.Status,
+		TicketType:       order.TicketType,
+		Services:         order.Services,
+		IssueDescription: order.IssueDescription,
+		Customer: TicketCustomer{
+			Name:  order.CustomerName,
+			Email: order.CustomerEmail,
+			Phone: order.CustomerPhone,
+		},
+		Device: TicketDevice{
+			Type:              order.DeviceType,
+			Model:             order.DeviceModel,
+			Serial:            order.DeviceSerial,
+			Password:          order.DevicePassword,
+			DataBackupConsent: order.DataBackupConsent,
+		},
+		Devices:              order.Devices,
+		CustomFields:         order.CustomFields,
+		StatusHistory:        []TicketStatusChange{},
+		ExpectedDeliveryDate: order.ExpectedDeliveryDate,
+		WarrantyExpDate:      order.WarrantyExpDate,
+		WarrantyClaimOf:      order.WarrantyClaimOf,
+		CancelledAt:          order.DeletedAt,
+		CancelReason:         order.CancelReason,
+		MergedInto:           order.MergedInto,
+		SplitFrom:            order.SplitFrom,
+		ParentTicketID:       order.ParentTicketID,
+		AccountID:            order.AccountID,
+		CreatedBy:            order.CreatedBy,
+		CreatedAt:            order.CreatedAt,
+		UpdatedAt:            order.UpdatedAt,
+	}
+	detail.Financials.Payments = []TicketPayment{}
+	if detail.LineItems, err = ticketLineItems(events); err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		switch event.Type {
+		case EventTicketCreated:
+			var created Order
+			if err := json.Unmarshal(event.Payload, &created); err != nil {
+				return nil, err
+			}
+			detail.StatusHistory = append(detail.StatusHistory, TicketStatusChange{
+				To: created.Status, ChangedBy: event.ActorID, ChangedAt: event.OccurredAt,
+			})
+
+		case EventStatusChanged:
+			var change StatusChangedPayload
+			if err := json.Unmarshal(event.Payload, &change); err != nil {
+				return nil, err
+			}
+			detail.StatusHistory = append(detail.StatusHistory, TicketStatusChange{
+				From: change.From, To: change.To, ChangedBy: event.ActorID, ChangedAt: event.OccurredAt,
+			})
+
+		case EventTicketCancelled:
+			var cancelled TicketCancelledPayload
+			if err := json.Unmarshal(event.Payload, &cancelled); err != nil {
+				return nil, err
+			}
+			detail.StatusHistory = append(detail.StatusHistory, TicketStatusChange{
+				From: cancelled.From, To: StatusCancelled, ChangedBy: event.ActorID, ChangedAt: event.OccurredAt,
+			})
+
+		case EventTicketReopened:
+			var reopened TicketReopenedPayload
+			if err := json.Unmarshal(event.Payload, &reopened); err != nil {
+				return nil, err
+			}
+			detail.StatusHistory = append(detail.StatusHistory, TicketStatusChange{
+				From: reopened.From, To: StatusReopened, ChangedBy: event.ActorID, ChangedAt: event.OccurredAt,
+			})
+
+		case EventTicketMerged:
+			var merged TicketMergedPayload
+			if err := json.Unmarshal(event.Payload, &merged); err != nil {
+				return nil, err
+			}
+			detail.MergedFrom = append(detail.MergedFrom, merged.SourceID)
+
+		case EventTicketSplit:
+			var split TicketSplitPayload
+			if err := json.Unmarshal(event.Payload, &split); err != nil {
+				return nil, err
+			}
+			detail.SplitInto = append(detail.SplitInto, split.NewTicketID)
+
+		case EventTicketEscalated:
+			var escalation TicketEscalation
+			if err := json.Unmarshal(event.Payload, &escalation.TicketEscalatedPayload); err != nil {
+				return nil, err
+			}
+			escalation.EscalatedAt = event.OccurredAt
+			detail.Escalations = append(detail.Escalations, escalation)
+
+		case EventDeliveryRescheduled:
+			detail.TimesRescheduled++
+
+		case EventPaymentRecorded:
+			var payment PaymentRecordedPayload
+			if err := json.Unmarshal(event.Payload, &payment); err != nil {
+				return nil, err
+			}
+			detail.Financials.Payments = append(detail.Financials.Payments, TicketPayment{
+				Amount: payment.Amount, Method: payment.Method, Reference: payment.Reference,
+				RecordedBy: event.ActorID, RecordedAt: event.OccurredAt,
+			})
+		}
+	}
+
+	detail.Financials.Total = order.TotalCost
+	detail.Financials.InvoiceTotal = order.TotalCost.RoundForInvoice(activeRoundingRule())
+	detail.Financials.AmountPaid = order.AmountPaid
+	detail.Financials.Balance = detail.Financials.InvoiceTotal - order.AmountPaid
+
+	// The order may be masked, so the flag is matched on the stored address
+	var flag EmailFlag
+	var flagDetail sql.NullString
+	err = os.db.QueryRow(`
+		SELECT f.reason, f.detail, f.flagged_at FROM orders o
+		JOIN email_flags f ON f.email_key = LOWER(TRIM(o.customer_email))
+		WHERE o.id = ?
+	`, order.ID).Scan(&flag.Reason, &flagDetail, &flag.FlaggedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		flag.Email = order.CustomerEmail
+		flag.Detail = flagDetail.String
+		detail.Customer.EmailFlag = &flag
+	}
+
+	if order.HoldState != "" && order.HoldStartedAt != nil {
+		detail.Hold = &TicketHold{
+			HoldState: order.HoldState,
+			Reason:    order.HoldReason,
+			StartedAt: *order.HoldStartedAt,
+			Hours:     time.Since(*order.HoldStartedAt).Hours(),
+			Customer:  slices.Contains(customerHoldStates, order.HoldState),
+		}
+	}
+
+	if detail.LegalHold, err = legalHoldService.Active(order.ID); err != nil {
+		return nil, err
+	}
+	if detail.ReworkTickets, err = os.reworkTickets(order.ID); err != nil {
+		return nil, err
+	}
+	if detail.Signatures, err = signatureService.List(order.ID, false); err != nil {
+		return nil, err
+	}
+	if detail.Watchers, err = watcherService.Watchers(order.ID); err != nil {
+		return nil, err
+	}
+	laborMinutes, err := ticketLaborMinutes(os.db, order.ID)
+	if err != nil {
+		return nil, err
+	}
+	detail.LaborHours = laborHours(laborMinutes)
+	if detail.Checklist, err = checklistService.ForOrder(order); err != nil {
+		return nil, err
+	}
+	if detail.Diagnosis, err = diagnosisService.Latest(order.ID); err != nil {
+		return nil, err
+	}
+
+	if order.AssignedEngineerID != "" {
+		engineer := TicketEngineer{ID: order.AssignedEngineerID}
+		err := os.db.QueryRow(`SELECT full_name, email FROM users WHERE id = ?`, engineer.ID).
+			Scan(&engineer.Name, &engineer.Email)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		detail.AssignedEngineer = &engineer
+	}
+
+	return detail, nil
+}
+
+// OrderDetailHandler returns one ticket with its customer, device, line
+// items, status history, engineer and financial summary (GET), edits its
+// details (PATCH) or cancels it (DELETE) at /api/v1/orders/{id}, serves
+// its status timeline at /api/v1/orders/{id}/history, reassigns it at
+// /api/v1/orders/{id}/assign, holds it at /api/v1/orders/{id}/holds, tags it
+// at /api/v1/orders/{id}/tags and merges or splits it at
+// /api/v1/orders/{id}/merge and /split, reopens it at
+// /api/v1/orders/{id}/reopen, takes signatures at
+// /api/v1/orders/{id}/signatures, records device checks at
+// /api/v1/orders/{id}/checklist, keeps the engineer's diagnosis at
+// /api/v1/orders/{id}/diagnosis, keeps voice notes at
+// /api/v1/orders/{id}/voice-notes, moves its delivery date at
+// /api/v1/orders/{id}/delivery-date, snoozes it for the signed-in user at
+// /api/v1/orders/{id}/snooze, watches it at /api/v1/orders/{id}/watch,
+// bills stocked parts at /api/v1/orders/{id}/parts, logs time at /api/v1/orders/{id}/time and /timer/start and /timer/stop,
+// records the customer's rating at
+// /api/v1/orders/{id}/rating and exports its case file at
+// /api/v1/orders/{id}/case-file.
+func OrderDetailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	orderID := strings.TrimPrefix(r.URL.Path, "/api/v1/orders/")
+	if id, found := strings.CutSuffix(orderID, "/history"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "GET" {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		getOrderHistory(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/assign"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "PUT" {
+			http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		assignOrder(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/holds"); found && id != "" && !strings.Contains(id, "/") {
+		orderHolds(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/tags"); found && id != "" && !strings.Contains(id, "/") {
+		orderTags(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/merge"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mergeOrder(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/split"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		splitOrder(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/reopen"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reopenOrder(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/signatures"); found && id != "" && !strings.Contains(id, "/") {
+		orderSignatures(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/diagnosis"); found && id != "" && !strings.Contains(id, "/") {
+		orderDiagnosis(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/diagnosis/publish"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		publishDiagnosis(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/checklist"); found && id != "" && !strings.Contains(id, "/") {
+		orderChecklist(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/voice-notes"); found && id != "" && !strings.Contains(id, "/") {
+		orderVoiceNotes(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/delivery-date"); found && id != "" && !strings.Contains(id, "/") {
+		orderDeliveryDate(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/snooze"); found && id != "" && !strings.Contains(id, "/") {
+		orderSnooze(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/watch"); found && id != "" && !strings.Contains(id, "/") {
+		orderWatch(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/parts"); found && id != "" && !strings.Contains(id, "/") {
+		orderParts(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/time"); found && id != "" && !strings.Contains(id, "/") {
+		orderTime(w, r, id)
+		return
+	}
+	for _, action := range []string{"start", "stop"} {
+		if id, found := strings.CutSuffix(orderID, "/timer/"+action); found && id != "" && !strings.Contains(id, "/") {
+			orderTimer(w, r, id, action)
+			return
+		}
+	}
+	if id, found := strings.CutSuffix(orderID, "/rating"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rateOrder(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(orderID, "/case-file"); found && id != "" && !strings.Contains(id, "/") {
+		if r.Method != "GET" {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		getOrderCaseFile(w, r, id)
+		return
+	}
+	if orderID == "" || strings.Contains(orderID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		getOrderDetail(w, r, orderID)
+	case "PATCH":
+		editOrder(w, r, orderID)
+	case "DELETE":
+		cancelOrder(w, r, orderID)
+	default:
+		http.Error(w, "Only GET, PATCH and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getOrderDetail serves GET /api/v1/orders/{id}.
+func getOrderDetail(w http.ResponseWriter, r *http.Request, orderID string) {
+
+	order, err := orderService.GetOrder(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order", http.StatusInternalServerError)
+		return
+	}
+	piiPolicyFor(r).shapeOrder(order)
+
+	detail, err := orderService.GetTicketDetail(order)
+	if err != nil {
+		log.Printf("Error assembling detail of order %s: %v", orderID, err)
+		http.Error(w, "Failed to retrieve order", http.StatusInternalServerError)
+		return
+	}
+	if userID := actorID(r); userID != "" {
+		if detail.Snooze, err = snoozeService.Get(orderID, userID); err != nil {
+			log.Printf("Error retrieving snooze of order %s for %s: %v", orderID, userID, err)
+			http.Error(w, "Failed to retrieve order", http.StatusInternalServerError)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(detail)
+}
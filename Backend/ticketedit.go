@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Tickets can be corrected after intake. Each edit is a TicketEdited event
+// holding the before and after value of every changed field, so the event
+// stream shows who changed what and when. Status, prices and payments keep
+// their own endpoints; device passwords never enter the event stream and
+// cannot be edited here. Custom field values (customfields.go) of the ticket
+// and its primary device are edited as "custom_fields" and
+// "device_custom_fields" objects and recorded per field. The expected
+// delivery date is moved with a reason instead (reschedule.go), and tickets
+// are reassigned at /assign (assignment.go).
+
+// editableOrderFields are the fields PATCH /api/v1/orders/{id} may change,
+// with their orders column.
+var editableOrderFields = []struct {
+	Field    string
+	Column   string
+	MaxLen   int
+	Date     bool
+	Required bool
+	Choices  []string // Allowed values, when limited
+}{
+	{Field: "issue_description", Column: "issue_description", MaxLen: 5000},
+	{Field: "warranty_exp_date", Column: "warranty_exp_date", Date: true},
+	{Field: "warranty_claim_of", Column: "warranty_claim_of", MaxLen: 50},
+	{Field: "device_type", Column: "device_type", MaxLen: 255, Required: true},
+	{Field: "device_model", Column: "device_model", MaxLen: 255},
+	{Field: "device_serial", Column: "device_serial", MaxLen: 100},
+	{Field: "priority", Column: "priority", MaxLen: 10, Required: true, Choices: orderPriorities},
+}
+
+// assignedEngineerField is recorded as a TicketEdited change like the
+// fields above, but only PUT /api/v1/orders/{id}/assign changes it
+// (assignment.go), which needs tickets.assign and an open ticket.
+const assignedEngineerField = "assigned_engineer_id"
+
+// editColumn returns the orders column a TicketEdited field is written to.
+func editColumn(field string) (string, bool) {
+	if field == assignedEngineerField {
+		return "assigned_engineer_id", true
+	}
+	for _, editable := range editableOrderFields {
+		if editable.Field == field {
+			return editable.Column, true
+		}
+	}
+	return "", false
+}
+
+var errNoTicketChanges = errors.New("the edit does not change the ticket")
+
+// FieldChange is the value of a field before and after an edit; nil is an
+// empty field.
+type FieldChange struct {
+	From *string `json:"from"`
+	To   *string `json:"to"`
+}
+
+// TicketEditedPayload records the fields changed by one edit.
+type TicketEditedPayload struct {
+	Changes map[string]FieldChange `json:"changes"`
+}
+
+// orderFieldValue returns the current value of an editable field.
+func orderFieldValue(order *Order, field string) *string {
+	var value string
+	if key, found := strings.CutPrefix(field, ticketCustomFieldsPrefix); found {
+		value = order.CustomFields[key]
+	} else if key, found := strings.CutPrefix(field, deviceCustomFieldsPrefix); found && len(order.Devices) > 0 {
+		value = order.Devices[0].CustomFields[key]
+	}
+	switch field {
+	case "issue_description":
+		value = order.IssueDescription
+	case assignedEngineerField:
+		value = order.AssignedEngineerID
+	case "warranty_exp_date":
+		if order.WarrantyExpDate != nil {
+			value = order.WarrantyExpDate.Format("2006-01-02")
+		}
+	case "warranty_claim_of":
+		value = order.WarrantyClaimOf
+	case "device_type":
+		value = order.DeviceType
+	case "device_model":
+		value = order.DeviceModel
+	case "device_serial":
+		value = order.DeviceSerial
+	case "priority":
+		value = order.Priority
+	}
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// EditOrder applies edits (field to new value, nil to clear) and records
+// the fields that actually changed.
+func (os *OrderService) EditOrder(orderID string, edits map[string]*string, actorID string) (*TicketEditedPayload, error) {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE id = ? FOR UPDATE`, orderID))
+	if err != nil {
+		return nil, err
+	}
+	orders := []Order{*order}
+	if err := os.loadDevices(orders); err != nil {
+		return nil, err
+	}
+	if err := os.loadCustomFields(orders); err != nil {
+		return nil, err
+	}
+	order = &orders[0]
+
+	payload := &TicketEditedPayload{Changes: map[string]FieldChange{}}
+	for field, to := range edits {
+		from := orderFieldValue(order, field)
+		if (from == nil && to == nil) || (from != nil && to != nil && *from == *to) {
+			continue
+		}
+		payload.Changes[field] = FieldChange{From: from, To: to}
+	}
+	if len(payload.Changes) == 0 {
+		return nil, errNoTicketChanges
+	}
+
+	if _, err := os.events.Append(tx, orderID, EventTicketEdited, actorID, payload); err != nil {
+		return nil, err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return nil, err
+	}
+	return payload, tx.Commit()
+}
+
+// projectTicketEdit writes a TicketEdited event's new values to the orders
+// row. Only known fields are applied.
+func projectTicketEdit(tx *sql.Tx, event *TicketEvent) error {
+	var payload TicketEditedPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	var fields []string
+	for field := range payload.Changes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	query := `UPDATE orders SET updated_at = ?, last_updated_by = NULLIF(?, '')`
+	args := []interface{}{event.OccurredAt, event.ActorID}
+	for _, field := range fields {
+		column, ok := editColumn(field)
+		if !ok {
+			continue
+		}
+		query += ", " + column + " = ?"
+		if to := payload.Changes[field].To; to != nil {
+			args = append(args, *to)
+		} else {
+			args = append(args, nil)
+		}
+	}
+	_, err := tx.Exec(query+` WHERE id = ?`, append(args, event.TicketID)...)
+	return err
+}
+
+// parseTicketEdits validates a PATCH body into field edits.
+func parseTicketEdits(body map[string]json.RawMessage, fieldErrors *ValidationErrors) map[string]*string {
+	edits := map[string]*string{}
+	for field, raw := range body {
+		known := false
+		for _, editable := range editableOrderFields {
+			if editable.Field != field {
+				continue
+			}
+			known = true
+
+			var value *string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				fieldErrors.Add(field, "must be a string or null")
+				break
+			}
+			if value != nil {
+				trimmed := strings.TrimSpace(*value)
+				value = &trimmed
+				if trimmed == "" {
+					value = nil
+				}
+			}
+
+			switch {
+			case value == nil && editable.Required:
+				fieldErrors.Add(field, "cannot be cleared")
+			case value != nil && editable.Date:
+				if date := parseDateField(field, *value, fieldErrors); date != nil {
+					formatted := date.Format("2006-01-02")
+					value = &formatted
+				}
+			case value != nil && editable.Choices != nil && !slices.Contains(editable.Choices, *value):
+				fieldErrors.Add(field, "must be one of "+strings.Join(editable.Choices, ", "))
+			case value != nil && len(*value) > editable.MaxLen:
+				fieldErrors.Add(field, "is too long")
+			}
+			edits[field] = value
+		}
+		if !known {
+			fieldErrors.Add(field, "cannot be edited")
+		}
+	}
+	return edits
+}
+
+// validateTicketReferences checks that an assigned engineer and a warranty
+// claim point at records that exist, and that the engineer holds any
+// certification the ticket's type requires.
+func validateTicketReferences(orderID string, edits map[string]*string, fieldErrors *ValidationErrors) error {
+	if engineerID := edits[assignedEngineerField]; engineerID != nil {
+		var role string
+		err := db.QueryRow(`SELECT role FROM users WHERE id = ?`, *engineerID).Scan(&role)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == sql.ErrNoRows || normalizeRole(role) != RoleEngineer {
+			fieldErrors.Add(assignedEngineerField, "must be an engineer")
+		} else {
+			var ticketType sql.NullString
+			if err := db.QueryRow(`SELECT ticket_type FROM orders WHERE id = ?`, orderID).Scan(&ticketType); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if err := checkEngineerCertification(db, *engineerID, ticketType.String, assignedEngineerField, fieldErrors); err != nil {
+				return err
+			}
+		}
+	}
+	if claimOf := edits["warranty_claim_of"]; claimOf != nil {
+		var exists, claims int
+		err := db.QueryRow(`SELECT COUNT(*), COUNT(warranty_claim_of) FROM orders WHERE id = ?`, *claimOf).Scan(&exists, &claims)
+		if err != nil {
+			return err
+		}
+		if exists == 0 || *claimOf == orderID {
+			fieldErrors.Add("warranty_claim_of", "must be another existing order")
+		} else if claims > 0 {
+			fieldErrors.Add("warranty_claim_of", "must be the original repair, not a warranty ticket")
+		}
+	}
+	return nil
+}
+
+// editOrder serves PATCH /api/v1/orders/{id}.
+func editOrder(w http.ResponseWriter, r *http.Request, orderID string) {
+	if !hasPermission(r, PermTicketsEdit) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if len(body) == 0 {
+		fieldErrors.Add("body", "must contain at least one field to change")
+	}
+	customEdits, err := parseCustomFieldEdits(body, &fieldErrors)
+	if err != nil {
+		log.Printf("Error validating custom fields of order %s: %v", orderID, err)
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+	edits := parseTicketEdits(body, &fieldErrors)
+	for field, value := range customEdits {
+		edits[field] = value
+	}
+	if err := validateTicketReferences(orderID, edits, &fieldErrors); err != nil {
+		log.Printf("Error validating edit of order %s: %v", orderID, err)
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	payload, err := orderService.EditOrder(orderID, edits, actorID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err == errNoTicketChanges {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "No changes",
+			"changes": map[string]FieldChange{},
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error editing order %s: %v", orderID, err)
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+
+	auditService.Record(r, AuditTicketEdited, "order", orderID, nil, payload)
+	piiPolicyFor(r).shapeTicketEdit(payload)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Order updated successfully",
+		"changes": payload.Changes,
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Stocked parts are billed on a ticket at /api/v1/orders/{id}/parts. One
+// transaction takes the parts out of stock at their weighted average cost
+// (costing.go), records that as the ticket's part cost and adds the billed
+// line item in the Parts section at the part's selling price, so the
+// ticket total, the stock count and the profitability can never disagree.
+// The line item keeps what the parts cost, which gives each part line its
+// margin; margins are shown to those who see revenue.
+
+// TicketPartLine is a stocked part billed on a ticket with its margin.
+type TicketPartLine struct {
+	ItemID      int    `json:"item_id"` // The line item
+	PartSKU     string `json:"part_sku"`
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	Amount      Money  `json:"amount"` // Billed
+	Cost        Money  `json:"cost"`   // From stock
+	Margin      Money  `json:"margin"`
+	MarginBps   *int64 `json:"margin_bps"` // Margin as basis points of the amount; null when billed at nothing
+}
+
+// TicketParts is the stocked parts billed on a ticket.
+type TicketParts struct {
+	OrderID   string           `json:"order_id"`
+	Parts     []TicketPartLine `json:"parts"`
+	Amount    Money            `json:"amount"`
+	Cost      Money            `json:"cost"`
+	Margin    Money            `json:"margin"`
+	MarginBps *int64           `json:"margin_bps"`
+}
+
+// marginBps is margin as basis points of amount, or nil without an amount.
+func marginBps(margin, amount Money) *int64 {
+	if amount <= 0 {
+		return nil
+	}
+	bps := int64(margin) * 10000 / int64(amount)
+	return &bps
+}
+
+// TicketPartRequest bills a stocked part on a ticket.
+type TicketPartRequest struct {
+	PartSKU      string `json:"part_sku"`
+	Quantity     int    `json:"quantity"`
+	UnitPrice    *Money `json:"unit_price"`    // Defaults to the part's selling price
+	PartSerial   string `json:"part_serial"`   // Serial of the part fitted, for recalls
+	PartLot      string `json:"part_lot"`      // Supplier lot to take it from
+	WarrantyDays int    `json:"warranty_days"` // As for line items
+}
+
+// AddPart bills a stocked part on a ticket, taking it from stock and
+// recording its cost in the same transaction. It returns the line item.
+func (os *OrderService) AddPart(orderID string, request TicketPartRequest, actorID string) (*TicketLineItem, error) {
+	tx, err := os.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	status, err := os.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if status == closedStatus || status == StatusCancelled {
+		return nil, &StatusGuardError{Reason: fmt.Sprintf("parts can't be added to a %s ticket", status)}
+	}
+
+	var name string
+	var unitPrice Money
+	err = tx.QueryRow(`SELECT name, unit_price FROM parts WHERE sku = ?`, request.PartSKU).Scan(&name, &unitPrice)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownPart
+	}
+	if err != nil {
+		return nil, err
+	}
+	if request.UnitPrice != nil {
+		unitPrice = *request.UnitPrice
+	}
+
+	cost := TicketCost{
+		OrderID: orderID, Kind: CostPart, Description: name, PartSKU: request.PartSKU, PartSerial: request.PartSerial,
+		PartLot: request.PartLot, Quantity: request.Quantity, RecordedBy: actorID,
+	}
+	if err := profitabilityService.recordCost(tx, &cost); err != nil {
+		return nil, err
+	}
+
+	item := ItemAddedPayload{
+		Description:  fmt.Sprintf("%s x%d", name, request.Quantity),
+		Amount:       unitPrice * Money(request.Quantity),
+		WarrantyKind: WarrantyParts,
+		WarrantyDays: request.WarrantyDays,
+		Section:      SectionParts,
+		PartSKU:      request.PartSKU,
+		Quantity:     request.Quantity,
+		PartCost:     cost.Amount,
+		CostID:       cost.ID,
+	}
+	event, err := os.events.Append(tx, orderID, EventItemAdded, actorID, item)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrationService.DualWrite(tx, "orders", orderID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &TicketLineItem{
+		ID: event.Version, Section: item.Section, Description: item.Description, Amount: item.Amount,
+		WarrantyKind: item.WarrantyKind, WarrantyDays: item.WarrantyDays, PartSKU: item.PartSKU, Quantity: item.Quantity,
+		PartCost: item.PartCost, CostID: item.CostID, AddedBy: actorID, AddedAt: event.OccurredAt,
+	}, nil
+}
+
+// Parts returns the stocked parts billed on a ticket with their margins.
+func (os *OrderService) Parts(orderID string) (*TicketParts, error) {
+	if err := checkOrderExists(os.db, orderID); err != nil {
+		return nil, err
+	}
+	events, err := os.events.Load(orderID)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ticketLineItems(events)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := &TicketParts{OrderID: orderID, Parts: []TicketPartLine{}}
+	for _, item := range items {
+		if item.PartSKU == "" {
+			continue
+		}
+		line := ticketPartLine(item)
+		parts.Parts = append(parts.Parts, line)
+		parts.Amount += line.Amount
+		parts.Cost += line.Cost
+	}
+	parts.Margin = parts.Amount - parts.Cost
+	parts.MarginBps = marginBps(parts.Margin, parts.Amount)
+	return parts, nil
+}
+
+func ticketPartLine(item TicketLineItem) TicketPartLine {
+	line := TicketPartLine{
+		ItemID: item.ID, PartSKU: item.PartSKU, Description: item.Description, Quantity: item.Quantity,
+		Amount: item.Amount, Cost: item.PartCost, Margin: item.Amount - item.PartCost,
+	}
+	line.MarginBps = marginBps(line.Margin, line.Amount)
+	return line
+}
+
+// orderParts lists the stocked parts billed on a ticket with their margins
+// (GET, needs reports.view_revenue) or bills one (POST {"part_sku":
+// "RAM-16-3200", "quantity": 2}, needs tickets.update_price; "unit_price"
+// overrides the part's selling price).
+func orderParts(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		if !hasPermission(r, PermReportsViewRevenue) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		parts, err := orderService.Parts(orderID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrieving parts of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve parts", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(parts)
+
+	case "POST":
+		if !hasPermission(r, PermTicketsUpdatePrice) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request TicketPartRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if request.Quantity == 0 {
+			request.Quantity = 1
+		}
+
+		var fieldErrors ValidationErrors
+		request.PartSKU = strings.TrimSpace(request.PartSKU)
+		if request.PartSKU == "" {
+			fieldErrors.Add("part_sku", "is required")
+		}
+		if request.Quantity < 1 {
+			fieldErrors.Add("quantity", "must be positive")
+		}
+		if request.UnitPrice != nil && *request.UnitPrice < 0 {
+			fieldErrors.Add("unit_price", "must not be negative")
+		}
+		request.PartSerial = strings.TrimSpace(request.PartSerial)
+		if len(request.PartSerial) > 100 {
+			fieldErrors.Add("part_serial", "must be at most 100 characters")
+		}
+		request.PartLot = strings.TrimSpace(request.PartLot)
+		if request.WarrantyDays < noWarranty {
+			fieldErrors.Add("warranty_days", "must be -1 (none), 0 (default) or positive")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		item, err := orderService.AddPart(orderID, request, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err == errUnknownPart {
+			writeValidationErrors(w, ValidationErrors{{Field: "part_sku", Message: err.Error()}})
+			return
+		}
+		if err == errPartOutOfStock || err == errLotInsufficient {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if guardErr, ok := err.(*StatusGuardError); ok {
+			http.Error(w, guardErr.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error adding part %s to order %s: %v", request.PartSKU, orderID, err)
+			http.Error(w, "Failed to add part", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("%d x %s billed on order %s by %s", item.Quantity, item.PartSKU, orderID, actorID(r))
+		auditService.Record(r, AuditTicketPartAdded, "order", orderID, nil, request)
+		w.WriteHeader(http.StatusCreated)
+		if hasPermission(r, PermReportsViewRevenue) {
+			json.NewEncoder(w).Encode(ticketPartLine(*item))
+			return
+		}
+		json.NewEncoder(w).Encode(item)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
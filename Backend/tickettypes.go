@@ -0,0 +1,316 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deposit rules a ticket type can ask for at intake.
+const (
+	DepositNone    = "none"
+	DepositFixed   = "fixed"   // DepositAmount up front
+	DepositPercent = "percent" // DepositBasisPoints of the quoted total
+)
+
+// defaultTicketType is used when intake does not name one.
+const defaultTicketType = "service"
+
+const ticketTypesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_types (
+		code VARCHAR(50) PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		sla_hours INT NOT NULL DEFAULT 0,
+		deposit_rule ENUM('none', 'fixed', 'percent') NOT NULL DEFAULT 'none',
+		deposit_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+		deposit_basis_points INT NOT NULL DEFAULT 0,
+		questionnaire JSON NULL,
+		required_fields JSON NULL,
+		required_certification VARCHAR(100) NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		updated_by VARCHAR(50) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// ticketTypeSeedStatements install the stock ticket types once; admin edits
+// are never overwritten.
+var ticketTypeSeedStatements = []string{
+	`INSERT IGNORE INTO ticket_types (code, name, sla_hours, deposit_rule, deposit_amount, deposit_basis_points, questionnaire) VALUES
+		('diagnostics', 'Diagnostics', 48, 'fixed', 500.00, 0, JSON_ARRAY('What symptoms do you see?', 'When did the problem start?')),
+		('service', 'Service', 72, 'none', 0, 0, JSON_ARRAY('What work do you need done?')),
+		('onsite_visit', 'On-site Visit', 24, 'fixed', 1000.00, 0, JSON_ARRAY('Site address', 'Preferred visit window', 'Parking or access instructions')),
+		('remote_support', 'Remote Support', 8, 'none', 0, 0, JSON_ARRAY('Remote access tool available?', 'Operating system')),
+		('build_to_order', 'Build-to-order PC', 240, 'percent', 0, 5000, JSON_ARRAY('Intended use', 'Budget', 'Preferred components')),
+		('rework', 'Rework', 24, 'none', 0, 0, JSON_ARRAY('What is happening again?', 'Was the original fault fixed when collected?'))`,
+}
+
+// TicketType holds the per-type intake defaults.
+type TicketType struct {
+	Code                  string    `json:"code"`
+	Name                  string    `json:"name"`
+	SLAHours              int       `json:"sla_hours"`
+	DepositRule           string    `json:"deposit_rule"`
+	DepositAmount         Money     `json:"deposit_amount"`
+	DepositBasisPoints    int64     `json:"deposit_basis_points"`
+	Questionnaire         []string  `json:"questionnaire"`
+	RequiredFields        []string  `json:"required_fields"`                  // Intake fields this type makes mandatory
+	RequiredCertification string    `json:"required_certification,omitempty"` // Engineers assigned its tickets must hold it (certifications.go)
+	Active                bool      `json:"active"`
+	UpdatedBy             string    `json:"updated_by,omitempty"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+// RequiredDeposit returns the deposit this type asks for on a ticket quoted
+// at total.
+func (tt *TicketType) RequiredDeposit(total Money) Money {
+	switch tt.DepositRule {
+	case DepositFixed:
+		return tt.DepositAmount
+	case DepositPercent:
+		return total.MulBasisPoints(tt.DepositBasisPoints, activeRoundingRule())
+	}
+	return 0
+}
+
+// requirableIntakeFields are the optional intake fields a ticket type can
+// make mandatory, with how to tell one was given.
+var requirableIntakeFields = map[string]func(order *Order) bool{
+	"device_model":           func(order *Order) bool { return strings.TrimSpace(order.DeviceModel) != "" },
+	"device_serial":          func(order *Order) bool { return strings.TrimSpace(order.DeviceSerial) != "" },
+	"issue_description":      func(order *Order) bool { return strings.TrimSpace(order.IssueDescription) != "" },
+	"device_password":        func(order *Order) bool { return order.DevicePassword != "" },
+	"data_backup_consent":    func(order *Order) bool { return order.DataBackupConsent != "" },
+	"expected_delivery_date": func(order *Order) bool { return order.ExpectedDeliveryDate != nil },
+	"assigned_engineer_id":   func(order *Order) bool { return order.AssignedEngineerID != "" },
+	"services":               func(order *Order) bool { return len(order.Services) > 0 },
+}
+
+// requirableIntakeFieldNames lists requirableIntakeFields for messages.
+func requirableIntakeFieldNames() string {
+	names := make([]string, 0, len(requirableIntakeFields))
+	for name := range requirableIntakeFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// checkRequiredFields records a field error for each field this type
+// requires that intake left empty.
+func (tt *TicketType) checkRequiredFields(order *Order, fieldErrors *ValidationErrors) {
+	for _, field := range tt.RequiredFields {
+		if present, known := requirableIntakeFields[field]; known && !present(order) {
+			fieldErrors.Add(field, "is required for "+tt.Name+" tickets")
+		}
+	}
+}
+
+// TicketTypeService handles ticket type database operations
+type TicketTypeService struct {
+	db *sql.DB
+}
+
+func NewTicketTypeService(database *sql.DB) *TicketTypeService {
+	return &TicketTypeService{db: database}
+}
+
+const ticketTypeColumns = `code, name, sla_hours, deposit_rule, deposit_amount, deposit_basis_points,
+	questionnaire, required_fields, required_certification, active, updated_by, updated_at`
+
+func scanTicketType(row rowScanner) (*TicketType, error) {
+	var tt TicketType
+	var questionnaire, requiredFields, requiredCertification, updatedBy sql.NullString
+	err := row.Scan(&tt.Code, &tt.Name, &tt.SLAHours, &tt.DepositRule, &tt.DepositAmount,
+		&tt.DepositBasisPoints, &questionnaire, &requiredFields, &requiredCertification, &tt.Active, &updatedBy, &tt.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	tt.Questionnaire = []string{}
+	if questionnaire.Valid {
+		if err := json.Unmarshal([]byte(questionnaire.String), &tt.Questionnaire); err != nil {
+			return nil, err
+		}
+	}
+	tt.RequiredFields = []string{}
+	if requiredFields.Valid {
+		if err := json.Unmarshal([]byte(requiredFields.String), &tt.RequiredFields); err != nil {
+			return nil, err
+		}
+	}
+	tt.RequiredCertification = requiredCertification.String
+	tt.UpdatedBy = updatedBy.String
+	return &tt, nil
+}
+
+func (ts *TicketTypeService) GetTicketType(code string) (*TicketType, error) {
+	return scanTicketType(ts.db.QueryRow(`SELECT `+ticketTypeColumns+` FROM ticket_types WHERE code = ?`, code))
+}
+
+func (ts *TicketTypeService) ListTicketTypes(includeInactive bool) ([]TicketType, error) {
+	query := `SELECT ` + ticketTypeColumns + ` FROM ticket_types`
+	if !includeInactive {
+		query += ` WHERE active`
+	}
+	rows, err := ts.db.Query(query + ` ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := []TicketType{}
+	for rows.Next() {
+		tt, err := scanTicketType(rows)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, *tt)
+	}
+	return types, rows.Err()
+}
+
+// SaveTicketType creates a ticket type or replaces an existing one.
+func (ts *TicketTypeService) SaveTicketType(tt *TicketType, actorID string) error {
+	questionnaire, err := json.Marshal(tt.Questionnaire)
+	if err != nil {
+		return err
+	}
+	requiredFields, err := json.Marshal(tt.RequiredFields)
+	if err != nil {
+		return err
+	}
+
+	_, err = ts.db.Exec(`
+		INSERT INTO ticket_types (code, name, sla_hours, deposit_rule, deposit_amount, deposit_basis_points,
+		                          questionnaire, required_fields, required_certification, active, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE name = VALUES(name), sla_hours = VALUES(sla_hours),
+			deposit_rule = VALUES(deposit_rule), deposit_amount = VALUES(deposit_amount),
+			deposit_basis_points = VALUES(deposit_basis_points), questionnaire = VALUES(questionnaire),
+			required_fields = VALUES(required_fields), required_certification = VALUES(required_certification),
+			active = VALUES(active), updated_by = VALUES(updated_by)
+	`, tt.Code, tt.Name, tt.SLAHours, tt.DepositRule, tt.DepositAmount, tt.DepositBasisPoints,
+		string(questionnaire), string(requiredFields), nullString(tt.RequiredCertification), tt.Active, nullString(actorID))
+	return err
+}
+
+var ticketTypeService *TicketTypeService
+
+// TicketTypesHandler lists the active ticket types offered at intake.
+func TicketTypesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	types, err := ticketTypeService.ListTicketTypes(false)
+	if err != nil {
+		log.Printf("Error listing ticket types: %v", err)
+		http.Error(w, "Failed to retrieve ticket types", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(types)
+}
+
+// AdminTicketTypesHandler lists every ticket type (GET) or creates/updates
+// one (PUT).
+func AdminTicketTypesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		types, err := ticketTypeService.ListTicketTypes(true)
+		if err != nil {
+			log.Printf("Error listing ticket types: %v", err)
+			http.Error(w, "Failed to retrieve ticket types", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(types)
+
+	case "PUT":
+		// Active defaults to true so new types are offered straight away
+		var request struct {
+			TicketType
+			Active *bool `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		tt := request.TicketType
+		tt.Active = request.Active == nil || *request.Active
+
+		var fieldErrors ValidationErrors
+		if tt.Code == "" || len(tt.Code) > 50 {
+			fieldErrors.Add("code", "is required and at most 50 characters")
+		}
+		if tt.Name == "" {
+			fieldErrors.Add("name", "is required")
+		}
+		if tt.SLAHours < 0 {
+			fieldErrors.Add("sla_hours", "must not be negative")
+		}
+		switch tt.DepositRule {
+		case "":
+			tt.DepositRule = DepositNone
+		case DepositNone:
+		case DepositFixed:
+			if tt.DepositAmount <= 0 {
+				fieldErrors.Add("deposit_amount", "must be greater than zero for a fixed deposit")
+			}
+		case DepositPercent:
+			if tt.DepositBasisPoints <= 0 || tt.DepositBasisPoints > 10000 {
+				fieldErrors.Add("deposit_basis_points", "must be between 1 and 10000 for a percentage deposit")
+			}
+		default:
+			fieldErrors.Add("deposit_rule", "must be one of none, fixed, percent")
+		}
+		for _, field := range tt.RequiredFields {
+			if _, known := requirableIntakeFields[field]; !known {
+				fieldErrors.Add("required_fields", field+" is not an intake field that can be required ("+requirableIntakeFieldNames()+")")
+			}
+		}
+		tt.RequiredCertification = strings.TrimSpace(tt.RequiredCertification)
+		if len(tt.RequiredCertification) > 100 {
+			fieldErrors.Add("required_certification", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+		if tt.Questionnaire == nil {
+			tt.Questionnaire = []string{}
+		}
+		sort.Strings(tt.RequiredFields)
+		tt.RequiredFields = slices.Compact(tt.RequiredFields)
+
+		previous, err := ticketTypeService.GetTicketType(tt.Code)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error loading ticket type %s: %v", tt.Code, err)
+			http.Error(w, "Failed to save ticket type", http.StatusInternalServerError)
+			return
+		}
+
+		if err := ticketTypeService.SaveTicketType(&tt, actorID(r)); err != nil {
+			log.Printf("Error saving ticket type %s: %v", tt.Code, err)
+			http.Error(w, "Failed to save ticket type", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Ticket type %s saved by %s", tt.Code, actorID(r))
+		auditService.Record(r, AuditTicketTypeSave, "ticket_type", tt.Code, previous, tt)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Ticket type saved successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Engineers log their time on a ticket with a timer or by hand. Starting a
+// timer on a ticket stops the one the engineer had running elsewhere, so
+// switching jobs is one tap; stopping it records the time as a labor cost
+// (profitability.go) in the engineer's name. Time not caught by a timer is
+// entered by hand. A timer left running more than timerMaxDuration has to
+// be stopped with the minutes actually worked. The ticket detail shows its
+// total labor hours, bench time and on-site visits together, and
+// GET /api/v1/reports/utilization compares each engineer's logged hours
+// with the hours they were available.
+
+const ticketTimersTable = `
+	CREATE TABLE IF NOT EXISTS ticket_timers (
+		user_id VARCHAR(50) PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		note VARCHAR(255) NULL,
+		started_at TIMESTAMP NOT NULL,
+		INDEX idx_ticket_timers_order (order_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// timerMaxDuration is how long a timer can run before stopping it needs the
+// minutes actually worked.
+const timerMaxDuration = 12 * time.Hour
+
+var (
+	errTimerRunning = errors.New("your timer is already running on this ticket")
+	errNoTimer      = errors.New("you have no timer running on this ticket")
+	errTimerTooLong = fmt.Errorf("the timer ran for more than %d hours; give the minutes actually worked", int(timerMaxDuration.Hours()))
+)
+
+// TicketTimer is an engineer's running timer.
+type TicketTimer struct {
+	EngineerID     string    `json:"engineer_id"`
+	EngineerName   string    `json:"engineer_name,omitempty"`
+	OrderID        string    `json:"order_id"`
+	Note           string    `json:"note,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	ElapsedMinutes int       `json:"elapsed_minutes"`
+}
+
+// TimeService runs engineers' ticket timers
+type TimeService struct {
+	db *sql.DB
+}
+
+func NewTimeService(database *sql.DB) *TimeService {
+	return &TimeService{db: database}
+}
+
+var timeService *TimeService
+
+// ticketLaborMinutes is the time logged on a ticket: labor costs plus
+// completed on-site visits.
+func ticketLaborMinutes(q rowQuerier, orderID string) (int, error) {
+	var minutes int
+	err := q.QueryRow(`
+		SELECT COALESCE((SELECT SUM(minutes) FROM ticket_costs WHERE order_id = ? AND kind = 'labor'), 0)
+		     + COALESCE((SELECT SUM(TIMESTAMPDIFF(MINUTE, check_in_at, check_out_at)) FROM onsite_visits
+		                 WHERE order_id = ? AND status = 'completed'), 0)
+	`, orderID, orderID).Scan(&minutes)
+	return minutes, err
+}
+
+// laborHours converts minutes to hours, to two decimals.
+func laborHours(minutes int) float64 {
+	return math.Round(float64(minutes)/60*100) / 100
+}
+
+// Timers returns the timers running on orderID.
+func (ts *TimeService) Timers(orderID string) ([]TicketTimer, error) {
+	rows, err := ts.db.Query(`
+		SELECT t.user_id, u.full_name, t.order_id, COALESCE(t.note, ''), t.started_at
+		FROM ticket_timers t JOIN users u ON u.id = t.user_id
+		WHERE t.order_id = ?
+		ORDER BY t.started_at
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	timers := []TicketTimer{}
+	for rows.Next() {
+		var timer TicketTimer
+		if err := rows.Scan(&timer.EngineerID, &timer.EngineerName, &timer.OrderID, &timer.Note, &timer.StartedAt); err != nil {
+			return nil, err
+		}
+		timer.ElapsedMinutes = int(now.Sub(timer.StartedAt).Minutes())
+		timers = append(timers, timer)
+	}
+	return timers, rows.Err()
+}
+
+// Start starts userID's timer on an open ticket. A timer they had running
+// on another ticket is stopped and its labor cost returned.
+func (ts *TimeService) Start(orderID, userID, note string) (*TicketCost, error) {
+	tx, err := ts.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	status, err := orderService.lockOrderStatus(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if status == closedStatus || status == StatusCancelled {
+		return nil, &StatusGuardError{Reason: fmt.Sprintf("time can't be logged on a %s ticket", status)}
+	}
+
+	var stopped *TicketCost
+	var running TicketTimer
+	err = tx.QueryRow(`SELECT order_id, COALESCE(note, ''), started_at FROM ticket_timers WHERE user_id = ? FOR UPDATE`, userID).
+		Scan(&running.OrderID, &running.Note, &running.StartedAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	case running.OrderID == orderID:
+		return nil, errTimerRunning
+	default:
+		running.EngineerID = userID
+		if stopped, err = ts.stop(tx, &running, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO ticket_timers (user_id, order_id, note, started_at) VALUES (?, ?, ?, NOW())`,
+		userID, orderID, nullString(note))
+	if err != nil {
+		return nil, err
+	}
+	return stopped, tx.Commit()
+}
+
+// Stop stops userID's timer on orderID and records the time as a labor
+// cost, or minutes instead of the time elapsed when given.
+func (ts *TimeService) Stop(orderID, userID string, minutes *int) (*TicketCost, error) {
+	tx, err := ts.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	timer := TicketTimer{EngineerID: userID, OrderID: orderID}
+	err = tx.QueryRow(`SELECT COALESCE(note, ''), started_at FROM ticket_timers WHERE user_id = ? AND order_id = ? FOR UPDATE`,
+		userID, orderID).Scan(&timer.Note, &timer.StartedAt)
+	if err == sql.ErrNoRows {
+		return nil, errNoTimer
+	}
+	if err != nil {
+		return nil, err
+	}
+	cost, err := ts.stop(tx, &timer, minutes)
+	if err != nil {
+		return nil, err
+	}
+	return cost, tx.Commit()
+}
+
+// stop removes a running timer and records its labor cost.
+func (ts *TimeService) stop(tx *sql.Tx, timer *TicketTimer, minutes *int) (*TicketCost, error) {
+	elapsed := time.Since(timer.StartedAt)
+	if minutes == nil && elapsed > timerMaxDuration {
+		return nil, errTimerTooLong
+	}
+	if _, err := tx.Exec(`DELETE FROM ticket_timers WHERE user_id = ?`, timer.EngineerID); err != nil {
+		return nil, err
+	}
+
+	description := timer.Note
+	if description == "" {
+		description = "Bench time"
+	}
+	cost := &TicketCost{
+		OrderID:     timer.OrderID,
+		Kind:        CostLabor,
+		Description: description,
+		Quantity:    1,
+		EngineerID:  timer.EngineerID,
+		RecordedBy:  timer.EngineerID,
+	}
+	if minutes != nil {
+		cost.Minutes = *minutes
+	} else {
+		// Started minutes count, so a short job still logs a minute
+		cost.Minutes = int(math.Ceil(elapsed.Minutes()))
+	}
+	if cost.Minutes < 1 {
+		cost.Minutes = 1
+	}
+	if err := profitabilityService.recordCost(tx, cost); err != nil {
+		return nil, err
+	}
+	return cost, nil
+}
+
+// orderTime lists a ticket's logged time and running timers (GET) or
+// records time worked on it by hand (POST {"minutes": 45, "description":
+// "Reflowed GPU", "engineer_id": "..."}); engineer_id defaults to the
+// signed-in user and only Admins log time for others.
+func orderTime(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		if _, err := orderService.GetOrder(orderID); err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error retrieving order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve logged time", http.StatusInternalServerError)
+			return
+		}
+		costs, err := profitabilityService.ListCosts(orderID)
+		if err != nil {
+			log.Printf("Error listing costs of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve logged time", http.StatusInternalServerError)
+			return
+		}
+		entries := []TicketCost{}
+		for _, cost := range costs {
+			if cost.Kind == CostLabor {
+				entries = append(entries, cost)
+			}
+		}
+		minutes, err := ticketLaborMinutes(orderService.db, orderID)
+		if err != nil {
+			log.Printf("Error totalling labor of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve logged time", http.StatusInternalServerError)
+			return
+		}
+		timers, err := timeService.Timers(orderID)
+		if err != nil {
+			log.Printf("Error listing timers of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve logged time", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id":      orderID,
+			"labor_minutes": minutes,
+			"labor_hours":   laborHours(minutes),
+			"entries":       entries,
+			"running":       timers,
+		})
+
+	case "POST":
+		if !hasPermission(r, PermCostsRecord) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+		var request struct {
+			Minutes     int    `json:"minutes"`
+			Description string `json:"description"`
+			EngineerID  string `json:"engineer_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		request.EngineerID = strings.TrimSpace(request.EngineerID)
+		if request.EngineerID == "" {
+			request.EngineerID = actorID(r)
+		}
+		if request.EngineerID != actorID(r) && !hasRole(r, RoleAdmin) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if request.Minutes < 1 || request.Minutes > 24*60 {
+			fieldErrors.Add("minutes", "must be between 1 and 1440")
+		}
+		request.Description = strings.TrimSpace(request.Description)
+		if request.Description == "" {
+			request.Description = "Bench time"
+		} else if len(request.Description) > 255 {
+			fieldErrors.Add("description", "must be at most 255 characters")
+		}
+		if request.EngineerID == "" {
+			fieldErrors.Add("engineer_id", "is required")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		cost := TicketCost{
+			OrderID:     orderID,
+			Kind:        CostLabor,
+			Description: request.Description,
+			Quantity:    1,
+			Minutes:     request.Minutes,
+			EngineerID:  request.EngineerID,
+			RecordedBy:  actorID(r),
+		}
+		err := profitabilityService.RecordCost(&cost)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error logging time on order %s: %v", orderID, err)
+			http.Error(w, "Failed to log time", http.StatusInternalServerError)
+			return
+		}
+		auditService.Record(r, AuditTicketCostRecorded, "order", orderID, nil, cost)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(cost)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// orderTimer starts (POST .../timer/start {"note": "..."}) or stops
+// (POST .../timer/stop, optionally {"minutes": 90}) the signed-in user's
+// timer on a ticket.
+func orderTimer(w http.ResponseWriter, r *http.Request, orderID, action string) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasPermission(r, PermCostsRecord) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+	userID := actorID(r)
+	if userID == "" {
+		http.Error(w, "This endpoint needs a signed-in user", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Note    string `json:"note"`
+		Minutes *int   `json:"minutes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+	var fieldErrors ValidationErrors
+	request.Note = strings.TrimSpace(request.Note)
+	if len(request.Note) > 255 {
+		fieldErrors.Add("note", "must be at most 255 characters")
+	}
+	if request.Minutes != nil && (*request.Minutes < 1 || *request.Minutes > 24*60) {
+		fieldErrors.Add("minutes", "must be between 1 and 1440")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	var cost *TicketCost
+	var err error
+	if action == "start" {
+		cost, err = timeService.Start(orderID, userID, request.Note)
+	} else {
+		cost, err = timeService.Stop(orderID, userID, request.Minutes)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err == errTimerRunning || err == errNoTimer || err == errTimerTooLong {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if guardErr, ok := err.(*StatusGuardError); ok {
+		http.Error(w, guardErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error on timer %s of order %s for %s: %v", action, orderID, userID, err)
+		http.Error(w, "Failed to "+action+" timer", http.StatusInternalServerError)
+		return
+	}
+
+	if cost != nil {
+		auditService.Record(r, AuditTicketCostRecorded, "order", cost.OrderID, nil, cost)
+	}
+	if action == "start" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Timer started",
+			"stopped": cost, // The timer stopped on another ticket, if any
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Timer stopped",
+		"logged":  cost,
+	})
+}
+
+// EngineerUtilization is an engineer's logged time against their available
+// hours over a period.
+type EngineerUtilization struct {
+	EngineerID         string   `json:"engineer_id"`
+	Name               string   `json:"name"`
+	Tickets            int      `json:"tickets"` // Tickets time was logged on
+	BenchMinutes       int      `json:"bench_minutes"`
+	VisitMinutes       int      `json:"visit_minutes"`
+	LoggedHours        float64  `json:"logged_hours"`
+	AvailableHours     float64  `json:"available_hours"`
+	UtilizationPercent *float64 `json:"utilization_percent"` // Null without available hours
+}
+
+// UtilizationReport returns every approved engineer's logged time in the
+// period, busiest first. Available hours are UTILIZATION_HOURS_PER_WEEK
+// (default 48) prorated over the period.
+func (rs *ReportService) UtilizationReport(period ReportRange) ([]EngineerUtilization, error) {
+	rows, err := rs.db.Query(`
+		SELECT u.id, u.full_name,
+		       COALESCE(l.tickets, 0), COALESCE(l.minutes, 0), COALESCE(v.minutes, 0)
+		FROM users u
+		LEFT JOIN (SELECT engineer_id, COUNT(DISTINCT order_id) AS tickets, SUM(minutes) AS minutes
+		           FROM ticket_costs WHERE kind = 'labor' AND created_at >= ? AND created_at < ?
+		           GROUP BY engineer_id) l ON l.engineer_id = u.id
+		LEFT JOIN (SELECT engineer_id, SUM(TIMESTAMPDIFF(MINUTE, check_in_at, check_out_at)) AS minutes
+		           FROM onsite_visits WHERE status = 'completed' AND check_out_at >= ? AND check_out_at < ?
+		           GROUP BY engineer_id) v ON v.engineer_id = u.id
+		WHERE u.role = ? AND u.approved = TRUE
+		ORDER BY COALESCE(l.minutes, 0) + COALESCE(v.minutes, 0) DESC, u.full_name, u.id
+	`, period.From, period.To, period.From, period.To, RoleEngineer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	weeks := period.To.Sub(period.From).Hours() / (24 * 7)
+	available := math.Round(float64(getEnvInt("UTILIZATION_HOURS_PER_WEEK", 48))*weeks*100) / 100
+	report := []EngineerUtilization{}
+	for rows.Next() {
+		row := EngineerUtilization{AvailableHours: available}
+		if err := rows.Scan(&row.EngineerID, &row.Name, &row.Tickets, &row.BenchMinutes, &row.VisitMinutes); err != nil {
+			return nil, err
+		}
+		row.LoggedHours = laborHours(row.BenchMinutes + row.VisitMinutes)
+		if available > 0 {
+			percent := math.Round(row.LoggedHours/available*1000) / 10
+			row.UtilizationPercent = &percent
+		}
+		report = append(report, row)
+	}
+	return report, rows.Err()
+}
+
+// ReportUtilizationHandler returns engineer utilization over ?from=&to=.
+func ReportUtilizationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, err := reportService.UtilizationReport(period)
+	if err != nil {
+		log.Printf("Error building utilization report: %v", err)
+		http.Error(w, "Failed to build utilization report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"range":     period,
+		"engineers": report,
+	})
+}
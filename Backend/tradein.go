@@ -0,0 +1,480 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Trade-ins are priced from a valuation matrix of model, age band and
+// condition grade. The offer is recorded with the buyback purchase; paying a
+// different price needs an admin override with a reason, and the margin is
+// tracked once the unit is resold.
+
+var conditionGrades = []string{"A", "B", "C", "D"}
+
+// anyModel is the matrix row that applies when no model-specific row does.
+const anyModel = "*"
+
+const valuationRulesTable = `
+	CREATE TABLE IF NOT EXISTS valuation_rules (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		model VARCHAR(255) NOT NULL,
+		max_age_months INT NOT NULL,
+		grade CHAR(1) NOT NULL,
+		offer DECIMAL(10,2) NOT NULL,
+		updated_by VARCHAR(50) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_valuation_rule (model, max_age_months, grade)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const buybackPurchasesTable = `
+	CREATE TABLE IF NOT EXISTS buyback_purchases (
+		id VARCHAR(50) PRIMARY KEY,
+		customer_name VARCHAR(255) NOT NULL,
+		customer_phone VARCHAR(20) NOT NULL,
+		model VARCHAR(255) NOT NULL,
+		serial VARCHAR(100) NULL,
+		age_months INT NOT NULL,
+		grade CHAR(1) NOT NULL,
+		offer_amount DECIMAL(10,2) NOT NULL,
+		purchase_price DECIMAL(10,2) NOT NULL,
+		override_by VARCHAR(50) NULL,
+		override_reason VARCHAR(500) NULL,
+		resale_price DECIMAL(10,2) NULL,
+		resold_at TIMESTAMP NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_buyback_serial (serial),
+		INDEX idx_buyback_created (created_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// ValuationRule is one cell of the valuation matrix: units of Model up to
+// MaxAgeMonths old in Grade condition are offered Offer.
+type ValuationRule struct {
+	ID           int64  `json:"id"`
+	Model        string `json:"model"`
+	MaxAgeMonths int    `json:"max_age_months"`
+	Grade        string `json:"grade"`
+	Offer        Money  `json:"offer"`
+	UpdatedBy    string `json:"updated_by,omitempty"`
+}
+
+// BuybackPurchase is a unit bought from a customer.
+type BuybackPurchase struct {
+	ID             string     `json:"id"`
+	CustomerName   string     `json:"customer_name"`
+	CustomerPhone  string     `json:"customer_phone"`
+	Model          string     `json:"model"`
+	Serial         string     `json:"serial,omitempty"`
+	AgeMonths      int        `json:"age_months"`
+	Grade          string     `json:"grade"`
+	OfferAmount    Money      `json:"offer_amount"`
+	PurchasePrice  Money      `json:"purchase_price"`
+	OverrideBy     string     `json:"override_by,omitempty"`
+	OverrideReason string     `json:"override_reason,omitempty"`
+	ResalePrice    *Money     `json:"resale_price,omitempty"`
+	Margin         *Money     `json:"margin,omitempty"`
+	ResoldAt       *time.Time `json:"resold_at,omitempty"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+var (
+	errNoValuation    = errors.New("no valuation rule matches this model, age and grade")
+	errAlreadyResold  = errors.New("unit has already been resold")
+	errOverrideDenied = errors.New("paying other than the offer needs the override permission and a reason")
+)
+
+// TradeInService handles valuation matrix and buyback database operations
+type TradeInService struct {
+	db *sql.DB
+}
+
+func NewTradeInService(database *sql.DB) *TradeInService {
+	return &TradeInService{db: database}
+}
+
+// Valuate returns the offer for a unit. A model-specific row wins over the
+// catch-all row, and the tightest age band that covers the unit applies.
+func (ts *TradeInService) Valuate(model string, ageMonths int, grade string) (Money, error) {
+	var offer Money
+	err := ts.db.QueryRow(`
+		SELECT offer FROM valuation_rules
+		WHERE (model = ? OR model = ?) AND max_age_months >= ? AND grade = ?
+		ORDER BY model = ? ASC, max_age_months ASC
+		LIMIT 1
+	`, strings.TrimSpace(model), anyModel, ageMonths, grade, anyModel).Scan(&offer)
+	if err == sql.ErrNoRows {
+		return 0, errNoValuation
+	}
+	return offer, err
+}
+
+func (ts *TradeInService) ListRules() ([]ValuationRule, error) {
+	rows, err := ts.db.Query(`
+		SELECT id, model, max_age_months, grade, offer, updated_by
+		FROM valuation_rules ORDER BY model, max_age_months, grade
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []ValuationRule{}
+	for rows.Next() {
+		var rule ValuationRule
+		var updatedBy sql.NullString
+		if err := rows.Scan(&rule.ID, &rule.Model, &rule.MaxAgeMonths, &rule.Grade, &rule.Offer, &updatedBy); err != nil {
+			return nil, err
+		}
+		rule.UpdatedBy = updatedBy.String
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// SaveRule creates a matrix cell or updates the offer of an existing one.
+func (ts *TradeInService) SaveRule(rule *ValuationRule, actorID string) error {
+	_, err := ts.db.Exec(`
+		INSERT INTO valuation_rules (model, max_age_months, grade, offer, updated_by)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE offer = VALUES(offer), updated_by = VALUES(updated_by)
+	`, rule.Model, rule.MaxAgeMonths, rule.Grade, rule.Offer, nullString(actorID))
+	return err
+}
+
+// RecordPurchase stores a buyback at the matrix offer, or at an overridden
+// price when overrideBy is set.
+func (ts *TradeInService) RecordPurchase(purchase *BuybackPurchase) error {
+	purchase.ID = fmt.Sprintf("BUY-%d", time.Now().UnixNano())
+	_, err := ts.db.Exec(`
+		INSERT INTO buyback_purchases (id, customer_name, customer_phone, model, serial, age_months, grade,
+		                               offer_amount, purchase_price, override_by, override_reason, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, purchase.ID, purchase.CustomerName, purchase.CustomerPhone, purchase.Model, nullString(purchase.Serial),
+		purchase.AgeMonths, purchase.Grade, purchase.OfferAmount, purchase.PurchasePrice,
+		nullString(purchase.OverrideBy), nullString(purchase.OverrideReason), nullString(purchase.CreatedBy))
+	return err
+}
+
+// RecordResale closes out a buyback with its resale price.
+func (ts *TradeInService) RecordResale(id string, resalePrice Money) error {
+	result, err := ts.db.Exec(`
+		UPDATE buyback_purchases SET resale_price = ?, resold_at = NOW()
+		WHERE id = ? AND resold_at IS NULL
+	`, resalePrice, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+
+	var exists int
+	if err := ts.db.QueryRow(`SELECT 1 FROM buyback_purchases WHERE id = ?`, id).Scan(&exists); err != nil {
+		return err
+	}
+	return errAlreadyResold
+}
+
+// ListPurchases returns buybacks, newest first; unsold only when asked.
+func (ts *TradeInService) ListPurchases(unsoldOnly bool) ([]BuybackPurchase, error) {
+	query := `
+		SELECT id, customer_name, customer_phone, model, serial, age_months, grade, offer_amount, purchase_price,
+		       override_by, override_reason, resale_price, resold_at, created_by, created_at
+		FROM buyback_purchases`
+	if unsoldOnly {
+		query += ` WHERE resold_at IS NULL`
+	}
+	rows, err := ts.db.Query(query + ` ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	purchases := []BuybackPurchase{}
+	for rows.Next() {
+		var p BuybackPurchase
+		var serial, overrideBy, overrideReason, createdBy sql.NullString
+		var resalePrice sql.NullString
+		var resoldAt sql.NullTime
+		if err := rows.Scan(&p.ID, &p.CustomerName, &p.CustomerPhone, &p.Model, &serial, &p.AgeMonths, &p.Grade,
+			&p.OfferAmount, &p.PurchasePrice, &overrideBy, &overrideReason, &resalePrice, &resoldAt,
+			&createdBy, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		p.Serial = serial.String
+		p.OverrideBy = overrideBy.String
+		p.OverrideReason = overrideReason.String
+		p.CreatedBy = createdBy.String
+		p.ResoldAt = timePtr(resoldAt)
+		if resalePrice.Valid {
+			price, err := ParseMoney(resalePrice.String)
+			if err != nil {
+				return nil, err
+			}
+			margin := price - p.PurchasePrice
+			p.ResalePrice = &price
+			p.Margin = &margin
+		}
+		purchases = append(purchases, p)
+	}
+	return purchases, rows.Err()
+}
+
+var tradeInService *TradeInService
+
+func validateTradeInUnit(model string, ageMonths int, grade string, errs *ValidationErrors) {
+	if strings.TrimSpace(model) == "" {
+		errs.Add("model", "is required")
+	}
+	if ageMonths < 0 {
+		errs.Add("age_months", "must not be negative")
+	}
+	if !slices.Contains(conditionGrades, grade) {
+		errs.Add("grade", "must be one of A, B, C, D")
+	}
+}
+
+// TradeInQuoteHandler prices a unit from the valuation matrix.
+func TradeInQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Model     string `json:"model"`
+		AgeMonths int    `json:"age_months"`
+		Grade     string `json:"grade"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	validateTradeInUnit(request.Model, request.AgeMonths, request.Grade, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	offer, err := tradeInService.Valuate(request.Model, request.AgeMonths, request.Grade)
+	if err == errNoValuation {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error valuating trade-in %s: %v", request.Model, err)
+		http.Error(w, "Failed to value trade-in", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"model":      request.Model,
+		"age_months": request.AgeMonths,
+		"grade":      request.Grade,
+		"offer":      offer,
+	})
+}
+
+// BuybackPurchasesHandler lists buybacks (GET, ?unsold=true) or records a
+// new one (POST) at the matrix offer or an admin-overridden price.
+func BuybackPurchasesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		purchases, err := tradeInService.ListPurchases(r.URL.Query().Get("unsold") == "true")
+		if err != nil {
+			log.Printf("Error listing buyback purchases: %v", err)
+			http.Error(w, "Failed to retrieve buyback purchases", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(purchases)
+
+	case "POST":
+		var request struct {
+			CustomerName   string `json:"customer_name"`
+			CustomerPhone  string `json:"customer_phone"`
+			Model          string `json:"model"`
+			Serial         string `json:"serial"`
+			AgeMonths      int    `json:"age_months"`
+			Grade          string `json:"grade"`
+			PurchasePrice  *Money `json:"purchase_price"`
+			OverrideReason string `json:"override_reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if request.CustomerName == "" {
+			fieldErrors.Add("customer_name", "is required")
+		}
+		if request.CustomerPhone == "" {
+			fieldErrors.Add("customer_phone", "is required")
+		}
+		validateTradeInUnit(request.Model, request.AgeMonths, request.Grade, &fieldErrors)
+		if request.PurchasePrice != nil && *request.PurchasePrice < 0 {
+			fieldErrors.Add("purchase_price", "must not be negative")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		offer, err := tradeInService.Valuate(request.Model, request.AgeMonths, request.Grade)
+		if err != nil && err != errNoValuation {
+			log.Printf("Error valuating trade-in %s: %v", request.Model, err)
+			http.Error(w, "Failed to record buyback", http.StatusInternalServerError)
+			return
+		}
+
+		purchase := &BuybackPurchase{
+			CustomerName:  request.CustomerName,
+			CustomerPhone: request.CustomerPhone,
+			Model:         strings.TrimSpace(request.Model),
+			Serial:        request.Serial,
+			AgeMonths:     request.AgeMonths,
+			Grade:         request.Grade,
+			OfferAmount:   offer,
+			PurchasePrice: offer,
+			CreatedBy:     actorID(r),
+		}
+
+		// Without a matrix offer every purchase is an override
+		overridden := err == errNoValuation || (request.PurchasePrice != nil && *request.PurchasePrice != offer)
+		if overridden {
+			if !hasPermission(r, PermTradeInOverride) || request.OverrideReason == "" || request.PurchasePrice == nil {
+				http.Error(w, errOverrideDenied.Error(), http.StatusForbidden)
+				return
+			}
+			purchase.PurchasePrice = *request.PurchasePrice
+			purchase.OverrideBy = actorID(r)
+			purchase.OverrideReason = truncate(request.OverrideReason, 500)
+		}
+
+		if err := tradeInService.RecordPurchase(purchase); err != nil {
+			log.Printf("Error recording buyback of %s: %v", purchase.Model, err)
+			http.Error(w, "Failed to record buyback", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Buyback %s recorded by %s at %s (offer %s)", purchase.ID, actorID(r), purchase.PurchasePrice, purchase.OfferAmount)
+		auditService.Record(r, AuditBuybackRecorded, "buyback", purchase.ID, nil, purchase)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "Buyback recorded successfully",
+			"buyback_id":     purchase.ID,
+			"offer_amount":   purchase.OfferAmount,
+			"purchase_price": purchase.PurchasePrice,
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// BuybackResaleHandler records the resale of a bought-back unit.
+func BuybackResaleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ID          string `json:"id"`
+		ResalePrice Money  `json:"resale_price"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.ID == "" || request.ResalePrice < 0 {
+		http.Error(w, "Buyback ID and a non-negative resale price are required", http.StatusBadRequest)
+		return
+	}
+
+	err := tradeInService.RecordResale(request.ID, request.ResalePrice)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Buyback not found", http.StatusNotFound)
+		return
+	}
+	if err == errAlreadyResold {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording resale of %s: %v", request.ID, err)
+		http.Error(w, "Failed to record resale", http.StatusInternalServerError)
+		return
+	}
+
+	auditService.Record(r, AuditBuybackResold, "buyback", request.ID, nil, map[string]Money{"resale_price": request.ResalePrice})
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Resale recorded successfully",
+	})
+}
+
+// ValuationRulesHandler lists (GET) or saves (PUT) valuation matrix cells.
+func ValuationRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		rules, err := tradeInService.ListRules()
+		if err != nil {
+			log.Printf("Error listing valuation rules: %v", err)
+			http.Error(w, "Failed to retrieve valuation rules", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(rules)
+
+	case "PUT":
+		var rule ValuationRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		rule.Model = strings.TrimSpace(rule.Model)
+		var fieldErrors ValidationErrors
+		validateTradeInUnit(rule.Model, rule.MaxAgeMonths, rule.Grade, &fieldErrors)
+		if rule.Offer < 0 {
+			fieldErrors.Add("offer", "must not be negative")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		if err := tradeInService.SaveRule(&rule, actorID(r)); err != nil {
+			log.Printf("Error saving valuation rule: %v", err)
+			http.Error(w, "Failed to save valuation rule", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditValuationRuleSaved, "valuation_rule",
+			fmt.Sprintf("%s/%d/%s", rule.Model, rule.MaxAgeMonths, rule.Grade), nil, rule)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Valuation rule saved successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
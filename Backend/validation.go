@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// FieldError describes why one input field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects field errors for a single request.
+type ValidationErrors []FieldError
+
+func (ve *ValidationErrors) Add(field, message string) {
+	*ve = append(*ve, FieldError{Field: field, Message: message})
+}
+
+// writeValidationErrors responds 422 with every field error at once, so
+// forms can highlight all bad inputs in one round trip.
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "validation_failed",
+		"fields": errs,
+	})
+}
+
+// acceptedDateLayouts are tried in order when parsing date fields.
+var acceptedDateLayouts = []string{"2006-01-02", time.RFC3339}
+
+// parseDateField parses an optional date given as YYYY-MM-DD or RFC3339.
+// An empty value yields nil; an unparseable one records a field error
+// instead of silently becoming 0001-01-01.
+func parseDateField(field, value string, errs *ValidationErrors) *time.Time {
+	if value == "" {
+		return nil
+	}
+
+	for _, layout := range acceptedDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t
+		}
+	}
+
+	errs.Add(field, "must be a date in YYYY-MM-DD or RFC3339 format")
+	return nil
+}
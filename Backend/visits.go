@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// On-site visits take the engineer to corporate clients who won't bring
+// machines in. The visit bills a travel fee and records where and when the
+// engineer checked in and out.
+
+const onsiteVisitsTable = `
+	CREATE TABLE IF NOT EXISTS onsite_visits (
+		id VARCHAR(50) PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		address TEXT NOT NULL,
+		window_start TIMESTAMP NOT NULL,
+		window_end TIMESTAMP NOT NULL,
+		engineer_id VARCHAR(50) NOT NULL,
+		travel_fee DECIMAL(10,2) NOT NULL DEFAULT 0,
+		status ENUM('scheduled', 'checked_in', 'completed') NOT NULL DEFAULT 'scheduled',
+		check_in_at TIMESTAMP NULL,
+		check_in_lat DECIMAL(9,6) NULL,
+		check_in_lng DECIMAL(9,6) NULL,
+		check_out_at TIMESTAMP NULL,
+		check_out_lat DECIMAL(9,6) NULL,
+		check_out_lng DECIMAL(9,6) NULL,
+		report TEXT NULL,
+		created_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_onsite_visits_order (order_id),
+		INDEX idx_onsite_visits_engineer (engineer_id, window_start),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// GeoPoint is a device-reported location in decimal degrees.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func (p *GeoPoint) valid() bool {
+	return p != nil && p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// OnsiteVisit is one scheduled trip to a customer site.
+type OnsiteVisit struct {
+	ID          string     `json:"id"`
+	OrderID     string     `json:"order_id"`
+	Address     string     `json:"address"`
+	WindowStart time.Time  `json:"window_start"`
+	WindowEnd   time.Time  `json:"window_end"`
+	EngineerID  string     `json:"engineer_id"`
+	TravelFee   Money      `json:"travel_fee"`
+	Status      string     `json:"status"`
+	CheckInAt   *time.Time `json:"check_in_at,omitempty"`
+	CheckIn     *GeoPoint  `json:"check_in,omitempty"`
+	CheckOutAt  *time.Time `json:"check_out_at,omitempty"`
+	CheckOut    *GeoPoint  `json:"check_out,omitempty"`
+	Report      string     `json:"report,omitempty"`
+	CreatedBy   string     `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// VisitService handles on-site visit database operations
+type VisitService struct {
+	db *sql.DB
+}
+
+func NewVisitService(database *sql.DB) *VisitService {
+	return &VisitService{db: database}
+}
+
+// ScheduleVisit books a visit and bills its travel fee on the ticket.
+func (vs *VisitService) ScheduleVisit(visit *OnsiteVisit, actorID string) error {
+	tx, err := vs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := orderService.lockOrderStatus(tx, visit.OrderID); err != nil {
+		return err
+	}
+
+	visit.ID = fmt.Sprintf("VIS-%d", time.Now().UnixNano())
+	visit.Status = "scheduled"
+	_, err = tx.Exec(`
+		INSERT INTO onsite_visits (id, order_id, address, window_start, window_end, engineer_id, travel_fee, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, visit.ID, visit.OrderID, visit.Address, visit.WindowStart, visit.WindowEnd, visit.EngineerID,
+		visit.TravelFee, nullString(actorID))
+	if err != nil {
+		return err
+	}
+
+	if visit.TravelFee > 0 {
+		item := ItemAddedPayload{
+			Description:  "On-site visit travel fee",
+			Amount:       visit.TravelFee,
+			WarrantyDays: noWarranty,
+		}
+		if _, err := orderService.events.Append(tx, visit.OrderID, EventItemAdded, actorID, item); err != nil {
+			return err
+		}
+		if err := migrationService.DualWrite(tx, "orders", visit.OrderID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+var errVisitState = fmt.Errorf("visit is not in the right state for this step")
+
+// CheckIn stamps the engineer's arrival at the site.
+func (vs *VisitService) CheckIn(visitID string, at GeoPoint) error {
+	result, err := vs.db.Exec(`
+		UPDATE onsite_visits SET status = 'checked_in', check_in_at = NOW(), check_in_lat = ?, check_in_lng = ?
+		WHERE id = ? AND status = 'scheduled'
+	`, at.Lat, at.Lng, visitID)
+	return vs.requireTransition(result, err, visitID)
+}
+
+// CheckOut stamps the engineer's departure and stores the visit report.
+func (vs *VisitService) CheckOut(visitID string, at GeoPoint, report string) error {
+	result, err := vs.db.Exec(`
+		UPDATE onsite_visits SET status = 'completed', check_out_at = NOW(), check_out_lat = ?, check_out_lng = ?, report = ?
+		WHERE id = ? AND status = 'checked_in'
+	`, at.Lat, at.Lng, report, visitID)
+	return vs.requireTransition(result, err, visitID)
+}
+
+// requireTransition tells a missing visit (sql.ErrNoRows) apart from one in
+// the wrong state (errVisitState) when an update matched nothing.
+func (vs *VisitService) requireTransition(result sql.Result, err error, visitID string) error {
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+	if _, err := vs.GetVisit(visitID); err != nil {
+		return err
+	}
+	return errVisitState
+}
+
+const visitColumns = `id, order_id, address, window_start, window_end, engineer_id, travel_fee, status,
+	check_in_at, check_in_lat, check_in_lng, check_out_at, check_out_lat, check_out_lng, report,
+	created_by, created_at`
+
+func scanVisit(row rowScanner) (*OnsiteVisit, error) {
+	var visit OnsiteVisit
+	var checkInAt, checkOutAt sql.NullTime
+	var checkInLat, checkInLng, checkOutLat, checkOutLng sql.NullFloat64
+	var report, createdBy sql.NullString
+
+	err := row.Scan(&visit.ID, &visit.OrderID, &visit.Address, &visit.WindowStart, &visit.WindowEnd,
+		&visit.EngineerID, &visit.TravelFee, &visit.Status, &checkInAt, &checkInLat, &checkInLng,
+		&checkOutAt, &checkOutLat, &checkOutLng, &report, &createdBy, &visit.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	visit.CheckInAt = timePtr(checkInAt)
+	if checkInLat.Valid && checkInLng.Valid {
+		visit.CheckIn = &GeoPoint{Lat: checkInLat.Float64, Lng: checkInLng.Float64}
+	}
+	visit.CheckOutAt = timePtr(checkOutAt)
+	if checkOutLat.Valid && checkOutLng.Valid {
+		visit.CheckOut = &GeoPoint{Lat: checkOutLat.Float64, Lng: checkOutLng.Float64}
+	}
+	visit.Report = report.String
+	visit.CreatedBy = createdBy.String
+	return &visit, nil
+}
+
+func (vs *VisitService) GetVisit(visitID string) (*OnsiteVisit, error) {
+	return scanVisit(vs.db.QueryRow(`SELECT `+visitColumns+` FROM onsite_visits WHERE id = ?`, visitID))
+}
+
+// ListVisits returns visits for an order, or an engineer's schedule when
+// orderID is empty.
+func (vs *VisitService) ListVisits(orderID, engineerID string) ([]OnsiteVisit, error) {
+	query := `SELECT ` + visitColumns + ` FROM onsite_visits WHERE order_id = ? ORDER BY window_start`
+	arg := orderID
+	if orderID == "" {
+		query = `SELECT ` + visitColumns + ` FROM onsite_visits WHERE engineer_id = ? ORDER BY window_start`
+		arg = engineerID
+	}
+
+	rows, err := vs.db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	visits := []OnsiteVisit{}
+	for rows.Next() {
+		visit, err := scanVisit(rows)
+		if err != nil {
+			return nil, err
+		}
+		visits = append(visits, *visit)
+	}
+	return visits, rows.Err()
+}
+
+var visitService *VisitService
+
+// VisitsHandler lists visits (GET ?order_id= or ?engineer_id=) or schedules
+// a new one (POST).
+func VisitsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		orderID := r.URL.Query().Get("order_id")
+		engineerID := r.URL.Query().Get("engineer_id")
+		if orderID == "" && engineerID == "" {
+			http.Error(w, "order_id or engineer_id is required", http.StatusBadRequest)
+			return
+		}
+
+		visits, err := visitService.ListVisits(orderID, engineerID)
+		if err != nil {
+			log.Printf("Error listing on-site visits: %v", err)
+			http.Error(w, "Failed to retrieve visits", http.StatusInternalServerError)
+			return
+		}
+		piiPolicyFor(r).shapeVisits(visits)
+		json.NewEncoder(w).Encode(visits)
+
+	case "POST":
+		var request struct {
+			OrderID     string `json:"order_id"`
+			Address     string `json:"address"`
+			WindowStart string `json:"window_start"`
+			WindowEnd   string `json:"window_end"`
+			EngineerID  string `json:"engineer_id"`
+			TravelFee   Money  `json:"travel_fee"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if request.Address == "" {
+			fieldErrors.Add("address", "is required")
+		}
+		if request.EngineerID == "" {
+			fieldErrors.Add("engineer_id", "is required")
+		}
+		if request.TravelFee < 0 {
+			fieldErrors.Add("travel_fee", "must not be negative")
+		}
+		windowStart := parseDateField("window_start", request.WindowStart, &fieldErrors)
+		windowEnd := parseDateField("window_end", request.WindowEnd, &fieldErrors)
+		if windowStart == nil && request.WindowStart == "" {
+			fieldErrors.Add("window_start", "is required")
+		}
+		if windowEnd == nil && request.WindowEnd == "" {
+			fieldErrors.Add("window_end", "is required")
+		}
+		if windowStart != nil && windowEnd != nil && !windowEnd.After(*windowStart) {
+			fieldErrors.Add("window_end", "must be after window_start")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		visit := &OnsiteVisit{
+			OrderID:     request.OrderID,
+			Address:     request.Address,
+			WindowStart: *windowStart,
+			WindowEnd:   *windowEnd,
+			EngineerID:  request.EngineerID,
+			TravelFee:   request.TravelFee,
+		}
+		err := visitService.ScheduleVisit(visit, actorID(r))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error scheduling visit for %s: %v", request.OrderID, err)
+			http.Error(w, "Failed to schedule visit", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":  "Visit scheduled successfully",
+			"visit_id": visit.ID,
+		})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// VisitCheckInHandler records the engineer's arrival with their location.
+func VisitCheckInHandler(w http.ResponseWriter, r *http.Request) {
+	handleVisitStep(w, r, false)
+}
+
+// VisitCheckOutHandler records the engineer's departure, location and
+// visit report.
+func VisitCheckOutHandler(w http.ResponseWriter, r *http.Request) {
+	handleVisitStep(w, r, true)
+}
+
+func handleVisitStep(w http.ResponseWriter, r *http.Request, checkOut bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		VisitID  string    `json:"visit_id"`
+		Location *GeoPoint `json:"location"`
+		Report   string    `json:"report"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	if request.VisitID == "" {
+		fieldErrors.Add("visit_id", "is required")
+	}
+	if !request.Location.valid() {
+		fieldErrors.Add("location", "must hold a valid lat and lng")
+	}
+	if checkOut && request.Report == "" {
+		fieldErrors.Add("report", "is required")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	// Only the assigned engineer (or an admin) checks in and out
+	visit, err := visitService.GetVisit(request.VisitID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Visit not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading visit %s: %v", request.VisitID, err)
+		http.Error(w, "Failed to update visit", http.StatusInternalServerError)
+		return
+	}
+	if visit.EngineerID != actorID(r) && !hasRole(r, RoleAdmin) {
+		http.Error(w, "Only the assigned engineer can update this visit", http.StatusForbidden)
+		return
+	}
+
+	if checkOut {
+		err = visitService.CheckOut(request.VisitID, *request.Location, request.Report)
+	} else {
+		err = visitService.CheckIn(request.VisitID, *request.Location)
+	}
+	if err == errVisitState {
+		http.Error(w, "Visit is not in the right state for this step", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating visit %s: %v", request.VisitID, err)
+		http.Error(w, "Failed to update visit", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Checked in successfully"
+	if checkOut {
+		message = "Checked out successfully"
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": message,
+	})
+}
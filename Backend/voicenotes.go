@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Engineers at the bench can record a short voice note on a ticket instead
+// of typing one, by POSTing the recording to /api/v1/orders/{id}/voice-notes.
+// The audio is stored as an ordinary attachment (it counts against the
+// storage quotas and plays back through the attachment download), and a
+// ticket_voice_notes row ties it to the ticket. When TRANSCRIPTION_PROVIDER
+// is set, a background job sends each new recording to the transcription
+// service and saves the text as an internal ticket note, so what was said
+// turns up in note search; with no provider the recording is kept as is.
+
+// Transcription providers
+const (
+	TranscriptionHTTP = "http"
+)
+
+// Voice note transcription states
+const (
+	TranscriptionOff     = "off" // No provider was configured when it was recorded
+	TranscriptionPending = "pending"
+	TranscriptionDone    = "done"
+	TranscriptionFailed  = "failed"
+)
+
+const (
+	maxVoiceNoteBytes         = 5 << 20
+	maxVoiceNoteSeconds       = 300
+	maxTranscriptionAttempts  = 3
+	voiceNoteTranscriptPrefix = "Voice note transcript: "
+)
+
+// voiceNoteTypes are the recording formats accepted. Phone recorders write
+// M4A and WebM containers, which sniff as video.
+var voiceNoteTypes = []string{
+	"audio/mpeg", "audio/mp4", "audio/x-m4a", "audio/aac", "audio/ogg", "application/ogg",
+	"audio/webm", "audio/wav", "audio/wave", "audio/x-wav", "video/mp4", "video/webm",
+}
+
+const ticketVoiceNotesTable = `
+	CREATE TABLE IF NOT EXISTS ticket_voice_notes (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		attachment_id VARCHAR(50) NOT NULL,
+		duration_seconds INT NOT NULL,
+		transcription ENUM('off', 'pending', 'done', 'failed') NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		note_id BIGINT NULL,
+		recorded_by VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_voice_notes_order (order_id, created_at),
+		INDEX idx_voice_notes_transcription (transcription),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+		FOREIGN KEY (attachment_id) REFERENCES attachments(id) ON DELETE CASCADE,
+		FOREIGN KEY (note_id) REFERENCES ticket_notes(id) ON DELETE SET NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// TranscriptionConfig selects and configures the transcription service.
+type TranscriptionConfig struct {
+	Provider string
+	APIURL   string
+	APIKey   string
+	Timeout  time.Duration
+}
+
+// getTranscriptionConfig reads the TRANSCRIPTION_* environment variables.
+func getTranscriptionConfig() (TranscriptionConfig, error) {
+	config := TranscriptionConfig{
+		Provider: getEnv("TRANSCRIPTION_PROVIDER", ""),
+		APIURL:   getEnv("TRANSCRIPTION_API_URL", ""),
+		APIKey:   getEnv("TRANSCRIPTION_API_KEY", ""),
+	}
+	timeout, err := time.ParseDuration(getEnv("TRANSCRIPTION_TIMEOUT", "60s"))
+	if err != nil || timeout <= 0 {
+		return config, fmt.Errorf("TRANSCRIPTION_TIMEOUT must be a positive duration")
+	}
+	config.Timeout = timeout
+	switch config.Provider {
+	case "":
+	case TranscriptionHTTP:
+		if config.APIURL == "" {
+			return config, fmt.Errorf("TRANSCRIPTION_API_URL is required when TRANSCRIPTION_PROVIDER is http")
+		}
+	default:
+		return config, fmt.Errorf("TRANSCRIPTION_PROVIDER must be http")
+	}
+	return config, nil
+}
+
+// Transcriber turns a recording into text.
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio []byte, contentType string) (string, error)
+}
+
+// httpTranscriber posts the recording to {url} with its content type and
+// reads {"text": "..."}.
+type httpTranscriber struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (ht *httpTranscriber) Transcribe(ctx context.Context, audio []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", ht.url, bytes.NewReader(audio))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	if ht.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+ht.apiKey)
+	}
+
+	resp, err := ht.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("transcription service returned %s", resp.Status)
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", fmt.Errorf("transcription service response: %w", err)
+	}
+	return result.Text, nil
+}
+
+// VoiceNote is a recording attached to a ticket. Transcript is the text of
+// the note it was transcribed into, when there is one.
+type VoiceNote struct {
+	ID              int64     `json:"id"`
+	OrderID         string    `json:"order_id"`
+	AttachmentID    string    `json:"attachment_id"`
+	ContentType     string    `json:"content_type"`
+	SizeBytes       int64     `json:"size_bytes"`
+	DurationSeconds int       `json:"duration_seconds"`
+	Transcription   string    `json:"transcription"`
+	NoteID          *int64    `json:"note_id,omitempty"`
+	Transcript      string    `json:"transcript,omitempty"`
+	RecordedBy      string    `json:"recorded_by,omitempty"`
+	RecordedByName  string    `json:"recorded_by_name,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// VoiceNoteService stores voice notes and transcribes them
+type VoiceNoteService struct {
+	db          *sql.DB
+	transcriber Transcriber // nil when transcription is off
+	timeout     time.Duration
+}
+
+func NewVoiceNoteService(database *sql.DB, config TranscriptionConfig) *VoiceNoteService {
+	service := &VoiceNoteService{db: database, timeout: config.Timeout}
+	if config.Provider == TranscriptionHTTP {
+		service.transcriber = &httpTranscriber{url: config.APIURL, apiKey: config.APIKey, client: &http.Client{Timeout: config.Timeout}}
+	}
+	return service
+}
+
+var voiceNoteService *VoiceNoteService
+
+// Record stores the recording as an attachment and the voice note against
+// it, queueing it for transcription when a provider is configured.
+func (vs *VoiceNoteService) Record(note *VoiceNote, filename string, content io.Reader) ([]StorageUsage, error) {
+	var deletedAt sql.NullTime
+	if err := vs.db.QueryRow(`SELECT deleted_at FROM orders WHERE id = ?`, note.OrderID).Scan(&deletedAt); err != nil {
+		return nil, err
+	}
+	if deletedAt.Valid {
+		return nil, &StatusGuardError{Reason: "the ticket is cancelled"}
+	}
+	attachment := &Attachment{
+		OrderID:     note.OrderID,
+		Filename:    filename,
+		ContentType: note.ContentType,
+		UploadedBy:  note.RecordedBy,
+	}
+	usages, err := attachmentService.StoreAllowing(attachment, content, voiceNoteTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	note.AttachmentID = attachment.ID
+	note.ContentType = attachment.ContentType
+	note.SizeBytes = attachment.SizeBytes
+	note.Transcription = TranscriptionOff
+	if vs.transcriber != nil {
+		note.Transcription = TranscriptionPending
+	}
+	result, err := vs.db.Exec(`
+		INSERT INTO ticket_voice_notes (order_id, attachment_id, duration_seconds, transcription, recorded_by)
+		VALUES (?, ?, ?, ?, ?)
+	`, note.OrderID, note.AttachmentID, note.DurationSeconds, note.Transcription, nullString(note.RecordedBy))
+	if err != nil {
+		if deleteErr := attachmentService.Delete(attachment); deleteErr != nil {
+			log.Printf("Error removing voice note recording %s: %v", attachment.ID, deleteErr)
+		}
+		return nil, err
+	}
+	note.ID, _ = result.LastInsertId()
+	note.CreatedAt = attachment.CreatedAt
+	return usages, nil
+}
+
+// List returns a ticket's voice notes, oldest first.
+func (vs *VoiceNoteService) List(orderID string) ([]VoiceNote, error) {
+	rows, err := vs.db.Query(`
+		SELECT v.id, v.order_id, v.attachment_id, a.content_type, a.size_bytes, v.duration_seconds,
+			v.transcription, v.note_id, n.body, v.recorded_by, u.full_name, v.created_at
+		FROM ticket_voice_notes v
+		JOIN attachments a ON a.id = v.attachment_id
+		LEFT JOIN ticket_notes n ON n.id = v.note_id
+		LEFT JOIN users u ON u.id = v.recorded_by
+		WHERE v.order_id = ? ORDER BY v.created_at, v.id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []VoiceNote{}
+	for rows.Next() {
+		var note VoiceNote
+		var noteID sql.NullInt64
+		var transcript, recordedBy, recordedByName sql.NullString
+		if err := rows.Scan(&note.ID, &note.OrderID, &note.AttachmentID, &note.ContentType, &note.SizeBytes,
+			&note.DurationSeconds, &note.Transcription, &noteID, &transcript, &recordedBy, &recordedByName,
+			&note.CreatedAt); err != nil {
+			return nil, err
+		}
+		if noteID.Valid {
+			note.NoteID = &noteID.Int64
+		}
+		note.Transcript = strings.TrimPrefix(transcript.String, voiceNoteTranscriptPrefix)
+		note.RecordedBy = recordedBy.String
+		note.RecordedByName = recordedByName.String
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+// TranscribePending transcribes voice notes waiting for it, saving each
+// transcript as an internal note by whoever recorded it. A recording that
+// keeps failing is given up on after a few attempts.
+func (vs *VoiceNoteService) TranscribePending(ctx context.Context) error {
+	if vs.transcriber == nil {
+		return nil
+	}
+	rows, err := vs.db.QueryContext(ctx, `
+		SELECT id, order_id, attachment_id, recorded_by, attempts FROM ticket_voice_notes
+		WHERE transcription = ? ORDER BY id LIMIT 10
+	`, TranscriptionPending)
+	if err != nil {
+		return err
+	}
+	type pendingNote struct {
+		id           int64
+		orderID      string
+		attachmentID string
+		recordedBy   sql.NullString
+		attempts     int
+	}
+	var pending []pendingNote
+	for rows.Next() {
+		var note pendingNote
+		if err := rows.Scan(&note.id, &note.orderID, &note.attachmentID, &note.recordedBy, &note.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, note)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, note := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		noteID, err := vs.transcribe(ctx, note.orderID, note.attachmentID, note.recordedBy.String)
+		if err != nil {
+			status := TranscriptionPending
+			if note.attempts+1 >= maxTranscriptionAttempts {
+				status = TranscriptionFailed
+			}
+			log.Printf("Error transcribing voice note %d on order %s (attempt %d): %v", note.id, note.orderID, note.attempts+1, err)
+			if _, err := vs.db.ExecContext(ctx, `
+				UPDATE ticket_voice_notes SET attempts = attempts + 1, transcription = ? WHERE id = ?
+			`, status, note.id); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := vs.db.ExecContext(ctx, `
+			UPDATE ticket_voice_notes SET attempts = attempts + 1, transcription = ?, note_id = ? WHERE id = ?
+		`, TranscriptionDone, noteID, note.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transcribe runs one recording through the transcriber and saves the text
+// as a note, returning its ID (null when nothing was said).
+func (vs *VoiceNoteService) transcribe(ctx context.Context, orderID, attachmentID, recordedBy string) (sql.NullInt64, error) {
+	attachment, err := attachmentService.GetAttachment(attachmentID)
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	content, err := attachmentService.Open(attachment)
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	audio, err := io.ReadAll(io.LimitReader(content, maxVoiceNoteBytes))
+	content.Close()
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, vs.timeout)
+	defer cancel()
+	text, err := vs.transcriber.Transcribe(ctx, audio, attachment.ContentType)
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return sql.NullInt64{}, nil
+	}
+
+	note := &TicketNote{
+		OrderID:    orderID,
+		AuthorID:   recordedBy,
+		Visibility: NoteInternal,
+		Body:       truncate(voiceNoteTranscriptPrefix+text, maxNoteLength),
+	}
+	if err := noteService.AddNote(note); err != nil {
+		return sql.NullInt64{}, err
+	}
+	return sql.NullInt64{Int64: note.ID, Valid: true}, nil
+}
+
+// voiceNoteTranscriptionJob transcribes newly recorded voice notes.
+func voiceNoteTranscriptionJob() BackgroundJob {
+	return BackgroundJob{
+		Name:     "voice_note_transcription",
+		Interval: getEnvDuration("TRANSCRIPTION_POLL_INTERVAL", 30*time.Second),
+		Run:      voiceNoteService.TranscribePending,
+	}
+}
+
+// orderVoiceNotes lists a ticket's voice notes (GET) or records one (POST, a
+// multipart "file" field with the recording and a "duration_seconds" field).
+func orderVoiceNotes(w http.ResponseWriter, r *http.Request, orderID string) {
+	switch r.Method {
+	case "GET":
+		notes, err := voiceNoteService.List(orderID)
+		if err != nil {
+			log.Printf("Error listing voice notes of order %s: %v", orderID, err)
+			http.Error(w, "Failed to retrieve voice notes", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(notes)
+
+	case "POST":
+		if !hasPermission(r, PermVoiceNotesRecord) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		// Leave headroom for the multipart envelope around the recording
+		r.Body = http.MaxBytesReader(w, r.Body, maxVoiceNoteBytes+1<<20)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, fmt.Sprintf("Voice notes must be at most %s", formatBytes(maxVoiceNoteBytes)), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "A multipart file field named \"file\" is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		if header.Size > maxVoiceNoteBytes {
+			http.Error(w, fmt.Sprintf("Voice notes must be at most %s", formatBytes(maxVoiceNoteBytes)), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		duration, err := strconv.Atoi(r.FormValue("duration_seconds"))
+		if err != nil || duration < 1 || duration > maxVoiceNoteSeconds {
+			fieldErrors.Add("duration_seconds", fmt.Sprintf("must be between 1 and %d", maxVoiceNoteSeconds))
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		contentType := header.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		note := &VoiceNote{
+			OrderID:         orderID,
+			ContentType:     truncate(contentType, 100),
+			DurationSeconds: duration,
+			RecordedBy:      actorID(r),
+		}
+		usages, err := voiceNoteService.Record(note, truncate(filepath.Base(header.Filename), 255), file)
+		var guardErr *StatusGuardError
+		if errors.As(err, &guardErr) {
+			http.Error(w, guardErr.Error(), http.StatusConflict)
+			return
+		}
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			http.Error(w, quotaErr.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var typeErr *AttachmentTypeError
+		if errors.As(err, &typeErr) {
+			http.Error(w, "Voice notes must be MP3, M4A, AAC, Ogg, WebM or WAV recordings", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error recording voice note for order %s: %v", orderID, err)
+			http.Error(w, "Failed to store voice note", http.StatusInternalServerError)
+			return
+		}
+
+		for _, warning := range attachmentService.quotaWarnings(usages) {
+			log.Printf("Storage warning: %s", warning)
+		}
+		auditService.Record(r, AuditVoiceNoteAdded, "order", orderID, nil, note)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(note)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Repairs carry a shop guarantee: labor and parts each have their own window
+// that starts when the customer collects the device. A device that comes
+// back inside an active window gets a warranty ticket on which the covered
+// work is free. Warranty tickets carry no guarantee of their own to claim
+// against, so claims always point at the original repair.
+
+const repairWarrantiesTable = `
+	CREATE TABLE IF NOT EXISTS repair_warranties (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		item_description VARCHAR(255) NOT NULL,
+		kind ENUM('labor', 'parts') NOT NULL DEFAULT 'labor',
+		days INT NOT NULL,
+		starts_at TIMESTAMP NULL,
+		expires_at TIMESTAMP NULL,
+		INDEX idx_repair_warranties_order (order_id),
+		INDEX idx_repair_warranties_expires (expires_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Warranty kinds
+const (
+	WarrantyLabor = "labor"
+	WarrantyParts = "parts"
+)
+
+// noWarranty as an item's WarrantyDays marks it as not covered, e.g. a data
+// backup rather than a repair.
+const noWarranty = -1
+
+// RepairWarranty is the shop guarantee on one repaired item. StartsAt and
+// ExpiresAt stay empty until the device is collected.
+type RepairWarranty struct {
+	ID              int64      `json:"id"`
+	OrderID         string     `json:"order_id"`
+	ItemDescription string     `json:"item_description"`
+	Kind            string     `json:"kind"`
+	Days            int        `json:"days"`
+	StartsAt        *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	Active          bool       `json:"active"`
+}
+
+// defaultWarrantyDays returns the configured window for a kind of work.
+func defaultWarrantyDays(kind string) int {
+	if kind == WarrantyParts {
+		return getEnvInt("REPAIR_WARRANTY_PARTS_DAYS", 365)
+	}
+	return getEnvInt("REPAIR_WARRANTY_LABOR_DAYS", 90)
+}
+
+func insertRepairWarranty(tx *sql.Tx, orderID, description, kind string, days int) error {
+	if kind != WarrantyParts {
+		kind = WarrantyLabor
+	}
+	if days <= 0 {
+		days = defaultWarrantyDays(kind)
+	}
+	_, err := tx.Exec(`INSERT INTO repair_warranties (order_id, item_description, kind, days) VALUES (?, ?, ?, ?)`,
+		orderID, truncate(description, 255), kind, days)
+	return err
+}
+
+// projectRepairWarranties keeps repair_warranties in step with ticket events:
+// every service or item gets a warranty, and collection starts the clock.
+func projectRepairWarranties(tx *sql.Tx, event *TicketEvent) error {
+	switch event.Type {
+	case EventTicketCreated:
+		var order Order
+		if err := json.Unmarshal(event.Payload, &order); err != nil {
+			return err
+		}
+		for _, service := range order.Services {
+			if err := insertRepairWarranty(tx, order.ID, service, WarrantyLabor, 0); err != nil {
+				return err
+			}
+		}
+
+	case EventItemAdded:
+		var payload ItemAddedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		if payload.WarrantyDays == noWarranty {
+			return nil
+		}
+		return insertRepairWarranty(tx, event.TicketID, payload.Description, payload.WarrantyKind, payload.WarrantyDays)
+
+	case EventTicketSplit:
+		// Items moved to another ticket take their warranty with them
+		var payload TicketSplitPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		for _, item := range payload.Items {
+			_, err := tx.Exec(`DELETE FROM repair_warranties WHERE order_id = ? AND item_description = ? ORDER BY id DESC LIMIT 1`,
+				event.TicketID, item.Description)
+			if err != nil {
+				return err
+			}
+		}
+
+	case EventStatusChanged:
+		var payload StatusChangedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		if payload.To == "Collected" {
+			_, err := tx.Exec(`
+				UPDATE repair_warranties
+				SET starts_at = ?, expires_at = DATE_ADD(?, INTERVAL days DAY)
+				WHERE order_id = ? AND starts_at IS NULL
+			`, event.OccurredAt, event.OccurredAt, event.TicketID)
+			return err
+		}
+	}
+	return nil
+}
+
+// WarrantyService handles repair warranty database operations
+type WarrantyService struct {
+	db *sql.DB
+}
+
+func NewWarrantyService(database *sql.DB) *WarrantyService {
+	return &WarrantyService{db: database}
+}
+
+// ActiveWarrantyForSerial returns the most recently started warranty still
+// in force for a device serial, or nil if there is none. The serial may be
+// any device of the warranted ticket, which is never a warranty ticket itself.
+func (ws *WarrantyService) ActiveWarrantyForSerial(serial string) (*RepairWarranty, error) {
+	warranties, err := ws.queryWarranties(`
+		SELECT w.id, w.order_id, w.item_description, w.kind, w.days, w.starts_at, w.expires_at
+		FROM repair_warranties w JOIN orders o ON o.id = w.order_id
+		WHERE (o.device_serial = ? OR EXISTS (
+		       SELECT 1 FROM ticket_devices d WHERE d.order_id = o.id AND d.device_serial = ?))
+		  AND o.warranty_claim_of IS NULL
+		  AND w.expires_at > NOW()
+		ORDER BY w.starts_at DESC LIMIT 1
+	`, serial, serial)
+	if err != nil || len(warranties) == 0 {
+		return nil, err
+	}
+	return &warranties[0], nil
+}
+
+// WarrantyCover is the work a warranty ticket gets free: the items of the
+// warranted ticket whose warranties are still in force.
+type WarrantyCover struct {
+	OrderID string
+	Items   []string
+}
+
+// Covers reports whether the work described is covered. A nil cover covers
+// nothing.
+func (c *WarrantyCover) Covers(description string) bool {
+	if c == nil {
+		return false
+	}
+	description = strings.TrimSpace(description)
+	return slices.ContainsFunc(c.Items, func(item string) bool {
+		return strings.EqualFold(strings.TrimSpace(item), description)
+	})
+}
+
+// markWarrantyClaim makes a ticket whose device comes back within a repair
+// warranty window a warranty ticket of the warranted one and returns its
+// cover, or nil. The intake quote is zeroed only when every service booked
+// in is covered; a bounce-back listing no services is the warranted work
+// again. Other work is charged as quoted.
+func (ws *WarrantyService) markWarrantyClaim(order *Order) (*WarrantyCover, error) {
+	order.WarrantyClaimOf = ""
+	warranty, err := ws.ActiveWarrantyForDevices(order)
+	if err != nil || warranty == nil {
+		return nil, err
+	}
+	warranties, err := ws.WarrantiesForOrder(warranty.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	cover := &WarrantyCover{OrderID: warranty.OrderID}
+	for _, w := range warranties {
+		if w.Active {
+			cover.Items = append(cover.Items, w.ItemDescription)
+		}
+	}
+	order.WarrantyClaimOf = cover.OrderID
+	if !slices.ContainsFunc(order.Services, func(service string) bool { return !cover.Covers(service) }) {
+		order.TotalCost = 0
+	}
+	return cover, nil
+}
+
+// ActiveWarrantyForDevices returns the first warranty still in force for
+// any device being booked in on a ticket, or nil if there is none.
+func (ws *WarrantyService) ActiveWarrantyForDevices(order *Order) (*RepairWarranty, error) {
+	for _, serial := range intakeSerials(order) {
+		warranty, err := ws.ActiveWarrantyForSerial(serial)
+		if err != nil || warranty != nil {
+			return warranty, err
+		}
+	}
+	return nil, nil
+}
+
+func (ws *WarrantyService) WarrantiesForOrder(orderID string) ([]RepairWarranty, error) {
+	return ws.queryWarranties(`
+		SELECT id, order_id, item_description, kind, days, starts_at, expires_at
+		FROM repair_warranties WHERE order_id = ? ORDER BY id
+	`, orderID)
+}
+
+func (ws *WarrantyService) queryWarranties(query string, args ...interface{}) ([]RepairWarranty, error) {
+	rows, err := ws.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warranties := []RepairWarranty{}
+	now := time.Now()
+	for rows.Next() {
+		var w RepairWarranty
+		var startsAt, expiresAt sql.NullTime
+		if err := rows.Scan(&w.ID, &w.OrderID, &w.ItemDescription, &w.Kind, &w.Days, &startsAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		w.StartsAt = timePtr(startsAt)
+		w.ExpiresAt = timePtr(expiresAt)
+		w.Active = w.ExpiresAt != nil && w.ExpiresAt.After(now)
+		warranties = append(warranties, w)
+	}
+	return warranties, rows.Err()
+}
+
+var warrantyService *WarrantyService
+
+// DeviceHistoryEntry is one past ticket for a device with its warranties.
+type DeviceHistoryEntry struct {
+	Order      Order            `json:"order"`
+	Warranties []RepairWarranty `json:"warranties"`
+	TheftCheck *TheftCheck      `json:"theft_check,omitempty"` // Registry check made at intake
+}
+
+// DeviceHistoryHandler lists every ticket for a device serial together with
+// the repair warranties each one carries and its intake theft check.
+func DeviceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serial := r.URL.Query().Get("serial")
+	if serial == "" {
+		http.Error(w, "serial is required", http.StatusBadRequest)
+		return
+	}
+
+	orders, err := orderService.queryOrders(`SELECT `+orderColumns+` FROM orders WHERE `+deviceSerialClause+` AND deleted_at IS NULL ORDER BY created_at DESC`, serial, serial)
+	if err != nil {
+		log.Printf("Error retrieving device history for %s: %v", serial, err)
+		http.Error(w, "Failed to retrieve device history", http.StatusInternalServerError)
+		return
+	}
+
+	piiPolicyFor(r).shapeOrders(orders)
+	history := []DeviceHistoryEntry{}
+	for _, order := range orders {
+		warranties, err := warrantyService.WarrantiesForOrder(order.ID)
+		if err != nil {
+			log.Printf("Error retrieving warranties for order %s: %v", order.ID, err)
+			http.Error(w, "Failed to retrieve device history", http.StatusInternalServerError)
+			return
+		}
+		theftCheck, err := theftCheckService.CheckForOrder(order.ID)
+		if err != nil {
+			log.Printf("Error retrieving theft check for order %s: %v", order.ID, err)
+			http.Error(w, "Failed to retrieve device history", http.StatusInternalServerError)
+			return
+		}
+		history = append(history, DeviceHistoryEntry{Order: order, Warranties: warranties, TheftCheck: theftCheck})
+	}
+
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every change to part stock is written to stock_movements, so the count on
+// hand can be explained: builds invoiced, parts scrapped during a repair,
+// admin adjustments, and cores. A core is the defective part pulled from a
+// customer's device when it is replaced; vendors credit it back when it is
+// returned. Cores are counted separately from sellable stock (cores_on_hand)
+// and follow held -> returned -> credited, or are rejected, either by the
+// shop before shipping (scrapped) or by the vendor after.
+
+const stockMovementsTable = `
+	CREATE TABLE IF NOT EXISTS stock_movements (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		part_sku VARCHAR(64) NOT NULL,
+		bucket ENUM('stock', 'cores') NOT NULL DEFAULT 'stock',
+		quantity INT NOT NULL,
+		reason VARCHAR(30) NOT NULL,
+		unit_cost DECIMAL(10,2) NOT NULL DEFAULT 0,
+		order_id VARCHAR(50) NULL,
+		core_id BIGINT NULL,
+		note VARCHAR(500) NULL,
+		actor_id VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_stock_movements_part (part_sku, created_at),
+		INDEX idx_stock_movements_reason (reason, created_at),
+		FOREIGN KEY (part_sku) REFERENCES parts(sku)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+const partCoresTable = `
+	CREATE TABLE IF NOT EXISTS part_cores (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(50) NOT NULL,
+		part_sku VARCHAR(64) NOT NULL,
+		serial VARCHAR(100) NULL,
+		notes VARCHAR(500) NULL,
+		status ENUM('held', 'returned', 'credited', 'rejected') NOT NULL DEFAULT 'held',
+		vendor_reference VARCHAR(100) NULL,
+		credit_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+		engineer_id VARCHAR(50) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		returned_at TIMESTAMP NULL,
+		resolved_at TIMESTAMP NULL,
+		resolved_by VARCHAR(50) NULL,
+		INDEX idx_part_cores_status (status),
+		INDEX idx_part_cores_order (order_id),
+		FOREIGN KEY (order_id) REFERENCES orders(id),
+		FOREIGN KEY (part_sku) REFERENCES parts(sku)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// Stock movement reasons
+const (
+	MovementBuild        = "build"         // Components of an invoiced build
+	MovementScrap        = "scrap"         // Damaged or wasted during a repair
+	MovementAdjustment   = "adjustment"    // Count changed by an admin
+	MovementCoreReceived = "core_received" // Pulled from a customer device
+	MovementCoreReturned = "core_returned" // Shipped to the vendor
+	MovementCoreScrapped = "core_scrapped" // Rejected before shipping
+)
+
+// Core statuses
+const (
+	CoreHeld     = "held"
+	CoreReturned = "returned"
+	CoreCredited = "credited"
+	CoreRejected = "rejected"
+)
+
+var coreStatuses = []string{CoreHeld, CoreReturned, CoreCredited, CoreRejected}
+
+// coreTransitions lists the statuses a core can move to from each status.
+var coreTransitions = map[string][]string{
+	CoreHeld:     {CoreReturned, CoreRejected},
+	CoreReturned: {CoreCredited, CoreRejected},
+}
+
+var (
+	errCoreTransition     = errors.New("the core cannot move to that status")
+	errScrapInsufficient  = errors.New("not enough stock to scrap")
+	errCoreCreditRequired = errors.New("a credited core needs its credit amount")
+)
+
+// StockMovement is one change to a part's stock or core count.
+type StockMovement struct {
+	ID        int64     `json:"id"`
+	PartSKU   string    `json:"part_sku"`
+	Bucket    string    `json:"bucket"`
+	Quantity  int       `json:"quantity"` // Negative when stock leaves
+	Reason    string    `json:"reason"`
+	UnitCost  Money     `json:"unit_cost"`
+	Lot       string    `json:"lot,omitempty"` // Supplier lot the stock came in or left from (lots.go)
+	OrderID   string    `json:"order_id,omitempty"`
+	CoreID    int64     `json:"core_id,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	ActorID   string    `json:"actor_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordStockMovement writes a movement in the transaction that changed the
+// count, costed at the part's current unit cost unless the movement gives
+// one (a receipt's purchase price).
+func recordStockMovement(tx execer, movement StockMovement) error {
+	if movement.Bucket == "" {
+		movement.Bucket = "stock"
+	}
+	var unitCost interface{}
+	if movement.UnitCost > 0 {
+		unitCost = movement.UnitCost
+	}
+	_, err := tx.Exec(`
+		INSERT INTO stock_movements (part_sku, bucket, quantity, reason, unit_cost, lot, order_id, core_id, note, actor_id)
+		SELECT sku, ?, ?, ?, COALESCE(?, unit_cost), ?, ?, ?, ?, ? FROM parts WHERE sku = ?
+	`, movement.Bucket, movement.Quantity, movement.Reason, unitCost, nullString(movement.Lot), nullString(movement.OrderID),
+		sql.NullInt64{Int64: movement.CoreID, Valid: movement.CoreID != 0}, nullString(movement.Note),
+		nullString(movement.ActorID), movement.PartSKU)
+	return err
+}
+
+// PartCore is a defective part held for a vendor return credit.
+type PartCore struct {
+	ID              int64      `json:"id"`
+	OrderID         string     `json:"order_id"`
+	PartSKU         string     `json:"part_sku"`
+	PartName        string     `json:"part_name,omitempty"`
+	Serial          string     `json:"serial,omitempty"`
+	Notes           string     `json:"notes,omitempty"`
+	Status          string     `json:"status"`
+	VendorReference string     `json:"vendor_reference,omitempty"` // RMA number
+	CreditAmount    Money      `json:"credit_amount"`
+	EngineerID      string     `json:"engineer_id,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ReturnedAt      *time.Time `json:"returned_at,omitempty"`
+	ResolvedAt      *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy      string     `json:"resolved_by,omitempty"`
+}
+
+// WastageLine is scrapped stock grouped by engineer or SKU.
+type WastageLine struct {
+	Key      string `json:"key"`
+	Name     string `json:"name,omitempty"`
+	Quantity int    `json:"quantity"`
+	Cost     Money  `json:"cost"`
+}
+
+// CoreSummary totals the cores pulled in a period.
+type CoreSummary struct {
+	Pulled   int   `json:"pulled"`
+	Pending  int   `json:"pending"` // Held or returned, awaiting credit
+	Credited int   `json:"credited"`
+	Rejected int   `json:"rejected"`
+	Credit   Money `json:"credit"`
+}
+
+// WastageReport is scrapped stock and core credits for a period.
+type WastageReport struct {
+	Range      ReportRange   `json:"range"`
+	ByEngineer []WastageLine `json:"by_engineer"`
+	BySKU      []WastageLine `json:"by_sku"`
+	Quantity   int           `json:"quantity"`
+	Cost       Money         `json:"cost"`
+	Cores      CoreSummary   `json:"cores"`
+}
+
+// WastageService records scrapped parts and cores
+type WastageService struct {
+	db *sql.DB
+}
+
+func NewWastageService(database *sql.DB) *WastageService {
+	return &WastageService{db: database}
+}
+
+// checkOrderExists returns sql.ErrNoRows for an unknown ticket.
+func checkOrderExists(q rowQuerier, orderID string) error {
+	var exists int
+	return q.QueryRow(`SELECT 1 FROM orders WHERE id = ?`, orderID).Scan(&exists)
+}
+
+// Scrap takes wasted parts out of stock, optionally against a ticket.
+func (ws *WastageService) Scrap(movement StockMovement) error {
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if movement.OrderID != "" {
+		if err := checkOrderExists(tx, movement.OrderID); err != nil {
+			return err
+		}
+	}
+	var onHand int
+	err = tx.QueryRow(`SELECT quantity_on_hand FROM parts WHERE sku = ? FOR UPDATE`, movement.PartSKU).Scan(&onHand)
+	if err == sql.ErrNoRows {
+		return errUnknownPart
+	}
+	if err != nil {
+		return err
+	}
+	if onHand < movement.Quantity {
+		return errScrapInsufficient
+	}
+	if _, err := tx.Exec(`UPDATE parts SET quantity_on_hand = quantity_on_hand - ? WHERE sku = ?`,
+		movement.Quantity, movement.PartSKU); err != nil {
+		return err
+	}
+
+	movement.Quantity = -movement.Quantity
+	movement.Reason = MovementScrap
+	if _, err := takeFromLots(tx, movement, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReceiveCore records a core pulled from a ticket's device.
+func (ws *WastageService) ReceiveCore(core *PartCore) error {
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkOrderExists(tx, core.OrderID); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`UPDATE parts SET cores_on_hand = cores_on_hand + 1 WHERE sku = ?`, core.PartSKU)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errUnknownPart
+	}
+
+	result, err = tx.Exec(`
+		INSERT INTO part_cores (order_id, part_sku, serial, notes, engineer_id) VALUES (?, ?, ?, ?, ?)
+	`, core.OrderID, core.PartSKU, nullString(core.Serial), nullString(core.Notes), nullString(core.EngineerID))
+	if err != nil {
+		return err
+	}
+	if core.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	err = recordStockMovement(tx, StockMovement{
+		PartSKU: core.PartSKU, Bucket: "cores", Quantity: 1, Reason: MovementCoreReceived,
+		OrderID: core.OrderID, CoreID: core.ID, ActorID: core.EngineerID,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResolveCore moves a core along its return flow. A core leaving the shop,
+// returned or scrapped, comes off cores_on_hand.
+func (ws *WastageService) ResolveCore(id int64, status, vendorReference string, credit Money, actorID string) (*PartCore, error) {
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	core, err := scanCore(tx.QueryRow(`SELECT `+coreColumns+` FROM part_cores c JOIN parts p ON p.sku = c.part_sku
+		WHERE c.id = ? FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(coreTransitions[core.Status], status) {
+		return nil, errCoreTransition
+	}
+	if status == CoreCredited && credit <= 0 {
+		return nil, errCoreCreditRequired
+	}
+
+	switch {
+	case status == CoreReturned:
+		_, err = tx.Exec(`UPDATE part_cores SET status = ?, vendor_reference = COALESCE(?, vendor_reference), returned_at = NOW()
+			WHERE id = ?`, status, nullString(vendorReference), id)
+	default:
+		_, err = tx.Exec(`UPDATE part_cores SET status = ?, vendor_reference = COALESCE(?, vendor_reference), credit_amount = ?,
+			resolved_at = NOW(), resolved_by = ? WHERE id = ?`, status, nullString(vendorReference), credit, nullString(actorID), id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if core.Status == CoreHeld {
+		reason := MovementCoreReturned
+		if status == CoreRejected {
+			reason = MovementCoreScrapped
+		}
+		if _, err := tx.Exec(`UPDATE parts SET cores_on_hand = GREATEST(cores_on_hand - 1, 0) WHERE sku = ?`, core.PartSKU); err != nil {
+			return nil, err
+		}
+		err = recordStockMovement(tx, StockMovement{
+			PartSKU: core.PartSKU, Bucket: "cores", Quantity: -1, Reason: reason,
+			OrderID: core.OrderID, CoreID: core.ID, Note: vendorReference, ActorID: actorID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return core, nil
+}
+
+const coreColumns = `c.id, c.order_id, c.part_sku, p.name, c.serial, c.notes, c.status, c.vendor_reference,
+	c.credit_amount, c.engineer_id, c.created_at, c.returned_at, c.resolved_at, c.resolved_by`
+
+func scanCore(row rowScanner) (*PartCore, error) {
+	var core PartCore
+	var serial, notes, vendorReference, engineerID, resolvedBy sql.NullString
+	var returnedAt, resolvedAt sql.NullTime
+	err := row.Scan(&core.ID, &core.OrderID, &core.PartSKU, &core.PartName, &serial, &notes, &core.Status,
+		&vendorReference, &core.CreditAmount, &engineerID, &core.CreatedAt, &returnedAt, &resolvedAt, &resolvedBy)
+	if err != nil {
+		return nil, err
+	}
+	core.Serial = serial.String
+	core.Notes = notes.String
+	core.VendorReference = vendorReference.String
+	core.EngineerID = engineerID.String
+	core.ReturnedAt = timePtr(returnedAt)
+	core.ResolvedAt = timePtr(resolvedAt)
+	core.ResolvedBy = resolvedBy.String
+	return &core, nil
+}
+
+// ListCores returns cores, newest first, optionally of one status or ticket.
+func (ws *WastageService) ListCores(status, orderID string) ([]PartCore, error) {
+	var where []string
+	var args []interface{}
+	if status != "" {
+		where = append(where, "c.status = ?")
+		args = append(args, status)
+	}
+	if orderID != "" {
+		where = append(where, "c.order_id = ?")
+		args = append(args, orderID)
+	}
+	query := `SELECT ` + coreColumns + ` FROM part_cores c JOIN parts p ON p.sku = c.part_sku`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+
+	rows, err := ws.db.Query(query+` ORDER BY c.created_at DESC, c.id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cores := []PartCore{}
+	for rows.Next() {
+		core, err := scanCore(rows)
+		if err != nil {
+			return nil, err
+		}
+		cores = append(cores, *core)
+	}
+	return cores, rows.Err()
+}
+
+// Movements returns a part's most recent stock movements.
+func (ws *WastageService) Movements(sku string, limit int) ([]StockMovement, error) {
+	rows, err := ws.db.Query(`
+		SELECT id, part_sku, bucket, quantity, reason, unit_cost, lot, order_id, core_id, note, actor_id, created_at
+		FROM stock_movements WHERE part_sku = ? ORDER BY created_at DESC, id DESC LIMIT ?
+	`, sku, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movements := []StockMovement{}
+	for rows.Next() {
+		var movement StockMovement
+		var lot, orderID, note, actorID sql.NullString
+		var coreID sql.NullInt64
+		if err := rows.Scan(&movement.ID, &movement.PartSKU, &movement.Bucket, &movement.Quantity, &movement.Reason,
+			&movement.UnitCost, &lot, &orderID, &coreID, &note, &actorID, &movement.CreatedAt); err != nil {
+			return nil, err
+		}
+		movement.Lot = lot.String
+		movement.OrderID = orderID.String
+		movement.CoreID = coreID.Int64
+		movement.Note = note.String
+		movement.ActorID = actorID.String
+		movements = append(movements, movement)
+	}
+	return movements, rows.Err()
+}
+
+// wastageLines groups the period's scrapped stock by a column.
+func (ws *WastageService) wastageLines(period ReportRange, key, name, join string) ([]WastageLine, error) {
+	rows, err := ws.db.Query(`
+		SELECT COALESCE(`+key+`, ''), MAX(`+name+`), SUM(-m.quantity), SUM(-m.quantity * m.unit_cost)
+		FROM stock_movements m `+join+`
+		WHERE m.reason = ? AND m.created_at >= ? AND m.created_at < ?
+		GROUP BY `+key+`
+		ORDER BY 4 DESC
+	`, MovementScrap, period.From, period.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []WastageLine{}
+	for rows.Next() {
+		var line WastageLine
+		var lineName sql.NullString
+		if err := rows.Scan(&line.Key, &lineName, &line.Quantity, &line.Cost); err != nil {
+			return nil, err
+		}
+		line.Name = lineName.String
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// Report totals a period's scrapped stock by engineer and SKU, and the cores
+// pulled in it.
+func (ws *WastageService) Report(period ReportRange) (*WastageReport, error) {
+	report := &WastageReport{Range: period}
+	var err error
+	report.ByEngineer, err = ws.wastageLines(period, "m.actor_id", "u.full_name", "LEFT JOIN users u ON u.id = m.actor_id")
+	if err != nil {
+		return nil, err
+	}
+	report.BySKU, err = ws.wastageLines(period, "m.part_sku", "p.name", "JOIN parts p ON p.sku = m.part_sku")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range report.BySKU {
+		report.Quantity += line.Quantity
+		report.Cost += line.Cost
+	}
+
+	err = ws.db.QueryRow(`
+		SELECT COUNT(*),
+		       COALESCE(SUM(status IN (?, ?)), 0),
+		       COALESCE(SUM(status = ?), 0),
+		       COALESCE(SUM(status = ?), 0),
+		       COALESCE(SUM(credit_amount), 0)
+		FROM part_cores WHERE created_at >= ? AND created_at < ?
+	`, CoreHeld, CoreReturned, CoreCredited, CoreRejected, period.From, period.To).Scan(
+		&report.Cores.Pulled, &report.Cores.Pending, &report.Cores.Credited, &report.Cores.Rejected, &report.Cores.Credit)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+var wastageService *WastageService
+
+// PartScrapHandler takes wasted parts out of stock (POST {"part_sku":
+// "...", "quantity": 1, "order_id": "...", "note": "Cracked during fitting"}).
+func PartScrapHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		PartSKU  string `json:"part_sku"`
+		Quantity int    `json:"quantity"`
+		OrderID  string `json:"order_id"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	request.Note = strings.TrimSpace(request.Note)
+	if request.PartSKU == "" {
+		fieldErrors.Add("part_sku", "is required")
+	}
+	if request.Quantity < 1 {
+		fieldErrors.Add("quantity", "must be at least 1")
+	}
+	if request.Note == "" {
+		fieldErrors.Add("note", "is required")
+	} else if len(request.Note) > 500 {
+		fieldErrors.Add("note", "is too long")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := wastageService.Scrap(StockMovement{
+		PartSKU: request.PartSKU, Quantity: request.Quantity, OrderID: request.OrderID,
+		Note: request.Note, ActorID: actorID(r),
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	case err == errUnknownPart:
+		http.Error(w, "Part not found", http.StatusNotFound)
+		return
+	case err == errScrapInsufficient:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Error scrapping part %s: %v", request.PartSKU, err)
+		http.Error(w, "Failed to record scrapped part", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%d x %s scrapped by %s", request.Quantity, request.PartSKU, actorID(r))
+	auditService.Record(r, AuditPartScrapped, "part", request.PartSKU, nil, request)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Scrapped part recorded successfully",
+	})
+}
+
+// PartCoresHandler lists cores (GET ?status=&order_id=), records one pulled
+// from a device (POST {"order_id": "...", "part_sku": "...", "serial":
+// "..."}) or moves one along the return flow (PUT {"id": 3, "status":
+// "credited", "credit_amount": "1200.00", "vendor_reference": "RMA-5521"}).
+func PartCoresHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		status := r.URL.Query().Get("status")
+		if status != "" && !slices.Contains(coreStatuses, status) {
+			http.Error(w, "status must be held, returned, credited or rejected", http.StatusBadRequest)
+			return
+		}
+		cores, err := wastageService.ListCores(status, r.URL.Query().Get("order_id"))
+		if err != nil {
+			log.Printf("Error listing cores: %v", err)
+			http.Error(w, "Failed to retrieve cores", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(cores)
+
+	case "POST":
+		if !hasPermission(r, PermPartsWastage) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			OrderID string `json:"order_id"`
+			PartSKU string `json:"part_sku"`
+			Serial  string `json:"serial"`
+			Notes   string `json:"notes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		request.Serial = strings.TrimSpace(request.Serial)
+		request.Notes = strings.TrimSpace(request.Notes)
+		if request.OrderID == "" {
+			fieldErrors.Add("order_id", "is required")
+		}
+		if request.PartSKU == "" {
+			fieldErrors.Add("part_sku", "is required")
+		}
+		if len(request.Serial) > 100 {
+			fieldErrors.Add("serial", "is too long")
+		}
+		if len(request.Notes) > 500 {
+			fieldErrors.Add("notes", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		core := &PartCore{
+			OrderID: request.OrderID, PartSKU: request.PartSKU, Serial: request.Serial,
+			Notes: request.Notes, EngineerID: actorID(r),
+		}
+		err := wastageService.ReceiveCore(core)
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		case err == errUnknownPart:
+			http.Error(w, "Part not found", http.StatusNotFound)
+			return
+		case err != nil:
+			log.Printf("Error recording core for order %s: %v", request.OrderID, err)
+			http.Error(w, "Failed to record core", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditCoreReceived, "order", request.OrderID, nil, request)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Core recorded successfully",
+			"id":      core.ID,
+		})
+
+	case "PUT":
+		if !hasPermission(r, PermPartsCores) {
+			http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			ID              int64  `json:"id"`
+			Status          string `json:"status"`
+			VendorReference string `json:"vendor_reference"`
+			CreditAmount    Money  `json:"credit_amount"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var fieldErrors ValidationErrors
+		request.VendorReference = strings.TrimSpace(request.VendorReference)
+		if request.ID == 0 {
+			fieldErrors.Add("id", "is required")
+		}
+		if request.Status != CoreReturned && request.Status != CoreCredited && request.Status != CoreRejected {
+			fieldErrors.Add("status", "must be returned, credited or rejected")
+		}
+		if request.CreditAmount < 0 {
+			fieldErrors.Add("credit_amount", "must not be negative")
+		}
+		if len(request.VendorReference) > 100 {
+			fieldErrors.Add("vendor_reference", "is too long")
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+
+		previous, err := wastageService.ResolveCore(request.ID, request.Status, request.VendorReference,
+			request.CreditAmount, actorID(r))
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "Core not found", http.StatusNotFound)
+			return
+		case err == errCoreTransition:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err == errCoreCreditRequired:
+			writeValidationErrors(w, ValidationErrors{{Field: "credit_amount", Message: "is required for a credited core"}})
+			return
+		case err != nil:
+			log.Printf("Error updating core %d: %v", request.ID, err)
+			http.Error(w, "Failed to update core", http.StatusInternalServerError)
+			return
+		}
+
+		auditService.Record(r, AuditCoreResolved, "order", previous.OrderID,
+			map[string]string{"status": previous.Status}, request)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Core updated successfully",
+		})
+
+	default:
+		http.Error(w, "Only GET, POST and PUT methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PartMovementsHandler lists a part's stock movements (GET ?sku=&limit=100).
+func PartMovementsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sku := r.URL.Query().Get("sku")
+	if sku == "" {
+		http.Error(w, "sku is required", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	movements, err := wastageService.Movements(sku, limit)
+	if err != nil {
+		log.Printf("Error listing movements of part %s: %v", sku, err)
+		http.Error(w, "Failed to retrieve stock movements", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(movements)
+}
+
+// ReportWastageHandler reports scrapped stock by engineer and SKU, and core
+// credits, for a period.
+func ReportWastageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	period := parseReportRange(r, &fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, err := wastageService.Report(period)
+	if err != nil {
+		log.Printf("Error building wastage report: %v", err)
+		http.Error(w, "Failed to build report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Staff watch tickets they care about, such as a manager keeping an eye on
+// a VIP job, at /api/v1/orders/{id}/watch. Watchers are emailed when the
+// ticket changes status (including cancellation and reopening) and when a
+// note is added to it, except about their own changes. Notices are queued
+// in the same transaction as the change, so a watcher hears of every change
+// that commits and none that doesn't. The ticket detail lists its watchers.
+
+const ticketWatchersTable = `
+	CREATE TABLE IF NOT EXISTS ticket_watchers (
+		order_id VARCHAR(50) NOT NULL,
+		user_id VARCHAR(50) NOT NULL,
+		watched_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (order_id, user_id),
+		INDEX idx_ticket_watchers_user (user_id),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`
+
+// TicketWatcher is a staff member watching a ticket.
+type TicketWatcher struct {
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	WatchedAt time.Time `json:"watched_at"`
+}
+
+// WatchNotice emails a watcher about a change to a ticket.
+type WatchNotice struct {
+	OrderID   string `json:"order_id"`
+	Change    string `json:"change"`          // e.g. "moved from New Order to In Progress"
+	Note      string `json:"note,omitempty"`  // The note added, shortened
+	ActorName string `json:"actor,omitempty"` // Who made the change
+	Recipient string `json:"recipient"`
+}
+
+// WatcherService keeps who watches which tickets
+type WatcherService struct {
+	db *sql.DB
+}
+
+func NewWatcherService(database *sql.DB) *WatcherService {
+	return &WatcherService{db: database}
+}
+
+var watcherService *WatcherService
+
+// Watchers returns a ticket's watchers, earliest first.
+func (ws *WatcherService) Watchers(orderID string) ([]TicketWatcher, error) {
+	rows, err := ws.db.Query(`
+		SELECT w.user_id, u.full_name, w.watched_at
+		FROM ticket_watchers w JOIN users u ON u.id = w.user_id
+		WHERE w.order_id = ?
+		ORDER BY w.watched_at, w.user_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watchers := []TicketWatcher{}
+	for rows.Next() {
+		var watcher TicketWatcher
+		if err := rows.Scan(&watcher.UserID, &watcher.Name, &watcher.WatchedAt); err != nil {
+			return nil, err
+		}
+		watchers = append(watchers, watcher)
+	}
+	return watchers, rows.Err()
+}
+
+// Watch adds userID to a ticket's watchers; watching it again changes
+// nothing.
+func (ws *WatcherService) Watch(orderID, userID string) error {
+	var exists int
+	if err := ws.db.QueryRow(`SELECT 1 FROM orders WHERE id = ?`, orderID).Scan(&exists); err != nil {
+		return err
+	}
+	_, err := ws.db.Exec(`
+		INSERT IGNORE INTO ticket_watchers (order_id, user_id, watched_at) VALUES (?, ?, NOW())
+	`, orderID, userID)
+	return err
+}
+
+// Unwatch removes userID from a ticket's watchers.
+func (ws *WatcherService) Unwatch(orderID, userID string) error {
+	result, err := ws.db.Exec(`DELETE FROM ticket_watchers WHERE order_id = ? AND user_id = ?`, orderID, userID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// notifyWatchers queues a notice of change to every watcher of orderID
+// but actorID.
+func notifyWatchers(tx *sql.Tx, orderID, actorID, change, note string) error {
+	rows, err := tx.Query(`
+		SELECT u.email FROM ticket_watchers w JOIN users u ON u.id = w.user_id
+		WHERE w.order_id = ? AND w.user_id <> ? AND u.approved = TRUE AND u.email <> ''
+	`, orderID, actorID)
+	if err != nil {
+		return err
+	}
+	var recipients []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(recipients) == 0 {
+		return err
+	}
+
+	var actorName sql.NullString
+	if actorID != "" {
+		err := tx.QueryRow(`SELECT full_name FROM users WHERE id = ?`, actorID).Scan(&actorName)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	for _, recipient := range recipients {
+		notice := WatchNotice{OrderID: orderID, Change: change, Note: note, ActorName: actorName.String, Recipient: recipient}
+		if err := enqueueOutbox(tx, "watch.notice", orderID, notice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyEventWatchers notifies a ticket's watchers of status changes.
+func notifyEventWatchers(tx *sql.Tx, event *TicketEvent) error {
+	var change string
+	switch event.Type {
+	case EventStatusChanged:
+		var payload StatusChangedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		change = fmt.Sprintf("moved from %s to %s", payload.From, payload.To)
+	case EventTicketCancelled:
+		var payload TicketCancelledPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		change = fmt.Sprintf("was cancelled (%s)", payload.Reason)
+	case EventTicketReopened:
+		var payload TicketReopenedPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		change = fmt.Sprintf("was reopened (%s)", payload.Reason)
+	default:
+		return nil
+	}
+	return notifyWatchers(tx, event.TicketID, event.ActorID, change, "")
+}
+
+// deliverWatchNotice emails a watcher about a change to a ticket.
+func deliverWatchNotice(msg OutboxMessage) error {
+	var notice WatchNotice
+	if err := json.Unmarshal(msg.Payload, &notice); err != nil {
+		return err
+	}
+	change := notice.Change
+	if notice.ActorName != "" {
+		change += " by " + notice.ActorName
+	}
+	subject := fmt.Sprintf("Ticket %s %s", notice.OrderID, notice.Change)
+	body := fmt.Sprintf("Hello,\n\nTicket %s, which you are watching, %s.\n", notice.OrderID, change)
+	if notice.Note != "" {
+		body += "\n" + notice.Note + "\n"
+	}
+	body += "\nPC Repair Hub"
+	return emailService.Send(notice.OrderID, msg.ID, notice.Recipient, subject, body)
+}
+
+// orderWatch makes the signed-in user watch a ticket (POST) or stop
+// watching it (DELETE), and returns its watchers.
+func orderWatch(w http.ResponseWriter, r *http.Request, orderID string) {
+	userID := actorID(r)
+	if userID == "" {
+		http.Error(w, "This endpoint needs a signed-in user", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "POST":
+		err = watcherService.Watch(orderID, userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+	case "DELETE":
+		err = watcherService.Unwatch(orderID, userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "You are not watching this ticket", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Only POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating watchers of order %s for %s: %v", orderID, userID, err)
+		http.Error(w, "Failed to update watchers", http.StatusInternalServerError)
+		return
+	}
+
+	watchers, err := watcherService.Watchers(orderID)
+	if err != nil {
+		log.Printf("Error retrieving watchers of order %s: %v", orderID, err)
+		http.Error(w, "Failed to update watchers", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"watchers": watchers,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// BackgroundJob is a task the worker runs on a fixed interval.
+type BackgroundJob struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// Worker runs background jobs alongside the HTTP server.
+type Worker struct {
+	jobs []BackgroundJob
+}
+
+func NewWorker() *Worker {
+	return &Worker{}
+}
+
+func (wk *Worker) Register(job BackgroundJob) {
+	wk.jobs = append(wk.jobs, job)
+}
+
+// Start launches one goroutine per job; they stop when ctx is cancelled.
+func (wk *Worker) Start(ctx context.Context) {
+	for _, job := range wk.jobs {
+		go wk.loop(ctx, job)
+	}
+	log.Printf("Background worker started with %d jobs", len(wk.jobs))
+}
+
+func (wk *Worker) loop(ctx context.Context, job BackgroundJob) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		wk.runOnce(ctx, job)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce isolates panics so one failing job cannot take down the server.
+func (wk *Worker) runOnce(ctx context.Context, job BackgroundJob) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("Background job %s panicked: %v", job.Name, recovered)
+		}
+	}()
+
+	if err := job.Run(ctx); err != nil {
+		log.Printf("Background job %s failed: %v", job.Name, err)
+	}
+}
+
+var worker = NewWorker()
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GET /api/v1/engineers/work-orders prints each engineer's work order sheet
+// for the day, for shops where the workshop floor still runs on paper: the
+// engineer's open tickets, most pressing first, with where the device sits
+// on the bench, the parts its latest diagnosis calls for and how many are in
+// stock, and when it was promised. The shop keeps bench locations in a ticket
+// custom field (customfields.go), bench_location unless
+// WORK_ORDER_BENCH_FIELD names another. Customer details are masked as on
+// the ticket screen. ?format=pdf prints one engineer per page and is run and
+// logged as a work_orders export (exportlog.go).
+
+// WorkOrderPart is a part a ticket needs and the stock on hand.
+type WorkOrderPart struct {
+	Description string `json:"description"`
+	SKU         string `json:"sku,omitempty"`
+	Quantity    int    `json:"quantity"`
+	OnHand      *int   `json:"on_hand,omitempty"` // Parts with a SKU only
+}
+
+// WorkOrderTicket is one ticket on an engineer's sheet.
+type WorkOrderTicket struct {
+	OrderID       string          `json:"order_id"`
+	Priority      string          `json:"priority"`
+	Status        string          `json:"status"`
+	HoldState     string          `json:"hold_state,omitempty"`
+	Device        string          `json:"device"`
+	DeviceSerial  string          `json:"device_serial,omitempty"`
+	Customer      string          `json:"customer"`
+	Issue         string          `json:"issue,omitempty"`
+	BenchLocation string          `json:"bench_location,omitempty"`
+	PromisedDate  *time.Time      `json:"promised_date,omitempty"` // Expected delivery date
+	SLADueAt      *time.Time      `json:"sla_due_at,omitempty"`
+	Parts         []WorkOrderPart `json:"parts"`
+}
+
+// WorkOrderSheet is one engineer's work order for the day.
+type WorkOrderSheet struct {
+	EngineerID   string            `json:"engineer_id"`
+	EngineerName string            `json:"engineer_name"`
+	Date         string            `json:"date"`
+	Tickets      []WorkOrderTicket `json:"tickets"`
+}
+
+// workOrderBenchField is the ticket custom field holding bench locations.
+func workOrderBenchField() string {
+	return getEnv("WORK_ORDER_BENCH_FIELD", "bench_location")
+}
+
+// WorkOrders returns the sheets of every approved engineer, or of
+// engineerID only, dated now. policy masks the customer details.
+func (os *OrderService) WorkOrders(engineerID string, policy piiPolicy, now time.Time) ([]WorkOrderSheet, error) {
+	query := `SELECT id, full_name FROM users WHERE role = ? AND approved = TRUE`
+	args := []interface{}{RoleEngineer}
+	if engineerID != "" {
+		query += ` AND id = ?`
+		args = append(args, engineerID)
+	}
+	rows, err := os.db.Query(query+` ORDER BY full_name, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	sheets := []WorkOrderSheet{}
+	for rows.Next() {
+		sheet := WorkOrderSheet{Date: now.Format("2006-01-02"), Tickets: []WorkOrderTicket{}}
+		if err := rows.Scan(&sheet.EngineerID, &sheet.EngineerName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sheets = append(sheets, sheet)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if engineerID != "" && len(sheets) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	benchField := workOrderBenchField()
+	for i := range sheets {
+		orders, err := os.queryOrders(`SELECT `+orderColumns+` FROM orders
+			WHERE assigned_engineer_id = ? AND `+myDayOpenClause+`
+			ORDER BY `+orderSorts["priority"], sheets[i].EngineerID)
+		if err != nil {
+			return nil, err
+		}
+		policy.shapeOrders(orders)
+		for _, order := range orders {
+			ticket := WorkOrderTicket{
+				OrderID:       order.ID,
+				Priority:      order.Priority,
+				Status:        order.Status,
+				HoldState:     order.HoldState,
+				Device:        strings.TrimSpace(order.DeviceType + " " + order.DeviceModel),
+				DeviceSerial:  order.DeviceSerial,
+				Customer:      order.CustomerName,
+				Issue:         order.IssueDescription,
+				BenchLocation: order.CustomFields[benchField],
+				PromisedDate:  order.ExpectedDeliveryDate,
+				SLADueAt:      order.SLADueAt,
+			}
+			if ticket.Parts, err = os.workOrderParts(order.ID); err != nil {
+				return nil, err
+			}
+			sheets[i].Tickets = append(sheets[i].Tickets, ticket)
+		}
+	}
+	return sheets, nil
+}
+
+// workOrderParts returns the parts in a ticket's latest diagnosis with the
+// stock on hand of those with a SKU.
+func (os *OrderService) workOrderParts(orderID string) ([]WorkOrderPart, error) {
+	parts := []WorkOrderPart{}
+	diagnosis, err := diagnosisService.Latest(orderID)
+	if err != nil || diagnosis == nil {
+		return parts, err
+	}
+	for _, needed := range diagnosis.PartsNeeded {
+		part := WorkOrderPart{Description: needed.Description, SKU: needed.SKU, Quantity: needed.Quantity}
+		if needed.SKU != "" {
+			var onHand int
+			err := os.db.QueryRow(`SELECT quantity_on_hand FROM parts WHERE sku = ?`, needed.SKU).Scan(&onHand)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			part.OnHand = &onHand
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// BuildWorkOrders lays the sheets out as a PDF, one engineer per page.
+func BuildWorkOrders(sheets []WorkOrderSheet, now time.Time) []byte {
+	locale := shopLocale
+	doc := newPDFDocument()
+	for i, sheet := range sheets {
+		if i > 0 {
+			doc.newPage()
+		}
+		doc.Text("Work order: "+sheet.EngineerName, 18, true, 0)
+		doc.Text(fmt.Sprintf("%s, printed %s, %d tickets", locale.FormatDate(now), locale.FormatDateTime(now), len(sheet.Tickets)),
+			pdfBodySize, false, 0)
+		if len(sheet.Tickets) == 0 {
+			doc.Text("No open tickets assigned.", pdfBodySize, false, 0)
+		}
+		for _, ticket := range sheet.Tickets {
+			doc.Heading(fmt.Sprintf("%s  [%s]  %s", ticket.OrderID, ticket.Priority, ticket.Device))
+			status := ticket.Status
+			if ticket.HoldState != "" {
+				status += ", on hold: " + ticket.HoldState
+			}
+			doc.Field("Status", status)
+			doc.Field("Bench", ticket.BenchLocation)
+			doc.Field("Customer", ticket.Customer)
+			doc.Field("Serial", ticket.DeviceSerial)
+			if ticket.PromisedDate != nil {
+				doc.Field("Promised", locale.FormatDate(*ticket.PromisedDate))
+			}
+			if ticket.SLADueAt != nil {
+				doc.Field("SLA due", locale.FormatDateTime(*ticket.SLADueAt))
+			}
+			doc.Field("Issue", ticket.Issue)
+			for _, part := range ticket.Parts {
+				line := fmt.Sprintf("[ ] %d x %s", part.Quantity, part.Description)
+				if part.SKU != "" {
+					line += fmt.Sprintf(" (%s, %d in stock)", part.SKU, *part.OnHand)
+				}
+				doc.Text(line, pdfBodySize, false, 12)
+			}
+			doc.Text("Work done: ______________________________________________", pdfBodySize, false, 0)
+		}
+	}
+	return doc.Bytes()
+}
+
+// WorkOrdersHandler returns the day's work order sheets of every engineer,
+// or of one with ?engineer_id=, as JSON or with ?format=pdf as a PDF.
+func WorkOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fieldErrors ValidationErrors
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "pdf" {
+		fieldErrors.Add("format", "must be json or pdf")
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if format == "pdf" && !authorizeExport(w, r, ExportWorkOrders, format) {
+		return
+	}
+
+	engineerID := r.URL.Query().Get("engineer_id")
+	now := time.Now()
+	sheets, err := orderService.WorkOrders(engineerID, piiPolicyFor(r), now)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Engineer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error building work orders: %v", err)
+		http.Error(w, "Failed to build work orders", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "pdf" {
+		tickets := 0
+		for _, sheet := range sheets {
+			tickets += len(sheet.Tickets)
+		}
+		recordExport(r, ExportWorkOrders, format, tickets)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="work-orders-%s.pdf"`, now.Format("2006-01-02")))
+		w.Write(BuildWorkOrders(sheets, now))
+		return
+	}
+	json.NewEncoder(w).Encode(sheets)
+}
@@ -15,7 +15,9 @@ CREATE TABLE IF NOT EXISTS users (
     email VARCHAR(255) UNIQUE NOT NULL,
     phone VARCHAR(20) NOT NULL,
     password VARCHAR(255) NOT NULL,
-    role VARCHAR(50) DEFAULT 'User',
+    role VARCHAR(50) DEFAULT 'FrontDesk',
+    approved BOOLEAN NOT NULL DEFAULT TRUE,
+    auth_provider VARCHAR(20) NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     INDEX idx_email (email),
@@ -30,28 +32,1152 @@ CREATE TABLE IF NOT EXISTS orders (
     customer_phone VARCHAR(20) NOT NULL,
     device_type VARCHAR(255) NOT NULL,
     device_model VARCHAR(255),
+    device_serial VARCHAR(100),
     services JSON NOT NULL,
     issue_description TEXT,
-    status ENUM('New Order', 'In Progress', 'Ready for Delivery', 'Collected') DEFAULT 'New Order',
+    status ENUM('New Order', 'In Progress', 'Ready for Delivery', 'Collected', 'Cancelled', 'Reopened') DEFAULT 'New Order',
     total_cost DECIMAL(10,2) NOT NULL,
+    amount_paid DECIMAL(10,2) NOT NULL DEFAULT 0,
     created_by VARCHAR(50),
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     last_updated_by VARCHAR(50),
+    assigned_engineer_id VARCHAR(50),
+    expected_delivery_date DATE,
+    warranty_exp_date DATE,
+    warranty_claim_of VARCHAR(50),
+    data_backup_consent VARCHAR(20),
+    ticket_type VARCHAR(50),
+    device_password VARCHAR(255),
+    deleted_at TIMESTAMP NULL,
+    cancel_reason VARCHAR(500),
+    priority VARCHAR(10) NOT NULL DEFAULT 'Normal',
+    sla_due_at TIMESTAMP NULL,
+    sla_breached_at TIMESTAMP NULL,
+    hold_state VARCHAR(30),
+    hold_reason VARCHAR(500),
+    hold_started_at TIMESTAMP NULL,
+    merged_into VARCHAR(50),
+    split_from VARCHAR(50),
+    parent_ticket_id VARCHAR(50),
+    account_id BIGINT,
+    board_position INT,
+    times_rescheduled INT NOT NULL DEFAULT 0,
     INDEX idx_status (status),
+    INDEX idx_priority (priority),
+    INDEX idx_sla_breached_at (sla_breached_at),
+    INDEX idx_hold_state (hold_state),
+    INDEX idx_split_from (split_from),
+    INDEX idx_parent_ticket (parent_ticket_id),
+    INDEX idx_account (account_id),
+    INDEX idx_deleted_at (deleted_at),
+    INDEX idx_assigned_engineer (assigned_engineer_id),
+    INDEX idx_ticket_type (ticket_type),
     INDEX idx_customer_email (customer_email),
     INDEX idx_created_at (created_at),
     FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
     FOREIGN KEY (last_updated_by) REFERENCES users(id) ON DELETE SET NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
--- Insert sample admin user (password: admin123 - should be hashed in production)
+-- Online migration progress (dual-write/backfill rollouts)
+CREATE TABLE IF NOT EXISTS online_migrations (
+    name VARCHAR(100) PRIMARY KEY,
+    status ENUM('pending', 'running', 'paused', 'completed', 'failed') NOT NULL DEFAULT 'pending',
+    cursor_id VARCHAR(50) NOT NULL DEFAULT '',
+    rows_processed BIGINT NOT NULL DEFAULT 0,
+    rows_total BIGINT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    started_at TIMESTAMP NULL,
+    completed_at TIMESTAMP NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Ticket domain events (source of truth for the orders read model)
+CREATE TABLE IF NOT EXISTS ticket_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    ticket_id VARCHAR(50) NOT NULL,
+    version INT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSON NOT NULL,
+    actor_id VARCHAR(50),
+    occurred_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+    UNIQUE KEY uniq_ticket_version (ticket_id, version),
+    INDEX idx_event_type (event_type),
+    INDEX idx_occurred_at (occurred_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Login sessions holding hashed refresh tokens
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(50) NOT NULL,
+    refresh_token_hash CHAR(64) NOT NULL UNIQUE,
+    user_agent VARCHAR(255),
+    ip_address VARCHAR(45),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL,
+    INDEX idx_sessions_user (user_id),
+    INDEX idx_sessions_expires (expires_at),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Access tokens revoked before expiry (logout, compromised tokens)
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(50) NULL,
+    reason VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_by VARCHAR(50) NULL,
+    revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_revoked_tokens_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Role-permission matrix (defaults are seeded by the backend at startup)
+CREATE TABLE IF NOT EXISTS permissions (
+    name VARCHAR(64) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(20) NOT NULL,
+    permission VARCHAR(64) NOT NULL,
+    granted_by VARCHAR(50) NULL,
+    granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (role, permission),
+    FOREIGN KEY (permission) REFERENCES permissions(name) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Transactional outbox for notifications and webhooks
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    topic VARCHAR(100) NOT NULL,
+    aggregate_id VARCHAR(50) NOT NULL,
+    payload JSON NOT NULL,
+    status ENUM('pending', 'delivered', 'dead') NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP NULL,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP NULL,
+    INDEX idx_outbox_pending (status, next_attempt_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- API keys for machine clients (website intake form, integrations)
+CREATE TABLE IF NOT EXISTS api_keys (
+    id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    key_prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes JSON NOT NULL,
+    created_by VARCHAR(50),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL,
+    revoked_at TIMESTAMP NULL,
+    service_account_id VARCHAR(50) NULL,
+    expires_at TIMESTAMP NULL,
+    INDEX idx_api_keys_service_account (service_account_id),
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Non-interactive clients (kiosks, label printers, website forms) owning scoped tokens
+CREATE TABLE IF NOT EXISTS service_accounts (
+    id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description VARCHAR(500) NULL,
+    scopes JSON NOT NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    disabled_at TIMESTAMP NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- One-time codes and reset tokens for password resets
+CREATE TABLE IF NOT EXISTS password_resets (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id VARCHAR(50) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    verified_at TIMESTAMP NULL,
+    reset_token_hash CHAR(64) NULL UNIQUE,
+    reset_expires_at TIMESTAMP NULL,
+    consumed_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_password_resets_user (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Shop repair warranties per ticket item (clock starts on collection)
+CREATE TABLE IF NOT EXISTS repair_warranties (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    item_description VARCHAR(255) NOT NULL,
+    kind ENUM('labor', 'parts') NOT NULL DEFAULT 'labor',
+    days INT NOT NULL,
+    starts_at TIMESTAMP NULL,
+    expires_at TIMESTAMP NULL,
+    INDEX idx_repair_warranties_order (order_id),
+    INDEX idx_repair_warranties_expires (expires_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Customer-approved data backups taken before wiping or repair
+CREATE TABLE IF NOT EXISTS backup_jobs (
+    order_id VARCHAR(50) PRIMARY KEY,
+    size_gb DECIMAL(10,2) NOT NULL,
+    quoted_price DECIMAL(10,2) NOT NULL,
+    storage_target VARCHAR(255) NOT NULL,
+    checklist JSON NULL,
+    proof_url VARCHAR(500) NULL,
+    status ENUM('quoted', 'verified') NOT NULL DEFAULT 'quoted',
+    created_by VARCHAR(50) NULL,
+    verified_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    verified_at TIMESTAMP NULL,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Managed ticket types with per-type intake defaults
+CREATE TABLE IF NOT EXISTS ticket_types (
+    code VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    sla_hours INT NOT NULL DEFAULT 0,
+    deposit_rule ENUM('none', 'fixed', 'percent') NOT NULL DEFAULT 'none',
+    deposit_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+    deposit_basis_points INT NOT NULL DEFAULT 0,
+    questionnaire JSON NULL,
+    required_fields JSON NULL,
+    required_certification VARCHAR(100) NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_by VARCHAR(50) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+INSERT IGNORE INTO ticket_types (code, name, sla_hours, deposit_rule, deposit_amount, deposit_basis_points, questionnaire) VALUES
+('diagnostics', 'Diagnostics', 48, 'fixed', 500.00, 0, JSON_ARRAY('What symptoms do you see?', 'When did the problem start?')),
+('service', 'Service', 72, 'none', 0, 0, JSON_ARRAY('What work do you need done?')),
+('onsite_visit', 'On-site Visit', 24, 'fixed', 1000.00, 0, JSON_ARRAY('Site address', 'Preferred visit window', 'Parking or access instructions')),
+('remote_support', 'Remote Support', 8, 'none', 0, 0, JSON_ARRAY('Remote access tool available?', 'Operating system')),
+('build_to_order', 'Build-to-order PC', 240, 'percent', 0, 5000, JSON_ARRAY('Intended use', 'Budget', 'Preferred components')),
+('rework', 'Rework', 24, 'none', 0, 0, JSON_ARRAY('What is happening again?', 'Was the original fault fixed when collected?'));
+
+-- On-site service visits with geolocated check-in/check-out
+CREATE TABLE IF NOT EXISTS onsite_visits (
+    id VARCHAR(50) PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    address TEXT NOT NULL,
+    window_start TIMESTAMP NOT NULL,
+    window_end TIMESTAMP NOT NULL,
+    engineer_id VARCHAR(50) NOT NULL,
+    travel_fee DECIMAL(10,2) NOT NULL DEFAULT 0,
+    status ENUM('scheduled', 'checked_in', 'completed') NOT NULL DEFAULT 'scheduled',
+    check_in_at TIMESTAMP NULL,
+    check_in_lat DECIMAL(9,6) NULL,
+    check_in_lng DECIMAL(9,6) NULL,
+    check_out_at TIMESTAMP NULL,
+    check_out_lat DECIMAL(9,6) NULL,
+    check_out_lng DECIMAL(9,6) NULL,
+    report TEXT NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_onsite_visits_order (order_id),
+    INDEX idx_onsite_visits_engineer (engineer_id, window_start),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- System-wide audit log of who did what, with before/after values
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    actor_id VARCHAR(50) NULL,
+    action VARCHAR(100) NOT NULL,
+    entity_type VARCHAR(50) NOT NULL,
+    entity_id VARCHAR(100) NULL,
+    before_value JSON NULL,
+    after_value JSON NULL,
+    ip_address VARCHAR(45) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_audit_actor (actor_id, created_at),
+    INDEX idx_audit_entity (entity_type, entity_id, created_at),
+    INDEX idx_audit_created (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Parts inventory
+CREATE TABLE IF NOT EXISTS parts (
+    sku VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    category VARCHAR(30) NOT NULL,
+    attributes JSON NULL,
+    unit_price DECIMAL(10,2) NOT NULL DEFAULT 0,
+    unit_cost DECIMAL(10,2) NOT NULL DEFAULT 0,
+    supplier_cost DECIMAL(10,2) NULL,
+    supplier_cost_at TIMESTAMP NULL,
+    quantity_on_hand INT NOT NULL DEFAULT 0,
+    cores_on_hand INT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX idx_parts_category (category)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Custom PC build orders and their component picklists
+CREATE TABLE IF NOT EXISTS build_orders (
+    order_id VARCHAR(50) PRIMARY KEY,
+    status ENUM('planning', 'assembling', 'burn_in', 'ready', 'invoiced') NOT NULL DEFAULT 'planning',
+    assembly_fee DECIMAL(10,2) NOT NULL DEFAULT 0,
+    checklist JSON NULL,
+    burn_in_passed BOOLEAN NULL,
+    burn_in_results JSON NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    invoiced_at TIMESTAMP NULL,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS build_components (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    part_sku VARCHAR(64) NOT NULL,
+    quantity INT NOT NULL,
+    unit_price DECIMAL(10,2) NOT NULL,
+    INDEX idx_build_components_order (order_id),
+    FOREIGN KEY (order_id) REFERENCES build_orders(order_id) ON DELETE CASCADE,
+    FOREIGN KEY (part_sku) REFERENCES parts(sku)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Trade-in valuation matrix and buyback purchases
+CREATE TABLE IF NOT EXISTS valuation_rules (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    model VARCHAR(255) NOT NULL,
+    max_age_months INT NOT NULL,
+    grade CHAR(1) NOT NULL,
+    offer DECIMAL(10,2) NOT NULL,
+    updated_by VARCHAR(50) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_valuation_rule (model, max_age_months, grade)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS buyback_purchases (
+    id VARCHAR(50) PRIMARY KEY,
+    customer_name VARCHAR(255) NOT NULL,
+    customer_phone VARCHAR(20) NOT NULL,
+    model VARCHAR(255) NOT NULL,
+    serial VARCHAR(100) NULL,
+    age_months INT NOT NULL,
+    grade CHAR(1) NOT NULL,
+    offer_amount DECIMAL(10,2) NOT NULL,
+    purchase_price DECIMAL(10,2) NOT NULL,
+    override_by VARCHAR(50) NULL,
+    override_reason VARCHAR(500) NULL,
+    resale_price DECIMAL(10,2) NULL,
+    resold_at TIMESTAMP NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_buyback_serial (serial),
+    INDEX idx_buyback_created (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Estimate options the customer compares and chooses from
+CREATE TABLE IF NOT EXISTS estimate_options (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    position INT NOT NULL,
+    label VARCHAR(100) NOT NULL,
+    description TEXT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    selected_at TIMESTAMP NULL,
+    selected_ip VARCHAR(45) NULL,
+    rejected_at TIMESTAMP NULL,
+    decided_by VARCHAR(50) NULL,
+    decision_note VARCHAR(500) NULL,
+    INDEX idx_estimate_options_order (order_id, position),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Line items proposed in an estimate option, billed once it is approved
+CREATE TABLE IF NOT EXISTS estimate_items (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    option_id BIGINT NOT NULL,
+    position INT NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    section VARCHAR(20) NULL,
+    warranty_kind VARCHAR(10) NULL,
+    warranty_days INT NOT NULL DEFAULT 0,
+    INDEX idx_estimate_items_option (option_id, position),
+    FOREIGN KEY (option_id) REFERENCES estimate_options(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS estimate_links (
+    token_hash CHAR(64) PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_estimate_links_order (order_id),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Print queue of receipts, labels and invoices with reprint history
+CREATE TABLE IF NOT EXISTS print_jobs (
+    id VARCHAR(50) PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    document ENUM('receipt', 'label', 'invoice', 'jobsheet') NOT NULL,
+    printer VARCHAR(100) NOT NULL,
+    status ENUM('queued', 'printed', 'failed') NOT NULL DEFAULT 'queued',
+    copy_number INT NOT NULL DEFAULT 1,
+    reprint_of VARCHAR(50) NULL,
+    reprint_reason VARCHAR(255) NULL,
+    error VARCHAR(500) NULL,
+    requested_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    printed_at TIMESTAMP NULL,
+    INDEX idx_print_jobs_order (order_id, document),
+    INDEX idx_print_jobs_queue (printer, status, created_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Ticket attachments, metered per ticket and per shop location
+CREATE TABLE IF NOT EXISTS attachments (
+    id VARCHAR(50) PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    location VARCHAR(50) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    storage_backend VARCHAR(20) NOT NULL DEFAULT 'local',
+    storage_path VARCHAR(500) NOT NULL,
+    uploaded_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_attachments_order (order_id),
+    INDEX idx_attachments_location (location),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- History of scheduled database maintenance runs
+CREATE TABLE IF NOT EXISTS maintenance_runs (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    task VARCHAR(50) NOT NULL,
+    trigger_source ENUM('schedule', 'manual') NOT NULL,
+    status ENUM('running', 'succeeded', 'failed') NOT NULL DEFAULT 'running',
+    rows_affected BIGINT NOT NULL DEFAULT 0,
+    detail TEXT NULL,
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP NULL,
+    INDEX idx_maintenance_runs_task (task, started_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ID prefixes claimed by each branch; a prefix can belong to only one branch and entity
+CREATE TABLE IF NOT EXISTS id_prefixes (
+    branch_code VARCHAR(10) NOT NULL,
+    entity VARCHAR(20) NOT NULL,
+    prefix VARCHAR(40) NOT NULL,
+    registered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (branch_code, entity),
+    UNIQUE KEY uniq_id_prefix (prefix)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Last issued sequence number per ID prefix
+CREATE TABLE IF NOT EXISTS id_sequences (
+    prefix VARCHAR(40) PRIMARY KEY,
+    last_value BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Customers; email_key/phone_key hold normalized values and are NULL on forced duplicates
+CREATE TABLE IF NOT EXISTS customers (
+    id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NULL,
+    phone VARCHAR(20) NULL,
+    email_key VARCHAR(255) NULL,
+    phone_key VARCHAR(20) NULL,
+    duplicate_of VARCHAR(50) NULL,
+    duplicate_reason VARCHAR(500) NULL,
+    preferred_language VARCHAR(10) NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_customers_email (email_key),
+    UNIQUE KEY uniq_customers_phone (phone_key),
+    INDEX idx_customers_email (email),
+    INDEX idx_customers_phone (phone)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Part, labor and outsourced costs recorded against tickets
+CREATE TABLE IF NOT EXISTS ticket_costs (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    kind ENUM('part', 'labor', 'outsourced') NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    part_sku VARCHAR(64) NULL,
+    part_serial VARCHAR(100) NULL,
+    part_lot VARCHAR(100) NULL,
+    quantity INT NOT NULL DEFAULT 1,
+    amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+    minutes INT NOT NULL DEFAULT 0,
+    engineer_id VARCHAR(50) NULL,
+    vendor VARCHAR(255) NULL,
+    recorded_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_ticket_costs_order (order_id),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Profitability of each collected ticket, fixed at closure
+CREATE TABLE IF NOT EXISTS ticket_profitability (
+    order_id VARCHAR(50) PRIMARY KEY,
+    revenue DECIMAL(10,2) NOT NULL,
+    part_cost DECIMAL(10,2) NOT NULL,
+    labor_minutes INT NOT NULL,
+    labor_rate DECIMAL(10,2) NOT NULL,
+    labor_cost DECIMAL(10,2) NOT NULL,
+    outsourced_cost DECIMAL(10,2) NOT NULL,
+    profit DECIMAL(10,2) NOT NULL,
+    closed_at TIMESTAMP NOT NULL,
+    computed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_ticket_profitability_closed (closed_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Customer emails sent, with their latest delivery state
+CREATE TABLE IF NOT EXISTS email_messages (
+    id VARCHAR(50) PRIMARY KEY,
+    order_id VARCHAR(50) NULL,
+    outbox_id BIGINT NULL,
+    recipient VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    provider VARCHAR(20) NOT NULL,
+    provider_message_id VARCHAR(255) NULL,
+    status ENUM('sent', 'deferred', 'delivered', 'bounced', 'complained', 'suppressed', 'failed') NOT NULL,
+    status_detail VARCHAR(500) NULL,
+    sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX idx_email_messages_order (order_id, sent_at),
+    INDEX idx_email_messages_provider (provider, provider_message_id),
+    UNIQUE KEY uniq_email_messages_outbox (outbox_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Delivery, bounce and complaint reports from the email provider
+CREATE TABLE IF NOT EXISTS email_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    message_id VARCHAR(50) NULL,
+    provider VARCHAR(20) NOT NULL,
+    recipient VARCHAR(255) NOT NULL,
+    event ENUM('delivered', 'deferred', 'bounced', 'complained') NOT NULL,
+    permanent BOOLEAN NOT NULL DEFAULT FALSE,
+    detail VARCHAR(500) NULL,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_email_events_message (message_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Addresses that hard-bounced or complained and are no longer mailed
+CREATE TABLE IF NOT EXISTS email_flags (
+    email_key VARCHAR(255) PRIMARY KEY,
+    reason ENUM('bounced', 'complained') NOT NULL,
+    detail VARCHAR(500) NULL,
+    message_id VARCHAR(50) NULL,
+    flagged_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Every status a ticket has passed through, for the order timeline
+CREATE TABLE IF NOT EXISTS ticket_status_history (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    event_version INT NOT NULL,
+    from_status VARCHAR(30) NULL,
+    to_status VARCHAR(30) NOT NULL,
+    changed_by VARCHAR(50) NULL,
+    note VARCHAR(500) NULL,
+    changed_at TIMESTAMP NOT NULL,
+    UNIQUE KEY uniq_status_history_event (order_id, event_version),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Texts received from customers and the replies they got
+CREATE TABLE IF NOT EXISTS sms_inbound (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    from_phone VARCHAR(20) NOT NULL,
+    body VARCHAR(1000) NOT NULL,
+    keyword VARCHAR(20) NOT NULL,
+    order_id VARCHAR(50) NULL,
+    reply VARCHAR(1000) NOT NULL,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_sms_inbound_phone (from_phone, received_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Per-location rules for requiring customer ID at intake
+CREATE TABLE IF NOT EXISTS id_policies (
+    location VARCHAR(50) PRIMARY KEY,
+    min_device_value DECIMAL(10,2) NOT NULL DEFAULT 0,
+    device_types VARCHAR(500) NULL,
+    retention_days INT NOT NULL DEFAULT 30,
+    updated_by VARCHAR(50) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Customer ID recorded at intake (masked number; the photo is purged after retention)
+CREATE TABLE IF NOT EXISTS ticket_identities (
+    order_id VARCHAR(50) PRIMARY KEY,
+    location VARCHAR(50) NOT NULL,
+    id_type VARCHAR(30) NOT NULL,
+    id_number_masked VARCHAR(30) NOT NULL,
+    declared_value DECIMAL(10,2) NULL,
+    photo_attachment_id VARCHAR(50) NULL,
+    photo_purged_at TIMESTAMP NULL,
+    verified_by VARCHAR(50) NULL,
+    verified_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_ticket_identities_purge (photo_purged_at, verified_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Stolen-device registry checks made at intake
+CREATE TABLE IF NOT EXISTS device_theft_checks (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NULL,
+    serial VARCHAR(100) NOT NULL,
+    result ENUM('clear', 'stolen', 'error') NOT NULL,
+    reference VARCHAR(100) NULL,
+    source VARCHAR(100) NULL,
+    checked_by VARCHAR(50) NULL,
+    checked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    overridden_by VARCHAR(50) NULL,
+    override_reason VARCHAR(500) NULL,
+    INDEX idx_device_theft_checks_serial (serial, checked_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Staff notes on tickets; customer-visible ones appear on the order tracker
+CREATE TABLE IF NOT EXISTS ticket_notes (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    author_id VARCHAR(50) NULL,
+    visibility ENUM('internal', 'customer') NOT NULL DEFAULT 'internal',
+    body TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NULL,
+    updated_by VARCHAR(50) NULL,
+    INDEX idx_ticket_notes_order (order_id, created_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Legal holds that keep a ticket's data from being deleted or purged
+CREATE TABLE IF NOT EXISTS legal_holds (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    reason VARCHAR(500) NOT NULL,
+    reference VARCHAR(100) NULL,
+    placed_by VARCHAR(50) NULL,
+    placed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    released_by VARCHAR(50) NULL,
+    released_at TIMESTAMP NULL,
+    release_reason VARCHAR(500) NULL,
+    INDEX idx_legal_holds_order (order_id, released_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Exports of ticket data and refused export attempts
+CREATE TABLE IF NOT EXISTS data_exports (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    export_type VARCHAR(50) NOT NULL,
+    format VARCHAR(10) NOT NULL,
+    user_id VARCHAR(50) NULL,
+    role VARCHAR(20) NULL,
+    api_key_id VARCHAR(50) NULL,
+    filters JSON NULL,
+    row_count INT NOT NULL DEFAULT 0,
+    allowed BOOLEAN NOT NULL,
+    ip_address VARCHAR(45) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_data_exports_user (user_id, created_at),
+    INDEX idx_data_exports_created (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Every change to part stock and core counts
+CREATE TABLE IF NOT EXISTS stock_movements (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    part_sku VARCHAR(64) NOT NULL,
+    bucket ENUM('stock', 'cores') NOT NULL DEFAULT 'stock',
+    quantity INT NOT NULL,
+    reason VARCHAR(30) NOT NULL,
+    unit_cost DECIMAL(10,2) NOT NULL DEFAULT 0,
+    lot VARCHAR(100) NULL,
+    order_id VARCHAR(50) NULL,
+    core_id BIGINT NULL,
+    note VARCHAR(500) NULL,
+    actor_id VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_stock_movements_part (part_sku, created_at),
+    INDEX idx_stock_movements_reason (reason, created_at),
+    INDEX idx_stock_movements_lot (part_sku, lot),
+    FOREIGN KEY (part_sku) REFERENCES parts(sku)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Defective parts pulled from customer devices for vendor return credits
+CREATE TABLE IF NOT EXISTS part_cores (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    part_sku VARCHAR(64) NOT NULL,
+    serial VARCHAR(100) NULL,
+    notes VARCHAR(500) NULL,
+    status ENUM('held', 'returned', 'credited', 'rejected') NOT NULL DEFAULT 'held',
+    vendor_reference VARCHAR(100) NULL,
+    credit_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+    engineer_id VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    returned_at TIMESTAMP NULL,
+    resolved_at TIMESTAMP NULL,
+    resolved_by VARCHAR(50) NULL,
+    INDEX idx_part_cores_status (status),
+    INDEX idx_part_cores_order (order_id),
+    FOREIGN KEY (order_id) REFERENCES orders(id),
+    FOREIGN KEY (part_sku) REFERENCES parts(sku)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Stock written down to lower supplier prices
+CREATE TABLE IF NOT EXISTS inventory_revaluations (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    part_sku VARCHAR(64) NOT NULL,
+    quantity INT NOT NULL,
+    old_unit_cost DECIMAL(10,2) NOT NULL,
+    new_unit_cost DECIMAL(10,2) NOT NULL,
+    value_change DECIMAL(12,2) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_inventory_revaluations_created (created_at),
+    FOREIGN KEY (part_sku) REFERENCES parts(sku)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Periods tickets spent on hold (Awaiting Parts, Awaiting Customer Approval)
+CREATE TABLE IF NOT EXISTS ticket_holds (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    hold_state VARCHAR(30) NOT NULL,
+    reason VARCHAR(500) NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    started_by VARCHAR(50) NULL,
+    released_at TIMESTAMP NULL,
+    released_by VARCHAR(50) NULL,
+    INDEX idx_ticket_holds_order (order_id, started_at),
+    INDEX idx_ticket_holds_started (started_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Devices brought in on a ticket; position 1 mirrors the orders device columns
+CREATE TABLE IF NOT EXISTS ticket_devices (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    position INT NOT NULL,
+    device_type VARCHAR(255) NOT NULL,
+    device_model VARCHAR(255) NULL,
+    device_serial VARCHAR(100) NULL,
+    note VARCHAR(255) NULL,
+    UNIQUE KEY uniq_ticket_device_position (order_id, position),
+    INDEX idx_ticket_devices_serial (device_serial),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Recalls of faulty parts and the tickets they cover
+CREATE TABLE IF NOT EXISTS recall_campaigns (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    title VARCHAR(255) NOT NULL,
+    message TEXT NOT NULL,
+    part_sku VARCHAR(64) NOT NULL,
+    lot VARCHAR(100) NULL,
+    serial_from VARCHAR(100) NULL,
+    serial_to VARCHAR(100) NULL,
+    fitted_from TIMESTAMP NULL,
+    fitted_to TIMESTAMP NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (part_sku) REFERENCES parts(sku)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS recall_tickets (
+    recall_id BIGINT NOT NULL,
+    order_id VARCHAR(50) NOT NULL,
+    notified TINYINT(1) NOT NULL DEFAULT 0,
+    response ENUM('pending', 'accepted', 'declined', 'unreachable') NOT NULL DEFAULT 'pending',
+    responded_at TIMESTAMP NULL,
+    rebooked_order_id VARCHAR(50) NULL,
+    updated_by VARCHAR(50) NULL,
+    PRIMARY KEY (recall_id, order_id),
+    INDEX idx_recall_tickets_order (order_id),
+    FOREIGN KEY (recall_id) REFERENCES recall_campaigns(id) ON DELETE CASCADE,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Supplier lots of received parts, counted down as stock leaves
+CREATE TABLE IF NOT EXISTS part_lots (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    part_sku VARCHAR(64) NOT NULL,
+    lot VARCHAR(100) NOT NULL,
+    supplier VARCHAR(255) NULL,
+    reference VARCHAR(255) NULL,
+    quantity_received INT NOT NULL DEFAULT 0,
+    quantity_remaining INT NOT NULL DEFAULT 0,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_part_lot (part_sku, lot),
+    FOREIGN KEY (part_sku) REFERENCES parts(sku)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Free-form ticket labels such as "rush" or "water-damage"
+CREATE TABLE IF NOT EXISTS ticket_tags (
+    order_id VARCHAR(50) NOT NULL,
+    tag VARCHAR(40) NOT NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (order_id, tag),
+    INDEX idx_ticket_tags_tag (tag),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Shop-defined fields on tickets, devices and customers
+CREATE TABLE IF NOT EXISTS custom_fields (
+    scope ENUM('ticket', 'device', 'customer') NOT NULL,
+    field_key VARCHAR(50) NOT NULL,
+    label VARCHAR(100) NOT NULL,
+    field_type ENUM('text', 'number', 'date', 'dropdown') NOT NULL,
+    options JSON NULL,
+    required BOOLEAN NOT NULL DEFAULT FALSE,
+    position INT NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_by VARCHAR(50) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, field_key)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Custom field values; device values belong to a ticket_devices row
+CREATE TABLE IF NOT EXISTS custom_field_values (
+    scope ENUM('ticket', 'device', 'customer') NOT NULL,
+    entity_id VARCHAR(50) NOT NULL,
+    field_key VARCHAR(50) NOT NULL,
+    value VARCHAR(1000) NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, entity_id, field_key),
+    INDEX idx_custom_field_values_key (scope, field_key, value(100))
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Staff certifications with their expiry and the last reminder sent
+CREATE TABLE IF NOT EXISTS staff_certifications (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id VARCHAR(50) NOT NULL,
+    certification VARCHAR(100) NOT NULL,
+    credential_id VARCHAR(100) NULL,
+    issued_on DATE NULL,
+    expires_on DATE NULL,
+    reminder_stage ENUM('expiring', 'expired') NULL,
+    updated_by VARCHAR(50) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_staff_certification (user_id, certification),
+    INDEX idx_staff_certifications_expiry (expires_on),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Walk-in queue tokens, numbered per day
+CREATE TABLE IF NOT EXISTS lobby_tokens (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    token_number INT NOT NULL,
+    reason VARCHAR(100) NULL,
+    customer_name VARCHAR(255) NULL,
+    status ENUM('waiting', 'called', 'served', 'abandoned') NOT NULL DEFAULT 'waiting',
+    issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    called_at TIMESTAMP NULL,
+    called_by VARCHAR(50) NULL,
+    closed_at TIMESTAMP NULL,
+    closed_by VARCHAR(50) NULL,
+    order_id VARCHAR(50) NULL,
+    INDEX idx_lobby_tokens_issued (issued_at),
+    INDEX idx_lobby_tokens_status (status)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Corporate accounts on contract
+CREATE TABLE IF NOT EXISTS corporate_accounts (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    contact_name VARCHAR(255) NULL,
+    contact_email VARCHAR(255) NULL,
+    contract_reference VARCHAR(100) NULL,
+    contract_start DATE NULL,
+    contract_end DATE NULL,
+    payment_terms_days INT NOT NULL DEFAULT 30,
+    response_hours INT NULL,
+    resolution_hours INT NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_corporate_accounts_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Customer ratings of collected tickets
+CREATE TABLE IF NOT EXISTS ticket_ratings (
+    order_id VARCHAR(50) PRIMARY KEY,
+    score TINYINT NOT NULL,
+    comment VARCHAR(1000) NULL,
+    recorded_by VARCHAR(50) NULL,
+    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_ticket_ratings_recorded (recorded_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Quotes issued before a ticket exists, numbered with their own prefix
+CREATE TABLE IF NOT EXISTS quotes (
+    id VARCHAR(50) PRIMARY KEY,
+    customer_name VARCHAR(255) NOT NULL,
+    customer_email VARCHAR(255) NULL,
+    customer_phone VARCHAR(20) NULL,
+    device_type VARCHAR(100) NOT NULL,
+    device_model VARCHAR(255) NULL,
+    device_serial VARCHAR(100) NULL,
+    issue_description TEXT NULL,
+    total DECIMAL(10,2) NOT NULL,
+    valid_until DATE NOT NULL,
+    status ENUM('open', 'converted') NOT NULL DEFAULT 'open',
+    converted_order_id VARCHAR(50) NULL,
+    converted_by VARCHAR(50) NULL,
+    converted_at TIMESTAMP NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_quotes_status (status, valid_until),
+    INDEX idx_quotes_created (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Proposed line items of a quote, billed on the ticket it converts to
+CREATE TABLE IF NOT EXISTS quote_items (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    quote_id VARCHAR(50) NOT NULL,
+    position INT NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    section VARCHAR(20) NULL,
+    warranty_kind VARCHAR(10) NULL,
+    warranty_days INT NOT NULL DEFAULT 0,
+    INDEX idx_quote_items_quote (quote_id, position),
+    FOREIGN KEY (quote_id) REFERENCES quotes(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Customer signatures on tickets, stored as PNG
+CREATE TABLE IF NOT EXISTS ticket_signatures (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    kind ENUM('intake_terms', 'delivery_ack') NOT NULL,
+    signer_name VARCHAR(255) NOT NULL,
+    image MEDIUMBLOB NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    ip_address VARCHAR(45) NULL,
+    recorded_by VARCHAR(50) NULL,
+    signed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_ticket_signatures_order (order_id, signed_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Check-in checklist templates per device type
+CREATE TABLE IF NOT EXISTS checklist_templates (
+    device_type VARCHAR(100) PRIMARY KEY,
+    items JSON NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_by VARCHAR(50) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+INSERT IGNORE INTO checklist_templates (device_type, items) VALUES
+('default', JSON_ARRAY('Physical condition', 'Powers on')),
+('Laptop', JSON_ARRAY('Screen condition', 'Dents or cracks on the case', 'Powers on', 'Battery present', 'Keyboard and touchpad work', 'Charger included')),
+('Desktop', JSON_ARRAY('Case condition', 'Powers on', 'Side panels and screws present')),
+('Phone', JSON_ARRAY('Screen condition', 'Dents or cracks on the body', 'Powers on', 'Battery present', 'SIM tray present')),
+('Tablet', JSON_ARRAY('Screen condition', 'Dents or cracks on the body', 'Powers on', 'Battery present'));
+
+-- Check-in checklist results per ticket device, at intake and at delivery
+CREATE TABLE IF NOT EXISTS ticket_checklist_items (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    device_position INT NOT NULL,
+    stage ENUM('intake', 'delivery') NOT NULL,
+    position INT NOT NULL,
+    item VARCHAR(255) NOT NULL,
+    result ENUM('pass', 'fail', 'na') NOT NULL,
+    notes VARCHAR(500) NULL,
+    recorded_by VARCHAR(50) NULL,
+    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_ticket_checklist_item (order_id, device_position, stage, position),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Engineers' diagnostic reports, one row per version
+CREATE TABLE IF NOT EXISTS ticket_diagnoses (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    version INT NOT NULL,
+    findings TEXT NOT NULL,
+    root_cause TEXT NULL,
+    recommended_actions TEXT NULL,
+    parts_needed JSON NULL,
+    created_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP NULL,
+    published_by VARCHAR(50) NULL,
+    UNIQUE KEY uniq_ticket_diagnoses_version (order_id, version),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Voice notes recorded on tickets, transcribed into ticket notes
+CREATE TABLE IF NOT EXISTS ticket_voice_notes (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    attachment_id VARCHAR(50) NOT NULL,
+    duration_seconds INT NOT NULL,
+    transcription ENUM('off', 'pending', 'done', 'failed') NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    note_id BIGINT NULL,
+    recorded_by VARCHAR(50) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_voice_notes_order (order_id, created_at),
+    INDEX idx_voice_notes_transcription (transcription),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+    FOREIGN KEY (attachment_id) REFERENCES attachments(id) ON DELETE CASCADE,
+    FOREIGN KEY (note_id) REFERENCES ticket_notes(id) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- When each user last marked their note mentions read
+CREATE TABLE IF NOT EXISTS mention_reads (
+    user_id VARCHAR(50) PRIMARY KEY,
+    read_at TIMESTAMP NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Reports emailed to managers on a schedule
+CREATE TABLE IF NOT EXISTS report_subscriptions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id VARCHAR(50) NOT NULL,
+    report VARCHAR(50) NOT NULL,
+    filters JSON NULL,
+    frequency ENUM('daily', 'weekly', 'monthly') NOT NULL,
+    next_run_at TIMESTAMP NOT NULL,
+    last_sent_at TIMESTAMP NULL,
+    last_error VARCHAR(500) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_report_subscriptions_due (next_run_at),
+    INDEX idx_report_subscriptions_user (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Rules that escalate tickets stuck in a status or past their SLA
+CREATE TABLE IF NOT EXISTS escalation_rules (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    status VARCHAR(30) NULL,
+    hours_in_status INT NOT NULL DEFAULT 0,
+    overdue BOOLEAN NOT NULL DEFAULT FALSE,
+    priority VARCHAR(10) NULL,
+    notify BOOLEAN NOT NULL DEFAULT TRUE,
+    notify_user_id VARCHAR(50) NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_by VARCHAR(50) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (notify_user_id) REFERENCES users(id) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Escalations applied to each ticket, projected from TicketEscalated events
+CREATE TABLE IF NOT EXISTS ticket_escalations (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    rule_id BIGINT NOT NULL,
+    event_version INT NOT NULL,
+    escalated_at TIMESTAMP NOT NULL,
+    INDEX idx_ticket_escalations_rule (order_id, rule_id, escalated_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Every move of a ticket's expected delivery date, with its reason
+CREATE TABLE IF NOT EXISTS ticket_delivery_date_changes (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    event_version INT NOT NULL,
+    from_date DATE NULL,
+    to_date DATE NOT NULL,
+    reason VARCHAR(500) NOT NULL,
+    changed_by VARCHAR(50) NULL,
+    changed_at TIMESTAMP NOT NULL,
+    UNIQUE KEY uniq_delivery_date_change_event (order_id, event_version),
+    INDEX idx_delivery_date_changes_changed (changed_at),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Staff who have marked themselves away (presence is otherwise session activity)
+CREATE TABLE IF NOT EXISTS staff_presence (
+    user_id VARCHAR(50) PRIMARY KEY,
+    away_note VARCHAR(200) NOT NULL,
+    away_since TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Tickets staff have snoozed until a follow-up time, one snooze per user
+CREATE TABLE IF NOT EXISTS ticket_snoozes (
+    order_id VARCHAR(50) NOT NULL,
+    user_id VARCHAR(50) NOT NULL,
+    snoozed_until TIMESTAMP NOT NULL,
+    note VARCHAR(500) NOT NULL,
+    snoozed_at TIMESTAMP NOT NULL,
+    reminded_at TIMESTAMP NULL,
+    PRIMARY KEY (order_id, user_id),
+    INDEX idx_ticket_snoozes_user (user_id, snoozed_until),
+    INDEX idx_ticket_snoozes_due (reminded_at, snoozed_until),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Staff watching a ticket, emailed on its status changes and new notes
+CREATE TABLE IF NOT EXISTS ticket_watchers (
+    order_id VARCHAR(50) NOT NULL,
+    user_id VARCHAR(50) NOT NULL,
+    watched_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (order_id, user_id),
+    INDEX idx_ticket_watchers_user (user_id),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Engineers' running ticket timers, one per engineer
+CREATE TABLE IF NOT EXISTS ticket_timers (
+    user_id VARCHAR(50) PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    note VARCHAR(255) NULL,
+    started_at TIMESTAMP NOT NULL,
+    INDEX idx_ticket_timers_order (order_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Stocktake (cycle count) sessions
+CREATE TABLE IF NOT EXISTS stocktakes (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    category VARCHAR(30) NULL,
+    status ENUM('open', 'posted', 'cancelled') NOT NULL DEFAULT 'open',
+    opened_by VARCHAR(50) NULL,
+    opened_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    closed_by VARCHAR(50) NULL,
+    closed_at TIMESTAMP NULL,
+    INDEX idx_stocktakes_status (status, opened_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Parts counted in each stocktake, against the book quantity when counted
+CREATE TABLE IF NOT EXISTS stocktake_counts (
+    stocktake_id BIGINT NOT NULL,
+    part_sku VARCHAR(64) NOT NULL,
+    counted INT NOT NULL,
+    book_quantity INT NOT NULL,
+    adjustment INT NULL,
+    counted_by VARCHAR(50) NULL,
+    counted_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (stocktake_id, part_sku),
+    FOREIGN KEY (stocktake_id) REFERENCES stocktakes(id) ON DELETE CASCADE,
+    FOREIGN KEY (part_sku) REFERENCES parts(sku)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Insert the admin user without a password; the server sets it from
+-- ADMIN_BOOTSTRAP_PASSWORD on first start and refuses to start without one
 INSERT IGNORE INTO users (id, full_name, email, phone, password, role, created_at, updated_at) 
-VALUES ('ADMIN-001', 'System Administrator', 'admin@pchub.com', '+91 98765 43210', 'admin123', 'Administrator', NOW(), NOW());
+VALUES ('ADMIN-001', 'System Administrator', 'admin@pchub.com', '+91 98765 43210', '', 'Admin', NOW(), NOW());
 
 -- Insert sample regular user
 INSERT IGNORE INTO users (id, full_name, email, phone, password, role, created_at, updated_at) 
-VALUES ('USER-001', 'John Doe', 'john@example.com', '+91 87654 32109', 'password123', 'User', NOW(), NOW());
+VALUES ('USER-001', 'John Doe', 'john@example.com', '+91 87654 32109', 'password123', 'FrontDesk', NOW(), NOW());
 
 -- Insert sample orders
 INSERT IGNORE INTO orders (id, customer_name, customer_email, customer_phone, device_type, device_model, services, issue_description, status, total_cost, created_by, created_at, updated_at, last_updated_by) 
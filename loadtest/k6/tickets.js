@@ -0,0 +1,61 @@
+// Ticket intake and listing under load.
+//
+//   k6 run -e BASE_URL=http://localhost:8080 -e API_KEY=... loadtest/k6/tickets.js
+//
+// API_KEY needs the orders:create and orders:read scopes. Seed the database
+// first (./main seed-loadtest 50000) so GetAllOrders reads a realistic table.
+import http from 'k6/http';
+import { check } from 'k6';
+
+const baseURL = __ENV.BASE_URL || 'http://localhost:8080';
+const headers = {
+  'Content-Type': 'application/json',
+  'X-API-Key': __ENV.API_KEY,
+};
+
+export const options = {
+  scenarios: {
+    intake: {
+      executor: 'constant-arrival-rate',
+      exec: 'createTicket',
+      rate: Number(__ENV.CREATE_RATE || 20),
+      timeUnit: '1s',
+      duration: __ENV.DURATION || '5m',
+      preAllocatedVUs: 20,
+      maxVUs: 100,
+    },
+    listing: {
+      executor: 'constant-arrival-rate',
+      exec: 'listOrders',
+      rate: Number(__ENV.LIST_RATE || 5),
+      timeUnit: '1s',
+      duration: __ENV.DURATION || '5m',
+      preAllocatedVUs: 10,
+      maxVUs: 50,
+    },
+  },
+  thresholds: {
+    'http_req_failed': ['rate<0.01'],
+    'http_req_duration{scenario:intake}': ['p(95)<300'],
+    'http_req_duration{scenario:listing}': ['p(95)<1500'],
+  },
+};
+
+export function createTicket() {
+  const n = Math.floor(Math.random() * 1e9);
+  const body = JSON.stringify({
+    customer_name: `Load Test ${n}`,
+    customer_email: `loadtest+${n}@example.com`,
+    customer_phone: `9${String(n).padStart(9, '0')}`,
+    device_type: 'Laptop',
+    services: ['Diagnostics'],
+    total_cost: '499.00',
+  });
+  const res = http.post(`${baseURL}/api/v1/orders/create`, body, { headers });
+  check(res, { 'ticket created': (r) => r.status === 201 });
+}
+
+export function listOrders() {
+  const res = http.get(`${baseURL}/api/v1/orders`, { headers });
+  check(res, { 'orders listed': (r) => r.status === 200 });
+}
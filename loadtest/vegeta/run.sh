@@ -0,0 +1,35 @@
+#!/bin/sh
+# Constant-rate attack on ticket intake and listing with vegeta.
+#
+#   API_KEY=... RATE=30 DURATION=2m loadtest/vegeta/run.sh
+#
+# API_KEY needs the orders:create and orders:read scopes.
+set -eu
+
+BASE_URL=${BASE_URL:-http://localhost:8080}
+RATE=${RATE:-25}
+DURATION=${DURATION:-2m}
+DIR=$(cd "$(dirname "$0")" && pwd)
+
+: "${API_KEY:?set API_KEY to a key with orders:create and orders:read}"
+
+# Four intakes for every listing
+targets=$(mktemp)
+trap 'rm -f "$targets"' EXIT
+for i in 1 2 3 4; do
+	cat >>"$targets" <<TARGET
+POST $BASE_URL/api/v1/orders/create
+Content-Type: application/json
+X-API-Key: $API_KEY
+@$DIR/create-ticket.json
+
+TARGET
+done
+cat >>"$targets" <<TARGET
+GET $BASE_URL/api/v1/orders
+X-API-Key: $API_KEY
+
+TARGET
+
+vegeta attack -targets="$targets" -rate="$RATE" -duration="$DURATION" | tee results.bin | vegeta report
+vegeta report -type='hist[0,50ms,100ms,250ms,500ms,1s,2s]' results.bin